@@ -0,0 +1,217 @@
+// Package cleanup exposes the clean-up engine of the controller to programs
+// embedding it, such as other operators, so that they don't need to run the
+// standalone binary.
+package cleanup
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+
+	"github.com/danielfm/kube-ecr-cleanup-controller/core"
+)
+
+// Maximum number of images deleted in a single request, between which the
+// context of `Engine.DeleteImages` is checked.
+const deleteBatchSize = 100
+
+// Engine defines the expected interface of any object capable of running
+// clean-up passes, along with the steps they are made of.
+type Engine interface {
+	// ListImages returns the images of the given repository of the given
+	// region.
+	ListImages(ctx context.Context, region, repository string) ([]*ecr.ImageDetail, error)
+
+	// FilterOldUnusedImages returns the images from the given list that are
+	// not in use by the given tags or digests and exceed the keepMax most
+	// recent ones, oldest first.
+	FilterOldUnusedImages(keepMax int, images []*ecr.ImageDetail, tagsInUse []string) []*ecr.ImageDetail
+
+	// DeleteImages deletes the given images from the given region.
+	DeleteImages(ctx context.Context, region string, images []*ecr.ImageDetail) error
+
+	// Run runs a whole clean-up pass and returns its outcome.
+	Run(ctx context.Context) (*Result, error)
+}
+
+// Result is the outcome of a clean-up pass.
+type Result struct {
+	// Random identifier of the pass, as found in the logs and audit records.
+	ReconcileID string
+
+	// Whether the pass was skipped because another one was still running.
+	Skipped bool
+
+	RepositoriesProcessed int
+	ImagesInUse           int
+
+	// Images deleted by the pass.
+	Deleted []core.PlanImage
+
+	// Images that would have been deleted if not for a dry run.
+	WouldDelete []core.PlanImage
+
+	// Images selected for deletion but kept, such as the ones quarantined or
+	// that could not be deleted.
+	Kept []core.PlanImage
+
+	// Number of images retained by the retention rules, by reason, such as
+	// `core.RetainReasonInUse`.
+	Retained map[string]int
+
+	// Number of bytes taken up by the deleted images, as far as their sizes
+	// are known.
+	BytesDeleted int64
+
+	// Errors found along the way.
+	Errors []error
+
+	// Full outcome of the pass, as reported by the task.
+	Reconcile *core.ReconcileResult
+}
+
+// Failed tells whether any errors were found during the pass.
+func (r *Result) Failed() bool {
+	return r.Reconcile.Failed()
+}
+
+// NewResult returns the outcome of the given pass.
+func NewResult(reconcile *core.ReconcileResult) *Result {
+	result := &Result{
+		ReconcileID:           reconcile.ReconcileID,
+		Skipped:               reconcile.Skipped,
+		RepositoriesProcessed: reconcile.RepositoriesProcessed,
+		ImagesInUse:           reconcile.ImagesInUse,
+		Deleted:               []core.PlanImage{},
+		WouldDelete:           []core.PlanImage{},
+		Kept:                  []core.PlanImage{},
+		Retained:              reconcile.ImagesRetained,
+		BytesDeleted:          reconcile.BytesDeleted,
+		Errors:                reconcile.Errors,
+		Reconcile:             reconcile,
+	}
+
+	if reconcile.Plan == nil {
+		return result
+	}
+
+	for _, image := range reconcile.Plan.Images {
+		switch image.Action {
+		case core.PlanActionDeleted:
+			result.Deleted = append(result.Deleted, image)
+		case core.PlanActionWouldDelete:
+			result.WouldDelete = append(result.WouldDelete, image)
+		case core.PlanActionRetained:
+			result.Kept = append(result.Kept, image)
+		}
+	}
+
+	return result
+}
+
+type EngineImpl struct {
+	// Task holding the retention rules and safety settings of the passes.
+	Task *core.CleanupTask
+
+	KubeClient core.KubernetesClient
+	ECRClients []core.RegionalECRClient
+}
+
+// NewEngine returns a new engine running the passes of the given task, after
+// performing its startup checks and creating its clients.
+func NewEngine(task *core.CleanupTask) (*EngineImpl, error) {
+	kubeClient, ecrClients, err := task.NewClients()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewEngineWithClients(task, kubeClient, ecrClients), nil
+}
+
+// NewEngineWithClients returns a new engine running the passes of the given
+// task with the given clients, such as clients configured by the embedding
+// program.
+func NewEngineWithClients(task *core.CleanupTask, kubeClient core.KubernetesClient, ecrClients []core.RegionalECRClient) *EngineImpl {
+	return &EngineImpl{
+		Task:       task,
+		KubeClient: kubeClient,
+		ECRClients: ecrClients,
+	}
+}
+
+// ecrClient returns the ECR client of the given region.
+func (e *EngineImpl) ecrClient(region string) (core.ECRClient, error) {
+	for _, regional := range e.ECRClients {
+		if regional.Region == region {
+			return regional.Client, nil
+		}
+	}
+	return nil, fmt.Errorf("No ECR client for '%s' region", region)
+}
+
+// ListImages returns the images of the given repository of the given region.
+func (e *EngineImpl) ListImages(ctx context.Context, region, repository string) ([]*ecr.ImageDetail, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ecrClient, err := e.ecrClient(region)
+	if err != nil {
+		return nil, err
+	}
+
+	return ecrClient.ListImages(&repository)
+}
+
+// FilterOldUnusedImages returns the images from the given list that are not
+// in use by the given tags or digests and exceed the keepMax most recent
+// ones, oldest first.
+func (e *EngineImpl) FilterOldUnusedImages(keepMax int, images []*ecr.ImageDetail, tagsInUse []string) []*ecr.ImageDetail {
+	return core.FilterOldUnusedImages(keepMax, images, tagsInUse)
+}
+
+// DeleteImages deletes the given images from the given region in batches,
+// stopping before the next batch once the given context is done. Nothing is
+// deleted if the task is a dry run.
+func (e *EngineImpl) DeleteImages(ctx context.Context, region string, images []*ecr.ImageDetail) error {
+	if e.Task.DryRun {
+		return fmt.Errorf("Cannot delete images in a dry run")
+	}
+
+	ecrClient, err := e.ecrClient(region)
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(images); start += deleteBatchSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		end := start + deleteBatchSize
+		if end > len(images) {
+			end = len(images)
+		}
+
+		if err := ecrClient.DeleteImages(images[start:end]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run runs a whole clean-up pass with the retention rules of the task, which
+// stops before the next repository once the given context is done, in which
+// case the outcome of the pass so far is returned along with the context
+// error.
+func (e *EngineImpl) Run(ctx context.Context) (*Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	result := NewResult(e.Task.ReconcileRegionsContext(ctx, e.KubeClient, e.ECRClients))
+
+	return result, ctx.Err()
+}
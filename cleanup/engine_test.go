@@ -0,0 +1,249 @@
+package cleanup
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"k8s.io/client-go/pkg/api/v1"
+	batchv1 "k8s.io/client-go/pkg/apis/batch/v1"
+	batchv2alpha1 "k8s.io/client-go/pkg/apis/batch/v2alpha1"
+	extensionsv1beta1 "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+
+	"github.com/danielfm/kube-ecr-cleanup-controller/core"
+)
+
+// fakeKubeClient is a cluster without any workloads.
+type fakeKubeClient struct{}
+
+func (f *fakeKubeClient) ListAllPods(namespace []*string) ([]*v1.Pod, error) {
+	return []*v1.Pod{}, nil
+}
+
+func (f *fakeKubeClient) ListEphemeralContainerImages(namespace []*string) ([]string, error) {
+	return []string{}, nil
+}
+
+func (f *fakeKubeClient) ListJobs(namespace []*string) ([]*batchv1.Job, error) {
+	return []*batchv1.Job{}, nil
+}
+
+func (f *fakeKubeClient) ListCronJobs(namespace []*string) ([]*batchv2alpha1.CronJob, error) {
+	return []*batchv2alpha1.CronJob{}, nil
+}
+
+func (f *fakeKubeClient) ListReplicaSets(namespace []*string) ([]*extensionsv1beta1.ReplicaSet, error) {
+	return []*extensionsv1beta1.ReplicaSet{}, nil
+}
+
+func (f *fakeKubeClient) ListControllerRevisionImages(namespace []*string) ([]string, error) {
+	return []string{}, nil
+}
+
+func (f *fakeKubeClient) ListCustomWorkloadImages(workload core.CustomWorkload, namespace []*string) ([]string, error) {
+	return []string{}, nil
+}
+
+func (f *fakeKubeClient) ListHelmReleaseSecrets(namespace []*string) ([]*v1.Secret, error) {
+	return []*v1.Secret{}, nil
+}
+
+func (f *fakeKubeClient) ListNodes() ([]*v1.Node, error) {
+	return []*v1.Node{}, nil
+}
+
+func (f *fakeKubeClient) GetConfigMap(namespace, name string) (*v1.ConfigMap, error) {
+	return nil, nil
+}
+
+func (f *fakeKubeClient) NamespaceExists(name string) (bool, error) {
+	return true, nil
+}
+
+func (f *fakeKubeClient) ListNamespaces() ([]string, error) {
+	return []string{"namespace"}, nil
+}
+
+func (f *fakeKubeClient) ListCleanupPolicies() ([]*core.CleanupPolicy, error) {
+	return []*core.CleanupPolicy{}, nil
+}
+
+// fakeECRClient is a registry holding a single repository, which records the
+// batches of images deleted from it.
+type fakeECRClient struct {
+	repoName string
+	images   []*ecr.ImageDetail
+
+	deleted [][]*ecr.ImageDetail
+}
+
+func (f *fakeECRClient) ListRepositories(repositoryNames []*string) ([]*ecr.Repository, error) {
+	return []*ecr.Repository{{RepositoryName: &f.repoName}}, nil
+}
+
+func (f *fakeECRClient) ListAllRepositories() ([]*ecr.Repository, error) {
+	return f.ListRepositories(nil)
+}
+
+func (f *fakeECRClient) ListImages(repositoryName *string) ([]*ecr.ImageDetail, error) {
+	if *repositoryName != f.repoName {
+		return nil, fmt.Errorf("Repository '%s' not found", *repositoryName)
+	}
+	return f.images, nil
+}
+
+func (f *fakeECRClient) DeleteImages(images []*ecr.ImageDetail) error {
+	f.deleted = append(f.deleted, images)
+	return nil
+}
+
+func (f *fakeECRClient) ListManifestListChildren(repositoryName *string, images []*ecr.ImageDetail) (map[string][]string, error) {
+	return map[string][]string{}, nil
+}
+
+func (f *fakeECRClient) TagImages(repositoryName *string, tags map[string]string) error {
+	return nil
+}
+
+func (f *fakeECRClient) GetImageManifests(repositoryName *string, images []*ecr.ImageDetail) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (f *fakeECRClient) Ping() error {
+	return nil
+}
+
+// nopLogger discards all messages.
+type nopLogger struct{}
+
+func (l nopLogger) Infof(format string, args ...interface{})    {}
+func (l nopLogger) Warningf(format string, args ...interface{}) {}
+func (l nopLogger) Errorf(format string, args ...interface{})   {}
+
+func newTestEngine(imageCount int, dryRun bool) (*EngineImpl, *fakeECRClient) {
+	repoName, namespace := "repo", "namespace"
+
+	ecrClient := &fakeECRClient{repoName: repoName}
+	for i := 0; i < imageCount; i++ {
+		digest, pushedAt := fmt.Sprintf("digest-%d", i), time.Unix(int64(i), 0)
+		ecrClient.images = append(ecrClient.images, &ecr.ImageDetail{ImageDigest: &digest, ImagePushedAt: &pushedAt})
+	}
+
+	task := core.NewCleanupTask()
+	task.KubeNamespaces = []*string{&namespace}
+	task.EcrRepositories = []*string{&repoName}
+	task.MaxImages = 1
+	task.DryRun = dryRun
+	task.Logger = nopLogger{}
+
+	return NewEngineWithClients(task, &fakeKubeClient{}, []core.RegionalECRClient{{Region: task.AwsRegion, Client: ecrClient}}), ecrClient
+}
+
+func TestEngineRun(t *testing.T) {
+	testCases := []struct {
+		dryRun              bool
+		expectedDeleted     int
+		expectedWouldDelete int
+	}{
+		{dryRun: false, expectedDeleted: 2},
+		{dryRun: true, expectedWouldDelete: 2},
+	}
+
+	for _, testCase := range testCases {
+		engine, ecrClient := newTestEngine(3, testCase.dryRun)
+
+		result, err := engine.Run(context.Background())
+		if err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+
+		if result.Failed() {
+			t.Errorf("Expected the pass to succeed, but got errors %q", result.Errors)
+		}
+
+		if len(result.Deleted) != testCase.expectedDeleted || len(result.WouldDelete) != testCase.expectedWouldDelete {
+			t.Errorf("Expected %d images to be deleted and %d images that would be deleted with dry run %t, but got %d and %d", testCase.expectedDeleted, testCase.expectedWouldDelete, testCase.dryRun, len(result.Deleted), len(result.WouldDelete))
+		}
+
+		if deleted := len(ecrClient.deleted) > 0; deleted == testCase.dryRun {
+			t.Errorf("Expected images to be deleted from ECR to be %t with dry run %t", !testCase.dryRun, testCase.dryRun)
+		}
+
+		if result.Retained[core.RetainReasonKeepMax] != 1 {
+			t.Errorf("Expected 1 image to be retained by -max-images, but got %d", result.Retained[core.RetainReasonKeepMax])
+		}
+	}
+}
+
+func TestEngineRunCanceled(t *testing.T) {
+	engine, ecrClient := newTestEngine(3, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := engine.Run(ctx); err != context.Canceled {
+		t.Errorf("Expected the pass to be canceled, but got %v", err)
+	}
+
+	if len(ecrClient.deleted) != 0 {
+		t.Errorf("Expected no images to be deleted, but got %v", ecrClient.deleted)
+	}
+}
+
+func TestEngineListAndFilterImages(t *testing.T) {
+	engine, _ := newTestEngine(3, false)
+
+	images, err := engine.ListImages(context.Background(), "us-east-1", "repo")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	// digest-0 is in use, and counts against the images to keep along with
+	// digest-2, the most recent one
+	filtered := engine.FilterOldUnusedImages(2, images, []string{"digest-0"})
+	if len(filtered) != 1 || *filtered[0].ImageDigest != "digest-1" {
+		t.Errorf("Expected only digest-1 to be selected, but got %+v", filtered)
+	}
+
+	if _, err := engine.ListImages(context.Background(), "eu-west-1", "repo"); err == nil {
+		t.Errorf("Expected an error for a region without ECR client, but got none")
+	}
+}
+
+func TestEngineDeleteImages(t *testing.T) {
+	engine, ecrClient := newTestEngine(250, false)
+
+	if err := engine.DeleteImages(context.Background(), "us-east-1", ecrClient.images); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	if len(ecrClient.deleted) != 3 || len(ecrClient.deleted[2]) != 50 {
+		t.Errorf("Expected images to be deleted in 3 batches, but got %d batches", len(ecrClient.deleted))
+	}
+
+	// Nothing is deleted once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := engine.DeleteImages(ctx, "us-east-1", ecrClient.images); err != context.Canceled {
+		t.Errorf("Expected the deletion to be canceled, but got %v", err)
+	}
+
+	if len(ecrClient.deleted) != 3 {
+		t.Errorf("Expected no further batches to be deleted, but got %d batches", len(ecrClient.deleted))
+	}
+}
+
+func TestEngineDeleteImagesInDryRun(t *testing.T) {
+	engine, ecrClient := newTestEngine(3, true)
+
+	if err := engine.DeleteImages(context.Background(), "us-east-1", ecrClient.images); err == nil {
+		t.Errorf("Expected an error in a dry run, but got none")
+	}
+
+	if len(ecrClient.deleted) != 0 {
+		t.Errorf("Expected no images to be deleted, but got %v", ecrClient.deleted)
+	}
+}
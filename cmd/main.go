@@ -1,85 +1,1130 @@
 package main
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"regexp"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"flag"
 
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
 
 	"github.com/danielfm/kube-ecr-cleanup-controller/core"
 )
 
+// Options of the running controller, and the task they configure
+var opts *options
 var task *core.CleanupTask
 
+// How often the -config file is checked for changes
+const configCheckInterval = 30 * time.Second
+
+// Tracer provider exporting the spans of the passes, if -otlp-endpoint is set
+var tracerProvider interface {
+	Shutdown(ctx context.Context) error
+}
+
+// How long the spans yet to be exported are waited for when exiting
+const tracingShutdownTimeout = 5 * time.Second
+
 // VERSION set by build script
 var VERSION = "UNKNOWN"
 
+const usage = `Usage: %s [flags] [command] [command flags]
+
+Commands:
+  clean                    Periodically remove old unused images (default)
+  scan                     Report which images would be removed, without removing them
+  report                   Summarize the size of the repos, and what the retention flags would reclaim
+  lifecycle-policy export  Print the ECR lifecycle policy equivalent to the retention flags
+
+Flags shared by all commands:
+`
+
+// durationValue is a flag.Value holding a duration that may also be given as
+// a number of days, such as "30d".
+type durationValue struct {
+	duration *time.Duration
+}
+
+func (v durationValue) String() string {
+	if v.duration == nil {
+		return "0s"
+	}
+	return v.duration.String()
+}
+
+func (v durationValue) Set(value string) error {
+	duration, err := core.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	*v.duration = duration
+	return nil
+}
+
+// stringsValue is a flag.Value collecting the values of a flag that may be
+// given more than once.
+type stringsValue []string
+
+func (v *stringsValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return strings.Join(*v, ", ")
+}
+
+func (v *stringsValue) Set(value string) error {
+	*v = append(*v, value)
+	return nil
+}
+
+// options holds the task configured by the command line and the -config
+// file, along with the raw values of the flags that need to be parsed further.
+type options struct {
+	task *core.CleanupTask
+
+	configPath string
+
+	// Raw values of the shared flags that need to be parsed further
+	namespacesStr, reposStr, regionsStr, registryAliasesStr, repoRolesStr, protectAnnotationStr, remoteClustersStr, customWorkloadsStr, gitOpsReposStr, excludeNamespacesStr string
+
+	logFormat, logLevel string
+	tagGroupPatternStr  string
+	maxRepoSizeGB       float64
+	otlpEndpoint        string
+	otlpInsecure        bool
+
+	keepTagPatterns, repoIncludePatterns, repoExcludePatterns stringsValue
+
+	// Flags specific to the clean command
+	confirm, dryRun, once bool
+	metricsAddress        string
+	shutdownTimeout       time.Duration
+	scheduleStr           string
+
+	// Flags specific to the lifecycle-policy export command
+	applyLifecyclePolicy, allowPartialLifecyclePolicy bool
+
+	// Flags specific to the report command
+	reportOutput           string
+	storagePricePerGBMonth float64
+}
+
+func newOptions() *options {
+	return &options{
+		task:            core.NewCleanupTask(),
+		namespacesStr:   "default",
+		logFormat:       core.LogFormatText,
+		logLevel:        core.LogLevelInfo,
+		metricsAddress:  ":8080",
+		shutdownTimeout: 25 * time.Second,
+
+		reportOutput:           "table",
+		storagePricePerGBMonth: core.DefaultStoragePricePerGBMonth,
+	}
+}
+
 func init() {
-	namespacesStr, reposStr := "default", ""
+	opts = newOptions()
+	task = opts.task
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		flag.PrintDefaults()
+	}
 
-	task = core.NewCleanupTask()
+	registerSharedFlags(flag.CommandLine, opts)
+}
 
-	flag.StringVar(&task.KubeConfig, "kubeconfig", task.KubeConfig, "Path to a kubeconfig file.")
-	flag.StringVar(&namespacesStr, "namespaces", namespacesStr, "Do not remove images used by pods in this comma-separated list of namespaces.")
-	flag.IntVar(&task.Interval, "interval", task.Interval, "Check interval in minutes.")
-	flag.IntVar(&task.MaxImages, "max-images", task.MaxImages, "Maximum number of images to keep in each repository.")
-	flag.StringVar(&reposStr, "repos", reposStr, "Comma-separated list of repository names to watch.")
-	flag.StringVar(&task.AwsRegion, "region", task.AwsRegion, "AWS Region to use when talking to AWS.")
+// registerSharedFlags registers the flags shared by all commands in the given
+// flag set, storing their values in the given options.
+func registerSharedFlags(flags *flag.FlagSet, o *options) {
+	flags.StringVar(&o.configPath, "config", o.configPath, "Path to a YAML or JSON file holding settings named after these flags, e.g. 'max-images: 10', for the ones not given on the command line. Reloaded on SIGHUP or when it changes.")
+	flags.StringVar(&o.task.KubeConfig, "kubeconfig", o.task.KubeConfig, "Path to a kubeconfig file.")
+	flags.StringVar(&o.remoteClustersStr, "remote-clusters", o.remoteClustersStr, "Comma-separated list of other clusters whose pods' images are also in use, each given as a kubeconfig path, optionally followed by #context to use another context than the current one.")
+	flags.StringVar(&o.task.ControllerNamespace, "controller-namespace", o.task.ControllerNamespace, "Namespace holding the Kubernetes resources owned by the controller. Defaults to the namespace of the controller pod.")
+	flags.StringVar(&o.namespacesStr, "namespaces", o.namespacesStr, "Do not remove images used by pods in this comma-separated list of namespaces, which may contain wildcards, e.g. '*' or 'team-*'.")
+	flags.StringVar(&o.excludeNamespacesStr, "exclude-namespaces", o.excludeNamespacesStr, "Comma-separated list of namespaces, which may contain wildcards, e.g. 'preview-*', whose pods are left out when finding out which images are in use, even if they match -namespaces.")
+	flags.BoolVar(&o.task.IgnoreKubernetesErrors, "unsafe-ignore-kube-errors", o.task.IgnoreKubernetesErrors, "Proceed as if no images were in use when pods or nodes cannot be listed. Unsafe, since images used by running pods might be removed.")
+	flags.IntVar(&o.task.Interval, "interval", o.task.Interval, "Check interval in minutes, unless -schedule is set.")
+	flags.IntVar(&o.task.MaxImages, "max-images", o.task.MaxImages, "Maximum number of images to keep in each repository.")
+	flags.DurationVar(&o.task.CountSince, "count-since", o.task.CountSince, "Only count images pushed within this window against -max-images, e.g. 720h, so that older images are never removed because of it (0 counts all images).")
+	flags.StringVar(&o.task.SemverRetention, "semver-retention", o.task.SemverRetention, "Keep -max-images images in each 'major' or 'minor' version line, as given by the tags that are semantic versions, such as v1.2.3, instead of in the whole repository (empty disables).")
+	flags.StringVar(&o.tagGroupPatternStr, "tag-group-regex", o.tagGroupPatternStr, "Keep -max-images images in each group of images whose tags share the text captured by the first group of this regular expression, e.g. '^(.+)-[0-9a-f]+$' to keep the most recent builds of each branch (empty disables).")
+	flags.Var(durationValue{&o.task.MaxImageAge}, "max-image-age", "Delete unused images pushed longer ago than this, e.g. 30d or 720h, regardless of -max-images (0 disables).")
+	flags.Var(durationValue{&o.task.MinImageAge}, "min-image-age", "Never remove images pushed within this window, e.g. 2d or 48h, regardless of -max-images and the other rules (0 disables).")
+	flags.BoolVar(&o.task.SkipScanPending, "skip-delete-if-scan-pending", o.task.SkipScanPending, "Do not remove images whose ECR image scans are yet to complete until the next pass, regardless of the other rules.")
+	flags.BoolVar(&o.task.DeleteCriticalFindings, "force-delete-critical-cves", o.task.DeleteCriticalFindings, "Delete unused images whose latest ECR image scans found vulnerabilities of CRITICAL severity, regardless of -max-images and the other retention rules.")
+	flags.BoolVar(&o.task.DeleteUntaggedImages, "delete-untagged", o.task.DeleteUntaggedImages, "Delete unused images without any tags, regardless of -max-images.")
+	flags.IntVar(&o.task.UntaggedKeepCount, "untagged-keep-count", o.task.UntaggedKeepCount, "Keep only this many of the most recent untagged images, which then don't count against -max-images (0 disables).")
+	flags.Var(durationValue{&o.task.UntaggedMaxAge}, "untagged-max-age", "Delete untagged images pushed longer ago than this, e.g. 1d or 6h, which then don't count against -max-images (0 disables).")
+	flags.IntVar(&o.task.MaxTagsPerImage, "max-tags", o.task.MaxTagsPerImage, "Delete unused images with more than this number of tags, regardless of -max-images (0 disables).")
+	flags.BoolVar(&o.task.DeleteManifestListChildren, "delete-manifest-list-children", o.task.DeleteManifestListChildren, "When removing manifest lists (multi-arch images), also remove the images they reference that no other manifest list references.")
+	flags.BoolVar(&o.task.DeleteOrphanedManifestLists, "delete-orphaned-manifest-lists", o.task.DeleteOrphanedManifestLists, "After removing images, also remove the manifest lists (multi-arch images) whose children were all removed.")
+	flags.BoolVar(&o.task.AllowEmptyRepositories, "allow-empty-repo", o.task.AllowEmptyRepositories, "Remove images even if that would leave a repository without any images.")
+	flags.BoolVar(&o.task.UseRepositoryTags, "repo-tag-overrides", o.task.UseRepositoryTags, "Override the retention rules of the repos carrying the cleanup.keep, cleanup.max-age or cleanup.enabled AWS resource tags, which are read again in each pass.")
+	flags.BoolVar(&o.task.UseNamespaceKeepCounts, "namespace-keep-counts", o.task.UseNamespaceKeepCounts, "Keep at least as many images in each repo as the highest 'ecr-cleanup/keep-count' annotation of the namespaces whose pods use its images, which are read again in each pass.")
+	flags.BoolVar(&o.task.UseCleanupPolicies, "cleanup-policies", o.task.UseCleanupPolicies, "Override the retention rules of the repos matched by ECRCleanupPolicy resources, which are read again in each pass.")
+	flags.StringVar(&o.task.KeepTagsConfigMap, "keep-tags-configmap", o.task.KeepTagsConfigMap, "Do not remove images with any of the tags listed in this ConfigMap, given as namespace/name. The ConfigMap is read again in each pass.")
+	flags.Var(&o.keepTagPatterns, "keep-tags-regex", "Do not remove images with any tags matching this regular expression, e.g. '^release-.*'. May be given more than once.")
+	flags.BoolVar(&o.task.MatchRegistryOnly, "match-registry-only", o.task.MatchRegistryOnly, "Only consider images hosted in the ECR registry being cleaned up as in use, ignoring identically named images from other registries.")
+	flags.Float64Var(&o.maxRepoSizeGB, "max-repo-size-gb", o.maxRepoSizeGB, "Delete the oldest unused images of each repository until the images left take up at most this many GB (2^30 bytes), regardless of -max-images (0 disables).")
+	flags.Int64Var(&o.task.MinImageSizeBytes, "min-image-size", o.task.MinImageSizeBytes, "Delete unused images smaller than this many bytes, which are most likely left behind by failed pushes, regardless of -max-images (0 disables).")
+	flags.IntVar(&o.task.MinRepositories, "min-repos", o.task.MinRepositories, "Minimum number of ECR repositories expected to be found in each pass.")
+	flags.StringVar(&o.task.MinRepositoriesAction, "min-repos-action", o.task.MinRepositoriesAction, "What to do when fewer than -min-repos repositories are found: 'warn' or 'error'.")
+	flags.Int64Var(&o.task.ReclaimBytes, "reclaim-bytes", o.task.ReclaimBytes, "Instead of keeping -max-images images, remove the oldest unused images across all repositories until at least this many bytes are reclaimed (0 disables).")
+	flags.StringVar(&o.reposStr, "repos", o.reposStr, "Comma-separated list of repository names to watch.")
+	flags.BoolVar(&o.task.DiscoverRepositories, "discover-repos", o.task.DiscoverRepositories, "Clean up all repositories in the registry instead of the ones given by -repos, which are listed again in each pass.")
+	flags.Var(&o.repoIncludePatterns, "repo-include-regex", "With -discover-repos, only clean up repositories whose names match this regular expression. May be given more than once.")
+	flags.Var(&o.repoExcludePatterns, "repo-exclude-regex", "With -discover-repos, do not clean up repositories whose names match this regular expression. May be given more than once.")
+	flags.BoolVar(&o.task.OnlyRepositoriesInUse, "only-in-use-repos", o.task.OnlyRepositoriesInUse, "Only clean up repositories with images in use by the cluster, leaving the others untouched.")
+	flags.BoolVar(&o.task.SkipReplicatedRepositories, "skip-replicated", o.task.SkipReplicatedRepositories, "Skip the repositories replicated to other regions or accounts by ECR, and the ones created by pull-through cache rules, instead of reporting them as failed.")
+	flags.BoolVar(&o.task.AllowReplicatedRepositories, "allow-replicated", o.task.AllowReplicatedRepositories, "Clean up the repositories replicated to other regions or accounts by ECR, and the ones created by pull-through cache rules, which are reported as failed otherwise.")
+	flags.IntVar(&o.task.OrphanedRepositoryDays, "orphaned-repo-days", o.task.OrphanedRepositoryDays, "Report the repositories none of whose images were in use, pushed or pulled in this many days, or that are empty and were created longer ago than that, as orphaned (0 disables).")
+	flags.BoolVar(&o.task.DeleteEmptyRepositories, "delete-empty-repos", o.task.DeleteEmptyRepositories, "With -orphaned-repo-days and -discover-repos, delete the orphaned repositories that are empty instead of only reporting them.")
+	flags.DurationVar(&o.task.RepositoryGracePeriod, "repo-grace-period", o.task.RepositoryGracePeriod, "Do not clean up repositories created less than this long ago, e.g. 6h (0 disables).")
+	flags.IntVar(&o.task.RepositoryFailureThreshold, "repo-failure-threshold", o.task.RepositoryFailureThreshold, "Skip the repositories that failed in this many consecutive passes, such as because access to them is denied, for -repo-cooldown, doubling each time they fail again (0 disables).")
+	flags.DurationVar(&o.task.RepositoryCooldown, "repo-cooldown", o.task.RepositoryCooldown, "How long the repositories reaching -repo-failure-threshold are first skipped for.")
+	flags.DurationVar(&o.task.RepositoryMaxCooldown, "repo-max-cooldown", o.task.RepositoryMaxCooldown, "Maximum time the repositories that keep failing are skipped for, as -repo-cooldown doubles (0 disables the limit).")
+	flags.BoolVar(&o.task.ProtectManifestListChildren, "protect-manifest-list-children", o.task.ProtectManifestListChildren, "Keep images referenced by manifest lists (multi-arch images) that are not being deleted.")
+	flags.StringVar(&o.protectAnnotationStr, "protect-annotation", o.protectAnnotationStr, "Keep images whose manifests carry this OCI annotation, given as key or key=value. Requires fetching the manifests of the images to be removed.")
+	flags.BoolVar(&o.task.ProtectImagesNewerThanInUse, "protect-newer-than-in-use", o.task.ProtectImagesNewerThanInUse, "Keep images pushed after the newest image in use in each repository, since they might be pending rollouts.")
+	flags.BoolVar(&o.task.AlwaysKeepLatestTagged, "always-keep-latest-tagged", o.task.AlwaysKeepLatestTagged, "Always keep the most recent tagged image of each repository, and of each -semver-retention line or -tag-group-regex group, so that there's always an image to roll back to.")
+	flags.BoolVar(&o.task.UseJobImages, "job-images", o.task.UseJobImages, "Do not remove images used by the jobs and cron jobs of -namespaces, even if no pods are running them.")
+	flags.DurationVar(&o.task.JobHistoryWindow, "job-history-window", o.task.JobHistoryWindow, "With -job-images, leave out the jobs that finished longer ago than this (0 means all jobs).")
+	flags.BoolVar(&o.task.UseRevisionHistoryImages, "revision-history-images", o.task.UseRevisionHistoryImages, "Do not remove images that the deployments and stateful sets of -namespaces can roll back to.")
+	flags.BoolVar(&o.task.UseRolloutImages, "rollout-images", o.task.UseRolloutImages, "Do not remove images used by the Argo Rollouts of -namespaces, including the replica sets they keep for aborts and rollbacks.")
+	flags.BoolVar(&o.task.UseHelmReleaseImages, "helm-release-images", o.task.UseHelmReleaseImages, "Do not remove images used by the rendered manifests of the deployed Helm releases of -namespaces, even if their workloads are scaled down to zero.")
+	flags.StringVar(&o.customWorkloadsStr, "custom-workloads", o.customWorkloadsStr, "Comma-separated list of custom resources running pods, given as <plural>.<version>.<group>, e.g. 'workflows.v1alpha1.argoproj.io'. Do not remove the images of their containers in -namespaces.")
+	flags.StringVar(&o.gitOpsReposStr, "gitops-repos", o.gitOpsReposStr, "Comma-separated list of GitOps repos, given as <url>[#<branch or tag>], e.g. 'https://github.com/org/deploy.git#main'. Do not remove the images referenced by their manifests, kustomizations and Helm values, even if they are not deployed yet.")
+	flags.StringVar(&o.task.GitTokenPath, "gitops-token-file", o.task.GitTokenPath, "Path of the file holding the access token sent to the HTTPS remotes of -gitops-repos.")
+	flags.BoolVar(&o.task.UseNodePinnedImages, "node-pinned-images", o.task.UseNodePinnedImages, "Do not remove images listed in the 'ecr-cleanup/pinned-images' annotation of the cluster nodes.")
+	flags.IntVar(&o.task.MinDaysSinceLastPull, "min-days-since-last-pull", o.task.MinDaysSinceLastPull, "Do not remove images pulled within this many days, according to the last pull times recorded by ECR, e.g. by CI jobs or Lambda functions outside of the cluster (0 disables).")
+	flags.DurationVar(&o.task.RecentPullWindow, "recent-pull-window", o.task.RecentPullWindow, "Do not remove images pulled within this window according to CloudTrail, e.g. 168h (0 disables). Requires the cloudtrail:LookupEvents permission.")
+	flags.StringVar(&o.task.PlanOutputPath, "plan-output", o.task.PlanOutputPath, "Write the images selected for deletion in each pass, along with the encryption settings of each repository, to this path as JSON.")
+	flags.StringVar(&o.task.PreviousPlanPath, "previous-plan", o.task.PreviousPlanPath, "Compare the images selected for deletion in each pass against the plan in this path. May be the same as -plan-output.")
+	flags.BoolVar(&o.task.VerifyPlan, "verify-plan", o.task.VerifyPlan, "Check the images selected for deletion against safety invariants, such as no images in use being selected, and abort the pass without removing anything if any invariant is violated.")
+	flags.StringVar(&o.task.ReportCSVPath, "report-csv", o.task.ReportCSVPath, "Write the images selected for deletion in each pass, and whether they were deleted, retained or would be deleted, to this path as CSV.")
+	flags.StringVar(&o.registryAliasesStr, "registry-aliases", o.registryAliasesStr, "Comma-separated list of alias=registry pairs mapping registry mirror hosts (optionally followed by a path prefix) to the ECR registry host they stand for.")
+	flags.StringVar(&o.logFormat, "log-format", o.logFormat, "Format of the messages logged by the clean-up passes: 'text' or 'json', with one JSON object per line on stderr.")
+	flags.StringVar(&o.logLevel, "log-level", o.logLevel, "Minimum level of the messages logged by the clean-up passes: 'info', 'warning' or 'error'.")
+	flags.StringVar(&o.task.AwsSdkVersion, "aws-sdk", o.task.AwsSdkVersion, "Version of the AWS SDK backing the ECR client: 'v1' or the experimental 'v2', which requires a build with '-tags awssdkv2'.")
+	flags.StringVar(&o.task.AwsRegion, "region", o.task.AwsRegion, "AWS Region to use when talking to AWS.")
+	flags.StringVar(&o.regionsStr, "regions", o.regionsStr, "Comma-separated list of AWS regions in which to clean up the repositories, overriding -region. The first one is used when talking to the other AWS services.")
+	flags.Float64Var(&o.task.ApiQPS, "api-qps", o.task.ApiQPS, "Maximum number of requests per second sent to the ECR API (0 disables the limit).")
+	flags.IntVar(&o.task.ApiBurst, "api-burst", o.task.ApiBurst, "Maximum burst of requests sent to the ECR API.")
+	flags.IntVar(&o.task.Concurrency, "concurrency", o.task.Concurrency, "Number of repositories whose images are listed and selected for deletion at once in each region, within the -api-qps limit.")
+	flags.IntVar(&o.task.ApiMaxRetries, "api-max-retries", o.task.ApiMaxRetries, "Maximum number of times failed ECR API requests, such as throttled ones, are retried with exponential backoff.")
+	flags.DurationVar(&o.task.ImageCacheTTL, "image-cache-ttl", o.task.ImageCacheTTL, "Cache the images listed from each repository for this long, e.g. 6h, instead of describing them again in each pass. The images of a repository are listed again once some of them are removed, and the images to remove are described again first, keeping the ones tagged since (0 disables the cache).")
+	flags.StringVar(&o.task.ImageTagStatus, "image-tag-status", o.task.ImageTagStatus, "Only list and clean up the images of the repositories with this tag status, either 'tagged' or 'untagged', such as 'untagged' as a first rollout step (empty lists all images).")
+	flags.DurationVar(&o.task.FullResyncInterval, "full-resync-interval", o.task.FullResyncInterval, "With -image-cache-ttl, list the images of all repositories again this often, e.g. 24h, whatever the TTL (0 disables).")
+	flags.StringVar(&o.otlpEndpoint, "otlp-endpoint", o.otlpEndpoint, "Export traces of the passes via OTLP over HTTP to this endpoint, given as host:port, e.g. localhost:4318, with spans for each repo, ECR API request and Kubernetes list (empty disables).")
+	flags.BoolVar(&o.otlpInsecure, "otlp-insecure", o.otlpInsecure, "Export the traces to -otlp-endpoint over plain HTTP instead of HTTPS.")
+	flags.StringVar(&o.task.AwsAuth.Mode, "aws-auth-mode", o.task.AwsAuth.Mode, "Where the AWS credentials come from: 'auto', 'env', 'profile', 'web-identity', 'ec2' or 'ecs'. With 'auto', the first of the AWS_ACCESS_KEY_ID environment variables, the IRSA web identity token, the shared credentials file and the ECS or EC2 metadata endpoints providing credentials is used.")
+	flags.StringVar(&o.task.AwsAuth.Profile, "aws-profile", o.task.AwsAuth.Profile, "Profile of the shared credentials file used with -aws-auth-mode 'auto' or 'profile'. Defaults to AWS_PROFILE, then to the default profile.")
+	flags.StringVar(&o.task.AwsAuth.WebIdentityTokenFile, "aws-web-identity-token-file", o.task.AwsAuth.WebIdentityTokenFile, "Web identity token file used with -aws-auth-mode 'web-identity'. Defaults to AWS_WEB_IDENTITY_TOKEN_FILE, as set by IRSA.")
+	flags.StringVar(&o.task.AwsAuth.WebIdentityRoleARN, "aws-web-identity-role-arn", o.task.AwsAuth.WebIdentityRoleARN, "ARN of the IAM role assumed with the web identity token with -aws-auth-mode 'web-identity'. Defaults to AWS_ROLE_ARN, as set by IRSA.")
+	flags.StringVar(&o.task.AssumeRoleARN, "assume-role-arn", o.task.AssumeRoleARN, "ARN of an IAM role to assume to access the repositories, e.g. to clean up repositories living in another AWS account.")
+	flags.StringVar(&o.repoRolesStr, "repo-roles", o.repoRolesStr, "Comma-separated list of repo=role-arn pairs mapping repositories that require a different IAM role than -assume-role-arn to the role to assume for each one.")
+	flags.StringVar(&o.task.ExpectedAccountID, "expected-account-id", o.task.ExpectedAccountID, "If set, refuse to run unless the AWS credentials belong to this AWS account ID.")
+	flags.BoolVar(&o.task.Preflight, "preflight", o.task.Preflight, "Verify at startup that the AWS credentials are allowed the IAM actions, and the Kubernetes service account the RBAC permissions, that the other flags require, and refuse to run otherwise.")
+	flags.StringVar(&o.task.EcrEndpoint, "ecr-endpoint", o.task.EcrEndpoint, "Custom ECR endpoint URL (e.g. LocalStack or a VPC endpoint). Leave empty to use the default endpoint for the region.")
+}
 
-	flag.Parse()
+// lifecyclePolicyExportCommand is the command exporting the ECR lifecycle
+// policy equivalent to the retention flags.
+const lifecyclePolicyExportCommand = "lifecycle-policy export"
+
+// registerLifecyclePolicyFlags registers the flags specific to the
+// lifecycle-policy export command in the given flag set, storing their values
+// in the given options.
+func registerLifecyclePolicyFlags(flags *flag.FlagSet, o *options) {
+	flags.BoolVar(&o.applyLifecyclePolicy, "apply", o.applyLifecyclePolicy, "Set the lifecycle policy of the repos given by -repos or -discover-repos to the exported policy, replacing their current one.")
+	flags.BoolVar(&o.allowPartialLifecyclePolicy, "allow-partial", o.allowPartialLifecyclePolicy, "With -apply, apply the exported policy even if some of the retention flags given cannot be translated into it.")
+}
+
+// registerReportFlags registers the flags specific to the report command in
+// the given flag set, storing their values in the given options.
+func registerReportFlags(flags *flag.FlagSet, o *options) {
+	flags.StringVar(&o.reportOutput, "output", o.reportOutput, "Format of the report: 'table' or 'json'.")
+	flags.Float64Var(&o.storagePricePerGBMonth, "price-per-gb-month", o.storagePricePerGBMonth, "Price of the storage of ECR images, in USD per GB and month, used to estimate what the images selected for deletion cost.")
+}
 
-	if len(namespacesStr) == 0 {
-		log.Fatalf("Must specify at least one namespace, exiting.")
+// registerCleanFlags registers the flags specific to the clean command in the
+// given flag set, storing their values in the given options.
+func registerCleanFlags(flags *flag.FlagSet, o *options) {
+	flags.BoolVar(&o.confirm, "confirm", o.confirm, "Actually remove images. Without it, images that would be removed are only reported.")
+	flags.BoolVar(&o.dryRun, "dry-run", o.dryRun, "Only report which images would be removed in each pass, which is the default without -confirm. Cannot be used along with -confirm.")
+	flags.StringVar(&o.task.AuditS3Bucket, "audit-s3-bucket", o.task.AuditS3Bucket, "Record the removed images as JSON lines in this S3 bucket, for long-term audit.")
+	flags.StringVar(&o.task.AuditS3Prefix, "audit-s3-prefix", o.task.AuditS3Prefix, "Prefix of the keys under which the removed images are recorded in -audit-s3-bucket.")
+	flags.StringVar(&o.task.AuditPath, "audit-path", o.task.AuditPath, "Append the removed images as JSON lines to the file at this path, such as on a persistent volume, for long-term audit.")
+	flags.BoolVar(&o.task.AuditFailuresBlockDeletion, "audit-failures-block-deletion", o.task.AuditFailuresBlockDeletion, "Stop removing images in a pass when the removed images cannot be recorded in -audit-s3-bucket or -audit-path, instead of only logging the failure.")
+	flags.BoolVar(&o.task.EmitEvents, "events", o.task.EmitEvents, "Emit a Kubernetes event on -events-target for each image removed, skipped or that could not be removed.")
+	flags.StringVar(&o.task.EventsTarget, "events-target", o.task.EventsTarget, "Object the -events are emitted on, given as Kind/name in -controller-namespace, where Kind is one of Pod, ConfigMap or Deployment. Defaults to the controller pod.")
+	flags.BoolVar(&o.once, "once", o.once, "Run a single pass and exit, with a non-zero code if it failed, e.g. to run as a Kubernetes CronJob.")
+	flags.StringVar(&o.metricsAddress, "metrics-address", o.metricsAddress, "Address on which to expose Prometheus metrics at /metrics, along with the /healthz and /readyz probes (empty disables).")
+	flags.IntVar(&o.task.LivenessIntervals, "liveness-intervals", o.task.LivenessIntervals, "Fail the /healthz probe when no pass completed for this many intervals (0 disables).")
+	flags.BoolVar(&o.task.LeaderElection, "leader-elect", o.task.LeaderElection, "Only run passes in the replica holding the lead, so that several replicas can be deployed for availability.")
+	flags.StringVar(&o.task.LeaderElectionIdentity, "leader-elect-identity", o.task.LeaderElectionIdentity, "Identity of this replica for -leader-elect. Defaults to the hostname, which is the pod name.")
+	flags.DurationVar(&o.task.LeaderElectionLeaseDuration, "leader-elect-lease-duration", o.task.LeaderElectionLeaseDuration, "How long the lead is held without being renewed before another replica can take it over, with -leader-elect.")
+	flags.IntVar(&o.task.MaxDeletesPerReconcile, "max-deletes-per-reconcile", o.task.MaxDeletesPerReconcile, "Maximum number of images deleted in each pass, starting with the oldest ones (0 means no limit).")
+	flags.IntVar(&o.task.MaxDeletesPerRepository, "max-deletes-per-repo", o.task.MaxDeletesPerRepository, "Maximum number of images deleted from each repo in each pass, starting with the oldest ones (0 means no limit).")
+	flags.StringVar(&o.task.NotifyWebhookURL, "notify-webhook-url", o.task.NotifyWebhookURL, "Post a summary of each pass to this Slack-compatible incoming webhook URL.")
+	flags.StringVar(&o.task.NotifyOn, "notify-on", o.task.NotifyOn, "Which passes are reported to -notify-webhook-url, either 'always' or 'errors'.")
+	flags.StringVar(&o.scheduleStr, "schedule", o.scheduleStr, "Run passes at the times given by this cron expression, in the local time of the controller, e.g. '30 2 * * 1-5' or '@daily', instead of every -interval minutes.")
+	flags.DurationVar(&o.task.ScheduleJitter, "schedule-jitter", o.task.ScheduleJitter, "Delay each pass by a random duration of up to this long, e.g. 10m, so that the controllers of several clusters don't hit ECR at the same time (0 disables).")
+	flags.DurationVar(&o.shutdownTimeout, "shutdown-timeout", o.shutdownTimeout, "How long to wait for the running pass to stop after a shutdown signal, which cancels it, before exiting anyway. Should be shorter than the termination grace period of the pod.")
+	flags.StringVar(&o.task.StatusConfigMap, "status-configmap", o.task.StatusConfigMap, "Record a JSON summary of each pass, with the images deleted from each repo and the errors, in the ConfigMap with this name in -controller-namespace.")
+	flags.DurationVar(&o.task.QuarantineRetention, "quarantine-retention", o.task.QuarantineRetention, "Instead of removing images right away, tag them as pending deletion and only remove them after this long, e.g. 168h (0 disables).")
+}
+
+// validate checks the values of the shared flags and fills in the
+// corresponding task fields.
+func (o *options) validate() error {
+	if len(o.namespacesStr) == 0 {
+		return fmt.Errorf("Must specify at least one namespace")
+	}
+	if len(o.reposStr) == 0 && !o.task.DiscoverRepositories {
+		return fmt.Errorf("Must specify at least one ECR repository to watch")
+	}
+	if len(o.reposStr) > 0 && o.task.DiscoverRepositories {
+		return fmt.Errorf("Cannot use -repos along with -discover-repos")
+	}
+	if (len(o.repoIncludePatterns) > 0 || len(o.repoExcludePatterns) > 0) && !o.task.DiscoverRepositories {
+		return fmt.Errorf("Cannot use -repo-include-regex or -repo-exclude-regex without -discover-repos")
+	}
+	if len(o.task.AwsRegion) == 0 && len(o.regionsStr) == 0 {
+		return fmt.Errorf("Must specify the AWS region")
+	}
+	if o.maxRepoSizeGB < 0 {
+		return fmt.Errorf("Invalid -max-repo-size-gb %v, must not be negative", o.maxRepoSizeGB)
+	}
+	if o.task.MinDaysSinceLastPull < 0 {
+		return fmt.Errorf("Invalid -min-days-since-last-pull %d, must not be negative", o.task.MinDaysSinceLastPull)
 	}
-	if len(reposStr) == 0 {
-		log.Fatalf("Must specify at least one ECR repository to watch, exiting.")
+	if o.task.ApiQPS < 0 {
+		return fmt.Errorf("Invalid -api-qps %v, must not be negative", o.task.ApiQPS)
+	}
+	if o.task.ApiQPS > 0 && o.task.ApiBurst < 1 {
+		return fmt.Errorf("Invalid -api-burst %d, must be at least 1 along with -api-qps", o.task.ApiBurst)
+	}
+	if o.task.Concurrency < 1 {
+		return fmt.Errorf("Invalid -concurrency %d, must be at least 1", o.task.Concurrency)
+	}
+	if o.task.SemverRetention != "" && o.task.SemverRetention != core.SemverRetentionMajor && o.task.SemverRetention != core.SemverRetentionMinor {
+		return fmt.Errorf("Invalid -semver-retention '%s', must be 'major' or 'minor'", o.task.SemverRetention)
+	}
+	if o.task.MinRepositoriesAction != core.MinRepositoriesActionWarn && o.task.MinRepositoriesAction != core.MinRepositoriesActionError {
+		return fmt.Errorf("Invalid -min-repos-action '%s', must be 'warn' or 'error'", o.task.MinRepositoriesAction)
+	}
+
+	if o.task.AwsSdkVersion != core.AwsSdkVersionV1 && o.task.AwsSdkVersion != core.AwsSdkVersionV2 {
+		return fmt.Errorf("Invalid -aws-sdk '%s', must be 'v1' or 'v2'", o.task.AwsSdkVersion)
+	}
+	if (o.task.AwsAuth.WebIdentityTokenFile != "" || o.task.AwsAuth.WebIdentityRoleARN != "") && o.task.AwsAuth.Mode != core.AwsAuthModeWebIdentity {
+		return fmt.Errorf("Cannot use -aws-web-identity-token-file or -aws-web-identity-role-arn without -aws-auth-mode 'web-identity'")
+	}
+	if o.task.AwsAuth.Profile != "" && o.task.AwsAuth.Mode != core.AwsAuthModeAuto && o.task.AwsAuth.Mode != core.AwsAuthModeProfile {
+		return fmt.Errorf("Cannot use -aws-profile along with -aws-auth-mode '%s'", o.task.AwsAuth.Mode)
+	}
+	if err := o.task.AwsAuth.Validate(); err != nil {
+		return fmt.Errorf("Invalid -aws-auth-mode: %v", err)
 	}
 
-	namespaces := core.ParseCommaSeparatedList(namespacesStr)
-	repositories := core.ParseCommaSeparatedList(reposStr)
+	logger, err := core.NewLogger(o.logFormat, o.logLevel, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("Invalid -log-format or -log-level: %v", err)
+	}
+	o.task.Logger = logger
+
+	namespaces := core.ParseCommaSeparatedList(o.namespacesStr)
+	repositories := core.ParseCommaSeparatedList(o.reposStr)
 
 	if len(namespaces) == 0 {
-		glog.Fatalf("Must specify at least one namespace, exiting.")
+		return fmt.Errorf("Must specify at least one namespace")
+	}
+
+	excludeNamespaces := core.ParseCommaSeparatedList(o.excludeNamespacesStr)
+	for _, namespace := range append(append([]*string{}, namespaces...), excludeNamespaces...) {
+		if _, err := path.Match(*namespace, ""); err != nil {
+			return fmt.Errorf("Invalid namespace pattern '%s': %v", *namespace, err)
+		}
+	}
+	if len(repositories) == 0 && !o.task.DiscoverRepositories {
+		return fmt.Errorf("Must specify at least one repository to watch")
+	}
+
+	if o.task.KeepTagsConfigMap != "" {
+		if _, _, err := core.ParseNamespacedName(o.task.KeepTagsConfigMap); err != nil {
+			return fmt.Errorf("Invalid -keep-tags-configmap: %v", err)
+		}
+	}
+
+	if o.task.KeepTagPatterns, err = compilePatterns("keep-tags-regex", o.keepTagPatterns); err != nil {
+		return err
 	}
-	if len(repositories) == 0 {
-		glog.Fatalf("Must specify at least one repository to watch, exiting.")
+	if o.task.RepositoryIncludePatterns, err = compilePatterns("repo-include-regex", o.repoIncludePatterns); err != nil {
+		return err
 	}
+	if o.task.RepositoryExcludePatterns, err = compilePatterns("repo-exclude-regex", o.repoExcludePatterns); err != nil {
+		return err
+	}
+
+	if o.tagGroupPatternStr != "" {
+		if o.task.SemverRetention != "" {
+			return fmt.Errorf("Cannot use -tag-group-regex along with -semver-retention")
+		}
+
+		patterns, err := compilePatterns("tag-group-regex", []string{o.tagGroupPatternStr})
+		if err != nil {
+			return err
+		}
+		o.task.TagGroupPattern = patterns[0]
+	}
+
+	if o.protectAnnotationStr != "" {
+		pair := strings.SplitN(o.protectAnnotationStr, "=", 2)
+		o.task.ProtectAnnotationKey = strings.TrimSpace(pair[0])
+		if len(pair) == 2 {
+			o.task.ProtectAnnotationValue = strings.TrimSpace(pair[1])
+		}
 
-	task.KubeNamespaces = namespaces
-	task.EcrRepositories = repositories
+		if o.task.ProtectAnnotationKey == "" {
+			return fmt.Errorf("Invalid -protect-annotation '%s', must be key or key=value", o.protectAnnotationStr)
+		}
+	}
+
+	if o.regionsStr != "" {
+		regions := core.ParseCommaSeparatedList(o.regionsStr)
+		if len(regions) == 0 {
+			return fmt.Errorf("Must specify at least one AWS region")
+		}
+
+		o.task.AwsRegions = nil
+		for _, region := range regions {
+			o.task.AwsRegions = append(o.task.AwsRegions, *region)
+		}
+		o.task.AwsRegion = o.task.AwsRegions[0]
+	}
+
+	registryAliases, err := core.ParseKeyValueList(o.registryAliasesStr)
+	if err != nil {
+		return fmt.Errorf("Invalid registry aliases: %v", err)
+	}
+
+	repositoryRoles, err := core.ParseKeyValueList(o.repoRolesStr)
+	if err != nil {
+		return fmt.Errorf("Invalid repository roles: %v", err)
+	}
+
+	// The registry being cleaned up is resolved from a single AWS account
+	if len(repositoryRoles) > 0 && o.task.MatchRegistryOnly {
+		return fmt.Errorf("Cannot use -match-registry-only along with -repo-roles")
+	}
+
+	remoteClusters, err := core.ParseRemoteClusters(o.remoteClustersStr)
+	if err != nil {
+		return fmt.Errorf("Invalid remote clusters: %v", err)
+	}
+
+	customWorkloads, err := core.ParseCustomWorkloads(o.customWorkloadsStr)
+	if err != nil {
+		return fmt.Errorf("Invalid custom workloads: %v", err)
+	}
+
+	gitOpsRepos, err := core.ParseGitRepositories(o.gitOpsReposStr)
+	if err != nil {
+		return fmt.Errorf("Invalid GitOps repos: %v", err)
+	}
+	if o.task.GitTokenPath != "" && len(gitOpsRepos) == 0 {
+		return fmt.Errorf("Cannot use -gitops-token-file without -gitops-repos")
+	}
+
+	if o.task.SkipReplicatedRepositories && o.task.AllowReplicatedRepositories {
+		return fmt.Errorf("Cannot use -skip-replicated along with -allow-replicated")
+	}
+
+	if o.task.OrphanedRepositoryDays < 0 {
+		return fmt.Errorf("Invalid -orphaned-repo-days %d, must not be negative", o.task.OrphanedRepositoryDays)
+	}
+	if o.task.DeleteEmptyRepositories && o.task.OrphanedRepositoryDays == 0 {
+		return fmt.Errorf("Cannot use -delete-empty-repos without -orphaned-repo-days")
+	}
+	if o.task.DeleteEmptyRepositories && !o.task.DiscoverRepositories {
+		return fmt.Errorf("Cannot use -delete-empty-repos without -discover-repos")
+	}
+
+	if o.task.ImageTagStatus != "" && o.task.ImageTagStatus != core.ImageTagStatusTagged && o.task.ImageTagStatus != core.ImageTagStatusUntagged {
+		return fmt.Errorf("Invalid -image-tag-status '%s', must be 'tagged' or 'untagged'", o.task.ImageTagStatus)
+	}
+	if o.task.ImageTagStatus == core.ImageTagStatusUntagged && o.task.ProtectManifestListChildren {
+		return fmt.Errorf("Cannot use -image-tag-status 'untagged' along with -protect-manifest-list-children, as the tagged manifest lists referencing untagged images are not listed; set -protect-manifest-list-children=false if no repos hold multi-arch images")
+	}
+	if o.task.ImageTagStatus != "" && o.task.OrphanedRepositoryDays > 0 {
+		return fmt.Errorf("Cannot use -orphaned-repo-days along with -image-tag-status")
+	}
+
+	if o.task.RepositoryFailureThreshold < 0 {
+		return fmt.Errorf("Invalid -repo-failure-threshold %d, must not be negative", o.task.RepositoryFailureThreshold)
+	}
+	if o.task.RepositoryFailureThreshold > 0 && o.task.RepositoryCooldown <= 0 {
+		return fmt.Errorf("Invalid -repo-cooldown %v, must be positive along with -repo-failure-threshold", o.task.RepositoryCooldown)
+	}
+	if o.task.RepositoryMaxCooldown < 0 {
+		return fmt.Errorf("Invalid -repo-max-cooldown %v, must not be negative", o.task.RepositoryMaxCooldown)
+	}
+
+	if o.task.FullResyncInterval > 0 && o.task.ImageCacheTTL <= 0 {
+		return fmt.Errorf("Cannot use -full-resync-interval without -image-cache-ttl")
+	}
+
+	if o.otlpInsecure && o.otlpEndpoint == "" {
+		return fmt.Errorf("Cannot use -otlp-insecure without -otlp-endpoint")
+	}
+
+	o.task.KubeNamespaces = namespaces
+	o.task.ExcludeNamespaces = excludeNamespaces
+	o.task.CustomWorkloads = customWorkloads
+	o.task.GitOpsRepositories = gitOpsRepos
+	o.task.RemoteClusters = remoteClusters
+	o.task.EcrRepositories = repositories
+	o.task.RegistryAliases = registryAliases
+	o.task.RepositoryRoles = repositoryRoles
+	o.task.MaxRepositorySizeBytes = int64(o.maxRepoSizeGB * (1 << 30))
+
+	return nil
+}
+
+// validateReport checks the values of the flags specific to the report
+// command.
+func (o *options) validateReport() error {
+	if o.reportOutput != "table" && o.reportOutput != "json" {
+		return fmt.Errorf("Invalid -output '%s', must be 'table' or 'json'", o.reportOutput)
+	}
+	if o.storagePricePerGBMonth < 0 {
+		return fmt.Errorf("Invalid -price-per-gb-month %v, must not be negative", o.storagePricePerGBMonth)
+	}
+	return nil
+}
+
+// validateClean checks the values of the flags specific to the clean command
+// and fills in the corresponding task fields.
+func (o *options) validateClean() error {
+	if o.dryRun && o.confirm {
+		return fmt.Errorf("Cannot use -dry-run along with -confirm")
+	}
+	o.task.DryRun = !o.confirm
+
+	if o.task.NotifyOn != core.NotifyOnAlways && o.task.NotifyOn != core.NotifyOnErrors {
+		return fmt.Errorf("Invalid -notify-on '%s', must be either '%s' or '%s'", o.task.NotifyOn, core.NotifyOnAlways, core.NotifyOnErrors)
+	}
+
+	if o.task.EventsTarget != "" {
+		if !o.task.EmitEvents {
+			return fmt.Errorf("Cannot use -events-target without -events")
+		}
+
+		if _, _, err := core.ParseEventsTarget(o.task.EventsTarget); err != nil {
+			return fmt.Errorf("Invalid -events-target: %v", err)
+		}
+	}
+
+	if o.once && o.task.LeaderElection {
+		return fmt.Errorf("Cannot use -once along with -leader-elect")
+	}
+
+	if o.scheduleStr != "" {
+		if o.once {
+			return fmt.Errorf("Cannot use -schedule along with -once")
+		}
+
+		schedule, err := core.ParseCronSchedule(o.scheduleStr)
+		if err != nil {
+			return fmt.Errorf("Invalid -schedule '%s': %v", o.scheduleStr, err)
+		}
+		o.task.Schedule = schedule
+	}
+
+	if o.task.ScheduleJitter < 0 {
+		return fmt.Errorf("Invalid -schedule-jitter %v, must not be negative", o.task.ScheduleJitter)
+	}
+
+	return nil
+}
+
+// load takes the settings not given on the command line, as parsed into the
+// given flag sets of the shared flags and of the given command, from the
+// -config file, if any, and then checks the values of the flags and fills in
+// the corresponding task fields.
+func (o *options) load(command string, shared, commandFlags *flag.FlagSet) error {
+	if o.configPath != "" {
+		config, err := core.LoadConfigFile(o.configPath)
+		if err != nil {
+			return fmt.Errorf("Cannot load -config: %v", err)
+		}
+
+		if err := applyConfig(config, shared, commandFlags); err != nil {
+			return err
+		}
+	}
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+
+	switch command {
+	case "clean":
+		return o.validateClean()
+	case "scan":
+		o.task.DryRun = true
+	case "report":
+		o.task.DryRun = true
+		return o.validateReport()
+	}
+
+	return nil
+}
+
+// applyConfig sets the flags of the given flag sets that were not given on
+// the command line to the values of the given configuration. Settings of the
+// flags specific to other commands are ignored.
+func applyConfig(config map[string][]string, shared, commandFlags *flag.FlagSet) error {
+	given := map[string]bool{}
+	for _, flags := range []*flag.FlagSet{shared, commandFlags} {
+		flags.Visit(func(f *flag.Flag) {
+			given[f.Name] = true
+		})
+	}
+
+	otherFlags := []*flag.FlagSet{
+		newCommandFlagSet("clean", newOptions(), flag.ContinueOnError),
+		newCommandFlagSet(lifecyclePolicyExportCommand, newOptions(), flag.ContinueOnError),
+		newCommandFlagSet("report", newOptions(), flag.ContinueOnError),
+	}
+	isOtherFlag := func(name string) bool {
+		for _, flags := range otherFlags {
+			if flags.Lookup(name) != nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, name := range core.ConfigSettingNames(config) {
+		if name == "config" {
+			return fmt.Errorf("Cannot set 'config' in -config")
+		}
+
+		f := shared.Lookup(name)
+		if f == nil {
+			f = commandFlags.Lookup(name)
+		}
+		if f == nil {
+			if isOtherFlag(name) {
+				continue
+			}
+			return fmt.Errorf("Unknown setting '%s' in -config", name)
+		}
+
+		if given[name] {
+			continue
+		}
+
+		if err := setFlag(f, config[name]); err != nil {
+			return fmt.Errorf("Invalid '%s' setting in -config: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// setFlag sets the given flag to the given values, one at a time for the
+// flags that may be given more than once, or as a comma-separated list
+// otherwise.
+func setFlag(f *flag.Flag, values []string) error {
+	if _, ok := f.Value.(*stringsValue); !ok {
+		return f.Value.Set(strings.Join(values, ","))
+	}
+
+	for _, value := range values {
+		if err := f.Value.Set(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compilePatterns compiles the regular expressions given by the flag with the
+// given name.
+func compilePatterns(name string, patterns []string) ([]*regexp.Regexp, error) {
+	compiled := []*regexp.Regexp{}
+	for _, pattern := range patterns {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid -%s '%s': %v", name, pattern, err)
+		}
+		compiled = append(compiled, regex)
+	}
+	return compiled, nil
 }
 
 func main() {
-	glog.Infof("Kubernetes ECR Image Cleanup Controller v%s started, will run every %d minute(s).", VERSION, task.Interval)
+	flag.Parse()
 
-	doneChan := make(chan struct{})
-	var wg sync.WaitGroup
+	command, args := commandArgs(flag.CommandLine)
 
-	for _, repo := range task.EcrRepositories {
-		glog.Infof("Will clean up '%s' repo in '%s' region.", *repo, task.AwsRegion)
+	switch command {
+	case "clean":
+		clean(args)
+	case "scan":
+		scan(args)
+	case "report":
+		report(args)
+	case "lifecycle-policy":
+		lifecyclePolicy(args)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'.\n\n", command)
+		flag.Usage()
+		os.Exit(2)
 	}
+}
 
-	for _, namespace := range task.KubeNamespaces {
-		glog.Infof("Images currently used by pods in '%s' namespace *will not* be removed.", *namespace)
+// commandArgs returns the command given after the shared flags parsed into
+// the given flag set, which defaults to clean, along with its arguments.
+func commandArgs(flags *flag.FlagSet) (string, []string) {
+	if flags.NArg() > 0 {
+		return flags.Arg(0), flags.Args()[1:]
+	}
+	return "clean", []string{}
+}
+
+// newCommandFlagSet returns the flag set holding the flags specific to the
+// given command, storing their values in the given options.
+func newCommandFlagSet(command string, o *options, errorHandling flag.ErrorHandling) *flag.FlagSet {
+	flags := flag.NewFlagSet(command, errorHandling)
+
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] %s [command flags]\n\nFlags specific to '%s':\n", os.Args[0], command, command)
+		flags.PrintDefaults()
+	}
+
+	switch command {
+	case "clean":
+		registerCleanFlags(flags, o)
+	case lifecyclePolicyExportCommand:
+		registerLifecyclePolicyFlags(flags, o)
+	case "report":
+		registerReportFlags(flags, o)
+	}
+
+	return flags
+}
+
+// parseCommand parses the flags specific to the given command from the given
+// arguments, and then loads the options of the controller, exiting if they
+// are invalid.
+func parseCommand(command string, args []string) {
+	flags := newCommandFlagSet(command, opts, flag.ExitOnError)
+	flags.Parse(args)
+
+	if err := opts.load(command, flag.CommandLine, flags); err != nil {
+		glog.Fatalf("%v, exiting.", err)
+	}
+}
+
+// scan runs a single pass that reports which images would be removed,
+// without removing them.
+func scan(args []string) {
+	parseCommand("scan", args)
+
+	glog.Infof("Kubernetes ECR Image Cleanup Controller v%s started in scan mode, no images will be removed.", VERSION)
+	logTargets()
+	startTracing()
+
+	runOnce()
+}
+
+// report runs a single pass that selects images for deletion without
+// removing them, and prints how much storage the repos take up and how much
+// of it deleting the selected images would reclaim.
+func report(args []string) {
+	parseCommand("report", args)
+
+	glog.Infof("Kubernetes ECR Image Cleanup Controller v%s started in report mode, no images will be removed.", VERSION)
+	logTargets()
+	startTracing()
+
+	result := runPass()
+
+	usageReport := core.NewUsageReport(result.Plan, opts.storagePricePerGBMonth)
+	if opts.reportOutput == "json" {
+		data, err := json.MarshalIndent(usageReport, "", "  ")
+		if err != nil {
+			glog.Fatalf("Cannot encode report: %v, exiting.", err)
+		}
+		fmt.Println(string(data))
+	} else if err := usageReport.WriteTable(os.Stdout); err != nil {
+		glog.Fatalf("Cannot write report: %v, exiting.", err)
+	}
+	stopTracing()
+	glog.Flush()
+
+	// Repos that failed are missing from the report
+	if result.Failed() {
+		os.Exit(1)
+	}
+}
+
+// lifecyclePolicy runs the lifecycle-policy commands, of which there is only
+// export, which prints the ECR lifecycle policy equivalent to the retention
+// flags, and optionally applies it to the repositories.
+func lifecyclePolicy(args []string) {
+	if len(args) == 0 || args[0] != "export" {
+		fmt.Fprintf(os.Stderr, "Unknown lifecycle-policy command, must be 'export'.\n\n")
+		flag.Usage()
+		os.Exit(2)
+	}
+	parseCommand(lifecyclePolicyExportCommand, args[1:])
+
+	policy, untranslated := task.LifecyclePolicy()
+	for _, caveat := range core.LifecyclePolicyCaveats {
+		glog.Warningf("Unlike the controller, with the lifecycle policy %s.", caveat)
+	}
+	for _, setting := range untranslated {
+		glog.Warningf("Cannot translate %s into the lifecycle policy, leaving it out.", setting)
+	}
+	fmt.Println(policy)
+
+	if !opts.applyLifecyclePolicy {
+		glog.Flush()
+		return
+	}
+
+	if len(untranslated) > 0 && !opts.allowPartialLifecyclePolicy {
+		glog.Fatalf("Not applying a lifecycle policy leaving out %d of the retention flags without -allow-partial, exiting.", len(untranslated))
+	}
+
+	if _, err := core.CheckAWSCredentials(task.AwsAuth, task.AwsRegion); err != nil {
+		glog.Fatalf("Cannot resolve AWS credentials: %v, exiting.", err)
+	}
+
+	if err := task.VerifyAccount(core.NewSTSClient(task.AwsAuth, task.AwsRegion, task.AssumeRoleARN)); err != nil {
+		glog.Fatalf("Cannot verify AWS account: %v, exiting.", err)
+	}
+
+	ecrClients, err := task.NewECRClients()
+	if err != nil {
+		glog.Fatalf("%v, exiting.", err)
+	}
+
+	if err := task.ApplyLifecyclePolicy(ecrClients, policy); err != nil {
+		glog.Fatalf("%v, exiting.", err)
+	}
+	glog.Flush()
+}
+
+// runOnce runs a single pass right away, as per `runPass`, and exits with a
+// non-zero code if it failed.
+func runOnce() {
+	result := runPass()
+	stopTracing()
+	glog.Flush()
+
+	// All regions are processed regardless, so that a failing region doesn't
+	// hide the outcome of the others
+	if result.Failed() {
+		os.Exit(1)
+	}
+}
+
+// runPass runs a single pass right away, which is canceled if a shutdown
+// signal is received, and logs its outcome.
+func runPass() *core.ReconcileResult {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signalChan
+		glog.Info("Shutdown signal received, canceling the pass...")
+		cancel()
+	}()
+
+	result := task.RunOnceContext(ctx)
+	for _, err := range result.Errors {
+		glog.Error(err)
+	}
+
+	for _, region := range result.Regions {
+		switch {
+		case region.Failed() && task.DryRun:
+			glog.Errorf("Region '%s' failed: scanned %d repos, %d images would be removed, %d errors.", region.Region, region.RepositoriesProcessed, region.ImagesSelected, len(region.Errors))
+		case region.Failed():
+			glog.Errorf("Region '%s' failed: processed %d repos, removed %d images, %d errors.", region.Region, region.RepositoriesProcessed, region.ImagesDeleted, len(region.Errors))
+		case task.DryRun:
+			glog.Infof("Region '%s' succeeded: scanned %d repos, %d images would be removed.", region.Region, region.RepositoriesProcessed, region.ImagesSelected)
+		default:
+			glog.Infof("Region '%s' succeeded: processed %d repos, removed %d images.", region.Region, region.RepositoriesProcessed, region.ImagesDeleted)
+		}
+	}
+
+	if task.DryRun {
+		glog.Infof("Scanned %d repos, %d images would be removed.", result.RepositoriesProcessed, result.ImagesSelected)
+	} else {
+		glog.Infof("Processed %d repos, removed %d images.", result.RepositoriesProcessed, result.ImagesDeleted)
 	}
 
+	return result
+}
+
+// clean periodically removes old unused images until a shutdown signal is
+// received.
+func clean(args []string) {
+	parseCommand("clean", args)
+
+	if opts.once {
+		glog.Infof("Kubernetes ECR Image Cleanup Controller v%s started, will run a single pass.", VERSION)
+	} else if task.Schedule != nil {
+		glog.Infof("Kubernetes ECR Image Cleanup Controller v%s started, will run on schedule '%s'.", VERSION, task.Schedule)
+	} else {
+		glog.Infof("Kubernetes ECR Image Cleanup Controller v%s started, will run every %d minute(s).", VERSION, task.Interval)
+	}
+	if task.ScheduleJitter > 0 && !opts.once {
+		glog.Infof("Each pass will be delayed by up to %v.", task.ScheduleJitter)
+	}
+	if task.DryRun {
+		glog.Warningf("Running without -confirm, no images will be removed; images that would be removed are only reported.")
+	} else {
+		glog.Infof("Running with -confirm, old unused images *will* be removed.")
+	}
+	logTargets()
+	startTracing()
+
+	if opts.once {
+		runOnce()
+		return
+	}
+
+	if opts.metricsAddress != "" {
+		go serveMetrics(opts.metricsAddress)
+	}
+
+	doneChan := make(chan struct{})
+	var wg sync.WaitGroup
+
 	wg.Add(1)
-	task.ImageCleanupLoop(doneChan, &wg)
+	if err := task.ImageCleanupLoop(doneChan, &wg); err != nil {
+		glog.Fatal(err)
+	}
+
+	if opts.configPath != "" {
+		go watchConfig(opts.configPath)
+	}
 
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 	for {
 		select {
 		case <-signalChan:
-			glog.Info("Shutdown signal received, exiting...")
+			glog.Info("Shutdown signal received, canceling the running pass, if any...")
 			close(doneChan)
-			wg.Wait()
-			os.Exit(0)
+			shutdown(&wg, opts.shutdownTimeout)
 		}
 	}
 }
+
+// shutdown waits for the given goroutines of the clean-up loop to stop, up to
+// the given timeout, and then exits once the logs are flushed, with a non-zero
+// code if they did not stop in time.
+func shutdown(wg *sync.WaitGroup, timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		glog.Info("Stopped, exiting...")
+		stopTracing()
+		glog.Flush()
+		os.Exit(0)
+	case <-time.After(timeout):
+		glog.Errorf("Running pass did not stop within %v, exiting anyway.", timeout)
+		stopTracing()
+		glog.Flush()
+		os.Exit(1)
+	}
+}
+
+// watchConfig reloads the settings of the controller whenever a SIGHUP is
+// received or the file in the given path changes, which is checked every
+// `configCheckInterval`. Settings that cannot be loaded are logged, and the
+// current ones are kept.
+func watchConfig(path string) {
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+	ticker := time.NewTicker(configCheckInterval)
+	defer ticker.Stop()
+
+	lastModified := configModTime(path)
+	for {
+		select {
+		case <-hupChan:
+			glog.Infof("SIGHUP received, reloading '%s'.", path)
+		case <-ticker.C:
+			if configModTime(path).Equal(lastModified) {
+				continue
+			}
+			glog.Infof("'%s' changed, reloading it.", path)
+		}
+		lastModified = configModTime(path)
+
+		reloaded, err := reloadOptions()
+		if err != nil {
+			glog.Errorf("Cannot reload settings, keeping the current ones: %v", err)
+			continue
+		}
+
+		if err := task.Reload(reloaded.task); err != nil {
+			glog.Errorf("Cannot reload settings, keeping the current ones: %v", err)
+		}
+	}
+}
+
+// configModTime returns the time the file in the given path was last
+// modified, or the zero time if it cannot be found.
+func configModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reloadOptions parses the command line again into new options, taking the
+// settings not given on it from the current contents of the -config file.
+func reloadOptions() (*options, error) {
+	reloaded := newOptions()
+
+	shared := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	shared.SetOutput(ioutil.Discard)
+	registerSharedFlags(shared, reloaded)
+
+	// Flags registered by the libraries, such as the ones of glog, are set
+	// again as they were at startup
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		if shared.Lookup(f.Name) == nil {
+			shared.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+
+	if err := shared.Parse(os.Args[1:]); err != nil {
+		return nil, err
+	}
+
+	command, args := commandArgs(shared)
+	commandFlags := newCommandFlagSet(command, reloaded, flag.ContinueOnError)
+	commandFlags.SetOutput(ioutil.Discard)
+
+	if err := commandFlags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	return reloaded, reloaded.load(command, shared, commandFlags)
+}
+
+// startTracing sets the global tracer provider to one exporting the spans of
+// the passes to -otlp-endpoint, if given, exiting if it cannot be set up.
+func startTracing() {
+	if opts.otlpEndpoint == "" {
+		return
+	}
+
+	provider, err := core.NewTracerProvider(opts.otlpEndpoint, opts.otlpInsecure)
+	if err != nil {
+		glog.Fatalf("Cannot set up tracing: %v, exiting.", err)
+	}
+	otel.SetTracerProvider(provider)
+	tracerProvider = provider
+
+	glog.Infof("Exporting traces to %s.", opts.otlpEndpoint)
+}
+
+// stopTracing exports the spans yet to be exported, if tracing was set up,
+// waiting for up to `tracingShutdownTimeout`.
+func stopTracing() {
+	if tracerProvider == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		glog.Warningf("Cannot export the remaining spans: %v", err)
+	}
+}
+
+// serveMetrics exposes the Prometheus metrics at /metrics, along with the
+// liveness and readiness probes at /healthz and /readyz, on the given
+// address, exiting if the address cannot be listened on.
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", task.HealthzHandler())
+	mux.Handle("/readyz", task.ReadyzHandler())
+
+	glog.Infof("Exposing Prometheus metrics at http://%s/metrics.", address)
+	glog.Fatal(http.ListenAndServe(address, mux))
+}
+
+// logTargets logs which repositories will be cleaned up, and which
+// namespaces will be looked at to find out which images are in use.
+func logTargets() {
+	regions := task.AwsRegions
+	if len(regions) == 0 {
+		regions = []string{task.AwsRegion}
+	}
+
+	for _, region := range regions {
+		if task.DiscoverRepositories {
+			glog.Infof("Will clean up the repos discovered in '%s' region.", region)
+		}
+		for _, repo := range task.EcrRepositories {
+			glog.Infof("Will clean up '%s' repo in '%s' region.", *repo, region)
+		}
+	}
+
+	for _, namespace := range task.KubeNamespaces {
+		if core.IsNamespacePattern(*namespace) {
+			glog.Infof("Images currently used by pods in namespaces matching '%s' *will not* be removed.", *namespace)
+			continue
+		}
+		glog.Infof("Images currently used by pods in '%s' namespace *will not* be removed.", *namespace)
+	}
+
+	for _, namespace := range task.ExcludeNamespaces {
+		glog.Infof("Images only used by pods in namespaces matching '%s' *may* be removed.", *namespace)
+	}
+
+	for _, repo := range task.GitOpsRepositories {
+		glog.Infof("Images referenced by the manifests of '%s' Git repo *will not* be removed.", repo)
+	}
+}
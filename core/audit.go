@@ -0,0 +1,205 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// AuditRecord describes an image deleted by the controller.
+type AuditRecord struct {
+	Region      string    `json:"region,omitempty"`
+	Repository  string    `json:"repository"`
+	Digest      string    `json:"digest"`
+	Tags        []string  `json:"tags,omitempty"`
+	SizeInBytes *int64    `json:"sizeInBytes,omitempty"`
+	DeletedAt   time.Time `json:"deletedAt"`
+	ReconcileID string    `json:"reconcileId"`
+
+	// Why the image was deleted, such as `DeleteReasonKeepMax`.
+	Reason string `json:"reason,omitempty"`
+
+	// Cleanup policy applied to the repository, if any.
+	Policy string `json:"policy,omitempty"`
+}
+
+// repositoryAudit is what goes into the audit records of the images deleted
+// from a repository, besides the images themselves.
+type repositoryAudit struct {
+	policy string
+
+	// Reasons why the images are deleted, by digest
+	reasons map[string]string
+}
+
+// AuditSink defines the expected interface of any object capable of keeping
+// a long-term record of the images deleted by the controller.
+type AuditSink interface {
+	RecordDeletions(records []AuditRecord) error
+}
+
+// noopAuditSink is the default audit sink, which records nothing.
+type noopAuditSink struct{}
+
+func (noopAuditSink) RecordDeletions(records []AuditRecord) error {
+	return nil
+}
+
+// auditSink returns the audit sink of this task, falling back to one that
+// records nothing.
+func (t *CleanupTask) auditSink() AuditSink {
+	if t.AuditSink == nil {
+		return noopAuditSink{}
+	}
+	return t.AuditSink
+}
+
+// MultiAuditSink records the deleted images in several sinks, such as an S3
+// bucket and a local file, stopping at the first one that fails.
+type MultiAuditSink []AuditSink
+
+func (m MultiAuditSink) RecordDeletions(records []AuditRecord) error {
+	for _, sink := range m {
+		if err := sink.RecordDeletions(records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewAuditRecords returns the audit records for the given images, deleted from
+// the given repository of the given region, to which the given policy applies,
+// at the given time during the given pass. The reasons why the images were
+// deleted are looked up in the given map, by digest.
+func NewAuditRecords(region, repoName string, images []*ecr.ImageDetail, policy string, reasons map[string]string, deletedAt time.Time, reconcileID string) []AuditRecord {
+	records := make([]AuditRecord, len(images))
+
+	for i, image := range images {
+		digest := aws.StringValue(image.ImageDigest)
+		records[i] = AuditRecord{
+			Region:      region,
+			Repository:  repoName,
+			Digest:      digest,
+			Tags:        aws.StringValueSlice(image.ImageTags),
+			SizeInBytes: image.ImageSizeInBytes,
+			DeletedAt:   deletedAt.UTC(),
+			ReconcileID: reconcileID,
+			Reason:      reasons[digest],
+			Policy:      policy,
+		}
+	}
+
+	return records
+}
+
+// encodeAuditRecords returns the given audit records as JSON lines.
+func encodeAuditRecords(records []AuditRecord) ([]byte, error) {
+	body := &bytes.Buffer{}
+	encoder := json.NewEncoder(body)
+
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return nil, err
+		}
+	}
+
+	return body.Bytes(), nil
+}
+
+type S3AuditSinkImpl struct {
+	S3Client s3iface.S3API
+
+	// Bucket in which the audit records are stored.
+	Bucket string
+
+	// Prefix of the keys under which the audit records are stored.
+	Prefix string
+}
+
+// NewS3AuditSink returns a new audit sink storing the audit records in the
+// given S3 bucket, using the same credentials as the ECR client.
+func NewS3AuditSink(auth AWSAuth, region, bucket, prefix string) *S3AuditSinkImpl {
+	return &S3AuditSinkImpl{
+		S3Client: s3.New(newAWSSession(auth, region)),
+		Bucket:   bucket,
+		Prefix:   prefix,
+	}
+}
+
+// RecordDeletions stores the given audit records as JSON lines. Since S3
+// objects cannot be appended to, each batch of records is stored in an object
+// of its own, whose key starts with the deletion time, so that listing the
+// objects lists the records in order. All records in a batch are expected to
+// belong to the same pass and repository.
+func (s *S3AuditSinkImpl) RecordDeletions(records []AuditRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	body, err := encodeAuditRecords(records)
+	if err != nil {
+		return err
+	}
+
+	first := records[0]
+	key := fmt.Sprintf("%s%s-%s-%s.jsonl", s.Prefix, first.DeletedAt.Format("20060102T150405.000000000Z"), first.ReconcileID, strings.Replace(first.Repository, "/", "_", -1))
+
+	_, err = s.S3Client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/x-ndjson"),
+	})
+
+	return err
+}
+
+type FileAuditSinkImpl struct {
+	// Path of the file the audit records are appended to, such as a file on
+	// a persistent volume.
+	Path string
+}
+
+// NewFileAuditSink returns a new audit sink appending the audit records to
+// the file at the given path, which is created if needed.
+func NewFileAuditSink(path string) *FileAuditSinkImpl {
+	return &FileAuditSinkImpl{Path: path}
+}
+
+// RecordDeletions appends the given audit records to the file as JSON lines,
+// in a single write, and makes sure they reach the disk before returning.
+func (f *FileAuditSinkImpl) RecordDeletions(records []AuditRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	body, err := encodeAuditRecords(records)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(body); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
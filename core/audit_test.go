@@ -0,0 +1,218 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// mockAWSS3Client is used to verify that the S3 client is being called with
+// the correct arguments, and that the return values are being handled
+// correctly by its consumers.
+type mockAWSS3Client struct {
+	t *testing.T
+	s3iface.S3API
+
+	putObjectInputs []*s3.PutObjectInput
+	putObjectBodies []string
+	putObjectError  error
+}
+
+func (m *mockAWSS3Client) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+
+	m.putObjectInputs = append(m.putObjectInputs, input)
+	m.putObjectBodies = append(m.putObjectBodies, string(body))
+
+	return &s3.PutObjectOutput{}, m.putObjectError
+}
+
+// mockAuditSink records the audit records given to it.
+type mockAuditSink struct {
+	records []AuditRecord
+
+	recordDeletionsError error
+}
+
+func (m *mockAuditSink) RecordDeletions(records []AuditRecord) error {
+	m.records = append(m.records, records...)
+	return m.recordDeletionsError
+}
+
+func TestNewAuditRecords(t *testing.T) {
+	digest, tag, size := "digest-1", "tag-1", int64(1024)
+	deletedAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.FixedZone("BRT", -3*60*60))
+
+	records := NewAuditRecords("us-east-1", "team/repo", []*ecr.ImageDetail{
+		{
+			ImageDigest:      &digest,
+			ImageTags:        []*string{&tag},
+			ImageSizeInBytes: &size,
+		},
+	}, "namespace/policy", map[string]string{digest: DeleteReasonMaxAge}, deletedAt, "reconcile-1")
+
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 record, but got %d", len(records))
+	}
+
+	record := records[0]
+	if record.Region != "us-east-1" || record.Repository != "team/repo" || record.Digest != digest || record.ReconcileID != "reconcile-1" || record.Reason != DeleteReasonMaxAge || record.Policy != "namespace/policy" {
+		t.Errorf("Unexpected record: %+v", record)
+	}
+	if len(record.Tags) != 1 || record.Tags[0] != tag {
+		t.Errorf("Expected record tags to be [%s], but were %v", tag, record.Tags)
+	}
+	if record.SizeInBytes == nil || *record.SizeInBytes != size {
+		t.Errorf("Expected record size to be %d, but was %v", size, record.SizeInBytes)
+	}
+	if record.DeletedAt.Location() != time.UTC || !record.DeletedAt.Equal(deletedAt) {
+		t.Errorf("Expected record deletion time to be %v in UTC, but was %v", deletedAt, record.DeletedAt)
+	}
+}
+
+func TestS3AuditSinkRecordDeletions(t *testing.T) {
+	client := &mockAWSS3Client{t: t}
+	sink := &S3AuditSinkImpl{
+		S3Client: client,
+		Bucket:   "bucket",
+		Prefix:   "audit/",
+	}
+
+	deletedAt := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	records := []AuditRecord{
+		{Repository: "team/repo", Digest: "digest-1", DeletedAt: deletedAt, ReconcileID: "reconcile-1"},
+		{Repository: "team/repo", Digest: "digest-2", DeletedAt: deletedAt, ReconcileID: "reconcile-1"},
+	}
+
+	if err := sink.RecordDeletions(records); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	if len(client.putObjectInputs) != 1 {
+		t.Fatalf("Expected 1 object to be put, but got %d", len(client.putObjectInputs))
+	}
+
+	input := client.putObjectInputs[0]
+	if aws.StringValue(input.Bucket) != "bucket" {
+		t.Errorf("Expected bucket to be 'bucket', but was '%s'", aws.StringValue(input.Bucket))
+	}
+
+	expectedKey := "audit/20200102T030405.000000006Z-reconcile-1-team_repo.jsonl"
+	if aws.StringValue(input.Key) != expectedKey {
+		t.Errorf("Expected key to be '%s', but was '%s'", expectedKey, aws.StringValue(input.Key))
+	}
+
+	lines := strings.Split(strings.TrimSpace(client.putObjectBodies[0]), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 JSON lines, but got %q", lines)
+	}
+
+	for i, line := range lines {
+		record := AuditRecord{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Cannot parse line %d: %v", i, err)
+		}
+		if record.Digest != records[i].Digest {
+			t.Errorf("Expected line %d digest to be '%s', but was '%s'", i, records[i].Digest, record.Digest)
+		}
+	}
+}
+
+func TestS3AuditSinkRecordDeletionsWithoutRecords(t *testing.T) {
+	sink := &S3AuditSinkImpl{
+		S3Client: nil, // Should not interact with the S3 client
+	}
+
+	if err := sink.RecordDeletions([]AuditRecord{}); err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+}
+
+func TestS3AuditSinkRecordDeletionsError(t *testing.T) {
+	sink := &S3AuditSinkImpl{
+		S3Client: &mockAWSS3Client{
+			t: t,
+
+			putObjectError: fmt.Errorf(""),
+		},
+	}
+
+	if err := sink.RecordDeletions([]AuditRecord{{Digest: "digest-1"}}); err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+}
+
+func TestFileAuditSinkRecordDeletions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink := NewFileAuditSink(filepath.Join(dir, "audit.jsonl"))
+
+	batches := [][]AuditRecord{
+		{{Repository: "repo", Digest: "digest-1"}, {Repository: "repo", Digest: "digest-2"}},
+		{},
+		{{Repository: "repo", Digest: "digest-3"}},
+	}
+
+	for _, records := range batches {
+		if err := sink.RecordDeletions(records); err != nil {
+			t.Fatalf("Expected error to be nil, but was %v", err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(sink.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 JSON lines, but got %q", lines)
+	}
+
+	for i, line := range lines {
+		record := AuditRecord{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Cannot parse line %d: %v", i, err)
+		}
+		if expected := fmt.Sprintf("digest-%d", i+1); record.Digest != expected {
+			t.Errorf("Expected line %d digest to be '%s', but was '%s'", i, expected, record.Digest)
+		}
+	}
+}
+
+func TestFileAuditSinkRecordDeletionsError(t *testing.T) {
+	sink := NewFileAuditSink(filepath.Join("non-existent-dir", "audit.jsonl"))
+
+	if err := sink.RecordDeletions([]AuditRecord{{Digest: "digest-1"}}); err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+}
+
+func TestMultiAuditSinkRecordDeletions(t *testing.T) {
+	first, failing, last := &mockAuditSink{}, &mockAuditSink{recordDeletionsError: fmt.Errorf("")}, &mockAuditSink{}
+
+	if err := (MultiAuditSink{first, failing, last}).RecordDeletions([]AuditRecord{{Digest: "digest-1"}}); err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+
+	if len(first.records) != 1 || len(failing.records) != 1 || len(last.records) != 0 {
+		t.Errorf("Expected the records to be recorded up to the failing sink, but got %+v, %+v and %+v", first.records, failing.records, last.records)
+	}
+}
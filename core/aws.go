@@ -0,0 +1,196 @@
+package core
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+	// Sources of the AWS credentials. With `AwsAuthModeAuto`, the first one
+	// among the environment variables, the web identity token file, the
+	// shared credentials file and the ECS or EC2 metadata endpoints that
+	// provides credentials is used.
+	AwsAuthModeAuto        = "auto"
+	AwsAuthModeEnv         = "env"
+	AwsAuthModeProfile     = "profile"
+	AwsAuthModeWebIdentity = "web-identity"
+	AwsAuthModeEC2         = "ec2"
+	AwsAuthModeECS         = "ecs"
+
+	// Name of the sessions of the role assumed with the web identity token
+	awsWebIdentitySessionName = "kube-ecr-cleanup-controller"
+
+	// Endpoint serving the credentials of ECS tasks, as per the
+	// AWS_CONTAINER_CREDENTIALS_RELATIVE_URI environment variable
+	ecsCredentialsHost = "http://169.254.170.2"
+)
+
+// AWSAuth tells where the AWS credentials used to talk to AWS come from.
+type AWSAuth struct {
+	// One of the `AwsAuthMode*` constants. Empty means `AwsAuthModeAuto`.
+	Mode string
+
+	// Profile of the shared credentials file, falling back to the
+	// AWS_PROFILE environment variable, then to the default profile.
+	Profile string
+
+	// Web identity token file and IAM role to assume with it, such as the
+	// ones of IAM Roles for Service Accounts (IRSA), falling back to the
+	// AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN environment variables
+	// set by EKS.
+	WebIdentityTokenFile string
+	WebIdentityRoleARN   string
+}
+
+// mode returns the mode of the auth, defaulting to `AwsAuthModeAuto`.
+func (a AWSAuth) mode() string {
+	if a.Mode == "" {
+		return AwsAuthModeAuto
+	}
+	return a.Mode
+}
+
+// webIdentity returns the web identity token file and the role to assume
+// with it, falling back to the environment variables.
+func (a AWSAuth) webIdentity() (string, string) {
+	tokenFile, roleARN := a.WebIdentityTokenFile, a.WebIdentityRoleARN
+	if tokenFile == "" {
+		tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	if roleARN == "" {
+		roleARN = os.Getenv("AWS_ROLE_ARN")
+	}
+	return tokenFile, roleARN
+}
+
+// ecsCredentialsEndpoint returns the endpoint serving the credentials of the
+// ECS task, and the authorization token to send to it, as given by the
+// environment variables set by ECS, or an empty endpoint if none is set.
+func ecsCredentialsEndpoint() (string, string) {
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		return ecsCredentialsHost + uri, ""
+	}
+	return os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"), os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+}
+
+// Validate makes sure the mode is known and that whatever it requires is
+// there, so that misconfigured credentials are reported at startup rather
+// than by the first request to AWS.
+func (a AWSAuth) Validate() error {
+	switch a.mode() {
+	case AwsAuthModeAuto, AwsAuthModeEnv, AwsAuthModeProfile, AwsAuthModeEC2:
+	case AwsAuthModeWebIdentity:
+		tokenFile, roleARN := a.webIdentity()
+		if tokenFile == "" || roleARN == "" {
+			return fmt.Errorf("Auth mode '%s' requires both a web identity token file and an IAM role ARN, neither of which may be empty", AwsAuthModeWebIdentity)
+		}
+		if _, err := os.Stat(tokenFile); err != nil {
+			return fmt.Errorf("Cannot read web identity token file: %v", err)
+		}
+	case AwsAuthModeECS:
+		if endpoint, _ := ecsCredentialsEndpoint(); endpoint == "" {
+			return fmt.Errorf("Auth mode '%s' requires the AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or AWS_CONTAINER_CREDENTIALS_FULL_URI environment variable", AwsAuthModeECS)
+		}
+	default:
+		return fmt.Errorf("Unknown auth mode '%s'", a.Mode)
+	}
+
+	return nil
+}
+
+// providers returns the providers the credentials are retrieved from for the
+// given region, in order.
+func (a AWSAuth) providers(region string) []credentials.Provider {
+	env := &credentials.EnvProvider{}
+	shared := &credentials.SharedCredentialsProvider{Profile: a.Profile}
+
+	webIdentity := func(tokenFile, roleARN string) credentials.Provider {
+		// The token is the only credential needed to assume the role
+		sess := session.New(aws.NewConfig().WithRegion(region).WithCredentials(credentials.AnonymousCredentials))
+		return stscreds.NewWebIdentityRoleProvider(sts.New(sess), roleARN, awsWebIdentitySessionName, tokenFile)
+	}
+
+	switch a.mode() {
+	case AwsAuthModeEnv:
+		return []credentials.Provider{env}
+	case AwsAuthModeProfile:
+		return []credentials.Provider{shared}
+	case AwsAuthModeWebIdentity:
+		return []credentials.Provider{webIdentity(a.webIdentity())}
+	case AwsAuthModeEC2:
+		return []credentials.Provider{&ec2rolecreds.EC2RoleProvider{
+			Client: ec2metadata.New(session.New(aws.NewConfig().WithRegion(region))),
+		}}
+	case AwsAuthModeECS:
+		return []credentials.Provider{defaults.RemoteCredProvider(*defaults.Config().WithRegion(region), defaults.Handlers())}
+	}
+
+	providers := []credentials.Provider{env}
+	if tokenFile, roleARN := a.webIdentity(); tokenFile != "" && roleARN != "" {
+		providers = append(providers, webIdentity(tokenFile, roleARN))
+	}
+
+	// The ECS endpoint is used if its environment variables are set, and the
+	// EC2 instance metadata endpoint otherwise
+	return append(providers, shared, defaults.RemoteCredProvider(*defaults.Config().WithRegion(region), defaults.Handlers()))
+}
+
+// newAWSSession returns a new AWS session for the given region, whose
+// credentials are retrieved as per the given auth.
+func newAWSSession(auth AWSAuth, region string) *session.Session {
+	creds := credentials.NewCredentials(&credentials.ChainProvider{
+		Providers: auth.providers(region),
+
+		// Tells why each of the providers failed to provide credentials
+		VerboseErrors: true,
+	})
+
+	awsConfig := aws.NewConfig()
+	awsConfig.WithCredentials(creds)
+	awsConfig.WithRegion(region)
+
+	return session.New(awsConfig)
+}
+
+// newAssumeRoleSession returns a new AWS session for the given region whose
+// credentials are obtained by assuming the given IAM role with the
+// credentials of `newAWSSession`. The credentials are refreshed automatically
+// before they expire. If roleARN is empty, the session returned by
+// `newAWSSession` is used as is.
+func newAssumeRoleSession(auth AWSAuth, region, roleARN string) *session.Session {
+	sess := newAWSSession(auth, region)
+	if roleARN == "" {
+		return sess
+	}
+
+	awsConfig := aws.NewConfig()
+	awsConfig.WithCredentials(stscreds.NewCredentials(sess, roleARN))
+	awsConfig.WithRegion(region)
+
+	return session.New(awsConfig)
+}
+
+// CheckAWSCredentials makes sure AWS credentials can be retrieved as per the
+// given auth, before assuming any role, so that the controller fails at
+// startup with the reason why rather than in each pass. The name of the
+// provider of the credentials is returned.
+func CheckAWSCredentials(auth AWSAuth, region string) (string, error) {
+	if err := auth.Validate(); err != nil {
+		return "", err
+	}
+
+	value, err := newAWSSession(auth, region).Config.Credentials.Get()
+	if err != nil {
+		return "", fmt.Errorf("No credentials found with '%s' auth mode: %v", auth.mode(), err)
+	}
+	return value.ProviderName, nil
+}
@@ -0,0 +1,153 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+)
+
+// setenv sets the given environment variables, or unsets the ones whose value
+// is empty, and returns a function restoring their previous values.
+func setenv(vars map[string]string) func() {
+	previous := map[string]string{}
+	for name, value := range vars {
+		previous[name] = os.Getenv(name)
+		if value == "" {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, value)
+		}
+	}
+
+	return func() {
+		for name, value := range previous {
+			if value == "" {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, value)
+			}
+		}
+	}
+}
+
+func TestAWSAuthValidate(t *testing.T) {
+	tokenFile, err := ioutil.TempFile("", "token")
+	if err != nil {
+		t.Fatalf("Cannot create token file: %v", err)
+	}
+	defer os.Remove(tokenFile.Name())
+	tokenFile.Close()
+
+	defer setenv(map[string]string{
+		"AWS_WEB_IDENTITY_TOKEN_FILE":            "",
+		"AWS_ROLE_ARN":                           "",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "",
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI":     "",
+	})()
+
+	roleARN := "arn:aws:iam::111111111111:role/cleanup"
+
+	testCases := []struct {
+		auth AWSAuth
+		env  map[string]string
+		err  bool
+	}{
+		{auth: AWSAuth{}},
+		{auth: AWSAuth{Mode: AwsAuthModeProfile, Profile: "cleanup"}},
+		{auth: AWSAuth{Mode: "vault"}, err: true},
+
+		// Web identity tokens come from the flags or the variables set by IRSA
+		{auth: AWSAuth{Mode: AwsAuthModeWebIdentity, WebIdentityTokenFile: tokenFile.Name(), WebIdentityRoleARN: roleARN}},
+		{auth: AWSAuth{Mode: AwsAuthModeWebIdentity}, env: map[string]string{"AWS_WEB_IDENTITY_TOKEN_FILE": tokenFile.Name(), "AWS_ROLE_ARN": roleARN}},
+		{auth: AWSAuth{Mode: AwsAuthModeWebIdentity, WebIdentityTokenFile: tokenFile.Name()}, err: true},
+		{auth: AWSAuth{Mode: AwsAuthModeWebIdentity, WebIdentityTokenFile: tokenFile.Name() + ".missing", WebIdentityRoleARN: roleARN}, err: true},
+
+		{auth: AWSAuth{Mode: AwsAuthModeECS}, err: true},
+		{auth: AWSAuth{Mode: AwsAuthModeECS}, env: map[string]string{"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "/v2/credentials/id"}},
+	}
+
+	for i, testCase := range testCases {
+		restore := setenv(testCase.env)
+		err := testCase.auth.Validate()
+		restore()
+
+		if testCase.err && err == nil {
+			t.Errorf("Test case %d: expected an error, but got none", i)
+		} else if !testCase.err && err != nil {
+			t.Errorf("Test case %d: expected no error, but got %v", i, err)
+		}
+	}
+}
+
+func TestAWSAuthProviders(t *testing.T) {
+	defer setenv(map[string]string{
+		"AWS_WEB_IDENTITY_TOKEN_FILE":            "",
+		"AWS_ROLE_ARN":                           "",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "",
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI":     "",
+	})()
+
+	providerTypes := func(auth AWSAuth) []string {
+		types := []string{}
+		for _, provider := range auth.providers("us-east-1") {
+			types = append(types, reflect.TypeOf(provider).String())
+		}
+		return types
+	}
+
+	envType := reflect.TypeOf(&credentials.EnvProvider{}).String()
+	sharedType := reflect.TypeOf(&credentials.SharedCredentialsProvider{}).String()
+	webIdentityType := reflect.TypeOf(&stscreds.WebIdentityRoleProvider{}).String()
+	ec2Type := reflect.TypeOf(&ec2rolecreds.EC2RoleProvider{}).String()
+
+	testCases := []struct {
+		auth     AWSAuth
+		env      map[string]string
+		expected []string
+	}{
+		{AWSAuth{Mode: AwsAuthModeEnv}, nil, []string{envType}},
+		{AWSAuth{Mode: AwsAuthModeProfile}, nil, []string{sharedType}},
+		{AWSAuth{Mode: AwsAuthModeEC2}, nil, []string{ec2Type}},
+		{AWSAuth{Mode: AwsAuthModeWebIdentity, WebIdentityTokenFile: "/token", WebIdentityRoleARN: "role"}, nil, []string{webIdentityType}},
+
+		// The metadata endpoints come last, and web identity tokens are only
+		// looked at when IRSA is set up
+		{AWSAuth{}, nil, []string{envType, sharedType, ec2Type}},
+		{AWSAuth{}, map[string]string{"AWS_WEB_IDENTITY_TOKEN_FILE": "/token", "AWS_ROLE_ARN": "role"}, []string{envType, webIdentityType, sharedType, ec2Type}},
+	}
+
+	for i, testCase := range testCases {
+		restore := setenv(testCase.env)
+		types := providerTypes(testCase.auth)
+		restore()
+
+		if !reflect.DeepEqual(types, testCase.expected) {
+			t.Errorf("Test case %d: expected providers %v, but got %v", i, testCase.expected, types)
+		}
+	}
+}
+
+func TestCheckAWSCredentials(t *testing.T) {
+	defer setenv(map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKID",
+		"AWS_SECRET_ACCESS_KEY": "SECRET",
+	})()
+
+	provider, err := CheckAWSCredentials(AWSAuth{Mode: AwsAuthModeEnv}, "us-east-1")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if provider != credentials.EnvProviderName {
+		t.Errorf("Expected credentials to be provided by %s, but got %s", credentials.EnvProviderName, provider)
+	}
+
+	setenv(map[string]string{"AWS_ACCESS_KEY_ID": "", "AWS_SECRET_ACCESS_KEY": ""})
+	if _, err := CheckAWSCredentials(AWSAuth{Mode: AwsAuthModeEnv}, "us-east-1"); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+}
@@ -0,0 +1,150 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// repositoryBreaker keeps track of the consecutive passes each repository
+// failed in, by region and repository name, so that the repositories that
+// keep failing are suspended for a while instead of failing every pass. It is
+// safe for concurrent use.
+type repositoryBreaker struct {
+	mutex   sync.Mutex
+	entries map[string]repositoryBreakerEntry
+}
+
+// repositoryBreakerEntry is the number of consecutive passes a repository
+// failed in, and until when it is suspended, if it is.
+type repositoryBreakerEntry struct {
+	failures       int
+	suspendedUntil time.Time
+}
+
+// SuspensionDuration returns how long a repository that failed in the given
+// number of consecutive passes is suspended for: not at all below the given
+// threshold, then for the given cooldown, doubling with each further failure
+// up to the given maximum, unless it is zero.
+func SuspensionDuration(failures, threshold int, cooldown, maxCooldown time.Duration) time.Duration {
+	if threshold <= 0 || failures < threshold {
+		return 0
+	}
+
+	duration := cooldown
+	for i := threshold; i < failures; i++ {
+		if maxCooldown > 0 && duration >= maxCooldown {
+			break
+		}
+		duration *= 2
+	}
+
+	if maxCooldown > 0 && duration > maxCooldown {
+		return maxCooldown
+	}
+	return duration
+}
+
+// suspended returns until when the given repository is suspended, if it
+// still is at the given time.
+func (b *repositoryBreaker) suspended(key string, now time.Time) (time.Time, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entry, ok := b.entries[key]
+	if !ok || !now.Before(entry.suspendedUntil) {
+		return time.Time{}, false
+	}
+	return entry.suspendedUntil, true
+}
+
+// fail records that the given repository failed in another pass, suspending
+// it for as long as per `SuspensionDuration`. It returns the number of
+// consecutive passes the repository failed in, and how long it is suspended
+// for, if at all.
+func (b *repositoryBreaker) fail(key string, threshold int, cooldown, maxCooldown time.Duration, now time.Time) (int, time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.entries == nil {
+		b.entries = map[string]repositoryBreakerEntry{}
+	}
+
+	entry := b.entries[key]
+	entry.failures++
+
+	duration := SuspensionDuration(entry.failures, threshold, cooldown, maxCooldown)
+	if duration > 0 {
+		entry.suspendedUntil = now.Add(duration)
+	}
+	b.entries[key] = entry
+
+	return entry.failures, duration
+}
+
+// succeed records that the given repository was processed without failing,
+// which resets its count of consecutive failures.
+func (b *repositoryBreaker) succeed(key string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.entries, key)
+}
+
+// repositoryBreakerKey returns the key of the given repository of the given
+// region in the `repositoryBreaker`.
+func repositoryBreakerKey(region, repoName string) string {
+	return region + "/" + repoName
+}
+
+// repositoryAccessDenied tells whether the given error, which may aggregate
+// the failures of several images, means that access to the repository was
+// denied as a whole, such as by its repository policy, rather than that some
+// of its images failed.
+func repositoryAccessDenied(err error) bool {
+	switch err := err.(type) {
+	case *MultiError:
+		for _, err := range err.Errors {
+			if repositoryAccessDenied(err) {
+				return true
+			}
+		}
+		return false
+	case *RepositoryError:
+		return err.Digest == "" && repositoryAccessDenied(err.Err)
+	default:
+		return isAccessDenied(err)
+	}
+}
+
+// recordRepositoryFailures records, for each of the given repositories of the
+// given region processed in the pass, whether it failed as a whole, such as
+// because its images could not be listed. Failures of single images are not
+// counted. The repositories failing in `RepositoryFailureThreshold`
+// consecutive passes are suspended, which is logged, counted and emitted as
+// an event.
+func (t *CleanupTask) recordRepositoryFailures(region string, repoNames []string, failed map[string]bool) {
+	if t.RepositoryFailureThreshold <= 0 {
+		return
+	}
+
+	now := time.Now()
+	for _, repoName := range repoNames {
+		key := repositoryBreakerKey(region, repoName)
+		if !failed[repoName] {
+			t.repositoryFailures.succeed(key)
+			continue
+		}
+
+		failures, cooldown := t.repositoryFailures.fail(key, t.RepositoryFailureThreshold, t.RepositoryCooldown, t.RepositoryMaxCooldown, now)
+		if cooldown == 0 {
+			continue
+		}
+
+		t.log().Warningf("'%s' ECR repo in '%s' region failed in the last %d passes, suspending it for %v.", repoName, region, failures, cooldown)
+		repositorySuspensionsTotal.WithLabelValues(repoName).Inc()
+		t.emitRepositoryEvent(repoName, v1.EventTypeWarning, EventReasonRepositorySuspended, fmt.Sprintf("Suspending '%s' ECR repo in '%s' region for %v, since it failed in the last %d passes.", repoName, region, cooldown, failures))
+	}
+}
@@ -0,0 +1,233 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestSuspensionDuration(t *testing.T) {
+	testCases := []struct {
+		failures    int
+		threshold   int
+		maxCooldown time.Duration
+		expected    time.Duration
+	}{
+		{1, 0, 0, 0},
+		{2, 3, 0, 0},
+		{3, 3, 0, 10 * time.Minute},
+		{4, 3, 0, 20 * time.Minute},
+		{6, 3, 0, 80 * time.Minute},
+		{6, 3, time.Hour, time.Hour},
+		{1000, 1, time.Hour, time.Hour},
+	}
+
+	for i, testCase := range testCases {
+		cooldown := SuspensionDuration(testCase.failures, testCase.threshold, 10*time.Minute, testCase.maxCooldown)
+		if cooldown != testCase.expected {
+			t.Errorf("Test case %d: expected cooldown %v, but got %v", i, testCase.expected, cooldown)
+		}
+	}
+}
+
+func TestRepositoryBreaker(t *testing.T) {
+	breaker := &repositoryBreaker{}
+	now := time.Now()
+
+	if _, cooldown := breaker.fail("us-east-1/repo-1", 2, time.Hour, 0, now); cooldown != 0 {
+		t.Errorf("Expected no cooldown below the threshold, but got %v", cooldown)
+	}
+	if _, ok := breaker.suspended("us-east-1/repo-1", now); ok {
+		t.Errorf("Expected repo not to be suspended below the threshold")
+	}
+
+	failures, cooldown := breaker.fail("us-east-1/repo-1", 2, time.Hour, 0, now)
+	if failures != 2 || cooldown != time.Hour {
+		t.Errorf("Expected 2 failures and a 1h cooldown, but got %d and %v", failures, cooldown)
+	}
+	if until, ok := breaker.suspended("us-east-1/repo-1", now.Add(time.Minute)); !ok || !until.Equal(now.Add(time.Hour)) {
+		t.Errorf("Expected repo to be suspended for 1h, but got %v, %v", until, ok)
+	}
+	if _, ok := breaker.suspended("us-east-1/repo-1", now.Add(time.Hour)); ok {
+		t.Errorf("Expected repo not to be suspended once the cooldown is over")
+	}
+	if _, ok := breaker.suspended("eu-west-1/repo-1", now); ok {
+		t.Errorf("Expected the repo of another region not to be suspended")
+	}
+
+	// The cooldown doubles with each further failure, until a success
+	if _, cooldown := breaker.fail("us-east-1/repo-1", 2, time.Hour, 0, now); cooldown != 2*time.Hour {
+		t.Errorf("Expected a 2h cooldown, but got %v", cooldown)
+	}
+	breaker.succeed("us-east-1/repo-1")
+	if failures, _ := breaker.fail("us-east-1/repo-1", 2, time.Hour, 0, now); failures != 1 {
+		t.Errorf("Expected failures to be reset, but got %d", failures)
+	}
+}
+
+func TestRecordRepositoryFailures(t *testing.T) {
+	events := &mockEventsClient{}
+	task := &CleanupTask{
+		RepositoryFailureThreshold: 1,
+		RepositoryCooldown:         time.Hour,
+		EventsClient:               events,
+	}
+
+	task.recordRepositoryFailures("us-east-1", []string{"repo-1", "repo-2"}, map[string]bool{"repo-1": true})
+
+	if _, ok := task.repositoryFailures.suspended("us-east-1/repo-1", time.Now()); !ok {
+		t.Errorf("Expected 'repo-1' to be suspended")
+	}
+	if _, ok := task.repositoryFailures.suspended("us-east-1/repo-2", time.Now()); ok {
+		t.Errorf("Expected 'repo-2' not to be suspended")
+	}
+
+	if len(events.events) != 1 || events.events[0].Reason != EventReasonRepositorySuspended || events.events[0].Type != v1.EventTypeWarning {
+		t.Errorf("Expected a single '%s' event, but got %v", EventReasonRepositorySuspended, events.events)
+	}
+}
+
+func TestRepositoryAccessDenied(t *testing.T) {
+	denied := awserr.New("AccessDeniedException", "not authorized to perform: ecr:BatchDeleteImage", nil)
+
+	testCases := []struct {
+		err      error
+		expected bool
+	}{
+		{denied, true},
+		{&MultiError{Errors: []error{denied}}, true},
+		{&RepositoryError{Repository: "repo-1", Err: denied}, true},
+
+		// Failures of single images don't fail the whole repository
+		{&RepositoryError{Repository: "repo-1", Digest: "digest-1", Err: denied}, false},
+		{&MultiError{Errors: []error{&RepositoryError{Repository: "repo-1", Digest: "digest-1", Err: &ImageFailureError{Code: ecr.ImageFailureCodeKmsError}}}}, false},
+		{fmt.Errorf("Could not connect"), false},
+	}
+
+	for i, testCase := range testCases {
+		if denied := repositoryAccessDenied(testCase.err); denied != testCase.expected {
+			t.Errorf("Test case %d: expected %v, but got %v", i, testCase.expected, denied)
+		}
+	}
+}
+
+func TestReconcileSuspendsFailingRepositories(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{},
+		},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesError:              fmt.Errorf("AccessDeniedException"),
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+
+		RepositoryFailureThreshold: 2,
+		RepositoryCooldown:         time.Hour,
+	}
+
+	for pass := 0; pass < 2; pass++ {
+		result := task.Reconcile(kubeClient, ecrClient)
+		if len(result.Errors) != 1 || result.RepositoriesSuspended != 0 {
+			t.Errorf("Pass %d: expected the repo to fail, but got %d suspended repos and errors %q", pass, result.RepositoriesSuspended, result.Errors)
+		}
+	}
+
+	// The repository failed in the last 2 passes, so it's left alone
+	result := task.Reconcile(kubeClient, ecrClient)
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
+	}
+	if result.RepositoriesProcessed != 0 || result.RepositoriesSuspended != 1 {
+		t.Errorf("Expected the repo to be suspended, but got %d processed and %d suspended repos", result.RepositoriesProcessed, result.RepositoriesSuspended)
+	}
+}
+
+func TestReconcileDoesNotSuspendRepositoriesWithImageFailures(t *testing.T) {
+	namespace, repoName, imageDigest := "namespace", "repo", "image-digest"
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{},
+		},
+	}
+
+	// The same image fails to be deleted in every pass
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest: &imageDigest,
+			},
+		},
+
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &imageDigest,
+			},
+		},
+		deleteImagesError: &MultiError{Errors: []error{
+			&RepositoryError{Repository: repoName, Digest: imageDigest, Err: &ImageFailureError{Code: ecr.ImageFailureCodeKmsError, Reason: "KMS key is disabled"}},
+		}},
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+
+		MaxImages:              0,
+		AllowEmptyRepositories: true,
+
+		RepositoryFailureThreshold: 1,
+		RepositoryCooldown:         time.Hour,
+	}
+
+	for pass := 0; pass < 2; pass++ {
+		result := task.Reconcile(kubeClient, ecrClient)
+		if len(result.Errors) != 1 {
+			t.Errorf("Pass %d: expected the image deletion to fail, but got errors %q", pass, result.Errors)
+		} else if repoErr, ok := result.Errors[0].(*RepositoryError); !ok || repoErr.Message != "Could not remove images" {
+			t.Errorf("Pass %d: expected the image deletion to fail, but got %#v", pass, result.Errors[0])
+		} else if failures, ok := repoErr.Err.(*MultiError); !ok || len(failures.Errors) != 1 || failures.Errors[0].(*RepositoryError).Digest != imageDigest {
+			t.Errorf("Pass %d: expected the failure of the image to be kept, but got %#v", pass, repoErr.Err)
+		}
+		if result.RepositoriesProcessed != 1 || result.RepositoriesSuspended != 0 {
+			t.Errorf("Pass %d: expected the repo to be processed, but got %d processed and %d suspended repos", pass, result.RepositoriesProcessed, result.RepositoriesSuspended)
+		}
+	}
+}
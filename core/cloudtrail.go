@@ -0,0 +1,131 @@
+package core
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudtrail"
+	"github.com/aws/aws-sdk-go/service/cloudtrail/cloudtrailiface"
+)
+
+const (
+	// Event recorded by CloudTrail whenever an image manifest is pulled
+	ecrPullEventName   = "BatchGetImage"
+	ecrPullEventSource = "ecr.amazonaws.com"
+)
+
+type CloudTrailClientImpl struct {
+	CloudTrailClient cloudtrailiface.CloudTrailAPI
+}
+
+// PullEventsClient defines the expected interface of any object capable of
+// telling which ECR images were pulled recently.
+type PullEventsClient interface {
+	ListRecentPulls(since time.Time) (map[string]map[string]bool, error)
+}
+
+// MultiPullEventsClient merges the recent pulls found by several clients, such
+// as the clients of the CloudTrail API in each region, so that images pulled
+// recently in any of them are considered pulled recently in all of them.
+type MultiPullEventsClient []PullEventsClient
+
+// ListRecentPulls returns the union of the recent pulls found by each client.
+func (c MultiPullEventsClient) ListRecentPulls(since time.Time) (map[string]map[string]bool, error) {
+	pulls := map[string]map[string]bool{}
+
+	for _, client := range c {
+		clientPulls, err := client.ListRecentPulls(since)
+		if err != nil {
+			return nil, err
+		}
+
+		for repoName, images := range clientPulls {
+			if pulls[repoName] == nil {
+				pulls[repoName] = map[string]bool{}
+			}
+			for image := range images {
+				pulls[repoName][image] = true
+			}
+		}
+	}
+
+	return pulls, nil
+}
+
+// ecrPullEvent holds the relevant parts of a CloudTrail event recorded for
+// an image pull.
+type ecrPullEvent struct {
+	EventSource       string `json:"eventSource"`
+	RequestParameters struct {
+		RepositoryName string `json:"repositoryName"`
+		ImageIds       []struct {
+			ImageTag    string `json:"imageTag"`
+			ImageDigest string `json:"imageDigest"`
+		} `json:"imageIds"`
+	} `json:"requestParameters"`
+}
+
+// NewCloudTrailClient returns a new client for interacting with the
+// CloudTrail API, using the same credentials as the ECR client. If roleARN is
+// not empty, that IAM role is assumed.
+func NewCloudTrailClient(auth AWSAuth, region, roleARN string) *CloudTrailClientImpl {
+	return &CloudTrailClientImpl{
+		CloudTrailClient: cloudtrail.New(newAssumeRoleSession(auth, region, roleARN)),
+	}
+}
+
+// ListRecentPulls returns a map where the keys are ECR repository names and
+// the values are the sets of image tags and digests pulled from those
+// repositories since the given time, according to CloudTrail.
+func (c *CloudTrailClientImpl) ListRecentPulls(since time.Time) (map[string]map[string]bool, error) {
+	pulls := map[string]map[string]bool{}
+
+	input := &cloudtrail.LookupEventsInput{
+		StartTime: aws.Time(since),
+		LookupAttributes: []*cloudtrail.LookupAttribute{
+			{
+				AttributeKey:   aws.String(cloudtrail.LookupAttributeKeyEventName),
+				AttributeValue: aws.String(ecrPullEventName),
+			},
+		},
+	}
+
+	var parseErr error
+	callback := func(page *cloudtrail.LookupEventsOutput, lastPage bool) bool {
+		for _, event := range page.Events {
+			pullEvent := ecrPullEvent{}
+			if parseErr = json.Unmarshal([]byte(aws.StringValue(event.CloudTrailEvent)), &pullEvent); parseErr != nil {
+				return false
+			}
+
+			if pullEvent.EventSource != ecrPullEventSource {
+				continue
+			}
+
+			repoName := pullEvent.RequestParameters.RepositoryName
+			if pulls[repoName] == nil {
+				pulls[repoName] = map[string]bool{}
+			}
+
+			for _, imageID := range pullEvent.RequestParameters.ImageIds {
+				if imageID.ImageTag != "" {
+					pulls[repoName][imageID.ImageTag] = true
+				}
+				if imageID.ImageDigest != "" {
+					pulls[repoName][imageID.ImageDigest] = true
+				}
+			}
+		}
+		return !lastPage
+	}
+
+	if err := c.CloudTrailClient.LookupEventsPages(input, callback); err != nil {
+		return nil, err
+	}
+	if parseErr != nil {
+		return nil, parseErr
+	}
+
+	return pulls, nil
+}
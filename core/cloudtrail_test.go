@@ -0,0 +1,176 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudtrail"
+	"github.com/aws/aws-sdk-go/service/cloudtrail/cloudtrailiface"
+)
+
+// mockAWSCloudTrailClient is used to verify that the CloudTrail client is
+// being called with the correct arguments, and that the return values are
+// being handled correctly by its consumers.
+type mockAWSCloudTrailClient struct {
+	t *testing.T
+	cloudtrailiface.CloudTrailAPI
+
+	expectedStartTime time.Time
+
+	outputEvents []string
+	outputError  error
+}
+
+func (m *mockAWSCloudTrailClient) LookupEventsPages(input *cloudtrail.LookupEventsInput, fn func(*cloudtrail.LookupEventsOutput, bool) bool) error {
+	if input == nil {
+		m.t.Errorf("Unexpected nil input")
+	}
+
+	if !input.StartTime.Equal(m.expectedStartTime) {
+		m.t.Errorf("Expected start time to be %v, but was %v", m.expectedStartTime, *input.StartTime)
+	}
+
+	if len(input.LookupAttributes) != 1 || *input.LookupAttributes[0].AttributeValue != "BatchGetImage" {
+		m.t.Errorf("Expected lookup to be restricted to BatchGetImage events, but was %v", input.LookupAttributes)
+	}
+
+	page := &cloudtrail.LookupEventsOutput{}
+	for i := range m.outputEvents {
+		page.Events = append(page.Events, &cloudtrail.Event{
+			CloudTrailEvent: &m.outputEvents[i],
+		})
+	}
+
+	fn(page, true)
+
+	return m.outputError
+}
+
+func TestListRecentPullsError(t *testing.T) {
+	since := time.Unix(0, 0)
+
+	client := CloudTrailClientImpl{
+		CloudTrailClient: &mockAWSCloudTrailClient{
+			t: t,
+
+			expectedStartTime: since,
+			outputError:       fmt.Errorf(""),
+		},
+	}
+
+	pulls, err := client.ListRecentPulls(since)
+
+	if pulls != nil {
+		t.Errorf("Expected pulls to be nil, but was %v", pulls)
+	}
+
+	if err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+}
+
+func TestListRecentPullsWithInvalidEvent(t *testing.T) {
+	since := time.Unix(0, 0)
+
+	client := CloudTrailClientImpl{
+		CloudTrailClient: &mockAWSCloudTrailClient{
+			t: t,
+
+			expectedStartTime: since,
+			outputEvents:      []string{"{"},
+		},
+	}
+
+	pulls, err := client.ListRecentPulls(since)
+
+	if pulls != nil {
+		t.Errorf("Expected pulls to be nil, but was %v", pulls)
+	}
+
+	if err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+}
+
+func TestListRecentPulls(t *testing.T) {
+	since := time.Unix(0, 0)
+
+	client := CloudTrailClientImpl{
+		CloudTrailClient: &mockAWSCloudTrailClient{
+			t: t,
+
+			expectedStartTime: since,
+			outputEvents: []string{
+				`{"eventSource": "ecr.amazonaws.com", "requestParameters": {"repositoryName": "repo-1", "imageIds": [{"imageTag": "tag-1"}]}}`,
+				`{"eventSource": "ecr.amazonaws.com", "requestParameters": {"repositoryName": "repo-1", "imageIds": [{"imageDigest": "digest-1"}]}}`,
+				`{"eventSource": "ecr.amazonaws.com", "requestParameters": {"repositoryName": "repo-2", "imageIds": [{"imageTag": "tag-2", "imageDigest": "digest-2"}]}}`,
+				`{"eventSource": "other.amazonaws.com", "requestParameters": {"repositoryName": "repo-3", "imageIds": [{"imageTag": "tag-3"}]}}`,
+			},
+		},
+	}
+
+	pulls, err := client.ListRecentPulls(since)
+
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+
+	expected := map[string]map[string]bool{
+		"repo-1": {"tag-1": true, "digest-1": true},
+		"repo-2": {"tag-2": true, "digest-2": true},
+	}
+
+	if !reflect.DeepEqual(pulls, expected) {
+		t.Errorf("Expected pulls to be %v, but was %v", expected, pulls)
+	}
+}
+
+func TestMultiPullEventsClient(t *testing.T) {
+	client := MultiPullEventsClient{
+		&mockPullEventsClient{
+			listRecentPullsResult: map[string]map[string]bool{
+				"repo-1": {"tag-1": true},
+			},
+		},
+		&mockPullEventsClient{
+			listRecentPullsResult: map[string]map[string]bool{
+				"repo-1": {"digest-1": true},
+				"repo-2": {"tag-2": true},
+			},
+		},
+	}
+
+	pulls, err := client.ListRecentPulls(time.Unix(0, 0))
+
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+
+	expected := map[string]map[string]bool{
+		"repo-1": {"tag-1": true, "digest-1": true},
+		"repo-2": {"tag-2": true},
+	}
+
+	if !reflect.DeepEqual(pulls, expected) {
+		t.Errorf("Expected pulls to be %v, but was %v", expected, pulls)
+	}
+}
+
+func TestMultiPullEventsClientError(t *testing.T) {
+	client := MultiPullEventsClient{
+		&mockPullEventsClient{},
+		&mockPullEventsClient{listRecentPullsError: fmt.Errorf("")},
+	}
+
+	pulls, err := client.ListRecentPulls(time.Unix(0, 0))
+
+	if pulls != nil {
+		t.Errorf("Expected pulls to be nil, but was %v", pulls)
+	}
+
+	if err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+}
@@ -0,0 +1,282 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/client-go/pkg/api/v1"
+	batchv1 "k8s.io/client-go/pkg/apis/batch/v1"
+	batchv2alpha1 "k8s.io/client-go/pkg/apis/batch/v2alpha1"
+	extensionsv1beta1 "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+// RemoteCluster is a Kubernetes cluster, other than the one the controller
+// runs in, whose pods' images are also considered in use.
+type RemoteCluster struct {
+	// Path of the kubeconfig file used to talk to the cluster.
+	Kubeconfig string
+
+	// Context of the kubeconfig file to use. Defaults to the current one.
+	Context string
+}
+
+// String returns the cluster as `kubeconfig#context`, or only as the
+// kubeconfig path if the current context is used.
+func (c RemoteCluster) String() string {
+	if c.Context == "" {
+		return c.Kubeconfig
+	}
+	return c.Kubeconfig + "#" + c.Context
+}
+
+// ParseRemoteClusters parses the given comma-separated list of remote
+// clusters, each given as a kubeconfig path, optionally followed by
+// `#context`.
+func ParseRemoteClusters(value string) ([]RemoteCluster, error) {
+	clusters := []RemoteCluster{}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "#", 2)
+		cluster := RemoteCluster{Kubeconfig: strings.TrimSpace(parts[0])}
+		if len(parts) == 2 {
+			cluster.Context = strings.TrimSpace(parts[1])
+			if cluster.Context == "" {
+				return nil, fmt.Errorf("Invalid cluster '%s', context must not be empty", entry)
+			}
+		}
+
+		if cluster.Kubeconfig == "" {
+			return nil, fmt.Errorf("Invalid cluster '%s', kubeconfig path must not be empty", entry)
+		}
+
+		clusters = append(clusters, cluster)
+	}
+
+	return clusters, nil
+}
+
+// RemoteKubernetesClient is a Kubernetes client for a remote cluster.
+type RemoteKubernetesClient struct {
+	Cluster string
+	Client  KubernetesClient
+}
+
+// MultiKubernetesClient merges the workloads found in several clusters, so
+// that images used in any of them are considered in use. The resources owned
+// by the controller, such as ConfigMaps and cleanup policies, are only read
+// from the cluster of the embedded client, which the controller runs in.
+type MultiKubernetesClient struct {
+	KubernetesClient
+
+	Remotes []RemoteKubernetesClient
+}
+
+// remoteError returns the given error of the given remote cluster, telling
+// which cluster it comes from.
+func remoteError(cluster string, err error) error {
+	return fmt.Errorf("Cluster '%s': %v", cluster, err)
+}
+
+// ListAllPods returns all pods from the given namespaces of every cluster.
+func (c *MultiKubernetesClient) ListAllPods(namespace []*string) ([]*v1.Pod, error) {
+	pods, err := c.KubernetesClient.ListAllPods(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, remote := range c.Remotes {
+		remotePods, err := remote.Client.ListAllPods(namespace)
+		if err != nil {
+			return nil, remoteError(remote.Cluster, err)
+		}
+		pods = append(pods, remotePods...)
+	}
+
+	return pods, nil
+}
+
+// ListEphemeralContainerImages returns the image references used by the
+// ephemeral containers of the pods from the given namespaces of every
+// cluster.
+func (c *MultiKubernetesClient) ListEphemeralContainerImages(namespace []*string) ([]string, error) {
+	images, err := c.KubernetesClient.ListEphemeralContainerImages(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, remote := range c.Remotes {
+		remoteImages, err := remote.Client.ListEphemeralContainerImages(namespace)
+		if err != nil {
+			return nil, remoteError(remote.Cluster, err)
+		}
+		images = append(images, remoteImages...)
+	}
+
+	return images, nil
+}
+
+// ListJobs returns all jobs from the given namespaces of every cluster.
+func (c *MultiKubernetesClient) ListJobs(namespace []*string) ([]*batchv1.Job, error) {
+	jobs, err := c.KubernetesClient.ListJobs(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, remote := range c.Remotes {
+		remoteJobs, err := remote.Client.ListJobs(namespace)
+		if err != nil {
+			return nil, remoteError(remote.Cluster, err)
+		}
+		jobs = append(jobs, remoteJobs...)
+	}
+
+	return jobs, nil
+}
+
+// ListCronJobs returns all cron jobs from the given namespaces of every
+// cluster.
+func (c *MultiKubernetesClient) ListCronJobs(namespace []*string) ([]*batchv2alpha1.CronJob, error) {
+	cronJobs, err := c.KubernetesClient.ListCronJobs(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, remote := range c.Remotes {
+		remoteCronJobs, err := remote.Client.ListCronJobs(namespace)
+		if err != nil {
+			return nil, remoteError(remote.Cluster, err)
+		}
+		cronJobs = append(cronJobs, remoteCronJobs...)
+	}
+
+	return cronJobs, nil
+}
+
+// ListReplicaSets returns all replica sets from the given namespaces of every
+// cluster.
+func (c *MultiKubernetesClient) ListReplicaSets(namespace []*string) ([]*extensionsv1beta1.ReplicaSet, error) {
+	replicaSets, err := c.KubernetesClient.ListReplicaSets(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, remote := range c.Remotes {
+		remoteReplicaSets, err := remote.Client.ListReplicaSets(namespace)
+		if err != nil {
+			return nil, remoteError(remote.Cluster, err)
+		}
+		replicaSets = append(replicaSets, remoteReplicaSets...)
+	}
+
+	return replicaSets, nil
+}
+
+// ListControllerRevisionImages returns the image references held by the
+// controller revisions from the given namespaces of every cluster.
+func (c *MultiKubernetesClient) ListControllerRevisionImages(namespace []*string) ([]string, error) {
+	images, err := c.KubernetesClient.ListControllerRevisionImages(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, remote := range c.Remotes {
+		remoteImages, err := remote.Client.ListControllerRevisionImages(namespace)
+		if err != nil {
+			return nil, remoteError(remote.Cluster, err)
+		}
+		images = append(images, remoteImages...)
+	}
+
+	return images, nil
+}
+
+// ListCustomWorkloadImages returns the image references used by the objects
+// of the given custom resource from the given namespaces of every cluster.
+func (c *MultiKubernetesClient) ListCustomWorkloadImages(workload CustomWorkload, namespace []*string) ([]string, error) {
+	images, err := c.KubernetesClient.ListCustomWorkloadImages(workload, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, remote := range c.Remotes {
+		remoteImages, err := remote.Client.ListCustomWorkloadImages(workload, namespace)
+		if err != nil {
+			return nil, remoteError(remote.Cluster, err)
+		}
+		images = append(images, remoteImages...)
+	}
+
+	return images, nil
+}
+
+// ListHelmReleaseSecrets returns the Helm release secrets from the given
+// namespaces of every cluster.
+func (c *MultiKubernetesClient) ListHelmReleaseSecrets(namespace []*string) ([]*v1.Secret, error) {
+	secrets, err := c.KubernetesClient.ListHelmReleaseSecrets(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, remote := range c.Remotes {
+		remoteSecrets, err := remote.Client.ListHelmReleaseSecrets(namespace)
+		if err != nil {
+			return nil, remoteError(remote.Cluster, err)
+		}
+		secrets = append(secrets, remoteSecrets...)
+	}
+
+	return secrets, nil
+}
+
+// ListNamespaces returns the names of the namespaces of every cluster, each
+// name being only listed once.
+func (c *MultiKubernetesClient) ListNamespaces() ([]string, error) {
+	namespaces, err := c.KubernetesClient.ListNamespaces()
+	if err != nil {
+		return nil, err
+	}
+
+	encountered := map[string]bool{}
+	for _, namespace := range namespaces {
+		encountered[namespace] = true
+	}
+
+	for _, remote := range c.Remotes {
+		remoteNamespaces, err := remote.Client.ListNamespaces()
+		if err != nil {
+			return nil, remoteError(remote.Cluster, err)
+		}
+
+		for _, namespace := range remoteNamespaces {
+			if !encountered[namespace] {
+				encountered[namespace] = true
+				namespaces = append(namespaces, namespace)
+			}
+		}
+	}
+
+	return namespaces, nil
+}
+
+// ListNodes returns all nodes of every cluster.
+func (c *MultiKubernetesClient) ListNodes() ([]*v1.Node, error) {
+	nodes, err := c.KubernetesClient.ListNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, remote := range c.Remotes {
+		remoteNodes, err := remote.Client.ListNodes()
+		if err != nil {
+			return nil, remoteError(remote.Cluster, err)
+		}
+		nodes = append(nodes, remoteNodes...)
+	}
+
+	return nodes, nil
+}
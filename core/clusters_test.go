@@ -0,0 +1,132 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestParseRemoteClusters(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected []RemoteCluster
+		ok       bool
+	}{
+		{
+			value:    "",
+			expected: []RemoteCluster{},
+			ok:       true,
+		},
+		{
+			value: "/etc/kube/staging.yaml, /etc/kube/prod.yaml#prod",
+			expected: []RemoteCluster{
+				{Kubeconfig: "/etc/kube/staging.yaml"},
+				{Kubeconfig: "/etc/kube/prod.yaml", Context: "prod"},
+			},
+			ok: true,
+		},
+		{value: "#prod", ok: false},
+		{value: "/etc/kube/prod.yaml#", ok: false},
+	}
+
+	for _, testCase := range testCases {
+		clusters, err := ParseRemoteClusters(testCase.value)
+
+		if (err == nil) != testCase.ok {
+			t.Errorf("Expected parsing '%s' to succeed to be %t, but got error %v", testCase.value, testCase.ok, err)
+			continue
+		}
+
+		if testCase.ok && !reflect.DeepEqual(clusters, testCase.expected) {
+			t.Errorf("Expected '%s' to be parsed as %+v, but got %+v", testCase.value, testCase.expected, clusters)
+		}
+	}
+}
+
+func TestMultiKubernetesClient(t *testing.T) {
+	namespace := "namespace"
+	names := []string{"local", "staging", "prod"}
+
+	newClient := func(name string) *mockKubeClient {
+		return &mockKubeClient{
+			t: t,
+
+			expectedNamespace: []string{namespace},
+			listAllPodsResult: []*v1.Pod{
+				{ObjectMeta: v1.ObjectMeta{Name: name}},
+			},
+			listNodesResult: []*v1.Node{
+				{ObjectMeta: v1.ObjectMeta{Name: name}},
+			},
+			getConfigMapResult: &v1.ConfigMap{
+				ObjectMeta: v1.ObjectMeta{Name: name},
+			},
+		}
+	}
+
+	client := &MultiKubernetesClient{
+		KubernetesClient: newClient(names[0]),
+		Remotes: []RemoteKubernetesClient{
+			{Cluster: names[1], Client: newClient(names[1])},
+			{Cluster: names[2], Client: newClient(names[2])},
+		},
+	}
+
+	pods, err := client.ListAllPods([]*string{&namespace})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	nodes, err := client.ListNodes()
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	if len(pods) != len(names) || len(nodes) != len(names) {
+		t.Fatalf("Expected %d pods and nodes, one from each cluster, but got %d pods and %d nodes", len(names), len(pods), len(nodes))
+	}
+
+	for i, name := range names {
+		if pods[i].Name != name || nodes[i].Name != name {
+			t.Errorf("Expected pod and node %d to come from '%s' cluster, but got '%s' and '%s'", i, name, pods[i].Name, nodes[i].Name)
+		}
+	}
+
+	// The resources of the controller only come from the local cluster
+	configMap, _ := client.GetConfigMap(namespace, "name")
+	if configMap.Name != names[0] {
+		t.Errorf("Expected ConfigMap to come from '%s' cluster, but came from '%s'", names[0], configMap.Name)
+	}
+}
+
+func TestMultiKubernetesClientWithRemoteError(t *testing.T) {
+	namespace := "namespace"
+
+	failing := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsError:  fmt.Errorf("unreachable"),
+	}
+
+	client := &MultiKubernetesClient{
+		KubernetesClient: &mockKubeClient{
+			t: t,
+
+			expectedNamespace: []string{namespace},
+			listAllPodsResult: []*v1.Pod{},
+		},
+		Remotes: []RemoteKubernetesClient{
+			{Cluster: "prod", Client: failing},
+		},
+	}
+
+	// Images used by an unreachable cluster would be considered unused
+	_, err := client.ListAllPods([]*string{&namespace})
+	if err == nil || !strings.Contains(err.Error(), "Cluster 'prod'") {
+		t.Errorf("Expected an error about 'prod' cluster, but got %v", err)
+	}
+}
@@ -0,0 +1,263 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ghodss/yaml"
+)
+
+// ParseConfig parses the given YAML or JSON configuration, made of settings
+// named after the flags of the controller, such as `max-images: 10`, into the
+// values of each setting as they would be given on the command line. Lists,
+// such as `repos: [app, worker]`, hold a value for each of their items.
+func ParseConfig(data []byte) (map[string][]string, error) {
+	data, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Numbers are decoded as given, so that large integers are not mangled
+	// into floats
+	settings := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&settings); err != nil {
+		return nil, err
+	}
+
+	config := map[string][]string{}
+	for name, setting := range settings {
+		items, ok := setting.([]interface{})
+		if !ok {
+			items = []interface{}{setting}
+		}
+
+		values := []string{}
+		for _, item := range items {
+			switch item.(type) {
+			case string, json.Number, bool:
+				values = append(values, fmt.Sprint(item))
+			default:
+				return nil, fmt.Errorf("Invalid value for '%s' setting, must be a string, number, boolean or a list of those", name)
+			}
+		}
+		config[name] = values
+	}
+
+	return config, nil
+}
+
+// LoadConfigFile parses the configuration in the given path, as per
+// `ParseConfig`.
+func LoadConfigFile(path string) (map[string][]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := ParseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse '%s': %v", path, err)
+	}
+
+	return config, nil
+}
+
+// ConfigSettingNames returns the names of the settings of the given
+// configuration, in lexicographic order.
+func ConfigSettingNames(config map[string][]string) []string {
+	names := []string{}
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Reload hands the settings of the given task that can change while the
+// controller runs, such as the retention rules, the repositories, the
+// interval, the dry run and the notification settings, over to the clean-up
+// loop, which applies them between passes, so that they never change under a
+// running pass. The clients, such as the regions, credentials and audit sinks,
+// and the settings they were created with are kept as they were when the loop
+// started, and a warning lists the ones that changed. An error is returned if
+// the loop is yet to start, or if it stopped.
+func (t *CleanupTask) Reload(settings *CleanupTask) error {
+	reloads, ok := t.reloads.Load().(reloadChannels)
+	if !ok {
+		return fmt.Errorf("Clean-up loop not started yet")
+	}
+
+	select {
+	case reloads.settings <- settings:
+		return nil
+	case <-reloads.done:
+		return fmt.Errorf("Clean-up loop stopped")
+	}
+}
+
+// tryReload applies the settings of the given task that can change while the
+// controller runs, unless a pass is running, in which case false is returned
+// so that they can be applied later.
+func (t *CleanupTask) tryReload(settings *CleanupTask) bool {
+	if !atomic.CompareAndSwapInt32(&t.reconciling, 0, 1) {
+		return false
+	}
+	defer atomic.StoreInt32(&t.reconciling, 0)
+
+	t.settingsMutex.Lock()
+	defer t.settingsMutex.Unlock()
+
+	if ignored := t.restartOnlyChanges(settings); len(ignored) > 0 {
+		t.baseLog().Warningf("Not reloading %s, which only apply on restart.", strings.Join(ignored, ", "))
+	}
+
+	t.Interval = settings.Interval
+	t.Schedule = settings.Schedule
+	t.ScheduleJitter = settings.ScheduleJitter
+
+	t.MaxImages = settings.MaxImages
+	t.ReclaimBytes = settings.ReclaimBytes
+	t.CountSince = settings.CountSince
+	t.SemverRetention = settings.SemverRetention
+	t.TagGroupPattern = settings.TagGroupPattern
+	t.MaxImageAge = settings.MaxImageAge
+	t.MinImageAge = settings.MinImageAge
+	t.MinDaysSinceLastPull = settings.MinDaysSinceLastPull
+	t.SkipScanPending = settings.SkipScanPending
+	t.DeleteCriticalFindings = settings.DeleteCriticalFindings
+	t.VerifyPlan = settings.VerifyPlan
+	t.DeleteUntaggedImages = settings.DeleteUntaggedImages
+	t.UntaggedKeepCount = settings.UntaggedKeepCount
+	t.UntaggedMaxAge = settings.UntaggedMaxAge
+	t.MaxTagsPerImage = settings.MaxTagsPerImage
+	t.MinImageSizeBytes = settings.MinImageSizeBytes
+	t.MaxRepositorySizeBytes = settings.MaxRepositorySizeBytes
+	t.ProtectManifestListChildren = settings.ProtectManifestListChildren
+	t.DeleteOrphanedManifestLists = settings.DeleteOrphanedManifestLists
+	t.DeleteManifestListChildren = settings.DeleteManifestListChildren
+	t.MaxDeletesPerReconcile = settings.MaxDeletesPerReconcile
+	t.MaxDeletesPerRepository = settings.MaxDeletesPerRepository
+	t.QuarantineRetention = settings.QuarantineRetention
+	t.Concurrency = settings.Concurrency
+
+	t.EcrRepositories = settings.EcrRepositories
+	t.DiscoverRepositories = settings.DiscoverRepositories
+	t.RepositoryIncludePatterns = settings.RepositoryIncludePatterns
+	t.RepositoryExcludePatterns = settings.RepositoryExcludePatterns
+	t.OnlyRepositoriesInUse = settings.OnlyRepositoriesInUse
+	t.RepositoryGracePeriod = settings.RepositoryGracePeriod
+	t.RepositoryFailureThreshold = settings.RepositoryFailureThreshold
+	t.RepositoryCooldown = settings.RepositoryCooldown
+	t.RepositoryMaxCooldown = settings.RepositoryMaxCooldown
+	t.MinRepositories = settings.MinRepositories
+	t.MinRepositoriesAction = settings.MinRepositoriesAction
+	t.AllowEmptyRepositories = settings.AllowEmptyRepositories
+
+	t.KubeNamespaces = settings.KubeNamespaces
+	t.ExcludeNamespaces = settings.ExcludeNamespaces
+	t.IgnoreKubernetesErrors = settings.IgnoreKubernetesErrors
+	t.UseNodePinnedImages = settings.UseNodePinnedImages
+	t.UseJobImages = settings.UseJobImages
+	t.UseRevisionHistoryImages = settings.UseRevisionHistoryImages
+	t.UseRolloutImages = settings.UseRolloutImages
+	t.UseHelmReleaseImages = settings.UseHelmReleaseImages
+	t.CustomWorkloads = settings.CustomWorkloads
+	t.GitOpsRepositories = settings.GitOpsRepositories
+	t.JobHistoryWindow = settings.JobHistoryWindow
+	t.RegistryAliases = settings.RegistryAliases
+	t.KeepTagPatterns = settings.KeepTagPatterns
+	t.UseCleanupPolicies = settings.UseCleanupPolicies
+	t.UseRepositoryTags = settings.UseRepositoryTags
+	t.UseNamespaceKeepCounts = settings.UseNamespaceKeepCounts
+	t.SkipReplicatedRepositories = settings.SkipReplicatedRepositories
+	t.AllowReplicatedRepositories = settings.AllowReplicatedRepositories
+	t.OrphanedRepositoryDays = settings.OrphanedRepositoryDays
+	t.DeleteEmptyRepositories = settings.DeleteEmptyRepositories
+	t.KeepTagsConfigMap = settings.KeepTagsConfigMap
+	t.ProtectImagesNewerThanInUse = settings.ProtectImagesNewerThanInUse
+	t.AlwaysKeepLatestTagged = settings.AlwaysKeepLatestTagged
+	t.ProtectAnnotationKey = settings.ProtectAnnotationKey
+	t.ProtectAnnotationValue = settings.ProtectAnnotationValue
+
+	t.PlanOutputPath = settings.PlanOutputPath
+	t.PreviousPlanPath = settings.PreviousPlanPath
+	t.ReportCSVPath = settings.ReportCSVPath
+	t.AuditFailuresBlockDeletion = settings.AuditFailuresBlockDeletion
+
+	// The notifier is only replaced when its settings change, so that
+	// notifiers set by embedding programs are kept otherwise
+	if settings.NotifyWebhookURL != t.NotifyWebhookURL || (settings.NotifyWebhookURL != "" && settings.DryRun != t.DryRun) {
+		t.Notifier = nil
+		if settings.NotifyWebhookURL != "" {
+			t.Notifier = NewWebhookNotifier(settings.NotifyWebhookURL, settings.DryRun)
+		}
+	}
+	t.NotifyWebhookURL = settings.NotifyWebhookURL
+	t.NotifyOn = settings.NotifyOn
+
+	if settings.DryRun && !t.DryRun {
+		t.baseLog().Infof("Switching to dry run, images are no longer removed from the next pass on.")
+	} else if !settings.DryRun && t.DryRun {
+		t.baseLog().Warningf("Leaving dry run, images are removed from the next pass on.")
+	}
+	t.DryRun = settings.DryRun
+
+	t.baseLog().Infof("Reloaded settings, which apply from the next pass on.")
+	return true
+}
+
+// restartOnlyChanges returns the flags of the settings of the given task that
+// differ from the ones of this task but cannot be reloaded, since the clients
+// or the clean-up loop were created with them.
+func (t *CleanupTask) restartOnlyChanges(settings *CleanupTask) []string {
+	changes := []struct {
+		flag    string
+		changed bool
+	}{
+		{"-region", settings.AwsRegion != t.AwsRegion},
+		{"-regions", !reflect.DeepEqual(settings.AwsRegions, t.AwsRegions)},
+		{"-ecr-endpoint", settings.EcrEndpoint != t.EcrEndpoint},
+		{"-aws-sdk", settings.AwsSdkVersion != t.AwsSdkVersion},
+		{"-api-qps", settings.ApiQPS != t.ApiQPS},
+		{"-api-burst", settings.ApiBurst != t.ApiBurst},
+		{"-api-max-retries", settings.ApiMaxRetries != t.ApiMaxRetries},
+		{"-image-cache-ttl", settings.ImageCacheTTL != t.ImageCacheTTL},
+		{"-full-resync-interval", settings.FullResyncInterval != t.FullResyncInterval},
+		{"-image-tag-status", settings.ImageTagStatus != t.ImageTagStatus},
+		{"-aws-auth-mode", settings.AwsAuth != t.AwsAuth},
+		{"-assume-role-arn", settings.AssumeRoleARN != t.AssumeRoleARN},
+		{"-repo-roles", (len(settings.RepositoryRoles) != 0 || len(t.RepositoryRoles) != 0) && !reflect.DeepEqual(settings.RepositoryRoles, t.RepositoryRoles)},
+		{"-expected-account-id", settings.ExpectedAccountID != t.ExpectedAccountID},
+		{"-kubeconfig", settings.KubeConfig != t.KubeConfig},
+		{"-controller-namespace", settings.ControllerNamespace != t.ControllerNamespace},
+		{"-gitops-token-file", settings.GitTokenPath != t.GitTokenPath},
+		{"-match-registry-only", settings.MatchRegistryOnly != t.MatchRegistryOnly},
+		{"-recent-pull-window", settings.RecentPullWindow != t.RecentPullWindow},
+		{"-audit-s3-bucket", settings.AuditS3Bucket != t.AuditS3Bucket},
+		{"-audit-s3-prefix", settings.AuditS3Prefix != t.AuditS3Prefix},
+		{"-audit-path", settings.AuditPath != t.AuditPath},
+		{"-status-configmap", settings.StatusConfigMap != t.StatusConfigMap},
+		{"-leader-elect", settings.LeaderElection != t.LeaderElection},
+		{"-events", settings.EmitEvents != t.EmitEvents},
+		{"-events-target", settings.EventsTarget != t.EventsTarget},
+		{"-liveness-intervals", settings.LivenessIntervals != t.LivenessIntervals},
+	}
+
+	flags := []string{}
+	for _, change := range changes {
+		if change.changed {
+			flags = append(flags, change.flag)
+		}
+	}
+
+	return flags
+}
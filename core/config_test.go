@@ -0,0 +1,203 @@
+package core
+
+import (
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestParseConfig(t *testing.T) {
+	testCases := []struct {
+		data     string
+		expected map[string][]string
+		ok       bool
+	}{
+		// Scalars and lists
+		{
+			data: "max-images: 10\nrepos: [app, worker]\ndelete-untagged: true\nmax-image-age: 30d\n",
+			expected: map[string][]string{
+				"max-images":      []string{"10"},
+				"repos":           []string{"app", "worker"},
+				"delete-untagged": []string{"true"},
+				"max-image-age":   []string{"30d"},
+			},
+			ok: true,
+		},
+
+		// Large integers are kept as given
+		{
+			data: "reclaim-bytes: 107374182400\n",
+			expected: map[string][]string{
+				"reclaim-bytes": []string{"107374182400"},
+			},
+			ok: true,
+		},
+
+		// JSON is YAML too
+		{
+			data: `{"keep-tags-regex": ["^release-", "^v[0-9]+"]}`,
+			expected: map[string][]string{
+				"keep-tags-regex": []string{"^release-", "^v[0-9]+"},
+			},
+			ok: true,
+		},
+
+		// Empty file
+		{
+			data:     "",
+			expected: map[string][]string{},
+			ok:       true,
+		},
+
+		// Nested settings
+		{data: "repos:\n  app: true\n"},
+
+		// Invalid YAML
+		{data: "max-images: [10\n"},
+	}
+
+	for i, testCase := range testCases {
+		config, err := ParseConfig([]byte(testCase.data))
+		if (err == nil) != testCase.ok {
+			t.Errorf("Test case %d: expected parsing to succeed to be %t, but got error %v", i, testCase.ok, err)
+			continue
+		}
+
+		if testCase.ok && !reflect.DeepEqual(config, testCase.expected) {
+			t.Errorf("Test case %d: expected config to be %+v, but was %+v", i, testCase.expected, config)
+		}
+	}
+}
+
+func TestTryReload(t *testing.T) {
+	logger := &mockLogger{}
+	task := NewCleanupTask()
+	task.Logger = logger
+	task.DryRun = true
+	task.AuditS3Bucket = "bucket"
+
+	settings := NewCleanupTask()
+	settings.DryRun = true
+	settings.Interval = 5
+	settings.MaxImages = 10
+	settings.NotifyWebhookURL = "https://hooks.example.com/1"
+	settings.AuditS3Bucket = "other-bucket"
+
+	// Settings never change under a running pass
+	atomic.StoreInt32(&task.reconciling, 1)
+	if task.tryReload(settings) || task.MaxImages == 10 {
+		t.Errorf("Expected settings not to be applied while a pass is running")
+	}
+	atomic.StoreInt32(&task.reconciling, 0)
+
+	if !task.tryReload(settings) {
+		t.Fatalf("Expected settings to be applied between passes")
+	}
+
+	if task.Interval != 5 || task.MaxImages != 10 {
+		t.Errorf("Expected interval and max images to be 5 and 10, but were %d and %d", task.Interval, task.MaxImages)
+	}
+
+	// Clients are kept as they were, with a warning
+	if task.AuditS3Bucket != "bucket" {
+		t.Errorf("Expected audit bucket to be kept, but was '%s'", task.AuditS3Bucket)
+	}
+	if len(logger.messages) == 0 || !strings.Contains(logger.messages[0], "-audit-s3-bucket") {
+		t.Errorf("Expected a warning about -audit-s3-bucket not being reloaded, but got %q", logger.messages)
+	}
+
+	notifier, ok := task.Notifier.(*WebhookNotifierImpl)
+	if !ok || notifier.URL != settings.NotifyWebhookURL || !notifier.DryRun {
+		t.Errorf("Expected a dry run notifier for the new webhook URL, but got %+v", task.Notifier)
+	}
+
+	if atomic.LoadInt32(&task.reconciling) != 0 {
+		t.Errorf("Expected passes to be allowed again after reloading settings")
+	}
+}
+
+func TestTryReloadDryRun(t *testing.T) {
+	namespace, repoName, imageDigest, imageTag := "namespace", "repo", "digest", "v1"
+	pushedAt := time.Now().Add(-time.Hour)
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{},
+		},
+	}
+
+	// Removing the image would fail the test, since none is expected
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest:   &imageDigest,
+				ImageTags:     []*string{&imageTag},
+				ImagePushedAt: &pushedAt,
+			},
+		},
+	}
+
+	newTask := func(dryRun bool) *CleanupTask {
+		task := NewCleanupTask()
+		task.Logger = &mockLogger{}
+		task.DryRun = dryRun
+		task.KubeNamespaces = []*string{&namespace}
+		task.EcrRepositories = []*string{&repoName}
+		task.MaxImages = 0
+		task.AllowEmptyRepositories = true
+		return task
+	}
+
+	// Going from -confirm back to a dry run
+	task := newTask(false)
+	if !task.tryReload(newTask(true)) {
+		t.Fatalf("Expected settings to be applied between passes")
+	}
+
+	result := task.Reconcile(kubeClient, ecrClient)
+
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
+	}
+	if result.ImagesSelected != 1 || result.ImagesDeleted != 0 {
+		t.Errorf("Expected the image to be selected but not removed, but got %d selected and %d removed images", result.ImagesSelected, result.ImagesDeleted)
+	}
+}
+
+func TestReloadBeforeLoopStarts(t *testing.T) {
+	task := NewCleanupTask()
+
+	if err := task.Reload(NewCleanupTask()); err == nil {
+		t.Errorf("Expected an error before the loop starts, but got none")
+	}
+}
+
+func TestReloadAfterLoopStops(t *testing.T) {
+	task := NewCleanupTask()
+
+	stopped := make(chan struct{})
+	close(stopped)
+	task.reloads.Store(reloadChannels{settings: make(chan *CleanupTask), done: stopped})
+
+	if err := task.Reload(NewCleanupTask()); err == nil {
+		t.Errorf("Expected an error once the loop stopped, but got none")
+	}
+}
@@ -1,30 +1,138 @@
 package core
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"golang.org/x/time/rate"
 )
 
 const (
 	batchRemoveMaxImages = 100
+
+	// Deletion progress is only logged for repositories with at least this
+	// many images to delete, so that small repositories don't flood the logs
+	deleteProgressLogThreshold = 500
+
+	// Number of times the images that ECR fails to delete for transient
+	// reasons are deleted again, and the delay before the first of these
+	// retries, which doubles with each retry
+	deleteMaxRetries = 3
+	deleteRetryDelay = 2 * time.Second
+
+	batchGetMaxImages = 100
+
+	// Maximum number of images DescribeImages describes by digest at once
+	describeImagesMaxImageIds = 100
+
+	// Maximum number of times the images of a repository are listed again
+	// from the first page when the pagination token expires midway
+	listImagesMaxRestarts = 3
+
+	// Bounds of the delay before retrying throttled ECR API requests, which
+	// grows exponentially with each retry
+	ecrMinThrottleDelay = 500 * time.Millisecond
+	ecrMaxThrottleDelay = 30 * time.Second
+
+	// Media types of manifests that reference other manifests, such as
+	// multi-arch images
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIImageIndex      = "application/vnd.oci.image.index.v1+json"
+
+	// Media types of manifests describing a single image
+	mediaTypeDockerManifest       = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestSigned = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	mediaTypeOCIManifest          = "application/vnd.oci.image.manifest.v1+json"
 )
 
+// Media types accepted when fetching manifests that are pushed back as is
+var allManifestMediaTypes = []*string{
+	aws.String(mediaTypeDockerManifest),
+	aws.String(mediaTypeDockerManifestSigned),
+	aws.String(mediaTypeOCIManifest),
+	aws.String(mediaTypeDockerManifestList),
+	aws.String(mediaTypeOCIImageIndex),
+}
+
 type ECRClientImpl struct {
 	ECRClient ecriface.ECRAPI
+
+	// Clients used instead of `ECRClient` for the repositories with these
+	// names, such as repositories living in other AWS accounts.
+	RepositoryClients map[string]ecriface.ECRAPI
+
+	// Logger used to report the progress of deletions. Defaults to glog.
+	Logger Logger
+
+	// Number of times the images that ECR fails to delete with a retryable
+	// failure code are deleted again, and the delay before the first retry,
+	// which doubles with each retry.
+	DeleteMaxRetries int
+	DeleteRetryDelay time.Duration
+
+	// If greater than zero, the images listed from each repository are
+	// cached for this long, instead of being described again in each pass.
+	// The images of a repository are listed again once some of them are
+	// deleted or tagged. Images about to be deleted are described again
+	// anyway, and the ones tagged since they were listed are left out.
+	ImageCacheTTL time.Duration
+
+	// If greater than zero, all the cached images are listed again this
+	// often, whatever their TTL.
+	FullResyncInterval time.Duration
+
+	// If set, either to `ImageTagStatusTagged` or `ImageTagStatusUntagged`,
+	// only the images with this tag status are listed from the repositories,
+	// as filtered by ECR. Defaults to all images.
+	ImageTagStatus string
+
+	// Returns the context of the running pass, which the requests sent to
+	// ECR are made with, so that they are canceled along with the pass, even
+	// while waiting for the rate limiter or before a retry, and which holds
+	// the span each of them is a child of. Deletions already sent are
+	// finished regardless. Defaults to none.
+	Context func() context.Context
+
+	images imageCache
+}
+
+// retryableImageFailureCodes are the failure codes reported by
+// BatchDeleteImage for images that may be deleted by trying again: KMS
+// errors are usually transient, and images referenced by manifest lists can
+// be deleted once the manifest lists deleted in the same batch are gone.
+var retryableImageFailureCodes = map[string]bool{
+	ecr.ImageFailureCodeKmsError:                      true,
+	ecr.ImageFailureCodeImageReferencedByManifestList: true,
 }
 
 // ECRClient defines the expected interface of any object capable of
 // listing and removing images from a ECR repository.
 type ECRClient interface {
 	ListRepositories(repositoryNames []*string) ([]*ecr.Repository, error)
+	ListAllRepositories() ([]*ecr.Repository, error)
 	ListImages(repositoryName *string) ([]*ecr.ImageDetail, error)
-	BatchRemoveImages(images []*ecr.ImageDetail) error
+	DeleteImages(images []*ecr.ImageDetail) error
+	ListManifestListChildren(repositoryName *string, images []*ecr.ImageDetail) (map[string][]string, error)
+	TagImages(repositoryName *string, tags map[string]string) error
+	GetImageManifests(repositoryName *string, images []*ecr.ImageDetail) (map[string]string, error)
+	Ping() error
+}
+
+// RegionalECRClient is an ECR client for the repositories of a region.
+type RegionalECRClient struct {
+	Region string
+	Client ECRClient
 }
 
 // ImagesByPushDate lets us sort ECR images by push date so that we can
@@ -35,9 +143,15 @@ func (slice ImagesByPushDate) Len() int {
 	return len(slice)
 }
 
+// Less orders images by push date, breaking ties by digest so that images
+// pushed at the same time are always sorted the same way.
 func (slice ImagesByPushDate) Less(i, j int) bool {
 	ti := *slice[i].ImagePushedAt
 	tj := *slice[j].ImagePushedAt
+
+	if ti.Equal(tj) {
+		return aws.StringValue(slice[i].ImageDigest) < aws.StringValue(slice[j].ImageDigest)
+	}
 	return ti.Before(tj)
 }
 
@@ -46,27 +160,154 @@ func (slice ImagesByPushDate) Swap(i, j int) {
 }
 
 // NewECRClient returns a new client for interacting with the ECR API. The
-// credentials are retrieved from environment variables or from the
-// `~/.aws/credentials` file.
-func NewECRClient(region string) *ECRClientImpl {
-	creds := credentials.NewChainCredentials(
-		[]credentials.Provider{
-			&credentials.EnvProvider{},
-			&credentials.SharedCredentialsProvider{},
-		})
+// credentials are retrieved as per the given auth. If endpoint is not empty,
+// it overrides the URL resolved by the SDK for the given region, which is
+// useful for testing against LocalStack or for reaching ECR through a VPC
+// endpoint. If apiQPS is greater than zero, requests are throttled to that
+// rate, allowing bursts of up to apiBurst requests. Failed requests, including
+// throttled ones, are retried up to apiMaxRetries times with exponential
+// backoff.
+//
+// If roleARN is not empty, that IAM role is assumed to access the
+// repositories, and repositoryRoles maps the names of the repositories that
+// require a different role to the role to assume for each one, so that
+// repositories living in other AWS accounts can be cleaned up as well.
+func NewECRClient(auth AWSAuth, region, endpoint string, apiQPS float64, apiBurst, apiMaxRetries int, roleARN string, repositoryRoles map[string]string) *ECRClientImpl {
+	var limiter *rate.Limiter
+	if apiQPS > 0 {
+		limiter = rate.NewLimiter(rate.Limit(apiQPS), apiBurst)
+	}
+
+	client := &ECRClientImpl{
+		DeleteMaxRetries: deleteMaxRetries,
+		DeleteRetryDelay: deleteRetryDelay,
+	}
+
+	// Repositories assuming the same role share the same client
+	roleClients := map[string]ecriface.ECRAPI{}
+	newRoleClient := func(roleARN string) ecriface.ECRAPI {
+		if svc, ok := roleClients[roleARN]; ok {
+			return svc
+		}
+
+		svc := newECRService(newAssumeRoleSession(auth, region, roleARN), endpoint, limiter, apiMaxRetries)
+		traceAWSRequests(&svc.Handlers, client.requestContext)
+		roleClients[roleARN] = svc
+		return svc
+	}
+
+	client.ECRClient = newRoleClient(roleARN)
+
+	for repositoryName, repositoryRoleARN := range repositoryRoles {
+		if client.RepositoryClients == nil {
+			client.RepositoryClients = map[string]ecriface.ECRAPI{}
+		}
+		client.RepositoryClients[repositoryName] = newRoleClient(repositoryRoleARN)
+	}
+
+	return client
+}
+
+// newECRService returns a new ECR API client using the given session. The
+// client shares the given limiter, if any, with the other clients using it,
+// and retries are subject to it as well.
+func newECRService(sess *session.Session, endpoint string, limiter *rate.Limiter, maxRetries int) *ecr.ECR {
+	ecrConfig := aws.NewConfig()
+
+	if endpoint != "" {
+		ecrConfig.WithEndpoint(endpoint)
+	}
+
+	ecrConfig = request.WithRetryer(ecrConfig, client.DefaultRetryer{
+		NumMaxRetries:    maxRetries,
+		MinThrottleDelay: ecrMinThrottleDelay,
+		MaxThrottleDelay: ecrMaxThrottleDelay,
+	})
 
-	awsConfig := aws.NewConfig()
-	awsConfig.WithCredentials(creds)
-	awsConfig.WithRegion(region)
+	svc := ecr.New(sess, ecrConfig)
 
-	sess := session.New(awsConfig)
+	if limiter != nil {
+		svc.Handlers.Send.PushFront(rateLimitHandler(limiter))
+	}
+
+	return svc
+}
+
+// rateLimitHandler returns a request handler that blocks until the given
+// limiter allows the request to be sent, or until the request context is
+// cancelled, in which case the request fails with the context error.
+func rateLimitHandler(limiter *rate.Limiter) func(*request.Request) {
+	return func(r *request.Request) {
+		if err := limiter.Wait(limiterContext(r.Context())); err != nil {
+			r.Error = err
+		}
+	}
+}
+
+// limiterContextKey is the key of the context that the waits for the rate
+// limiter are canceled with, in a context returned by detachContext.
+type limiterContextKey struct{}
+
+// detachedContext is a context that is never canceled, which carries the
+// values, such as the span, of the context it was detached from.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	if key == (limiterContextKey{}) {
+		return c.Context
+	}
+	return c.Context.Value(key)
+}
+
+// detachContext returns a context for the requests that must be finished
+// once sent, such as deletions, so that ECR and the audit records never
+// disagree on the images deleted. Only the waits for the rate limiter are
+// canceled along with the given context.
+func detachContext(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
+
+// limiterContext returns the context that the waits for the rate limiter of a
+// request made with the given context are canceled with.
+func limiterContext(ctx context.Context) context.Context {
+	if parent, ok := ctx.Value(limiterContextKey{}).(context.Context); ok {
+		return parent
+	}
+	return ctx
+}
+
+// log returns the logger of this client, falling back to glog.
+func (c *ECRClientImpl) log() Logger {
+	if c.Logger == nil {
+		return glogLogger{}
+	}
+	return c.Logger
+}
+
+// requestContext returns the context the requests sent to ECR are made with.
+func (c *ECRClientImpl) requestContext() context.Context {
+	if c.Context == nil {
+		return context.Background()
+	}
+	return c.Context()
+}
 
-	return &ECRClientImpl{
-		ECRClient: ecr.New(sess),
+// api returns the client used for the repository with the given name.
+func (c *ECRClientImpl) api(repositoryName *string) ecriface.ECRAPI {
+	if svc, ok := c.RepositoryClients[aws.StringValue(repositoryName)]; ok {
+		return svc
 	}
+	return c.ECRClient
 }
 
 // ListRepositories returns the data belonging to the given repository names.
+// Repositories accessed through different clients are described separately.
 func (c *ECRClientImpl) ListRepositories(repositoryNames []*string) ([]*ecr.Repository, error) {
 	repos := []*ecr.Repository{}
 
@@ -74,16 +315,49 @@ func (c *ECRClientImpl) ListRepositories(repositoryNames []*string) ([]*ecr.Repo
 		return repos, nil
 	}
 
-	input := &ecr.DescribeRepositoriesInput{
-		RepositoryNames: repositoryNames,
+	// Clients are kept in the order of their first repository, so that the
+	// API is always called in the same order
+	clients := []ecriface.ECRAPI{}
+	namesByClient := map[ecriface.ECRAPI][]*string{}
+	for _, repositoryName := range repositoryNames {
+		svc := c.api(repositoryName)
+		if _, ok := namesByClient[svc]; !ok {
+			clients = append(clients, svc)
+		}
+		namesByClient[svc] = append(namesByClient[svc], repositoryName)
+	}
+
+	callback := func(page *ecr.DescribeRepositoriesOutput, lastPage bool) bool {
+		repos = append(repos, page.Repositories...)
+		return !lastPage
 	}
 
+	for _, svc := range clients {
+		input := &ecr.DescribeRepositoriesInput{
+			RepositoryNames: namesByClient[svc],
+		}
+
+		err := svc.DescribeRepositoriesPagesWithContext(c.requestContext(), input, callback)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return repos, nil
+}
+
+// ListAllRepositories returns the data belonging to all repositories in the
+// registry accessed through `ECRClient`. Repositories only accessible through
+// `RepositoryClients` are left out.
+func (c *ECRClientImpl) ListAllRepositories() ([]*ecr.Repository, error) {
+	repos := []*ecr.Repository{}
+
 	callback := func(page *ecr.DescribeRepositoriesOutput, lastPage bool) bool {
 		repos = append(repos, page.Repositories...)
 		return !lastPage
 	}
 
-	err := c.ECRClient.DescribeRepositoriesPages(input, callback)
+	err := c.ECRClient.DescribeRepositoriesPagesWithContext(c.requestContext(), &ecr.DescribeRepositoriesInput{}, callback)
 	if err != nil {
 		return nil, err
 	}
@@ -91,34 +365,109 @@ func (c *ECRClientImpl) ListRepositories(repositoryNames []*string) ([]*ecr.Repo
 	return repos, nil
 }
 
+// Ping makes sure the ECR API can be reached by listing a single repository.
+func (c *ECRClientImpl) Ping() error {
+	input := &ecr.DescribeRepositoriesInput{
+		MaxResults: aws.Int64(1),
+	}
+
+	return c.ECRClient.DescribeRepositoriesPagesWithContext(c.requestContext(), input, func(page *ecr.DescribeRepositoriesOutput, lastPage bool) bool {
+		return false
+	})
+}
+
 // ListImages returns data from all images stored in the repository identified
-// by the given repository name.
+// by the given repository name, which may be cached as per `ImageCacheTTL`.
 func (c *ECRClientImpl) ListImages(repositoryName *string) ([]*ecr.ImageDetail, error) {
-	images := []*ecr.ImageDetail{}
-
 	if repositoryName == nil {
-		return images, nil
+		return []*ecr.ImageDetail{}, nil
 	}
 
-	input := &ecr.DescribeImagesInput{
-		RepositoryName: repositoryName,
+	if c.ImageCacheTTL <= 0 {
+		return c.describeImages(repositoryName)
 	}
 
-	callback := func(page *ecr.DescribeImagesOutput, lastPage bool) bool {
-		images = append(images, page.ImageDetails...)
-		return !lastPage
+	now := time.Now()
+	if images, age, ok := c.images.get(*repositoryName, c.ImageCacheTTL, c.FullResyncInterval, now); ok {
+		c.log().Infof("Using the images of '%s' ECR repo listed %v ago.", *repositoryName, age/time.Second*time.Second)
+		return images, nil
 	}
 
-	err := c.ECRClient.DescribeImagesPages(input, callback)
+	images, err := c.describeImages(repositoryName)
 	if err != nil {
 		return nil, err
 	}
+	c.images.put(*repositoryName, images, now)
 
 	return images, nil
 }
 
+// describeImages returns data from all images stored in the repository
+// identified by the given repository name, as described by ECR.
+func (c *ECRClientImpl) describeImages(repositoryName *string) ([]*ecr.ImageDetail, error) {
+	var images []*ecr.ImageDetail
+
+	for restarts := 0; ; restarts++ {
+		images = []*ecr.ImageDetail{}
+
+		input := &ecr.DescribeImagesInput{
+			RepositoryName: repositoryName,
+		}
+		if tagStatus := describeImagesTagStatus(c.ImageTagStatus); tagStatus != "" {
+			input.Filter = &ecr.DescribeImagesFilter{TagStatus: aws.String(tagStatus)}
+		}
+
+		pages := 0
+		callback := func(page *ecr.DescribeImagesOutput, lastPage bool) bool {
+			images = append(images, page.ImageDetails...)
+			pages++
+			return !lastPage
+		}
+
+		err := c.api(repositoryName).DescribeImagesPagesWithContext(c.requestContext(), input, callback)
+		if err == nil {
+			return images, nil
+		}
+
+		// Paging through very large repositories can take long enough for
+		// the pagination token to expire
+		if pages == 0 || !isExpiredTokenError(err) || restarts >= listImagesMaxRestarts {
+			return nil, err
+		}
+
+		c.log().Warningf("Pagination token expired after listing %d images from '%s' ECR repo, listing them again from the start: %v", len(images), *repositoryName, err)
+	}
+}
+
+// describeImagesTagStatus returns the tag status by which DescribeImages
+// filters the images for the given `ImageTagStatus`, if any.
+func describeImagesTagStatus(imageTagStatus string) string {
+	switch imageTagStatus {
+	case ImageTagStatusTagged:
+		return ecr.TagStatusTagged
+	case ImageTagStatusUntagged:
+		return ecr.TagStatusUntagged
+	default:
+		return ""
+	}
+}
+
+// isExpiredTokenError tells whether the given error was returned by the ECR
+// API because the pagination token sent along the request is no longer valid.
+func isExpiredTokenError(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+
+	message := strings.ToLower(awsErr.Message())
+	return awsErr.Code() == ecr.ErrCodeInvalidParameterException && strings.Contains(message, "token")
+}
+
 // BatchRemoveImages deletes all the given images in one go. All images must
-// be stored in the same repository for this to work.
+// be stored in the same repository for this to work. Images that ECR fails
+// to delete are reported together as a MultiError, except for images that no
+// longer exist.
 func (c *ECRClientImpl) BatchRemoveImages(images []*ecr.ImageDetail) error {
 
 	// No images to be removed
@@ -151,12 +500,509 @@ func (c *ECRClientImpl) BatchRemoveImages(images []*ecr.ImageDetail) error {
 		ImageIds:       imageIds,
 	}
 
-	_, err := c.ECRClient.BatchDeleteImage(input)
+	// Some images might be gone even if the request fails, so the request
+	// is not aborted along with the pass
+	output, err := c.api(repositoryName).BatchDeleteImageWithContext(detachContext(c.requestContext()), input)
+	c.images.invalidate(*repositoryName)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// Images that could not be deleted are reported individually
+	errs := &MultiError{}
+	for _, failure := range output.Failures {
+
+		// Images that were already deleted, e.g. by a previous attempt, are
+		// fine since that's the desired state anyway
+		if aws.StringValue(failure.FailureCode) == ecr.ImageFailureCodeImageNotFound {
+			continue
+		}
+
+		digest := ""
+		if failure.ImageId != nil {
+			digest = aws.StringValue(failure.ImageId.ImageDigest)
+		}
+
+		errs.Append(&RepositoryError{
+			Repository: *repositoryName,
+			Digest:     digest,
+			Err:        &ImageFailureError{Code: aws.StringValue(failure.FailureCode), Reason: aws.StringValue(failure.FailureReason)},
+		})
+	}
+
+	return errs.ErrorOrNil()
+}
+
+// DeleteImages deletes all the given images in batches of at most
+// `batchRemoveMaxImages` images. All images must be stored in the same
+// repository for this to work. A failing batch does not prevent the remaining
+// batches from being deleted, and the images of each batch that fail with a
+// retryable failure code are deleted again, up to `DeleteMaxRetries` times.
+// All errors are reported together as a MultiError, with one error per image
+// that could not be deleted whenever ECR tells which ones. With
+// `ImageCacheTTL`, the images tagged since they were listed are not deleted,
+// and are reported as errors as well.
+func (c *ECRClientImpl) DeleteImages(images []*ecr.ImageDetail) error {
+
+	// No images to be removed
+	if len(images) == 0 {
+		return nil
+	}
+
+	repositoryName := aws.StringValue(images[0].RepositoryName)
+	deleted := 0
+	errs := &MultiError{}
+
+	// Cached images may have been tagged since they were listed, e.g. by
+	// retagging an image pulled by an older tag, in which case they may be
+	// in use by now
+	if c.ImageCacheTTL > 0 {
+		untouched, err := c.excludeRetaggedImages(images)
+		if _, ok := err.(*MultiError); err != nil && !ok {
+			return err
+		}
+		errs.Append(err)
+		images = untouched
+	}
+
+	total := len(images)
+
+	for start := 0; start < total; start += batchRemoveMaxImages {
+		end := start + batchRemoveMaxImages
+		if end > total {
+			end = total
+		}
+
+		batch := images[start:end]
+		batchDeleted := len(batch)
+
+		if err := c.retryImageFailures(c.BatchRemoveImages(batch)); err != nil {
+			errs.Append(err)
+			batchDeleted = countSucceeded(len(batch), err)
+			c.log().Warningf("Could not remove %d/%d images in repo '%s': %s.", len(batch)-batchDeleted, len(batch), repositoryName, imageFailureSummary(err))
+		}
+
+		deleted += batchDeleted
+		imagesDeletedTotal.WithLabelValues(repositoryName).Add(float64(batchDeleted))
+		imageDeletionErrorsTotal.WithLabelValues(repositoryName).Add(float64(len(batch) - batchDeleted))
+
+		if total >= deleteProgressLogThreshold {
+			c.log().Infof("Deleted %d/%d images in repo '%s'.", deleted, total, repositoryName)
+		}
+	}
+
+	return errs.ErrorOrNil()
+}
+
+// excludeRetaggedImages describes again the given images, all stored in the
+// same repository, bypassing the cache, and leaves out the ones tagged since
+// they were listed, reporting each of them in a MultiError.
+// Images that no longer exist are kept, since deleting them is harmless.
+func (c *ECRClientImpl) excludeRetaggedImages(images []*ecr.ImageDetail) ([]*ecr.ImageDetail, error) {
+	repositoryName := images[0].RepositoryName
+
+	current, err := c.describeImagesByDigest(repositoryName, images)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot describe the images to remove from '%s' ECR repo again: %v", *repositoryName, err)
+	}
+
+	untouched := []*ecr.ImageDetail{}
+	errs := &MultiError{}
+
+	for _, image := range images {
+		digest := aws.StringValue(image.ImageDigest)
+
+		if detail, ok := current[digest]; ok {
+			if added := addedTags(image.ImageTags, detail.ImageTags); len(added) > 0 {
+				errs.Append(&RepositoryError{
+					Repository: *repositoryName,
+					Digest:     digest,
+					Err:        fmt.Errorf("Tagged with [%s] since it was listed, not removing it", strings.Join(added, ", ")),
+				})
+				continue
+			}
+		}
+
+		untouched = append(untouched, image)
+	}
+
+	// The images are listed again in the next pass, even if none of them are
+	// deleted, so that the new tags are seen
+	if len(errs.Errors) > 0 {
+		c.log().Warningf("Not removing %d/%d images from repo '%s', which were tagged since they were listed.", len(errs.Errors), len(images), *repositoryName)
+		c.images.invalidate(*repositoryName)
+	}
+
+	return untouched, errs.ErrorOrNil()
+}
+
+// describeImagesByDigest returns the given images of the given repository,
+// as currently described by ECR, by digest. Images that no longer exist are
+// left out.
+func (c *ECRClientImpl) describeImagesByDigest(repositoryName *string, images []*ecr.ImageDetail) (map[string]*ecr.ImageDetail, error) {
+	described := map[string]*ecr.ImageDetail{}
+
+	for start := 0; start < len(images); start += describeImagesMaxImageIds {
+		end := start + describeImagesMaxImageIds
+		if end > len(images) {
+			end = len(images)
+		}
+
+		imageIds := []*ecr.ImageIdentifier{}
+		for _, image := range images[start:end] {
+			imageIds = append(imageIds, &ecr.ImageIdentifier{
+				ImageDigest: image.ImageDigest,
+			})
+		}
+
+		err := c.describeImageIds(repositoryName, imageIds, described)
+
+		// DescribeImages fails altogether once one of the images is gone,
+		// so they are described one by one to find out which ones are left
+		if isImageNotFoundError(err) {
+			for _, imageId := range imageIds {
+				if err := c.describeImageIds(repositoryName, []*ecr.ImageIdentifier{imageId}, described); err != nil && !isImageNotFoundError(err) {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return described, nil
+}
+
+// describeImageIds adds the given images of the given repository, as
+// described by ECR, to the given images by digest.
+func (c *ECRClientImpl) describeImageIds(repositoryName *string, imageIds []*ecr.ImageIdentifier, described map[string]*ecr.ImageDetail) error {
+	input := &ecr.DescribeImagesInput{
+		RepositoryName: repositoryName,
+		ImageIds:       imageIds,
+	}
+
+	return c.api(repositoryName).DescribeImagesPagesWithContext(c.requestContext(), input, func(page *ecr.DescribeImagesOutput, lastPage bool) bool {
+		for _, image := range page.ImageDetails {
+			described[aws.StringValue(image.ImageDigest)] = image
+		}
+		return !lastPage
+	})
+}
+
+// isImageNotFoundError tells whether the given error was returned by the ECR
+// API because some of the requested images do not exist.
+func isImageNotFoundError(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == ecr.ErrCodeImageNotFoundException
+}
+
+// addedTags returns the tags among the given current ones that are not among
+// the given listed ones.
+func addedTags(listed, current []*string) []string {
+	known := map[string]bool{}
+	for _, tag := range listed {
+		known[aws.StringValue(tag)] = true
+	}
+
+	added := []string{}
+	for _, tag := range current {
+		if !known[aws.StringValue(tag)] {
+			added = append(added, aws.StringValue(tag))
+		}
+	}
+
+	return added
+}
+
+// retryImageFailures deletes again the images whose deletion failed with a
+// retryable failure code, as reported by the given error of
+// BatchRemoveImages, waiting longer before each retry. It returns the
+// failures left once the retries are exhausted, once no retryable failures
+// are left, or once the pass is canceled.
+func (c *ECRClientImpl) retryImageFailures(err error) error {
+	delay := c.DeleteRetryDelay
+
+	for retry := 1; retry <= c.DeleteMaxRetries; retry++ {
+		retryable, rest := splitRetryableFailures(err)
+		if len(retryable) == 0 {
+			break
+		}
+
+		c.log().Infof("Retrying the removal of %d images in repo '%s' in %v (retry %d/%d).", len(retryable), *retryable[0].RepositoryName, delay, retry, c.DeleteMaxRetries)
+		if err := aws.SleepWithContext(c.requestContext(), delay); err != nil {
+			c.log().Warningf("Pass canceled, not retrying the removal of %d images in repo '%s'.", len(retryable), *retryable[0].RepositoryName)
+			break
+		}
+		delay *= 2
+
+		retryErr := c.BatchRemoveImages(retryable)
+
+		// Images cannot be told apart when the whole request fails, so each
+		// of them is reported as failed
+		if _, ok := retryErr.(*MultiError); retryErr != nil && !ok {
+			failures := &MultiError{}
+			for _, image := range retryable {
+				failures.Append(&RepositoryError{Repository: *image.RepositoryName, Digest: *image.ImageDigest, Err: retryErr})
+			}
+			retryErr = failures
+		}
+
+		errs := &MultiError{}
+		errs.Append(rest)
+		errs.Append(retryErr)
+		err = errs.ErrorOrNil()
+	}
+
+	return err
+}
+
+// splitRetryableFailures splits the per-image failures reported by the given
+// error of BatchRemoveImages into the images that can be deleted again, and
+// the error made of the other failures. Errors that don't come with per-image
+// failures are never retried here, since the SDK already retries failed
+// requests.
+func splitRetryableFailures(err error) ([]*ecr.ImageDetail, error) {
+	failures, ok := err.(*MultiError)
+	if !ok {
+		return nil, err
+	}
+
+	retryable := []*ecr.ImageDetail{}
+	rest := &MultiError{}
+	for _, failure := range failures.Errors {
+		repoErr, ok := failure.(*RepositoryError)
+		if ok && repoErr.Digest != "" {
+			if imageErr, ok := repoErr.Err.(*ImageFailureError); ok && retryableImageFailureCodes[imageErr.Code] {
+				retryable = append(retryable, &ecr.ImageDetail{
+					RepositoryName: aws.String(repoErr.Repository),
+					ImageDigest:    aws.String(repoErr.Digest),
+				})
+				continue
+			}
+		}
+		rest.Append(failure)
+	}
+
+	return retryable, rest.ErrorOrNil()
+}
+
+// imageFailureSummary returns the number of images that failed to be deleted
+// with each failure code, as reported by the given error of
+// BatchRemoveImages, e.g. "2 KmsError, 1 ImageReferencedByManifestList".
+// Other errors are counted as "other".
+func imageFailureSummary(err error) string {
+	errs := []error{err}
+	if failures, ok := err.(*MultiError); ok {
+		errs = failures.Errors
+	}
+
+	codes := []string{}
+	counts := map[string]int{}
+	for _, err := range errs {
+		code := "other"
+		if repoErr, ok := err.(*RepositoryError); ok {
+			if imageErr, ok := repoErr.Err.(*ImageFailureError); ok {
+				code = imageErr.Code
+			}
+		}
+
+		if counts[code] == 0 {
+			codes = append(codes, code)
+		}
+		counts[code]++
+	}
+
+	summary := make([]string, len(codes))
+	for i, code := range codes {
+		summary[i] = fmt.Sprintf("%d %s", counts[code], code)
+	}
+	return strings.Join(summary, ", ")
+}
+
+// IsManifestList tells whether the given image is a manifest list (or an OCI
+// image index) referencing other images, such as a multi-arch image.
+func IsManifestList(image *ecr.ImageDetail) bool {
+	mediaType := aws.StringValue(image.ImageManifestMediaType)
+	return mediaType == mediaTypeDockerManifestList || mediaType == mediaTypeOCIImageIndex
+}
+
+// manifestList holds the relevant parts of a manifest list or OCI image index.
+type manifestList struct {
+	Manifests []struct {
+		Digest string `json:"digest"`
+	} `json:"manifests"`
+}
+
+// ListManifestListChildren returns a map where the keys are the digests of the
+// given images that are manifest lists (or OCI image indexes), and the values
+// are the digests of the images they reference. All images must be stored in
+// the given repository.
+func (c *ECRClientImpl) ListManifestListChildren(repositoryName *string, images []*ecr.ImageDetail) (map[string][]string, error) {
+	children := map[string][]string{}
+
+	imageIds := []*ecr.ImageIdentifier{}
+	for _, image := range images {
+		if IsManifestList(image) {
+			imageIds = append(imageIds, &ecr.ImageIdentifier{
+				ImageDigest: image.ImageDigest,
+			})
+		}
+	}
+
+	for start := 0; start < len(imageIds); start += batchGetMaxImages {
+		end := start + batchGetMaxImages
+		if end > len(imageIds) {
+			end = len(imageIds)
+		}
+
+		input := &ecr.BatchGetImageInput{
+			RepositoryName:     repositoryName,
+			ImageIds:           imageIds[start:end],
+			AcceptedMediaTypes: []*string{aws.String(mediaTypeDockerManifestList), aws.String(mediaTypeOCIImageIndex)},
+		}
+
+		output, err := c.api(repositoryName).BatchGetImageWithContext(c.requestContext(), input)
+		if err != nil {
+			return nil, err
+		}
+
+		// Lists we cannot resolve would leave their children unprotected
+		if len(output.Failures) > 0 {
+			failure := output.Failures[0]
+			return nil, fmt.Errorf("Cannot get %d manifest lists, first failure: %s: %s", len(output.Failures), aws.StringValue(failure.FailureCode), aws.StringValue(failure.FailureReason))
+		}
+
+		for _, image := range output.Images {
+			list := manifestList{}
+			if err = json.Unmarshal([]byte(aws.StringValue(image.ImageManifest)), &list); err != nil {
+				return nil, fmt.Errorf("Cannot parse manifest list '%s': %v", aws.StringValue(image.ImageId.ImageDigest), err)
+			}
+
+			digest := aws.StringValue(image.ImageId.ImageDigest)
+			for _, manifest := range list.Manifests {
+				children[digest] = append(children[digest], manifest.Digest)
+			}
+		}
+	}
+
+	return children, nil
+}
+
+// GetImageManifests returns a map where the keys are the digests of the given
+// images and the values are their manifests. All images must be stored in the
+// given repository.
+func (c *ECRClientImpl) GetImageManifests(repositoryName *string, images []*ecr.ImageDetail) (map[string]string, error) {
+	manifests := map[string]string{}
+
+	imageIds := []*ecr.ImageIdentifier{}
+	for _, image := range images {
+		imageIds = append(imageIds, &ecr.ImageIdentifier{
+			ImageDigest: image.ImageDigest,
+		})
+	}
+
+	for start := 0; start < len(imageIds); start += batchGetMaxImages {
+		end := start + batchGetMaxImages
+		if end > len(imageIds) {
+			end = len(imageIds)
+		}
+
+		input := &ecr.BatchGetImageInput{
+			RepositoryName:     repositoryName,
+			ImageIds:           imageIds[start:end],
+			AcceptedMediaTypes: allManifestMediaTypes,
+		}
+
+		output, err := c.api(repositoryName).BatchGetImageWithContext(c.requestContext(), input)
+		if err != nil {
+			return nil, err
+		}
+
+		// Manifests we cannot get might have protected their images
+		if len(output.Failures) > 0 {
+			failure := output.Failures[0]
+			return nil, fmt.Errorf("Cannot get %d image manifests, first failure: %s: %s", len(output.Failures), aws.StringValue(failure.FailureCode), aws.StringValue(failure.FailureReason))
+		}
+
+		for _, image := range output.Images {
+			manifests[aws.StringValue(image.ImageId.ImageDigest)] = aws.StringValue(image.ImageManifest)
+		}
+	}
+
+	return manifests, nil
+}
+
+// TagImages adds a tag to each of the images stored in the given repository,
+// where the keys of the given map are image digests and the values are the
+// tags to add. Tags are added by pushing the image manifests again under the
+// new tags, so the images themselves are left untouched. Images that cannot be
+// tagged are reported together as a MultiError.
+func (c *ECRClientImpl) TagImages(repositoryName *string, tags map[string]string) error {
+	defer c.images.invalidate(aws.StringValue(repositoryName))
+
+	imageIds := []*ecr.ImageIdentifier{}
+	for digest := range tags {
+		imageIds = append(imageIds, &ecr.ImageIdentifier{
+			ImageDigest: aws.String(digest),
+		})
+	}
+
+	errs := &MultiError{}
+
+	for start := 0; start < len(imageIds); start += batchGetMaxImages {
+		end := start + batchGetMaxImages
+		if end > len(imageIds) {
+			end = len(imageIds)
+		}
+
+		input := &ecr.BatchGetImageInput{
+			RepositoryName:     repositoryName,
+			ImageIds:           imageIds[start:end],
+			AcceptedMediaTypes: allManifestMediaTypes,
+		}
+
+		output, err := c.api(repositoryName).BatchGetImageWithContext(c.requestContext(), input)
+		if err != nil {
+			errs.Append(err)
+			continue
+		}
+
+		for _, failure := range output.Failures {
+			digest := ""
+			if failure.ImageId != nil {
+				digest = aws.StringValue(failure.ImageId.ImageDigest)
+			}
+
+			errs.Append(&RepositoryError{
+				Repository: *repositoryName,
+				Digest:     digest,
+				Err:        fmt.Errorf("%s: %s", aws.StringValue(failure.FailureCode), aws.StringValue(failure.FailureReason)),
+			})
+		}
+
+		for _, image := range output.Images {
+			digest := aws.StringValue(image.ImageId.ImageDigest)
+
+			_, err = c.api(repositoryName).PutImageWithContext(c.requestContext(), &ecr.PutImageInput{
+				RepositoryName:         repositoryName,
+				ImageManifest:          image.ImageManifest,
+				ImageManifestMediaType: image.ImageManifestMediaType,
+				ImageTag:               aws.String(tags[digest]),
+			})
+			if err != nil {
+				errs.Append(&RepositoryError{
+					Repository: *repositoryName,
+					Digest:     digest,
+					Err:        err,
+				})
+			}
+		}
+	}
+
+	return errs.ErrorOrNil()
 }
 
 // SortImagesByPushDate uses the `ImagesByPushDate` type to sort the given slice
@@ -168,34 +1014,112 @@ func SortImagesByPushDate(images []*ecr.ImageDetail) {
 	sort.Sort(imagesByDate)
 }
 
+// Reasons why images are retained by ClassifyOldUnusedImages
+const (
+	RetainReasonInUse        = "in-use"
+	RetainReasonProtectedTag = "protected-tag"
+	RetainReasonKeepMax      = "within-keep-max"
+
+	// Images pushed before the `CountSince` window take no part in the
+	// `MaxImages` accounting, so only the rules based on age and protection
+	// apply to them.
+	RetainReasonAgeWindow = "within-age-window"
+
+	// Images whose manifests carry the `ProtectAnnotationKey` annotation are
+	// never deleted, regardless of the other rules.
+	RetainReasonAnnotation = "protected-annotation"
+
+	// Images pushed within `MinImageAge` are never deleted, regardless of the
+	// other rules.
+	RetainReasonMinAge = "within-min-age"
+
+	// Untagged images within `UntaggedKeepCount` and `UntaggedMaxAge`, when
+	// untagged images have their own policy.
+	RetainReasonUntaggedKeep = "within-untagged-keep"
+
+	// Images whose ECR scans are yet to complete, with `SkipScanPending`.
+	RetainReasonScanPending = "scan-pending"
+
+	// Images pulled within `MinDaysSinceLastPull` days, as recorded by ECR.
+	RetainReasonRecentlyPulled = "recently-pulled"
+
+	// The most recent tagged image of the repository, or of its group, with
+	// `AlwaysKeepLatestTagged`.
+	RetainReasonLatestTagged = "latest-tagged"
+)
+
+// RetainedImage is an image that is not to be deleted, along with the reason
+// why.
+type RetainedImage struct {
+	Image  *ecr.ImageDetail
+	Reason string
+}
+
+// Reasons why images are deleted, as found in the audit records. Images
+// selected by several rules are recorded with the first one in this list.
+const (
+	DeleteReasonKeepMax      = "exceeds-keep-max"
+	DeleteReasonReclaimBytes = "reclaim-bytes"
+	DeleteReasonUntagged     = "untagged-policy"
+	DeleteReasonTagCount     = "tag-count"
+	DeleteReasonMinSize      = "below-min-size"
+	DeleteReasonMaxAge       = "exceeds-max-age"
+
+	// Images with critical scan findings, with `DeleteCriticalFindings`.
+	DeleteReasonCriticalFindings = "critical-findings"
+
+	// Images deleted to bring the repository under `MaxRepositorySizeBytes`.
+	DeleteReasonRepositorySize = "exceeds-repo-size"
+
+	// Children that would be left behind by the manifest lists deleted, with
+	// `DeleteManifestListChildren`.
+	DeleteReasonManifestListChild = "orphaned-manifest-list-child"
+
+	// Manifest lists whose children are all gone, with
+	// `DeleteOrphanedManifestLists`.
+	DeleteReasonOrphanedManifestList = "orphaned-manifest-list"
+)
+
 // FilterOldUnusedImages goes through the given list of ECR images and returns
 // another list of images (giving priority to older images) that are not in use.
-// This list will contain at most 100 images, which is the maximum number of
-// images we are allowed to delete in a single API call to AWS.
 func FilterOldUnusedImages(keepMax int, repoImages []*ecr.ImageDetail, tagsInUse []string) []*ecr.ImageDetail {
+	deletable, _ := ClassifyOldUnusedImages(keepMax, repoImages, tagsInUse)
+	return deletable
+}
+
+// ClassifyOldUnusedImages goes through the given list of ECR images and returns
+// the images (giving priority to older images) that are not in use and exceed
+// keepMax, which are deletable, and the remaining images, which are retained,
+// each along with the reason why.
+func ClassifyOldUnusedImages(keepMax int, repoImages []*ecr.ImageDetail, tagsInUse []string) ([]*ecr.ImageDetail, []RetainedImage) {
 	usedImagesFound := 0
 	unusedImages := []*ecr.ImageDetail{}
-
-	// There's no need to remove any images for now
-	if keepMax >= len(repoImages) {
-		return []*ecr.ImageDetail{}
-	}
+	retained := []RetainedImage{}
 
 repoImagesLoop:
 	for _, repoImage := range repoImages {
 		for _, tag := range repoImage.ImageTags {
 			if *tag == "latest" {
+				retained = append(retained, RetainedImage{Image: repoImage, Reason: RetainReasonProtectedTag})
 				continue repoImagesLoop
 			}
 
 			for _, tagInUse := range tagsInUse {
 				if tagInUse == *tag {
 					usedImagesFound++
+					retained = append(retained, RetainedImage{Image: repoImage, Reason: RetainReasonInUse})
 					continue repoImagesLoop
 				}
 			}
 		}
 
+		// Images pulled by digest are in use whatever their tags
+		if isImageInUse(repoImage, tagsInUse) {
+			usedImagesFound++
+			retained = append(retained, RetainedImage{Image: repoImage, Reason: RetainReasonInUse})
+			continue
+		}
+
 		unusedImages = append(unusedImages, repoImage)
 	}
 
@@ -205,12 +1129,68 @@ repoImagesLoop:
 	if lastImageIdx > len(unusedImages) {
 		lastImageIdx = len(unusedImages)
 	}
+	if lastImageIdx < 0 {
+		lastImageIdx = 0
+	}
+
+	for _, image := range unusedImages[lastImageIdx:] {
+		retained = append(retained, RetainedImage{Image: image, Reason: RetainReasonKeepMax})
+	}
+
+	return unusedImages[:lastImageIdx], retained
+}
+
+// ClassifyOldUnusedImagesByGroup is like ClassifyOldUnusedImages, but keeps
+// up to keepMax images in each group the given images are split into, as
+// given by groupOf, with images in use counting against the images to keep
+// of their own group. The deletable images are sorted by push date.
+func ClassifyOldUnusedImagesByGroup(keepMax int, repoImages []*ecr.ImageDetail, tagsInUse []string, groupOf func(*ecr.ImageDetail) string) ([]*ecr.ImageDetail, []RetainedImage) {
+	groups := []string{}
+	groupImages := map[string][]*ecr.ImageDetail{}
+	for _, image := range repoImages {
+		group := groupOf(image)
+		if _, ok := groupImages[group]; !ok {
+			groups = append(groups, group)
+		}
+		groupImages[group] = append(groupImages[group], image)
+	}
+
+	deletable := []*ecr.ImageDetail{}
+	retained := []RetainedImage{}
+	for _, group := range groups {
+		groupDeletable, groupRetained := ClassifyOldUnusedImages(keepMax, groupImages[group], tagsInUse)
+		deletable = append(deletable, groupDeletable...)
+		retained = append(retained, groupRetained...)
+	}
+
+	SortImagesByPushDate(deletable)
+
+	return deletable, retained
+}
+
+// ClassifyUntaggedImages goes through the given list of untagged ECR images
+// and returns the images (giving priority to older images) that are deletable,
+// that is, the ones exceeding the keepCount most recent images if keepCount is
+// greater than zero, and the ones pushed more than maxAge before now if maxAge
+// is greater than zero, and the remaining images, which are retained.
+func ClassifyUntaggedImages(keepCount int, maxAge time.Duration, now time.Time, repoImages []*ecr.ImageDetail) ([]*ecr.ImageDetail, []RetainedImage) {
+	images := append([]*ecr.ImageDetail{}, repoImages...)
+	SortImagesByPushDate(images)
+
+	deletable := []*ecr.ImageDetail{}
+	retained := []RetainedImage{}
 
-	// Only returns the 100 oldest unused images, which is the number of
-	// images we are allowed to delete in a single API call
-	if lastImageIdx > batchRemoveMaxImages {
-		lastImageIdx = batchRemoveMaxImages
+	pushedBefore := now.Add(-maxAge)
+	for i, image := range images {
+		tooMany := keepCount > 0 && i < len(images)-keepCount
+		tooOld := maxAge > 0 && image.ImagePushedAt != nil && image.ImagePushedAt.Before(pushedBefore)
+
+		if tooMany || tooOld {
+			deletable = append(deletable, image)
+		} else {
+			retained = append(retained, RetainedImage{Image: image, Reason: RetainReasonUntaggedKeep})
+		}
 	}
 
-	return unusedImages[:lastImageIdx]
+	return deletable, retained
 }
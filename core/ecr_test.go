@@ -1,12 +1,20 @@
 package core
 
 import (
+	"context"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"golang.org/x/time/rate"
 )
 
 // mockAWSECRClient is used to verify that the ECR client is being called with the
@@ -19,10 +27,50 @@ type mockAWSECRClient struct {
 	expectedRepositoryNames []string
 	expectedImageDigests    []string
 
-	outputError error
+	// When set, each call to BatchDeleteImage is expected to delete the
+	// digests in the corresponding batch, instead of `expectedImageDigests`
+	expectedImageDigestBatches [][]string
+	batchDeleteImageCalls      int
+
+	// Called by BatchDeleteImage while the images are being deleted, such
+	// as to cancel the pass. The call fails, as with the SDK, if its
+	// context is canceled by then
+	onBatchDeleteImage func()
+
+	outputFailures []*ecr.ImageFailure
+	outputImages   []*ecr.Image
+	outputError    error
+
+	// When set, each call to BatchDeleteImage reports the failures in the
+	// corresponding batch, instead of `outputFailures`
+	outputFailureBatches [][]*ecr.ImageFailure
+
+	putImageInputs []*ecr.PutImageInput
+	putImageError  error
+
+	putLifecyclePolicyInputs []*ecr.PutLifecyclePolicyInput
+
+	listTagsForResourceOutput *ecr.ListTagsForResourceOutput
+
+	describeRegistryOutput *ecr.DescribeRegistryOutput
+	pullThroughCacheRules  []*ecr.PullThroughCacheRule
+
+	deleteRepositoryInputs []*ecr.DeleteRepositoryInput
+
+	// The first calls to DescribeImagesPages fail after the first page due
+	// to an expired pagination token
+	describeImagesTokenExpiries int
+	describeImagesCalls         int
+	describeImagesInputs        []*ecr.DescribeImagesInput
+
+	// Current tags of the images described by digest, which otherwise exist
+	// untagged unless listed in `missingImageDigests`
+	currentImageTags     map[string][]*string
+	missingImageDigests  map[string]bool
+	describeImageIdCalls int
 }
 
-func (m *mockAWSECRClient) DescribeRepositoriesPages(input *ecr.DescribeRepositoriesInput, fn func(*ecr.DescribeRepositoriesOutput, bool) bool) error {
+func (m *mockAWSECRClient) DescribeRepositoriesPagesWithContext(ctx aws.Context, input *ecr.DescribeRepositoriesInput, fn func(*ecr.DescribeRepositoriesOutput, bool) bool, opts ...request.Option) error {
 	if input == nil {
 		m.t.Errorf("Unexpected nil input")
 	}
@@ -59,7 +107,7 @@ func (m *mockAWSECRClient) DescribeRepositoriesPages(input *ecr.DescribeReposito
 	return m.outputError
 }
 
-func (m *mockAWSECRClient) DescribeImagesPages(input *ecr.DescribeImagesInput, fn func(*ecr.DescribeImagesOutput, bool) bool) error {
+func (m *mockAWSECRClient) DescribeImagesPagesWithContext(ctx aws.Context, input *ecr.DescribeImagesInput, fn func(*ecr.DescribeImagesOutput, bool) bool, opts ...request.Option) error {
 	if input == nil {
 		m.t.Errorf("Unexpected nil input")
 	}
@@ -68,6 +116,28 @@ func (m *mockAWSECRClient) DescribeImagesPages(input *ecr.DescribeImagesInput, f
 		m.t.Errorf("Expected repository name to be %s, but was %s", m.expectedRepositoryNames[0], *input.RepositoryName)
 	}
 
+	// Images described by digest, as ECR does, fail altogether if one of
+	// them does not exist
+	if len(input.ImageIds) > 0 {
+		m.describeImageIdCalls++
+
+		page := &ecr.DescribeImagesOutput{}
+		for _, imageId := range input.ImageIds {
+			if m.missingImageDigests[*imageId.ImageDigest] {
+				return awserr.New(ecr.ErrCodeImageNotFoundException, "The image requested does not exist", nil)
+			}
+			page.ImageDetails = append(page.ImageDetails, &ecr.ImageDetail{
+				ImageDigest: imageId.ImageDigest,
+				ImageTags:   m.currentImageTags[*imageId.ImageDigest],
+			})
+		}
+
+		fn(page, true)
+		return nil
+	}
+
+	m.describeImagesInputs = append(m.describeImagesInputs, input)
+
 	imageDigest := "image-digest"
 	page := &ecr.DescribeImagesOutput{
 		ImageDetails: []*ecr.ImageDetail{
@@ -77,6 +147,12 @@ func (m *mockAWSECRClient) DescribeImagesPages(input *ecr.DescribeImagesInput, f
 		},
 	}
 
+	m.describeImagesCalls++
+	if m.describeImagesCalls <= m.describeImagesTokenExpiries {
+		fn(page, false)
+		return awserr.New(ecr.ErrCodeInvalidParameterException, "Invalid parameter at 'nextToken' failed to satisfy constraint: 'The token has expired'", nil)
+	}
+
 	// There's two pages, so the function must return true
 	if fn(page, false) != true {
 		m.t.Errorf("Expected callback to return true for first page, but returned false")
@@ -90,7 +166,49 @@ func (m *mockAWSECRClient) DescribeImagesPages(input *ecr.DescribeImagesInput, f
 	return m.outputError
 }
 
-func (m *mockAWSECRClient) BatchDeleteImage(input *ecr.BatchDeleteImageInput) (*ecr.BatchDeleteImageOutput, error) {
+func (m *mockAWSECRClient) BatchDeleteImageWithContext(ctx aws.Context, input *ecr.BatchDeleteImageInput, opts ...request.Option) (*ecr.BatchDeleteImageOutput, error) {
+	if input == nil {
+		m.t.Errorf("Unexpected nil input")
+	}
+
+	if *input.RepositoryName != m.expectedRepositoryNames[0] {
+		m.t.Errorf("Expected repository name to be %s, but was %s", m.expectedRepositoryNames[0], *input.RepositoryName)
+	}
+
+	expectedImageDigests := m.expectedImageDigests
+	if m.expectedImageDigestBatches != nil {
+		if m.batchDeleteImageCalls >= len(m.expectedImageDigestBatches) {
+			m.t.Fatalf("Unexpected call to BatchDeleteImage #%d", m.batchDeleteImageCalls+1)
+		}
+		expectedImageDigests = m.expectedImageDigestBatches[m.batchDeleteImageCalls]
+	}
+	outputFailures := m.outputFailures
+	if m.outputFailureBatches != nil {
+		outputFailures = m.outputFailureBatches[m.batchDeleteImageCalls]
+	}
+	m.batchDeleteImageCalls++
+
+	if len(input.ImageIds) != len(expectedImageDigests) {
+		m.t.Errorf("Expected delete with %d images, but got %d", len(expectedImageDigests), len(input.ImageIds))
+	}
+
+	for i := range input.ImageIds {
+		if *input.ImageIds[i].ImageDigest != expectedImageDigests[i] {
+			m.t.Errorf("Expected image digest of image in idx %d to be %v, but was %v", i, expectedImageDigests[i], *input.ImageIds[i].ImageDigest)
+		}
+	}
+
+	if m.onBatchDeleteImage != nil {
+		m.onBatchDeleteImage()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, awserr.New(request.CanceledErrorCode, "request context canceled", err)
+	}
+
+	return &ecr.BatchDeleteImageOutput{Failures: outputFailures}, m.outputError
+}
+
+func (m *mockAWSECRClient) BatchGetImageWithContext(ctx aws.Context, input *ecr.BatchGetImageInput, opts ...request.Option) (*ecr.BatchGetImageOutput, error) {
 	if input == nil {
 		m.t.Errorf("Unexpected nil input")
 	}
@@ -100,16 +218,100 @@ func (m *mockAWSECRClient) BatchDeleteImage(input *ecr.BatchDeleteImageInput) (*
 	}
 
 	if len(input.ImageIds) != len(m.expectedImageDigests) {
-		m.t.Errorf("Expected delete with %d images, but got %d", len(m.expectedImageDigests), len(input.ImageIds))
+		m.t.Errorf("Expected get with %d images, but got %d", len(m.expectedImageDigests), len(input.ImageIds))
 	}
 
 	for i := range input.ImageIds {
 		if *input.ImageIds[i].ImageDigest != m.expectedImageDigests[i] {
-			m.t.Errorf("Expected image digest of image in idx %d to be %v, but was %v", i, m.expectedImageDigests, *input.ImageIds[i].ImageDigest)
+			m.t.Errorf("Expected image digest of image in idx %d to be %v, but was %v", i, m.expectedImageDigests[i], *input.ImageIds[i].ImageDigest)
+		}
+	}
+
+	if m.outputError != nil {
+		return nil, m.outputError
+	}
+
+	return &ecr.BatchGetImageOutput{Images: m.outputImages, Failures: m.outputFailures}, nil
+}
+
+func (m *mockAWSECRClient) PutLifecyclePolicyWithContext(ctx aws.Context, input *ecr.PutLifecyclePolicyInput, opts ...request.Option) (*ecr.PutLifecyclePolicyOutput, error) {
+	m.putLifecyclePolicyInputs = append(m.putLifecyclePolicyInputs, input)
+
+	if m.outputError != nil {
+		return nil, m.outputError
+	}
+
+	return &ecr.PutLifecyclePolicyOutput{}, nil
+}
+
+func (m *mockAWSECRClient) ListTagsForResourceWithContext(ctx aws.Context, input *ecr.ListTagsForResourceInput, opts ...request.Option) (*ecr.ListTagsForResourceOutput, error) {
+	if input == nil {
+		m.t.Errorf("Unexpected nil input")
+	}
+
+	if m.outputError != nil {
+		return nil, m.outputError
+	}
+
+	return m.listTagsForResourceOutput, nil
+}
+
+func (m *mockAWSECRClient) DescribeRegistryWithContext(ctx aws.Context, input *ecr.DescribeRegistryInput, opts ...request.Option) (*ecr.DescribeRegistryOutput, error) {
+	if input == nil {
+		m.t.Errorf("Unexpected nil input")
+	}
+
+	if m.outputError != nil {
+		return nil, m.outputError
+	}
+
+	return m.describeRegistryOutput, nil
+}
+
+func (m *mockAWSECRClient) DeleteRepositoryWithContext(ctx aws.Context, input *ecr.DeleteRepositoryInput, opts ...request.Option) (*ecr.DeleteRepositoryOutput, error) {
+	m.deleteRepositoryInputs = append(m.deleteRepositoryInputs, input)
+
+	if m.outputError != nil {
+		return nil, m.outputError
+	}
+
+	return &ecr.DeleteRepositoryOutput{}, nil
+}
+
+func (m *mockAWSECRClient) DescribePullThroughCacheRulesPagesWithContext(ctx aws.Context, input *ecr.DescribePullThroughCacheRulesInput, fn func(*ecr.DescribePullThroughCacheRulesOutput, bool) bool, opts ...request.Option) error {
+	if input == nil {
+		m.t.Errorf("Unexpected nil input")
+	}
+
+	if m.outputError != nil {
+		return m.outputError
+	}
+
+	// One rule per page
+	for i, rule := range m.pullThroughCacheRules {
+		output := &ecr.DescribePullThroughCacheRulesOutput{
+			PullThroughCacheRules: []*ecr.PullThroughCacheRule{rule},
+		}
+		if !fn(output, i == len(m.pullThroughCacheRules)-1) {
+			break
 		}
 	}
 
-	return nil, m.outputError
+	return nil
+}
+
+func (m *mockAWSECRClient) PutImageWithContext(ctx aws.Context, input *ecr.PutImageInput, opts ...request.Option) (*ecr.PutImageOutput, error) {
+	if input == nil {
+		m.t.Errorf("Unexpected nil input")
+	}
+
+	m.putImageInputs = append(m.putImageInputs, input)
+
+	if m.putImageError != nil {
+		return nil, m.putImageError
+	}
+
+	return &ecr.PutImageOutput{}, nil
 }
 
 func TestSortImagesByPushDate(t *testing.T) {
@@ -118,35 +320,168 @@ func TestSortImagesByPushDate(t *testing.T) {
 		time.Unix(1, 0),
 		time.Unix(2, 0),
 	}
+	digests := []string{"digest-0", "digest-1a", "digest-1b", "digest-2"}
 
 	ecrImages := []*ecr.ImageDetail{
 		{
+			ImageDigest:   &digests[3],
 			ImagePushedAt: &orderedTime[2],
 		},
 		{
+			ImageDigest:   &digests[2],
 			ImagePushedAt: &orderedTime[1],
 		},
 		{
+			ImageDigest:   &digests[0],
 			ImagePushedAt: &orderedTime[0],
 		},
+		{
+			ImageDigest:   &digests[1],
+			ImagePushedAt: &orderedTime[1],
+		},
 	}
 
 	SortImagesByPushDate(ecrImages)
 
-	if len(ecrImages) != 3 {
-		t.Errorf("Expected image list to remain with 3 elements, but the size is now %d", len(ecrImages))
+	if len(ecrImages) != 4 {
+		t.Errorf("Expected image list to remain with 4 elements, but the size is now %d", len(ecrImages))
 	}
 
+	// Images pushed at the same time are sorted by digest
 	for i := range ecrImages {
-		actualDate := *ecrImages[i].ImagePushedAt
-		expectedDate := time.Unix(int64(i), 0)
+		if *ecrImages[i].ImageDigest != digests[i] {
+			t.Errorf("Expected ecrImages[%d] digest to be %s, but was %s", i, digests[i], *ecrImages[i].ImageDigest)
+		}
+	}
+}
+
+func TestNewECRClientEndpoint(t *testing.T) {
+	testCases := []struct {
+		region   string
+		endpoint string
+		expected string
+	}{
+		// Default endpoint for the region
+		{
+			region:   "us-east-1",
+			endpoint: "",
+			expected: "https://api.ecr.us-east-1.amazonaws.com",
+		},
+
+		// Custom endpoint
+		{
+			region:   "us-east-1",
+			endpoint: "http://localhost:4566",
+			expected: "http://localhost:4566",
+		},
+	}
+
+	for _, testCase := range testCases {
+		client := NewECRClient(AWSAuth{}, testCase.region, testCase.endpoint, 0, 0, 0, "", nil)
+		actual := client.ECRClient.(*ecr.ECR).Endpoint
 
-		if *ecrImages[i].ImagePushedAt != expectedDate {
-			t.Errorf("Expected ercImages[%d] timestamp to be %+v, but was %+v", i, expectedDate, actualDate)
+		if actual != testCase.expected {
+			t.Errorf("Expected endpoint to be %s, but was %s", testCase.expected, actual)
 		}
 	}
 }
 
+func TestNewECRClientRetries(t *testing.T) {
+	ecrClient := NewECRClient(AWSAuth{}, "us-east-1", "", 0, 0, 5, "", nil)
+
+	retryer, ok := ecrClient.ECRClient.(*ecr.ECR).Retryer.(client.DefaultRetryer)
+	if !ok {
+		t.Fatalf("Expected the default retryer to be used, but got %T", ecrClient.ECRClient.(*ecr.ECR).Retryer)
+	}
+
+	if retryer.NumMaxRetries != 5 {
+		t.Errorf("Expected requests to be retried up to 5 times, but was %d", retryer.NumMaxRetries)
+	}
+
+	if retryer.MaxThrottleDelay != ecrMaxThrottleDelay {
+		t.Errorf("Expected throttled requests to be retried after up to %v, but was %v", ecrMaxThrottleDelay, retryer.MaxThrottleDelay)
+	}
+}
+
+func TestNewECRClientWithRoles(t *testing.T) {
+	client := NewECRClient(AWSAuth{}, "us-east-1", "", 0, 0, 0, "arn:aws:iam::111111111111:role/cleanup", map[string]string{
+		"repo-1": "arn:aws:iam::222222222222:role/cleanup",
+		"repo-2": "arn:aws:iam::222222222222:role/cleanup",
+		"repo-3": "arn:aws:iam::111111111111:role/cleanup",
+	})
+
+	if len(client.RepositoryClients) != 3 {
+		t.Fatalf("Expected repository clients to contain 3 elements, but it contains %d", len(client.RepositoryClients))
+	}
+
+	// Repositories assuming the same role share the same client
+	if client.RepositoryClients["repo-1"] != client.RepositoryClients["repo-2"] {
+		t.Errorf("Expected repositories assuming the same role to share the same client, but they did not")
+	}
+
+	if client.RepositoryClients["repo-3"] != client.ECRClient {
+		t.Errorf("Expected repositories assuming the default role to share the default client, but they did not")
+	}
+
+	if client.RepositoryClients["repo-1"] == client.ECRClient {
+		t.Errorf("Expected repositories assuming a different role not to share the default client, but they did")
+	}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	limiter := rate.NewLimiter(rate.Every(time.Hour), 1)
+	handler := rateLimitHandler(limiter)
+
+	// The first request is allowed by the burst
+	r := &request.Request{}
+	r.SetContext(context.Background())
+	handler(r)
+
+	if r.Error != nil {
+		t.Errorf("Expected request error to be nil, but was %v", r.Error)
+	}
+
+	// The second request would have to wait, but the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r = &request.Request{}
+	r.SetContext(ctx)
+	handler(r)
+
+	if r.Error == nil {
+		t.Errorf("Expected request error not to be nil, but it was")
+	}
+}
+
+func TestDetachContext(t *testing.T) {
+	type key struct{}
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "value"))
+	cancel()
+
+	// Requests keep going, but still wait for the limiter with the context
+	// they were detached from, even once wrapped, such as by tracing
+	detached := context.WithValue(detachContext(ctx), struct{}{}, "span")
+	if detached.Err() != nil || detached.Value(key{}) != "value" {
+		t.Errorf("Expected the detached context to keep its values without being canceled, but got %v", detached.Err())
+	}
+	if limiterContext(detached) != ctx {
+		t.Errorf("Expected the limiter to wait with the original context")
+	}
+
+	limiter := rate.NewLimiter(rate.Every(time.Hour), 1)
+	limiter.Allow()
+
+	r := &request.Request{}
+	r.SetContext(detached)
+	rateLimitHandler(limiter)(r)
+
+	if r.Error == nil {
+		t.Errorf("Expected request error not to be nil, but it was")
+	}
+}
+
 func TestListRepositoriesWithEmptyRepos(t *testing.T) {
 	client := ECRClientImpl{
 		ECRClient: nil, // Should not interact with the ECR client
@@ -187,6 +522,36 @@ func TestListRepositoriesError(t *testing.T) {
 	}
 }
 
+func TestListRepositoriesWithRepositoryClients(t *testing.T) {
+	repoNames := []string{"repo-1", "repo-2", "repo-3"}
+
+	client := ECRClientImpl{
+		ECRClient: &mockAWSECRClient{
+			t: t,
+
+			expectedRepositoryNames: []string{repoNames[0], repoNames[2]},
+		},
+		RepositoryClients: map[string]ecriface.ECRAPI{
+			repoNames[1]: &mockAWSECRClient{
+				t: t,
+
+				expectedRepositoryNames: []string{repoNames[1]},
+			},
+		},
+	}
+
+	repos, err := client.ListRepositories([]*string{&repoNames[0], &repoNames[1], &repoNames[2]})
+
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+
+	// Each client returns two pages with one repo each
+	if len(repos) != 4 {
+		t.Errorf("Expected repos to contain 4 elements, but it contains %d", len(repos))
+	}
+}
+
 func TestListRepositories(t *testing.T) {
 	repoNames := []string{"repo-1"}
 
@@ -204,178 +569,1019 @@ func TestListRepositories(t *testing.T) {
 		t.Errorf("Expected error to be nil, but it was: %v", err)
 	}
 
-	if repos == nil {
-		t.Errorf("Expected repos not to be nil, but it was")
+	if repos == nil {
+		t.Errorf("Expected repos not to be nil, but it was")
+	}
+
+	if len(repos) != 2 {
+		t.Errorf("Expected repos to contain 2 items, but it contains: %q", repos)
+	}
+}
+
+func TestListAllRepositories(t *testing.T) {
+	client := ECRClientImpl{
+		ECRClient: &mockAWSECRClient{
+			t: t,
+		},
+	}
+
+	repos, err := client.ListAllRepositories()
+
+	if err != nil {
+		t.Errorf("Expected error to be nil, but it was: %v", err)
+	}
+
+	if len(repos) != 2 {
+		t.Errorf("Expected repos to contain 2 items, but it contains: %q", repos)
+	}
+}
+
+func TestListImagesWithNilRepositoryName(t *testing.T) {
+	client := ECRClientImpl{
+		ECRClient: nil, // Should not interact with the ECR client
+	}
+
+	images, err := client.ListImages(nil)
+
+	if len(images) != 0 {
+		t.Errorf("Expected images to be empty, but was not: %q", images)
+	}
+
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+}
+
+func TestListImagesError(t *testing.T) {
+	repoName := "repo-1"
+
+	client := ECRClientImpl{
+		ECRClient: &mockAWSECRClient{
+			t: t,
+
+			expectedRepositoryNames: []string{repoName},
+
+			outputError: fmt.Errorf(""),
+		},
+	}
+
+	images, err := client.ListImages(&repoName)
+
+	if images != nil {
+		t.Errorf("Expected images to be nil, but was %v", images)
+	}
+
+	if err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+}
+
+func TestListImages(t *testing.T) {
+	repoName := "repo-1"
+
+	client := ECRClientImpl{
+		ECRClient: &mockAWSECRClient{
+			t: t,
+
+			expectedRepositoryNames: []string{repoName},
+		},
+	}
+
+	images, err := client.ListImages(&repoName)
+
+	if err != nil {
+		t.Errorf("Expected error to be nil, but it was: %v", err)
+	}
+
+	if images == nil {
+		t.Errorf("Expected images not to be nil, but it was")
+	}
+
+	if len(images) != 2 {
+		t.Errorf("Expected images to contain 2 items, but it contains: %q", images)
+	}
+}
+
+func TestListImagesWithTagStatus(t *testing.T) {
+	repoName := "repo-1"
+
+	testCases := []struct {
+		imageTagStatus string
+		expected       *ecr.DescribeImagesFilter
+	}{
+		{"", nil},
+		{ImageTagStatusTagged, &ecr.DescribeImagesFilter{TagStatus: aws.String(ecr.TagStatusTagged)}},
+		{ImageTagStatusUntagged, &ecr.DescribeImagesFilter{TagStatus: aws.String(ecr.TagStatusUntagged)}},
+	}
+
+	for i, testCase := range testCases {
+		mock := &mockAWSECRClient{
+			t: t,
+
+			expectedRepositoryNames: []string{repoName},
+		}
+		client := ECRClientImpl{ECRClient: mock, ImageTagStatus: testCase.imageTagStatus}
+
+		if _, err := client.ListImages(&repoName); err != nil {
+			t.Fatalf("Test case %d: expected no error, but got %v", i, err)
+		}
+
+		if len(mock.describeImagesInputs) != 1 || !reflect.DeepEqual(mock.describeImagesInputs[0].Filter, testCase.expected) {
+			t.Errorf("Test case %d: expected images to be filtered by %v, but got %v", i, testCase.expected, mock.describeImagesInputs)
+		}
+	}
+}
+
+func TestListImagesWithCache(t *testing.T) {
+	repoName, digest := "repo-1", "image-digest"
+	mock := &mockAWSECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		expectedImageDigests:    []string{digest},
+	}
+
+	client := &ECRClientImpl{
+		ECRClient:     mock,
+		Logger:        &mockLogger{},
+		ImageCacheTTL: time.Hour,
+	}
+
+	for i := 0; i < 2; i++ {
+		images, err := client.ListImages(&repoName)
+		if err != nil {
+			t.Fatalf("Expected error to be nil, but it was: %v", err)
+		}
+		if len(images) != 2 {
+			t.Errorf("Expected images to contain 2 items, but it contains: %q", images)
+		}
+	}
+
+	if mock.describeImagesCalls != 1 {
+		t.Errorf("Expected images to be described once, but they were described %d times", mock.describeImagesCalls)
+	}
+
+	// Deletions invalidate the images of the repository
+	if err := client.DeleteImages([]*ecr.ImageDetail{{RepositoryName: &repoName, ImageDigest: &digest}}); err != nil {
+		t.Fatalf("Expected error to be nil, but it was: %v", err)
+	}
+	if _, err := client.ListImages(&repoName); err != nil {
+		t.Fatalf("Expected error to be nil, but it was: %v", err)
+	}
+
+	if mock.describeImagesCalls != 2 {
+		t.Errorf("Expected images to be described again after deletions, but they were described %d times", mock.describeImagesCalls)
+	}
+}
+
+func TestDeleteCachedImagesExcludesRetaggedImages(t *testing.T) {
+	repoName, oldTag, newTag := "repo-1", "old", "new"
+	images, _ := newTestImages(repoName, 4)
+	images[0].ImageTags = []*string{&oldTag}
+	images[1].ImageTags = []*string{&oldTag}
+
+	// The first image got a new tag since it was listed, the second one
+	// lost its tag, and the last one is gone
+	mock := &mockAWSECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		expectedImageDigests:    []string{*images[1].ImageDigest, *images[2].ImageDigest, *images[3].ImageDigest},
+
+		currentImageTags: map[string][]*string{
+			*images[0].ImageDigest: {&oldTag, &newTag},
+		},
+		missingImageDigests: map[string]bool{
+			*images[3].ImageDigest: true,
+		},
+	}
+
+	client := &ECRClientImpl{
+		ECRClient:     mock,
+		Logger:        &mockLogger{},
+		ImageCacheTTL: time.Hour,
+	}
+
+	err := client.DeleteImages(images)
+
+	if mock.batchDeleteImageCalls != 1 {
+		t.Errorf("Expected 1 call to BatchDeleteImage, but got %d", mock.batchDeleteImageCalls)
+	}
+
+	// Described at once, then one by one once an image was not found
+	if mock.describeImageIdCalls != 5 {
+		t.Errorf("Expected 5 calls to describe the images by digest, but got %d", mock.describeImageIdCalls)
+	}
+
+	multiErr, ok := err.(*MultiError)
+	if !ok || len(multiErr.Errors) != 1 {
+		t.Fatalf("Expected a MultiError with 1 error, but got %v", err)
+	}
+
+	repoErr, ok := multiErr.Errors[0].(*RepositoryError)
+	if !ok || repoErr.Digest != *images[0].ImageDigest || !strings.Contains(repoErr.Error(), newTag) {
+		t.Errorf("Expected the retagged image to be reported, but got %v", multiErr.Errors[0])
+	}
+}
+
+func TestListImagesWithExpiredToken(t *testing.T) {
+	testCases := []struct {
+		tokenExpiries int
+		expectError   bool
+	}{
+		// Listing starts over from the first page
+		{
+			tokenExpiries: 1,
+			expectError:   false,
+		},
+
+		// Listing gives up after too many restarts
+		{
+			tokenExpiries: listImagesMaxRestarts + 1,
+			expectError:   true,
+		},
+	}
+
+	for i, testCase := range testCases {
+		repoName := "repo-1"
+		mock := &mockAWSECRClient{
+			t: t,
+
+			expectedRepositoryNames:     []string{repoName},
+			describeImagesTokenExpiries: testCase.tokenExpiries,
+		}
+
+		client := ECRClientImpl{
+			ECRClient: mock,
+			Logger:    &mockLogger{},
+		}
+
+		images, err := client.ListImages(&repoName)
+
+		if testCase.expectError {
+			if err == nil {
+				t.Errorf("Expected error in test case %d not to be nil, but it was", i)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Expected error in test case %d to be nil, but it was: %v", i, err)
+		}
+
+		// Images from the pages listed before the token expired are dropped
+		if len(images) != 2 {
+			t.Errorf("Expected images in test case %d to contain 2 items, but it contains: %q", i, images)
+		}
+
+		if mock.describeImagesCalls != testCase.tokenExpiries+1 {
+			t.Errorf("Expected %d calls to DescribeImagesPages in test case %d, but got %d", testCase.tokenExpiries+1, i, mock.describeImagesCalls)
+		}
+	}
+}
+
+func TestBatchRemoveImagesWithEmptyImages(t *testing.T) {
+	client := ECRClientImpl{
+		ECRClient: nil, // Should not interact with the ECR client
+	}
+
+	err := client.BatchRemoveImages([]*ecr.ImageDetail{})
+
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+}
+
+func TestBatchRemoveImagesWithTooManyImages(t *testing.T) {
+	client := ECRClientImpl{
+		ECRClient: nil, // Should not interact with the ECR client
+	}
+
+	err := client.BatchRemoveImages(make([]*ecr.ImageDetail, 101))
+
+	if err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+}
+
+func TestBatchRemoveImagesFromDifferentRepos(t *testing.T) {
+	repoNames := []string{"repo-1", "repo-2"}
+
+	client := ECRClientImpl{
+		ECRClient: nil, // Should not interact with the ECR client
+	}
+
+	err := client.BatchRemoveImages([]*ecr.ImageDetail{
+		{
+			RepositoryName: &repoNames[0],
+		},
+		{
+			RepositoryName: &repoNames[1],
+		},
+	})
+
+	if err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+}
+
+func TestBatchRemoveImagesError(t *testing.T) {
+	repoName, digest := "repo-1", "digest-1"
+
+	images := []*ecr.ImageDetail{
+		{
+			ImageDigest:    &digest,
+			RepositoryName: &repoName,
+		},
+	}
+
+	client := ECRClientImpl{
+		ECRClient: &mockAWSECRClient{
+			t: t,
+
+			expectedRepositoryNames: []string{repoName},
+			expectedImageDigests:    []string{digest},
+
+			outputError: fmt.Errorf(""),
+		},
+	}
+
+	err := client.BatchRemoveImages(images)
+
+	if err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+}
+
+func TestBatchRemoveImagesWithRepositoryClients(t *testing.T) {
+	repoName, digest := "repo-1", "digest-1"
+
+	images := []*ecr.ImageDetail{
+		{
+			ImageDigest:    &digest,
+			RepositoryName: &repoName,
+		},
+	}
+
+	mock := &mockAWSECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		expectedImageDigests:    []string{digest},
+	}
+
+	client := ECRClientImpl{
+		ECRClient: nil, // Should not interact with the default ECR client
+		RepositoryClients: map[string]ecriface.ECRAPI{
+			repoName: mock,
+		},
+	}
+
+	err := client.BatchRemoveImages(images)
+
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+
+	if mock.batchDeleteImageCalls != 1 {
+		t.Errorf("Expected BatchDeleteImage to be called once, but was called %d times", mock.batchDeleteImageCalls)
+	}
+}
+
+func TestBatchRemoveImagesWithFailures(t *testing.T) {
+	repoName, failureCode, failureReason := "repo-1", "ImageReferencedByManifestList", "reason"
+	digests := []string{"digest-1", "digest-2"}
+
+	images := []*ecr.ImageDetail{
+		{
+			ImageDigest:    &digests[0],
+			RepositoryName: &repoName,
+		},
+		{
+			ImageDigest:    &digests[1],
+			RepositoryName: &repoName,
+		},
+	}
+
+	client := ECRClientImpl{
+		ECRClient: &mockAWSECRClient{
+			t: t,
+
+			expectedRepositoryNames: []string{repoName},
+			expectedImageDigests:    digests,
+
+			outputFailures: []*ecr.ImageFailure{
+				{
+					FailureCode:   &failureCode,
+					FailureReason: &failureReason,
+					ImageId:       &ecr.ImageIdentifier{ImageDigest: &digests[0]},
+				},
+				{
+					FailureCode:   &failureCode,
+					FailureReason: &failureReason,
+					ImageId:       &ecr.ImageIdentifier{ImageDigest: &digests[1]},
+				},
+			},
+		},
+	}
+
+	err := client.BatchRemoveImages(images)
+
+	multiErr, ok := err.(*MultiError)
+	if !ok {
+		t.Fatalf("Expected error to be a MultiError, but was %v", err)
+	}
+
+	if len(multiErr.Errors) != 2 {
+		t.Errorf("Expected 2 errors, but got %d", len(multiErr.Errors))
+	}
+
+	for i := range multiErr.Errors {
+		repoErr, ok := multiErr.Errors[i].(*RepositoryError)
+		if !ok {
+			t.Errorf("Expected error in idx %d to be a RepositoryError, but was %v", i, multiErr.Errors[i])
+			continue
+		}
+
+		if repoErr.Digest != digests[i] {
+			t.Errorf("Expected error in idx %d to refer to digest %s, but was %s", i, digests[i], repoErr.Digest)
+		}
+	}
+}
+
+func TestBatchRemoveImagesWithImagesNotFound(t *testing.T) {
+	repoName, failureCode, failureReason := "repo-1", ecr.ImageFailureCodeImageNotFound, "Requested image not found"
+	digest := "digest-1"
+
+	images := []*ecr.ImageDetail{
+		{
+			ImageDigest:    &digest,
+			RepositoryName: &repoName,
+		},
+	}
+
+	client := ECRClientImpl{
+		ECRClient: &mockAWSECRClient{
+			t: t,
+
+			expectedRepositoryNames: []string{repoName},
+			expectedImageDigests:    []string{digest},
+
+			outputFailures: []*ecr.ImageFailure{
+				{
+					FailureCode:   &failureCode,
+					FailureReason: &failureReason,
+					ImageId:       &ecr.ImageIdentifier{ImageDigest: &digest},
+				},
+			},
+		},
+	}
+
+	err := client.BatchRemoveImages(images)
+
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+}
+
+func TestDeleteImagesWithImagesNotFound(t *testing.T) {
+	images, batches := newTestImages("repo-1", 1)
+	failureCode := ecr.ImageFailureCodeImageNotFound
+
+	client := ECRClientImpl{
+		ECRClient: &mockAWSECRClient{
+			t: t,
+
+			expectedRepositoryNames:    []string{"repo-1"},
+			expectedImageDigestBatches: batches,
+
+			outputFailures: []*ecr.ImageFailure{
+				{
+					FailureCode: &failureCode,
+					ImageId:     &ecr.ImageIdentifier{ImageDigest: images[0].ImageDigest},
+				},
+			},
+		},
+	}
+
+	err := client.DeleteImages(images)
+
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+}
+
+func TestBatchRemoveImages(t *testing.T) {
+	repoName, digest := "repo-1", "digest-1"
+
+	images := []*ecr.ImageDetail{
+		{
+			ImageDigest:    &digest,
+			RepositoryName: &repoName,
+		},
+	}
+
+	client := ECRClientImpl{
+		ECRClient: &mockAWSECRClient{
+			t: t,
+
+			expectedRepositoryNames: []string{repoName},
+			expectedImageDigests:    []string{digest},
+		},
+	}
+
+	err := client.BatchRemoveImages(images)
+
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+}
+
+func TestDeleteImagesWithEmptyImages(t *testing.T) {
+	client := ECRClientImpl{
+		ECRClient: nil, // Should not interact with the ECR client
+	}
+
+	err := client.DeleteImages([]*ecr.ImageDetail{})
+
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+}
+
+// newTestImages returns `count` images from the given repository, along with
+// their digests split in batches of at most `batchRemoveMaxImages` items.
+func newTestImages(repoName string, count int) ([]*ecr.ImageDetail, [][]string) {
+	images := make([]*ecr.ImageDetail, count)
+	batches := [][]string{}
+
+	for i := range images {
+		digest := fmt.Sprintf("digest-%d", i)
+		images[i] = &ecr.ImageDetail{
+			ImageDigest:    &digest,
+			RepositoryName: &repoName,
+		}
+
+		if i%batchRemoveMaxImages == 0 {
+			batches = append(batches, []string{})
+		}
+		batches[len(batches)-1] = append(batches[len(batches)-1], digest)
+	}
+
+	return images, batches
+}
+
+func TestDeleteImagesError(t *testing.T) {
+	images, batches := newTestImages("repo-1", 250)
+
+	mock := &mockAWSECRClient{
+		t: t,
+
+		expectedRepositoryNames:    []string{"repo-1"},
+		expectedImageDigestBatches: batches,
+
+		outputError: fmt.Errorf(""),
+	}
+
+	client := ECRClientImpl{
+		ECRClient: mock,
+	}
+
+	err := client.DeleteImages(images)
+
+	// All batches must be attempted even if they fail
+	if mock.batchDeleteImageCalls != 3 {
+		t.Errorf("Expected 3 calls to BatchDeleteImage, but got %d", mock.batchDeleteImageCalls)
+	}
+
+	multiErr, ok := err.(*MultiError)
+	if !ok {
+		t.Fatalf("Expected error to be a MultiError, but was %v", err)
+	}
+
+	if len(multiErr.Errors) != 3 {
+		t.Errorf("Expected 3 errors, but got %d", len(multiErr.Errors))
+	}
+}
+
+func TestDeleteImages(t *testing.T) {
+	images, batches := newTestImages("repo-1", 250)
+
+	mock := &mockAWSECRClient{
+		t: t,
+
+		expectedRepositoryNames:    []string{"repo-1"},
+		expectedImageDigestBatches: batches,
+	}
+
+	client := ECRClientImpl{
+		ECRClient: mock,
+	}
+
+	err := client.DeleteImages(images)
+
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+
+	if mock.batchDeleteImageCalls != 3 {
+		t.Errorf("Expected 3 calls to BatchDeleteImage, but got %d", mock.batchDeleteImageCalls)
+	}
+}
+
+func TestDeleteImagesRetriesFailures(t *testing.T) {
+	images, _ := newTestImages("repo-1", 3)
+	kmsError, manifestListError, invalidDigest := ecr.ImageFailureCodeKmsError, ecr.ImageFailureCodeImageReferencedByManifestList, ecr.ImageFailureCodeInvalidImageDigest
+
+	mock := &mockAWSECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{"repo-1"},
+
+		// Only the images failing with retryable codes are deleted again,
+		// until no retryable failures are left
+		expectedImageDigestBatches: [][]string{
+			{"digest-0", "digest-1", "digest-2"},
+			{"digest-0", "digest-1"},
+			{"digest-1"},
+		},
+		outputFailureBatches: [][]*ecr.ImageFailure{
+			{
+				{FailureCode: &kmsError, ImageId: &ecr.ImageIdentifier{ImageDigest: images[0].ImageDigest}},
+				{FailureCode: &manifestListError, ImageId: &ecr.ImageIdentifier{ImageDigest: images[1].ImageDigest}},
+				{FailureCode: &invalidDigest, ImageId: &ecr.ImageIdentifier{ImageDigest: images[2].ImageDigest}},
+			},
+			{
+				{FailureCode: &kmsError, ImageId: &ecr.ImageIdentifier{ImageDigest: images[1].ImageDigest}},
+			},
+			{},
+		},
+	}
+
+	client := ECRClientImpl{
+		ECRClient:        mock,
+		DeleteMaxRetries: 3,
+		Logger:           &mockLogger{},
+	}
+
+	err := client.DeleteImages(images)
+
+	if mock.batchDeleteImageCalls != 3 {
+		t.Errorf("Expected 3 calls to BatchDeleteImage, but got %d", mock.batchDeleteImageCalls)
+	}
+
+	// Only the image failing with a code that is not retryable is reported
+	multiErr, ok := err.(*MultiError)
+	if !ok {
+		t.Fatalf("Expected error to be a MultiError, but was %v", err)
+	}
+
+	if len(multiErr.Errors) != 1 {
+		t.Fatalf("Expected 1 error, but got %d", len(multiErr.Errors))
+	}
+
+	repoErr, ok := multiErr.Errors[0].(*RepositoryError)
+	if !ok || repoErr.Digest != "digest-2" {
+		t.Errorf("Expected error to refer to digest-2, but was %v", multiErr.Errors[0])
+	}
+
+	imageErr, ok := repoErr.Err.(*ImageFailureError)
+	if !ok || imageErr.Code != invalidDigest {
+		t.Errorf("Expected error to have failure code %s, but was %v", invalidDigest, repoErr.Err)
+	}
+}
+
+func TestDeleteImagesRetriesExhausted(t *testing.T) {
+	images, _ := newTestImages("repo-1", 1)
+	kmsError := ecr.ImageFailureCodeKmsError
+
+	mock := &mockAWSECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{"repo-1"},
+		expectedImageDigests:    []string{"digest-0"},
+
+		outputFailures: []*ecr.ImageFailure{
+			{FailureCode: &kmsError, ImageId: &ecr.ImageIdentifier{ImageDigest: images[0].ImageDigest}},
+		},
+	}
+
+	logger := &mockLogger{}
+	client := ECRClientImpl{
+		ECRClient:        mock,
+		DeleteMaxRetries: 2,
+		Logger:           logger,
+	}
+
+	err := client.DeleteImages(images)
+
+	if mock.batchDeleteImageCalls != 3 {
+		t.Errorf("Expected 3 calls to BatchDeleteImage, but got %d", mock.batchDeleteImageCalls)
+	}
+
+	if countSucceeded(len(images), err) != 0 {
+		t.Errorf("Expected the image to be reported as failed, but got %v", err)
+	}
+
+	// The failures are summed up by failure code
+	logged := false
+	for _, message := range logger.messages {
+		if strings.Contains(message, "1 KmsError") {
+			logged = true
+		}
+	}
+
+	if !logged {
+		t.Errorf("Expected the failure codes to be logged, but they were not: %q", logger.messages)
+	}
+}
+
+func TestDeleteImagesRetriesCanceled(t *testing.T) {
+	images, _ := newTestImages("repo-1", 1)
+	kmsError := ecr.ImageFailureCodeKmsError
+
+	mock := &mockAWSECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{"repo-1"},
+		expectedImageDigests:    []string{"digest-0"},
+
+		outputFailures: []*ecr.ImageFailure{
+			{FailureCode: &kmsError, ImageId: &ecr.ImageIdentifier{ImageDigest: images[0].ImageDigest}},
+		},
+	}
+
+	// The pass is canceled, so the retries are not waited for
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	client := ECRClientImpl{
+		ECRClient:        mock,
+		DeleteMaxRetries: 2,
+		DeleteRetryDelay: time.Hour,
+		Logger:           &mockLogger{},
+		Context:          func() context.Context { return ctx },
+	}
+
+	err := client.DeleteImages(images)
+
+	if mock.batchDeleteImageCalls != 1 {
+		t.Errorf("Expected a single call to BatchDeleteImage, but got %d", mock.batchDeleteImageCalls)
 	}
 
-	if len(repos) != 2 {
-		t.Errorf("Expected repos to contain 2 items, but it contains: %q", repos)
+	if countSucceeded(len(images), err) != 0 {
+		t.Errorf("Expected the image to be reported as failed, but got %v", err)
 	}
 }
 
-func TestListImagesWithNilRepositoryName(t *testing.T) {
+func TestListManifestListChildrenWithoutManifestLists(t *testing.T) {
+	repoName, digest := "repo-1", "digest-1"
+
 	client := ECRClientImpl{
 		ECRClient: nil, // Should not interact with the ECR client
 	}
 
-	images, err := client.ListImages(nil)
-
-	if len(images) != 0 {
-		t.Errorf("Expected images to be empty, but was not: %q", images)
-	}
+	children, err := client.ListManifestListChildren(&repoName, []*ecr.ImageDetail{
+		{
+			ImageDigest: &digest,
+		},
+	})
 
 	if err != nil {
 		t.Errorf("Expected error to be nil, but was %v", err)
 	}
+
+	if len(children) != 0 {
+		t.Errorf("Expected children to be empty, but was %v", children)
+	}
 }
 
-func TestListImagesError(t *testing.T) {
-	repoName := "repo-1"
+func TestListManifestListChildrenError(t *testing.T) {
+	repoName, digest, mediaType := "repo-1", "digest-1", "application/vnd.docker.distribution.manifest.list.v2+json"
 
 	client := ECRClientImpl{
 		ECRClient: &mockAWSECRClient{
 			t: t,
 
 			expectedRepositoryNames: []string{repoName},
+			expectedImageDigests:    []string{digest},
 
 			outputError: fmt.Errorf(""),
 		},
 	}
 
-	images, err := client.ListImages(&repoName)
-
-	if images != nil {
-		t.Errorf("Expected images to be nil, but was %v", images)
-	}
+	children, err := client.ListManifestListChildren(&repoName, []*ecr.ImageDetail{
+		{
+			ImageDigest:            &digest,
+			ImageManifestMediaType: &mediaType,
+		},
+	})
 
 	if err == nil {
 		t.Errorf("Expected error not to be nil, but it was")
 	}
+
+	if children != nil {
+		t.Errorf("Expected children to be nil, but was %v", children)
+	}
 }
 
-func TestListImages(t *testing.T) {
-	repoName := "repo-1"
+func TestListManifestListChildren(t *testing.T) {
+	repoName, listDigest, imageDigest := "repo-1", "list-digest", "image-digest"
+	listMediaType, imageMediaType := "application/vnd.oci.image.index.v1+json", "application/vnd.oci.image.manifest.v1+json"
+	manifest := `{"manifests": [{"digest": "child-1"}, {"digest": "child-2"}]}`
 
 	client := ECRClientImpl{
 		ECRClient: &mockAWSECRClient{
 			t: t,
 
 			expectedRepositoryNames: []string{repoName},
+			expectedImageDigests:    []string{listDigest},
+
+			outputImages: []*ecr.Image{
+				{
+					ImageId:       &ecr.ImageIdentifier{ImageDigest: &listDigest},
+					ImageManifest: &manifest,
+				},
+			},
 		},
 	}
 
-	images, err := client.ListImages(&repoName)
+	children, err := client.ListManifestListChildren(&repoName, []*ecr.ImageDetail{
+		{
+			ImageDigest:            &listDigest,
+			ImageManifestMediaType: &listMediaType,
+		},
+		{
+			ImageDigest:            &imageDigest,
+			ImageManifestMediaType: &imageMediaType,
+		},
+	})
 
 	if err != nil {
-		t.Errorf("Expected error to be nil, but it was: %v", err)
+		t.Errorf("Expected error to be nil, but was %v", err)
 	}
 
-	if images == nil {
-		t.Errorf("Expected images not to be nil, but it was")
+	expected := map[string][]string{
+		listDigest: []string{"child-1", "child-2"},
 	}
 
-	if len(images) != 2 {
-		t.Errorf("Expected images to contain 2 items, but it contains: %q", images)
+	if !reflect.DeepEqual(children, expected) {
+		t.Errorf("Expected children to be %v, but was %v", expected, children)
 	}
 }
 
-func TestBatchRemoveImagesWithEmptyImages(t *testing.T) {
+func TestGetImageManifests(t *testing.T) {
+	repoName, firstDigest, secondDigest := "repo-1", "digest-1", "digest-2"
+	firstManifest, secondManifest := `{"schemaVersion": 2}`, `{"schemaVersion": 2, "annotations": {}}`
+
 	client := ECRClientImpl{
-		ECRClient: nil, // Should not interact with the ECR client
+		ECRClient: &mockAWSECRClient{
+			t: t,
+
+			expectedRepositoryNames: []string{repoName},
+			expectedImageDigests:    []string{firstDigest, secondDigest},
+
+			outputImages: []*ecr.Image{
+				{
+					ImageId:       &ecr.ImageIdentifier{ImageDigest: &firstDigest},
+					ImageManifest: &firstManifest,
+				},
+				{
+					ImageId:       &ecr.ImageIdentifier{ImageDigest: &secondDigest},
+					ImageManifest: &secondManifest,
+				},
+			},
+		},
 	}
 
-	err := client.BatchRemoveImages([]*ecr.ImageDetail{})
+	manifests, err := client.GetImageManifests(&repoName, []*ecr.ImageDetail{
+		{ImageDigest: &firstDigest},
+		{ImageDigest: &secondDigest},
+	})
 
 	if err != nil {
 		t.Errorf("Expected error to be nil, but was %v", err)
 	}
-}
 
-func TestBatchRemoveImagesWithTooManyImages(t *testing.T) {
-	client := ECRClientImpl{
-		ECRClient: nil, // Should not interact with the ECR client
+	expected := map[string]string{
+		firstDigest:  firstManifest,
+		secondDigest: secondManifest,
 	}
 
-	err := client.BatchRemoveImages(make([]*ecr.ImageDetail, 101))
-
-	if err == nil {
-		t.Errorf("Expected error not to be nil, but it was")
+	if !reflect.DeepEqual(manifests, expected) {
+		t.Errorf("Expected manifests to be %v, but was %v", expected, manifests)
 	}
 }
 
-func TestBatchRemoveImagesFromDifferentRepos(t *testing.T) {
-	repoNames := []string{"repo-1", "repo-2"}
+func TestGetImageManifestsWithFailures(t *testing.T) {
+	repoName, digest := "repo-1", "digest-1"
+	failureCode, failureReason := "ImageNotFound", "reason"
 
 	client := ECRClientImpl{
-		ECRClient: nil, // Should not interact with the ECR client
-	}
+		ECRClient: &mockAWSECRClient{
+			t: t,
 
-	err := client.BatchRemoveImages([]*ecr.ImageDetail{
-		{
-			RepositoryName: &repoNames[0],
-		},
-		{
-			RepositoryName: &repoNames[1],
+			expectedRepositoryNames: []string{repoName},
+			expectedImageDigests:    []string{digest},
+
+			outputFailures: []*ecr.ImageFailure{
+				{
+					FailureCode:   &failureCode,
+					FailureReason: &failureReason,
+				},
+			},
 		},
-	})
+	}
 
-	if err == nil {
+	if _, err := client.GetImageManifests(&repoName, []*ecr.ImageDetail{{ImageDigest: &digest}}); err == nil {
 		t.Errorf("Expected error not to be nil, but it was")
 	}
 }
 
-func TestBatchRemoveImagesError(t *testing.T) {
+func TestTagImagesError(t *testing.T) {
 	repoName, digest := "repo-1", "digest-1"
+	manifest, mediaType := "{}", "application/vnd.oci.image.manifest.v1+json"
 
-	images := []*ecr.ImageDetail{
-		{
-			ImageDigest:    &digest,
-			RepositoryName: &repoName,
+	mockClient := &mockAWSECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		expectedImageDigests:    []string{digest},
+
+		outputImages: []*ecr.Image{
+			{
+				ImageId:                &ecr.ImageIdentifier{ImageDigest: &digest},
+				ImageManifest:          &manifest,
+				ImageManifestMediaType: &mediaType,
+			},
 		},
+
+		putImageError: fmt.Errorf(""),
 	}
 
 	client := ECRClientImpl{
-		ECRClient: &mockAWSECRClient{
-			t: t,
+		ECRClient: mockClient,
+	}
 
-			expectedRepositoryNames: []string{repoName},
-			expectedImageDigests:    []string{digest},
+	err := client.TagImages(&repoName, map[string]string{digest: "tag-1"})
 
-			outputError: fmt.Errorf(""),
-		},
+	multiErr, ok := err.(*MultiError)
+	if !ok {
+		t.Fatalf("Expected error to be a MultiError, but was %v", err)
 	}
 
-	err := client.BatchRemoveImages(images)
-
-	if err == nil {
-		t.Errorf("Expected error not to be nil, but it was")
+	if len(multiErr.Errors) != 1 {
+		t.Errorf("Expected 1 error, but got %d", len(multiErr.Errors))
 	}
 }
 
-func TestBatchRemoveImages(t *testing.T) {
+func TestTagImages(t *testing.T) {
 	repoName, digest := "repo-1", "digest-1"
+	manifest, mediaType := "{}", "application/vnd.oci.image.manifest.v1+json"
 
-	images := []*ecr.ImageDetail{
-		{
-			ImageDigest:    &digest,
-			RepositoryName: &repoName,
+	mockClient := &mockAWSECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		expectedImageDigests:    []string{digest},
+
+		outputImages: []*ecr.Image{
+			{
+				ImageId:                &ecr.ImageIdentifier{ImageDigest: &digest},
+				ImageManifest:          &manifest,
+				ImageManifestMediaType: &mediaType,
+			},
 		},
 	}
 
 	client := ECRClientImpl{
-		ECRClient: &mockAWSECRClient{
-			t: t,
-
-			expectedRepositoryNames: []string{repoName},
-			expectedImageDigests:    []string{digest},
-		},
+		ECRClient: mockClient,
 	}
 
-	err := client.BatchRemoveImages(images)
+	err := client.TagImages(&repoName, map[string]string{digest: "tag-1"})
 
 	if err != nil {
 		t.Errorf("Expected error to be nil, but was %v", err)
 	}
+
+	if len(mockClient.putImageInputs) != 1 {
+		t.Fatalf("Expected 1 call to PutImage, but got %d", len(mockClient.putImageInputs))
+	}
+
+	input := mockClient.putImageInputs[0]
+
+	if *input.RepositoryName != repoName {
+		t.Errorf("Expected repository name to be %s, but was %s", repoName, *input.RepositoryName)
+	}
+
+	if *input.ImageManifest != manifest || *input.ImageManifestMediaType != mediaType {
+		t.Errorf("Expected manifest to be pushed as is, but was %s (%s)", *input.ImageManifest, *input.ImageManifestMediaType)
+	}
+
+	if *input.ImageTag != "tag-1" {
+		t.Errorf("Expected image tag to be tag-1, but was %s", *input.ImageTag)
+	}
 }
 
 func TestFilterOldUnusedImages(t *testing.T) {
@@ -395,13 +1601,6 @@ func TestFilterOldUnusedImages(t *testing.T) {
 		}
 	}
 
-	oldImagesCapped := make([]*ecr.ImageDetail, 100)
-	for i := range oldImagesCapped {
-		oldImagesCapped[i] = &ecr.ImageDetail{
-			ImagePushedAt: &orderedTime[0],
-		}
-	}
-
 	testCases := []struct {
 		keepMax   int
 		tagsInUse []string
@@ -577,12 +1776,12 @@ func TestFilterOldUnusedImages(t *testing.T) {
 			},
 		},
 
-		// Should limit the output to 100 images
+		// Should not limit the output, as images are deleted in batches
 		{
 			keepMax:   0,
 			tagsInUse: []string{},
 			images:    tooManyImages,
-			oldImages: oldImagesCapped,
+			oldImages: tooManyImages,
 		},
 	}
 
@@ -603,3 +1802,225 @@ func TestFilterOldUnusedImages(t *testing.T) {
 		}
 	}
 }
+
+func TestClassifyOldUnusedImages(t *testing.T) {
+	latestTag, usedTag := "latest", "tag-1"
+	digests := []string{"digest-0", "digest-1", "digest-2", "digest-3"}
+
+	orderedTime := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+		time.Unix(2, 0),
+		time.Unix(3, 0),
+	}
+
+	images := []*ecr.ImageDetail{
+		{
+			ImageDigest:   &digests[3],
+			ImagePushedAt: &orderedTime[3],
+			ImageTags:     []*string{&latestTag},
+		},
+		{
+			ImageDigest:   &digests[2],
+			ImagePushedAt: &orderedTime[2],
+		},
+		{
+			ImageDigest:   &digests[1],
+			ImagePushedAt: &orderedTime[1],
+			ImageTags:     []*string{&usedTag},
+		},
+		{
+			ImageDigest:   &digests[0],
+			ImagePushedAt: &orderedTime[0],
+		},
+	}
+
+	deletable, retained := ClassifyOldUnusedImages(2, images, []string{usedTag})
+
+	if len(deletable) != 1 || *deletable[0].ImageDigest != "digest-0" {
+		t.Errorf("Expected only digest-0 to be deletable, but got %+v", deletable)
+	}
+
+	actual := map[string]string{}
+	for _, image := range retained {
+		actual[*image.Image.ImageDigest] = image.Reason
+	}
+
+	expected := map[string]string{
+		"digest-3": RetainReasonProtectedTag,
+		"digest-1": RetainReasonInUse,
+		"digest-2": RetainReasonKeepMax,
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected retained images to be %v, but was %v", expected, actual)
+	}
+}
+
+func TestClassifyOldUnusedImagesInUseByDigest(t *testing.T) {
+	digests := []string{"sha256:0", "sha256:1"}
+	orderedTime := []time.Time{time.Unix(0, 0), time.Unix(1, 0)}
+
+	images := []*ecr.ImageDetail{
+		{ImageDigest: &digests[1], ImagePushedAt: &orderedTime[1]},
+		{ImageDigest: &digests[0], ImagePushedAt: &orderedTime[0]},
+	}
+
+	deletable, retained := ClassifyOldUnusedImages(0, images, []string{"sha256:0"})
+
+	if len(deletable) != 1 || *deletable[0].ImageDigest != "sha256:1" {
+		t.Errorf("Expected only sha256:1 to be deletable, but got %+v", deletable)
+	}
+
+	if len(retained) != 1 || retained[0].Reason != RetainReasonInUse {
+		t.Errorf("Expected sha256:0 to be retained as in use, but got %+v", retained)
+	}
+}
+
+func TestClassifyOldUnusedImagesWithManyProtectedImages(t *testing.T) {
+	latestTag := "latest"
+	orderedTime := time.Unix(0, 0)
+
+	images := []*ecr.ImageDetail{
+		{ImagePushedAt: &orderedTime, ImageTags: []*string{&latestTag}},
+		{ImagePushedAt: &orderedTime, ImageTags: []*string{&latestTag}},
+		{ImagePushedAt: &orderedTime},
+	}
+
+	deletable, retained := ClassifyOldUnusedImages(2, images, []string{})
+
+	if len(deletable) != 0 {
+		t.Errorf("Expected no images to be deletable, but got %d", len(deletable))
+	}
+
+	if len(retained) != 3 {
+		t.Errorf("Expected all 3 images to be retained, but got %d", len(retained))
+	}
+}
+
+func TestClassifyOldUnusedImagesByGroup(t *testing.T) {
+	tags := []string{"v1.0.0", "v1.1.0", "v1.1.1", "v2.0.0", "v2.0.1", "build-1"}
+
+	images := []*ecr.ImageDetail{}
+	for i := range tags {
+		pushedAt := time.Unix(int64(i), 0)
+		images = append(images, &ecr.ImageDetail{
+			ImageDigest:   &tags[i],
+			ImagePushedAt: &pushedAt,
+			ImageTags:     []*string{&tags[i]},
+		})
+	}
+
+	testCases := []struct {
+		retention         string
+		tagsInUse         []string
+		expectedDeletable []string
+	}{
+		{
+			retention:         SemverRetentionMajor,
+			expectedDeletable: []string{"v1.0.0", "v1.1.0", "v2.0.0"},
+		},
+		{
+			retention:         SemverRetentionMinor,
+			expectedDeletable: []string{"v1.1.0", "v2.0.0"},
+		},
+
+		// Images in use count against the images to keep of their own line
+		{
+			retention:         SemverRetentionMajor,
+			tagsInUse:         []string{"v1.0.0"},
+			expectedDeletable: []string{"v1.1.0", "v1.1.1", "v2.0.0"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		deletable, retained := ClassifyOldUnusedImagesByGroup(1, images, testCase.tagsInUse, func(image *ecr.ImageDetail) string {
+			return SemverLine(image, testCase.retention)
+		})
+
+		actual := []string{}
+		for _, image := range deletable {
+			actual = append(actual, *image.ImageDigest)
+		}
+
+		if !reflect.DeepEqual(actual, testCase.expectedDeletable) {
+			t.Errorf("Expected %v to be deletable per %s version line, but got %v", testCase.expectedDeletable, testCase.retention, actual)
+		}
+
+		if len(deletable)+len(retained) != len(images) {
+			t.Errorf("Expected every image to be either deletable or retained per %s version line, but got %d and %d", testCase.retention, len(deletable), len(retained))
+		}
+	}
+}
+
+func TestClassifyUntaggedImages(t *testing.T) {
+	digests := []string{"digest-0", "digest-1", "digest-2", "digest-3"}
+	now := time.Unix(10*3600, 0)
+
+	orderedTime := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1*3600, 0),
+		time.Unix(8*3600, 0),
+		time.Unix(9*3600, 0),
+	}
+
+	images := []*ecr.ImageDetail{
+		{ImageDigest: &digests[3], ImagePushedAt: &orderedTime[3]},
+		{ImageDigest: &digests[1], ImagePushedAt: &orderedTime[1]},
+		{ImageDigest: &digests[2], ImagePushedAt: &orderedTime[2]},
+		{ImageDigest: &digests[0], ImagePushedAt: &orderedTime[0]},
+	}
+
+	testCases := []struct {
+		keepCount int
+		maxAge    time.Duration
+		deletable []string
+	}{
+		// Should keep everything when neither limit is set
+		{
+			deletable: []string{},
+		},
+
+		// Should delete all but the most recent images
+		{
+			keepCount: 1,
+			deletable: []string{"digest-0", "digest-1", "digest-2"},
+		},
+
+		// Should delete the images older than the maximum age
+		{
+			maxAge:    5 * time.Hour,
+			deletable: []string{"digest-0", "digest-1"},
+		},
+
+		// Should delete the images exceeding either limit
+		{
+			keepCount: 3,
+			maxAge:    5 * time.Hour,
+			deletable: []string{"digest-0", "digest-1"},
+		},
+	}
+
+	for i, testCase := range testCases {
+		deletable, retained := ClassifyUntaggedImages(testCase.keepCount, testCase.maxAge, now, images)
+
+		actual := []string{}
+		for _, image := range deletable {
+			actual = append(actual, *image.ImageDigest)
+		}
+
+		if !reflect.DeepEqual(actual, testCase.deletable) {
+			t.Errorf("Test case %d: expected deletable images to be %v, but was %v", i, testCase.deletable, actual)
+		}
+
+		if len(deletable)+len(retained) != len(images) {
+			t.Errorf("Test case %d: expected %d images to be retained, but got %d", i, len(images)-len(deletable), len(retained))
+		}
+
+		for _, image := range retained {
+			if image.Reason != RetainReasonUntaggedKeep {
+				t.Errorf("Test case %d: expected retained images to be %s, but got %s", i, RetainReasonUntaggedKeep, image.Reason)
+			}
+		}
+	}
+}
@@ -0,0 +1,544 @@
+//go:build awssdkv2
+// +build awssdkv2
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"golang.org/x/time/rate"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	retryv2 "github.com/aws/aws-sdk-go-v2/aws/retry"
+	configv2 "github.com/aws/aws-sdk-go-v2/config"
+	credentialsv2 "github.com/aws/aws-sdk-go-v2/credentials"
+	ec2rolecredsv2 "github.com/aws/aws-sdk-go-v2/credentials/ec2rolecreds"
+	endpointcredsv2 "github.com/aws/aws-sdk-go-v2/credentials/endpointcreds"
+	stscredsv2 "github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	ecrv2 "github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrv2types "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	stsv2 "github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// ecrV2API is the subset of the aws-sdk-go-v2 ECR client used by ecrV2Adapter.
+type ecrV2API interface {
+	DescribeRepositories(ctx context.Context, input *ecrv2.DescribeRepositoriesInput, opts ...func(*ecrv2.Options)) (*ecrv2.DescribeRepositoriesOutput, error)
+	DescribeImages(ctx context.Context, input *ecrv2.DescribeImagesInput, opts ...func(*ecrv2.Options)) (*ecrv2.DescribeImagesOutput, error)
+	BatchDeleteImage(ctx context.Context, input *ecrv2.BatchDeleteImageInput, opts ...func(*ecrv2.Options)) (*ecrv2.BatchDeleteImageOutput, error)
+	BatchGetImage(ctx context.Context, input *ecrv2.BatchGetImageInput, opts ...func(*ecrv2.Options)) (*ecrv2.BatchGetImageOutput, error)
+	PutImage(ctx context.Context, input *ecrv2.PutImageInput, opts ...func(*ecrv2.Options)) (*ecrv2.PutImageOutput, error)
+	PutLifecyclePolicy(ctx context.Context, input *ecrv2.PutLifecyclePolicyInput, opts ...func(*ecrv2.Options)) (*ecrv2.PutLifecyclePolicyOutput, error)
+	ListTagsForResource(ctx context.Context, input *ecrv2.ListTagsForResourceInput, opts ...func(*ecrv2.Options)) (*ecrv2.ListTagsForResourceOutput, error)
+	DescribeRegistry(ctx context.Context, input *ecrv2.DescribeRegistryInput, opts ...func(*ecrv2.Options)) (*ecrv2.DescribeRegistryOutput, error)
+	DescribePullThroughCacheRules(ctx context.Context, input *ecrv2.DescribePullThroughCacheRulesInput, opts ...func(*ecrv2.Options)) (*ecrv2.DescribePullThroughCacheRulesOutput, error)
+	DeleteRepository(ctx context.Context, input *ecrv2.DeleteRepositoryInput, opts ...func(*ecrv2.Options)) (*ecrv2.DeleteRepositoryOutput, error)
+}
+
+// ecrV2Adapter implements the parts of the aws-sdk-go ECR API used by
+// ECRClientImpl on top of the aws-sdk-go-v2 ECR client, translating between
+// the types of both SDKs, so that the clean-up code stays the same regardless
+// of the SDK in use. The request options of aws-sdk-go are ignored.
+type ecrV2Adapter struct {
+	ecriface.ECRAPI
+
+	client  ecrV2API
+	limiter *rate.Limiter
+}
+
+// NewECRClientV2 is like NewECRClient, but backed by aws-sdk-go-v2, as an
+// experimental alternative to the default aws-sdk-go backend. With
+// `AwsAuthModeAuto`, the credentials are retrieved from the default
+// aws-sdk-go-v2 credential chain, which covers SSO profiles and IMDSv2 among
+// others. Either way, they are used to assume the given roles, if any.
+func NewECRClientV2(auth AWSAuth, region, endpoint string, apiQPS float64, apiBurst, apiMaxRetries int, roleARN string, repositoryRoles map[string]string) (*ECRClientImpl, error) {
+	retryer := func() awsv2.Retryer {
+		return retryv2.NewStandard(func(o *retryv2.StandardOptions) {
+			o.MaxAttempts = apiMaxRetries + 1
+			o.MaxBackoff = ecrMaxThrottleDelay
+		})
+	}
+
+	loadOptions := []func(*configv2.LoadOptions) error{configv2.WithRegion(region), configv2.WithRetryer(retryer)}
+	if auth.Profile != "" {
+		loadOptions = append(loadOptions, configv2.WithSharedConfigProfile(auth.Profile))
+	}
+
+	cfg, err := configv2.LoadDefaultConfig(context.Background(), loadOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := credentialsProviderV2(auth, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if creds != nil {
+		cfg.Credentials = awsv2.NewCredentialsCache(creds)
+	}
+
+	var limiter *rate.Limiter
+	if apiQPS > 0 {
+		limiter = rate.NewLimiter(rate.Limit(apiQPS), apiBurst)
+	}
+
+	// Repositories assuming the same role share the same client
+	roleClients := map[string]ecriface.ECRAPI{}
+	newRoleClient := func(roleARN string) ecriface.ECRAPI {
+		if svc, ok := roleClients[roleARN]; ok {
+			return svc
+		}
+
+		roleCfg := cfg.Copy()
+		if roleARN != "" {
+			roleCfg.Credentials = awsv2.NewCredentialsCache(stscredsv2.NewAssumeRoleProvider(stsv2.NewFromConfig(cfg), roleARN))
+		}
+
+		svc := &ecrV2Adapter{
+			client: ecrv2.NewFromConfig(roleCfg, func(o *ecrv2.Options) {
+				if endpoint != "" {
+					o.BaseEndpoint = awsv2.String(endpoint)
+				}
+			}),
+			limiter: limiter,
+		}
+		roleClients[roleARN] = svc
+		return svc
+	}
+
+	client := &ECRClientImpl{
+		ECRClient:        newRoleClient(roleARN),
+		DeleteMaxRetries: deleteMaxRetries,
+		DeleteRetryDelay: deleteRetryDelay,
+	}
+
+	for repositoryName, repositoryRoleARN := range repositoryRoles {
+		if client.RepositoryClients == nil {
+			client.RepositoryClients = map[string]ecriface.ECRAPI{}
+		}
+		client.RepositoryClients[repositoryName] = newRoleClient(repositoryRoleARN)
+	}
+
+	return client, nil
+}
+
+// credentialsProviderV2 returns the provider of the credentials of the given
+// auth, on top of the given configuration, or nil to keep the default
+// credential chain of the configuration.
+func credentialsProviderV2(auth AWSAuth, cfg awsv2.Config) (awsv2.CredentialsProvider, error) {
+	switch auth.mode() {
+	case AwsAuthModeEnv:
+		env, err := configv2.NewEnvConfig()
+		if err != nil {
+			return nil, err
+		}
+		if !env.Credentials.HasKeys() {
+			return nil, fmt.Errorf("No credentials found in AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables")
+		}
+		return credentialsv2.StaticCredentialsProvider{Value: env.Credentials}, nil
+	case AwsAuthModeProfile:
+		// Unlike the default chain, static credentials of the profile win
+		// over the environment variables, while other kinds of profiles,
+		// such as SSO ones, are left to the default chain
+		profile := auth.Profile
+		if profile == "" {
+			profile = os.Getenv("AWS_PROFILE")
+		}
+		if profile == "" {
+			profile = "default"
+		}
+
+		shared, err := configv2.LoadSharedConfigProfile(context.Background(), profile)
+		if err != nil {
+			return nil, err
+		}
+		if !shared.Credentials.HasKeys() {
+			return nil, nil
+		}
+		return credentialsv2.StaticCredentialsProvider{Value: shared.Credentials}, nil
+	case AwsAuthModeWebIdentity:
+		tokenFile, roleARN := auth.webIdentity()
+		return stscredsv2.NewWebIdentityRoleProvider(stsv2.NewFromConfig(cfg), roleARN, stscredsv2.IdentityTokenFile(tokenFile), func(o *stscredsv2.WebIdentityRoleOptions) {
+			o.RoleSessionName = awsWebIdentitySessionName
+		}), nil
+	case AwsAuthModeEC2:
+		return ec2rolecredsv2.New(), nil
+	case AwsAuthModeECS:
+		endpoint, token := ecsCredentialsEndpoint()
+		return endpointcredsv2.New(endpoint, func(o *endpointcredsv2.Options) {
+			o.AuthorizationToken = token
+		}), nil
+	}
+
+	return nil, nil
+}
+
+// wait blocks until the limiter allows the next request to be sent, or until
+// the context of the request is canceled, as per `limiterContext`.
+func (a *ecrV2Adapter) wait(ctx context.Context) error {
+	if a.limiter == nil {
+		return nil
+	}
+	return a.limiter.Wait(limiterContext(ctx))
+}
+
+func (a *ecrV2Adapter) DescribeRepositoriesPagesWithContext(ctx aws.Context, input *ecr.DescribeRepositoriesInput, fn func(*ecr.DescribeRepositoriesOutput, bool) bool, opts ...request.Option) error {
+	paginator := ecrv2.NewDescribeRepositoriesPaginator(a.client, &ecrv2.DescribeRepositoriesInput{
+		RepositoryNames: aws.StringValueSlice(input.RepositoryNames),
+	})
+
+	for paginator.HasMorePages() {
+		if err := a.wait(ctx); err != nil {
+			return err
+		}
+
+		outputV2, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		output := &ecr.DescribeRepositoriesOutput{}
+		for _, repo := range outputV2.Repositories {
+			output.Repositories = append(output.Repositories, repositoryFromV2(repo))
+		}
+
+		if !fn(output, !paginator.HasMorePages()) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (a *ecrV2Adapter) DescribeImagesPagesWithContext(ctx aws.Context, input *ecr.DescribeImagesInput, fn func(*ecr.DescribeImagesOutput, bool) bool, opts ...request.Option) error {
+	inputV2 := &ecrv2.DescribeImagesInput{
+		RepositoryName: input.RepositoryName,
+	}
+	if len(input.ImageIds) > 0 {
+		inputV2.ImageIds = imageIdentifiersToV2(input.ImageIds)
+	}
+	if input.Filter != nil && input.Filter.TagStatus != nil {
+		inputV2.Filter = &ecrv2types.DescribeImagesFilter{
+			TagStatus: ecrv2types.TagStatus(*input.Filter.TagStatus),
+		}
+	}
+
+	paginator := ecrv2.NewDescribeImagesPaginator(a.client, inputV2)
+
+	for paginator.HasMorePages() {
+		if err := a.wait(ctx); err != nil {
+			return err
+		}
+
+		outputV2, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		output := &ecr.DescribeImagesOutput{}
+		for _, image := range outputV2.ImageDetails {
+			output.ImageDetails = append(output.ImageDetails, imageDetailFromV2(image))
+		}
+
+		if !fn(output, !paginator.HasMorePages()) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (a *ecrV2Adapter) BatchDeleteImageWithContext(ctx aws.Context, input *ecr.BatchDeleteImageInput, opts ...request.Option) (*ecr.BatchDeleteImageOutput, error) {
+	if err := a.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	outputV2, err := a.client.BatchDeleteImage(ctx, &ecrv2.BatchDeleteImageInput{
+		RepositoryName: input.RepositoryName,
+		ImageIds:       imageIdentifiersToV2(input.ImageIds),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ecr.BatchDeleteImageOutput{
+		ImageIds: imageIdentifiersFromV2(outputV2.ImageIds),
+		Failures: imageFailuresFromV2(outputV2.Failures),
+	}, nil
+}
+
+func (a *ecrV2Adapter) BatchGetImageWithContext(ctx aws.Context, input *ecr.BatchGetImageInput, opts ...request.Option) (*ecr.BatchGetImageOutput, error) {
+	if err := a.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	outputV2, err := a.client.BatchGetImage(ctx, &ecrv2.BatchGetImageInput{
+		RepositoryName:     input.RepositoryName,
+		ImageIds:           imageIdentifiersToV2(input.ImageIds),
+		AcceptedMediaTypes: aws.StringValueSlice(input.AcceptedMediaTypes),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	output := &ecr.BatchGetImageOutput{
+		Failures: imageFailuresFromV2(outputV2.Failures),
+	}
+
+	for _, image := range outputV2.Images {
+		output.Images = append(output.Images, &ecr.Image{
+			RepositoryName:         image.RepositoryName,
+			ImageId:                imageIdentifierFromV2(image.ImageId),
+			ImageManifest:          image.ImageManifest,
+			ImageManifestMediaType: image.ImageManifestMediaType,
+		})
+	}
+
+	return output, nil
+}
+
+func (a *ecrV2Adapter) PutImageWithContext(ctx aws.Context, input *ecr.PutImageInput, opts ...request.Option) (*ecr.PutImageOutput, error) {
+	if err := a.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	_, err := a.client.PutImage(ctx, &ecrv2.PutImageInput{
+		RepositoryName:         input.RepositoryName,
+		ImageManifest:          input.ImageManifest,
+		ImageManifestMediaType: input.ImageManifestMediaType,
+		ImageTag:               input.ImageTag,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ecr.PutImageOutput{}, nil
+}
+
+func (a *ecrV2Adapter) PutLifecyclePolicyWithContext(ctx aws.Context, input *ecr.PutLifecyclePolicyInput, opts ...request.Option) (*ecr.PutLifecyclePolicyOutput, error) {
+	if err := a.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	_, err := a.client.PutLifecyclePolicy(ctx, &ecrv2.PutLifecyclePolicyInput{
+		RepositoryName:      input.RepositoryName,
+		LifecyclePolicyText: input.LifecyclePolicyText,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ecr.PutLifecyclePolicyOutput{}, nil
+}
+
+func (a *ecrV2Adapter) ListTagsForResourceWithContext(ctx aws.Context, input *ecr.ListTagsForResourceInput, opts ...request.Option) (*ecr.ListTagsForResourceOutput, error) {
+	if err := a.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	outputV2, err := a.client.ListTagsForResource(ctx, &ecrv2.ListTagsForResourceInput{
+		ResourceArn: input.ResourceArn,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	output := &ecr.ListTagsForResourceOutput{}
+	for _, tag := range outputV2.Tags {
+		output.Tags = append(output.Tags, &ecr.Tag{Key: tag.Key, Value: tag.Value})
+	}
+
+	return output, nil
+}
+
+func (a *ecrV2Adapter) DescribeRegistryWithContext(ctx aws.Context, input *ecr.DescribeRegistryInput, opts ...request.Option) (*ecr.DescribeRegistryOutput, error) {
+	if err := a.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	outputV2, err := a.client.DescribeRegistry(ctx, &ecrv2.DescribeRegistryInput{})
+	if err != nil {
+		return nil, err
+	}
+
+	output := &ecr.DescribeRegistryOutput{RegistryId: outputV2.RegistryId}
+	if outputV2.ReplicationConfiguration != nil {
+		output.ReplicationConfiguration = &ecr.ReplicationConfiguration{}
+		for _, ruleV2 := range outputV2.ReplicationConfiguration.Rules {
+			rule := &ecr.ReplicationRule{}
+			for _, destination := range ruleV2.Destinations {
+				rule.Destinations = append(rule.Destinations, &ecr.ReplicationDestination{
+					Region:     destination.Region,
+					RegistryId: destination.RegistryId,
+				})
+			}
+			for _, filter := range ruleV2.RepositoryFilters {
+				rule.RepositoryFilters = append(rule.RepositoryFilters, &ecr.RepositoryFilter{
+					Filter:     filter.Filter,
+					FilterType: aws.String(string(filter.FilterType)),
+				})
+			}
+			output.ReplicationConfiguration.Rules = append(output.ReplicationConfiguration.Rules, rule)
+		}
+	}
+
+	return output, nil
+}
+
+func (a *ecrV2Adapter) DescribePullThroughCacheRulesPagesWithContext(ctx aws.Context, input *ecr.DescribePullThroughCacheRulesInput, fn func(*ecr.DescribePullThroughCacheRulesOutput, bool) bool, opts ...request.Option) error {
+	paginator := ecrv2.NewDescribePullThroughCacheRulesPaginator(a.client, &ecrv2.DescribePullThroughCacheRulesInput{
+		EcrRepositoryPrefixes: aws.StringValueSlice(input.EcrRepositoryPrefixes),
+	})
+
+	for paginator.HasMorePages() {
+		if err := a.wait(ctx); err != nil {
+			return err
+		}
+
+		outputV2, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		output := &ecr.DescribePullThroughCacheRulesOutput{}
+		for _, rule := range outputV2.PullThroughCacheRules {
+			output.PullThroughCacheRules = append(output.PullThroughCacheRules, &ecr.PullThroughCacheRule{
+				EcrRepositoryPrefix: rule.EcrRepositoryPrefix,
+				RegistryId:          rule.RegistryId,
+				UpstreamRegistryUrl: rule.UpstreamRegistryUrl,
+			})
+		}
+
+		if !fn(output, !paginator.HasMorePages()) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (a *ecrV2Adapter) DeleteRepositoryWithContext(ctx aws.Context, input *ecr.DeleteRepositoryInput, opts ...request.Option) (*ecr.DeleteRepositoryOutput, error) {
+	if err := a.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	outputV2, err := a.client.DeleteRepository(ctx, &ecrv2.DeleteRepositoryInput{
+		RepositoryName: input.RepositoryName,
+		RegistryId:     input.RegistryId,
+		Force:          aws.BoolValue(input.Force),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	output := &ecr.DeleteRepositoryOutput{}
+	if outputV2.Repository != nil {
+		output.Repository = repositoryFromV2(*outputV2.Repository)
+	}
+
+	return output, nil
+}
+
+// repositoryFromV2 translates an aws-sdk-go-v2 repository into the aws-sdk-go
+// type used by the clean-up code.
+func repositoryFromV2(repo ecrv2types.Repository) *ecr.Repository {
+	out := &ecr.Repository{
+		RepositoryName: repo.RepositoryName,
+		RepositoryArn:  repo.RepositoryArn,
+		RegistryId:     repo.RegistryId,
+		CreatedAt:      repo.CreatedAt,
+	}
+
+	if config := repo.EncryptionConfiguration; config != nil {
+		out.EncryptionConfiguration = &ecr.EncryptionConfiguration{
+			EncryptionType: aws.String(string(config.EncryptionType)),
+			KmsKey:         config.KmsKey,
+		}
+	}
+
+	return out
+}
+
+// imageDetailFromV2 translates an aws-sdk-go-v2 image detail into the
+// aws-sdk-go type used by the clean-up code.
+func imageDetailFromV2(image ecrv2types.ImageDetail) *ecr.ImageDetail {
+	out := &ecr.ImageDetail{
+		RegistryId:             image.RegistryId,
+		RepositoryName:         image.RepositoryName,
+		ImageDigest:            image.ImageDigest,
+		ImageTags:              aws.StringSlice(image.ImageTags),
+		ImagePushedAt:          image.ImagePushedAt,
+		LastRecordedPullTime:   image.LastRecordedPullTime,
+		ImageSizeInBytes:       image.ImageSizeInBytes,
+		ImageManifestMediaType: image.ImageManifestMediaType,
+	}
+
+	if status := image.ImageScanStatus; status != nil {
+		out.ImageScanStatus = &ecr.ImageScanStatus{
+			Status:      aws.String(string(status.Status)),
+			Description: status.Description,
+		}
+	}
+
+	if summary := image.ImageScanFindingsSummary; summary != nil {
+		counts := map[string]*int64{}
+		for severity, count := range summary.FindingSeverityCounts {
+			counts[severity] = aws.Int64(int64(count))
+		}
+
+		out.ImageScanFindingsSummary = &ecr.ImageScanFindingsSummary{
+			FindingSeverityCounts:        counts,
+			ImageScanCompletedAt:         summary.ImageScanCompletedAt,
+			VulnerabilitySourceUpdatedAt: summary.VulnerabilitySourceUpdatedAt,
+		}
+	}
+
+	return out
+}
+
+func imageIdentifiersToV2(imageIds []*ecr.ImageIdentifier) []ecrv2types.ImageIdentifier {
+	out := make([]ecrv2types.ImageIdentifier, len(imageIds))
+	for i, imageID := range imageIds {
+		out[i] = ecrv2types.ImageIdentifier{
+			ImageDigest: imageID.ImageDigest,
+			ImageTag:    imageID.ImageTag,
+		}
+	}
+	return out
+}
+
+func imageIdentifierFromV2(imageID *ecrv2types.ImageIdentifier) *ecr.ImageIdentifier {
+	if imageID == nil {
+		return nil
+	}
+
+	return &ecr.ImageIdentifier{
+		ImageDigest: imageID.ImageDigest,
+		ImageTag:    imageID.ImageTag,
+	}
+}
+
+func imageIdentifiersFromV2(imageIds []ecrv2types.ImageIdentifier) []*ecr.ImageIdentifier {
+	out := make([]*ecr.ImageIdentifier, len(imageIds))
+	for i := range imageIds {
+		out[i] = imageIdentifierFromV2(&imageIds[i])
+	}
+	return out
+}
+
+func imageFailuresFromV2(failures []ecrv2types.ImageFailure) []*ecr.ImageFailure {
+	out := make([]*ecr.ImageFailure, len(failures))
+	for i, failure := range failures {
+		out[i] = &ecr.ImageFailure{
+			FailureCode:   aws.String(string(failure.FailureCode)),
+			FailureReason: failure.FailureReason,
+			ImageId:       imageIdentifierFromV2(failure.ImageId),
+		}
+	}
+	return out
+}
@@ -0,0 +1,14 @@
+//go:build !awssdkv2
+// +build !awssdkv2
+
+package core
+
+import (
+	"fmt"
+)
+
+// NewECRClientV2 is like NewECRClient, but backed by aws-sdk-go-v2, which is
+// only available when built with the `awssdkv2` build tag.
+func NewECRClientV2(auth AWSAuth, region, endpoint string, apiQPS float64, apiBurst, apiMaxRetries int, roleARN string, repositoryRoles map[string]string) (*ECRClientImpl, error) {
+	return nil, fmt.Errorf("Built without aws-sdk-go-v2 support, rebuild with '-tags awssdkv2'")
+}
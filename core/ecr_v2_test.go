@@ -0,0 +1,273 @@
+//go:build awssdkv2
+// +build awssdkv2
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	ecrv2 "github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrv2types "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+)
+
+// mockECRV2Client is used to verify that the aws-sdk-go-v2 ECR client is
+// being called with the correct arguments, and that its pages and types are
+// translated correctly by ecrV2Adapter.
+type mockECRV2Client struct {
+	ecrV2API
+
+	t *testing.T
+
+	repositoryPages []*ecrv2.DescribeRepositoriesOutput
+	imagePages      []*ecrv2.DescribeImagesOutput
+
+	expectedImageDigests []string
+	batchDeleteOutput    *ecrv2.BatchDeleteImageOutput
+
+	outputError error
+}
+
+func (m *mockECRV2Client) DescribeRepositories(ctx context.Context, input *ecrv2.DescribeRepositoriesInput, opts ...func(*ecrv2.Options)) (*ecrv2.DescribeRepositoriesOutput, error) {
+	if m.outputError != nil {
+		return nil, m.outputError
+	}
+
+	page := 0
+	if input.NextToken != nil {
+		fmt.Sscanf(*input.NextToken, "%d", &page)
+	}
+	return m.repositoryPages[page], nil
+}
+
+func (m *mockECRV2Client) DescribeImages(ctx context.Context, input *ecrv2.DescribeImagesInput, opts ...func(*ecrv2.Options)) (*ecrv2.DescribeImagesOutput, error) {
+	if m.outputError != nil {
+		return nil, m.outputError
+	}
+
+	page := 0
+	if input.NextToken != nil {
+		fmt.Sscanf(*input.NextToken, "%d", &page)
+	}
+	return m.imagePages[page], nil
+}
+
+func (m *mockECRV2Client) BatchDeleteImage(ctx context.Context, input *ecrv2.BatchDeleteImageInput, opts ...func(*ecrv2.Options)) (*ecrv2.BatchDeleteImageOutput, error) {
+	if len(input.ImageIds) != len(m.expectedImageDigests) {
+		m.t.Fatalf("Expected %d images to be deleted, but got %d", len(m.expectedImageDigests), len(input.ImageIds))
+	}
+
+	for i, imageID := range input.ImageIds {
+		if awsv2.ToString(imageID.ImageDigest) != m.expectedImageDigests[i] {
+			m.t.Errorf("Expected image digest %d to be '%s', but was '%s'", i, m.expectedImageDigests[i], awsv2.ToString(imageID.ImageDigest))
+		}
+	}
+
+	return m.batchDeleteOutput, m.outputError
+}
+
+func TestECRV2AdapterListRepositories(t *testing.T) {
+	client := ECRClientImpl{
+		ECRClient: &ecrV2Adapter{
+			client: &mockECRV2Client{
+				t: t,
+
+				repositoryPages: []*ecrv2.DescribeRepositoriesOutput{
+					{
+						Repositories: []ecrv2types.Repository{
+							{
+								RepositoryName: awsv2.String("repo-1"),
+								EncryptionConfiguration: &ecrv2types.EncryptionConfiguration{
+									EncryptionType: ecrv2types.EncryptionTypeKms,
+									KmsKey:         awsv2.String("key-1"),
+								},
+							},
+						},
+						NextToken: awsv2.String("1"),
+					},
+					{
+						Repositories: []ecrv2types.Repository{
+							{RepositoryName: awsv2.String("repo-2")},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	repos, err := client.ListRepositories([]*string{aws.String("repo-1"), aws.String("repo-2")})
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but it was: %v", err)
+	}
+
+	if len(repos) != 2 {
+		t.Fatalf("Expected 2 repositories, but got %d", len(repos))
+	}
+
+	if aws.StringValue(repos[1].RepositoryName) != "repo-2" {
+		t.Errorf("Expected second repository to be 'repo-2', but was '%s'", aws.StringValue(repos[1].RepositoryName))
+	}
+
+	if config := repos[0].EncryptionConfiguration; config == nil || aws.StringValue(config.EncryptionType) != "KMS" || aws.StringValue(config.KmsKey) != "key-1" {
+		t.Errorf("Expected first repository to be encrypted with KMS key 'key-1', but was %v", config)
+	}
+}
+
+func TestECRV2AdapterListImages(t *testing.T) {
+	pushedAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	client := ECRClientImpl{
+		ECRClient: &ecrV2Adapter{
+			client: &mockECRV2Client{
+				t: t,
+
+				imagePages: []*ecrv2.DescribeImagesOutput{
+					{
+						ImageDetails: []ecrv2types.ImageDetail{
+							{
+								ImageDigest:      awsv2.String("digest-1"),
+								ImageTags:        []string{"v1", "v1.0"},
+								ImagePushedAt:    &pushedAt,
+								ImageSizeInBytes: awsv2.Int64(1024),
+								ImageScanStatus: &ecrv2types.ImageScanStatus{
+									Status: ecrv2types.ScanStatusComplete,
+								},
+								ImageScanFindingsSummary: &ecrv2types.ImageScanFindingsSummary{
+									FindingSeverityCounts: map[string]int32{"CRITICAL": 2},
+								},
+							},
+						},
+						NextToken: awsv2.String("1"),
+					},
+					{
+						ImageDetails: []ecrv2types.ImageDetail{
+							{ImageDigest: awsv2.String("digest-2")},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	images, err := client.ListImages(aws.String("repo-1"))
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but it was: %v", err)
+	}
+
+	if len(images) != 2 {
+		t.Fatalf("Expected 2 images, but got %d", len(images))
+	}
+
+	image := images[0]
+	if aws.StringValue(image.ImageDigest) != "digest-1" {
+		t.Errorf("Expected image digest to be 'digest-1', but was '%s'", aws.StringValue(image.ImageDigest))
+	}
+	if tags := aws.StringValueSlice(image.ImageTags); len(tags) != 2 || tags[0] != "v1" || tags[1] != "v1.0" {
+		t.Errorf("Expected image tags to be [v1 v1.0], but were %v", tags)
+	}
+	if !aws.TimeValue(image.ImagePushedAt).Equal(pushedAt) {
+		t.Errorf("Expected image push date to be %v, but was %v", pushedAt, aws.TimeValue(image.ImagePushedAt))
+	}
+	if aws.Int64Value(image.ImageSizeInBytes) != 1024 {
+		t.Errorf("Expected image size to be 1024, but was %d", aws.Int64Value(image.ImageSizeInBytes))
+	}
+	if status := image.ImageScanStatus; status == nil || aws.StringValue(status.Status) != ecr.ScanStatusComplete {
+		t.Errorf("Expected image scan status to be '%s', but was %v", ecr.ScanStatusComplete, status)
+	}
+	if summary := image.ImageScanFindingsSummary; summary == nil || aws.Int64Value(summary.FindingSeverityCounts["CRITICAL"]) != 2 {
+		t.Errorf("Expected image to have 2 critical findings, but got %v", summary)
+	}
+	if images[1].ImageScanStatus != nil || images[1].ImageScanFindingsSummary != nil {
+		t.Errorf("Expected image without scan to have no scan status nor findings, but got %v and %v", images[1].ImageScanStatus, images[1].ImageScanFindingsSummary)
+	}
+}
+
+func TestECRV2AdapterListImagesError(t *testing.T) {
+	client := ECRClientImpl{
+		ECRClient: &ecrV2Adapter{
+			client: &mockECRV2Client{
+				t: t,
+
+				outputError: fmt.Errorf("boom"),
+			},
+		},
+	}
+
+	if _, err := client.ListImages(aws.String("repo-1")); err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+}
+
+func TestECRV2AdapterDeleteImagesWithFailures(t *testing.T) {
+	repoName := "repo-1"
+
+	client := ECRClientImpl{
+		ECRClient: &ecrV2Adapter{
+			client: &mockECRV2Client{
+				t: t,
+
+				expectedImageDigests: []string{"digest-1", "digest-2"},
+				batchDeleteOutput: &ecrv2.BatchDeleteImageOutput{
+					ImageIds: []ecrv2types.ImageIdentifier{
+						{ImageDigest: awsv2.String("digest-1")},
+					},
+					Failures: []ecrv2types.ImageFailure{
+						{
+							FailureCode:   ecrv2types.ImageFailureCodeImageReferencedByManifestList,
+							FailureReason: awsv2.String("referenced by manifest list"),
+							ImageId:       &ecrv2types.ImageIdentifier{ImageDigest: awsv2.String("digest-2")},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	images := []*ecr.ImageDetail{
+		{RepositoryName: &repoName, ImageDigest: aws.String("digest-1")},
+		{RepositoryName: &repoName, ImageDigest: aws.String("digest-2")},
+	}
+
+	err := client.BatchRemoveImages(images)
+	if err == nil {
+		t.Fatalf("Expected error not to be nil, but it was")
+	}
+
+	if succeeded := succeededImages(images, err); len(succeeded) != 1 || aws.StringValue(succeeded[0].ImageDigest) != "digest-1" {
+		t.Errorf("Expected only 'digest-1' to be deleted, but got %v", succeeded)
+	}
+}
+
+func TestNewECRClientV2WithRoles(t *testing.T) {
+	client, err := NewECRClientV2(AWSAuth{}, "us-east-1", "", 0, 0, 0, "arn:aws:iam::111111111111:role/cleanup", map[string]string{
+		"repo-1": "arn:aws:iam::222222222222:role/cleanup",
+		"repo-2": "arn:aws:iam::222222222222:role/cleanup",
+		"repo-3": "arn:aws:iam::111111111111:role/cleanup",
+	})
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but it was: %v", err)
+	}
+
+	if len(client.RepositoryClients) != 3 {
+		t.Fatalf("Expected repository clients to contain 3 elements, but it contains %d", len(client.RepositoryClients))
+	}
+
+	// Repositories assuming the same role share the same client
+	if client.RepositoryClients["repo-1"] != client.RepositoryClients["repo-2"] {
+		t.Errorf("Expected repositories assuming the same role to share the same client, but they did not")
+	}
+
+	if client.RepositoryClients["repo-3"] != client.ECRClient {
+		t.Errorf("Expected repositories assuming the default role to share the default client, but they did not")
+	}
+
+	if client.RepositoryClients["repo-1"] == client.ECRClient {
+		t.Errorf("Expected repositories assuming a different role not to share the default client, but they did")
+	}
+}
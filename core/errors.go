@@ -0,0 +1,150 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// MultiError aggregates several errors into a single one, so that callers
+// get to know about every failure instead of only the first one.
+type MultiError struct {
+	Errors []error
+}
+
+// Append adds the given error to the list of errors. Nil errors are ignored,
+// and errors of type MultiError are flattened.
+func (m *MultiError) Append(err error) {
+	if err == nil {
+		return
+	}
+
+	if other, ok := err.(*MultiError); ok {
+		m.Errors = append(m.Errors, other.Errors...)
+		return
+	}
+
+	m.Errors = append(m.Errors, err)
+}
+
+// ErrorOrNil returns nil if no errors were collected, or the MultiError
+// itself otherwise.
+func (m *MultiError) ErrorOrNil() error {
+	if m == nil || len(m.Errors) == 0 {
+		return nil
+	}
+	return m
+}
+
+func (m *MultiError) Error() string {
+	if len(m.Errors) == 1 {
+		return m.Errors[0].Error()
+	}
+
+	messages := make([]string, len(m.Errors))
+	for i, err := range m.Errors {
+		messages[i] = err.Error()
+	}
+
+	return fmt.Sprintf("%d errors occurred: %s", len(m.Errors), strings.Join(messages, "; "))
+}
+
+// Unwrap returns the individual errors, so they can be inspected by
+// the callers.
+func (m *MultiError) Unwrap() []error {
+	return m.Errors
+}
+
+// RepositoryError decorates an error with the region, repository and image
+// digest it relates to, and with a message saying what failed, such as
+// "Cannot list images". Fields that are unknown or don't apply can be left
+// empty. The error itself is kept as is, so that the failures of single
+// images it may aggregate can still be told apart by the callers.
+type RepositoryError struct {
+	Region     string
+	Repository string
+	Digest     string
+	Message    string
+	Err        error
+}
+
+func (e *RepositoryError) Error() string {
+	location := e.Repository
+
+	switch {
+	case e.Region != "" && location != "":
+		location = e.Region + "/" + location
+	case e.Region != "":
+		location = e.Region
+	}
+	if e.Digest != "" {
+		location = location + "@" + e.Digest
+	}
+	if e.Message != "" {
+		location = location + ": " + e.Message
+	}
+
+	return fmt.Sprintf("%s: %v", location, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *RepositoryError) Unwrap() error {
+	return e.Err
+}
+
+// ImageFailureError is the failure reported by ECR for a single image of a
+// batch request, such as BatchDeleteImage.
+type ImageFailureError struct {
+	Code   string
+	Reason string
+}
+
+func (e *ImageFailureError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Reason)
+}
+
+// countSucceeded returns how many out of the given number of operations
+// succeeded, given the error returned for them. Only the operations reported
+// in a MultiError are considered failed; any other error means they all
+// failed.
+func countSucceeded(total int, err error) int {
+	if err == nil {
+		return total
+	}
+
+	if failures, ok := err.(*MultiError); ok {
+		return total - len(failures.Errors)
+	}
+
+	return 0
+}
+
+// succeededImages returns the images from the given list that were processed
+// successfully, given the error returned for them. Only the images whose
+// digests are reported in a MultiError are considered failed; any other error,
+// including errors in a MultiError that don't identify an image, means they
+// might all have failed.
+func succeededImages(images []*ecr.ImageDetail, err error) []*ecr.ImageDetail {
+	if err == nil {
+		return images
+	}
+
+	failures, ok := err.(*MultiError)
+	if !ok {
+		return []*ecr.ImageDetail{}
+	}
+
+	failed := []*ecr.ImageDetail{}
+	for _, err := range failures.Errors {
+		repoErr, ok := err.(*RepositoryError)
+		if !ok || repoErr.Digest == "" {
+			return []*ecr.ImageDetail{}
+		}
+
+		failed = append(failed, &ecr.ImageDetail{ImageDigest: aws.String(repoErr.Digest)})
+	}
+
+	return ExcludeImages(images, failed)
+}
@@ -0,0 +1,179 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+func TestMultiErrorAppend(t *testing.T) {
+	errs := &MultiError{}
+
+	if errs.ErrorOrNil() != nil {
+		t.Errorf("Expected empty MultiError to be nil, but was %v", errs.ErrorOrNil())
+	}
+
+	errs.Append(nil)
+	errs.Append(fmt.Errorf("error-1"))
+	errs.Append(&MultiError{Errors: []error{fmt.Errorf("error-2"), fmt.Errorf("error-3")}})
+
+	if len(errs.Unwrap()) != 3 {
+		t.Errorf("Expected MultiError to contain 3 errors, but it contains %d", len(errs.Unwrap()))
+	}
+
+	if errs.ErrorOrNil() == nil {
+		t.Errorf("Expected MultiError not to be nil, but it was")
+	}
+}
+
+func TestMultiErrorError(t *testing.T) {
+	testCases := []struct {
+		errs     []error
+		expected string
+	}{
+		// Single error
+		{
+			errs:     []error{fmt.Errorf("error-1")},
+			expected: "error-1",
+		},
+
+		// Multiple errors
+		{
+			errs:     []error{fmt.Errorf("error-1"), fmt.Errorf("error-2")},
+			expected: "2 errors occurred: error-1; error-2",
+		},
+	}
+
+	for _, testCase := range testCases {
+		actual := (&MultiError{Errors: testCase.errs}).Error()
+
+		if actual != testCase.expected {
+			t.Errorf("Expected error message to be '%s', but was '%s'", testCase.expected, actual)
+		}
+	}
+}
+
+func TestRepositoryError(t *testing.T) {
+	cause := fmt.Errorf("cause")
+
+	testCases := []struct {
+		err      *RepositoryError
+		expected string
+	}{
+		// Only repository
+		{
+			err:      &RepositoryError{Repository: "repo", Err: cause},
+			expected: "repo: cause",
+		},
+
+		// Repository and digest
+		{
+			err:      &RepositoryError{Repository: "repo", Digest: "sha256:1", Err: cause},
+			expected: "repo@sha256:1: cause",
+		},
+
+		// Only region
+		{
+			err:      &RepositoryError{Region: "us-east-1", Err: cause},
+			expected: "us-east-1: cause",
+		},
+
+		// Region, repository and digest
+		{
+			err:      &RepositoryError{Region: "us-east-1", Repository: "repo", Digest: "sha256:1", Err: cause},
+			expected: "us-east-1/repo@sha256:1: cause",
+		},
+
+		// Region, repository and message
+		{
+			err:      &RepositoryError{Region: "us-east-1", Repository: "repo", Message: "Could not remove images", Err: cause},
+			expected: "us-east-1/repo: Could not remove images: cause",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if testCase.err.Error() != testCase.expected {
+			t.Errorf("Expected error message to be '%s', but was '%s'", testCase.expected, testCase.err.Error())
+		}
+
+		if testCase.err.Unwrap() != cause {
+			t.Errorf("Expected unwrapped error to be %v, but was %v", cause, testCase.err.Unwrap())
+		}
+	}
+}
+
+func TestCountSucceeded(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected int
+	}{
+		// Nothing failed
+		{
+			err:      nil,
+			expected: 3,
+		},
+
+		// Only the reported operations failed
+		{
+			err:      &MultiError{Errors: []error{fmt.Errorf("a")}},
+			expected: 2,
+		},
+
+		// Everything failed
+		{
+			err:      fmt.Errorf("a"),
+			expected: 0,
+		},
+	}
+
+	for _, testCase := range testCases {
+		if actual := countSucceeded(3, testCase.err); actual != testCase.expected {
+			t.Errorf("Expected %d operations to succeed, but got %d", testCase.expected, actual)
+		}
+	}
+}
+
+func TestSucceededImages(t *testing.T) {
+	digests := []string{"digest-1", "digest-2"}
+	images := []*ecr.ImageDetail{
+		{ImageDigest: &digests[0]},
+		{ImageDigest: &digests[1]},
+	}
+
+	testCases := []struct {
+		err      error
+		expected []*ecr.ImageDetail
+	}{
+		// Nothing failed
+		{
+			err:      nil,
+			expected: images,
+		},
+
+		// Only the reported images failed
+		{
+			err:      &MultiError{Errors: []error{&RepositoryError{Digest: "digest-1"}}},
+			expected: []*ecr.ImageDetail{images[1]},
+		},
+
+		// Failures that don't identify an image
+		{
+			err:      &MultiError{Errors: []error{fmt.Errorf("a")}},
+			expected: []*ecr.ImageDetail{},
+		},
+
+		// Everything failed
+		{
+			err:      fmt.Errorf("a"),
+			expected: []*ecr.ImageDetail{},
+		},
+	}
+
+	for i, testCase := range testCases {
+		if actual := succeededImages(images, testCase.err); !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Expected succeeded images in test case %d to be %+v, but was %+v", i, testCase.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"k8s.io/client-go/pkg/api/unversioned"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// EventSourceComponent is the component reported as the source of the
+// Kubernetes events emitted by the controller.
+const EventSourceComponent = "ecr-cleanup-controller"
+
+// Reasons of the Kubernetes events emitted for the images selected for
+// deletion, and for the repositories.
+const (
+	// The image was deleted.
+	EventReasonImageDeleted = "ImageDeleted"
+
+	// The image was not deleted in this pass, such as in a dry run, or when
+	// a safety valve kicked in.
+	EventReasonImageDeletionSkipped = "ImageDeletionSkipped"
+
+	// ECR failed to delete the image.
+	EventReasonImageDeletionFailed = "ImageDeletionFailed"
+
+	// The repository failed in too many consecutive passes, and is skipped
+	// by the next passes for a while.
+	EventReasonRepositorySuspended = "RepositorySuspended"
+)
+
+// Kinds of the objects the Kubernetes events can be emitted on, along with
+// their API versions.
+var eventTargetAPIVersions = map[string]string{
+	"Pod":        "v1",
+	"ConfigMap":  "v1",
+	"Deployment": "extensions/v1beta1",
+}
+
+// EventsClient defines the expected interface of any object capable of
+// emitting Kubernetes events on objects of the `eventTargetAPIVersions`
+// kinds.
+type EventsClient interface {
+	GetObjectReference(namespace, kind, name string) (*v1.ObjectReference, error)
+	CreateEvent(event *v1.Event) (*v1.Event, error)
+}
+
+// ParseEventsTarget returns the kind and name of the object given as
+// `Kind/name`, such as `Deployment/ecr-cleanup-controller`, failing if the
+// kind is not supported.
+func ParseEventsTarget(target string) (string, string, error) {
+	parts := strings.SplitN(target, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("Invalid events target '%s', must be given as Kind/name", target)
+	}
+
+	if _, ok := eventTargetAPIVersions[parts[0]]; !ok {
+		return "", "", fmt.Errorf("Unsupported events target kind '%s'", parts[0])
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// NewImageEvent returns a Kubernetes event of the given type and reason about
+// an image, or a repository, emitted on the referenced object at the given
+// time.
+func NewImageEvent(object *v1.ObjectReference, eventType, reason, message string, now time.Time) *v1.Event {
+	timestamp := unversioned.NewTime(now)
+
+	return &v1.Event{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: object.Namespace,
+			Name:      fmt.Sprintf("%s.%x", object.Name, now.UnixNano()),
+		},
+		InvolvedObject: *object,
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         v1.EventSource{Component: EventSourceComponent},
+		FirstTimestamp: timestamp,
+		LastTimestamp:  timestamp,
+		Count:          1,
+	}
+}
+
+// eventsObject returns the reference to the object the events are emitted
+// on, given by `EventsTarget` in `ControllerNamespace`, which defaults to the
+// controller pod. The reference is looked up once, since its UID is needed
+// for `kubectl describe` to show the events.
+func (t *CleanupTask) eventsObject() (*v1.ObjectReference, error) {
+	if t.eventsObjectRef != nil {
+		return t.eventsObjectRef, nil
+	}
+
+	target := t.EventsTarget
+	if target == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("Cannot get the name of the controller pod: %v", err)
+		}
+		target = "Pod/" + hostname
+	}
+
+	kind, name, err := ParseEventsTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := t.EventsClient.GetObjectReference(t.ControllerNamespace, kind, name)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get events target '%s' in '%s' namespace: %v", target, t.ControllerNamespace, err)
+	}
+
+	t.eventsObjectRef = object
+	return object, nil
+}
+
+// emitImageEvents emits a Kubernetes event of the given type and reason for
+// each of the given images from the given repository, through `EventsClient`
+// if any, with the given message format, which is passed the digest, the
+// repository and the tags of each image. Failing to emit the events is only
+// logged.
+func (t *CleanupTask) emitImageEvents(repoName string, images []*ecr.ImageDetail, eventType, reason, format string) {
+	if t.EventsClient == nil || len(images) == 0 {
+		return
+	}
+
+	object, err := t.eventsObject()
+	if err != nil {
+		t.log().Warningf("Cannot emit events for %d images from '%s' ECR repo: %v", len(images), repoName, err)
+		return
+	}
+
+	for i, image := range images {
+		digest, tags, _ := imageLogDetails(image)
+		event := NewImageEvent(object, eventType, reason, fmt.Sprintf(format, digest, repoName, tags), time.Now())
+
+		// Giving up after the first failure, since the others would most
+		// likely fail the same way
+		if _, err := t.EventsClient.CreateEvent(event); err != nil {
+			t.log().Warningf("Cannot emit events for %d images from '%s' ECR repo: %v", len(images)-i, repoName, err)
+			return
+		}
+	}
+}
+
+// emitRepositoryEvent emits a Kubernetes event of the given type and reason
+// with the given message about the given repository, through `EventsClient`
+// if any. Failing to emit the event is only logged.
+func (t *CleanupTask) emitRepositoryEvent(repoName, eventType, reason, message string) {
+	if t.EventsClient == nil {
+		return
+	}
+
+	object, err := t.eventsObject()
+	if err == nil {
+		_, err = t.EventsClient.CreateEvent(NewImageEvent(object, eventType, reason, message, time.Now()))
+	}
+	if err != nil {
+		t.log().Warningf("Cannot emit event for '%s' ECR repo: %v", repoName, err)
+	}
+}
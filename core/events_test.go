@@ -0,0 +1,240 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+type mockEventsClient struct {
+	events []*v1.Event
+
+	getObjectReferenceCalls int
+	getObjectReferenceError error
+
+	createEventError error
+}
+
+func (m *mockEventsClient) GetObjectReference(namespace, kind, name string) (*v1.ObjectReference, error) {
+	m.getObjectReferenceCalls++
+	if m.getObjectReferenceError != nil {
+		return nil, m.getObjectReferenceError
+	}
+
+	return &v1.ObjectReference{
+		Kind:      kind,
+		Namespace: namespace,
+		Name:      name,
+		UID:       "uid",
+	}, nil
+}
+
+func (m *mockEventsClient) CreateEvent(event *v1.Event) (*v1.Event, error) {
+	if m.createEventError != nil {
+		return nil, m.createEventError
+	}
+
+	m.events = append(m.events, event)
+	return event, nil
+}
+
+func TestParseEventsTarget(t *testing.T) {
+	testCases := []struct {
+		target       string
+		expectedKind string
+		expectedName string
+		ok           bool
+	}{
+		{target: "Pod/controller-abcde", expectedKind: "Pod", expectedName: "controller-abcde", ok: true},
+		{target: "Deployment/controller", expectedKind: "Deployment", expectedName: "controller", ok: true},
+		{target: "ConfigMap/controller", expectedKind: "ConfigMap", expectedName: "controller", ok: true},
+		{target: "controller", ok: false},
+		{target: "Pod/", ok: false},
+		{target: "Service/controller", ok: false},
+	}
+
+	for _, testCase := range testCases {
+		kind, name, err := ParseEventsTarget(testCase.target)
+
+		if (err == nil) != testCase.ok {
+			t.Errorf("Expected parsing '%s' to succeed to be %t, but got error %v", testCase.target, testCase.ok, err)
+			continue
+		}
+
+		if kind != testCase.expectedKind || name != testCase.expectedName {
+			t.Errorf("Expected '%s' to be parsed as %s/%s, but got %s/%s", testCase.target, testCase.expectedKind, testCase.expectedName, kind, name)
+		}
+	}
+}
+
+func TestNewImageEvent(t *testing.T) {
+	object := &v1.ObjectReference{Kind: "Pod", Namespace: "namespace", Name: "controller", UID: "uid"}
+	now := time.Unix(1500000000, 0)
+
+	event := NewImageEvent(object, v1.EventTypeNormal, EventReasonImageDeleted, "message", now)
+
+	if event.Namespace != "namespace" || !strings.HasPrefix(event.Name, "controller.") {
+		t.Errorf("Expected the event to be named after the object in its namespace, but was '%s/%s'", event.Namespace, event.Name)
+	}
+
+	if event.InvolvedObject != *object {
+		t.Errorf("Expected the event to involve %+v, but involved %+v", *object, event.InvolvedObject)
+	}
+
+	if event.Reason != EventReasonImageDeleted || event.Type != v1.EventTypeNormal || event.Message != "message" {
+		t.Errorf("Expected the event to carry the given type, reason and message, but got %+v", event)
+	}
+
+	if event.Source.Component != EventSourceComponent || event.Count != 1 || !event.LastTimestamp.Time.Equal(now) {
+		t.Errorf("Expected the event to be emitted once at %v by the controller, but got %+v", now, event)
+	}
+}
+
+func TestEmitImageEvents(t *testing.T) {
+	digests := []string{"digest-0", "digest-1"}
+	tag := "tag-0"
+	images := []*ecr.ImageDetail{
+		{ImageDigest: &digests[0], ImageTags: []*string{&tag}},
+		{ImageDigest: &digests[1]},
+	}
+
+	eventsClient := &mockEventsClient{}
+	task := &CleanupTask{
+		ControllerNamespace: "namespace",
+		EventsTarget:        "Deployment/controller",
+		EventsClient:        eventsClient,
+		Logger:              &mockLogger{},
+	}
+
+	task.emitImageEvents("repo", images, v1.EventTypeNormal, EventReasonImageDeleted, "Removed image '%s' from '%s' ECR repo, tagged with [%s].")
+	task.emitImageEvents("repo", images[:1], v1.EventTypeWarning, EventReasonImageDeletionFailed, "Could not remove image '%s' from '%s' ECR repo, tagged with [%s].")
+
+	if eventsClient.getObjectReferenceCalls != 1 {
+		t.Errorf("Expected the events target to be looked up once, but it was looked up %d times", eventsClient.getObjectReferenceCalls)
+	}
+
+	expected := []string{
+		"Removed image 'digest-0' from 'repo' ECR repo, tagged with [tag-0].",
+		"Removed image 'digest-1' from 'repo' ECR repo, tagged with [].",
+		"Could not remove image 'digest-0' from 'repo' ECR repo, tagged with [tag-0].",
+	}
+
+	if len(eventsClient.events) != len(expected) {
+		t.Fatalf("Expected %d events to be emitted, but got %d", len(expected), len(eventsClient.events))
+	}
+
+	for i, event := range eventsClient.events {
+		if event.Message != expected[i] {
+			t.Errorf("Expected event %d to be %q, but was %q", i, expected[i], event.Message)
+		}
+
+		if event.InvolvedObject.Kind != "Deployment" || event.InvolvedObject.Name != "controller" || event.Namespace != "namespace" {
+			t.Errorf("Expected event %d to be emitted on the deployment, but was emitted on %+v", i, event.InvolvedObject)
+		}
+	}
+}
+
+func TestEmitImageEventsWithErrors(t *testing.T) {
+	digest := "digest-0"
+	images := []*ecr.ImageDetail{{ImageDigest: &digest}}
+
+	clients := []*mockEventsClient{
+		{getObjectReferenceError: fmt.Errorf("not found")},
+		{createEventError: fmt.Errorf("forbidden")},
+	}
+
+	for i, eventsClient := range clients {
+		logger := &mockLogger{}
+		task := &CleanupTask{
+			EventsTarget: "Pod/controller",
+			EventsClient: eventsClient,
+			Logger:       logger,
+		}
+
+		task.emitImageEvents("repo", images, v1.EventTypeNormal, EventReasonImageDeleted, "%s %s %s")
+
+		// Failing to emit events is only logged
+		logged := false
+		for _, message := range logger.messages {
+			if strings.Contains(message, "Cannot emit events for 1 images from 'repo' ECR repo") {
+				logged = true
+			}
+		}
+
+		if !logged {
+			t.Errorf("Test case %d: expected the failure to be logged, but it was not: %q", i, logger.messages)
+		}
+	}
+}
+
+func TestReconcileEmitsEvents(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	digests := []string{"digest-0", "digest-1"}
+
+	pushedAt := []time.Time{
+		time.Now().Add(-2 * time.Hour),
+		time.Now().Add(-time.Hour),
+	}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest:   &digests[0],
+				ImagePushedAt: &pushedAt[0],
+			},
+			{
+				ImageDigest:   &digests[1],
+				ImagePushedAt: &pushedAt[1],
+			},
+		},
+
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &digests[0],
+			},
+		},
+		deleteImagesError: fmt.Errorf("cannot delete"),
+	}
+
+	eventsClient := &mockEventsClient{}
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		EventsTarget:    "Pod/controller",
+		EventsClient:    eventsClient,
+		Logger:          &mockLogger{},
+
+		MaxImages: 1,
+	}
+
+	task.Reconcile(kubeClient, ecrClient)
+
+	if len(eventsClient.events) != 1 {
+		t.Fatalf("Expected 1 event to be emitted, but got %d", len(eventsClient.events))
+	}
+
+	if event := eventsClient.events[0]; event.Reason != EventReasonImageDeletionFailed || event.Type != v1.EventTypeWarning {
+		t.Errorf("Expected a warning event about the image that could not be removed, but got %+v", event)
+	}
+}
@@ -0,0 +1,712 @@
+package core
+
+import (
+	"encoding/json"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// isImageProtected tells whether the given image must never be deleted,
+// either because it's tagged as 'latest', or because one of its tags is
+// currently in use.
+func isImageProtected(image *ecr.ImageDetail, tagsInUse []string) bool {
+	return isTaggedLatest(image) || isImageInUse(image, tagsInUse)
+}
+
+// isTaggedLatest tells whether the given image is tagged as 'latest'.
+func isTaggedLatest(image *ecr.ImageDetail) bool {
+	for _, tag := range image.ImageTags {
+		if *tag == "latest" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isImageInUse tells whether the given image is referenced by any of the given
+// tags or digests in use, as returned by `ECRImagesFromReferences`.
+func isImageInUse(image *ecr.ImageDetail, tagsInUse []string) bool {
+	for _, tagInUse := range tagsInUse {
+		if tagInUse == aws.StringValue(image.ImageDigest) {
+			return true
+		}
+
+		for _, tag := range image.ImageTags {
+			if tagInUse == *tag {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isUntagged tells whether the given image has no tags other than the ones
+// added by this controller to quarantine it.
+func isUntagged(image *ecr.ImageDetail) bool {
+	for _, tag := range image.ImageTags {
+		if !IsQuarantineTag(*tag) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SplitUntaggedImages splits the given list of ECR images into the images with
+// tags and the ones without any.
+func SplitUntaggedImages(images []*ecr.ImageDetail) ([]*ecr.ImageDetail, []*ecr.ImageDetail) {
+	tagged := []*ecr.ImageDetail{}
+	untagged := []*ecr.ImageDetail{}
+
+	for _, image := range images {
+		if isUntagged(image) {
+			untagged = append(untagged, image)
+		} else {
+			tagged = append(tagged, image)
+		}
+	}
+
+	return tagged, untagged
+}
+
+// TagsMatchingPatterns returns the tags of the given ECR images that match any
+// of the given patterns, so that they can be protected like tags in use.
+func TagsMatchingPatterns(repoImages []*ecr.ImageDetail, patterns []*regexp.Regexp) []string {
+	tags := []string{}
+
+	if len(patterns) == 0 {
+		return tags
+	}
+
+	for _, repoImage := range repoImages {
+		for _, tag := range repoImage.ImageTags {
+			for _, pattern := range patterns {
+				if pattern.MatchString(*tag) {
+					tags = append(tags, *tag)
+					break
+				}
+			}
+		}
+	}
+
+	return tags
+}
+
+// TagGroup returns the group the given image belongs to according to the
+// first of its tags matching the given pattern, which is the text matched by
+// the first capture group of the pattern, or by the whole pattern if it has
+// none, such as `main` for `main-0123abc` with `^(.+)-[0-9a-f]+$`. An empty
+// string is returned if none of the tags match.
+func TagGroup(image *ecr.ImageDetail, pattern *regexp.Regexp) string {
+	for _, tag := range image.ImageTags {
+		matches := pattern.FindStringSubmatch(*tag)
+		if matches == nil {
+			continue
+		}
+
+		if len(matches) > 1 {
+			return matches[1]
+		}
+		return matches[0]
+	}
+
+	return ""
+}
+
+// FilterImagesByTagCount goes through the given list of ECR images and returns
+// another list of images (giving priority to older images) that are not in use
+// and whose number of tags suggests they were abandoned. That is, images
+// without any tags if deleteUntagged is true, and images with more than
+// maxTags tags if maxTags is greater than zero.
+func FilterImagesByTagCount(deleteUntagged bool, maxTags int, repoImages []*ecr.ImageDetail, tagsInUse []string) []*ecr.ImageDetail {
+	images := []*ecr.ImageDetail{}
+
+	for _, repoImage := range repoImages {
+		// Quarantine tags are added by this controller, so they don't count
+		tagCount := 0
+		for _, tag := range repoImage.ImageTags {
+			if !IsQuarantineTag(*tag) {
+				tagCount++
+			}
+		}
+
+		untagged := deleteUntagged && tagCount == 0
+		tooManyTags := maxTags > 0 && tagCount > maxTags
+
+		if !untagged && !tooManyTags {
+			continue
+		}
+
+		if isImageProtected(repoImage, tagsInUse) {
+			continue
+		}
+
+		images = append(images, repoImage)
+	}
+
+	SortImagesByPushDate(images)
+
+	return images
+}
+
+// FilterImagesBySize goes through the given list of ECR images and returns
+// another list of images (giving priority to older images) that are not in use
+// and smaller than minBytes, which suggests an incomplete push. Images of
+// unknown size, and manifest lists, which are small by nature, are never
+// returned.
+func FilterImagesBySize(minBytes int64, repoImages []*ecr.ImageDetail, tagsInUse []string) []*ecr.ImageDetail {
+	images := []*ecr.ImageDetail{}
+
+	if minBytes <= 0 {
+		return images
+	}
+
+	for _, repoImage := range repoImages {
+		if repoImage.ImageSizeInBytes == nil || *repoImage.ImageSizeInBytes >= minBytes {
+			continue
+		}
+
+		if IsManifestList(repoImage) || isImageProtected(repoImage, tagsInUse) {
+			continue
+		}
+
+		images = append(images, repoImage)
+	}
+
+	SortImagesByPushDate(images)
+
+	return images
+}
+
+// FilterImagesByRepositorySize goes through the given list of ECR images of a
+// repository and returns the oldest images that are not in use, besides the
+// given images already selected for deletion, that must be deleted as well
+// for the sizes of the images left to add up to at most maxBytes. Images of
+// unknown size, and manifest lists, which take up next to no space, are never
+// returned.
+func FilterImagesByRepositorySize(maxBytes int64, repoImages, selected []*ecr.ImageDetail, tagsInUse []string) []*ecr.ImageDetail {
+	images := []*ecr.ImageDetail{}
+
+	if maxBytes <= 0 {
+		return images
+	}
+
+	left := ExcludeImages(repoImages, selected)
+	leftBytes := imagesSize(left)
+
+	candidates := []*ecr.ImageDetail{}
+	for _, image := range left {
+		if image.ImageSizeInBytes == nil || IsManifestList(image) || isImageProtected(image, tagsInUse) {
+			continue
+		}
+		candidates = append(candidates, image)
+	}
+
+	SortImagesByPushDate(candidates)
+
+	for _, image := range candidates {
+		if leftBytes <= maxBytes {
+			break
+		}
+
+		images = append(images, image)
+		leftBytes -= *image.ImageSizeInBytes
+	}
+
+	return images
+}
+
+// FilterImagesByAge goes through the given list of ECR images and returns
+// another list of images (giving priority to older images) that are not in use
+// and were pushed more than maxAge before now. Images without a push date are
+// never returned.
+func FilterImagesByAge(maxAge time.Duration, now time.Time, repoImages []*ecr.ImageDetail, tagsInUse []string) []*ecr.ImageDetail {
+	images := []*ecr.ImageDetail{}
+
+	if maxAge <= 0 {
+		return images
+	}
+
+	pushedBefore := now.Add(-maxAge)
+	for _, repoImage := range repoImages {
+		if repoImage.ImagePushedAt == nil || !repoImage.ImagePushedAt.Before(pushedBefore) {
+			continue
+		}
+
+		if isImageProtected(repoImage, tagsInUse) {
+			continue
+		}
+
+		images = append(images, repoImage)
+	}
+
+	SortImagesByPushDate(images)
+
+	return images
+}
+
+// MergeImages returns the union of the given lists of ECR images, sorted by
+// push date. Images are considered the same if they share the same digest, so
+// that images selected by more than one filter are deleted only once.
+func MergeImages(imageLists ...[]*ecr.ImageDetail) []*ecr.ImageDetail {
+	images := []*ecr.ImageDetail{}
+	encountered := map[string]bool{}
+
+	for _, imageList := range imageLists {
+		for _, image := range imageList {
+			digest := aws.StringValue(image.ImageDigest)
+
+			if encountered[digest] {
+				continue
+			}
+
+			encountered[digest] = true
+			images = append(images, image)
+		}
+	}
+
+	SortImagesByPushDate(images)
+
+	return images
+}
+
+// FilterManifestListChildren removes from the given list of images selected
+// for deletion the images referenced by manifest lists that are not being
+// deleted themselves, since deleting them would break pulls of the retained
+// manifest lists. The manifest list children map is the one returned by
+// `ECRClient.ListManifestListChildren`.
+func FilterManifestListChildren(images []*ecr.ImageDetail, manifestListChildren map[string][]string) []*ecr.ImageDetail {
+	deleted := map[string]bool{}
+	for _, image := range images {
+		deleted[aws.StringValue(image.ImageDigest)] = true
+	}
+
+	protected := map[string]bool{}
+	for listDigest, childDigests := range manifestListChildren {
+		if deleted[listDigest] {
+			continue
+		}
+
+		for _, childDigest := range childDigests {
+			protected[childDigest] = true
+		}
+	}
+
+	filtered := []*ecr.ImageDetail{}
+	for _, image := range images {
+		if !protected[aws.StringValue(image.ImageDigest)] {
+			filtered = append(filtered, image)
+		}
+	}
+
+	return filtered
+}
+
+// OrphanedManifestListChildren returns the images from repoImages that are
+// referenced by the manifest lists among the given images selected for
+// deletion, and by no other manifest list, which would be left behind once
+// those are deleted. Images already selected, and the ones that are protected,
+// are never returned. The manifest list children map is the one returned by
+// `ECRClient.ListManifestListChildren`.
+func OrphanedManifestListChildren(repoImages, images []*ecr.ImageDetail, manifestListChildren map[string][]string, tagsInUse []string) []*ecr.ImageDetail {
+	deleted := map[string]bool{}
+	for _, image := range images {
+		deleted[aws.StringValue(image.ImageDigest)] = true
+	}
+
+	orphaned, retained := map[string]bool{}, map[string]bool{}
+	for listDigest, childDigests := range manifestListChildren {
+		for _, childDigest := range childDigests {
+			if deleted[listDigest] {
+				orphaned[childDigest] = true
+			} else {
+				retained[childDigest] = true
+			}
+		}
+	}
+
+	children := []*ecr.ImageDetail{}
+	for _, image := range repoImages {
+		digest := aws.StringValue(image.ImageDigest)
+		if orphaned[digest] && !retained[digest] && !deleted[digest] && !isImageProtected(image, tagsInUse) {
+			children = append(children, image)
+		}
+	}
+
+	return children
+}
+
+// FilterOrphanedManifestLists returns the manifest lists among the given
+// images whose children are all gone from the given images, which makes them
+// impossible to pull. Manifest lists without any children, and the ones that
+// are in use, are never returned. The manifest list children map is the one
+// returned by `ECRClient.ListManifestListChildren`.
+func FilterOrphanedManifestLists(images []*ecr.ImageDetail, manifestListChildren map[string][]string, tagsInUse []string) []*ecr.ImageDetail {
+	existing := map[string]bool{}
+	for _, image := range images {
+		existing[aws.StringValue(image.ImageDigest)] = true
+	}
+
+	orphaned := []*ecr.ImageDetail{}
+	for _, image := range images {
+		childDigests := manifestListChildren[aws.StringValue(image.ImageDigest)]
+		if len(childDigests) == 0 || isImageProtected(image, tagsInUse) {
+			continue
+		}
+
+		hasChildren := false
+		for _, childDigest := range childDigests {
+			if existing[childDigest] {
+				hasChildren = true
+				break
+			}
+		}
+
+		if !hasChildren {
+			orphaned = append(orphaned, image)
+		}
+	}
+
+	return orphaned
+}
+
+// FilterRepositoriesByName returns the given repositories whose names match
+// any of the include patterns, or all of them if there are none, and none of
+// the exclude patterns.
+func FilterRepositoriesByName(repos []*ecr.Repository, include, exclude []*regexp.Regexp) []*ecr.Repository {
+	filtered := []*ecr.Repository{}
+
+reposLoop:
+	for _, repo := range repos {
+		repoName := aws.StringValue(repo.RepositoryName)
+
+		for _, pattern := range exclude {
+			if pattern.MatchString(repoName) {
+				continue reposLoop
+			}
+		}
+
+		included := len(include) == 0
+		for _, pattern := range include {
+			if pattern.MatchString(repoName) {
+				included = true
+				break
+			}
+		}
+
+		if included {
+			filtered = append(filtered, repo)
+		}
+	}
+
+	return filtered
+}
+
+// FilterRepositoriesInUse returns the given repositories that have images in
+// use, according to the given map where the keys are repository names, as
+// returned by `ECRImagesFromReferences`.
+func FilterRepositoriesInUse(repos []*ecr.Repository, usedImages map[string][]string) []*ecr.Repository {
+	filtered := []*ecr.Repository{}
+
+	for _, repo := range repos {
+		if _, ok := usedImages[aws.StringValue(repo.RepositoryName)]; ok {
+			filtered = append(filtered, repo)
+		}
+	}
+
+	return filtered
+}
+
+// imageAnnotations holds the annotations of an OCI image manifest or index.
+type imageAnnotations struct {
+	Annotations map[string]string `json:"annotations"`
+}
+
+// FilterAnnotatedImages removes from the given list of images selected for
+// deletion the images whose manifests carry the given annotation, along with
+// the given value, unless it's empty, in which case any value will do. The
+// manifests map is the one returned by `ECRClient.GetImageManifests`. The
+// second return value lists the images removed from the given list.
+func FilterAnnotatedImages(images []*ecr.ImageDetail, manifests map[string]string, key, value string) ([]*ecr.ImageDetail, []*ecr.ImageDetail) {
+	filtered, protected := []*ecr.ImageDetail{}, []*ecr.ImageDetail{}
+
+	for _, image := range images {
+		annotations := imageAnnotations{}
+
+		// Manifests without annotations, such as Docker ones, or that cannot
+		// be parsed carry no annotations as far as we're concerned
+		json.Unmarshal([]byte(manifests[aws.StringValue(image.ImageDigest)]), &annotations)
+
+		annotation, ok := annotations.Annotations[key]
+		if ok && (value == "" || annotation == value) {
+			protected = append(protected, image)
+			continue
+		}
+
+		filtered = append(filtered, image)
+	}
+
+	return filtered, protected
+}
+
+// LimitDeletions takes a map where the keys are repository names and the
+// values are the images to delete from those repositories, and returns
+// another map containing only the maxDeletes oldest images across all
+// repositories, along with the number of images left out.
+func LimitDeletions(imagesToDelete map[string][]*ecr.ImageDetail, maxDeletes int) (map[string][]*ecr.ImageDetail, int) {
+	allImages := []*ecr.ImageDetail{}
+	repoNames := map[*ecr.ImageDetail]string{}
+
+	for repoName, images := range imagesToDelete {
+		for _, image := range images {
+			allImages = append(allImages, image)
+			repoNames[image] = repoName
+		}
+	}
+
+	if len(allImages) <= maxDeletes {
+		return imagesToDelete, 0
+	}
+
+	SortImagesByPushDate(allImages)
+
+	limited := map[string][]*ecr.ImageDetail{}
+	for _, image := range allImages[:maxDeletes] {
+		repoName := repoNames[image]
+		limited[repoName] = append(limited[repoName], image)
+	}
+
+	return limited, len(allImages) - maxDeletes
+}
+
+// LimitDeletionsPerRepository takes a map where the keys are repository names
+// and the values are the images to delete from those repositories, and returns
+// another map containing only the maxDeletes oldest images of each repository,
+// along with a map of the images left out of each repository.
+func LimitDeletionsPerRepository(imagesToDelete map[string][]*ecr.ImageDetail, maxDeletes int) (map[string][]*ecr.ImageDetail, map[string][]*ecr.ImageDetail) {
+	limited := map[string][]*ecr.ImageDetail{}
+	deferred := map[string][]*ecr.ImageDetail{}
+
+	for repoName, images := range imagesToDelete {
+		if len(images) <= maxDeletes {
+			limited[repoName] = images
+			continue
+		}
+
+		sorted := append([]*ecr.ImageDetail{}, images...)
+		SortImagesByPushDate(sorted)
+
+		limited[repoName] = sorted[:maxDeletes]
+		deferred[repoName] = sorted[maxDeletes:]
+	}
+
+	return limited, deferred
+}
+
+// LimitDeletionsBySize takes a map where the keys are repository names and the
+// values are the images to delete from those repositories, and returns another
+// map containing only the oldest images across all repositories whose sizes
+// add up to at least targetBytes, along with the number of bytes those images
+// add up to. Since images can't be split, that's usually a bit more than
+// targetBytes, or less if there aren't enough images. Images without a size
+// are considered to take up no space.
+func LimitDeletionsBySize(imagesToDelete map[string][]*ecr.ImageDetail, targetBytes int64) (map[string][]*ecr.ImageDetail, int64) {
+	allImages := []*ecr.ImageDetail{}
+	repoNames := map[*ecr.ImageDetail]string{}
+
+	for repoName, images := range imagesToDelete {
+		for _, image := range images {
+			allImages = append(allImages, image)
+			repoNames[image] = repoName
+		}
+	}
+
+	SortImagesByPushDate(allImages)
+
+	limited := map[string][]*ecr.ImageDetail{}
+	selectedBytes := int64(0)
+
+	for _, image := range allImages {
+		if selectedBytes >= targetBytes {
+			break
+		}
+
+		repoName := repoNames[image]
+		limited[repoName] = append(limited[repoName], image)
+		selectedBytes += aws.Int64Value(image.ImageSizeInBytes)
+	}
+
+	return limited, selectedBytes
+}
+
+// imagesSize returns the number of bytes taken up by the given images, leaving
+// out the ones whose size is unknown.
+func imagesSize(images []*ecr.ImageDetail) int64 {
+	size := int64(0)
+	for _, image := range images {
+		size += aws.Int64Value(image.ImageSizeInBytes)
+	}
+	return size
+}
+
+// imageDigests returns the digests of the given images.
+func imageDigests(images []*ecr.ImageDetail) []string {
+	digests := make([]string, len(images))
+	for i, image := range images {
+		digests[i] = aws.StringValue(image.ImageDigest)
+	}
+	return digests
+}
+
+// FilterRecentlyPulledImages removes from the given list of images the ones
+// whose digest or any of its tags belong to the given set of recently pulled
+// image identifiers.
+func FilterRecentlyPulledImages(images []*ecr.ImageDetail, recentlyPulled map[string]bool) []*ecr.ImageDetail {
+	filtered := []*ecr.ImageDetail{}
+
+imagesLoop:
+	for _, image := range images {
+		if recentlyPulled[aws.StringValue(image.ImageDigest)] {
+			continue
+		}
+
+		for _, tag := range image.ImageTags {
+			if recentlyPulled[*tag] {
+				continue imagesLoop
+			}
+		}
+
+		filtered = append(filtered, image)
+	}
+
+	return filtered
+}
+
+// FilterImagesNewerThanInUse removes from the given list of images the ones
+// pushed after the newest image in use, which might be pending rollouts. The
+// newest image in use is looked up in repoImages, which must hold all images
+// from the repository. No images are removed if none of them are in use.
+func FilterImagesNewerThanInUse(images []*ecr.ImageDetail, repoImages []*ecr.ImageDetail, tagsInUse []string) []*ecr.ImageDetail {
+	var newestInUse *time.Time
+
+	for _, repoImage := range repoImages {
+		if repoImage.ImagePushedAt == nil || !isImageInUse(repoImage, tagsInUse) {
+			continue
+		}
+
+		if newestInUse == nil || repoImage.ImagePushedAt.After(*newestInUse) {
+			newestInUse = repoImage.ImagePushedAt
+		}
+	}
+
+	if newestInUse == nil {
+		return images
+	}
+
+	filtered := []*ecr.ImageDetail{}
+	for _, image := range images {
+		if image.ImagePushedAt != nil && image.ImagePushedAt.After(*newestInUse) {
+			continue
+		}
+		filtered = append(filtered, image)
+	}
+
+	return filtered
+}
+
+// FilterImagesPushedSince returns the images from the given list that were
+// pushed at or after the given time. Images without a push date are left out.
+func FilterImagesPushedSince(images []*ecr.ImageDetail, since time.Time) []*ecr.ImageDetail {
+	filtered := []*ecr.ImageDetail{}
+
+	for _, image := range images {
+		if image.ImagePushedAt != nil && !image.ImagePushedAt.Before(since) {
+			filtered = append(filtered, image)
+		}
+	}
+
+	return filtered
+}
+
+// FilterImagesPulledSince returns the images from the given list that were
+// last pulled at or after the given time, as recorded by ECR. Images that were
+// never pulled are left out.
+func FilterImagesPulledSince(images []*ecr.ImageDetail, since time.Time) []*ecr.ImageDetail {
+	filtered := []*ecr.ImageDetail{}
+
+	for _, image := range images {
+		if image.LastRecordedPullTime != nil && !image.LastRecordedPullTime.Before(since) {
+			filtered = append(filtered, image)
+		}
+	}
+
+	return filtered
+}
+
+// ExcludeImages returns the images from the given list whose digests don't
+// belong to any of the excluded images.
+func ExcludeImages(images []*ecr.ImageDetail, excluded []*ecr.ImageDetail) []*ecr.ImageDetail {
+	excludedDigests := map[string]bool{}
+	for _, image := range excluded {
+		excludedDigests[aws.StringValue(image.ImageDigest)] = true
+	}
+
+	filtered := []*ecr.ImageDetail{}
+	for _, image := range images {
+		if !excludedDigests[aws.StringValue(image.ImageDigest)] {
+			filtered = append(filtered, image)
+		}
+	}
+
+	return filtered
+}
+
+// Statuses of the ECR image scans that are yet to complete. `PENDING` is only
+// reported by enhanced scanning.
+var scanPendingStatuses = map[string]bool{
+	ecr.ScanStatusInProgress: true,
+	"PENDING":                true,
+}
+
+// FilterScanPendingImages removes from the given list of images selected for
+// deletion the images whose scans are yet to complete, according to the scan
+// status returned by ECR along with the images. The second return value lists
+// the images removed from the given list.
+func FilterScanPendingImages(images []*ecr.ImageDetail) ([]*ecr.ImageDetail, []*ecr.ImageDetail) {
+	filtered, pending := []*ecr.ImageDetail{}, []*ecr.ImageDetail{}
+
+	for _, image := range images {
+		if image.ImageScanStatus != nil && scanPendingStatuses[aws.StringValue(image.ImageScanStatus.Status)] {
+			pending = append(pending, image)
+			continue
+		}
+
+		filtered = append(filtered, image)
+	}
+
+	return filtered, pending
+}
+
+// FilterImagesWithCriticalFindings returns the images from the given list that
+// are not in use and whose latest scans found vulnerabilities of `CRITICAL`
+// severity, regardless of how many images there are.
+func FilterImagesWithCriticalFindings(repoImages []*ecr.ImageDetail, tagsInUse []string) []*ecr.ImageDetail {
+	images := []*ecr.ImageDetail{}
+
+	for _, image := range repoImages {
+		if image.ImageScanFindingsSummary == nil || isImageProtected(image, tagsInUse) {
+			continue
+		}
+
+		if aws.Int64Value(image.ImageScanFindingsSummary.FindingSeverityCounts[ecr.FindingSeverityCritical]) > 0 {
+			images = append(images, image)
+		}
+	}
+
+	return images
+}
@@ -0,0 +1,1161 @@
+package core
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+func TestFilterImagesByTagCount(t *testing.T) {
+	latestTag := "latest"
+	tags := []string{"tag-1", "tag-2", "tag-3", "tag-4", "tag-5"}
+
+	orderedTime := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+		time.Unix(2, 0),
+	}
+
+	images := []*ecr.ImageDetail{
+		{
+			ImagePushedAt: &orderedTime[2],
+		},
+		{
+			ImagePushedAt: &orderedTime[1],
+			ImageTags:     []*string{&tags[0], &tags[1], &tags[2]},
+		},
+		{
+			ImagePushedAt: &orderedTime[0],
+			ImageTags:     []*string{&tags[3]},
+		},
+	}
+
+	testCases := []struct {
+		deleteUntagged bool
+		maxTags        int
+		tagsInUse      []string
+		images         []*ecr.ImageDetail
+		expected       []*ecr.ImageDetail
+	}{
+
+		// Should return no images when the filter is disabled
+		{
+			deleteUntagged: false,
+			maxTags:        0,
+			tagsInUse:      []string{},
+			images:         images,
+			expected:       []*ecr.ImageDetail{},
+		},
+
+		// Should return the untagged image
+		{
+			deleteUntagged: true,
+			maxTags:        0,
+			tagsInUse:      []string{},
+			images:         images,
+			expected: []*ecr.ImageDetail{
+				{
+					ImagePushedAt: &orderedTime[2],
+				},
+			},
+		},
+
+		// Should return the image with too many tags
+		{
+			deleteUntagged: false,
+			maxTags:        2,
+			tagsInUse:      []string{},
+			images:         images,
+			expected: []*ecr.ImageDetail{
+				{
+					ImagePushedAt: &orderedTime[1],
+				},
+			},
+		},
+
+		// Should return both untagged and images with too many tags, sorted by date
+		{
+			deleteUntagged: true,
+			maxTags:        2,
+			tagsInUse:      []string{},
+			images:         images,
+			expected: []*ecr.ImageDetail{
+				{
+					ImagePushedAt: &orderedTime[1],
+				},
+				{
+					ImagePushedAt: &orderedTime[2],
+				},
+			},
+		},
+
+		// Should not return images in use
+		{
+			deleteUntagged: true,
+			maxTags:        2,
+			tagsInUse:      []string{tags[1]},
+			images:         images,
+			expected: []*ecr.ImageDetail{
+				{
+					ImagePushedAt: &orderedTime[2],
+				},
+			},
+		},
+
+		// Should not return images tagged with 'latest'
+		{
+			deleteUntagged: false,
+			maxTags:        1,
+			tagsInUse:      []string{},
+			images: []*ecr.ImageDetail{
+				{
+					ImagePushedAt: &orderedTime[0],
+					ImageTags:     []*string{&tags[0], &latestTag},
+				},
+			},
+			expected: []*ecr.ImageDetail{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		filtered := FilterImagesByTagCount(testCase.deleteUntagged, testCase.maxTags, testCase.images, testCase.tagsInUse)
+
+		if len(filtered) != len(testCase.expected) {
+			t.Errorf("Expected list of images to have %d items, but it has %d:\n\nExpected: %+v\nActual: %+v", len(testCase.expected), len(filtered), testCase.expected, filtered)
+			continue
+		}
+
+		for i := range filtered {
+			actualDate := *filtered[i].ImagePushedAt
+			expectedDate := *testCase.expected[i].ImagePushedAt
+
+			if actualDate != expectedDate {
+				t.Errorf("Expected filtered[%d] timestamp to be %+v, but was %+v", i, expectedDate, actualDate)
+			}
+		}
+	}
+}
+
+func TestMergeImages(t *testing.T) {
+	digests := []string{"digest-1", "digest-2", "digest-3"}
+
+	orderedTime := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+		time.Unix(2, 0),
+	}
+
+	images := []*ecr.ImageDetail{
+		{
+			ImageDigest:   &digests[0],
+			ImagePushedAt: &orderedTime[0],
+		},
+		{
+			ImageDigest:   &digests[1],
+			ImagePushedAt: &orderedTime[1],
+		},
+		{
+			ImageDigest:   &digests[2],
+			ImagePushedAt: &orderedTime[2],
+		},
+	}
+
+	merged := MergeImages(
+		[]*ecr.ImageDetail{images[2], images[0]},
+		[]*ecr.ImageDetail{},
+		[]*ecr.ImageDetail{images[0], images[1]},
+	)
+
+	if len(merged) != 3 {
+		t.Fatalf("Expected merged list to have 3 items, but it has %d: %+v", len(merged), merged)
+	}
+
+	for i := range merged {
+		if *merged[i].ImageDigest != digests[i] {
+			t.Errorf("Expected merged[%d] digest to be %s, but was %s", i, digests[i], *merged[i].ImageDigest)
+		}
+	}
+}
+
+func TestFilterImagesBySize(t *testing.T) {
+	digests := []string{"tiny", "large", "unknown", "in-use", "list", "zero"}
+	tag, listMediaType := "tag-1", "application/vnd.docker.distribution.manifest.list.v2+json"
+	sizes := []int64{512, 1 << 20, 0}
+
+	orderedTime := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+	}
+
+	images := []*ecr.ImageDetail{
+		{ImageDigest: &digests[0], ImageSizeInBytes: &sizes[0], ImagePushedAt: &orderedTime[1]},
+		{ImageDigest: &digests[1], ImageSizeInBytes: &sizes[1]},
+		{ImageDigest: &digests[2]},
+		{ImageDigest: &digests[3], ImageSizeInBytes: &sizes[0], ImageTags: []*string{&tag}},
+		{ImageDigest: &digests[4], ImageSizeInBytes: &sizes[0], ImageManifestMediaType: &listMediaType},
+		{ImageDigest: &digests[5], ImageSizeInBytes: &sizes[2], ImagePushedAt: &orderedTime[0]},
+	}
+
+	testCases := []struct {
+		minBytes int64
+		expected []string
+	}{
+		// Disabled
+		{
+			minBytes: 0,
+			expected: []string{},
+		},
+
+		// Images of unknown size, in use or that are manifest lists are kept
+		{
+			minBytes: 1024,
+			expected: []string{"zero", "tiny"},
+		},
+
+		// Images as large as the threshold are kept
+		{
+			minBytes: 512,
+			expected: []string{"zero"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		filtered := FilterImagesBySize(testCase.minBytes, images, []string{tag})
+
+		actual := make([]string, len(filtered))
+		for i := range filtered {
+			actual[i] = *filtered[i].ImageDigest
+		}
+
+		if !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Expected filtered digests with %d min bytes to be %v, but was %v", testCase.minBytes, testCase.expected, actual)
+		}
+	}
+}
+
+func TestFilterImagesByRepositorySize(t *testing.T) {
+	digests := []string{"a", "b-in-use", "c", "d", "e-unknown", "f-list"}
+	tag, listMediaType := "tag-1", "application/vnd.docker.distribution.manifest.list.v2+json"
+	sizes := []int64{100, 200, 300, 400, 0, 10}
+
+	images := []*ecr.ImageDetail{}
+	for i := range digests {
+		pushedAt := time.Unix(int64(i), 0)
+		images = append(images, &ecr.ImageDetail{ImageDigest: &digests[i], ImagePushedAt: &pushedAt, ImageSizeInBytes: &sizes[i]})
+	}
+	images[1].ImageTags = []*string{&tag}
+	images[4].ImageSizeInBytes = nil
+	images[5].ImageManifestMediaType = &listMediaType
+
+	testCases := []struct {
+		maxBytes int64
+		selected []*ecr.ImageDetail
+		expected []string
+	}{
+		// Disabled
+		{maxBytes: 0, expected: []string{}},
+
+		// Already small enough
+		{maxBytes: 2000, expected: []string{}},
+
+		// The oldest images are deleted first, skipping the ones in use, of
+		// unknown size or that are manifest lists
+		{maxBytes: 700, expected: []string{"a", "c"}},
+		{maxBytes: 100, expected: []string{"a", "c", "d"}},
+
+		// Images already selected for deletion make up for the others
+		{maxBytes: 700, selected: images[:1], expected: []string{"c"}},
+	}
+
+	for _, testCase := range testCases {
+		filtered := FilterImagesByRepositorySize(testCase.maxBytes, images, testCase.selected, []string{tag})
+
+		actual := make([]string, len(filtered))
+		for i := range filtered {
+			actual[i] = *filtered[i].ImageDigest
+		}
+
+		if !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Expected filtered digests with %d max bytes to be %v, but was %v", testCase.maxBytes, testCase.expected, actual)
+		}
+	}
+}
+
+func TestTagsMatchingPatterns(t *testing.T) {
+	tags := []string{"release-1", "v1.2.3", "v1.2", "feature-1", "1.2.3"}
+
+	images := []*ecr.ImageDetail{
+		{ImageTags: []*string{&tags[0], &tags[1]}},
+		{ImageTags: []*string{&tags[2]}},
+		{ImageTags: []*string{&tags[3], &tags[4]}},
+		{},
+	}
+
+	testCases := []struct {
+		patterns []*regexp.Regexp
+		expected []string
+	}{
+		// Disabled
+		{
+			patterns: nil,
+			expected: []string{},
+		},
+
+		// Tags matching any of the patterns
+		{
+			patterns: []*regexp.Regexp{
+				regexp.MustCompile(`^release-.*`),
+				regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+$`),
+			},
+			expected: []string{"release-1", "v1.2.3"},
+		},
+
+		// Tags matching more than one pattern are returned once
+		{
+			patterns: []*regexp.Regexp{
+				regexp.MustCompile(`1`),
+				regexp.MustCompile(`\.`),
+			},
+			expected: []string{"release-1", "v1.2.3", "v1.2", "feature-1", "1.2.3"},
+		},
+	}
+
+	for i, testCase := range testCases {
+		actual := TagsMatchingPatterns(images, testCase.patterns)
+
+		if !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Expected matching tags in test case %d to be %v, but was %v", i, testCase.expected, actual)
+		}
+	}
+}
+
+func TestTagGroup(t *testing.T) {
+	tags := []string{"main-0123abc", "feature-xyz-4567def", "latest"}
+
+	testCases := []struct {
+		pattern  *regexp.Regexp
+		tags     []*string
+		expected string
+	}{
+		{pattern: regexp.MustCompile(`^(.+)-[0-9a-f]+$`), tags: []*string{&tags[0]}, expected: "main"},
+		{pattern: regexp.MustCompile(`^(.+)-[0-9a-f]+$`), tags: []*string{&tags[2], &tags[1]}, expected: "feature-xyz"},
+
+		// Without capture groups, the whole match is the group
+		{pattern: regexp.MustCompile(`^[a-z]+`), tags: []*string{&tags[1]}, expected: "feature"},
+
+		{pattern: regexp.MustCompile(`^(.+)-[0-9a-f]+$`), tags: []*string{&tags[2]}, expected: ""},
+		{pattern: regexp.MustCompile(`^(.+)-[0-9a-f]+$`), tags: []*string{}, expected: ""},
+	}
+
+	for i, testCase := range testCases {
+		group := TagGroup(&ecr.ImageDetail{ImageTags: testCase.tags}, testCase.pattern)
+
+		if group != testCase.expected {
+			t.Errorf("Test case %d: expected tag group to be '%s', but was '%s'", i, testCase.expected, group)
+		}
+	}
+}
+
+func TestFilterImagesByAge(t *testing.T) {
+	digests := []string{"old", "new", "unknown", "in-use", "older"}
+	tag := "tag-1"
+	now := time.Unix(100*24*60*60, 0)
+
+	pushedAt := []time.Time{
+		now.Add(-40 * 24 * time.Hour),
+		now.Add(-time.Hour),
+		now.Add(-50 * 24 * time.Hour),
+	}
+
+	images := []*ecr.ImageDetail{
+		{ImageDigest: &digests[0], ImagePushedAt: &pushedAt[0]},
+		{ImageDigest: &digests[1], ImagePushedAt: &pushedAt[1]},
+		{ImageDigest: &digests[2]},
+		{ImageDigest: &digests[3], ImagePushedAt: &pushedAt[2], ImageTags: []*string{&tag}},
+		{ImageDigest: &digests[4], ImagePushedAt: &pushedAt[2]},
+	}
+
+	testCases := []struct {
+		maxAge   time.Duration
+		expected []string
+	}{
+		// Disabled
+		{
+			maxAge:   0,
+			expected: []string{},
+		},
+
+		// Images of unknown age or in use are kept
+		{
+			maxAge:   30 * 24 * time.Hour,
+			expected: []string{"older", "old"},
+		},
+
+		// Images exactly as old as the threshold are kept
+		{
+			maxAge:   40 * 24 * time.Hour,
+			expected: []string{"older"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		filtered := FilterImagesByAge(testCase.maxAge, now, images, []string{tag})
+
+		actual := make([]string, len(filtered))
+		for i := range filtered {
+			actual[i] = *filtered[i].ImageDigest
+		}
+
+		if !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Expected filtered digests with %v max age to be %v, but was %v", testCase.maxAge, testCase.expected, actual)
+		}
+	}
+}
+
+func TestFilterManifestListChildren(t *testing.T) {
+	digests := []string{"list-1", "list-2", "child-1", "child-2", "child-3", "other"}
+
+	images := make([]*ecr.ImageDetail, len(digests))
+	for i := range digests {
+		images[i] = &ecr.ImageDetail{
+			ImageDigest: &digests[i],
+		}
+	}
+
+	children := map[string][]string{
+		"list-1": []string{"child-1", "child-2"},
+		"list-2": []string{"child-2", "child-3"},
+	}
+
+	testCases := []struct {
+		images   []*ecr.ImageDetail
+		expected []string
+	}{
+		// Both lists are retained, so all their children are protected
+		{
+			images:   []*ecr.ImageDetail{images[2], images[3], images[4], images[5]},
+			expected: []string{"other"},
+		},
+
+		// Only the children of the retained list are protected
+		{
+			images:   []*ecr.ImageDetail{images[0], images[2], images[3], images[4]},
+			expected: []string{"list-1", "child-1"},
+		},
+
+		// Both lists are deleted along with their children
+		{
+			images:   images,
+			expected: digests,
+		},
+	}
+
+	for _, testCase := range testCases {
+		filtered := FilterManifestListChildren(testCase.images, children)
+
+		actual := make([]string, len(filtered))
+		for i := range filtered {
+			actual[i] = *filtered[i].ImageDigest
+		}
+
+		if !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Expected filtered digests to be %v, but was %v", testCase.expected, actual)
+		}
+	}
+}
+
+func TestFilterOrphanedManifestLists(t *testing.T) {
+	digests := []string{"list-1", "list-2", "list-3", "child-1", "child-2"}
+	tagInUse := "in-use"
+
+	images := make([]*ecr.ImageDetail, len(digests))
+	for i := range digests {
+		images[i] = &ecr.ImageDetail{
+			ImageDigest: &digests[i],
+		}
+	}
+	images[2].ImageTags = []*string{&tagInUse}
+
+	children := map[string][]string{
+		"list-1": []string{"child-1", "child-2"},
+		"list-2": []string{"child-2", "child-3"},
+		"list-3": []string{"child-4"},
+	}
+
+	testCases := []struct {
+		images   []*ecr.ImageDetail
+		expected []string
+	}{
+		// All children are still around
+		{
+			images:   images,
+			expected: []string{},
+		},
+
+		// Lists are orphaned only when all their children are gone
+		{
+			images:   []*ecr.ImageDetail{images[0], images[1], images[2], images[3]},
+			expected: []string{"list-2"},
+		},
+
+		// Lists in use are never orphaned
+		{
+			images:   []*ecr.ImageDetail{images[0], images[1], images[2]},
+			expected: []string{"list-1", "list-2"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		orphaned := FilterOrphanedManifestLists(testCase.images, children, []string{tagInUse})
+
+		actual := make([]string, len(orphaned))
+		for i := range orphaned {
+			actual[i] = *orphaned[i].ImageDigest
+		}
+
+		if !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Expected orphaned digests to be %v, but was %v", testCase.expected, actual)
+		}
+	}
+}
+
+func TestOrphanedManifestListChildren(t *testing.T) {
+	digests := []string{"list-1", "list-2", "child-1", "child-2", "child-3", "child-4"}
+	tagInUse := "in-use"
+
+	images := make([]*ecr.ImageDetail, len(digests))
+	for i := range digests {
+		images[i] = &ecr.ImageDetail{
+			ImageDigest: &digests[i],
+		}
+	}
+	images[5].ImageTags = []*string{&tagInUse}
+
+	children := map[string][]string{
+		"list-1": []string{"child-1", "child-2", "child-4"},
+		"list-2": []string{"child-2", "child-3"},
+	}
+
+	testCases := []struct {
+		images   []*ecr.ImageDetail
+		expected []string
+	}{
+		// No lists are deleted
+		{
+			images:   []*ecr.ImageDetail{images[2]},
+			expected: []string{},
+		},
+
+		// Children shared with a retained list, or in use, are left alone
+		{
+			images:   []*ecr.ImageDetail{images[0]},
+			expected: []string{"child-1"},
+		},
+
+		// Children already selected are not returned again
+		{
+			images:   []*ecr.ImageDetail{images[0], images[1], images[2]},
+			expected: []string{"child-2", "child-3"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		orphaned := OrphanedManifestListChildren(images, testCase.images, children, []string{tagInUse})
+
+		actual := make([]string, len(orphaned))
+		for i := range orphaned {
+			actual[i] = *orphaned[i].ImageDigest
+		}
+
+		if !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Expected orphaned children digests to be %v, but was %v", testCase.expected, actual)
+		}
+	}
+}
+
+func TestFilterRepositoriesInUse(t *testing.T) {
+	repoNames := []string{"repo-1", "repo-2", "repo-3"}
+
+	repos := make([]*ecr.Repository, len(repoNames))
+	for i := range repoNames {
+		repos[i] = &ecr.Repository{
+			RepositoryName: &repoNames[i],
+		}
+	}
+
+	filtered := FilterRepositoriesInUse(repos, map[string][]string{
+		"repo-1": []string{"tag-1"},
+		"repo-3": []string{"tag-1", "tag-2"},
+		"other":  []string{"tag-1"},
+	})
+
+	actual := make([]string, len(filtered))
+	for i := range filtered {
+		actual[i] = *filtered[i].RepositoryName
+	}
+
+	expected := []string{"repo-1", "repo-3"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected filtered repos to be %v, but was %v", expected, actual)
+	}
+}
+
+func TestFilterRepositoriesByName(t *testing.T) {
+	repoNames := []string{"team-a/app", "team-a/base", "team-b/app"}
+
+	repos := make([]*ecr.Repository, len(repoNames))
+	for i := range repoNames {
+		repos[i] = &ecr.Repository{
+			RepositoryName: &repoNames[i],
+		}
+	}
+
+	testCases := []struct {
+		include  []string
+		exclude  []string
+		expected []string
+	}{
+		// No patterns
+		{
+			expected: repoNames,
+		},
+
+		// Only includes
+		{
+			include:  []string{"^team-a/", "^team-c/"},
+			expected: []string{"team-a/app", "team-a/base"},
+		},
+
+		// Only excludes
+		{
+			exclude:  []string{"/base$"},
+			expected: []string{"team-a/app", "team-b/app"},
+		},
+
+		// Excludes win over includes
+		{
+			include:  []string{"^team-a/"},
+			exclude:  []string{"/base$"},
+			expected: []string{"team-a/app"},
+		},
+	}
+
+	compile := func(patterns []string) []*regexp.Regexp {
+		compiled := []*regexp.Regexp{}
+		for _, pattern := range patterns {
+			compiled = append(compiled, regexp.MustCompile(pattern))
+		}
+		return compiled
+	}
+
+	for _, testCase := range testCases {
+		filtered := FilterRepositoriesByName(repos, compile(testCase.include), compile(testCase.exclude))
+
+		actual := make([]string, len(filtered))
+		for i := range filtered {
+			actual[i] = *filtered[i].RepositoryName
+		}
+
+		if !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Expected filtered repos with %v includes and %v excludes to be %v, but was %v", testCase.include, testCase.exclude, testCase.expected, actual)
+		}
+	}
+}
+
+func TestFilterAnnotatedImages(t *testing.T) {
+	digests := []string{"forever", "never", "docker", "broken", "missing"}
+
+	images := make([]*ecr.ImageDetail, len(digests))
+	for i := range digests {
+		images[i] = &ecr.ImageDetail{
+			ImageDigest: &digests[i],
+		}
+	}
+
+	manifests := map[string]string{
+		"forever": `{"annotations": {"com.example.keep": "forever"}}`,
+		"never":   `{"annotations": {"com.example.keep": "never"}}`,
+		"docker":  `{"schemaVersion": 2, "layers": []}`,
+		"broken":  `{`,
+	}
+
+	testCases := []struct {
+		value             string
+		expectedFiltered  []string
+		expectedProtected []string
+	}{
+		// Only the given value
+		{
+			value:             "forever",
+			expectedFiltered:  []string{"never", "docker", "broken", "missing"},
+			expectedProtected: []string{"forever"},
+		},
+
+		// Any value
+		{
+			value:             "",
+			expectedFiltered:  []string{"docker", "broken", "missing"},
+			expectedProtected: []string{"forever", "never"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		filtered, protected := FilterAnnotatedImages(images, manifests, "com.example.keep", testCase.value)
+
+		actualFiltered := make([]string, len(filtered))
+		for i := range filtered {
+			actualFiltered[i] = *filtered[i].ImageDigest
+		}
+
+		actualProtected := make([]string, len(protected))
+		for i := range protected {
+			actualProtected[i] = *protected[i].ImageDigest
+		}
+
+		if !reflect.DeepEqual(actualFiltered, testCase.expectedFiltered) {
+			t.Errorf("Expected filtered digests for value '%s' to be %v, but was %v", testCase.value, testCase.expectedFiltered, actualFiltered)
+		}
+
+		if !reflect.DeepEqual(actualProtected, testCase.expectedProtected) {
+			t.Errorf("Expected protected digests for value '%s' to be %v, but was %v", testCase.value, testCase.expectedProtected, actualProtected)
+		}
+	}
+}
+
+func TestLimitDeletions(t *testing.T) {
+	orderedTime := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+		time.Unix(2, 0),
+		time.Unix(3, 0),
+	}
+
+	images := make([]*ecr.ImageDetail, len(orderedTime))
+	for i := range orderedTime {
+		images[i] = &ecr.ImageDetail{
+			ImagePushedAt: &orderedTime[i],
+		}
+	}
+
+	imagesToDelete := map[string][]*ecr.ImageDetail{
+		"repo-1": []*ecr.ImageDetail{images[1], images[3]},
+		"repo-2": []*ecr.ImageDetail{images[0], images[2]},
+	}
+
+	testCases := []struct {
+		maxDeletes       int
+		expected         map[string][]*ecr.ImageDetail
+		expectedDeferred int
+	}{
+		// Below the limit
+		{
+			maxDeletes:       4,
+			expected:         imagesToDelete,
+			expectedDeferred: 0,
+		},
+
+		// The oldest images are chosen across repositories
+		{
+			maxDeletes: 3,
+			expected: map[string][]*ecr.ImageDetail{
+				"repo-1": []*ecr.ImageDetail{images[1]},
+				"repo-2": []*ecr.ImageDetail{images[0], images[2]},
+			},
+			expectedDeferred: 1,
+		},
+
+		// A repository may be left out entirely
+		{
+			maxDeletes: 1,
+			expected: map[string][]*ecr.ImageDetail{
+				"repo-2": []*ecr.ImageDetail{images[0]},
+			},
+			expectedDeferred: 3,
+		},
+	}
+
+	for _, testCase := range testCases {
+		actual, deferred := LimitDeletions(imagesToDelete, testCase.maxDeletes)
+
+		if !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Expected images to delete with limit %d to be %+v, but was %+v", testCase.maxDeletes, testCase.expected, actual)
+		}
+
+		if deferred != testCase.expectedDeferred {
+			t.Errorf("Expected %d deferred images with limit %d, but got %d", testCase.expectedDeferred, testCase.maxDeletes, deferred)
+		}
+	}
+}
+
+func TestLimitDeletionsPerRepository(t *testing.T) {
+	orderedTime := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+		time.Unix(2, 0),
+	}
+
+	images := make([]*ecr.ImageDetail, len(orderedTime))
+	for i := range orderedTime {
+		images[i] = &ecr.ImageDetail{
+			ImagePushedAt: &orderedTime[i],
+		}
+	}
+
+	imagesToDelete := map[string][]*ecr.ImageDetail{
+		"repo-1": []*ecr.ImageDetail{images[2], images[0], images[1]},
+		"repo-2": []*ecr.ImageDetail{images[1]},
+	}
+
+	testCases := []struct {
+		maxDeletes       int
+		expected         map[string][]*ecr.ImageDetail
+		expectedDeferred map[string][]*ecr.ImageDetail
+	}{
+		// Below the limit
+		{
+			maxDeletes:       3,
+			expected:         imagesToDelete,
+			expectedDeferred: map[string][]*ecr.ImageDetail{},
+		},
+
+		// The oldest images are chosen in each repository
+		{
+			maxDeletes: 1,
+			expected: map[string][]*ecr.ImageDetail{
+				"repo-1": []*ecr.ImageDetail{images[0]},
+				"repo-2": []*ecr.ImageDetail{images[1]},
+			},
+			expectedDeferred: map[string][]*ecr.ImageDetail{
+				"repo-1": []*ecr.ImageDetail{images[1], images[2]},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		actual, deferred := LimitDeletionsPerRepository(imagesToDelete, testCase.maxDeletes)
+
+		if !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Expected images to delete with limit %d to be %+v, but was %+v", testCase.maxDeletes, testCase.expected, actual)
+		}
+
+		if !reflect.DeepEqual(deferred, testCase.expectedDeferred) {
+			t.Errorf("Expected deferred images with limit %d to be %+v, but was %+v", testCase.maxDeletes, testCase.expectedDeferred, deferred)
+		}
+	}
+}
+
+func TestFilterRecentlyPulledImages(t *testing.T) {
+	digests := []string{"digest-1", "digest-2", "digest-3"}
+	tags := []string{"tag-1", "tag-2"}
+
+	images := []*ecr.ImageDetail{
+		{
+			ImageDigest: &digests[0],
+			ImageTags:   []*string{&tags[0]},
+		},
+		{
+			ImageDigest: &digests[1],
+			ImageTags:   []*string{&tags[1]},
+		},
+		{
+			ImageDigest: &digests[2],
+		},
+	}
+
+	testCases := []struct {
+		recentlyPulled map[string]bool
+		expected       []string
+	}{
+		// Nothing was pulled
+		{
+			recentlyPulled: nil,
+			expected:       digests,
+		},
+
+		// Pulled by tag
+		{
+			recentlyPulled: map[string]bool{"tag-2": true},
+			expected:       []string{"digest-1", "digest-3"},
+		},
+
+		// Pulled by digest
+		{
+			recentlyPulled: map[string]bool{"digest-3": true, "tag-1": true},
+			expected:       []string{"digest-2"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		filtered := FilterRecentlyPulledImages(images, testCase.recentlyPulled)
+
+		actual := make([]string, len(filtered))
+		for i := range filtered {
+			actual[i] = *filtered[i].ImageDigest
+		}
+
+		if !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Expected filtered digests to be %v, but was %v", testCase.expected, actual)
+		}
+	}
+}
+
+func TestFilterImagesNewerThanInUse(t *testing.T) {
+	orderedTime := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+		time.Unix(2, 0),
+	}
+	digests := []string{"digest-0", "digest-1", "digest-2"}
+	tags := []string{"tag-0", "tag-1", "tag-2"}
+
+	images := []*ecr.ImageDetail{}
+	for i := range digests {
+		images = append(images, &ecr.ImageDetail{
+			ImageDigest:   &digests[i],
+			ImageTags:     []*string{&tags[i]},
+			ImagePushedAt: &orderedTime[i],
+		})
+	}
+
+	testCases := []struct {
+		tagsInUse []string
+		expected  []string
+	}{
+		// Nothing in use
+		{
+			tagsInUse: []string{},
+			expected:  digests,
+		},
+
+		// Images newer than the newest image in use are removed
+		{
+			tagsInUse: []string{"tag-0", "tag-1"},
+			expected:  []string{"digest-0", "digest-1"},
+		},
+
+		// Nothing is newer than the newest image
+		{
+			tagsInUse: []string{"tag-2"},
+			expected:  digests,
+		},
+	}
+
+	for _, testCase := range testCases {
+		filtered := FilterImagesNewerThanInUse(images, images, testCase.tagsInUse)
+
+		actual := make([]string, len(filtered))
+		for i := range filtered {
+			actual[i] = *filtered[i].ImageDigest
+		}
+
+		if !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Expected filtered digests to be %v, but was %v", testCase.expected, actual)
+		}
+	}
+}
+
+func TestFilterImagesPushedSince(t *testing.T) {
+	orderedTime := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+		time.Unix(2, 0),
+	}
+	digests := []string{"digest-0", "digest-1", "digest-2", "digest-3"}
+
+	images := []*ecr.ImageDetail{
+		{ImageDigest: &digests[0], ImagePushedAt: &orderedTime[0]},
+		{ImageDigest: &digests[1], ImagePushedAt: &orderedTime[1]},
+		{ImageDigest: &digests[2], ImagePushedAt: &orderedTime[2]},
+		{ImageDigest: &digests[3]},
+	}
+
+	filtered := FilterImagesPushedSince(images, orderedTime[1])
+
+	actual := make([]string, len(filtered))
+	for i := range filtered {
+		actual[i] = *filtered[i].ImageDigest
+	}
+
+	if expected := []string{"digest-1", "digest-2"}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected filtered digests to be %v, but was %v", expected, actual)
+	}
+}
+
+func TestFilterImagesPulledSince(t *testing.T) {
+	orderedTime := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+		time.Unix(2, 0),
+	}
+	digests := []string{"digest-0", "digest-1", "digest-2", "digest-3"}
+
+	// Images that were never pulled have no pull time
+	images := []*ecr.ImageDetail{
+		{ImageDigest: &digests[0], LastRecordedPullTime: &orderedTime[0]},
+		{ImageDigest: &digests[1], LastRecordedPullTime: &orderedTime[1]},
+		{ImageDigest: &digests[2], LastRecordedPullTime: &orderedTime[2]},
+		{ImageDigest: &digests[3], ImagePushedAt: &orderedTime[2]},
+	}
+
+	filtered := FilterImagesPulledSince(images, orderedTime[1])
+
+	actual := make([]string, len(filtered))
+	for i := range filtered {
+		actual[i] = *filtered[i].ImageDigest
+	}
+
+	if expected := []string{"digest-1", "digest-2"}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected filtered digests to be %v, but was %v", expected, actual)
+	}
+}
+
+func TestLimitDeletionsBySize(t *testing.T) {
+	orderedTime := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+		time.Unix(2, 0),
+		time.Unix(3, 0),
+	}
+	sizes := []int64{10, 20, 30}
+
+	images := []*ecr.ImageDetail{
+		{ImagePushedAt: &orderedTime[0], ImageSizeInBytes: &sizes[0]},
+		{ImagePushedAt: &orderedTime[1]},
+		{ImagePushedAt: &orderedTime[2], ImageSizeInBytes: &sizes[1]},
+		{ImagePushedAt: &orderedTime[3], ImageSizeInBytes: &sizes[2]},
+	}
+
+	imagesToDelete := map[string][]*ecr.ImageDetail{
+		"repo-1": []*ecr.ImageDetail{images[1], images[3]},
+		"repo-2": []*ecr.ImageDetail{images[0], images[2]},
+	}
+
+	testCases := []struct {
+		targetBytes   int64
+		expected      map[string][]*ecr.ImageDetail
+		expectedBytes int64
+	}{
+		// The target is reached exactly
+		{
+			targetBytes: 10,
+			expected: map[string][]*ecr.ImageDetail{
+				"repo-2": []*ecr.ImageDetail{images[0]},
+			},
+			expectedBytes: 10,
+		},
+
+		// The target is overshot, and images without a size count as empty
+		{
+			targetBytes: 15,
+			expected: map[string][]*ecr.ImageDetail{
+				"repo-1": []*ecr.ImageDetail{images[1]},
+				"repo-2": []*ecr.ImageDetail{images[0], images[2]},
+			},
+			expectedBytes: 30,
+		},
+
+		// The target can't be reached
+		{
+			targetBytes:   100,
+			expected:      imagesToDelete,
+			expectedBytes: 60,
+		},
+	}
+
+	for _, testCase := range testCases {
+		actual, selectedBytes := LimitDeletionsBySize(imagesToDelete, testCase.targetBytes)
+
+		if !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Expected images to delete with target %d to be %+v, but was %+v", testCase.targetBytes, testCase.expected, actual)
+		}
+
+		if selectedBytes != testCase.expectedBytes {
+			t.Errorf("Expected %d selected bytes with target %d, but got %d", testCase.expectedBytes, testCase.targetBytes, selectedBytes)
+		}
+	}
+}
+
+func TestSplitUntaggedImages(t *testing.T) {
+	tag := "tag-1"
+	digests := []string{"digest-0", "digest-1", "digest-2"}
+	quarantineTag := QuarantineTag(&ecr.ImageDetail{ImageDigest: &digests[2]}, time.Unix(0, 0))
+
+	images := []*ecr.ImageDetail{
+		{ImageDigest: &digests[0], ImageTags: []*string{&tag}},
+		{ImageDigest: &digests[1]},
+		{ImageDigest: &digests[2], ImageTags: []*string{&quarantineTag}},
+	}
+
+	tagged, untagged := SplitUntaggedImages(images)
+
+	if len(tagged) != 1 || *tagged[0].ImageDigest != "digest-0" {
+		t.Errorf("Expected only digest-0 to be tagged, but got %+v", tagged)
+	}
+
+	if len(untagged) != 2 || *untagged[0].ImageDigest != "digest-1" || *untagged[1].ImageDigest != "digest-2" {
+		t.Errorf("Expected digest-1 and digest-2 to be untagged, but got %+v", untagged)
+	}
+}
+
+func TestFilterScanPendingImages(t *testing.T) {
+	digests := []string{"digest-0", "digest-1", "digest-2", "digest-3"}
+	statuses := []string{ecr.ScanStatusComplete, ecr.ScanStatusInProgress, "PENDING"}
+
+	images := []*ecr.ImageDetail{
+		{ImageDigest: &digests[0], ImageScanStatus: &ecr.ImageScanStatus{Status: &statuses[0]}},
+		{ImageDigest: &digests[1], ImageScanStatus: &ecr.ImageScanStatus{Status: &statuses[1]}},
+		{ImageDigest: &digests[2], ImageScanStatus: &ecr.ImageScanStatus{Status: &statuses[2]}},
+
+		// Images never scanned have no status
+		{ImageDigest: &digests[3]},
+	}
+
+	filtered, pending := FilterScanPendingImages(images)
+
+	if expected := []*ecr.ImageDetail{images[0], images[3]}; !reflect.DeepEqual(filtered, expected) {
+		t.Errorf("Expected filtered images to be %+v, but was %+v", expected, filtered)
+	}
+
+	if expected := []*ecr.ImageDetail{images[1], images[2]}; !reflect.DeepEqual(pending, expected) {
+		t.Errorf("Expected pending images to be %+v, but was %+v", expected, pending)
+	}
+}
+
+func TestFilterImagesWithCriticalFindings(t *testing.T) {
+	tags := []string{"tag-0", "tag-1", "tag-2", "tag-3"}
+	critical, high := int64(1), int64(3)
+
+	images := []*ecr.ImageDetail{
+		{
+			ImageTags: []*string{&tags[0]},
+			ImageScanFindingsSummary: &ecr.ImageScanFindingsSummary{
+				FindingSeverityCounts: map[string]*int64{ecr.FindingSeverityCritical: &critical},
+			},
+		},
+		{
+			ImageTags: []*string{&tags[1]},
+			ImageScanFindingsSummary: &ecr.ImageScanFindingsSummary{
+				FindingSeverityCounts: map[string]*int64{ecr.FindingSeverityHigh: &high},
+			},
+		},
+		{
+			ImageTags: []*string{&tags[2]},
+			ImageScanFindingsSummary: &ecr.ImageScanFindingsSummary{
+				FindingSeverityCounts: map[string]*int64{ecr.FindingSeverityCritical: &critical},
+			},
+		},
+		{
+			ImageTags: []*string{&tags[3]},
+		},
+	}
+
+	// tag-2 is in use, so it's never deleted
+	actual := FilterImagesWithCriticalFindings(images, []string{"tag-2"})
+
+	if expected := []*ecr.ImageDetail{images[0]}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected images with critical findings to be %+v, but was %+v", expected, actual)
+	}
+}
@@ -0,0 +1,377 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+)
+
+// GitRepository is a Git repository holding the manifests deployed by a
+// GitOps tool such as Flux or Argo CD.
+type GitRepository struct {
+	URL string
+
+	// Branch or tag to check out, such as `main`. If empty, the default
+	// branch of the repository is used.
+	Ref string
+}
+
+// ParseGitRepository parses the given Git repository, given as its URL
+// optionally followed by `#<ref>`, such as
+// `https://github.com/org/deploy.git#main`.
+func ParseGitRepository(value string) (GitRepository, error) {
+	repo := GitRepository{URL: value}
+	if index := strings.LastIndex(value, "#"); index >= 0 {
+		repo.URL, repo.Ref = value[:index], value[index+1:]
+		if repo.Ref == "" {
+			return repo, fmt.Errorf("Expected <url>#<ref>, but got '%s'", value)
+		}
+	}
+
+	if repo.URL == "" {
+		return repo, fmt.Errorf("Expected <url>[#<ref>], but got '%s'", value)
+	}
+
+	return repo, nil
+}
+
+// ParseGitRepositories parses the given comma-separated list of Git
+// repositories, as per `ParseGitRepository`.
+func ParseGitRepositories(value string) ([]GitRepository, error) {
+	repos := []GitRepository{}
+	for _, item := range ParseCommaSeparatedList(value) {
+		repo, err := ParseGitRepository(*item)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, repo)
+	}
+
+	return repos, nil
+}
+
+// String returns the repository as given to `ParseGitRepository`.
+func (r GitRepository) String() string {
+	if r.Ref == "" {
+		return r.URL
+	}
+	return r.URL + "#" + r.Ref
+}
+
+// GitClient defines the expected interface of any object capable of checking
+// out Git repositories.
+type GitClient interface {
+	// Clone checks out the given repository in the given directory, which
+	// must not exist yet.
+	Clone(repo GitRepository, dir string) error
+}
+
+// GitClientImpl checks out Git repositories without a `git` binary.
+type GitClientImpl struct {
+	// If not empty, the token sent to HTTPS remotes, such as a GitHub or
+	// GitLab access token.
+	Token string
+}
+
+// NewGitClient returns a new Git client sending the token stored in the
+// given file to HTTPS remotes, if the path is not empty.
+func NewGitClient(tokenPath string) (*GitClientImpl, error) {
+	client := &GitClientImpl{}
+	if tokenPath == "" {
+		return client, nil
+	}
+
+	token, err := ioutil.ReadFile(tokenPath)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read Git token: %v", err)
+	}
+	client.Token = strings.TrimSpace(string(token))
+
+	return client, nil
+}
+
+// Clone makes a shallow clone of the given repository in the given
+// directory. Refs are looked up as branches first, then as tags, unless they
+// are full refs such as `refs/heads/main`.
+func (c *GitClientImpl) Clone(repo GitRepository, dir string) error {
+	var auth transport.AuthMethod
+	if c.Token != "" && strings.HasPrefix(repo.URL, "https://") {
+		// Access tokens are sent as the password, the user name being
+		// ignored by GitHub and GitLab
+		auth = &githttp.BasicAuth{Username: "git", Password: c.Token}
+	}
+
+	refs := []plumbing.ReferenceName{""}
+	switch {
+	case strings.HasPrefix(repo.Ref, "refs/"):
+		refs = []plumbing.ReferenceName{plumbing.ReferenceName(repo.Ref)}
+	case repo.Ref != "":
+		refs = []plumbing.ReferenceName{plumbing.NewBranchReferenceName(repo.Ref), plumbing.NewTagReferenceName(repo.Ref)}
+	}
+
+	var err error
+	for _, ref := range refs {
+		_, err = git.PlainClone(dir, false, &git.CloneOptions{
+			URL:           repo.URL,
+			Auth:          auth,
+			ReferenceName: ref,
+			SingleBranch:  true,
+			Depth:         1,
+		})
+		if err != plumbing.ErrReferenceNotFound {
+			break
+		}
+
+		// Clones looking for the wrong kind of ref leave an empty
+		// repository behind
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+// GitOpsScanner finds out the images referenced by the manifests stored in
+// GitOps repositories, so that images declared in Git but not deployed yet,
+// or not anymore, are considered in use. The repositories are checked out
+// again in each pass.
+type GitOpsScanner struct {
+	Repositories []GitRepository
+	Client       GitClient
+}
+
+// Name returns the name of the GitOps repositories.
+func (s *GitOpsScanner) Name() string {
+	return "GitOps repos"
+}
+
+// ScanImages returns the image references found in the GitOps repositories,
+// as per `ImagesFromManifestTree`. These don't depend on the given client nor
+// on the given namespaces.
+func (s *GitOpsScanner) ScanImages(kubeClient KubernetesClient, namespace []*string) ([]string, error) {
+	images := []string{}
+	for _, repo := range s.Repositories {
+		repoImages, err := s.scanRepository(repo)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot scan '%s': %v", repo, err)
+		}
+		images = append(images, repoImages...)
+	}
+
+	return images, nil
+}
+
+// scanRepository checks out the given repository in a temporary directory,
+// which is removed afterwards, and returns the image references found in it.
+func (s *GitOpsScanner) scanRepository(repo GitRepository) ([]string, error) {
+	tempDir, err := ioutil.TempDir("", "ecr-cleanup-gitops")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	client := s.Client
+	if client == nil {
+		client = &GitClientImpl{}
+	}
+
+	dir := filepath.Join(tempDir, "repo")
+	if err := client.Clone(repo, dir); err != nil {
+		return nil, fmt.Errorf("Cannot clone: %v", err)
+	}
+
+	return ImagesFromManifestTree(dir)
+}
+
+// ImagesFromManifestTree returns the image references found in the YAML files
+// under the given directory, as per `ImagesFromManifest`. Documents that are
+// not valid YAML, such as Helm templates, are skipped.
+func ImagesFromManifestTree(root string) ([]string, error) {
+	images := []string{}
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if ext := filepath.Ext(path); !info.Mode().IsRegular() || (ext != ".yaml" && ext != ".yml") {
+			return nil
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		images = append(images, ImagesFromManifest(data)...)
+
+		return nil
+	})
+
+	return images, err
+}
+
+// ImagesFromManifest returns the image references found in the documents of
+// the given YAML file, which may be Kubernetes manifests, kustomizations or
+// Helm values, wherever they are nested, such as in the values of a Flux
+// `HelmRelease` or of an Argo CD `Application`:
+//
+//   - the `image` fields holding a string, such as the ones of containers;
+//   - the `repository`, `tag` and `digest` fields, along with the `registry`
+//     one, of the maps holding a `repository` string field, as in most charts;
+//   - the `newName` or `name`, `newTag` and `digest` fields of the `images`
+//     lists of kustomizations.
+//
+// Any other string holding YAML, such as the inline values of an Argo CD
+// `Application`, is looked at as well. Documents that are not valid YAML are
+// skipped.
+func ImagesFromManifest(data []byte) []string {
+	images := []string{}
+	for _, document := range manifestSeparatorRegex.Split(string(data), -1) {
+		documentJSON, err := yaml.YAMLToJSON([]byte(document))
+		if err != nil {
+			continue
+		}
+
+		var object interface{}
+		if err := json.Unmarshal(documentJSON, &object); err != nil {
+			continue
+		}
+		images = appendManifestImages(images, object)
+	}
+
+	return images
+}
+
+// appendManifestImages appends the image references found in the given
+// unstructured value to the given images, as per `ImagesFromManifest`.
+func appendManifestImages(images []string, value interface{}) []string {
+	switch value := value.(type) {
+	case []interface{}:
+		for _, item := range value {
+			images = appendManifestImages(images, item)
+		}
+
+	case map[string]interface{}:
+		if image, ok := value["image"].(string); ok && image != "" && !strings.ContainsAny(image, " \n") {
+			images = append(images, image)
+		}
+
+		if image := chartValuesImage(value); image != "" {
+			images = append(images, image)
+		}
+
+		if kustomizeImages, ok := value["images"].([]interface{}); ok {
+			for _, item := range kustomizeImages {
+				if image := kustomizeImage(item); image != "" {
+					images = append(images, image)
+				}
+			}
+		}
+
+		// Sorted, so that images are listed in the same order every time
+		keys := []string{}
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			images = appendManifestImages(images, value[key])
+		}
+
+	case string:
+		// Only multi-line strings may be YAML documents worth parsing
+		if strings.Contains(value, "\n") {
+			images = append(images, ImagesFromManifest([]byte(value))...)
+		}
+	}
+
+	return images
+}
+
+// chartValuesImage returns the image reference given by the `registry`,
+// `repository`, `tag` and `digest` fields of the given Helm values, such as
+// the ones of the `image` field of most charts, or an empty string if there
+// is no `repository` field.
+func chartValuesImage(values map[string]interface{}) string {
+	repository, _ := values["repository"].(string)
+	if repository == "" || strings.ContainsAny(repository, " \n") {
+		return ""
+	}
+
+	image := repository
+	if registry, _ := values["registry"].(string); registry != "" {
+		image = registry + "/" + repository
+	}
+
+	if digest, _ := values["digest"].(string); digest != "" {
+		return image + "@" + digest
+	}
+	if tag := manifestScalar(values["tag"]); tag != "" {
+		return image + ":" + tag
+	}
+	return image
+}
+
+// kustomizeImage returns the image reference given by the given entry of the
+// `images` list of a kustomization, or an empty string if it is not one.
+func kustomizeImage(value interface{}) string {
+	fields, _ := value.(map[string]interface{})
+	name, _ := fields["name"].(string)
+	if name == "" {
+		return ""
+	}
+
+	newName, _ := fields["newName"].(string)
+	newTag := manifestScalar(fields["newTag"])
+	digest, _ := fields["digest"].(string)
+
+	// Entries only renaming images don't say which tag is used
+	if newName == "" && newTag == "" && digest == "" {
+		return ""
+	}
+
+	image := name
+	if newName != "" {
+		image = newName
+	}
+
+	if digest != "" {
+		return image + "@" + digest
+	}
+	if newTag != "" {
+		return image + ":" + newTag
+	}
+	return image
+}
+
+// manifestScalar returns the given unstructured scalar as a string, since
+// unquoted tags such as `42` are parsed as numbers.
+func manifestScalar(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return ""
+}
@@ -0,0 +1,164 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// mockGitClient checks out repositories holding the given files, by path, or
+// fails with the given error.
+type mockGitClient struct {
+	files      map[string]string
+	cloneError error
+	clonedRepo GitRepository
+}
+
+func (m *mockGitClient) Clone(repo GitRepository, dir string) error {
+	m.clonedRepo = repo
+	if m.cloneError != nil {
+		return m.cloneError
+	}
+
+	for path, content := range m.files {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestParseGitRepository(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected GitRepository
+		err      bool
+	}{
+		{value: "https://github.com/org/deploy.git", expected: GitRepository{URL: "https://github.com/org/deploy.git"}},
+		{value: "https://github.com/org/deploy.git#main", expected: GitRepository{URL: "https://github.com/org/deploy.git", Ref: "main"}},
+		{value: "git@github.com:org/deploy.git#v1.2.0", expected: GitRepository{URL: "git@github.com:org/deploy.git", Ref: "v1.2.0"}},
+		{value: "https://github.com/org/deploy.git#", err: true},
+		{value: "#main", err: true},
+	}
+
+	for i, testCase := range testCases {
+		repo, err := ParseGitRepository(testCase.value)
+
+		if testCase.err {
+			if err == nil {
+				t.Errorf("Test case %d: expected an error, but got %+v", i, repo)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Test case %d: expected no error, but got %v", i, err)
+		} else if repo != testCase.expected {
+			t.Errorf("Test case %d: expected %+v, but got %+v", i, testCase.expected, repo)
+		} else if repo.String() != testCase.value {
+			t.Errorf("Test case %d: expected '%s', but got '%s'", i, testCase.value, repo)
+		}
+	}
+}
+
+func TestImagesFromManifest(t *testing.T) {
+	manifest := `
+apiVersion: apps/v1
+kind: Deployment
+spec:
+  template:
+    spec:
+      initContainers:
+      - name: migrate
+        image: registry/migrate:1.0
+      containers:
+      - name: app
+        image: registry/app:1.0
+---
+apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+images:
+- name: registry/app
+  newTag: "2.0"
+- name: registry/worker
+  newName: registry/worker-v2
+  digest: sha256:abc
+- name: registry/renamed-only
+  newName: registry/other
+---
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+spec:
+  values:
+    image:
+      registry: registry
+      repository: api
+      tag: 42
+---
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+spec:
+  source:
+    helm:
+      values: |
+        image:
+          repository: registry/web
+          tag: "3.1"
+---
+image: {{ .Values.image }}
+`
+
+	expected := []string{
+		"registry/app:1.0",
+		"registry/migrate:1.0",
+		"registry/app:2.0",
+		"registry/worker-v2@sha256:abc",
+		"registry/api:42",
+		"registry/web:3.1",
+	}
+
+	if images := ImagesFromManifest([]byte(manifest)); !reflect.DeepEqual(images, expected) {
+		t.Errorf("Expected images to be %v, but got %v", expected, images)
+	}
+}
+
+func TestGitOpsScanner(t *testing.T) {
+	gitClient := &mockGitClient{
+		files: map[string]string{
+			"apps/app.yaml":        "image: registry/app:1.0\n",
+			"apps/values.yml":      "image:\n  repository: registry/worker\n  tag: \"2.0\"\n",
+			"apps/README.md":       "image: registry/readme:1.0\n",
+			".git/refs/state.yaml": "image: registry/git:1.0\n",
+		},
+	}
+
+	repo := GitRepository{URL: "https://github.com/org/deploy.git", Ref: "main"}
+	scanner := &GitOpsScanner{Repositories: []GitRepository{repo}, Client: gitClient}
+
+	images, err := scanner.ScanImages(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	expected := []string{"registry/app:1.0", "registry/worker:2.0"}
+	if !reflect.DeepEqual(images, expected) {
+		t.Errorf("Expected images to be %v, but got %v", expected, images)
+	}
+
+	if gitClient.clonedRepo != repo {
+		t.Errorf("Expected '%s' to be cloned, but got '%s'", repo, gitClient.clonedRepo)
+	}
+
+	gitClient.cloneError = fmt.Errorf("authentication required")
+	if _, err := scanner.ScanImages(nil, nil); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+}
@@ -0,0 +1,107 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// healthClients holds the clients used by the clean-up loop, which the
+// readiness probe talks to.
+type healthClients struct {
+	kubeClient KubernetesClient
+	ecrClients []RegionalECRClient
+}
+
+// markLoopActivity records that the clean-up loop made progress at the given
+// time, such as completing a pass.
+func (t *CleanupTask) markLoopActivity(now time.Time) {
+	atomic.StoreInt64(&t.loopActivity, now.UnixNano())
+}
+
+// CheckLiveness returns an error if the clean-up loop made no progress, such
+// as completing a pass, for `LivenessIntervals` intervals up to the given
+// time, or while that many passes were due as per `Schedule`, which means it
+// is most likely wedged. No error is returned before the loop starts, or if
+// `LivenessIntervals` is not positive.
+func (t *CleanupTask) CheckLiveness(now time.Time) error {
+	lastActivity := atomic.LoadInt64(&t.loopActivity)
+	if t.LivenessIntervals <= 0 || lastActivity == 0 {
+		return nil
+	}
+
+	// The interval and schedule can be reloaded while the loop runs
+	t.settingsMutex.RLock()
+	interval, schedule, jitter := t.Interval, t.Schedule, t.ScheduleJitter
+	t.settingsMutex.RUnlock()
+
+	maxIdle := time.Duration(t.LivenessIntervals*interval) * time.Minute
+	if schedule != nil {
+		// Scheduled passes are not evenly spaced, e.g. on weekdays only
+		last, due := time.Unix(0, lastActivity), time.Unix(0, lastActivity)
+		for i := 0; i < t.LivenessIntervals; i++ {
+			due = schedule.Next(due)
+		}
+		maxIdle = due.Sub(last)
+	}
+	maxIdle += jitter
+
+	if idle := now.Sub(time.Unix(0, lastActivity)); idle > maxIdle {
+		return fmt.Errorf("No clean-up pass completed in the last %v, longer than %d intervals", idle, t.LivenessIntervals)
+	}
+
+	return nil
+}
+
+// CheckReadiness returns an error if the Kubernetes API or the ECR API of any
+// region cannot be reached with the clients of the clean-up loop, or if the
+// loop is yet to start.
+func (t *CleanupTask) CheckReadiness() error {
+	clients, ok := t.clients.Load().(healthClients)
+	if !ok {
+		return fmt.Errorf("Clean-up loop not started yet")
+	}
+
+	if _, err := clients.kubeClient.NamespaceExists(t.ControllerNamespace); err != nil {
+		return fmt.Errorf("Cannot reach Kubernetes API: %v", err)
+	}
+
+	for _, regional := range clients.ecrClients {
+		if err := regional.Client.Ping(); err != nil {
+			return fmt.Errorf("Cannot reach ECR API in '%s' region: %v", regional.Region, err)
+		}
+	}
+
+	return nil
+}
+
+// HealthzHandler returns an HTTP handler for liveness probes, which responds
+// with 503 when `CheckLiveness` fails.
+func (t *CleanupTask) HealthzHandler() http.Handler {
+	return healthHandler(func() error {
+		return t.CheckLiveness(time.Now())
+	})
+}
+
+// ReadyzHandler returns an HTTP handler for readiness probes, which responds
+// with 503 when `CheckReadiness` fails.
+func (t *CleanupTask) ReadyzHandler() http.Handler {
+	return healthHandler(t.CheckReadiness)
+}
+
+// healthHandler returns an HTTP handler responding with "ok" if the given
+// check succeeds, or with 503 and the error otherwise.
+func healthHandler(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+		if err := check(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "%v\n", err)
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	})
+}
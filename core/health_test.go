@@ -0,0 +1,143 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckLiveness(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+
+	testCases := []struct {
+		livenessIntervals int
+		lastActivity      time.Time
+		ok                bool
+	}{
+		// Loop not started yet
+		{livenessIntervals: 3, ok: true},
+
+		// Within 3 intervals of 10 minutes
+		{livenessIntervals: 3, lastActivity: now.Add(-29 * time.Minute), ok: true},
+		{livenessIntervals: 3, lastActivity: now.Add(-31 * time.Minute), ok: false},
+
+		// Disabled
+		{livenessIntervals: 0, lastActivity: now.Add(-24 * time.Hour), ok: true},
+	}
+
+	for i, testCase := range testCases {
+		task := &CleanupTask{
+			Interval:          10,
+			LivenessIntervals: testCase.livenessIntervals,
+		}
+
+		if !testCase.lastActivity.IsZero() {
+			task.markLoopActivity(testCase.lastActivity)
+		}
+
+		if err := task.CheckLiveness(now); (err == nil) != testCase.ok {
+			t.Errorf("Test case %d: expected liveness check to succeed to be %t, but got error %v", i, testCase.ok, err)
+		}
+	}
+}
+
+func TestCheckLivenessWithSchedule(t *testing.T) {
+	// A Saturday, while passes only run on weekdays
+	now := time.Date(2017, time.March, 18, 12, 0, 0, 0, time.UTC)
+	schedule, _ := ParseCronSchedule("0 3 * * 1-5")
+
+	testCases := []struct {
+		lastActivity time.Time
+		jitter       time.Duration
+		ok           bool
+	}{
+		// Passes due on Thursday and Friday
+		{lastActivity: time.Date(2017, time.March, 16, 2, 0, 0, 0, time.UTC), ok: false},
+		{lastActivity: time.Date(2017, time.March, 16, 4, 0, 0, 0, time.UTC), ok: true},
+
+		// The jitter delays the passes
+		{lastActivity: time.Date(2017, time.March, 15, 4, 0, 0, 0, time.UTC), ok: false},
+		{lastActivity: time.Date(2017, time.March, 15, 4, 0, 0, 0, time.UTC), jitter: 72 * time.Hour, ok: true},
+	}
+
+	for i, testCase := range testCases {
+		task := &CleanupTask{
+			Interval:          10,
+			Schedule:          schedule,
+			ScheduleJitter:    testCase.jitter,
+			LivenessIntervals: 2,
+		}
+		task.markLoopActivity(testCase.lastActivity)
+
+		if err := task.CheckLiveness(now); (err == nil) != testCase.ok {
+			t.Errorf("Test case %d: expected liveness check to succeed to be %t, but got error %v", i, testCase.ok, err)
+		}
+	}
+}
+
+func TestCheckReadiness(t *testing.T) {
+	testCases := []struct {
+		kubeError error
+		ecrErrors []error
+		expected  string
+	}{
+		{ecrErrors: []error{nil, nil}},
+		{kubeError: fmt.Errorf("timeout"), ecrErrors: []error{nil, nil}, expected: "Cannot reach Kubernetes API"},
+		{ecrErrors: []error{nil, fmt.Errorf("timeout")}, expected: "Cannot reach ECR API in 'eu-west-1' region"},
+	}
+
+	for i, testCase := range testCases {
+		task := &CleanupTask{ControllerNamespace: "namespace"}
+
+		if err := task.CheckReadiness(); err == nil {
+			t.Errorf("Test case %d: expected readiness check to fail before the loop starts, but it succeeded", i)
+		}
+
+		ecrClients := []RegionalECRClient{
+			{Region: "us-east-1", Client: &mockECRClient{t: t, pingError: testCase.ecrErrors[0]}},
+			{Region: "eu-west-1", Client: &mockECRClient{t: t, pingError: testCase.ecrErrors[1]}},
+		}
+		task.clients.Store(healthClients{
+			kubeClient: &mockKubeClient{t: t, namespaceExistsResult: true, namespaceExistsError: testCase.kubeError},
+			ecrClients: ecrClients,
+		})
+
+		err := task.CheckReadiness()
+		if testCase.expected == "" && err != nil {
+			t.Errorf("Test case %d: expected readiness check to succeed, but got error %v", i, err)
+		}
+
+		if testCase.expected != "" && (err == nil || !strings.Contains(err.Error(), testCase.expected)) {
+			t.Errorf("Test case %d: expected readiness check to fail with %q, but got error %v", i, testCase.expected, err)
+		}
+	}
+}
+
+func TestHealthHandlers(t *testing.T) {
+	task := &CleanupTask{
+		Interval:          10,
+		LivenessIntervals: 3,
+	}
+	task.markLoopActivity(time.Now().Add(-time.Hour))
+
+	testCases := []struct {
+		handler      http.Handler
+		expectedCode int
+	}{
+		{handler: healthHandler(func() error { return nil }), expectedCode: http.StatusOK},
+		{handler: task.HealthzHandler(), expectedCode: http.StatusServiceUnavailable},
+		{handler: task.ReadyzHandler(), expectedCode: http.StatusServiceUnavailable},
+	}
+
+	for i, testCase := range testCases {
+		recorder := httptest.NewRecorder()
+		testCase.handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+		if recorder.Code != testCase.expectedCode {
+			t.Errorf("Test case %d: expected status code %d, but got %d: %s", i, testCase.expectedCode, recorder.Code, recorder.Body.String())
+		}
+	}
+}
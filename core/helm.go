@@ -0,0 +1,122 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Type, label selector and data key of the secrets in which Helm records its
+// releases, named `sh.helm.release.v1.<release>.v<revision>`.
+const (
+	HelmReleaseSecretType     = "helm.sh/release.v1"
+	HelmReleaseSecretSelector = "owner=helm"
+	HelmReleaseSecretKey      = "release"
+)
+
+// manifestSeparatorRegex matches the separators between the documents of a
+// rendered manifest.
+var manifestSeparatorRegex = regexp.MustCompile(`(?m)^---\s*$`)
+
+// HelmReleaseScanner finds out the images used by the rendered manifests of
+// the Helm releases that are deployed or being deployed, so that workloads
+// scaled down to zero still have their images on the next `helm upgrade`.
+// Superseded revisions are left out.
+type HelmReleaseScanner struct{}
+
+// Name returns the name of the Helm releases.
+func (s *HelmReleaseScanner) Name() string {
+	return "Helm releases"
+}
+
+// ScanImages returns the image references used by the manifests of the Helm
+// releases from the given namespaces.
+func (s *HelmReleaseScanner) ScanImages(kubeClient KubernetesClient, namespace []*string) ([]string, error) {
+	secrets, err := kubeClient.ListHelmReleaseSecrets(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	images := []string{}
+	for _, secret := range secrets {
+		if !isCurrentHelmRelease(secret) {
+			continue
+		}
+
+		releaseImages, err := ImagesFromHelmRelease(secret.Data[HelmReleaseSecretKey])
+		if err != nil {
+			return nil, fmt.Errorf("Cannot decode Helm release '%s/%s': %v", secret.Namespace, secret.Name, err)
+		}
+		images = append(images, releaseImages...)
+	}
+
+	return images, nil
+}
+
+// isCurrentHelmRelease tells whether the given secret records a Helm release
+// that is deployed, or that is being installed, upgraded or rolled back.
+func isCurrentHelmRelease(secret *v1.Secret) bool {
+	if string(secret.Type) != HelmReleaseSecretType {
+		return false
+	}
+
+	status := secret.Labels["status"]
+	return status == "deployed" || strings.HasPrefix(status, "pending-")
+}
+
+// ImagesFromHelmRelease returns the image references found in the rendered
+// manifest of the given Helm release, as stored by Helm in the data of its
+// release secrets: base64-encoded, gzipped JSON. The images are the ones of
+// every container list found in the manifest, as per
+// `ImagesFromUnstructuredList`.
+func ImagesFromHelmRelease(data []byte) ([]string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	// Helm gzips the releases it stores, but reads the ones that are not as
+	// they are, and so does this
+	if bytes.HasPrefix(decoded, []byte{0x1f, 0x8b}) {
+		reader, err := gzip.NewReader(bytes.NewReader(decoded))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+
+		if decoded, err = ioutil.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	}
+
+	release := struct {
+		Manifest string `json:"manifest"`
+	}{}
+	if err := json.Unmarshal(decoded, &release); err != nil {
+		return nil, err
+	}
+
+	images := []string{}
+	for _, document := range manifestSeparatorRegex.Split(release.Manifest, -1) {
+		documentJSON, err := yaml.YAMLToJSON([]byte(document))
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse manifest: %v", err)
+		}
+
+		var object interface{}
+		if err := json.Unmarshal(documentJSON, &object); err != nil {
+			return nil, fmt.Errorf("Cannot parse manifest: %v", err)
+		}
+		images = appendUnstructuredImages(images, object)
+	}
+
+	return images, nil
+}
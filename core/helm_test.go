@@ -0,0 +1,129 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// newTestHelmRelease returns the data of a Helm release secret holding the
+// given rendered manifest, encoded as Helm does, optionally without gzip.
+func newTestHelmRelease(t *testing.T, manifest string, gzipped bool) []byte {
+	data, err := json.Marshal(map[string]interface{}{"name": "app", "version": 2, "manifest": manifest})
+	if err != nil {
+		t.Fatalf("Cannot encode release: %v", err)
+	}
+
+	if gzipped {
+		buffer := &bytes.Buffer{}
+		writer := gzip.NewWriter(buffer)
+		writer.Write(data)
+		writer.Close()
+		data = buffer.Bytes()
+	}
+
+	return []byte(base64.StdEncoding.EncodeToString(data))
+}
+
+const testHelmManifest = `---
+# Source: app/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+---
+# Source: app/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  replicas: 0
+  template:
+    spec:
+      initContainers:
+        - name: migrate
+          image: "repo-1:migrate"
+      containers:
+        - name: app
+          image: repo-1:tag-1
+---
+apiVersion: batch/v1
+kind: CronJob
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+            - image: repo-2:tag-1
+`
+
+func TestImagesFromHelmRelease(t *testing.T) {
+	expected := []string{"repo-1:tag-1", "repo-1:migrate", "repo-2:tag-1"}
+
+	for _, gzipped := range []bool{true, false} {
+		actual, err := ImagesFromHelmRelease(newTestHelmRelease(t, testHelmManifest, gzipped))
+		if err != nil {
+			t.Errorf("Expected no error with gzip %t, but got %v", gzipped, err)
+		}
+
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Expected result with gzip %t to be %+v, but was %+v", gzipped, expected, actual)
+		}
+	}
+
+	for _, data := range [][]byte{[]byte("not base64!"), []byte(base64.StdEncoding.EncodeToString([]byte("not json")))} {
+		if _, err := ImagesFromHelmRelease(data); err == nil {
+			t.Errorf("Expected an error for %q, but got none", data)
+		}
+	}
+}
+
+func TestHelmReleaseScannerScanImages(t *testing.T) {
+	namespace := "namespace"
+
+	newSecret := func(name, secretType, status, manifest string) *v1.Secret {
+		secret := &v1.Secret{
+			Type: v1.SecretType(secretType),
+			Data: map[string][]byte{HelmReleaseSecretKey: newTestHelmRelease(t, manifest, true)},
+		}
+		secret.Name, secret.Namespace = name, namespace
+		secret.Labels = map[string]string{"owner": "helm", "status": status}
+		return secret
+	}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		listHelmReleaseSecretsResult: []*v1.Secret{
+			newSecret("sh.helm.release.v1.app.v1", HelmReleaseSecretType, "superseded", "spec: {containers: [{image: repo-1:tag-0}]}"),
+			newSecret("sh.helm.release.v1.app.v2", HelmReleaseSecretType, "deployed", "spec: {containers: [{image: repo-1:tag-1}]}"),
+			newSecret("sh.helm.release.v1.app.v3", HelmReleaseSecretType, "pending-upgrade", "spec: {containers: [{image: repo-1:tag-2}]}"),
+			newSecret("not-a-release", "Opaque", "deployed", "spec: {containers: [{image: repo-1:tag-3}]}"),
+		},
+	}
+
+	expected := []string{"repo-1:tag-1", "repo-1:tag-2"}
+	actual, err := (&HelmReleaseScanner{}).ScanImages(kubeClient, []*string{&namespace})
+
+	if err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected result to be %+v, but was %+v", expected, actual)
+	}
+
+	// Releases that cannot be decoded must not be mistaken for releases
+	// without images
+	kubeClient.listHelmReleaseSecretsResult[1].Data[HelmReleaseSecretKey] = []byte("not base64!")
+	if _, err := (&HelmReleaseScanner{}).ScanImages(kubeClient, []*string{&namespace}); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+}
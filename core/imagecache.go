@@ -0,0 +1,75 @@
+package core
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// imageCache holds the images listed from each repository, so that they are
+// not described again in each pass. It is safe for concurrent use.
+type imageCache struct {
+	mutex   sync.Mutex
+	entries map[string]imageCacheEntry
+
+	// When all the entries were last dropped, as per the full resync
+	// interval.
+	lastFullResync time.Time
+}
+
+// imageCacheEntry is the list of images of a repository, and when it was
+// listed.
+type imageCacheEntry struct {
+	images   []*ecr.ImageDetail
+	listedAt time.Time
+}
+
+// get returns the cached images of the given repository, if they were listed
+// less than ttl before now, along with their age. All entries are dropped
+// first if fullResyncInterval has elapsed since they last were, unless it is
+// zero.
+func (c *imageCache) get(repositoryName string, ttl, fullResyncInterval time.Duration, now time.Time) ([]*ecr.ImageDetail, time.Duration, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.lastFullResync.IsZero() {
+		c.lastFullResync = now
+	}
+	if fullResyncInterval > 0 && now.Sub(c.lastFullResync) >= fullResyncInterval {
+		c.entries = nil
+		c.lastFullResync = now
+	}
+
+	entry, ok := c.entries[repositoryName]
+	if !ok || now.Sub(entry.listedAt) >= ttl {
+		return nil, 0, false
+	}
+
+	// Callers are free to modify the list they get
+	return append([]*ecr.ImageDetail{}, entry.images...), now.Sub(entry.listedAt), true
+}
+
+// put caches the given images of the given repository, listed at the given
+// time.
+func (c *imageCache) put(repositoryName string, images []*ecr.ImageDetail, listedAt time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.entries == nil {
+		c.entries = map[string]imageCacheEntry{}
+	}
+	c.entries[repositoryName] = imageCacheEntry{
+		images:   append([]*ecr.ImageDetail{}, images...),
+		listedAt: listedAt,
+	}
+}
+
+// invalidate drops the cached images of the given repository, whose images
+// changed.
+func (c *imageCache) invalidate(repositoryName string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.entries, repositoryName)
+}
@@ -0,0 +1,79 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+func TestImageCache(t *testing.T) {
+	start := time.Unix(0, 0)
+	images := []*ecr.ImageDetail{{ImageDigest: aws.String("digest-1")}}
+
+	cache := &imageCache{}
+	if _, _, ok := cache.get("repo-1", time.Hour, 0, start); ok {
+		t.Errorf("Expected no images in an empty cache")
+	}
+
+	cache.put("repo-1", images, start)
+
+	testCases := []struct {
+		repositoryName string
+		now            time.Time
+		expected       bool
+	}{
+		{"repo-1", start, true},
+		{"repo-1", start.Add(59 * time.Minute), true},
+		{"repo-1", start.Add(time.Hour), false},
+		{"repo-2", start, false},
+	}
+
+	for i, testCase := range testCases {
+		cached, age, ok := cache.get(testCase.repositoryName, time.Hour, 0, testCase.now)
+		if ok != testCase.expected {
+			t.Errorf("Test case %d: expected cached images to be found: %v, but got %v", i, testCase.expected, ok)
+			continue
+		}
+
+		if ok && (len(cached) != 1 || age != testCase.now.Sub(start)) {
+			t.Errorf("Test case %d: expected 1 image listed %v ago, but got %d images listed %v ago", i, testCase.now.Sub(start), len(cached), age)
+		}
+	}
+
+	// Callers modifying the list they get leave the cache untouched
+	cached, _, _ := cache.get("repo-1", time.Hour, 0, start)
+	cached[0] = nil
+	if cached, _, _ = cache.get("repo-1", time.Hour, 0, start); cached[0] == nil {
+		t.Errorf("Expected cached images not to be modified")
+	}
+
+	cache.invalidate("repo-1")
+	if _, _, ok := cache.get("repo-1", time.Hour, 0, start); ok {
+		t.Errorf("Expected invalidated images not to be found")
+	}
+}
+
+func TestImageCacheFullResync(t *testing.T) {
+	start := time.Unix(0, 0)
+	images := []*ecr.ImageDetail{{ImageDigest: aws.String("digest-1")}}
+
+	cache := &imageCache{}
+	cache.get("repo-1", 24*time.Hour, 2*time.Hour, start)
+
+	cache.put("repo-1", images, start.Add(90*time.Minute))
+	if _, _, ok := cache.get("repo-1", 24*time.Hour, 2*time.Hour, start.Add(100*time.Minute)); !ok {
+		t.Errorf("Expected images to be found before the full resync")
+	}
+
+	// All images are dropped, however recent, once the interval elapsed
+	if _, _, ok := cache.get("repo-1", 24*time.Hour, 2*time.Hour, start.Add(2*time.Hour)); ok {
+		t.Errorf("Expected images not to be found after the full resync")
+	}
+
+	cache.put("repo-1", images, start.Add(2*time.Hour))
+	if _, _, ok := cache.get("repo-1", 24*time.Hour, 2*time.Hour, start.Add(3*time.Hour)); !ok {
+		t.Errorf("Expected images listed after the full resync to be found")
+	}
+}
@@ -0,0 +1,583 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// ImageFilter is a step of the pipeline selecting the images to delete from a
+// repository. Filters either select further images for deletion, or retain
+// some of the images selected by the filters before them.
+type ImageFilter interface {
+	FilterImages(selection *ImageSelection) error
+}
+
+// ImageFilterFunc lets ordinary functions be used as image filters.
+type ImageFilterFunc func(selection *ImageSelection) error
+
+// FilterImages calls f(selection).
+func (f ImageFilterFunc) FilterImages(selection *ImageSelection) error {
+	return f(selection)
+}
+
+// ImageSelection holds the images selected for deletion from a repository so
+// far, as it goes through the image filters.
+type ImageSelection struct {
+	Client     ECRClient
+	Repository string
+
+	// All the images of the repository, and the tags and digests in use,
+	// including the protected tags.
+	Images    []*ecr.ImageDetail
+	TagsInUse []string
+
+	// Retention rules of the repository, as overridden by its cleanup policy
+	// or its tags, if any.
+	MaxImages   int
+	MaxImageAge time.Duration
+
+	// Digests of the images pulled recently, as recorded by CloudTrail.
+	RecentlyPulled map[string]bool
+
+	// Time the selection started, against which ages are measured.
+	Now time.Time
+
+	// Images selected for deletion, sorted by push date, along with the
+	// reason why, by digest, as given by the first filter selecting them.
+	Selected []*ecr.ImageDetail
+	Reasons  map[string]string
+
+	// Images not selected by the rules they fall under, and why. Retained
+	// images may still be selected by other filters.
+	Retained []RetainedImage
+
+	manifestCache map[string]string
+}
+
+// Select adds the given images to the selection for the given reason.
+func (s *ImageSelection) Select(images []*ecr.ImageDetail, reason string) {
+	addDeleteReasons(s.Reasons, images, reason)
+	s.Selected = MergeImages(s.Selected, images)
+}
+
+// Retain removes the given images from the selection, and records them as
+// retained for the given reason.
+func (s *ImageSelection) Retain(images []*ecr.ImageDetail, reason string) {
+	s.Selected = ExcludeImages(s.Selected, images)
+
+	for _, image := range images {
+		s.Retained = append(s.Retained, RetainedImage{Image: image, Reason: reason})
+	}
+}
+
+// filterCandidates runs the given filters on the given images, as if they
+// were the only ones selected, and returns the ones still selected after
+// them. The images the filters retain are recorded as retained.
+func (s *ImageSelection) filterCandidates(images []*ecr.ImageDetail, filters []ImageFilter) ([]*ecr.ImageDetail, error) {
+	if s.manifestCache == nil {
+		s.manifestCache = map[string]string{}
+	}
+
+	candidates := *s
+	candidates.Selected = images
+
+	for _, filter := range filters {
+		if err := filter.FilterImages(&candidates); err != nil {
+			return nil, err
+		}
+	}
+
+	s.Retained = candidates.Retained
+	return candidates.Selected, nil
+}
+
+// Manifests returns the manifests of the given images, which are only fetched
+// once per selection.
+func (s *ImageSelection) Manifests(images []*ecr.ImageDetail) (map[string]string, error) {
+	if s.manifestCache == nil {
+		s.manifestCache = map[string]string{}
+	}
+	return getImageManifests(s.Client, s.Repository, images, s.manifestCache)
+}
+
+// retainAnnotatedImages records as retained the given images whose manifests
+// carry the given annotation, and returns the other ones.
+func (s *ImageSelection) retainAnnotatedImages(images []*ecr.ImageDetail, key, value string) ([]*ecr.ImageDetail, error) {
+	if len(images) == 0 {
+		return images, nil
+	}
+
+	manifests, err := s.Manifests(images)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get image manifests: %v", err)
+	}
+
+	images, annotated := FilterAnnotatedImages(images, manifests, key, value)
+	s.Retain(annotated, RetainReasonAnnotation)
+
+	return images, nil
+}
+
+// DefaultImageFilters returns the image filters enforcing the retention rules
+// of the task, as per its current settings. Programs embedding the controller
+// can insert their own filters into the returned list, and set it as
+// `ImageFilters`, before the final `InUseFilter` so that the images they
+// select are never deleted while in use.
+func (t *CleanupTask) DefaultImageFilters() []ImageFilter {
+	filters := []ImageFilter{
+		&KeepCountFilter{
+			CountSince:   t.CountSince,
+			GroupOf:      t.keepMaxGroup(),
+			SkipUntagged: t.hasUntaggedPolicy(),
+			Reclaim:      t.ReclaimBytes > 0,
+		},
+	}
+
+	if t.hasUntaggedPolicy() {
+		filters = append(filters, &UntaggedFilter{KeepCount: t.UntaggedKeepCount, MaxAge: t.UntaggedMaxAge})
+	}
+	if t.DeleteUntaggedImages || t.MaxTagsPerImage > 0 {
+		filters = append(filters, &TagCountFilter{DeleteUntagged: t.DeleteUntaggedImages, MaxTags: t.MaxTagsPerImage})
+	}
+	if t.MinImageSizeBytes > 0 {
+		filters = append(filters, &SizeFilter{MinBytes: t.MinImageSizeBytes})
+	}
+
+	// The maximum age may be set by the rules of the repository alone
+	filters = append(filters, &AgeFilter{})
+
+	if t.DeleteCriticalFindings {
+		filters = append(filters, &CriticalFindingsFilter{})
+	}
+	if t.MaxRepositorySizeBytes > 0 {
+		filters = append(filters, &RepositorySizeFilter{MaxBytes: t.MaxRepositorySizeBytes})
+	}
+
+	retention := t.retentionImageFilters()
+	filters = append(filters, retention...)
+
+	// Annotated manifest lists must be filtered out before their children
+	// are protected, and the children left behind go through the same
+	// retention filters
+	if t.ProtectManifestListChildren || t.DeleteManifestListChildren {
+		filters = append(filters, &ManifestListFilter{
+			ProtectChildren:        t.ProtectManifestListChildren,
+			DeleteOrphanedChildren: t.DeleteManifestListChildren,
+			OrphanFilters:          retention,
+		})
+	}
+
+	return append(filters, &InUseFilter{})
+}
+
+// retentionImageFilters returns the image filters removing images from the
+// selection, as per the current settings of the task, which never select
+// images of their own.
+func (t *CleanupTask) retentionImageFilters() []ImageFilter {
+	filters := []ImageFilter{&RecentlyPulledFilter{}}
+
+	if t.MinDaysSinceLastPull > 0 {
+		filters = append(filters, &LastPullFilter{MinDays: t.MinDaysSinceLastPull})
+	}
+	if t.MinImageAge > 0 {
+		filters = append(filters, &MinAgeFilter{MinAge: t.MinImageAge})
+	}
+	if t.SkipScanPending {
+		filters = append(filters, &ScanPendingFilter{})
+	}
+	if t.ProtectImagesNewerThanInUse {
+		filters = append(filters, &NewerThanInUseFilter{})
+	}
+	if t.AlwaysKeepLatestTagged {
+		filters = append(filters, &LatestTaggedFilter{GroupOf: t.keepMaxGroup()})
+	}
+	if t.ProtectAnnotationKey != "" {
+		filters = append(filters, &AnnotationFilter{Key: t.ProtectAnnotationKey, Value: t.ProtectAnnotationValue})
+	}
+
+	return filters
+}
+
+// imageFilters returns `ImageFilters` if set, and the default filters
+// otherwise.
+func (t *CleanupTask) imageFilters() []ImageFilter {
+	if t.ImageFilters != nil {
+		return t.ImageFilters
+	}
+	return t.DefaultImageFilters()
+}
+
+// KeepCountFilter selects the unused images beyond the `MaxImages` most
+// recent ones of the repository, as per `ClassifyOldUnusedImages`.
+type KeepCountFilter struct {
+	// Images pushed longer ago than this take no part in the count, if not
+	// zero.
+	CountSince time.Duration
+
+	// If not nil, the images are kept per group, as per
+	// `ClassifyOldUnusedImagesByGroup`.
+	GroupOf func(*ecr.ImageDetail) string
+
+	// Whether untagged images take no part in the count, being left to the
+	// `UntaggedFilter`.
+	SkipUntagged bool
+
+	// Whether all unused images are selected, as candidates for reclaiming
+	// space.
+	Reclaim bool
+}
+
+// FilterImages selects the images exceeding the count.
+func (f *KeepCountFilter) FilterImages(selection *ImageSelection) error {
+	counted := selection.Images
+	if f.SkipUntagged {
+		counted, _ = SplitUntaggedImages(counted)
+	}
+
+	if f.CountSince > 0 {
+		windowImages := FilterImagesPushedSince(counted, selection.Now.Add(-f.CountSince))
+
+		for _, image := range ExcludeImages(counted, windowImages) {
+			selection.Retained = append(selection.Retained, RetainedImage{Image: image, Reason: RetainReasonAgeWindow})
+		}
+
+		counted = windowImages
+	}
+
+	keepMax, reason := selection.MaxImages, DeleteReasonKeepMax
+	if f.Reclaim {
+		keepMax, reason = 0, DeleteReasonReclaimBytes
+	}
+
+	var deletable []*ecr.ImageDetail
+	var retained []RetainedImage
+	if f.GroupOf != nil {
+		deletable, retained = ClassifyOldUnusedImagesByGroup(keepMax, counted, selection.TagsInUse, f.GroupOf)
+	} else {
+		deletable, retained = ClassifyOldUnusedImages(keepMax, counted, selection.TagsInUse)
+	}
+
+	selection.Retained = append(selection.Retained, retained...)
+	selection.Select(deletable, reason)
+
+	return nil
+}
+
+// UntaggedFilter selects the untagged images, as per
+// `ClassifyUntaggedImages`.
+type UntaggedFilter struct {
+	KeepCount int
+	MaxAge    time.Duration
+}
+
+// FilterImages selects the untagged images beyond the count or the age.
+func (f *UntaggedFilter) FilterImages(selection *ImageSelection) error {
+	_, untagged := SplitUntaggedImages(selection.Images)
+
+	deletable, retained := ClassifyUntaggedImages(f.KeepCount, f.MaxAge, selection.Now, untagged)
+	selection.Retained = append(selection.Retained, retained...)
+	selection.Select(deletable, DeleteReasonUntagged)
+
+	return nil
+}
+
+// TagCountFilter selects the unused images whose number of tags suggests they
+// were abandoned, as per `FilterImagesByTagCount`.
+type TagCountFilter struct {
+	DeleteUntagged bool
+	MaxTags        int
+}
+
+// FilterImages selects the images without tags or with too many tags.
+func (f *TagCountFilter) FilterImages(selection *ImageSelection) error {
+	selection.Select(FilterImagesByTagCount(f.DeleteUntagged, f.MaxTags, selection.Images, selection.TagsInUse), DeleteReasonTagCount)
+	return nil
+}
+
+// SizeFilter selects the unused images smaller than MinBytes, as per
+// `FilterImagesBySize`.
+type SizeFilter struct {
+	MinBytes int64
+}
+
+// FilterImages selects the images that are too small.
+func (f *SizeFilter) FilterImages(selection *ImageSelection) error {
+	selection.Select(FilterImagesBySize(f.MinBytes, selection.Images, selection.TagsInUse), DeleteReasonMinSize)
+	return nil
+}
+
+// AgeFilter selects the unused images pushed more than the `MaxImageAge` of
+// the repository ago, as per `FilterImagesByAge`.
+type AgeFilter struct{}
+
+// FilterImages selects the images that are too old.
+func (f *AgeFilter) FilterImages(selection *ImageSelection) error {
+	selection.Select(FilterImagesByAge(selection.MaxImageAge, selection.Now, selection.Images, selection.TagsInUse), DeleteReasonMaxAge)
+	return nil
+}
+
+// CriticalFindingsFilter selects the unused images with critical scan
+// findings, as per `FilterImagesWithCriticalFindings`.
+type CriticalFindingsFilter struct{}
+
+// FilterImages selects the vulnerable images.
+func (f *CriticalFindingsFilter) FilterImages(selection *ImageSelection) error {
+	selection.Select(FilterImagesWithCriticalFindings(selection.Images, selection.TagsInUse), DeleteReasonCriticalFindings)
+	return nil
+}
+
+// RepositorySizeFilter selects the oldest unused images needed to bring the
+// repository under MaxBytes, besides the images selected already, as per
+// `FilterImagesByRepositorySize`.
+type RepositorySizeFilter struct {
+	MaxBytes int64
+}
+
+// FilterImages selects the images exceeding the size of the repository.
+func (f *RepositorySizeFilter) FilterImages(selection *ImageSelection) error {
+	selection.Select(FilterImagesByRepositorySize(f.MaxBytes, selection.Images, selection.Selected, selection.TagsInUse), DeleteReasonRepositorySize)
+	return nil
+}
+
+// RecentlyPulledFilter removes the images pulled recently from the
+// selection, as per `FilterRecentlyPulledImages`.
+type RecentlyPulledFilter struct{}
+
+// FilterImages removes the recently pulled images.
+func (f *RecentlyPulledFilter) FilterImages(selection *ImageSelection) error {
+	selection.Selected = FilterRecentlyPulledImages(selection.Selected, selection.RecentlyPulled)
+	return nil
+}
+
+// LastPullFilter retains the images pulled within MinDays days, as recorded
+// by ECR, which includes pulls by consumers outside of the cluster, such as
+// CI jobs or Lambda functions.
+type LastPullFilter struct {
+	MinDays int
+}
+
+// FilterImages retains the images pulled lately.
+func (f *LastPullFilter) FilterImages(selection *ImageSelection) error {
+	selection.Retain(FilterImagesPulledSince(selection.Selected, selection.Now.AddDate(0, 0, -f.MinDays)), RetainReasonRecentlyPulled)
+	return nil
+}
+
+// MinAgeFilter retains the images pushed within MinAge.
+type MinAgeFilter struct {
+	MinAge time.Duration
+}
+
+// FilterImages retains the images that are too recent.
+func (f *MinAgeFilter) FilterImages(selection *ImageSelection) error {
+	selection.Retain(FilterImagesPushedSince(selection.Selected, selection.Now.Add(-f.MinAge)), RetainReasonMinAge)
+	return nil
+}
+
+// ScanPendingFilter retains the images whose scans are yet to complete, as
+// per `FilterScanPendingImages`.
+type ScanPendingFilter struct{}
+
+// FilterImages retains the images being scanned.
+func (f *ScanPendingFilter) FilterImages(selection *ImageSelection) error {
+	_, pending := FilterScanPendingImages(selection.Selected)
+	selection.Retain(pending, RetainReasonScanPending)
+	return nil
+}
+
+// NewerThanInUseFilter removes the images pushed after the newest image in
+// use from the selection, as per `FilterImagesNewerThanInUse`.
+type NewerThanInUseFilter struct{}
+
+// FilterImages removes the images newer than the ones in use.
+func (f *NewerThanInUseFilter) FilterImages(selection *ImageSelection) error {
+	selection.Selected = FilterImagesNewerThanInUse(selection.Selected, selection.Images, selection.TagsInUse)
+	return nil
+}
+
+// LatestTaggedFilter retains the most recent image of the repository carrying
+// any tag, so that there's always an image to roll back to, along with the
+// most recent tagged image of each group, if GroupOf is not nil.
+type LatestTaggedFilter struct {
+	// If not nil, the most recent tagged image of each group is retained as
+	// well, leaving out the images returning an empty group.
+	GroupOf func(*ecr.ImageDetail) string
+}
+
+// FilterImages retains the most recent tagged images.
+func (f *LatestTaggedFilter) FilterImages(selection *ImageSelection) error {
+	images := append([]*ecr.ImageDetail{}, selection.Images...)
+	SortImagesByPushDate(images)
+
+	latest := map[string]bool{}
+	groups := map[string]bool{}
+	for i := len(images) - 1; i >= 0; i-- {
+		image := images[i]
+		if len(image.ImageTags) == 0 {
+			continue
+		}
+
+		group := ""
+		if f.GroupOf != nil {
+			group = f.GroupOf(image)
+		}
+
+		if len(latest) == 0 || (group != "" && !groups[group]) {
+			latest[aws.StringValue(image.ImageDigest)] = true
+			groups[group] = true
+		}
+	}
+
+	retained := []*ecr.ImageDetail{}
+	for _, image := range selection.Selected {
+		if latest[aws.StringValue(image.ImageDigest)] {
+			retained = append(retained, image)
+		}
+	}
+
+	selection.Retain(retained, RetainReasonLatestTagged)
+	return nil
+}
+
+// AnnotationFilter retains the images whose manifests carry the Key
+// annotation, with the given Value if not empty, as per
+// `FilterAnnotatedImages`.
+type AnnotationFilter struct {
+	Key   string
+	Value string
+}
+
+// FilterImages retains the annotated images.
+func (f *AnnotationFilter) FilterImages(selection *ImageSelection) error {
+	selected, err := selection.retainAnnotatedImages(selection.Selected, f.Key, f.Value)
+	if err != nil {
+		return err
+	}
+
+	selection.Selected = selected
+	return nil
+}
+
+// ManifestListFilter deals with the images referenced by manifest lists, as
+// per `FilterManifestListChildren` and `OrphanedManifestListChildren`.
+type ManifestListFilter struct {
+	// Whether the children of the manifest lists that are not deleted are
+	// removed from the selection.
+	ProtectChildren bool
+
+	// Whether the children left behind by the manifest lists deleted are
+	// selected, unless any of OrphanFilters removes them from the selection.
+	// The children go through these filters of their own, since they were
+	// not selected yet when the filters ran, so they should be the filters
+	// removing images from the selection, such as the `LastPullFilter`.
+	DeleteOrphanedChildren bool
+	OrphanFilters          []ImageFilter
+}
+
+// FilterImages protects or selects the children of the manifest lists.
+func (f *ManifestListFilter) FilterImages(selection *ImageSelection) error {
+	if len(selection.Selected) == 0 {
+		return nil
+	}
+
+	children, err := selection.Client.ListManifestListChildren(&selection.Repository, selection.Images)
+	if err != nil {
+		return fmt.Errorf("Cannot resolve manifest lists: %v", err)
+	}
+
+	if f.ProtectChildren {
+		selection.Selected = FilterManifestListChildren(selection.Selected, children)
+	}
+
+	if f.DeleteOrphanedChildren {
+		orphaned := OrphanedManifestListChildren(selection.Images, selection.Selected, children, selection.TagsInUse)
+		if len(orphaned) == 0 {
+			return nil
+		}
+
+		orphaned, err = selection.filterCandidates(orphaned, f.OrphanFilters)
+		if err != nil {
+			return err
+		}
+
+		selection.Select(orphaned, DeleteReasonManifestListChild)
+	}
+
+	return nil
+}
+
+// TagRegexFilter retains the images with a tag matching any of Patterns.
+// Unlike `KeepTagPatterns`, the images retained still count against
+// `MaxImages` as unused images, so the filter is meant for rules that only
+// apply to some repositories.
+type TagRegexFilter struct {
+	Patterns []*regexp.Regexp
+}
+
+// FilterImages retains the images with matching tags.
+func (f *TagRegexFilter) FilterImages(selection *ImageSelection) error {
+	matching := []*ecr.ImageDetail{}
+	for _, image := range selection.Selected {
+		if len(TagsMatchingPatterns([]*ecr.ImageDetail{image}, f.Patterns)) > 0 {
+			matching = append(matching, image)
+		}
+	}
+
+	selection.Retain(matching, RetainReasonProtectedTag)
+	return nil
+}
+
+// InUseFilter retains the images that are in use or tagged `latest`, which
+// the built-in filters never select, so that images selected by the filters
+// before it, such as the ones of programs embedding the controller, are never
+// deleted while in use.
+type InUseFilter struct{}
+
+// FilterImages retains the images in use.
+func (f *InUseFilter) FilterImages(selection *ImageSelection) error {
+	latest := []*ecr.ImageDetail{}
+	inUse := []*ecr.ImageDetail{}
+	for _, image := range selection.Selected {
+		switch {
+		case isImageInUse(image, selection.TagsInUse):
+			inUse = append(inUse, image)
+		case isTaggedLatest(image):
+			latest = append(latest, image)
+		}
+	}
+
+	selection.Retain(inUse, RetainReasonInUse)
+	selection.Retain(latest, RetainReasonProtectedTag)
+
+	return nil
+}
+
+// runImageFilters runs the given filters on the given selection, in order,
+// and returns the images selected by the last of them, along with the images
+// retained, leaving out the ones that ended up selected anyway.
+func runImageFilters(filters []ImageFilter, selection *ImageSelection) ([]*ecr.ImageDetail, []RetainedImage, error) {
+	for _, filter := range filters {
+		if err := filter.FilterImages(selection); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Images retained by the `MaxImages` rule might still be deleted by
+	// the other rules
+	deleted := map[string]bool{}
+	for _, image := range selection.Selected {
+		deleted[aws.StringValue(image.ImageDigest)] = true
+	}
+
+	stillRetained := []RetainedImage{}
+	for _, image := range selection.Retained {
+		if !deleted[aws.StringValue(image.Image.ImageDigest)] {
+			stillRetained = append(stillRetained, image)
+		}
+	}
+
+	return selection.Selected, stillRetained, nil
+}
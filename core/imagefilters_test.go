@@ -0,0 +1,300 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// filterTypes returns the types of the given filters, in order.
+func filterTypes(filters []ImageFilter) []string {
+	types := []string{}
+	for _, filter := range filters {
+		types = append(types, reflect.TypeOf(filter).Elem().Name())
+	}
+	return types
+}
+
+func TestDefaultImageFilters(t *testing.T) {
+	testCases := []struct {
+		task     *CleanupTask
+		expected []string
+	}{
+		{
+			task:     &CleanupTask{MaxImages: 10},
+			expected: []string{"KeepCountFilter", "AgeFilter", "RecentlyPulledFilter", "InUseFilter"},
+		},
+		{
+			task: &CleanupTask{
+				MaxImages:              10,
+				UntaggedKeepCount:      2,
+				MaxTagsPerImage:        5,
+				MinImageSizeBytes:      1,
+				DeleteCriticalFindings: true,
+				MaxRepositorySizeBytes: 1,
+				MinDaysSinceLastPull:   7,
+				MinImageAge:            time.Hour,
+				SkipScanPending:        true,
+
+				ProtectImagesNewerThanInUse: true,
+				AlwaysKeepLatestTagged:      true,
+				ProtectAnnotationKey:        "keep",
+				ProtectManifestListChildren: true,
+			},
+			expected: []string{
+				"KeepCountFilter",
+				"UntaggedFilter",
+				"TagCountFilter",
+				"SizeFilter",
+				"AgeFilter",
+				"CriticalFindingsFilter",
+				"RepositorySizeFilter",
+				"RecentlyPulledFilter",
+				"LastPullFilter",
+				"MinAgeFilter",
+				"ScanPendingFilter",
+				"NewerThanInUseFilter",
+				"LatestTaggedFilter",
+				"AnnotationFilter",
+				"ManifestListFilter",
+				"InUseFilter",
+			},
+		},
+	}
+
+	for i, testCase := range testCases {
+		if types := filterTypes(testCase.task.DefaultImageFilters()); !reflect.DeepEqual(types, testCase.expected) {
+			t.Errorf("Test case %d: expected filters %v, but got %v", i, testCase.expected, types)
+		}
+	}
+
+	// Filters set by embedding programs replace the default ones
+	task := &CleanupTask{ImageFilters: []ImageFilter{&AgeFilter{}}}
+	if types := filterTypes(task.imageFilters()); !reflect.DeepEqual(types, []string{"AgeFilter"}) {
+		t.Errorf("Expected the filters of the task, but got %v", types)
+	}
+}
+
+func TestImageSelectionSelectAndRetain(t *testing.T) {
+	images := []*ecr.ImageDetail{}
+	for i := 0; i < 3; i++ {
+		images = append(images, &ecr.ImageDetail{
+			ImageDigest:   aws.String(fmt.Sprintf("digest-%d", i)),
+			ImagePushedAt: aws.Time(time.Unix(int64(i), 0)),
+		})
+	}
+
+	selection := &ImageSelection{Selected: []*ecr.ImageDetail{}, Reasons: map[string]string{}}
+
+	// Images are selected once, for the first reason given
+	selection.Select([]*ecr.ImageDetail{images[2], images[0]}, DeleteReasonKeepMax)
+	selection.Select([]*ecr.ImageDetail{images[1], images[2]}, DeleteReasonMaxAge)
+
+	if digests := imageDigests(selection.Selected); !reflect.DeepEqual(digests, []string{"digest-0", "digest-1", "digest-2"}) {
+		t.Errorf("Expected images to be selected by push date, but got %v", digests)
+	}
+
+	expectedReasons := map[string]string{
+		"digest-0": DeleteReasonKeepMax,
+		"digest-1": DeleteReasonMaxAge,
+		"digest-2": DeleteReasonKeepMax,
+	}
+	if !reflect.DeepEqual(selection.Reasons, expectedReasons) {
+		t.Errorf("Expected reasons %v, but got %v", expectedReasons, selection.Reasons)
+	}
+
+	selection.Retain([]*ecr.ImageDetail{images[1]}, RetainReasonMinAge)
+
+	if digests := imageDigests(selection.Selected); !reflect.DeepEqual(digests, []string{"digest-0", "digest-2"}) {
+		t.Errorf("Expected retained image to be unselected, but got %v", digests)
+	}
+	if expected := []RetainedImage{{Image: images[1], Reason: RetainReasonMinAge}}; !reflect.DeepEqual(selection.Retained, expected) {
+		t.Errorf("Expected retained images %v, but got %v", expected, selection.Retained)
+	}
+}
+
+func TestInUseFilter(t *testing.T) {
+	images := []*ecr.ImageDetail{
+		{ImageDigest: aws.String("digest-0"), ImageTags: []*string{aws.String("v1")}},
+		{ImageDigest: aws.String("digest-1"), ImageTags: []*string{aws.String("latest")}},
+		{ImageDigest: aws.String("digest-2")},
+		{ImageDigest: aws.String("digest-3"), ImageTags: []*string{aws.String("v2")}},
+	}
+
+	selection := &ImageSelection{
+		Images:    images,
+		TagsInUse: []string{"v1", "digest-2"},
+		Selected:  images,
+		Reasons:   map[string]string{},
+	}
+
+	if err := (&InUseFilter{}).FilterImages(selection); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	if digests := imageDigests(selection.Selected); !reflect.DeepEqual(digests, []string{"digest-3"}) {
+		t.Errorf("Expected only unused images to be selected, but got %v", digests)
+	}
+
+	expected := []RetainedImage{
+		{Image: images[0], Reason: RetainReasonInUse},
+		{Image: images[2], Reason: RetainReasonInUse},
+		{Image: images[1], Reason: RetainReasonProtectedTag},
+	}
+	if !reflect.DeepEqual(selection.Retained, expected) {
+		t.Errorf("Expected retained images %v, but got %v", expected, selection.Retained)
+	}
+}
+
+func TestLatestTaggedFilter(t *testing.T) {
+	images := []*ecr.ImageDetail{
+		{ImageDigest: aws.String("digest-0"), ImageTags: []*string{aws.String("main-1")}, ImagePushedAt: aws.Time(time.Unix(0, 0))},
+		{ImageDigest: aws.String("digest-1"), ImageTags: []*string{aws.String("develop-1")}, ImagePushedAt: aws.Time(time.Unix(1, 0))},
+		{ImageDigest: aws.String("digest-2"), ImageTags: []*string{aws.String("main-2")}, ImagePushedAt: aws.Time(time.Unix(2, 0))},
+		{ImageDigest: aws.String("digest-3"), ImagePushedAt: aws.Time(time.Unix(3, 0))},
+	}
+
+	testCases := []struct {
+		filter   *LatestTaggedFilter
+		expected []string
+	}{
+		// Untagged images are never the latest tagged one
+		{
+			filter:   &LatestTaggedFilter{},
+			expected: []string{"digest-0", "digest-1", "digest-3"},
+		},
+		{
+			filter: &LatestTaggedFilter{GroupOf: func(image *ecr.ImageDetail) string {
+				return TagGroup(image, regexp.MustCompile(`^(.+)-[0-9]+$`))
+			}},
+			expected: []string{"digest-0", "digest-3"},
+		},
+	}
+
+	for i, testCase := range testCases {
+		selection := &ImageSelection{Images: images, Selected: images, Reasons: map[string]string{}}
+
+		if err := testCase.filter.FilterImages(selection); err != nil {
+			t.Fatalf("Test case %d: expected no error, but got %v", i, err)
+		}
+
+		if digests := imageDigests(selection.Selected); !reflect.DeepEqual(digests, testCase.expected) {
+			t.Errorf("Test case %d: expected images %v to be selected, but got %v", i, testCase.expected, digests)
+		}
+		for _, retained := range selection.Retained {
+			if retained.Reason != RetainReasonLatestTagged {
+				t.Errorf("Test case %d: expected images to be retained as the latest tagged ones, but got %s", i, retained.Reason)
+			}
+		}
+	}
+}
+
+func TestManifestListFilterOrphanedChildren(t *testing.T) {
+	now := time.Now()
+	list := &ecr.ImageDetail{ImageDigest: aws.String("list-digest"), ImagePushedAt: aws.Time(now.AddDate(0, 0, -31))}
+	pulledChild := &ecr.ImageDetail{ImageDigest: aws.String("child-digest-0"), ImagePushedAt: aws.Time(now.AddDate(0, 0, -30)), LastRecordedPullTime: aws.Time(now.AddDate(0, 0, -1))}
+	staleChild := &ecr.ImageDetail{ImageDigest: aws.String("child-digest-1"), ImagePushedAt: aws.Time(now.AddDate(0, 0, -30)), LastRecordedPullTime: aws.Time(now.AddDate(0, 0, -20))}
+
+	selection := &ImageSelection{
+		Client: &mockECRClient{
+			t: t,
+
+			expectedImagesRepositoryName: "repo",
+			listManifestListChildrenResult: map[string][]string{
+				"list-digest": {"child-digest-0", "child-digest-1"},
+			},
+		},
+		Repository: "repo",
+		Images:     []*ecr.ImageDetail{list, pulledChild, staleChild},
+		Now:        now,
+		Selected:   []*ecr.ImageDetail{list},
+		Reasons:    map[string]string{},
+		Retained:   []RetainedImage{},
+	}
+
+	filter := &ManifestListFilter{
+		DeleteOrphanedChildren: true,
+		OrphanFilters:          []ImageFilter{&RecentlyPulledFilter{}, &LastPullFilter{MinDays: 7}},
+	}
+	if err := filter.FilterImages(selection); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	// The child pulled recently survives the deletion of its manifest list
+	if digests := imageDigests(selection.Selected); !reflect.DeepEqual(digests, []string{"list-digest", "child-digest-1"}) {
+		t.Errorf("Expected the manifest list and its stale child to be selected, but got %v", digests)
+	}
+	if expected := []RetainedImage{{Image: pulledChild, Reason: RetainReasonRecentlyPulled}}; !reflect.DeepEqual(selection.Retained, expected) {
+		t.Errorf("Expected retained images %v, but got %v", expected, selection.Retained)
+	}
+	if reason := selection.Reasons["child-digest-1"]; reason != DeleteReasonManifestListChild {
+		t.Errorf("Expected the stale child to be selected as '%s', but got '%s'", DeleteReasonManifestListChild, reason)
+	}
+}
+
+func TestTagRegexFilter(t *testing.T) {
+	images := []*ecr.ImageDetail{
+		{ImageDigest: aws.String("digest-0"), ImageTags: []*string{aws.String("release-1.0")}},
+		{ImageDigest: aws.String("digest-1"), ImageTags: []*string{aws.String("main-0123abc")}},
+		{ImageDigest: aws.String("digest-2")},
+	}
+
+	selection := &ImageSelection{Images: images, Selected: images, Reasons: map[string]string{}}
+	filter := &TagRegexFilter{Patterns: []*regexp.Regexp{regexp.MustCompile(`^release-`)}}
+
+	if err := filter.FilterImages(selection); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	if digests := imageDigests(selection.Selected); !reflect.DeepEqual(digests, []string{"digest-1", "digest-2"}) {
+		t.Errorf("Expected images with matching tags to be unselected, but got %v", digests)
+	}
+	if expected := []RetainedImage{{Image: images[0], Reason: RetainReasonProtectedTag}}; !reflect.DeepEqual(selection.Retained, expected) {
+		t.Errorf("Expected retained images %v, but got %v", expected, selection.Retained)
+	}
+}
+
+func TestRunImageFilters(t *testing.T) {
+	images := []*ecr.ImageDetail{
+		{ImageDigest: aws.String("digest-0"), ImagePushedAt: aws.Time(time.Now().Add(-72 * time.Hour))},
+		{ImageDigest: aws.String("digest-1"), ImagePushedAt: aws.Time(time.Now().Add(-48 * time.Hour))},
+		{ImageDigest: aws.String("digest-2"), ImagePushedAt: aws.Time(time.Now().Add(-time.Hour))},
+	}
+
+	newSelection := func() *ImageSelection {
+		return &ImageSelection{
+			Images:      images,
+			MaxImages:   2,
+			MaxImageAge: 24 * time.Hour,
+			Now:         time.Now(),
+			Selected:    []*ecr.ImageDetail{},
+			Reasons:     map[string]string{},
+			Retained:    []RetainedImage{},
+		}
+	}
+
+	// Images kept by `MaxImages` but deleted for their age are not retained
+	selected, retained, err := runImageFilters([]ImageFilter{&KeepCountFilter{}, &AgeFilter{}}, newSelection())
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	if digests := imageDigests(selected); !reflect.DeepEqual(digests, []string{"digest-0", "digest-1"}) {
+		t.Errorf("Expected the old images to be selected, but got %v", digests)
+	}
+	if expected := []RetainedImage{{Image: images[2], Reason: RetainReasonKeepMax}}; !reflect.DeepEqual(retained, expected) {
+		t.Errorf("Expected retained images %v, but got %v", expected, retained)
+	}
+
+	failing := ImageFilterFunc(func(selection *ImageSelection) error {
+		return fmt.Errorf("Release database unavailable")
+	})
+	if _, _, err := runImageFilters([]ImageFilter{&KeepCountFilter{}, failing}, newSelection()); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// NamespaceKeepCountAnnotation is the namespace annotation giving the number
+// of images to keep in the repositories whose images the pods of the
+// namespace use, when `UseNamespaceKeepCounts` is set.
+const NamespaceKeepCountAnnotation = "ecr-cleanup/keep-count"
+
+// NamespaceAnnotationsClient defines the expected interface of any object
+// capable of listing the annotations of Kubernetes namespaces.
+type NamespaceAnnotationsClient interface {
+	ListNamespaceAnnotations(key string) (map[string]string, error)
+}
+
+// ListNamespaceAnnotations returns the value of the annotation with the given
+// key of each namespace carrying it, by namespace name.
+func (c *KubernetesClientImpl) ListNamespaceAnnotations(key string) (map[string]string, error) {
+	namespaceList, err := c.clientset.Core().Namespaces().List(v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	annotations := map[string]string{}
+	for _, namespace := range namespaceList.Items {
+		if value, ok := namespace.Annotations[key]; ok {
+			annotations[namespace.Name] = value
+		}
+	}
+
+	return annotations, nil
+}
+
+// ListNamespaceAnnotations returns the value of the annotation with the given
+// key of each namespace carrying it in the cluster of the embedded client,
+// which applies to the namespaces of the same name in the remote clusters.
+func (c *MultiKubernetesClient) ListNamespaceAnnotations(key string) (map[string]string, error) {
+	annotationsClient, ok := c.KubernetesClient.(NamespaceAnnotationsClient)
+	if !ok {
+		return nil, fmt.Errorf("Kubernetes client cannot list namespace annotations")
+	}
+
+	return annotationsClient.ListNamespaceAnnotations(key)
+}
+
+// ParseNamespaceKeepCounts parses the given values of the
+// `NamespaceKeepCountAnnotation` annotation, by namespace name, which must be
+// positive numbers. The namespaces whose values are invalid are left out, and
+// an error is returned for each of them.
+func ParseNamespaceKeepCounts(annotations map[string]string) (map[string]int, []error) {
+	keepCounts := map[string]int{}
+	errs := []error{}
+
+	for namespace, value := range annotations {
+		keepCount, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || keepCount < 1 {
+			errs = append(errs, fmt.Errorf("Invalid '%s' annotation of '%s' namespace, must be a positive number: '%s'", NamespaceKeepCountAnnotation, namespace, value))
+			continue
+		}
+		keepCounts[namespace] = keepCount
+	}
+
+	return keepCounts, errs
+}
+
+// RepositoryKeepCounts returns the highest of the given keep counts of the
+// namespaces whose pods use images hosted in the given registry, by
+// repository name, as per `ECRImagesFromReferences`.
+func RepositoryKeepCounts(pods []*v1.Pod, keepCounts map[string]int, registryHost string, registryAliases map[string]string) map[string]int {
+	repoKeepCounts := map[string]int{}
+
+	for _, pod := range pods {
+		keepCount := keepCounts[pod.Namespace]
+		if keepCount == 0 {
+			continue
+		}
+
+		for repoName := range ECRImagesFromReferences(ImageReferencesFromPods([]*v1.Pod{pod}), registryHost, registryAliases) {
+			if keepCount > repoKeepCounts[repoName] {
+				repoKeepCounts[repoName] = keepCount
+			}
+		}
+	}
+
+	return repoKeepCounts
+}
+
+// namespaceKeepCounts returns the keep counts given by the
+// `NamespaceKeepCountAnnotation` annotation of the namespaces of the cluster,
+// by namespace name, logging the invalid ones, which are left out.
+func (t *CleanupTask) namespaceKeepCounts(kubeClient KubernetesClient) (map[string]int, error) {
+	annotationsClient, ok := kubeClient.(NamespaceAnnotationsClient)
+	if !ok {
+		return nil, fmt.Errorf("Kubernetes client cannot list namespace annotations")
+	}
+
+	annotations, err := annotationsClient.ListNamespaceAnnotations(NamespaceKeepCountAnnotation)
+	if err != nil {
+		return nil, err
+	}
+
+	keepCounts, errs := ParseNamespaceKeepCounts(annotations)
+	for _, err := range errs {
+		t.log().Warningf("%v, ignoring it.", err)
+	}
+
+	return keepCounts, nil
+}
@@ -0,0 +1,96 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// mockNamespaceAnnotationsKubeClient returns the given annotations of the
+// namespaces.
+type mockNamespaceAnnotationsKubeClient struct {
+	KubernetesClient
+
+	annotations map[string]string
+	outputError error
+}
+
+func (m *mockNamespaceAnnotationsKubeClient) ListNamespaceAnnotations(key string) (map[string]string, error) {
+	if key != NamespaceKeepCountAnnotation {
+		return nil, fmt.Errorf("Unexpected annotation '%s'", key)
+	}
+	return m.annotations, m.outputError
+}
+
+// podInNamespace returns a pod of the given namespace running the given
+// images.
+func podInNamespace(namespace string, images ...string) *v1.Pod {
+	pod := &v1.Pod{ObjectMeta: v1.ObjectMeta{Namespace: namespace}}
+	for _, image := range images {
+		pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{Image: image})
+	}
+	return pod
+}
+
+func TestParseNamespaceKeepCounts(t *testing.T) {
+	keepCounts, errs := ParseNamespaceKeepCounts(map[string]string{
+		"prod":    "30",
+		"staging": " 10 ",
+		"dev":     "0",
+		"qa":      "many",
+	})
+
+	expected := map[string]int{"prod": 30, "staging": 10}
+	if !reflect.DeepEqual(keepCounts, expected) {
+		t.Errorf("Expected keep counts %v, but got %v", expected, keepCounts)
+	}
+
+	if len(errs) != 2 {
+		t.Errorf("Expected 2 errors, but got %v", errs)
+	}
+}
+
+func TestRepositoryKeepCounts(t *testing.T) {
+	pods := []*v1.Pod{
+		podInNamespace("prod", "id.dkr.ecr.region.amazonaws.com/repo-1:v1"),
+		podInNamespace("dev", "id.dkr.ecr.region.amazonaws.com/repo-1:v2", "id.dkr.ecr.region.amazonaws.com/repo-2:v1"),
+		podInNamespace("other", "id.dkr.ecr.region.amazonaws.com/repo-3:v1"),
+		podInNamespace("prod", "other.dkr.ecr.region.amazonaws.com/repo-4:v1"),
+	}
+	keepCounts := map[string]int{"prod": 30, "dev": 5}
+
+	// The strictest keep count wins, and other registries are left out
+	expected := map[string]int{"repo-1": 30, "repo-2": 5}
+	if repoKeepCounts := RepositoryKeepCounts(pods, keepCounts, "id.dkr.ecr.region.amazonaws.com", nil); !reflect.DeepEqual(repoKeepCounts, expected) {
+		t.Errorf("Expected keep counts %v, but got %v", expected, repoKeepCounts)
+	}
+
+	if repoKeepCounts := RepositoryKeepCounts(pods, nil, "id.dkr.ecr.region.amazonaws.com", nil); len(repoKeepCounts) != 0 {
+		t.Errorf("Expected no keep counts, but got %v", repoKeepCounts)
+	}
+}
+
+func TestNamespaceKeepCounts(t *testing.T) {
+	task := &CleanupTask{}
+
+	keepCounts, err := task.namespaceKeepCounts(&mockNamespaceAnnotationsKubeClient{
+		annotations: map[string]string{"prod": "30", "dev": "-1"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if !reflect.DeepEqual(keepCounts, map[string]int{"prod": 30}) {
+		t.Errorf("Expected only the valid keep counts, but got %v", keepCounts)
+	}
+
+	if _, err := task.namespaceKeepCounts(&mockNamespaceAnnotationsKubeClient{outputError: fmt.Errorf("Forbidden")}); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+
+	// Clients that cannot list annotations fail the pass
+	if _, err := task.namespaceKeepCounts(&mockKubeClient{}); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+}
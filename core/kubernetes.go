@@ -1,18 +1,49 @@
 package core
 
 import (
-	"regexp"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
 
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/errors"
 	"k8s.io/client-go/pkg/api/v1"
+	batchv1 "k8s.io/client-go/pkg/apis/batch/v1"
+	batchv2alpha1 "k8s.io/client-go/pkg/apis/batch/v2alpha1"
+	extensionsv1beta1 "k8s.io/client-go/pkg/apis/extensions/v1beta1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+// PinnedImagesAnnotation is the node annotation listing additional image
+// references, separated by commas or whitespace, that must be considered in
+// use.
+const PinnedImagesAnnotation = "ecr-cleanup/pinned-images"
+
+// ServiceAccountNamespacePath is the path of the file holding the namespace
+// of the pod the controller runs in, when running inside a Kubernetes cluster.
+const ServiceAccountNamespacePath = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
 // KubernetesClient defines the expected interface of any object capable of
-// listing pods from a Kubernetes cluster.
+// listing pods and nodes from a Kubernetes cluster.
 type KubernetesClient interface {
 	ListAllPods(namespace []*string) ([]*v1.Pod, error)
+	ListEphemeralContainerImages(namespace []*string) ([]string, error)
+	ListJobs(namespace []*string) ([]*batchv1.Job, error)
+	ListCronJobs(namespace []*string) ([]*batchv2alpha1.CronJob, error)
+	ListReplicaSets(namespace []*string) ([]*extensionsv1beta1.ReplicaSet, error)
+	ListControllerRevisionImages(namespace []*string) ([]string, error)
+	ListCustomWorkloadImages(workload CustomWorkload, namespace []*string) ([]string, error)
+	ListHelmReleaseSecrets(namespace []*string) ([]*v1.Secret, error)
+	ListNodes() ([]*v1.Node, error)
+	GetConfigMap(namespace, name string) (*v1.ConfigMap, error)
+	NamespaceExists(name string) (bool, error)
+	ListNamespaces() ([]string, error)
+	ListCleanupPolicies() ([]*CleanupPolicy, error)
 }
 
 type KubernetesClientImpl struct {
@@ -37,6 +68,26 @@ func NewKubernetesClient(kubeconfig string) (*KubernetesClientImpl, error) {
 		return nil, err
 	}
 
+	return newKubernetesClientForConfig(config)
+}
+
+// NewRemoteKubernetesClient returns a client capable of talking to the API
+// server of the given remote cluster.
+func NewRemoteKubernetesClient(cluster RemoteCluster) (*KubernetesClientImpl, error) {
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: cluster.Kubeconfig},
+		&clientcmd.ConfigOverrides{CurrentContext: cluster.Context},
+	).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return newKubernetesClientForConfig(config)
+}
+
+// newKubernetesClientForConfig returns a client capable of talking to the API
+// server given by the given config.
+func newKubernetesClientForConfig(config *rest.Config) (*KubernetesClientImpl, error) {
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return nil, err
@@ -66,45 +117,602 @@ func (c *KubernetesClientImpl) ListAllPods(namespace []*string) ([]*v1.Pod, erro
 	return pods, nil
 }
 
+// ListEphemeralContainerImages returns the image references used by the
+// ephemeral containers of the pods from the given namespaces. These are
+// decoded from the raw pod list, since the pod type of this client predates
+// ephemeral containers.
+func (c *KubernetesClientImpl) ListEphemeralContainerImages(namespace []*string) ([]string, error) {
+	images := []string{}
+
+	for _, ns := range namespace {
+		data, err := c.clientset.Core().RESTClient().Get().AbsPath("/api/v1/namespaces", *ns, "pods").DoRaw()
+		if err != nil {
+			return nil, err
+		}
+
+		nsImages, err := EphemeralContainerImagesFromPodList(data)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, nsImages...)
+	}
+
+	return images, nil
+}
+
+// EphemeralContainerImagesFromPodList returns the image references used by the
+// ephemeral containers of the pods in the given JSON pod list, as returned by
+// the API server.
+func EphemeralContainerImagesFromPodList(data []byte) ([]string, error) {
+	list := struct {
+		Items []struct {
+			Spec struct {
+				EphemeralContainers []struct {
+					Image string `json:"image"`
+				} `json:"ephemeralContainers"`
+			} `json:"spec"`
+		} `json:"items"`
+	}{}
+
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("Cannot parse pod list: %v", err)
+	}
+
+	images := []string{}
+	for _, pod := range list.Items {
+		for _, container := range pod.Spec.EphemeralContainers {
+			images = append(images, container.Image)
+		}
+	}
+
+	return images, nil
+}
+
+// ListJobs returns all jobs from the given namespaces.
+func (c *KubernetesClientImpl) ListJobs(namespace []*string) ([]*batchv1.Job, error) {
+	opts := v1.ListOptions{}
+	jobs := []*batchv1.Job{}
+
+	for _, ns := range namespace {
+		jobList, err := c.clientset.Batch().Jobs(*ns).List(opts)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range jobList.Items {
+			jobs = append(jobs, &jobList.Items[i])
+		}
+	}
+
+	return jobs, nil
+}
+
+// ListCronJobs returns all cron jobs from the given namespaces, including the
+// suspended ones. These are listed through the batch/v1 API, since the
+// batch/v2alpha1 one this client knows of was never served by default, and
+// Kubernetes 1.21 removed it.
+func (c *KubernetesClientImpl) ListCronJobs(namespace []*string) ([]*batchv2alpha1.CronJob, error) {
+	cronJobs := []*batchv2alpha1.CronJob{}
+
+	for _, ns := range namespace {
+		data, err := c.clientset.Core().RESTClient().Get().AbsPath("/apis/batch/v1/namespaces", *ns, "cronjobs").DoRaw()
+		if err != nil {
+			return nil, err
+		}
+
+		nsCronJobs, err := CronJobsFromList(data)
+		if err != nil {
+			return nil, err
+		}
+		cronJobs = append(cronJobs, nsCronJobs...)
+	}
+
+	return cronJobs, nil
+}
+
+// CronJobsFromList returns the cron jobs of the given JSON batch/v1 cron job
+// list, as returned by the API server, whose fields are the same as the
+// batch/v2alpha1 ones.
+func CronJobsFromList(data []byte) ([]*batchv2alpha1.CronJob, error) {
+	list := &batchv2alpha1.CronJobList{}
+	if err := json.Unmarshal(data, list); err != nil {
+		return nil, fmt.Errorf("Cannot parse cron job list: %v", err)
+	}
+
+	cronJobs := []*batchv2alpha1.CronJob{}
+	for i := range list.Items {
+		cronJobs = append(cronJobs, &list.Items[i])
+	}
+
+	return cronJobs, nil
+}
+
+// ListReplicaSets returns all replica sets from the given namespaces,
+// including the ones scaled down to zero, which deployments keep around to be
+// able to roll back. These are listed through the apps/v1 API, since
+// Kubernetes 1.16 stopped serving the extensions/v1beta1 one this client
+// knows of.
+func (c *KubernetesClientImpl) ListReplicaSets(namespace []*string) ([]*extensionsv1beta1.ReplicaSet, error) {
+	replicaSets := []*extensionsv1beta1.ReplicaSet{}
+
+	for _, ns := range namespace {
+		data, err := c.clientset.Core().RESTClient().Get().AbsPath("/apis/apps/v1/namespaces", *ns, "replicasets").DoRaw()
+		if err != nil {
+			return nil, err
+		}
+
+		nsReplicaSets, err := ReplicaSetsFromList(data)
+		if err != nil {
+			return nil, err
+		}
+		replicaSets = append(replicaSets, nsReplicaSets...)
+	}
+
+	return replicaSets, nil
+}
+
+// ReplicaSetsFromList returns the replica sets of the given JSON apps/v1
+// replica set list, as returned by the API server, whose fields are the same
+// as the extensions/v1beta1 ones.
+func ReplicaSetsFromList(data []byte) ([]*extensionsv1beta1.ReplicaSet, error) {
+	list := &extensionsv1beta1.ReplicaSetList{}
+	if err := json.Unmarshal(data, list); err != nil {
+		return nil, fmt.Errorf("Cannot parse replica set list: %v", err)
+	}
+
+	replicaSets := []*extensionsv1beta1.ReplicaSet{}
+	for i := range list.Items {
+		replicaSets = append(replicaSets, &list.Items[i])
+	}
+
+	return replicaSets, nil
+}
+
+// ListControllerRevisionImages returns the image references used by the pod
+// templates recorded in the controller revisions from the given namespaces,
+// which stateful sets keep around to be able to roll back. These are decoded
+// from the raw controller revision list, since this client predates
+// controller revisions.
+func (c *KubernetesClientImpl) ListControllerRevisionImages(namespace []*string) ([]string, error) {
+	images := []string{}
+
+	for _, ns := range namespace {
+		data, err := c.clientset.Core().RESTClient().Get().AbsPath("/apis/apps/v1/namespaces", *ns, "controllerrevisions").DoRaw()
+		if err != nil {
+			return nil, err
+		}
+
+		nsImages, err := ImagesFromControllerRevisionList(data)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, nsImages...)
+	}
+
+	return images, nil
+}
+
+// ImagesFromControllerRevisionList returns the image references used by the
+// pod templates recorded in the given JSON controller revision list, as
+// returned by the API server.
+func ImagesFromControllerRevisionList(data []byte) ([]string, error) {
+	list := struct {
+		Items []struct {
+			Data struct {
+				Spec struct {
+					Template v1.PodTemplateSpec `json:"template"`
+				} `json:"spec"`
+			} `json:"data"`
+		} `json:"items"`
+	}{}
+
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("Cannot parse controller revision list: %v", err)
+	}
+
+	images := []string{}
+	for _, revision := range list.Items {
+		images = append(images, imageReferencesFromPodSpec(revision.Data.Spec.Template.Spec)...)
+	}
+
+	return images, nil
+}
+
+// ListCustomWorkloadImages returns the image references used by the objects
+// of the given custom resource from the given namespaces, as per
+// `ImagesFromUnstructuredList`.
+func (c *KubernetesClientImpl) ListCustomWorkloadImages(workload CustomWorkload, namespace []*string) ([]string, error) {
+	images := []string{}
+
+	for _, ns := range namespace {
+		data, err := c.clientset.Core().RESTClient().Get().AbsPath(workload.Path(*ns)).DoRaw()
+		if err != nil {
+			return nil, err
+		}
+
+		nsImages, err := ImagesFromUnstructuredList(data)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, nsImages...)
+	}
+
+	return images, nil
+}
+
+// ListHelmReleaseSecrets returns the secrets in which Helm records the
+// releases from the given namespaces.
+func (c *KubernetesClientImpl) ListHelmReleaseSecrets(namespace []*string) ([]*v1.Secret, error) {
+	opts := v1.ListOptions{LabelSelector: HelmReleaseSecretSelector}
+	secrets := []*v1.Secret{}
+
+	for _, ns := range namespace {
+		secretList, err := c.clientset.Core().Secrets(*ns).List(opts)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range secretList.Items {
+			secrets = append(secrets, &secretList.Items[i])
+		}
+	}
+
+	return secrets, nil
+}
+
+// ListNodes returns all nodes from the cluster.
+func (c *KubernetesClientImpl) ListNodes() ([]*v1.Node, error) {
+	opts := v1.ListOptions{}
+	nodes := []*v1.Node{}
+
+	nodeList, err := c.clientset.Core().Nodes().List(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range nodeList.Items {
+		nodes = append(nodes, &nodeList.Items[i])
+	}
+
+	return nodes, nil
+}
+
+// GetConfigMap returns the ConfigMap with the given name from the given
+// namespace, or nil if there's no such ConfigMap.
+func (c *KubernetesClientImpl) GetConfigMap(namespace, name string) (*v1.ConfigMap, error) {
+	configMap, err := c.clientset.Core().ConfigMaps(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return configMap, nil
+}
+
+// CreateConfigMap creates the given ConfigMap.
+func (c *KubernetesClientImpl) CreateConfigMap(configMap *v1.ConfigMap) (*v1.ConfigMap, error) {
+	return c.clientset.Core().ConfigMaps(configMap.Namespace).Create(configMap)
+}
+
+// UpdateConfigMap updates the given ConfigMap, failing with a conflict error
+// if it was changed since it was read.
+func (c *KubernetesClientImpl) UpdateConfigMap(configMap *v1.ConfigMap) (*v1.ConfigMap, error) {
+	return c.clientset.Core().ConfigMaps(configMap.Namespace).Update(configMap)
+}
+
+// ListCleanupPolicies returns the `ECRCleanupPolicy` resources from all
+// namespaces.
+func (c *KubernetesClientImpl) ListCleanupPolicies() ([]*CleanupPolicy, error) {
+	data, err := c.clientset.Core().RESTClient().Get().AbsPath(CleanupPolicyPath).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseCleanupPolicyList(data)
+}
+
+// isConflictError tells whether the given error means that a Kubernetes
+// resource was created or changed concurrently.
+func isConflictError(err error) bool {
+	return errors.IsConflict(err) || errors.IsAlreadyExists(err)
+}
+
+// NamespaceExists tells whether the namespace with the given name exists.
+func (c *KubernetesClientImpl) NamespaceExists(name string) (bool, error) {
+	_, err := c.clientset.Core().Namespaces().Get(name)
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ListNamespaces returns the names of all namespaces from the cluster.
+func (c *KubernetesClientImpl) ListNamespaces() ([]string, error) {
+	namespaceList, err := c.clientset.Core().Namespaces().List(v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces := []string{}
+	for _, namespace := range namespaceList.Items {
+		namespaces = append(namespaces, namespace.Name)
+	}
+
+	return namespaces, nil
+}
+
+// GetObjectReference returns a reference to the object of the given kind,
+// among the `eventTargetAPIVersions` ones, and name in the given namespace.
+func (c *KubernetesClientImpl) GetObjectReference(namespace, kind, name string) (*v1.ObjectReference, error) {
+	var meta v1.ObjectMeta
+
+	switch kind {
+	case "Pod":
+		pod, err := c.clientset.Core().Pods(namespace).Get(name)
+		if err != nil {
+			return nil, err
+		}
+		meta = pod.ObjectMeta
+	case "ConfigMap":
+		configMap, err := c.clientset.Core().ConfigMaps(namespace).Get(name)
+		if err != nil {
+			return nil, err
+		}
+		meta = configMap.ObjectMeta
+	case "Deployment":
+		deployment, err := c.clientset.Extensions().Deployments(namespace).Get(name)
+		if err != nil {
+			return nil, err
+		}
+		meta = deployment.ObjectMeta
+	default:
+		return nil, fmt.Errorf("Unsupported kind '%s'", kind)
+	}
+
+	return &v1.ObjectReference{
+		Kind:            kind,
+		APIVersion:      eventTargetAPIVersions[kind],
+		Namespace:       meta.Namespace,
+		Name:            meta.Name,
+		UID:             meta.UID,
+		ResourceVersion: meta.ResourceVersion,
+	}, nil
+}
+
+// CreateEvent creates the given event.
+func (c *KubernetesClientImpl) CreateEvent(event *v1.Event) (*v1.Event, error) {
+	return c.clientset.Core().Events(event.Namespace).Create(event)
+}
+
+// ReadNamespaceFile returns the namespace stored in the given file, such as
+// `ServiceAccountNamespacePath`.
+func ReadNamespaceFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	namespace := strings.TrimSpace(string(data))
+	if namespace == "" {
+		return "", fmt.Errorf("No namespace found in '%s'", path)
+	}
+
+	return namespace, nil
+}
+
 // ECRImagesFromPods converts the given list of pods to a map where the keys
 // are the ECR repository names and their values are a slice of strings
-// containing the unique image tags referenced by those pods.
-func ECRImagesFromPods(pods []*v1.Pod) map[string][]string {
-	imagesPerRepo := map[string][]string{}
-	encountered := map[string]bool{}
+// containing the unique image tags referenced by those pods. Image references
+// are normalized according to the given registry aliases before being matched.
+// If registryHost is not empty, images hosted in other registries are ignored.
+func ECRImagesFromPods(pods []*v1.Pod, registryHost string, registryAliases map[string]string) map[string][]string {
+	return ECRImagesFromReferences(ImageReferencesFromPods(pods), registryHost, registryAliases)
+}
 
-	// Only matches tagged images hosted on ECR
-	re := regexp.MustCompile(`^.*\.dkr\.ecr\.[^\.]+\.amazonaws\.com/([^:/]+):(.*)$`)
+// ImageReferencesFromPods returns the image references used by the
+// containers of the given pods, along with the digests their images were
+// resolved to by the container runtime, which are still running even if
+// their tags have moved on since.
+func ImageReferencesFromPods(pods []*v1.Pod) []string {
+	images := []string{}
 
 	for _, pod := range pods {
-		podContainers := append(pod.Spec.InitContainers, pod.Spec.Containers...)
+		images = append(images, imageReferencesFromPodSpec(pod.Spec)...)
 
-		for _, container := range podContainers {
+		statuses := append(append([]v1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+		for _, status := range statuses {
+			if image, ok := imageReferenceFromImageID(status.ImageID); ok {
+				images = append(images, image)
+			}
+		}
+	}
 
-			// Ignore images we already seen
-			if !encountered[container.Image] {
-				imageData := re.FindStringSubmatch(container.Image)
-				if imageData == nil {
-					continue
-				}
+	return images
+}
 
-				repoName, imageTag := imageData[1], imageData[2]
+// imageReferenceFromImageID returns the image reference by digest found in
+// the given image ID of a container status, such as
+// `docker-pullable://repo@sha256:...`. The second return value is false if
+// the image ID does not refer to a registry digest, such as the local image
+// IDs reported by some runtimes.
+func imageReferenceFromImageID(imageID string) (string, bool) {
+	image := strings.TrimPrefix(imageID, "docker-pullable://")
+	if strings.Contains(image, "://") || !strings.Contains(image, "@") {
+		return "", false
+	}
 
-				// Ignore 'latest' tag
-				if imageTag == "latest" {
-					continue
-				}
+	return image, true
+}
 
-				_, ok := imagesPerRepo[repoName]
-				if ok {
-					imagesPerRepo[repoName] = append(imagesPerRepo[repoName], imageTag)
-				} else {
-					imagesPerRepo[repoName] = []string{imageTag}
-				}
+// imageReferencesFromPodSpec returns the image references used by the
+// containers of the given pod spec.
+func imageReferencesFromPodSpec(spec v1.PodSpec) []string {
+	images := []string{}
+
+	podContainers := append(append([]v1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, container := range podContainers {
+		images = append(images, container.Image)
+	}
 
-				encountered[container.Image] = true
+	return images
+}
+
+// ImageReferencesFromJobs returns the image references used by the pod
+// templates of the given jobs, leaving out the jobs that finished before the
+// given time, whose images are unlikely to be needed again.
+func ImageReferencesFromJobs(jobs []*batchv1.Job, since time.Time) []string {
+	images := []string{}
+
+	for _, job := range jobs {
+		if finishedAt, ok := jobFinishedAt(job); ok && finishedAt.Before(since) {
+			continue
+		}
+
+		images = append(images, imageReferencesFromPodSpec(job.Spec.Template.Spec)...)
+	}
+
+	return images
+}
+
+// jobFinishedAt returns the time the given job either completed or failed, if
+// it's finished.
+func jobFinishedAt(job *batchv1.Job) (time.Time, bool) {
+	if job.Status.CompletionTime != nil {
+		return job.Status.CompletionTime.Time, true
+	}
+
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Status == v1.ConditionTrue {
+			return condition.LastTransitionTime.Time, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// ImageReferencesFromReplicaSets returns the image references used by the pod
+// templates of the given replica sets.
+func ImageReferencesFromReplicaSets(replicaSets []*extensionsv1beta1.ReplicaSet) []string {
+	images := []string{}
+
+	for _, replicaSet := range replicaSets {
+		images = append(images, imageReferencesFromPodSpec(replicaSet.Spec.Template.Spec)...)
+	}
+
+	return images
+}
+
+// ImageReferencesFromCronJobs returns the image references used by the job
+// templates of the given cron jobs, including the suspended ones, since they
+// might be resumed at any time.
+func ImageReferencesFromCronJobs(cronJobs []*batchv2alpha1.CronJob) []string {
+	images := []string{}
+
+	for _, cronJob := range cronJobs {
+		images = append(images, imageReferencesFromPodSpec(cronJob.Spec.JobTemplate.Spec.Template.Spec)...)
+	}
+
+	return images
+}
+
+// PinnedImageReferencesFromNodes returns the image references listed in the
+// `PinnedImagesAnnotation` annotation of the given nodes. This lets operators
+// protect images that are pulled directly on the nodes, and thus don't show
+// up in any pod spec.
+func PinnedImageReferencesFromNodes(nodes []*v1.Node) []string {
+	images := []string{}
+
+	isSeparator := func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	}
+
+	for _, node := range nodes {
+		images = append(images, strings.FieldsFunc(node.Annotations[PinnedImagesAnnotation], isSeparator)...)
+	}
+
+	return images
+}
+
+// TagsFromConfigMap returns the sorted, unique image tags listed in the given
+// ConfigMap, where both the keys and the values separated by commas or
+// whitespace are taken as tags. This lets teams either list tags as keys,
+// with a comment as value, or keep their own lists of tags under keys of
+// their choosing.
+func TagsFromConfigMap(configMap *v1.ConfigMap) []string {
+	tags := []string{}
+	encountered := map[string]bool{}
+
+	isSeparator := func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	}
+
+	if configMap == nil {
+		return tags
+	}
+
+	for key, value := range configMap.Data {
+		for _, tag := range append([]string{key}, strings.FieldsFunc(value, isSeparator)...) {
+			if encountered[tag] {
+				continue
 			}
+
+			encountered[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+
+	sort.Strings(tags)
+
+	return tags
+}
+
+// ECRImagesFromReferences converts the given list of image references to a
+// map where the keys are the ECR repository names and their values are a
+// slice of strings containing the unique image tags referenced, along with
+// the digests of the references pinned to one, such as `sha256:...`. Image
+// references are normalized according to the given registry aliases before
+// being matched. If registryHost is not empty, images hosted in other
+// registries are ignored.
+func ECRImagesFromReferences(images []string, registryHost string, registryAliases map[string]string) map[string][]string {
+	imagesPerRepo := map[string][]string{}
+	encountered := map[string]bool{}
+
+	for _, image := range images {
+
+		// Ignore images we already seen
+		if encountered[image] {
+			continue
+		}
+
+		imageRef, ok := ParseImageReference(image, registryAliases)
+		if !ok {
+			continue
 		}
+
+		// Ignore images from other registries
+		if registryHost != "" && imageRef.Registry != registryHost {
+			continue
+		}
+
+		repoName, imageTag := imageRef.Repository, imageRef.Tag
+
+		// The digest is what's actually pulled, even if a tag is given
+		if imageRef.Digest != "" {
+			imagesPerRepo[repoName] = append(imagesPerRepo[repoName], imageRef.Digest)
+		}
+
+		// Ignore 'latest' tag
+		if imageTag != "" && imageTag != "latest" {
+			imagesPerRepo[repoName] = append(imagesPerRepo[repoName], imageTag)
+		}
+
+		encountered[image] = true
 	}
 
 	return imagesPerRepo
@@ -3,14 +3,21 @@ package core
 import (
 	"reflect"
 	"testing"
+	"time"
 
+	"k8s.io/client-go/pkg/api/unversioned"
 	"k8s.io/client-go/pkg/api/v1"
+	batchv1 "k8s.io/client-go/pkg/apis/batch/v1"
+	batchv2alpha1 "k8s.io/client-go/pkg/apis/batch/v2alpha1"
+	extensionsv1beta1 "k8s.io/client-go/pkg/apis/extensions/v1beta1"
 )
 
 func TestECRImagesFromPods(t *testing.T) {
 	testCases := []struct {
-		pods     []*v1.Pod
-		expected map[string][]string
+		pods            []*v1.Pod
+		registryHost    string
+		registryAliases map[string]string
+		expected        map[string][]string
 	}{
 		// Different tagged images from different repos in the same pod
 		{
@@ -134,6 +141,52 @@ func TestECRImagesFromPods(t *testing.T) {
 			},
 		},
 
+		// Ignore images from other ECR registries
+		{
+			pods: []*v1.Pod{
+				{
+					Spec: v1.PodSpec{
+						Containers: []v1.Container{
+							{
+								Image: "id.dkr.ecr.region.amazonaws.com/repo-1:tag-1",
+							},
+							{
+								Image: "other-id.dkr.ecr.region.amazonaws.com/repo-1:tag-2",
+							},
+						},
+					},
+				},
+			},
+			registryHost: "id.dkr.ecr.region.amazonaws.com",
+			expected: map[string][]string{
+				"repo-1": []string{"tag-1"},
+			},
+		},
+
+		// Mirrored ECR image
+		{
+			pods: []*v1.Pod{
+				{
+					Spec: v1.PodSpec{
+						Containers: []v1.Container{
+							{
+								Image: "mirror.internal/ecr/team/repo-1:tag-1",
+							},
+							{
+								Image: "mirror.internal/other/repo-2:tag-2",
+							},
+						},
+					},
+				},
+			},
+			registryAliases: map[string]string{
+				"mirror.internal/ecr": "id.dkr.ecr.region.amazonaws.com",
+			},
+			expected: map[string][]string{
+				"team/repo-1": []string{"tag-1"},
+			},
+		},
+
 		// Ignore 'latest' tag
 		{
 			pods: []*v1.Pod{
@@ -154,10 +207,353 @@ func TestECRImagesFromPods(t *testing.T) {
 				"repo-1": []string{"tag-2"},
 			},
 		},
+
+		// Digests the running images were resolved to
+		{
+			pods: []*v1.Pod{
+				{
+					Spec: v1.PodSpec{
+						InitContainers: []v1.Container{
+							{
+								Image: "id.dkr.ecr.region.amazonaws.com/repo-1:tag-1",
+							},
+						},
+						Containers: []v1.Container{
+							{
+								Image: "id.dkr.ecr.region.amazonaws.com/repo-2:tag-2",
+							},
+							{
+								Image: "id.dkr.ecr.region.amazonaws.com/repo-2:tag-3",
+							},
+						},
+					},
+					Status: v1.PodStatus{
+						InitContainerStatuses: []v1.ContainerStatus{
+							{
+								ImageID: "docker-pullable://id.dkr.ecr.region.amazonaws.com/repo-1@sha256:digest-1",
+							},
+						},
+						ContainerStatuses: []v1.ContainerStatus{
+							{
+								ImageID: "id.dkr.ecr.region.amazonaws.com/repo-2@sha256:digest-2",
+							},
+							{
+								ImageID: "docker://sha256:local-image-id",
+							},
+						},
+					},
+				},
+			},
+			expected: map[string][]string{
+				"repo-1": []string{"tag-1", "sha256:digest-1"},
+				"repo-2": []string{"tag-2", "tag-3", "sha256:digest-2"},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		actual := ECRImagesFromPods(testCase.pods, testCase.registryHost, testCase.registryAliases)
+
+		if !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Expected result to be %+v, but was %+v", testCase.expected, actual)
+		}
+	}
+}
+
+func TestPinnedImageReferencesFromNodes(t *testing.T) {
+	nodes := []*v1.Node{
+		{
+			ObjectMeta: v1.ObjectMeta{
+				Annotations: map[string]string{
+					PinnedImagesAnnotation: "id.dkr.ecr.region.amazonaws.com/repo-1:tag-1, id.dkr.ecr.region.amazonaws.com/repo-1:tag-2",
+				},
+			},
+		},
+		{
+			ObjectMeta: v1.ObjectMeta{
+				Annotations: map[string]string{
+					"other-annotation": "id.dkr.ecr.region.amazonaws.com/repo-2:tag-1",
+				},
+			},
+		},
+		{
+			ObjectMeta: v1.ObjectMeta{
+				Annotations: map[string]string{
+					PinnedImagesAnnotation: "\n  id.dkr.ecr.region.amazonaws.com/repo-3:tag-1\n",
+				},
+			},
+		},
+		{},
+	}
+
+	expected := []string{
+		"id.dkr.ecr.region.amazonaws.com/repo-1:tag-1",
+		"id.dkr.ecr.region.amazonaws.com/repo-1:tag-2",
+		"id.dkr.ecr.region.amazonaws.com/repo-3:tag-1",
+	}
+
+	actual := PinnedImageReferencesFromNodes(nodes)
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected result to be %+v, but was %+v", expected, actual)
+	}
+}
+
+func TestEphemeralContainerImagesFromPodList(t *testing.T) {
+	data := []byte(`{
+		"items": [
+			{"spec": {"containers": [{"image": "repo-1:tag-1"}]}},
+			{"spec": {"ephemeralContainers": [{"name": "debugger", "image": "repo-2:tag-1"}, {"image": "repo-2:tag-2"}]}},
+			{}
+		]
+	}`)
+
+	expected := []string{"repo-2:tag-1", "repo-2:tag-2"}
+	actual, err := EphemeralContainerImagesFromPodList(data)
+
+	if err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected result to be %+v, but was %+v", expected, actual)
+	}
+
+	if _, err := EphemeralContainerImagesFromPodList([]byte("not json")); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+}
+
+func newTestPodTemplate(initImage, image string) v1.PodTemplateSpec {
+	template := v1.PodTemplateSpec{
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{Image: image}},
+		},
+	}
+
+	if initImage != "" {
+		template.Spec.InitContainers = []v1.Container{{Image: initImage}}
+	}
+
+	return template
+}
+
+func TestImageReferencesFromJobs(t *testing.T) {
+	since := time.Unix(1000, 0)
+	finishedBefore := unversioned.NewTime(since.Add(-time.Second))
+	finishedAfter := unversioned.NewTime(since.Add(time.Second))
+
+	jobs := []*batchv1.Job{
+		// Running job
+		{
+			Spec: batchv1.JobSpec{Template: newTestPodTemplate("repo-1:init", "repo-1:tag-1")},
+		},
+
+		// Job completed within the window
+		{
+			Spec:   batchv1.JobSpec{Template: newTestPodTemplate("", "repo-2:tag-1")},
+			Status: batchv1.JobStatus{CompletionTime: &finishedAfter},
+		},
+
+		// Job completed before the window
+		{
+			Spec:   batchv1.JobSpec{Template: newTestPodTemplate("", "repo-3:tag-1")},
+			Status: batchv1.JobStatus{CompletionTime: &finishedBefore},
+		},
+
+		// Job failed before the window
+		{
+			Spec: batchv1.JobSpec{Template: newTestPodTemplate("", "repo-4:tag-1")},
+			Status: batchv1.JobStatus{
+				Conditions: []batchv1.JobCondition{
+					{
+						Type:               batchv1.JobFailed,
+						Status:             v1.ConditionTrue,
+						LastTransitionTime: finishedBefore,
+					},
+				},
+			},
+		},
+	}
+
+	expected := []string{"repo-1:init", "repo-1:tag-1", "repo-2:tag-1"}
+	actual := ImageReferencesFromJobs(jobs, since)
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected result to be %+v, but was %+v", expected, actual)
+	}
+
+	// All jobs are taken into account without a window
+	expected = []string{"repo-1:init", "repo-1:tag-1", "repo-2:tag-1", "repo-3:tag-1", "repo-4:tag-1"}
+	actual = ImageReferencesFromJobs(jobs, time.Time{})
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected result to be %+v, but was %+v", expected, actual)
+	}
+}
+
+func TestImageReferencesFromCronJobs(t *testing.T) {
+	suspended := true
+
+	cronJobs := []*batchv2alpha1.CronJob{
+		{
+			Spec: batchv2alpha1.CronJobSpec{
+				JobTemplate: batchv2alpha1.JobTemplateSpec{
+					Spec: batchv2alpha1.JobSpec{Template: newTestPodTemplate("", "repo-1:tag-1")},
+				},
+			},
+		},
+		{
+			Spec: batchv2alpha1.CronJobSpec{
+				Suspend: &suspended,
+				JobTemplate: batchv2alpha1.JobTemplateSpec{
+					Spec: batchv2alpha1.JobSpec{Template: newTestPodTemplate("repo-2:init", "repo-2:tag-1")},
+				},
+			},
+		},
+	}
+
+	expected := []string{"repo-1:tag-1", "repo-2:init", "repo-2:tag-1"}
+	actual := ImageReferencesFromCronJobs(cronJobs)
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected result to be %+v, but was %+v", expected, actual)
+	}
+}
+
+func TestCronJobsFromList(t *testing.T) {
+	data := []byte(`{
+		"apiVersion": "batch/v1",
+		"kind": "CronJobList",
+		"items": [
+			{
+				"metadata": {"name": "backup"},
+				"spec": {"schedule": "0 * * * *", "suspend": true, "jobTemplate": {"spec": {"template": {"spec": {"containers": [{"name": "backup", "image": "repo-1:tag-1"}]}}}}}
+			}
+		]
+	}`)
+
+	cronJobs, err := CronJobsFromList(data)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	if len(cronJobs) != 1 || cronJobs[0].Name != "backup" || cronJobs[0].Spec.Suspend == nil || !*cronJobs[0].Spec.Suspend {
+		t.Errorf("Expected the suspended cron job, but got %+v", cronJobs)
+	}
+
+	if actual := ImageReferencesFromCronJobs(cronJobs); !reflect.DeepEqual(actual, []string{"repo-1:tag-1"}) {
+		t.Errorf("Expected the images of the cron job, but got %+v", actual)
+	}
+
+	if _, err := CronJobsFromList([]byte("not json")); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+}
+
+func TestImageReferencesFromReplicaSets(t *testing.T) {
+	var replicas int32
+
+	replicaSets := []*extensionsv1beta1.ReplicaSet{
+		{
+			Spec: extensionsv1beta1.ReplicaSetSpec{Template: newTestPodTemplate("", "repo-1:tag-2")},
+		},
+
+		// Previous revision, scaled down to zero
+		{
+			Spec: extensionsv1beta1.ReplicaSetSpec{Replicas: &replicas, Template: newTestPodTemplate("repo-1:init", "repo-1:tag-1")},
+		},
+	}
+
+	expected := []string{"repo-1:tag-2", "repo-1:init", "repo-1:tag-1"}
+	actual := ImageReferencesFromReplicaSets(replicaSets)
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected result to be %+v, but was %+v", expected, actual)
+	}
+}
+
+func TestReplicaSetsFromList(t *testing.T) {
+	data := []byte(`{
+		"apiVersion": "apps/v1",
+		"kind": "ReplicaSetList",
+		"items": [
+			{
+				"metadata": {"name": "app-1", "ownerReferences": [{"kind": "Deployment", "name": "app"}]},
+				"spec": {"replicas": 0, "template": {"spec": {"containers": [{"name": "app", "image": "repo-1:tag-1"}]}}}
+			}
+		]
+	}`)
+
+	replicaSets, err := ReplicaSetsFromList(data)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	if len(replicaSets) != 1 || replicaSets[0].Name != "app-1" || len(replicaSets[0].OwnerReferences) != 1 || replicaSets[0].Spec.Replicas == nil || *replicaSets[0].Spec.Replicas != 0 {
+		t.Errorf("Expected the replica set scaled down to zero, but got %+v", replicaSets)
+	}
+
+	if actual := ImageReferencesFromReplicaSets(replicaSets); !reflect.DeepEqual(actual, []string{"repo-1:tag-1"}) {
+		t.Errorf("Expected the images of the replica set, but got %+v", actual)
+	}
+
+	if _, err := ReplicaSetsFromList([]byte("not json")); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+}
+
+func TestImagesFromControllerRevisionList(t *testing.T) {
+	data := []byte(`{
+		"items": [
+			{"revision": 1, "data": {"spec": {"template": {"spec": {"containers": [{"name": "app", "image": "repo-1:tag-1"}]}}}}},
+			{"revision": 2, "data": {"spec": {"template": {"spec": {"initContainers": [{"image": "repo-1:init"}], "containers": [{"image": "repo-1:tag-2"}]}}}}},
+			{"revision": 3}
+		]
+	}`)
+
+	expected := []string{"repo-1:tag-1", "repo-1:init", "repo-1:tag-2"}
+	actual, err := ImagesFromControllerRevisionList(data)
+
+	if err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected result to be %+v, but was %+v", expected, actual)
+	}
+
+	if _, err := ImagesFromControllerRevisionList([]byte("not json")); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+}
+
+func TestTagsFromConfigMap(t *testing.T) {
+	testCases := []struct {
+		configMap *v1.ConfigMap
+		expected  []string
+	}{
+		// No ConfigMap
+		{
+			configMap: nil,
+			expected:  []string{},
+		},
+
+		// Tags as keys and as values
+		{
+			configMap: &v1.ConfigMap{
+				Data: map[string]string{
+					"v1.0.0": "",
+					"team-a": "tag-1, tag-2\ntag-3",
+					"team-b": "tag-2",
+				},
+			},
+			expected: []string{"tag-1", "tag-2", "tag-3", "team-a", "team-b", "v1.0.0"},
+		},
 	}
 
 	for _, testCase := range testCases {
-		actual := ECRImagesFromPods(testCase.pods)
+		actual := TagsFromConfigMap(testCase.configMap)
 
 		if !reflect.DeepEqual(actual, testCase.expected) {
 			t.Errorf("Expected result to be %+v, but was %+v", testCase.expected, actual)
@@ -0,0 +1,238 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// LeaderElectionConfigMapName is the name of the ConfigMap, kept in the
+// controller namespace, that records which replica of the controller is the
+// leader.
+const LeaderElectionConfigMapName = "ecr-cleanup-controller-leader"
+
+// LeaderElectionRecordAnnotation is the annotation of the leader election
+// ConfigMap holding the `LeaderElectionRecord` as JSON.
+const LeaderElectionRecordAnnotation = "ecr-cleanup/leader"
+
+// LeaderLockClient defines the expected interface of any object capable of
+// reading and writing the ConfigMap used as the leader election lock. Updates
+// must fail with a conflict error if the ConfigMap was changed since it was
+// read, so that only one replica can take the lead.
+type LeaderLockClient interface {
+	GetConfigMap(namespace, name string) (*v1.ConfigMap, error)
+	CreateConfigMap(configMap *v1.ConfigMap) (*v1.ConfigMap, error)
+	UpdateConfigMap(configMap *v1.ConfigMap) (*v1.ConfigMap, error)
+}
+
+// LeaderElectionRecord tells which replica holds the lead, and until when.
+type LeaderElectionRecord struct {
+	HolderIdentity       string    `json:"holderIdentity"`
+	LeaseDurationSeconds int       `json:"leaseDurationSeconds"`
+	AcquireTime          time.Time `json:"acquireTime"`
+	RenewTime            time.Time `json:"renewTime"`
+}
+
+// LeaderElector takes and keeps the lead on behalf of a replica of the
+// controller, using a ConfigMap as lock. The lease is considered expired once
+// it hasn't been renewed for `LeaseDuration`, as measured by the local clock
+// since the record last changed, so that clock skew between replicas doesn't
+// matter.
+type LeaderElector struct {
+	Client        LeaderLockClient
+	Namespace     string
+	Name          string
+	Identity      string
+	LeaseDuration time.Duration
+
+	observedRecord LeaderElectionRecord
+	observedTime   time.Time
+}
+
+// TryAcquireOrRenew takes the lead if it's free or its lease has expired, or
+// renews it if already held, and tells whether the lead is held afterwards.
+// Losing a race against another replica is not an error.
+func (e *LeaderElector) TryAcquireOrRenew(now time.Time) (bool, error) {
+	record := LeaderElectionRecord{
+		HolderIdentity:       e.Identity,
+		LeaseDurationSeconds: int(e.LeaseDuration / time.Second),
+		AcquireTime:          now,
+		RenewTime:            now,
+	}
+
+	configMap, err := e.Client.GetConfigMap(e.Namespace, e.Name)
+	if err != nil {
+		return false, fmt.Errorf("Cannot get leader election ConfigMap '%s/%s': %v", e.Namespace, e.Name, err)
+	}
+
+	if configMap == nil {
+		configMap = &v1.ConfigMap{
+			ObjectMeta: v1.ObjectMeta{
+				Namespace: e.Namespace,
+				Name:      e.Name,
+			},
+		}
+		if err := setLeaderElectionRecord(configMap, record); err != nil {
+			return false, err
+		}
+
+		if _, err := e.Client.CreateConfigMap(configMap); err != nil {
+			if isConflictError(err) {
+				return false, nil
+			}
+			return false, fmt.Errorf("Cannot create leader election ConfigMap '%s/%s': %v", e.Namespace, e.Name, err)
+		}
+
+		e.observe(record, now)
+		return true, nil
+	}
+
+	current := LeaderElectionRecord{}
+	if value := configMap.Annotations[LeaderElectionRecordAnnotation]; value != "" {
+		if err := json.Unmarshal([]byte(value), &current); err != nil {
+			return false, fmt.Errorf("Cannot parse leader election record of ConfigMap '%s/%s': %v", e.Namespace, e.Name, err)
+		}
+	}
+
+	if current != e.observedRecord {
+		e.observe(current, now)
+	}
+
+	if current.HolderIdentity != "" && current.HolderIdentity != e.Identity && e.observedTime.Add(e.LeaseDuration).After(now) {
+		return false, nil
+	}
+
+	// The acquire time only changes when the lead changes hands
+	if current.HolderIdentity == e.Identity {
+		record.AcquireTime = current.AcquireTime
+	}
+
+	if err := setLeaderElectionRecord(configMap, record); err != nil {
+		return false, err
+	}
+
+	if _, err := e.Client.UpdateConfigMap(configMap); err != nil {
+		if isConflictError(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("Cannot update leader election ConfigMap '%s/%s': %v", e.Namespace, e.Name, err)
+	}
+
+	e.observe(record, now)
+	return true, nil
+}
+
+// observe records the given leader election record as the last one seen, at
+// the given time.
+func (e *LeaderElector) observe(record LeaderElectionRecord, now time.Time) {
+	e.observedRecord = record
+	e.observedTime = now
+}
+
+// setLeaderElectionRecord stores the given record in the annotations of the
+// given ConfigMap.
+func setLeaderElectionRecord(configMap *v1.ConfigMap, record LeaderElectionRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("Cannot encode leader election record: %v", err)
+	}
+
+	if configMap.Annotations == nil {
+		configMap.Annotations = map[string]string{}
+	}
+	configMap.Annotations[LeaderElectionRecordAnnotation] = string(data)
+
+	return nil
+}
+
+// startLeaderElection tries to take the lead right away, and then keeps trying
+// to take or renew it every third of `LeaderElectionLeaseDuration` in the
+// background, until done is closed.
+func (t *CleanupTask) startLeaderElection(kubeClient KubernetesClient, done chan struct{}, wg *sync.WaitGroup) error {
+	if t.LeaderLockClient == nil {
+		lockClient, ok := kubeClient.(LeaderLockClient)
+		if !ok {
+			return fmt.Errorf("Kubernetes client cannot be used for leader election")
+		}
+		t.LeaderLockClient = lockClient
+	}
+
+	if t.LeaderElectionIdentity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("Cannot get leader election identity: %v", err)
+		}
+		t.LeaderElectionIdentity = hostname
+	}
+
+	if t.LeaderElectionLeaseDuration <= 0 {
+		return fmt.Errorf("Leader election lease duration must be greater than zero")
+	}
+
+	elector := &LeaderElector{
+		Client:        t.LeaderLockClient,
+		Namespace:     t.ControllerNamespace,
+		Name:          LeaderElectionConfigMapName,
+		Identity:      t.LeaderElectionIdentity,
+		LeaseDuration: t.LeaderElectionLeaseDuration,
+	}
+
+	t.log().Infof("Taking part in leader election as '%s', using '%s/%s' ConfigMap.", elector.Identity, elector.Namespace, elector.Name)
+	t.updateLeadership(elector)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(t.LeaderElectionLeaseDuration / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				t.updateLeadership(elector)
+			case <-done:
+				t.log().Infof("Stopped leader election.")
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// updateLeadership tries to take or renew the lead with the given elector,
+// and records whether it's held. The lead is given up if it cannot be renewed,
+// since another replica might take it over in the meantime.
+func (t *CleanupTask) updateLeadership(elector *LeaderElector) {
+	leading, err := elector.TryAcquireOrRenew(time.Now())
+	if err != nil {
+		t.log().Errorf("%v", err)
+	}
+
+	if leading != t.isLeading() {
+		if leading {
+			t.log().Infof("Took the lead, clean-up passes will run in this replica.")
+		} else {
+			t.log().Infof("Lost the lead, clean-up passes will not run in this replica.")
+		}
+	}
+
+	if leading {
+		atomic.StoreInt32(&t.leading, 1)
+		leader.Set(1)
+	} else {
+		atomic.StoreInt32(&t.leading, 0)
+		leader.Set(0)
+	}
+}
+
+// isLeading tells whether this replica holds the lead.
+func (t *CleanupTask) isLeading() bool {
+	return atomic.LoadInt32(&t.leading) == 1
+}
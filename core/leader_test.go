@@ -0,0 +1,191 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/pkg/api/errors"
+	"k8s.io/client-go/pkg/api/unversioned"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// mockLeaderLockClient keeps a single ConfigMap in memory, failing with a
+// conflict error when it's updated from a stale copy, like the API server.
+type mockLeaderLockClient struct {
+	configMap *v1.ConfigMap
+	version   int
+}
+
+func (m *mockLeaderLockClient) GetConfigMap(namespace, name string) (*v1.ConfigMap, error) {
+	if m.configMap == nil {
+		return nil, nil
+	}
+	return copyConfigMap(m.configMap), nil
+}
+
+func (m *mockLeaderLockClient) CreateConfigMap(configMap *v1.ConfigMap) (*v1.ConfigMap, error) {
+	if m.configMap != nil {
+		return nil, errors.NewAlreadyExists(unversioned.GroupResource{Resource: "configmaps"}, configMap.Name)
+	}
+	return m.store(configMap), nil
+}
+
+func (m *mockLeaderLockClient) UpdateConfigMap(configMap *v1.ConfigMap) (*v1.ConfigMap, error) {
+	if configMap.ResourceVersion != m.configMap.ResourceVersion {
+		return nil, errors.NewConflict(unversioned.GroupResource{Resource: "configmaps"}, configMap.Name, fmt.Errorf("stale resource version"))
+	}
+	return m.store(configMap), nil
+}
+
+func (m *mockLeaderLockClient) store(configMap *v1.ConfigMap) *v1.ConfigMap {
+	m.version++
+	m.configMap = copyConfigMap(configMap)
+	m.configMap.ResourceVersion = strconv.Itoa(m.version)
+	return copyConfigMap(m.configMap)
+}
+
+func copyConfigMap(configMap *v1.ConfigMap) *v1.ConfigMap {
+	copied := *configMap
+	copied.Annotations = map[string]string{}
+	for key, value := range configMap.Annotations {
+		copied.Annotations[key] = value
+	}
+	if configMap.Data != nil {
+		copied.Data = map[string]string{}
+		for key, value := range configMap.Data {
+			copied.Data[key] = value
+		}
+	}
+	return &copied
+}
+
+func newTestLeaderElector(client LeaderLockClient, identity string) *LeaderElector {
+	return &LeaderElector{
+		Client:        client,
+		Namespace:     "namespace",
+		Name:          LeaderElectionConfigMapName,
+		Identity:      identity,
+		LeaseDuration: time.Minute,
+	}
+}
+
+func TestLeaderElector(t *testing.T) {
+	client := &mockLeaderLockClient{}
+	first := newTestLeaderElector(client, "first")
+	second := newTestLeaderElector(client, "second")
+	now := time.Unix(0, 0)
+
+	steps := []struct {
+		elector  *LeaderElector
+		elapsed  time.Duration
+		expected bool
+	}{
+		// Should take the lead when there's no leader yet
+		{elector: first, expected: true},
+
+		// Should not take the lead while the lease is being renewed
+		{elector: second, elapsed: 10 * time.Second, expected: false},
+		{elector: first, elapsed: 20 * time.Second, expected: true},
+		{elector: second, elapsed: 50 * time.Second, expected: false},
+
+		// Should take the lead once the lease has expired
+		{elector: second, elapsed: 90 * time.Second, expected: true},
+		{elector: first, elapsed: 10 * time.Second, expected: false},
+	}
+
+	for i, step := range steps {
+		now = now.Add(step.elapsed)
+
+		leading, err := step.elector.TryAcquireOrRenew(now)
+		if err != nil {
+			t.Errorf("Step %d: expected no error, but got %v", i, err)
+		}
+
+		if leading != step.expected {
+			t.Errorf("Step %d: expected '%s' leading to be %t, but was %t", i, step.elector.Identity, step.expected, leading)
+		}
+	}
+}
+
+func TestLeaderElectorWithConcurrentUpdate(t *testing.T) {
+	client := &racingLeaderLockClient{mockLeaderLockClient: &mockLeaderLockClient{}}
+	now := time.Unix(0, 0)
+
+	if _, err := newTestLeaderElector(client.mockLeaderLockClient, "first").TryAcquireOrRenew(now); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	second := newTestLeaderElector(client, "second")
+	if leading, _ := second.TryAcquireOrRenew(now); leading {
+		t.Fatalf("Expected the lead not to be taken while the lease is valid")
+	}
+
+	// The leader renews the lease right after it's read, once expired
+	client.racing = true
+	leading, err := second.TryAcquireOrRenew(now.Add(2 * time.Minute))
+
+	if err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+
+	if leading {
+		t.Errorf("Expected the lead not to be taken after a conflict")
+	}
+}
+
+func TestLeaderElectorWithConcurrentCreate(t *testing.T) {
+	client := &racingLeaderLockClient{mockLeaderLockClient: &mockLeaderLockClient{}, racing: true}
+
+	leading, err := newTestLeaderElector(client, "second").TryAcquireOrRenew(time.Unix(0, 0))
+
+	if err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+
+	if leading {
+		t.Errorf("Expected the lead not to be taken after a conflict")
+	}
+}
+
+// racingLeaderLockClient lets the 'first' replica take or renew the lead
+// right after the ConfigMap is read, if racing, so that the following write
+// conflicts.
+type racingLeaderLockClient struct {
+	*mockLeaderLockClient
+	racing bool
+}
+
+func (m *racingLeaderLockClient) GetConfigMap(namespace, name string) (*v1.ConfigMap, error) {
+	configMap, err := m.mockLeaderLockClient.GetConfigMap(namespace, name)
+	if err != nil || !m.racing {
+		return configMap, err
+	}
+
+	if _, err := newTestLeaderElector(m.mockLeaderLockClient, "first").TryAcquireOrRenew(time.Unix(0, 0)); err != nil {
+		return nil, err
+	}
+
+	return configMap, nil
+}
+
+func TestLeaderElectorWithInvalidRecord(t *testing.T) {
+	client := &mockLeaderLockClient{
+		configMap: &v1.ConfigMap{
+			ObjectMeta: v1.ObjectMeta{
+				Annotations: map[string]string{LeaderElectionRecordAnnotation: "invalid"},
+			},
+		},
+	}
+
+	leading, err := newTestLeaderElector(client, "first").TryAcquireOrRenew(time.Unix(0, 0))
+
+	if err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+
+	if leading {
+		t.Errorf("Expected the lead not to be taken")
+	}
+}
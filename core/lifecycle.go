@@ -0,0 +1,231 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// LifecyclePolicy is an ECR lifecycle policy, which ECR applies on its own to
+// the repositories it is set on.
+type LifecyclePolicy struct {
+	Rules []LifecyclePolicyRule `json:"rules"`
+}
+
+// LifecyclePolicyRule is a rule of a LifecyclePolicy, expiring the images
+// it selects.
+type LifecyclePolicyRule struct {
+	RulePriority int                      `json:"rulePriority"`
+	Description  string                   `json:"description,omitempty"`
+	Selection    LifecyclePolicySelection `json:"selection"`
+	Action       LifecyclePolicyAction    `json:"action"`
+}
+
+// LifecyclePolicySelection tells which images a LifecyclePolicyRule
+// expires.
+type LifecyclePolicySelection struct {
+	TagStatus      string   `json:"tagStatus"`
+	TagPatternList []string `json:"tagPatternList,omitempty"`
+	CountType      string   `json:"countType"`
+	CountUnit      string   `json:"countUnit,omitempty"`
+	CountNumber    int      `json:"countNumber"`
+}
+
+// LifecyclePolicyAction is what a LifecyclePolicyRule does to the images it
+// selects.
+type LifecyclePolicyAction struct {
+	Type string `json:"type"`
+}
+
+// LifecyclePolicyCaveats are the differences between the controller and any
+// lifecycle policy, whatever the settings being translated, since ECR knows
+// nothing about the cluster.
+var LifecyclePolicyCaveats = []string{
+	"images in use by the cluster are not protected",
+	"images tagged 'latest' are not protected",
+	"images referenced by manifest lists are not protected",
+}
+
+// LifecyclePolicyClient defines the expected interface of any object capable
+// of setting the lifecycle policy of ECR repositories.
+type LifecyclePolicyClient interface {
+	PutLifecyclePolicy(repositoryName *string, policyText string) error
+}
+
+// PutLifecyclePolicy sets the lifecycle policy of the given repository to the
+// given JSON policy, replacing the existing one, if any.
+func (c *ECRClientImpl) PutLifecyclePolicy(repositoryName *string, policyText string) error {
+	_, err := c.api(repositoryName).PutLifecyclePolicyWithContext(c.requestContext(), &ecr.PutLifecyclePolicyInput{
+		RepositoryName:      repositoryName,
+		LifecyclePolicyText: aws.String(policyText),
+	})
+	return err
+}
+
+// lifecyclePolicyDays returns the given duration as a number of days, rounded
+// up so that images are never expired earlier than the controller would.
+func lifecyclePolicyDays(duration time.Duration) int {
+	day := 24 * time.Hour
+	return int((duration + day - 1) / day)
+}
+
+// LifecyclePolicy translates the retention rules of the task into an
+// equivalent lifecycle policy, along with the settings whose semantics cannot
+// be reproduced by the policy, which are left out of it. On top of these,
+// `LifecyclePolicyCaveats` always apply.
+func (t *CleanupTask) LifecyclePolicy() (*LifecyclePolicy, []string) {
+	policy := &LifecyclePolicy{Rules: []LifecyclePolicyRule{}}
+	untranslated := []string{}
+
+	addRule := func(description string, selection LifecyclePolicySelection) {
+		policy.Rules = append(policy.Rules, LifecyclePolicyRule{
+			RulePriority: len(policy.Rules) + 1,
+			Description:  description,
+			Selection:    selection,
+			Action:       LifecyclePolicyAction{Type: "expire"},
+		})
+	}
+
+	// Images matched by a rule cannot be expired by the rules that come after
+	// it, so rules combining with each other, as most of the ones of the
+	// controller do, can only be translated one at a time
+	tagged := LifecyclePolicySelection{TagStatus: "any"}
+	switch {
+	case t.UntaggedKeepCount > 0 && t.UntaggedMaxAge > 0:
+		untranslated = append(untranslated, "-untagged-max-age along with -untagged-keep-count")
+		fallthrough
+	case t.UntaggedKeepCount > 0:
+		addRule("Keep the most recent untagged images, as per -untagged-keep-count", LifecyclePolicySelection{
+			TagStatus:   "untagged",
+			CountType:   "imageCountMoreThan",
+			CountNumber: t.UntaggedKeepCount,
+		})
+	case t.UntaggedMaxAge > 0:
+		addRule("Expire old untagged images, as per -untagged-max-age", LifecyclePolicySelection{
+			TagStatus:   "untagged",
+			CountType:   "sinceImagePushed",
+			CountUnit:   "days",
+			CountNumber: lifecyclePolicyDays(t.UntaggedMaxAge),
+		})
+	case t.DeleteUntaggedImages:
+		// Lifecycle policies cannot expire images right after they are pushed
+		untranslated = append(untranslated, "-delete-untagged, which expires untagged images a day after they are pushed instead")
+		addRule("Expire untagged images, as per -delete-untagged", LifecyclePolicySelection{
+			TagStatus:   "untagged",
+			CountType:   "sinceImagePushed",
+			CountUnit:   "days",
+			CountNumber: 1,
+		})
+	}
+	if len(policy.Rules) > 0 {
+		tagged = LifecyclePolicySelection{TagStatus: "tagged", TagPatternList: []string{"*"}}
+	}
+
+	switch {
+	case t.MaxImages > 0:
+		if t.MaxImageAge > 0 {
+			untranslated = append(untranslated, "-max-image-age along with -max-images")
+		}
+		tagged.CountType, tagged.CountNumber = "imageCountMoreThan", t.MaxImages
+		addRule("Keep the most recent images, as per -max-images", tagged)
+	case t.MaxImageAge > 0 && t.AllowEmptyRepositories:
+		tagged.CountType, tagged.CountUnit, tagged.CountNumber = "sinceImagePushed", "days", lifecyclePolicyDays(t.MaxImageAge)
+		addRule("Expire old images, as per -max-image-age", tagged)
+	default:
+		// Lifecycle policies cannot expire all images while keeping at least
+		// one of them
+		untranslated = append(untranslated, "-max-images below 1 without -max-image-age and -allow-empty-repo")
+	}
+
+	unsupported := []struct {
+		set  bool
+		flag string
+	}{
+		{t.CountSince > 0, "-count-since"},
+		{t.SemverRetention != "", "-semver-retention"},
+		{t.TagGroupPattern != nil, "-tag-group-regex"},
+		{t.MinImageAge > 0, "-min-image-age"},
+		{t.SkipScanPending, "-skip-delete-if-scan-pending"},
+		{t.DeleteCriticalFindings, "-force-delete-critical-cves"},
+		{t.MaxTagsPerImage > 0, "-max-tags"},
+		{t.MinImageSizeBytes > 0, "-min-image-size"},
+		{t.MaxRepositorySizeBytes > 0, "-max-repo-size-gb"},
+		{t.ReclaimBytes > 0, "-reclaim-bytes"},
+		{len(t.KeepTagPatterns) > 0, "-keep-tags-regex"},
+		{t.KeepTagsConfigMap != "", "-keep-tags-configmap"},
+		{t.UseCleanupPolicies, "-cleanup-policies"},
+		{t.UseRepositoryTags, "-repo-tag-overrides"},
+		{t.UseNamespaceKeepCounts, "-namespace-keep-counts"},
+		{t.SkipReplicatedRepositories, "-skip-replicated"},
+		{t.DeleteEmptyRepositories, "-delete-empty-repos"},
+		{len(t.GitOpsRepositories) > 0, "-gitops-repos"},
+		{t.ProtectImagesNewerThanInUse, "-protect-newer-than-in-use"},
+		{t.AlwaysKeepLatestTagged, "-always-keep-latest-tagged"},
+		{t.ProtectAnnotationKey != "", "-protect-annotation"},
+		{t.RecentPullWindow > 0, "-recent-pull-window"},
+		{t.MinDaysSinceLastPull > 0, "-min-days-since-last-pull"},
+		{t.DeleteOrphanedManifestLists, "-delete-orphaned-manifest-lists"},
+		{t.DeleteManifestListChildren, "-delete-manifest-list-children"},
+		{t.QuarantineRetention > 0, "-quarantine-retention"},
+		{t.ImageTagStatus != "", "-image-tag-status"},
+	}
+	for _, setting := range unsupported {
+		if setting.set {
+			untranslated = append(untranslated, setting.flag)
+		}
+	}
+
+	return policy, untranslated
+}
+
+// String returns the policy as JSON, as expected by PutLifecyclePolicy.
+func (p *LifecyclePolicy) String() string {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Sprintf("%+v", *p)
+	}
+	return string(data)
+}
+
+// ApplyLifecyclePolicy sets the lifecycle policy of the repositories of each
+// of the given regions, as given by `EcrRepositories` or discovered with
+// `DiscoverRepositories`, to the given policy. All repositories are handled
+// regardless of failures, which are returned together.
+func (t *CleanupTask) ApplyLifecyclePolicy(ecrClients []RegionalECRClient, policy *LifecyclePolicy) error {
+	errs := &MultiError{}
+	policyText := policy.String()
+
+	for _, regional := range ecrClients {
+		policyClient, ok := regional.Client.(LifecyclePolicyClient)
+		if !ok {
+			errs.Append(&RepositoryError{Region: regional.Region, Err: fmt.Errorf("ECR client cannot set lifecycle policies")})
+			continue
+		}
+
+		var repos []*ecr.Repository
+		var err error
+		if t.DiscoverRepositories {
+			repos, err = regional.Client.ListAllRepositories()
+			repos = FilterRepositoriesByName(repos, t.RepositoryIncludePatterns, t.RepositoryExcludePatterns)
+		} else {
+			repos, err = regional.Client.ListRepositories(t.EcrRepositories)
+		}
+		if err != nil {
+			errs.Append(&RepositoryError{Region: regional.Region, Message: "Cannot list ECR repositories", Err: err})
+			continue
+		}
+
+		for _, repo := range repos {
+			if err := policyClient.PutLifecyclePolicy(repo.RepositoryName, policyText); err != nil {
+				errs.Append(&RepositoryError{Region: regional.Region, Repository: *repo.RepositoryName, Message: "Cannot set lifecycle policy", Err: err})
+				continue
+			}
+			t.log().Infof("Set the lifecycle policy of '%s' ECR repo in '%s' region.", *repo.RepositoryName, regional.Region)
+		}
+	}
+
+	return errs.ErrorOrNil()
+}
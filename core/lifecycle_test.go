@@ -0,0 +1,119 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLifecyclePolicy(t *testing.T) {
+	testCases := []struct {
+		task         CleanupTask
+		expected     []LifecyclePolicySelection
+		untranslated []string
+	}{
+		{
+			task: CleanupTask{MaxImages: 10},
+			expected: []LifecyclePolicySelection{
+				{TagStatus: "any", CountType: "imageCountMoreThan", CountNumber: 10},
+			},
+			untranslated: []string{},
+		},
+
+		// Untagged images have their own rule, so only tagged images count
+		// against -max-images
+		{
+			task: CleanupTask{MaxImages: 10, UntaggedMaxAge: 36 * time.Hour},
+			expected: []LifecyclePolicySelection{
+				{TagStatus: "untagged", CountType: "sinceImagePushed", CountUnit: "days", CountNumber: 2},
+				{TagStatus: "tagged", TagPatternList: []string{"*"}, CountType: "imageCountMoreThan", CountNumber: 10},
+			},
+			untranslated: []string{},
+		},
+		{
+			task: CleanupTask{MaxImages: 10, MaxImageAge: 720 * time.Hour, DeleteUntaggedImages: true, MinImageAge: time.Hour},
+			expected: []LifecyclePolicySelection{
+				{TagStatus: "untagged", CountType: "sinceImagePushed", CountUnit: "days", CountNumber: 1},
+				{TagStatus: "tagged", TagPatternList: []string{"*"}, CountType: "imageCountMoreThan", CountNumber: 10},
+			},
+			untranslated: []string{
+				"-delete-untagged, which expires untagged images a day after they are pushed instead",
+				"-max-image-age along with -max-images",
+				"-min-image-age",
+			},
+		},
+		{
+			task: CleanupTask{MaxImageAge: 720 * time.Hour, AllowEmptyRepositories: true},
+			expected: []LifecyclePolicySelection{
+				{TagStatus: "any", CountType: "sinceImagePushed", CountUnit: "days", CountNumber: 30},
+			},
+			untranslated: []string{},
+		},
+
+		// Lifecycle policies would leave repositories empty
+		{
+			task:         CleanupTask{MaxImageAge: 720 * time.Hour},
+			expected:     []LifecyclePolicySelection{},
+			untranslated: []string{"-max-images below 1 without -max-image-age and -allow-empty-repo"},
+		},
+	}
+
+	for i, testCase := range testCases {
+		policy, untranslated := testCase.task.LifecyclePolicy()
+
+		selections := []LifecyclePolicySelection{}
+		for j, rule := range policy.Rules {
+			if rule.RulePriority != j+1 || rule.Action.Type != "expire" {
+				t.Errorf("Test case %d: expected rule %d to expire images with priority %d, but got %+v", i, j, j+1, rule)
+			}
+			selections = append(selections, rule.Selection)
+		}
+
+		if !reflect.DeepEqual(selections, testCase.expected) {
+			t.Errorf("Test case %d: expected rules to select %+v, but got %+v", i, testCase.expected, selections)
+		}
+
+		if !reflect.DeepEqual(untranslated, testCase.untranslated) {
+			t.Errorf("Test case %d: expected untranslated settings to be %q, but got %q", i, testCase.untranslated, untranslated)
+		}
+	}
+}
+
+func TestApplyLifecyclePolicy(t *testing.T) {
+	repoName := "repo-name"
+	policy, _ := (&CleanupTask{MaxImages: 10}).LifecyclePolicy()
+
+	awsClient := &mockAWSECRClient{t: t, expectedRepositoryNames: []string{repoName}}
+	task := &CleanupTask{
+		EcrRepositories: []*string{&repoName},
+		Logger:          &mockLogger{},
+	}
+
+	ecrClients := []RegionalECRClient{{Region: "us-east-1", Client: &ECRClientImpl{ECRClient: awsClient}}}
+	if err := task.ApplyLifecyclePolicy(ecrClients, policy); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	// The mock lists the repository once on each of its two pages
+	if len(awsClient.putLifecyclePolicyInputs) != 2 {
+		t.Fatalf("Expected 2 calls to PutLifecyclePolicy, but got %d", len(awsClient.putLifecyclePolicyInputs))
+	}
+
+	input := awsClient.putLifecyclePolicyInputs[0]
+	applied := &LifecyclePolicy{}
+	if err := json.Unmarshal([]byte(*input.LifecyclePolicyText), applied); err != nil {
+		t.Fatalf("Expected the policy to be valid JSON, but got %v", err)
+	}
+
+	if *input.RepositoryName != repoName || !reflect.DeepEqual(applied, policy) {
+		t.Errorf("Expected policy %+v to be set on '%s', but got %+v on '%s'", policy, repoName, applied, *input.RepositoryName)
+	}
+
+	// Failures are reported, along with the region
+	awsClient.outputError = fmt.Errorf("AccessDeniedException")
+	if err := task.ApplyLifecyclePolicy(ecrClients, policy); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+}
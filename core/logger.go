@@ -0,0 +1,227 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Formats of the messages logged by loggers returned by NewLogger
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Minimum levels of the messages logged by loggers returned by NewLogger
+const (
+	LogLevelInfo    = "info"
+	LogLevelWarning = "warning"
+	LogLevelError   = "error"
+)
+
+// logLevels orders the log levels by severity.
+var logLevels = map[string]int{
+	LogLevelInfo:    0,
+	LogLevelWarning: 1,
+	LogLevelError:   2,
+}
+
+// Logger defines the expected interface of any object capable of logging the
+// progress of the clean-up code, so that programs embedding this package can
+// plug in their own logging.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// FieldLogger may be implemented by loggers supporting structured fields, so
+// that the reconcile ID of each pass is attached to the messages as a field,
+// instead of being prepended to them.
+type FieldLogger interface {
+	Logger
+	WithField(key, value string) Logger
+}
+
+// Name of the field holding the ID of the pass a message was logged from
+const ReconcileIDField = "reconcile_id"
+
+// WithField returns a logger that attaches the given field to the messages
+// logged through the given logger.
+func WithField(logger Logger, key, value string) Logger {
+	if fieldLogger, ok := logger.(FieldLogger); ok {
+		return fieldLogger.WithField(key, value)
+	}
+	return prefixLogger{Logger: logger, prefix: fieldPrefix(key, value)}
+}
+
+// fieldPrefix returns the prefix standing for the given field in loggers
+// without support for structured fields.
+func fieldPrefix(key, value string) string {
+	return fmt.Sprintf("[%s=%s] ", key, value)
+}
+
+// prefixLogger prepends a prefix to the messages logged through the wrapped
+// logger.
+type prefixLogger struct {
+	Logger
+	prefix string
+}
+
+func (l prefixLogger) Infof(format string, args ...interface{}) {
+	l.Logger.Infof("%s%s", l.prefix, fmt.Sprintf(format, args...))
+}
+
+func (l prefixLogger) Warningf(format string, args ...interface{}) {
+	l.Logger.Warningf("%s%s", l.prefix, fmt.Sprintf(format, args...))
+}
+
+func (l prefixLogger) Errorf(format string, args ...interface{}) {
+	l.Logger.Errorf("%s%s", l.prefix, fmt.Sprintf(format, args...))
+}
+
+// NewLogger returns a logger for the given format, either `LogFormatText`,
+// which logs via glog, or `LogFormatJSON`, which writes each message as a JSON
+// object on a line of its own to out, along with its fields. Messages below
+// the given level are left out.
+func NewLogger(format, level string, out io.Writer) (Logger, error) {
+	minLevel, ok := logLevels[level]
+	if !ok {
+		return nil, fmt.Errorf("Unknown log level '%s'", level)
+	}
+
+	switch format {
+	case LogFormatText:
+		return glogLogger{level: minLevel}, nil
+	case LogFormatJSON:
+		return jsonLogger{out: out, mutex: &sync.Mutex{}, level: minLevel}, nil
+	default:
+		return nil, fmt.Errorf("Unknown log format '%s'", format)
+	}
+}
+
+// glogLogger is the default logger, which logs via glog. Fields are prepended
+// to the messages.
+type glogLogger struct {
+	prefix string
+	level  int
+}
+
+func (l glogLogger) Infof(format string, args ...interface{}) {
+	if l.level <= logLevels[LogLevelInfo] {
+		glog.InfoDepth(1, l.prefix+fmt.Sprintf(format, args...))
+	}
+}
+
+func (l glogLogger) Warningf(format string, args ...interface{}) {
+	if l.level <= logLevels[LogLevelWarning] {
+		glog.WarningDepth(1, l.prefix+fmt.Sprintf(format, args...))
+	}
+}
+
+func (l glogLogger) Errorf(format string, args ...interface{}) {
+	glog.ErrorDepth(1, l.prefix+fmt.Sprintf(format, args...))
+}
+
+func (l glogLogger) WithField(key, value string) Logger {
+	return glogLogger{prefix: l.prefix + fieldPrefix(key, value), level: l.level}
+}
+
+// jsonLogger writes each message as a JSON object, holding its time, level,
+// text and fields, on a line of its own.
+type jsonLogger struct {
+	out    io.Writer
+	mutex  *sync.Mutex
+	level  int
+	fields map[string]string
+}
+
+func (l jsonLogger) Infof(format string, args ...interface{}) {
+	l.write(LogLevelInfo, format, args...)
+}
+
+func (l jsonLogger) Warningf(format string, args ...interface{}) {
+	l.write(LogLevelWarning, format, args...)
+}
+
+func (l jsonLogger) Errorf(format string, args ...interface{}) {
+	l.write(LogLevelError, format, args...)
+}
+
+func (l jsonLogger) WithField(key, value string) Logger {
+	fields := map[string]string{key: value}
+	for k, v := range l.fields {
+		if k != key {
+			fields[k] = v
+		}
+	}
+	return jsonLogger{out: l.out, mutex: l.mutex, level: l.level, fields: fields}
+}
+
+func (l jsonLogger) write(level, format string, args ...interface{}) {
+	if logLevels[level] < l.level {
+		return
+	}
+
+	entry := map[string]string{}
+	for key, value := range l.fields {
+		entry[key] = value
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["msg"] = fmt.Sprintf(format, args...)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.out.Write(append(data, '\n'))
+}
+
+// withDetails attaches the given key and value pairs as fields to the given
+// logger, but only if it keeps fields apart from the messages, such as the
+// JSON logger does, since the messages already tell the same.
+func withDetails(logger Logger, keysAndValues ...string) Logger {
+	if _, ok := logger.(glogLogger); ok {
+		return logger
+	}
+	if _, ok := logger.(FieldLogger); !ok {
+		return logger
+	}
+
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		logger = WithField(logger, keysAndValues[i], keysAndValues[i+1])
+	}
+	return logger
+}
+
+// loggerHolder holds the logger of the running pass, since atomic.Value
+// cannot hold nil.
+type loggerHolder struct {
+	Logger
+}
+
+// log returns the logger of this task, falling back to glog. While a pass is
+// running, the messages carry the ID of that pass.
+func (t *CleanupTask) log() Logger {
+	if holder, ok := t.passLogger.Load().(loggerHolder); ok && holder.Logger != nil {
+		return holder.Logger
+	}
+	return t.baseLog()
+}
+
+// baseLog returns the logger of this task, falling back to glog, regardless
+// of the running pass.
+func (t *CleanupTask) baseLog() Logger {
+	if t.Logger == nil {
+		return glogLogger{}
+	}
+	return t.Logger
+}
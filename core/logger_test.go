@@ -0,0 +1,89 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	testCases := []struct {
+		format string
+		level  string
+		ok     bool
+	}{
+		{format: LogFormatText, level: LogLevelInfo, ok: true},
+		{format: LogFormatJSON, level: LogLevelError, ok: true},
+		{format: "xml", level: LogLevelInfo, ok: false},
+		{format: LogFormatJSON, level: "debug", ok: false},
+	}
+
+	for _, testCase := range testCases {
+		_, err := NewLogger(testCase.format, testCase.level, &bytes.Buffer{})
+
+		if (err == nil) != testCase.ok {
+			t.Errorf("Expected NewLogger('%s', '%s') to succeed to be %t, but got error %v", testCase.format, testCase.level, testCase.ok, err)
+		}
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	out := &bytes.Buffer{}
+	logger, _ := NewLogger(LogFormatJSON, LogLevelWarning, out)
+
+	logger = WithField(logger, ReconcileIDField, "id")
+	logger.Infof("left out")
+	logger.Warningf("kept %d", 1)
+	WithField(logger, "repo", "repo-1").Errorf("kept %d", 2)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines to be logged, but got %d: %q", len(lines), lines)
+	}
+
+	expected := []map[string]string{
+		{"level": "warning", "msg": "kept 1", "reconcile_id": "id"},
+		{"level": "error", "msg": "kept 2", "reconcile_id": "id", "repo": "repo-1"},
+	}
+
+	for i, line := range lines {
+		entry := map[string]string{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Expected line %d to be JSON, but got %v", i, err)
+		}
+
+		if entry["time"] == "" {
+			t.Errorf("Expected line %d to have a time, but it did not", i)
+		}
+		delete(entry, "time")
+
+		if len(entry) != len(expected[i]) {
+			t.Errorf("Expected line %d to be %v, but was %v", i, expected[i], entry)
+		}
+		for key, value := range expected[i] {
+			if entry[key] != value {
+				t.Errorf("Expected field '%s' of line %d to be '%s', but was '%s'", key, i, value, entry[key])
+			}
+		}
+	}
+}
+
+func TestWithDetails(t *testing.T) {
+	out := &bytes.Buffer{}
+	jsonLog, _ := NewLogger(LogFormatJSON, LogLevelInfo, out)
+
+	withDetails(jsonLog, "repo", "repo-1", "action", PlanActionDeleted).Infof("message")
+
+	entry := map[string]string{}
+	json.Unmarshal(out.Bytes(), &entry)
+	if entry["repo"] != "repo-1" || entry["action"] != PlanActionDeleted {
+		t.Errorf("Expected details to be attached as fields, but got %v", entry)
+	}
+
+	// The text logger would only repeat the message
+	textLog, _ := NewLogger(LogFormatText, LogLevelInfo, nil)
+	if logger := withDetails(textLog, "repo", "repo-1"); logger != textLog {
+		t.Errorf("Expected details not to be attached to the text logger, but they were")
+	}
+}
@@ -0,0 +1,127 @@
+package core
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	imagesScannedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ecr_cleanup_images_scanned_total",
+			Help: "Number of images found in ECR repositories.",
+		},
+		[]string{"repository"},
+	)
+
+	imagesDeletedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ecr_cleanup_images_deleted_total",
+			Help: "Number of images deleted from ECR repositories.",
+		},
+		[]string{"repository"},
+	)
+
+	imageDeletionErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ecr_cleanup_image_deletion_errors_total",
+			Help: "Number of images that could not be deleted from ECR repositories.",
+		},
+		[]string{"repository"},
+	)
+
+	repositoriesProcessedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ecr_cleanup_repositories_processed_total",
+			Help: "Number of ECR repositories processed by cleanup passes.",
+		},
+	)
+
+	skippedReconcilesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ecr_cleanup_skipped_reconciles_total",
+			Help: "Number of cleanup passes skipped because the previous one was still running.",
+		},
+	)
+
+	repositoriesDiscovered = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ecr_cleanup_repositories_discovered",
+			Help: "Number of ECR repositories found in the last cleanup pass.",
+		},
+	)
+
+	repositoriesOrphaned = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ecr_cleanup_orphaned_repositories",
+			Help: "Number of ECR repositories found to be orphaned in the last cleanup pass.",
+		},
+	)
+
+	repositoriesDeletedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ecr_cleanup_repositories_deleted_total",
+			Help: "Number of empty orphaned ECR repositories deleted.",
+		},
+	)
+
+	repositoriesSuspended = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ecr_cleanup_suspended_repositories",
+			Help: "Number of ECR repositories skipped in the last cleanup pass because they kept failing.",
+		},
+	)
+
+	repositorySuspensionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ecr_cleanup_repository_suspensions_total",
+			Help: "Number of times ECR repositories were suspended because they kept failing.",
+		},
+		[]string{"repository"},
+	)
+
+	imagesInUse = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ecr_cleanup_images_in_use",
+			Help: "Number of ECR image tags found to be in use in the last cleanup pass.",
+		},
+	)
+
+	reconcileDurationSeconds = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "ecr_cleanup_reconcile_duration_seconds",
+			Help:    "Duration of the cleanup passes.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+		},
+	)
+
+	leader = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ecr_cleanup_leader",
+			Help: "Whether this replica holds the lead, when leader election is enabled.",
+		},
+	)
+
+	lastReconcileTimestampSeconds = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ecr_cleanup_last_reconcile_timestamp_seconds",
+			Help: "Time the last cleanup pass finished, as seconds since the Unix epoch.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(imagesScannedTotal)
+	prometheus.MustRegister(imagesDeletedTotal)
+	prometheus.MustRegister(imageDeletionErrorsTotal)
+	prometheus.MustRegister(repositoriesProcessedTotal)
+	prometheus.MustRegister(skippedReconcilesTotal)
+	prometheus.MustRegister(repositoriesDiscovered)
+	prometheus.MustRegister(repositoriesOrphaned)
+	prometheus.MustRegister(repositoriesDeletedTotal)
+	prometheus.MustRegister(repositoriesSuspended)
+	prometheus.MustRegister(repositorySuspensionsTotal)
+	prometheus.MustRegister(imagesInUse)
+	prometheus.MustRegister(reconcileDurationSeconds)
+	prometheus.MustRegister(lastReconcileTimestampSeconds)
+	prometheus.MustRegister(leader)
+}
@@ -0,0 +1,81 @@
+package core
+
+import (
+	"path"
+	"strings"
+)
+
+// IsNamespacePattern tells whether the given namespace holds wildcards, such
+// as `preview-*`, and thus stands for all the namespaces it matches.
+func IsNamespacePattern(namespace string) bool {
+	return strings.ContainsAny(namespace, "*?[")
+}
+
+// MatchesNamespace tells whether the given namespace matches any of the given
+// names, which may contain wildcards.
+func MatchesNamespace(patterns []*string, namespace string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(*pattern, namespace); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterNamespaces returns the given namespaces that match any of the given
+// include patterns, but none of the given exclude patterns.
+func FilterNamespaces(namespaces []string, include, exclude []*string) []*string {
+	filtered := []*string{}
+
+	for i := range namespaces {
+		if MatchesNamespace(include, namespaces[i]) && !MatchesNamespace(exclude, namespaces[i]) {
+			filtered = append(filtered, &namespaces[i])
+		}
+	}
+
+	return filtered
+}
+
+// excludeNamespaces returns the given namespaces, except for the ones
+// matching any of the given exclude patterns.
+func excludeNamespaces(namespaces, exclude []*string) []*string {
+	filtered := []*string{}
+
+	for _, namespace := range namespaces {
+		if !MatchesNamespace(exclude, *namespace) {
+			filtered = append(filtered, namespace)
+		}
+	}
+
+	return filtered
+}
+
+// hasNamespacePatterns tells whether any of the given namespaces holds
+// wildcards.
+func hasNamespacePatterns(namespaces []*string) bool {
+	for _, namespace := range namespaces {
+		if IsNamespacePattern(*namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// scannedNamespaces returns the namespaces whose workloads are looked at to
+// find out which images are in use, which are the ones given by
+// `KubeNamespaces` and the given policies, except for the ones matching
+// `ExcludeNamespaces`. The namespaces of the cluster are only listed if
+// `KubeNamespaces` holds wildcards.
+func (t *CleanupTask) scannedNamespaces(kubeClient KubernetesClient, policies []*CleanupPolicy) ([]*string, error) {
+	namespaces := t.KubeNamespaces
+
+	if hasNamespacePatterns(namespaces) {
+		clusterNamespaces, err := kubeClient.ListNamespaces()
+		if err != nil {
+			return nil, err
+		}
+		namespaces = FilterNamespaces(clusterNamespaces, namespaces, nil)
+	}
+
+	return excludeNamespaces(policyNamespaces(namespaces, policies), t.ExcludeNamespaces), nil
+}
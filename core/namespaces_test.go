@@ -0,0 +1,84 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestFilterNamespaces(t *testing.T) {
+	all, teams, previews := "*", "team-*", "preview-*"
+	namespaces := []string{"default", "team-a", "team-b", "preview-123", "kube-system"}
+
+	testCases := []struct {
+		include  []*string
+		exclude  []*string
+		expected []string
+	}{
+		{include: []*string{&all}, expected: namespaces},
+		{include: []*string{&all}, exclude: []*string{&previews}, expected: []string{"default", "team-a", "team-b", "kube-system"}},
+		{include: []*string{&teams}, expected: []string{"team-a", "team-b"}},
+		{include: []*string{&teams}, exclude: []*string{&all}, expected: []string{}},
+	}
+
+	for i, testCase := range testCases {
+		actual := []string{}
+		for _, namespace := range FilterNamespaces(namespaces, testCase.include, testCase.exclude) {
+			actual = append(actual, *namespace)
+		}
+
+		if !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Test case %d: expected namespaces to be %+v, but were %+v", i, testCase.expected, actual)
+		}
+	}
+}
+
+func TestScannedNamespaces(t *testing.T) {
+	all, teamA, previews := "*", "team-a", "preview-*"
+	policies := []*CleanupPolicy{
+		{Spec: CleanupPolicySpec{Namespaces: []string{"team-b", "preview-456"}}},
+	}
+
+	testCases := []struct {
+		namespaces        []*string
+		excludeNamespaces []*string
+		listError         error
+		expected          []string
+		err               bool
+	}{
+		// The namespaces of the cluster are only listed for wildcards
+		{namespaces: []*string{&teamA}, listError: fmt.Errorf("forbidden"), expected: []string{"team-a", "team-b", "preview-456"}},
+		{namespaces: []*string{&teamA}, excludeNamespaces: []*string{&previews}, expected: []string{"team-a", "team-b"}},
+		{namespaces: []*string{&all}, excludeNamespaces: []*string{&previews}, expected: []string{"team-a", "kube-system", "team-b"}},
+		{namespaces: []*string{&all}, listError: fmt.Errorf("forbidden"), err: true},
+	}
+
+	for i, testCase := range testCases {
+		kubeClient := &mockKubeClient{
+			t: t,
+
+			listNamespacesResult: []string{"team-a", "preview-123", "kube-system"},
+			listNamespacesError:  testCase.listError,
+		}
+
+		task := &CleanupTask{
+			KubeNamespaces:    testCase.namespaces,
+			ExcludeNamespaces: testCase.excludeNamespaces,
+		}
+
+		namespaces, err := task.scannedNamespaces(kubeClient, policies)
+		if (err != nil) != testCase.err {
+			t.Errorf("Test case %d: expected error to be %t, but got %v", i, testCase.err, err)
+			continue
+		}
+
+		actual := []string{}
+		for _, namespace := range namespaces {
+			actual = append(actual, *namespace)
+		}
+
+		if !testCase.err && !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Test case %d: expected namespaces to be %+v, but were %+v", i, testCase.expected, actual)
+		}
+	}
+}
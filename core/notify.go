@@ -0,0 +1,110 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Notifier defines the expected interface of any object capable of sending a
+// summary of a clean-up pass somewhere, such as a chat channel.
+type Notifier interface {
+	Notify(result *ReconcileResult) error
+}
+
+type WebhookNotifierImpl struct {
+	HTTPClient *http.Client
+
+	// URL the summaries are posted to.
+	URL string
+
+	// Whether the passes only report which images would be deleted.
+	DryRun bool
+}
+
+// NewWebhookNotifier returns a new notifier posting the summaries of the
+// passes to the given webhook URL, as Slack-compatible JSON payloads.
+func NewWebhookNotifier(url string, dryRun bool) *WebhookNotifierImpl {
+	return &WebhookNotifierImpl{
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		URL:        url,
+		DryRun:     dryRun,
+	}
+}
+
+// Notify posts the summary of the given pass as a `{"text": "..."}` payload,
+// which Slack incoming webhooks, among others, understand.
+func (n *WebhookNotifierImpl) Notify(result *ReconcileResult) error {
+	body, err := json.Marshal(map[string]string{
+		"text": NotificationText(result, n.DryRun),
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.HTTPClient.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook responded with status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// NotificationText returns the summary of the given pass, which only reports
+// which images would be deleted if dryRun is true.
+func NotificationText(result *ReconcileResult, dryRun bool) string {
+	lines := []string{}
+
+	status := "succeeded"
+	if result.Failed() {
+		status = "failed"
+	}
+	lines = append(lines, fmt.Sprintf("ECR cleanup pass %s %s.", result.ReconcileID, status))
+
+	lines = append(lines, fmt.Sprintf("Repos processed: %d", result.RepositoriesProcessed))
+	if dryRun {
+		lines = append(lines, fmt.Sprintf("Images that would be deleted: %d", result.ImagesSelected))
+	} else {
+		lines = append(lines, fmt.Sprintf("Images deleted: %d", result.ImagesDeleted))
+		lines = append(lines, fmt.Sprintf("Bytes reclaimed: %d", result.BytesDeleted))
+	}
+
+	if len(result.Errors) > 0 {
+		lines = append(lines, fmt.Sprintf("Errors: %d", len(result.Errors)))
+		for _, err := range result.Errors {
+			lines = append(lines, fmt.Sprintf("- %v", err))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// notify sends the summary of the given pass through `Notifier`, if any,
+// unless `NotifyOn` says the pass is not worth it. Failing to send it is only
+// logged.
+func (t *CleanupTask) notify(result *ReconcileResult) {
+	// The notification settings can be reloaded once the pass is over
+	t.settingsMutex.RLock()
+	notifier, notifyOn := t.Notifier, t.NotifyOn
+	t.settingsMutex.RUnlock()
+
+	if notifier == nil || result.Skipped {
+		return
+	}
+
+	if notifyOn == NotifyOnErrors && !result.Failed() {
+		return
+	}
+
+	if err := notifier.Notify(result); err != nil {
+		WithField(t.baseLog(), ReconcileIDField, result.ReconcileID).Errorf("Cannot send notification: %v", err)
+	}
+}
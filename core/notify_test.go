@@ -0,0 +1,133 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type mockNotifier struct {
+	notified []*ReconcileResult
+	err      error
+}
+
+func (m *mockNotifier) Notify(result *ReconcileResult) error {
+	m.notified = append(m.notified, result)
+	return m.err
+}
+
+func TestNotificationText(t *testing.T) {
+	testCases := []struct {
+		result   *ReconcileResult
+		dryRun   bool
+		expected string
+	}{
+		// Successful pass
+		{
+			result: &ReconcileResult{
+				ReconcileID:           "id",
+				RepositoriesProcessed: 3,
+				ImagesSelected:        5,
+				ImagesDeleted:         4,
+				BytesDeleted:          1024,
+			},
+			expected: "ECR cleanup pass id succeeded.\nRepos processed: 3\nImages deleted: 4\nBytes reclaimed: 1024",
+		},
+
+		// Dry run
+		{
+			result: &ReconcileResult{
+				ReconcileID:           "id",
+				RepositoriesProcessed: 3,
+				ImagesSelected:        5,
+			},
+			dryRun:   true,
+			expected: "ECR cleanup pass id succeeded.\nRepos processed: 3\nImages that would be deleted: 5",
+		},
+
+		// Failed pass
+		{
+			result: &ReconcileResult{
+				ReconcileID: "id",
+				Errors:      []error{fmt.Errorf("first"), fmt.Errorf("second")},
+			},
+			expected: "ECR cleanup pass id failed.\nRepos processed: 0\nImages deleted: 0\nBytes reclaimed: 0\nErrors: 2\n- first\n- second",
+		},
+	}
+
+	for i, testCase := range testCases {
+		text := NotificationText(testCase.result, testCase.dryRun)
+
+		if text != testCase.expected {
+			t.Errorf("Test case %d: expected notification text to be %q, but was %q", i, testCase.expected, text)
+		}
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var payload map[string]string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	result := &ReconcileResult{ReconcileID: "id", ImagesDeleted: 2}
+	if err := NewWebhookNotifier(server.URL, false).Notify(result); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	if expected := NotificationText(result, false); payload["text"] != expected {
+		t.Errorf("Expected posted text to be %q, but was %q", expected, payload["text"])
+	}
+}
+
+func TestWebhookNotifierWithErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	err := NewWebhookNotifier(server.URL, false).Notify(&ReconcileResult{})
+
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Expected an error about the 403 status, but got %v", err)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	succeeded := &ReconcileResult{}
+	failed := &ReconcileResult{Errors: []error{fmt.Errorf("error")}}
+	skipped := &ReconcileResult{Skipped: true}
+
+	testCases := []struct {
+		notifyOn string
+		result   *ReconcileResult
+		expected bool
+	}{
+		{notifyOn: NotifyOnAlways, result: succeeded, expected: true},
+		{notifyOn: NotifyOnAlways, result: failed, expected: true},
+		{notifyOn: NotifyOnAlways, result: skipped, expected: false},
+		{notifyOn: NotifyOnErrors, result: succeeded, expected: false},
+		{notifyOn: NotifyOnErrors, result: failed, expected: true},
+	}
+
+	for i, testCase := range testCases {
+		notifier := &mockNotifier{err: fmt.Errorf("cannot notify")}
+		task := &CleanupTask{
+			Notifier: notifier,
+			NotifyOn: testCase.notifyOn,
+		}
+
+		task.notify(testCase.result)
+
+		if notified := len(notifier.notified) == 1; notified != testCase.expected {
+			t.Errorf("Test case %d: expected notified to be %t, but was %t", i, testCase.expected, notified)
+		}
+	}
+}
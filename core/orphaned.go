@@ -0,0 +1,104 @@
+package core
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// RepositoryDeletionClient defines the expected interface of any object
+// capable of deleting ECR repositories.
+type RepositoryDeletionClient interface {
+	DeleteRepository(repositoryName *string) error
+}
+
+// DeleteRepository deletes the repository with the given name, which ECR
+// refuses to do if it still holds any images.
+func (c *ECRClientImpl) DeleteRepository(repositoryName *string) error {
+	defer c.images.invalidate(aws.StringValue(repositoryName))
+
+	_, err := c.api(repositoryName).DeleteRepositoryWithContext(c.requestContext(), &ecr.DeleteRepositoryInput{
+		RepositoryName: repositoryName,
+	})
+	return err
+}
+
+// orphanedReason returns why the given repository, holding the given images,
+// of which the given tags are in use, and of which the given images were
+// recently pulled, is orphaned as of now, or an empty string if it is not.
+// Repositories are orphaned when none of their images were in use, pushed or
+// pulled in the given number of days, or when they are empty and were created
+// longer ago than that, since ECR does not tell when their last images were
+// deleted.
+func orphanedReason(repo *ecr.Repository, images []*ecr.ImageDetail, tagsInUse []string, recentlyPulled map[string]bool, days int, now time.Time) string {
+	since := now.AddDate(0, 0, -days)
+
+	if len(images) == 0 {
+		if repo.CreatedAt == nil || repo.CreatedAt.After(since) {
+			return ""
+		}
+		return fmt.Sprintf("is empty, and was created more than %d days ago", days)
+	}
+
+	if len(recentlyPulled) > 0 {
+		return ""
+	}
+
+	for _, image := range images {
+		if isImageInUse(image, tagsInUse) {
+			return ""
+		}
+		if image.ImagePushedAt != nil && image.ImagePushedAt.After(since) {
+			return ""
+		}
+		if image.LastRecordedPullTime != nil && image.LastRecordedPullTime.After(since) {
+			return ""
+		}
+	}
+
+	return fmt.Sprintf("has had no images in use, pushed or pulled in the last %d days", days)
+}
+
+// handleOrphanedRepositories reports the given orphaned repositories of the
+// given region, and deletes the empty ones if `DeleteEmptyRepositories` is
+// set, recording the outcome in the given result.
+func (t *CleanupTask) handleOrphanedRepositories(region string, ecrClient ECRClient, selections []*repositorySelection, result *ReconcileResult) {
+	for _, selection := range selections {
+		repoName := aws.StringValue(selection.repo.RepositoryName)
+
+		result.RepositoriesOrphaned++
+		result.Plan.SetRepositoryOrphaned(region, repoName, selection.orphaned)
+
+		if !t.DeleteEmptyRepositories || len(selection.images) > 0 {
+			t.log().Warningf("'%s' ECR repo in '%s' region is orphaned, since it %s.", repoName, region, selection.orphaned)
+			continue
+		}
+
+		if t.DryRun {
+			t.log().Infof("Would delete '%s' ECR repo, which %s, if not for a dry run.", repoName, selection.orphaned)
+			continue
+		}
+
+		var err error
+		if deletionClient, ok := ecrClient.(RepositoryDeletionClient); ok {
+			err = deletionClient.DeleteRepository(selection.repo.RepositoryName)
+		} else {
+			err = fmt.Errorf("ECR client cannot delete repositories")
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, &RepositoryError{
+				Region:     region,
+				Repository: repoName,
+				Message:    "Could not delete orphaned repository",
+				Err:        err,
+			})
+			continue
+		}
+
+		t.log().Infof("Deleted '%s' ECR repo, which %s.", repoName, selection.orphaned)
+		result.RepositoriesDeleted++
+		repositoriesDeletedTotal.Inc()
+	}
+}
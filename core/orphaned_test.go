@@ -0,0 +1,145 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// mockRepositoryDeletionECRClient records the repositories it is asked to
+// delete.
+type mockRepositoryDeletionECRClient struct {
+	ECRClient
+
+	deletedRepositories []string
+	outputError         error
+}
+
+func (m *mockRepositoryDeletionECRClient) DeleteRepository(repositoryName *string) error {
+	if m.outputError != nil {
+		return m.outputError
+	}
+
+	m.deletedRepositories = append(m.deletedRepositories, aws.StringValue(repositoryName))
+	return nil
+}
+
+func TestOrphanedReason(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	old := now.AddDate(0, 0, -60)
+	recent := now.AddDate(0, 0, -5)
+
+	oldRepo := &ecr.Repository{RepositoryName: aws.String("repo-1"), CreatedAt: &old}
+	newRepo := &ecr.Repository{RepositoryName: aws.String("repo-1"), CreatedAt: &recent}
+
+	testCases := []struct {
+		repo           *ecr.Repository
+		images         []*ecr.ImageDetail
+		tagsInUse      []string
+		recentlyPulled map[string]bool
+		expected       string
+	}{
+		// Empty repositories
+		{oldRepo, nil, nil, nil, "is empty, and was created more than 30 days ago"},
+		{newRepo, nil, nil, nil, ""},
+		{&ecr.Repository{RepositoryName: aws.String("repo-1")}, nil, nil, nil, ""},
+
+		// Repositories with old images only
+		{oldRepo, []*ecr.ImageDetail{{ImageTags: aws.StringSlice([]string{"v1"}), ImagePushedAt: &old}}, nil, nil, "has had no images in use, pushed or pulled in the last 30 days"},
+		{oldRepo, []*ecr.ImageDetail{{ImageTags: aws.StringSlice([]string{"v1"}), ImagePushedAt: &old}}, []string{"v1"}, nil, ""},
+		{oldRepo, []*ecr.ImageDetail{{ImageTags: aws.StringSlice([]string{"v1"}), ImagePushedAt: &old}}, nil, map[string]bool{"digest-1": true}, ""},
+		{oldRepo, []*ecr.ImageDetail{{ImageTags: aws.StringSlice([]string{"v1"}), ImagePushedAt: &old, LastRecordedPullTime: &recent}}, nil, nil, ""},
+
+		// Repositories with recent images
+		{oldRepo, []*ecr.ImageDetail{{ImagePushedAt: &old}, {ImagePushedAt: &recent}}, nil, nil, ""},
+	}
+
+	for i, testCase := range testCases {
+		reason := orphanedReason(testCase.repo, testCase.images, testCase.tagsInUse, testCase.recentlyPulled, 30, now)
+		if reason != testCase.expected {
+			t.Errorf("Test case %d: expected reason %q, but got %q", i, testCase.expected, reason)
+		}
+	}
+}
+
+func TestHandleOrphanedRepositories(t *testing.T) {
+	selections := []*repositorySelection{
+		{repo: &ecr.Repository{RepositoryName: aws.String("repo-empty")}, orphaned: "is empty"},
+		{repo: &ecr.Repository{RepositoryName: aws.String("repo-stale")}, images: []*ecr.ImageDetail{{}}, orphaned: "is stale"},
+	}
+
+	testCases := []struct {
+		task            *CleanupTask
+		outputError     error
+		expectedDeleted []string
+		expectedErrors  int
+	}{
+		{
+			task:            &CleanupTask{},
+			expectedDeleted: nil,
+		},
+		{
+			task:            &CleanupTask{DeleteEmptyRepositories: true, DryRun: true},
+			expectedDeleted: nil,
+		},
+		{
+			task:            &CleanupTask{DeleteEmptyRepositories: true},
+			expectedDeleted: []string{"repo-empty"},
+		},
+		{
+			task:           &CleanupTask{DeleteEmptyRepositories: true},
+			outputError:    fmt.Errorf("RepositoryNotEmptyException"),
+			expectedErrors: 1,
+		},
+	}
+
+	for i, testCase := range testCases {
+		client := &mockRepositoryDeletionECRClient{outputError: testCase.outputError}
+
+		result := &ReconcileResult{Plan: NewPlan()}
+		for _, selection := range selections {
+			result.Plan.AddRepository("us-east-1", selection.repo)
+		}
+
+		testCase.task.handleOrphanedRepositories("us-east-1", client, selections, result)
+
+		if !reflect.DeepEqual(client.deletedRepositories, testCase.expectedDeleted) {
+			t.Errorf("Test case %d: expected repos %v to be deleted, but got %v", i, testCase.expectedDeleted, client.deletedRepositories)
+		}
+
+		if result.RepositoriesOrphaned != 2 || result.RepositoriesDeleted != len(testCase.expectedDeleted) {
+			t.Errorf("Test case %d: expected 2 orphaned and %d deleted repos, but got %d and %d", i, len(testCase.expectedDeleted), result.RepositoriesOrphaned, result.RepositoriesDeleted)
+		}
+
+		if len(result.Errors) != testCase.expectedErrors {
+			t.Errorf("Test case %d: expected %d errors, but got %v", i, testCase.expectedErrors, result.Errors)
+		}
+
+		if result.Plan.Repositories[1].Orphaned != "is stale" {
+			t.Errorf("Test case %d: expected the plan to tell why 'repo-stale' is orphaned, but got %q", i, result.Plan.Repositories[1].Orphaned)
+		}
+	}
+}
+
+func TestDeleteRepository(t *testing.T) {
+	mock := &mockAWSECRClient{t: t}
+	client := &ECRClientImpl{ECRClient: mock}
+
+	if err := client.DeleteRepository(aws.String("repo-1")); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	// Repositories still holding images are never deleted along with them
+	if len(mock.deleteRepositoryInputs) != 1 || aws.StringValue(mock.deleteRepositoryInputs[0].RepositoryName) != "repo-1" || aws.BoolValue(mock.deleteRepositoryInputs[0].Force) {
+		t.Errorf("Expected 'repo-1' to be deleted without force, but got %v", mock.deleteRepositoryInputs)
+	}
+
+	mock.outputError = fmt.Errorf("RepositoryNotEmptyException")
+	if err := client.DeleteRepository(aws.String("repo-1")); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+}
@@ -0,0 +1,227 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// Plan lists the repositories processed during a cleanup pass, and the images
+// selected for deletion from them.
+type Plan struct {
+	ReconcileID  string           `json:"reconcileId,omitempty"`
+	Repositories []PlanRepository `json:"repositories"`
+	Images       []PlanImage      `json:"images"`
+}
+
+// PlanRepository describes a repository processed during a cleanup pass.
+type PlanRepository struct {
+	Region         string `json:"region,omitempty"`
+	Name           string `json:"name"`
+	EncryptionType string `json:"encryptionType"`
+	KmsKey         string `json:"kmsKey,omitempty"`
+
+	// Number of images retained by the `MaxImages` rule, by reason.
+	Retained map[string]int `json:"retained,omitempty"`
+
+	// Number of images in the repository, and their total size, as reported
+	// by ECR.
+	ImageCount  int   `json:"imageCount,omitempty"`
+	SizeInBytes int64 `json:"sizeInBytes,omitempty"`
+
+	// Why the repository is orphaned, when `OrphanedRepositoryDays` is set.
+	Orphaned string `json:"orphaned,omitempty"`
+}
+
+// Outcomes of the images selected for deletion
+const (
+	PlanActionDeleted     = "deleted"
+	PlanActionRetained    = "retained"
+	PlanActionWouldDelete = "would-delete"
+)
+
+// PlanImage describes an image selected for deletion, and what happened to it.
+// Images are retained when they could not be deleted, or when they were
+// quarantined instead.
+type PlanImage struct {
+	Region      string     `json:"region,omitempty"`
+	Repository  string     `json:"repository"`
+	Digest      string     `json:"digest"`
+	Tags        []string   `json:"tags,omitempty"`
+	PushedAt    *time.Time `json:"pushedAt,omitempty"`
+	SizeInBytes *int64     `json:"sizeInBytes,omitempty"`
+	Action      string     `json:"action"`
+}
+
+// PlanDiff describes the differences between two plans. Images are compared
+// by region, repository and digest.
+type PlanDiff struct {
+
+	// Images present in the current plan, but not in the previous one.
+	Added []PlanImage
+
+	// Images present in the previous plan, but not in the current one.
+	Removed []PlanImage
+
+	// Images present in both plans.
+	Unchanged []PlanImage
+}
+
+// NewPlan returns an empty plan.
+func NewPlan() *Plan {
+	return &Plan{
+		Repositories: []PlanRepository{},
+		Images:       []PlanImage{},
+	}
+}
+
+// AddRepository adds the given repository of the given region to the plan,
+// along with its encryption configuration. Repositories without an encryption
+// configuration are reported as using AES256, which is what ECR defaults to.
+func (p *Plan) AddRepository(region string, repo *ecr.Repository) {
+	planRepo := PlanRepository{
+		Region:         region,
+		Name:           aws.StringValue(repo.RepositoryName),
+		EncryptionType: ecr.EncryptionTypeAes256,
+	}
+
+	if config := repo.EncryptionConfiguration; config != nil {
+		if config.EncryptionType != nil {
+			planRepo.EncryptionType = *config.EncryptionType
+		}
+		planRepo.KmsKey = aws.StringValue(config.KmsKey)
+	}
+
+	p.Repositories = append(p.Repositories, planRepo)
+}
+
+// AddRetainedImages counts the given retained images towards the given
+// repository of the given region, which must have been added to the plan
+// already.
+func (p *Plan) AddRetainedImages(region, repositoryName string, images []RetainedImage) {
+	for i := range p.Repositories {
+		if p.Repositories[i].Region != region || p.Repositories[i].Name != repositoryName {
+			continue
+		}
+
+		for _, image := range images {
+			if p.Repositories[i].Retained == nil {
+				p.Repositories[i].Retained = map[string]int{}
+			}
+			p.Repositories[i].Retained[image.Reason]++
+		}
+	}
+}
+
+// SetRepositoryOrphaned records why the given repository of the given region
+// is orphaned. The repository must have been added to the plan already.
+func (p *Plan) SetRepositoryOrphaned(region, repositoryName, reason string) {
+	for i := range p.Repositories {
+		if p.Repositories[i].Region == region && p.Repositories[i].Name == repositoryName {
+			p.Repositories[i].Orphaned = reason
+		}
+	}
+}
+
+// AddRepositoryImages counts the given images, which are all the images of
+// the given repository of the given region, towards its size. The repository
+// must have been added to the plan already.
+func (p *Plan) AddRepositoryImages(region, repositoryName string, images []*ecr.ImageDetail) {
+	for i := range p.Repositories {
+		if p.Repositories[i].Region != region || p.Repositories[i].Name != repositoryName {
+			continue
+		}
+
+		for _, image := range images {
+			p.Repositories[i].ImageCount++
+			p.Repositories[i].SizeInBytes += aws.Int64Value(image.ImageSizeInBytes)
+		}
+	}
+}
+
+// AddImages adds the given images from the given repository of the given
+// region to the plan, along with what happened to them.
+func (p *Plan) AddImages(region, repositoryName string, images []*ecr.ImageDetail, action string) {
+	for _, image := range images {
+		tags := make([]string, len(image.ImageTags))
+		for i := range image.ImageTags {
+			tags[i] = *image.ImageTags[i]
+		}
+
+		p.Images = append(p.Images, PlanImage{
+			Region:      region,
+			Repository:  repositoryName,
+			Digest:      aws.StringValue(image.ImageDigest),
+			Tags:        tags,
+			PushedAt:    image.ImagePushedAt,
+			SizeInBytes: image.ImageSizeInBytes,
+			Action:      action,
+		})
+	}
+}
+
+// LoadPlan reads a plan previously written with WritePlan.
+func LoadPlan(path string) (*Plan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := NewPlan()
+	if err = json.Unmarshal(data, plan); err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+// WritePlan writes the given plan to the given path as JSON.
+func WritePlan(path string, plan *Plan) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// DiffPlans compares the given plans, so that the impact of changing the
+// retention settings between two runs can be assessed.
+func DiffPlans(previous, current *Plan) PlanDiff {
+	diff := PlanDiff{
+		Added:     []PlanImage{},
+		Removed:   []PlanImage{},
+		Unchanged: []PlanImage{},
+	}
+
+	key := func(image PlanImage) string {
+		return image.Region + "/" + image.Repository + "@" + image.Digest
+	}
+
+	previousImages := map[string]bool{}
+	for _, image := range previous.Images {
+		previousImages[key(image)] = true
+	}
+
+	currentImages := map[string]bool{}
+	for _, image := range current.Images {
+		currentImages[key(image)] = true
+
+		if previousImages[key(image)] {
+			diff.Unchanged = append(diff.Unchanged, image)
+		} else {
+			diff.Added = append(diff.Added, image)
+		}
+	}
+
+	for _, image := range previous.Images {
+		if !currentImages[key(image)] {
+			diff.Removed = append(diff.Removed, image)
+		}
+	}
+
+	return diff
+}
@@ -0,0 +1,223 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+func TestPlanAddImages(t *testing.T) {
+	digest, tag := "digest-1", "tag-1"
+	pushedAt, size := time.Unix(0, 0), int64(10)
+
+	plan := NewPlan()
+	plan.AddImages("us-east-1", "repo-1", []*ecr.ImageDetail{
+		{
+			ImageDigest:      &digest,
+			ImageTags:        []*string{&tag},
+			ImagePushedAt:    &pushedAt,
+			ImageSizeInBytes: &size,
+		},
+	}, PlanActionDeleted)
+
+	expected := []PlanImage{
+		{
+			Region:      "us-east-1",
+			Repository:  "repo-1",
+			Digest:      digest,
+			Tags:        []string{tag},
+			PushedAt:    &pushedAt,
+			SizeInBytes: &size,
+			Action:      PlanActionDeleted,
+		},
+	}
+
+	if !reflect.DeepEqual(plan.Images, expected) {
+		t.Errorf("Expected plan images to be %+v, but was %+v", expected, plan.Images)
+	}
+}
+
+func TestPlanAddRepository(t *testing.T) {
+	names := []string{"repo-1", "repo-2", "repo-3"}
+	kms, kmsKey := "KMS", "arn:aws:kms:us-east-1:123456789012:key/key-1"
+
+	plan := NewPlan()
+
+	// No encryption configuration
+	plan.AddRepository("us-east-1", &ecr.Repository{
+		RepositoryName: &names[0],
+	})
+
+	// KMS encryption
+	plan.AddRepository("us-east-1", &ecr.Repository{
+		RepositoryName: &names[1],
+		EncryptionConfiguration: &ecr.EncryptionConfiguration{
+			EncryptionType: &kms,
+			KmsKey:         &kmsKey,
+		},
+	})
+
+	// Empty encryption configuration
+	plan.AddRepository("us-east-1", &ecr.Repository{
+		RepositoryName:          &names[2],
+		EncryptionConfiguration: &ecr.EncryptionConfiguration{},
+	})
+
+	expected := []PlanRepository{
+		{
+			Region:         "us-east-1",
+			Name:           "repo-1",
+			EncryptionType: "AES256",
+		},
+		{
+			Region:         "us-east-1",
+			Name:           "repo-2",
+			EncryptionType: "KMS",
+			KmsKey:         kmsKey,
+		},
+		{
+			Region:         "us-east-1",
+			Name:           "repo-3",
+			EncryptionType: "AES256",
+		},
+	}
+
+	if !reflect.DeepEqual(plan.Repositories, expected) {
+		t.Errorf("Expected plan repositories to be %+v, but was %+v", expected, plan.Repositories)
+	}
+}
+
+func TestPlanAddRetainedImages(t *testing.T) {
+	repoName := "repo-1"
+
+	plan := NewPlan()
+	plan.AddRepository("us-east-1", &ecr.Repository{
+		RepositoryName: &repoName,
+	})
+
+	// Identically named repository in another region
+	plan.AddRepository("eu-west-1", &ecr.Repository{
+		RepositoryName: &repoName,
+	})
+
+	plan.AddRetainedImages("us-east-1", repoName, []RetainedImage{
+		{Reason: RetainReasonInUse},
+		{Reason: RetainReasonKeepMax},
+		{Reason: RetainReasonInUse},
+	})
+
+	expected := map[string]int{
+		RetainReasonInUse:   2,
+		RetainReasonKeepMax: 1,
+	}
+
+	if !reflect.DeepEqual(plan.Repositories[0].Retained, expected) {
+		t.Errorf("Expected retained images to be %v, but was %v", expected, plan.Repositories[0].Retained)
+	}
+
+	if plan.Repositories[1].Retained != nil {
+		t.Errorf("Expected no retained images in another region, but there were %v", plan.Repositories[1].Retained)
+	}
+}
+
+func TestPlanAddRepositoryImages(t *testing.T) {
+	repoName := "repo-1"
+	size1, size2 := int64(10), int64(32)
+
+	plan := NewPlan()
+	plan.AddRepository("us-east-1", &ecr.Repository{
+		RepositoryName: &repoName,
+	})
+
+	// Identically named repository in another region
+	plan.AddRepository("eu-west-1", &ecr.Repository{
+		RepositoryName: &repoName,
+	})
+
+	plan.AddRepositoryImages("us-east-1", repoName, []*ecr.ImageDetail{
+		{ImageSizeInBytes: &size1},
+		{ImageSizeInBytes: &size2},
+		{},
+	})
+
+	if repo := plan.Repositories[0]; repo.ImageCount != 3 || repo.SizeInBytes != 42 {
+		t.Errorf("Expected 3 images of 42 bytes, but got %d images of %d bytes", repo.ImageCount, repo.SizeInBytes)
+	}
+
+	if repo := plan.Repositories[1]; repo.ImageCount != 0 || repo.SizeInBytes != 0 {
+		t.Errorf("Expected no images in another region, but got %d images of %d bytes", repo.ImageCount, repo.SizeInBytes)
+	}
+}
+
+func TestWriteAndLoadPlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "plan.json")
+	plan := &Plan{
+		Repositories: []PlanRepository{
+			{Name: "repo-1", EncryptionType: "KMS", KmsKey: "key-1"},
+		},
+		Images: []PlanImage{
+			{Repository: "repo-1", Digest: "digest-1", Tags: []string{"tag-1"}},
+		},
+	}
+
+	if err = WritePlan(path, plan); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	loaded, err := LoadPlan(path)
+	if err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	if !reflect.DeepEqual(loaded, plan) {
+		t.Errorf("Expected loaded plan to be %+v, but was %+v", plan, loaded)
+	}
+}
+
+func TestLoadPlanError(t *testing.T) {
+	plan, err := LoadPlan("/does/not/exist.json")
+
+	if plan != nil {
+		t.Errorf("Expected plan to be nil, but was %+v", plan)
+	}
+
+	if err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+}
+
+func TestDiffPlans(t *testing.T) {
+	images := []PlanImage{
+		{Repository: "repo-1", Digest: "digest-1"},
+		{Repository: "repo-1", Digest: "digest-2"},
+		{Repository: "repo-1", Digest: "digest-3"},
+		{Repository: "repo-2", Digest: "digest-1"},
+		{Region: "eu-west-1", Repository: "repo-1", Digest: "digest-2"},
+	}
+
+	previous := &Plan{Images: []PlanImage{images[0], images[1]}}
+	current := &Plan{Images: []PlanImage{images[1], images[2], images[3], images[4]}}
+
+	expected := PlanDiff{
+		Added:     []PlanImage{images[2], images[3], images[4]},
+		Removed:   []PlanImage{images[0]},
+		Unchanged: []PlanImage{images[1]},
+	}
+
+	actual := DiffPlans(previous, current)
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected diff to be %+v, but was %+v", expected, actual)
+	}
+}
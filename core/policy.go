@@ -0,0 +1,252 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+)
+
+// API group, version and plural name of the `ECRCleanupPolicy` custom
+// resources.
+const (
+	CleanupPolicyGroup   = "ecr-cleanup.danielfm.github.io"
+	CleanupPolicyVersion = "v1"
+	CleanupPolicyPlural  = "ecrcleanuppolicies"
+)
+
+// CleanupPolicyPath is the API server path under which the `ECRCleanupPolicy`
+// resources of all namespaces are listed.
+const CleanupPolicyPath = "/apis/" + CleanupPolicyGroup + "/" + CleanupPolicyVersion + "/" + CleanupPolicyPlural
+
+// CleanupPolicy is an `ECRCleanupPolicy` resource, which overrides the
+// retention rules given by flags for the repositories it matches.
+type CleanupPolicy struct {
+	Namespace string
+	Name      string
+	Spec      CleanupPolicySpec
+
+	// Set if the spec is invalid, in which case the repositories matched by
+	// the policy are skipped, rather than cleaned up by the default rules
+	Err error
+
+	// Parsed `Spec.MaxAge`
+	maxAge time.Duration
+}
+
+// CleanupPolicySpec holds the retention rules of a CleanupPolicy. Rules that
+// are not set default to the ones given by flags.
+type CleanupPolicySpec struct {
+
+	// Names of the repositories the policy applies to, which may contain
+	// wildcards, such as `team-a/*`.
+	Repositories []string `json:"repositories"`
+
+	// Namespaces whose pods' images are also considered in use.
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// Overrides `MaxImages`.
+	KeepMax *int `json:"keepMax,omitempty"`
+
+	// Overrides `MaxImageAge`, e.g. "30d" or "720h".
+	MaxAge string `json:"maxAge,omitempty"`
+
+	// Tags that are never deleted, in addition to the ones in use.
+	ProtectedTags []string `json:"protectedTags,omitempty"`
+}
+
+// String returns the policy as `namespace/name`.
+func (p *CleanupPolicy) String() string {
+	return p.Namespace + "/" + p.Name
+}
+
+// Matches tells whether the policy applies to the given repository.
+func (p *CleanupPolicy) Matches(repoName string) bool {
+	for _, pattern := range p.Spec.Repositories {
+		if matched, _ := path.Match(pattern, repoName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the spec of the policy, recording the first problem found
+// in `Err`.
+func (p *CleanupPolicy) validate() {
+	if len(p.Spec.Repositories) == 0 {
+		p.Err = fmt.Errorf("No repositories given")
+		return
+	}
+
+	for _, pattern := range p.Spec.Repositories {
+		if _, err := path.Match(pattern, ""); err != nil {
+			p.Err = fmt.Errorf("Invalid repository pattern '%s': %v", pattern, err)
+			return
+		}
+	}
+
+	if p.Spec.KeepMax != nil && *p.Spec.KeepMax < 0 {
+		p.Err = fmt.Errorf("Invalid keepMax %d, must not be negative", *p.Spec.KeepMax)
+		return
+	}
+
+	if p.Spec.MaxAge != "" {
+		maxAge, err := ParseDuration(p.Spec.MaxAge)
+		if err != nil {
+			p.Err = fmt.Errorf("Invalid maxAge '%s': %v", p.Spec.MaxAge, err)
+			return
+		}
+		p.maxAge = maxAge
+	}
+}
+
+// ParseCleanupPolicyList returns the policies in the given JSON list of
+// `ECRCleanupPolicy` resources, as returned by the API server, sorted by
+// namespace and name. Policies with invalid specs are returned along with
+// the problem found.
+func ParseCleanupPolicyList(data []byte) ([]*CleanupPolicy, error) {
+	list := struct {
+		Items []struct {
+			Metadata struct {
+				Namespace string `json:"namespace"`
+				Name      string `json:"name"`
+			} `json:"metadata"`
+			Spec json.RawMessage `json:"spec"`
+		} `json:"items"`
+	}{}
+
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("Cannot parse cleanup policies: %v", err)
+	}
+
+	policies := []*CleanupPolicy{}
+	for _, item := range list.Items {
+		policy := &CleanupPolicy{
+			Namespace: item.Metadata.Namespace,
+			Name:      item.Metadata.Name,
+		}
+
+		if err := json.Unmarshal(item.Spec, &policy.Spec); err != nil {
+			policy.Err = fmt.Errorf("Cannot parse spec: %v", err)
+		} else {
+			policy.validate()
+		}
+
+		policies = append(policies, policy)
+	}
+
+	sort.Sort(cleanupPoliciesByName(policies))
+
+	return policies, nil
+}
+
+// cleanupPoliciesByName lets us sort policies by namespace and name, so that
+// the same policy always wins when several match a repository.
+type cleanupPoliciesByName []*CleanupPolicy
+
+func (slice cleanupPoliciesByName) Len() int {
+	return len(slice)
+}
+
+func (slice cleanupPoliciesByName) Less(i, j int) bool {
+	return slice[i].String() < slice[j].String()
+}
+
+func (slice cleanupPoliciesByName) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
+
+// MatchCleanupPolicies returns the policies, among the given ones, that apply
+// to the given repository.
+func MatchCleanupPolicies(policies []*CleanupPolicy, repoName string) []*CleanupPolicy {
+	matched := []*CleanupPolicy{}
+
+	for _, policy := range policies {
+		if policy.Matches(repoName) {
+			matched = append(matched, policy)
+		}
+	}
+
+	return matched
+}
+
+// policyFor returns the policy, among the given ones, that applies to the
+// given repository, or nil if there's none. If several policies match, the
+// first one by namespace and name wins. An error is returned if that policy
+// is invalid.
+func (t *CleanupTask) policyFor(policies []*CleanupPolicy, repoName string) (*CleanupPolicy, error) {
+	matched := MatchCleanupPolicies(policies, repoName)
+	if len(matched) == 0 {
+		return nil, nil
+	}
+
+	policy := matched[0]
+	if len(matched) > 1 {
+		t.log().Warningf("%d cleanup policies match '%s' ECR repo, only applying '%s' cleanup policy.", len(matched), repoName, policy)
+	} else {
+		t.log().Infof("Applying '%s' cleanup policy to '%s' ECR repo.", policy, repoName)
+	}
+
+	if policy.Err != nil {
+		return nil, fmt.Errorf("Invalid cleanup policy '%s': %v", policy, policy.Err)
+	}
+
+	return policy, nil
+}
+
+// repositoryRules are the retention rules that cleanup policies can override
+// for the repositories they match.
+type repositoryRules struct {
+	maxImages   int
+	maxImageAge time.Duration
+}
+
+// rulesFor returns the retention rules of the given policy, which default to
+// the ones of the task if the policy is nil or doesn't set them.
+func (t *CleanupTask) rulesFor(policy *CleanupPolicy) repositoryRules {
+	rules := repositoryRules{
+		maxImages:   t.MaxImages,
+		maxImageAge: t.MaxImageAge,
+	}
+
+	if policy == nil {
+		return rules
+	}
+
+	if policy.Spec.KeepMax != nil {
+		rules.maxImages = *policy.Spec.KeepMax
+	}
+	if policy.maxAge > 0 {
+		rules.maxImageAge = policy.maxAge
+	}
+
+	return rules
+}
+
+// policyNamespaces returns the namespaces to look at to find out which images
+// are in use, which are the ones given by `KubeNamespaces` along with the ones
+// given by the given policies.
+func policyNamespaces(namespaces []*string, policies []*CleanupPolicy) []*string {
+	all := append([]*string{}, namespaces...)
+	encountered := map[string]bool{}
+	for _, namespace := range namespaces {
+		encountered[*namespace] = true
+	}
+
+	for _, policy := range policies {
+		if policy.Err != nil {
+			continue
+		}
+
+		for i := range policy.Spec.Namespaces {
+			namespace := policy.Spec.Namespaces[i]
+			if !encountered[namespace] {
+				encountered[namespace] = true
+				all = append(all, &namespace)
+			}
+		}
+	}
+
+	return all
+}
@@ -0,0 +1,142 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCleanupPolicyList(t *testing.T) {
+	data := []byte(`{
+		"items": [
+			{
+				"metadata": {"namespace": "team-b", "name": "default"},
+				"spec": {"repositories": ["team-b/*"], "keepMax": 10, "maxAge": "30d", "protectedTags": ["stable"]}
+			},
+			{
+				"metadata": {"namespace": "team-a", "name": "default"},
+				"spec": {"repositories": ["team-a/app"], "namespaces": ["team-a"]}
+			},
+			{
+				"metadata": {"namespace": "team-c", "name": "no-repos"},
+				"spec": {"keepMax": 10}
+			},
+			{
+				"metadata": {"namespace": "team-c", "name": "invalid-max-age"},
+				"spec": {"repositories": ["team-c/*"], "maxAge": "a month"}
+			},
+			{
+				"metadata": {"namespace": "team-c", "name": "negative-keep-max"},
+				"spec": {"repositories": ["team-c/*"], "keepMax": -1}
+			},
+			{
+				"metadata": {"namespace": "team-c", "name": "invalid-spec"},
+				"spec": {"repositories": "team-c/*"}
+			}
+		]
+	}`)
+
+	policies, err := ParseCleanupPolicyList(data)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	names := []string{}
+	invalid := map[string]bool{}
+	for _, policy := range policies {
+		names = append(names, policy.String())
+		invalid[policy.String()] = policy.Err != nil
+	}
+
+	expectedNames := []string{
+		"team-a/default",
+		"team-b/default",
+		"team-c/invalid-max-age",
+		"team-c/invalid-spec",
+		"team-c/negative-keep-max",
+		"team-c/no-repos",
+	}
+
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("Expected policies to be %v, but were %v", expectedNames, names)
+	}
+
+	expectedInvalid := map[string]bool{
+		"team-a/default":           false,
+		"team-b/default":           false,
+		"team-c/invalid-max-age":   true,
+		"team-c/invalid-spec":      true,
+		"team-c/negative-keep-max": true,
+		"team-c/no-repos":          true,
+	}
+
+	if !reflect.DeepEqual(invalid, expectedInvalid) {
+		t.Errorf("Expected invalid policies to be %v, but were %v", expectedInvalid, invalid)
+	}
+
+	task := &CleanupTask{MaxImages: 100, MaxImageAge: time.Hour}
+
+	expectedRules := repositoryRules{maxImages: 10, maxImageAge: 30 * 24 * time.Hour}
+	if rules := task.rulesFor(policies[1]); rules != expectedRules {
+		t.Errorf("Expected rules to be %+v, but were %+v", expectedRules, rules)
+	}
+
+	expectedRules = repositoryRules{maxImages: 100, maxImageAge: time.Hour}
+	if rules := task.rulesFor(policies[0]); rules != expectedRules {
+		t.Errorf("Expected rules to default to %+v, but were %+v", expectedRules, rules)
+	}
+}
+
+func TestParseCleanupPolicyListError(t *testing.T) {
+	if _, err := ParseCleanupPolicyList([]byte("not json")); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+}
+
+func TestMatchCleanupPolicies(t *testing.T) {
+	policies := []*CleanupPolicy{
+		{Namespace: "team-a", Name: "all", Spec: CleanupPolicySpec{Repositories: []string{"team-a/*"}}},
+		{Namespace: "team-a", Name: "app", Spec: CleanupPolicySpec{Repositories: []string{"team-a/app", "shared"}}},
+	}
+
+	testCases := []struct {
+		repoName string
+		expected []string
+	}{
+		{repoName: "team-a/app", expected: []string{"team-a/all", "team-a/app"}},
+		{repoName: "team-a/worker", expected: []string{"team-a/all"}},
+		{repoName: "shared", expected: []string{"team-a/app"}},
+		{repoName: "team-b/app", expected: []string{}},
+	}
+
+	for _, testCase := range testCases {
+		actual := []string{}
+		for _, policy := range MatchCleanupPolicies(policies, testCase.repoName) {
+			actual = append(actual, policy.String())
+		}
+
+		if !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Expected policies matching '%s' to be %v, but were %v", testCase.repoName, testCase.expected, actual)
+		}
+	}
+}
+
+func TestPolicyNamespaces(t *testing.T) {
+	namespace := "default"
+	policies := []*CleanupPolicy{
+		{Spec: CleanupPolicySpec{Namespaces: []string{"team-a", "default"}}},
+		{Spec: CleanupPolicySpec{Namespaces: []string{"team-a", "team-b"}}},
+		{Spec: CleanupPolicySpec{Namespaces: []string{"team-c"}}, Err: fmt.Errorf("Invalid")},
+	}
+
+	actual := []string{}
+	for _, namespace := range policyNamespaces([]*string{&namespace}, policies) {
+		actual = append(actual, *namespace)
+	}
+
+	expected := []string{"default", "team-a", "team-b"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected namespaces to be %v, but were %v", expected, actual)
+	}
+}
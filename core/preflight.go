@@ -0,0 +1,447 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+)
+
+// probeImageDigest is the digest of the image the ECR API is asked to get or
+// delete when probing permissions, which cannot exist, so that the requests
+// have no effect.
+const probeImageDigest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+
+// PolicySimulatorClient defines the expected interface of any object capable
+// of telling which IAM actions the AWS credentials in use are not allowed to
+// perform.
+type PolicySimulatorClient interface {
+	DeniedActions(actions []string) ([]string, error)
+}
+
+type IAMClientImpl struct {
+	IAMClient iamiface.IAMAPI
+	STSClient stsiface.STSAPI
+}
+
+// NewIAMClient returns a new client for simulating the IAM policies of the
+// AWS credentials in use, using the same credentials as the ECR client. If
+// roleARN is not empty, that IAM role is assumed.
+func NewIAMClient(auth AWSAuth, region, roleARN string) *IAMClientImpl {
+	sess := newAssumeRoleSession(auth, region, roleARN)
+
+	return &IAMClientImpl{
+		IAMClient: iam.New(sess),
+		STSClient: sts.New(sess),
+	}
+}
+
+// DeniedActions returns which of the given IAM actions the policies of the
+// principal the AWS credentials in use belong to do not allow on any
+// resource, as simulated by IAM, which requires the
+// `iam:SimulatePrincipalPolicy` action.
+func (c *IAMClientImpl) DeniedActions(actions []string) ([]string, error) {
+	identity, err := c.STSClient.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get caller identity: %v", err)
+	}
+
+	input := &iam.SimulatePrincipalPolicyInput{
+		PolicySourceArn: aws.String(PrincipalARN(aws.StringValue(identity.Arn))),
+		ActionNames:     aws.StringSlice(actions),
+	}
+
+	denied := []string{}
+	err = c.IAMClient.SimulatePrincipalPolicyPages(input, func(page *iam.SimulatePolicyResponse, lastPage bool) bool {
+		for _, result := range page.EvaluationResults {
+			if aws.StringValue(result.EvalDecision) != iam.PolicyEvaluationDecisionTypeAllowed {
+				denied = append(denied, aws.StringValue(result.EvalActionName))
+			}
+		}
+		return !lastPage
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return denied, nil
+}
+
+// PrincipalARN returns the ARN of the IAM principal whose policies apply to
+// the caller with the given ARN, which is the role itself for the sessions of
+// assumed roles. The path of the role, if any, is unknown, in which case the
+// policies of the role cannot be simulated.
+func PrincipalARN(callerARN string) string {
+	parts := strings.SplitN(callerARN, ":", 6)
+	if len(parts) != 6 || parts[2] != "sts" || !strings.HasPrefix(parts[5], "assumed-role/") {
+		return callerARN
+	}
+
+	role := strings.SplitN(strings.TrimPrefix(parts[5], "assumed-role/"), "/", 2)[0]
+	return strings.Join([]string{parts[0], parts[1], "iam", "", parts[4], "role/" + role}, ":")
+}
+
+// PermissionsProbeClient defines the expected interface of any object capable
+// of telling which ECR API actions are denied by sending requests that have
+// no effect.
+type PermissionsProbeClient interface {
+	ProbeActions(repositoryName *string, actions []string) (denied []string, unverified []string, err error)
+}
+
+// ProbeActions tells which of the given IAM actions are denied on the
+// repository with the given name, or on the first repository found if nil,
+// by sending requests that have no effect, such as deleting an image that
+// cannot exist, to the ECR API. The actions that cannot be probed this way
+// are returned as unverified, along with the ones on repositories when there
+// are none.
+func (c *ECRClientImpl) ProbeActions(repositoryName *string, actions []string) ([]string, []string, error) {
+	denied := []string{}
+	unverified := []string{}
+
+	input := &ecr.DescribeRepositoriesInput{MaxResults: aws.Int64(1)}
+	if repositoryName != nil {
+		input = &ecr.DescribeRepositoriesInput{RepositoryNames: []*string{repositoryName}}
+	}
+
+	err := c.api(repositoryName).DescribeRepositoriesPagesWithContext(c.requestContext(), input, func(page *ecr.DescribeRepositoriesOutput, lastPage bool) bool {
+		if repositoryName == nil && len(page.Repositories) > 0 {
+			repositoryName = page.Repositories[0].RepositoryName
+		}
+		return false
+	})
+	if isAccessDenied(err) {
+		denied = append(denied, "ecr:DescribeRepositories")
+	} else if err != nil && !isRepositoryNotFound(err) {
+		return nil, nil, err
+	}
+
+	api := c.api(repositoryName)
+	imageIds := []*ecr.ImageIdentifier{{ImageDigest: aws.String(probeImageDigest)}}
+
+	for _, action := range actions {
+		var probe func() error
+		switch action {
+		case "ecr:DescribeRepositories":
+			continue
+		case "ecr:DescribeImages":
+			probe = func() error {
+				return api.DescribeImagesPagesWithContext(c.requestContext(), &ecr.DescribeImagesInput{RepositoryName: repositoryName, MaxResults: aws.Int64(1)}, func(page *ecr.DescribeImagesOutput, lastPage bool) bool {
+					return false
+				})
+			}
+		case "ecr:BatchDeleteImage":
+			probe = func() error {
+				_, err := api.BatchDeleteImageWithContext(c.requestContext(), &ecr.BatchDeleteImageInput{RepositoryName: repositoryName, ImageIds: imageIds})
+				return err
+			}
+		case "ecr:BatchGetImage":
+			probe = func() error {
+				_, err := api.BatchGetImageWithContext(c.requestContext(), &ecr.BatchGetImageInput{RepositoryName: repositoryName, ImageIds: imageIds})
+				return err
+			}
+		case "ecr:DescribeRegistry":
+			probe = func() error {
+				_, err := api.DescribeRegistryWithContext(c.requestContext(), &ecr.DescribeRegistryInput{})
+				return err
+			}
+		}
+
+		if probe == nil || (repositoryName == nil && action != "ecr:DescribeRegistry") {
+			unverified = append(unverified, action)
+			continue
+		}
+
+		err := probe()
+		if isAccessDenied(err) {
+			denied = append(denied, action)
+		} else if err != nil && !isRepositoryNotFound(err) {
+			return nil, nil, err
+		}
+	}
+
+	return denied, unverified, nil
+}
+
+// isAccessDenied tells whether the given error was returned by an AWS API
+// because the IAM action is not allowed.
+func isAccessDenied(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && (awsErr.Code() == "AccessDeniedException" || awsErr.Code() == "AccessDenied")
+}
+
+// isRepositoryNotFound tells whether the given error was returned by the ECR
+// API because the repository does not exist, which means the action was
+// allowed.
+func isRepositoryNotFound(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == ecr.ErrCodeRepositoryNotFoundException
+}
+
+// ResourceAccess is an action on Kubernetes resources, as checked by access
+// reviews. An empty namespace means all namespaces, or no namespace for
+// cluster-scoped resources, and an empty name means all resources.
+type ResourceAccess struct {
+	Verb      string `json:"verb"`
+	Group     string `json:"group,omitempty"`
+	Resource  string `json:"resource"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+}
+
+func (a ResourceAccess) String() string {
+	resource := a.Resource
+	if a.Group != "" {
+		resource += "." + a.Group
+	}
+	if a.Name != "" {
+		resource += " '" + a.Name + "'"
+	}
+
+	if a.Namespace == "" {
+		return a.Verb + " " + resource
+	}
+	return fmt.Sprintf("%s %s in '%s' namespace", a.Verb, resource, a.Namespace)
+}
+
+// AccessReviewClient defines the expected interface of any object capable of
+// telling whether it is allowed access to Kubernetes resources.
+type AccessReviewClient interface {
+	CanAccess(access ResourceAccess) (bool, error)
+}
+
+// CanAccess tells whether the client is allowed the given access, as per a
+// `SelfSubjectAccessReview`, which any authenticated user may create.
+func (c *KubernetesClientImpl) CanAccess(access ResourceAccess) (bool, error) {
+	review := map[string]interface{}{
+		"apiVersion": "authorization.k8s.io/v1",
+		"kind":       "SelfSubjectAccessReview",
+		"spec": map[string]interface{}{
+			"resourceAttributes": access,
+		},
+	}
+
+	body, err := json.Marshal(review)
+	if err != nil {
+		return false, err
+	}
+
+	data, err := c.clientset.Core().RESTClient().Post().AbsPath("/apis/authorization.k8s.io/v1/selfsubjectaccessreviews").Body(body).DoRaw()
+	if err != nil {
+		return false, err
+	}
+
+	return AccessReviewAllowed(data)
+}
+
+// AccessReviewAllowed tells whether the given JSON access review, as returned
+// by the API server, allows the access it was created for.
+func AccessReviewAllowed(data []byte) (bool, error) {
+	review := struct {
+		Status struct {
+			Allowed bool `json:"allowed"`
+		} `json:"status"`
+	}{}
+
+	if err := json.Unmarshal(data, &review); err != nil {
+		return false, fmt.Errorf("Cannot parse access review: %v", err)
+	}
+
+	return review.Status.Allowed, nil
+}
+
+// requiredActions returns the IAM actions the AWS credentials in use need to
+// be allowed as per the current settings, leaving out the ones that the
+// controller can do without, such as the ones only needed to describe the
+// replication of the registries unless replicated repositories are skipped.
+func (t *CleanupTask) requiredActions() []string {
+	actions := []string{"ecr:DescribeRepositories", "ecr:DescribeImages"}
+
+	if !t.DryRun {
+		actions = append(actions, "ecr:BatchDeleteImage")
+	}
+	if t.ProtectAnnotationKey != "" || t.ProtectManifestListChildren || t.DeleteManifestListChildren || t.DeleteOrphanedManifestLists || t.QuarantineRetention > 0 {
+		actions = append(actions, "ecr:BatchGetImage")
+	}
+	if t.QuarantineRetention > 0 && !t.DryRun {
+		actions = append(actions, "ecr:PutImage")
+	}
+	if t.UseRepositoryTags {
+		actions = append(actions, "ecr:ListTagsForResource")
+	}
+	if t.SkipReplicatedRepositories {
+		actions = append(actions, "ecr:DescribeRegistry", "ecr:DescribePullThroughCacheRules")
+	}
+	if t.DeleteEmptyRepositories && !t.DryRun {
+		actions = append(actions, "ecr:DeleteRepository")
+	}
+	if t.RecentPullWindow > 0 {
+		actions = append(actions, "cloudtrail:LookupEvents")
+	}
+	if t.AuditS3Bucket != "" {
+		actions = append(actions, "s3:PutObject")
+	}
+
+	return actions
+}
+
+// requiredAccesses returns the access to Kubernetes resources the controller
+// needs to find out which images are in use as per the current settings, and
+// to keep its own resources in `ControllerNamespace`.
+func (t *CleanupTask) requiredAccesses() []ResourceAccess {
+	accesses := []ResourceAccess{}
+	seen := map[ResourceAccess]bool{}
+	add := func(access ResourceAccess) {
+		if !seen[access] {
+			seen[access] = true
+			accesses = append(accesses, access)
+		}
+	}
+
+	namespaces := []string{}
+	for _, namespace := range t.KubeNamespaces {
+		if IsNamespacePattern(*namespace) {
+			add(ResourceAccess{Verb: "list", Resource: "namespaces"})
+			namespaces = append(namespaces, "")
+			continue
+		}
+		namespaces = append(namespaces, *namespace)
+	}
+
+	for _, namespace := range namespaces {
+		add(ResourceAccess{Verb: "list", Resource: "pods", Namespace: namespace})
+		if t.UseJobImages {
+			add(ResourceAccess{Verb: "list", Group: "batch", Resource: "jobs", Namespace: namespace})
+			add(ResourceAccess{Verb: "list", Group: "batch", Resource: "cronjobs", Namespace: namespace})
+		}
+		if t.UseRevisionHistoryImages || t.UseRolloutImages {
+			add(ResourceAccess{Verb: "list", Group: "apps", Resource: "replicasets", Namespace: namespace})
+		}
+		if t.UseRevisionHistoryImages {
+			add(ResourceAccess{Verb: "list", Group: "apps", Resource: "controllerrevisions", Namespace: namespace})
+		}
+		if t.UseRolloutImages {
+			add(ResourceAccess{Verb: "list", Group: RolloutWorkload.Group, Resource: RolloutWorkload.Plural, Namespace: namespace})
+		}
+		if t.UseHelmReleaseImages {
+			add(ResourceAccess{Verb: "list", Resource: "secrets", Namespace: namespace})
+		}
+		for _, workload := range t.CustomWorkloads {
+			add(ResourceAccess{Verb: "list", Group: workload.Group, Resource: workload.Plural, Namespace: namespace})
+		}
+	}
+
+	if t.UseNodePinnedImages {
+		add(ResourceAccess{Verb: "list", Resource: "nodes"})
+	}
+	if t.UseNamespaceKeepCounts {
+		add(ResourceAccess{Verb: "list", Resource: "namespaces"})
+	}
+	if t.UseCleanupPolicies {
+		add(ResourceAccess{Verb: "list", Group: CleanupPolicyGroup, Resource: CleanupPolicyPlural})
+	}
+	if t.KeepTagsConfigMap != "" {
+		if namespace, name, err := ParseNamespacedName(t.KeepTagsConfigMap); err == nil {
+			add(ResourceAccess{Verb: "get", Resource: "configmaps", Namespace: namespace, Name: name})
+		}
+	}
+
+	add(ResourceAccess{Verb: "get", Resource: "namespaces", Name: t.ControllerNamespace})
+	if t.StatusConfigMap != "" || t.LeaderElection {
+		for _, verb := range []string{"get", "create", "update"} {
+			add(ResourceAccess{Verb: verb, Resource: "configmaps", Namespace: t.ControllerNamespace})
+		}
+	}
+	if t.EmitEvents {
+		add(ResourceAccess{Verb: "create", Resource: "events", Namespace: t.ControllerNamespace})
+	}
+
+	return accesses
+}
+
+// VerifyPermissions makes sure the AWS credentials in use are allowed the IAM
+// actions required by the current settings, as simulated by the given
+// simulator, or by probing the ECR API of each region with the given clients
+// when the policies cannot be simulated, and that the given Kubernetes client
+// is allowed the access to Kubernetes resources they require, so that the
+// controller fails at startup rather than in the middle of a pass. All the
+// missing permissions are returned at once, telling how to grant them.
+func (t *CleanupTask) VerifyPermissions(kubeClient KubernetesClient, ecrClients []RegionalECRClient, simulator PolicySimulatorClient) error {
+	errs := &MultiError{}
+	actions := t.requiredActions()
+
+	denied, err := simulator.DeniedActions(actions)
+	if err == nil {
+		for _, action := range denied {
+			errs.Append(fmt.Errorf("IAM action '%s' is not allowed; add it to the IAM policy of the controller", action))
+		}
+		if len(denied) == 0 {
+			t.log().Infof("Verified that the %d IAM actions required are allowed.", len(actions))
+		}
+	} else {
+		t.log().Warningf("Cannot simulate IAM policies, probing the ECR API instead: %v", err)
+
+		var repositoryName *string
+		if !t.DiscoverRepositories && len(t.EcrRepositories) > 0 {
+			repositoryName = t.EcrRepositories[0]
+		}
+
+		unverified := map[string]bool{}
+		for _, regional := range ecrClients {
+			probeClient, ok := regional.Client.(PermissionsProbeClient)
+			if !ok {
+				continue
+			}
+
+			regionDenied, regionUnverified, err := probeClient.ProbeActions(repositoryName, actions)
+			if err != nil {
+				errs.Append(&RepositoryError{Region: regional.Region, Message: "Cannot probe ECR API", Err: err})
+				continue
+			}
+
+			for _, action := range regionDenied {
+				errs.Append(&RepositoryError{
+					Region: regional.Region,
+					Err:    fmt.Errorf("IAM action '%s' is not allowed; add it to the IAM policy of the controller", action),
+				})
+			}
+			for _, action := range regionUnverified {
+				unverified[action] = true
+			}
+		}
+
+		for _, action := range actions {
+			if unverified[action] {
+				t.log().Warningf("Cannot verify that IAM action '%s' is allowed, make sure the IAM policy of the controller allows it.", action)
+			}
+		}
+	}
+
+	accessClient, ok := kubeClient.(AccessReviewClient)
+	if !ok {
+		t.log().Warningf("Kubernetes client cannot review access, not verifying RBAC permissions.")
+		return errs.ErrorOrNil()
+	}
+
+	accesses := t.requiredAccesses()
+	for _, access := range accesses {
+		allowed, err := accessClient.CanAccess(access)
+		if err != nil {
+			errs.Append(fmt.Errorf("Cannot review Kubernetes access to %s: %v", access, err))
+			continue
+		}
+
+		if !allowed {
+			errs.Append(fmt.Errorf("Not allowed to %s by Kubernetes RBAC; grant it to the service account of the controller", access))
+		}
+	}
+	t.log().Infof("Reviewed %d Kubernetes permissions required.", len(accesses))
+
+	return errs.ErrorOrNil()
+}
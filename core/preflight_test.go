@@ -0,0 +1,192 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// mockPolicySimulatorClient denies the given actions, or fails to simulate
+// the policies if an error is given.
+type mockPolicySimulatorClient struct {
+	denied      []string
+	outputError error
+}
+
+func (m *mockPolicySimulatorClient) DeniedActions(actions []string) ([]string, error) {
+	return m.denied, m.outputError
+}
+
+// mockPermissionsProbeECRClient denies the given actions, and cannot probe
+// the given others.
+type mockPermissionsProbeECRClient struct {
+	ECRClient
+
+	denied     []string
+	unverified []string
+}
+
+func (m *mockPermissionsProbeECRClient) ProbeActions(repositoryName *string, actions []string) ([]string, []string, error) {
+	return m.denied, m.unverified, nil
+}
+
+// mockAccessReviewKubeClient denies the accesses to the given resources.
+type mockAccessReviewKubeClient struct {
+	KubernetesClient
+
+	deniedResources map[string]bool
+	reviewed        []ResourceAccess
+}
+
+func (m *mockAccessReviewKubeClient) CanAccess(access ResourceAccess) (bool, error) {
+	m.reviewed = append(m.reviewed, access)
+	return !m.deniedResources[access.Resource], nil
+}
+
+func TestPrincipalARN(t *testing.T) {
+	testCases := []struct {
+		callerARN string
+		expected  string
+	}{
+		{"arn:aws:sts::123456789012:assumed-role/ecr-cleanup/session-1", "arn:aws:iam::123456789012:role/ecr-cleanup"},
+		{"arn:aws:iam::123456789012:user/admin", "arn:aws:iam::123456789012:user/admin"},
+		{"arn:aws:sts::123456789012:federated-user/admin", "arn:aws:sts::123456789012:federated-user/admin"},
+	}
+
+	for i, testCase := range testCases {
+		if principal := PrincipalARN(testCase.callerARN); principal != testCase.expected {
+			t.Errorf("Test case %d: expected principal '%s', but got '%s'", i, testCase.expected, principal)
+		}
+	}
+}
+
+func TestAccessReviewAllowed(t *testing.T) {
+	allowed, err := AccessReviewAllowed([]byte(`{"kind": "SelfSubjectAccessReview", "status": {"allowed": true}}`))
+	if err != nil || !allowed {
+		t.Errorf("Expected access to be allowed, but got %v, %v", allowed, err)
+	}
+
+	allowed, err = AccessReviewAllowed([]byte(`{"kind": "SelfSubjectAccessReview", "status": {"allowed": false, "reason": "no RBAC policy matched"}}`))
+	if err != nil || allowed {
+		t.Errorf("Expected access to be denied, but got %v, %v", allowed, err)
+	}
+
+	if _, err := AccessReviewAllowed([]byte("not json")); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+}
+
+func TestRequiredActions(t *testing.T) {
+	testCases := []struct {
+		task     *CleanupTask
+		expected []string
+	}{
+		{&CleanupTask{DryRun: true}, []string{"ecr:DescribeRepositories", "ecr:DescribeImages"}},
+		{&CleanupTask{}, []string{"ecr:DescribeRepositories", "ecr:DescribeImages", "ecr:BatchDeleteImage"}},
+		{&CleanupTask{QuarantineRetention: 1, UseRepositoryTags: true}, []string{"ecr:DescribeRepositories", "ecr:DescribeImages", "ecr:BatchDeleteImage", "ecr:BatchGetImage", "ecr:PutImage", "ecr:ListTagsForResource"}},
+		{&CleanupTask{DryRun: true, DeleteEmptyRepositories: true, RecentPullWindow: 1}, []string{"ecr:DescribeRepositories", "ecr:DescribeImages", "cloudtrail:LookupEvents"}},
+	}
+
+	for i, testCase := range testCases {
+		if actions := testCase.task.requiredActions(); !reflect.DeepEqual(actions, testCase.expected) {
+			t.Errorf("Test case %d: expected actions %v, but got %v", i, testCase.expected, actions)
+		}
+	}
+}
+
+func TestRequiredAccesses(t *testing.T) {
+	task := &CleanupTask{
+		KubeNamespaces:      aws.StringSlice([]string{"default", "team-*"}),
+		UseJobImages:        true,
+		UseNodePinnedImages: true,
+		ControllerNamespace: "ecr-cleanup",
+		KeepTagsConfigMap:   "ops/keep-tags",
+		EmitEvents:          true,
+	}
+
+	expected := []string{
+		"list namespaces",
+		"list pods in 'default' namespace",
+		"list jobs.batch in 'default' namespace",
+		"list cronjobs.batch in 'default' namespace",
+		"list pods",
+		"list jobs.batch",
+		"list cronjobs.batch",
+		"list nodes",
+		"get configmaps 'keep-tags' in 'ops' namespace",
+		"get namespaces 'ecr-cleanup'",
+		"create events in 'ecr-cleanup' namespace",
+	}
+
+	accesses := []string{}
+	for _, access := range task.requiredAccesses() {
+		accesses = append(accesses, access.String())
+	}
+	if !reflect.DeepEqual(accesses, expected) {
+		t.Errorf("Expected accesses %v, but got %v", expected, accesses)
+	}
+}
+
+func TestVerifyPermissions(t *testing.T) {
+	ecrClients := []RegionalECRClient{
+		{Region: "us-east-1", Client: &mockPermissionsProbeECRClient{denied: []string{"ecr:BatchDeleteImage"}, unverified: []string{"ecr:PutImage"}}},
+		{Region: "eu-west-1", Client: &mockPermissionsProbeECRClient{}},
+	}
+
+	testCases := []struct {
+		simulator      *mockPolicySimulatorClient
+		kubeClient     KubernetesClient
+		expectedErrors []string
+	}{
+		{
+			simulator:  &mockPolicySimulatorClient{},
+			kubeClient: &mockAccessReviewKubeClient{},
+		},
+		{
+			simulator:      &mockPolicySimulatorClient{denied: []string{"ecr:BatchDeleteImage"}},
+			kubeClient:     &mockAccessReviewKubeClient{deniedResources: map[string]bool{"pods": true}},
+			expectedErrors: []string{"IAM action 'ecr:BatchDeleteImage' is not allowed", "Not allowed to list pods in 'default' namespace"},
+		},
+		{
+			// The ECR API is probed when the policies cannot be simulated
+			simulator:      &mockPolicySimulatorClient{outputError: fmt.Errorf("AccessDenied")},
+			kubeClient:     &mockAccessReviewKubeClient{},
+			expectedErrors: []string{"us-east-1: IAM action 'ecr:BatchDeleteImage' is not allowed"},
+		},
+		{
+			// Clients that cannot review access are not verified
+			simulator:  &mockPolicySimulatorClient{},
+			kubeClient: &mockKubeClient{},
+		},
+	}
+
+	for i, testCase := range testCases {
+		task := &CleanupTask{
+			KubeNamespaces:      aws.StringSlice([]string{"default"}),
+			ControllerNamespace: "ecr-cleanup",
+		}
+
+		err := task.VerifyPermissions(testCase.kubeClient, ecrClients, testCase.simulator)
+		if len(testCase.expectedErrors) == 0 {
+			if err != nil {
+				t.Errorf("Test case %d: expected no error, but got %v", i, err)
+			}
+			continue
+		}
+
+		multiErr, ok := err.(*MultiError)
+		if !ok || len(multiErr.Errors) != len(testCase.expectedErrors) {
+			t.Errorf("Test case %d: expected %d errors, but got %v", i, len(testCase.expectedErrors), err)
+			continue
+		}
+
+		for j, expected := range testCase.expectedErrors {
+			if !strings.Contains(multiErr.Errors[j].Error(), expected) {
+				t.Errorf("Test case %d: expected error %d to contain %q, but got %q", i, j, expected, multiErr.Errors[j])
+			}
+		}
+	}
+}
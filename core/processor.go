@@ -1,87 +1,1720 @@
 package core
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"go.opentelemetry.io/otel/attribute"
+	"k8s.io/client-go/pkg/api/v1"
 )
 
-func (t *CleanupTask) ImageCleanupLoop(done chan struct{}, wg *sync.WaitGroup) {
+// ReconcileResult summarizes the outcome of a cleanup pass.
+type ReconcileResult struct {
+
+	// Number of ECR repositories processed.
+	RepositoriesProcessed int
+
+	// Number of ECR repositories found to be orphaned, when
+	// `OrphanedRepositoryDays` is set.
+	RepositoriesOrphaned int
+
+	// Number of empty orphaned ECR repositories actually deleted.
+	RepositoriesDeleted int
+
+	// Number of ECR repositories skipped because they kept failing, when
+	// `RepositoryFailureThreshold` is set.
+	RepositoriesSuspended int
+
+	// Number of ECR images found to be in use.
+	ImagesInUse int
+
+	// Number of images selected for deletion, including the ones that were not
+	// deleted because of a dry run or a quarantine.
+	ImagesSelected int
+
+	// Number of images retained by the `MaxImages` rule, by reason.
+	ImagesRetained map[string]int
+
+	// Number of images tagged as pending deletion.
+	ImagesQuarantined int
+
+	// Number of images actually deleted.
+	ImagesDeleted int
+
+	// Number of manifest lists selected for deletion because their children
+	// were all deleted, when `DeleteOrphanedManifestLists` is set. These are
+	// also counted in `ImagesSelected` and `ImagesDeleted`.
+	OrphanedManifestListsSelected int
+
+	// Number of images left for the next passes due to
+	// `MaxDeletesPerReconcile`.
+	ImagesDeferred int
+
+	// Number of bytes taken up by the images selected for deletion, when
+	// `ReclaimBytes` is set, which count towards it. This leaves out the
+	// images skipped, such as the ones that would leave their repository
+	// empty, and the ones that could not be deleted.
+	BytesSelected int64
+
+	// Number of bytes taken up by the images actually deleted, as far as
+	// their sizes are known.
+	BytesDeleted int64
+
+	// Whether the pass was skipped because another one was still running.
+	Skipped bool
+
+	// Random identifier of the pass, as found in the audit records.
+	ReconcileID string
+
+	// Repositories processed and images selected for deletion.
+	Plan *Plan
+
+	// Outcome of the pass in each region.
+	Regions []RegionResult
+
+	// Errors found along the way.
+	Errors []error
+}
+
+// RegionResult summarizes the outcome of a clean-up pass in a region.
+type RegionResult struct {
+	Region string
+
+	// Number of repositories processed in the region.
+	RepositoriesProcessed int
+
+	// Number of images selected for deletion, and actually deleted, in the
+	// region.
+	ImagesSelected int
+	ImagesDeleted  int
+
+	// Errors found in the region.
+	Errors []error
+}
+
+// Failed tells whether any errors were found in the region.
+func (r RegionResult) Failed() bool {
+	return len(r.Errors) > 0
+}
+
+// Failed tells whether the pass failed in any region.
+func (r *ReconcileResult) Failed() bool {
+	for _, region := range r.Regions {
+		if region.Failed() {
+			return true
+		}
+	}
+	return len(r.Errors) > 0
+}
+
+// summarizeRegions fills in the outcome of the pass in the given regions it
+// did not get to, which happens when the pass fails before processing any
+// region, in which case those regions fail along with it.
+func (r *ReconcileResult) summarizeRegions(regions []string) {
+	processed := map[string]bool{}
+	for _, region := range r.Regions {
+		processed[region.Region] = true
+	}
+
+	for _, region := range regions {
+		if !processed[region] {
+			r.Regions = append(r.Regions, RegionResult{
+				Region: region,
+				Errors: r.Errors,
+			})
+		}
+	}
+}
+
+// ImageCleanupLoop performs the startup checks and then runs a clean-up pass
+// every `Interval` minutes, or as per `Schedule`, delayed by up to
+// `ScheduleJitter`, in the background, until done is closed, which
+// cancels the running pass, if any, as per `ReconcileRegionsContext`. Settings
+// handed over by `Reload` are applied between passes. An error is returned if
+// the startup checks fail, in which case no passes are run.
+func (t *CleanupTask) ImageCleanupLoop(done chan struct{}, wg *sync.WaitGroup) error {
+	kubeClient, ecrClients, err := t.NewClients()
+	if err != nil {
+		return err
+	}
+
+	if t.LeaderElection {
+		if err := t.startLeaderElection(kubeClient, done, wg); err != nil {
+			return err
+		}
+	}
+
+	t.clients.Store(healthClients{kubeClient: kubeClient, ecrClients: ecrClients})
+	t.markLoopActivity(time.Now())
+	reloads := make(chan *CleanupTask)
+	stopped := make(chan struct{})
+	t.reloads.Store(reloadChannels{settings: reloads, done: stopped})
+
+	// The running pass, if any, is canceled once done is closed
+	ctx, cancel := context.WithCancel(context.Background())
+
 	go func() {
-		ecrClient := NewECRClient(t.AwsRegion)
+		newTimer := func() *time.Timer {
+			now := time.Now()
+			next := t.nextPassTime(now)
+			t.log().Infof("Next clean-up pass at %s.", next.Format(time.RFC3339))
+			return time.NewTimer(next.Sub(now))
+		}
 
-		kubeClient, err := NewKubernetesClient(t.KubeConfig)
-		if err != nil {
-			glog.Fatalf("Cannot create Kubernetes client: %v", err)
+		timer := newTimer()
+		defer func() { timer.Stop() }()
+
+		// Reloaded settings wait for the running pass, if any, to finish
+		var pending *CleanupTask
+		applyPending := func() {
+			if pending == nil || !t.tryReload(pending) {
+				return
+			}
+			pending = nil
+
+			timer.Stop()
+			timer = newTimer()
 		}
 
 		for {
 			select {
-			case <-time.After(time.Duration(t.Interval) * time.Minute):
-				errors := t.RemoveOldImages(kubeClient, ecrClient)
-				if len(errors) > 0 {
-					for _, err := range errors {
-						glog.Error(err)
-					}
+			case settings := <-reloads:
+				pending = settings
+				applyPending()
+			case <-timer.C:
+				timer = newTimer()
+				applyPending()
+
+				if t.LeaderElection && !t.isLeading() {
+					t.log().Infof("Not the leader, skipping clean-up pass.")
+					t.markLoopActivity(time.Now())
+					continue
 				}
+
+				// Passes that overrun the interval cause the next ones to
+				// be skipped, rather than piling up
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					result := t.ReconcileRegionsContext(ctx, kubeClient, ecrClients)
+
+					// Passes skipped while another one is still running
+					// don't count as progress, since it might be wedged
+					if !result.Skipped {
+						t.markLoopActivity(time.Now())
+					}
+
+					logger := WithField(t.baseLog(), ReconcileIDField, result.ReconcileID)
+					for _, err := range result.Errors {
+						logger.Errorf("%v", err)
+					}
+
+					t.notify(result)
+					t.reportStatus(result)
+				}()
 			case <-done:
+				cancel()
+				close(stopped)
 				wg.Done()
-				glog.Info("Stopped deployment status watcher.")
+				t.log().Infof("Stopped deployment status watcher.")
 				return
 			}
 		}
 	}()
+
+	return nil
+}
+
+// RunOnce runs a single clean-up pass right away and returns its outcome.
+func (t *CleanupTask) RunOnce() *ReconcileResult {
+	return t.RunOnceContext(context.Background())
+}
+
+// RunOnceContext is like RunOnce, but cancels the pass once the given context
+// is done, as per `ReconcileRegionsContext`.
+func (t *CleanupTask) RunOnceContext(ctx context.Context) *ReconcileResult {
+	kubeClient, ecrClients, err := t.NewClients()
+	if err != nil {
+		result := &ReconcileResult{
+			Plan:   NewPlan(),
+			Errors: []error{err},
+		}
+		result.summarizeRegions(t.regions())
+		return result
+	}
+
+	result := t.ReconcileRegionsContext(ctx, kubeClient, ecrClients)
+	t.notify(result)
+	t.reportStatus(result)
+
+	return result
+}
+
+// NewClients performs the startup checks and returns the clients used to
+// talk to Kubernetes and ECR, with an ECR client for each region.
+func (t *CleanupTask) NewClients() (KubernetesClient, []RegionalECRClient, error) {
+	provider, err := CheckAWSCredentials(t.AwsAuth, t.AwsRegion)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot resolve AWS credentials: %v", err)
+	}
+	t.log().Infof("Using the AWS credentials provided by %s.", provider)
+
+	if err := t.VerifyAccount(NewSTSClient(t.AwsAuth, t.AwsRegion, t.AssumeRoleARN)); err != nil {
+		return nil, nil, fmt.Errorf("Cannot verify AWS account: %v", err)
+	}
+
+	if t.MatchRegistryOnly {
+		if err := t.ResolveRegistryHost(NewSTSClient(t.AwsAuth, t.AwsRegion, t.AssumeRoleARN)); err != nil {
+			return nil, nil, fmt.Errorf("Cannot resolve ECR registry host: %v", err)
+		}
+
+		for _, region := range t.regions() {
+			t.log().Infof("Only images hosted in '%s' will be considered in use in '%s' region.", t.registryHost(region), region)
+		}
+	}
+
+	ecrClients, err := t.NewECRClients()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if (t.AuditS3Bucket != "" || t.AuditPath != "") && t.AuditSink == nil {
+		auditSinks := MultiAuditSink{}
+		if t.AuditS3Bucket != "" {
+			auditSinks = append(auditSinks, NewS3AuditSink(t.AwsAuth, t.AwsRegion, t.AuditS3Bucket, t.AuditS3Prefix))
+		}
+		if t.AuditPath != "" {
+			auditSinks = append(auditSinks, NewFileAuditSink(t.AuditPath))
+		}
+		t.AuditSink = auditSinks
+	}
+
+	if len(t.GitOpsRepositories) > 0 && t.GitClient == nil {
+		gitClient, err := NewGitClient(t.GitTokenPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		t.GitClient = gitClient
+	}
+
+	if t.NotifyWebhookURL != "" && t.Notifier == nil {
+		t.Notifier = NewWebhookNotifier(t.NotifyWebhookURL, t.DryRun)
+	}
+
+	if t.RecentPullWindow > 0 && t.PullEventsClient == nil {
+		pullEventsClients := MultiPullEventsClient{}
+		for _, region := range t.regions() {
+			pullEventsClients = append(pullEventsClients, NewCloudTrailClient(t.AwsAuth, region, t.AssumeRoleARN))
+		}
+		t.PullEventsClient = pullEventsClients
+	}
+
+	kubeClient, err := NewKubernetesClient(t.KubeConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot create Kubernetes client: %v", err)
+	}
+
+	if err := t.ResolveControllerNamespace(kubeClient, ServiceAccountNamespacePath); err != nil {
+		return nil, nil, fmt.Errorf("Cannot resolve controller namespace: %v", err)
+	}
+	t.log().Infof("Resources owned by the controller will be kept in '%s' namespace.", t.ControllerNamespace)
+
+	if t.Preflight {
+		if err := t.VerifyPermissions(kubeClient, ecrClients, NewIAMClient(t.AwsAuth, t.AwsRegion, t.AssumeRoleARN)); err != nil {
+			return nil, nil, fmt.Errorf("Preflight checks failed: %v", err)
+		}
+	}
+
+	if t.EmitEvents && t.EventsClient == nil {
+		t.EventsClient = kubeClient
+	}
+
+	if t.LeaderElection && t.LeaderLockClient == nil {
+		t.LeaderLockClient = kubeClient
+	}
+
+	if t.StatusConfigMap != "" && t.StatusClient == nil {
+		t.StatusClient = kubeClient
+	}
+
+	if len(t.RemoteClusters) == 0 {
+		return kubeClient, ecrClients, nil
+	}
+
+	multiKubeClient := &MultiKubernetesClient{KubernetesClient: kubeClient}
+	for _, cluster := range t.RemoteClusters {
+		remoteClient, err := NewRemoteKubernetesClient(cluster)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Cannot create Kubernetes client for cluster '%s': %v", cluster, err)
+		}
+
+		multiKubeClient.Remotes = append(multiKubeClient.Remotes, RemoteKubernetesClient{Cluster: cluster.String(), Client: remoteClient})
+		t.log().Infof("Images used in '%s' cluster will also be considered in use.", cluster)
+	}
+
+	return multiKubeClient, ecrClients, nil
+
+}
+
+// NewECRClients returns an ECR client for each region whose repositories are
+// cleaned up, backed by the AWS SDK given by `AwsSdkVersion`.
+func (t *CleanupTask) NewECRClients() ([]RegionalECRClient, error) {
+	ecrClients := []RegionalECRClient{}
+	for _, region := range t.regions() {
+		var ecrClient *ECRClientImpl
+		switch t.AwsSdkVersion {
+		case AwsSdkVersionV1, "":
+			ecrClient = NewECRClient(t.AwsAuth, region, t.EcrEndpoint, t.ApiQPS, t.ApiBurst, t.ApiMaxRetries, t.AssumeRoleARN, t.RepositoryRoles)
+		case AwsSdkVersionV2:
+			var err error
+			if ecrClient, err = NewECRClientV2(t.AwsAuth, region, t.EcrEndpoint, t.ApiQPS, t.ApiBurst, t.ApiMaxRetries, t.AssumeRoleARN, t.RepositoryRoles); err != nil {
+				return nil, fmt.Errorf("Cannot create ECR client: %v", err)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown AWS SDK version '%s'", t.AwsSdkVersion)
+		}
+		ecrClient.Logger = t.log()
+		ecrClient.Context = t.traceContext
+		ecrClient.ImageCacheTTL = t.ImageCacheTTL
+		ecrClient.FullResyncInterval = t.FullResyncInterval
+		ecrClient.ImageTagStatus = t.ImageTagStatus
+
+		ecrClients = append(ecrClients, RegionalECRClient{Region: region, Client: ecrClient})
+	}
+
+	return ecrClients, nil
+}
+
+// VerifyAccount makes sure the AWS credentials in use belong to the expected
+// AWS account, if one was specified, so that a misconfigured controller never
+// deletes images from the wrong registry.
+func (t *CleanupTask) VerifyAccount(identityClient IdentityClient) error {
+	if t.ExpectedAccountID == "" {
+		return nil
+	}
+
+	accountID, err := identityClient.GetAccountID()
+	if err != nil {
+		return fmt.Errorf("Cannot get caller identity: %v", err)
+	}
+
+	if accountID != t.ExpectedAccountID {
+		return fmt.Errorf("AWS credentials belong to account '%s', but expected account '%s'", accountID, t.ExpectedAccountID)
+	}
+
+	return nil
+}
+
+// ResolveControllerNamespace sets the namespace holding the resources owned
+// by the controller, if not specified, to the one stored in the given service
+// account namespace file, or to `DefaultControllerNamespace` if there's no
+// such file, and makes sure that namespace exists.
+func (t *CleanupTask) ResolveControllerNamespace(kubeClient KubernetesClient, namespacePath string) error {
+	if t.ControllerNamespace == "" {
+		namespace, err := ReadNamespaceFile(namespacePath)
+		if err != nil {
+			t.log().Warningf("Cannot read the namespace of the controller pod, using '%s' namespace: %v", DefaultControllerNamespace, err)
+			namespace = DefaultControllerNamespace
+		}
+		t.ControllerNamespace = namespace
+	}
+
+	exists, err := kubeClient.NamespaceExists(t.ControllerNamespace)
+	if err != nil {
+		return fmt.Errorf("Cannot get namespace '%s': %v", t.ControllerNamespace, err)
+	}
+
+	if !exists {
+		return fmt.Errorf("Namespace '%s' does not exist", t.ControllerNamespace)
+	}
+
+	return nil
+}
+
+// ResolveRegistryHost sets the host of the ECR registry being cleaned up in
+// `AwsRegion`, which is derived from the expected AWS account, if one was
+// specified, or from the account the AWS credentials in use belong to. The
+// registries of the other regions belong to the same account.
+func (t *CleanupTask) ResolveRegistryHost(identityClient IdentityClient) error {
+	accountID := t.ExpectedAccountID
+
+	if accountID == "" {
+		var err error
+		if accountID, err = identityClient.GetAccountID(); err != nil {
+			return fmt.Errorf("Cannot get caller identity: %v", err)
+		}
+	}
+
+	t.RegistryHost = ECRRegistryHost(accountID, t.AwsRegion)
+	t.registryAccountID = accountID
+	return nil
+}
+
+// registryHost returns the host of the ECR registry being cleaned up in the
+// given region, or an empty string if images hosted in any ECR registry are
+// considered in use.
+func (t *CleanupTask) registryHost(region string) string {
+	if t.registryAccountID == "" || region == t.AwsRegion {
+		return t.RegistryHost
+	}
+	return ECRRegistryHost(t.registryAccountID, region)
 }
 
+// RemoveOldImages runs a single clean-up pass and returns the errors found
+// along the way.
 func (t *CleanupTask) RemoveOldImages(kubeClient KubernetesClient, ecrClient ECRClient) []error {
-	errors := []error{}
+	return t.Reconcile(kubeClient, ecrClient).Errors
+}
+
+// Reconcile runs a single clean-up pass in `AwsRegion` and returns its
+// outcome. It has no process-level side effects besides logging, so it's safe
+// to call from programs embedding this package. Only one pass runs at a time;
+// the pass is skipped if another one is still running.
+func (t *CleanupTask) Reconcile(kubeClient KubernetesClient, ecrClient ECRClient) *ReconcileResult {
+	return t.ReconcileRegions(kubeClient, []RegionalECRClient{{Region: t.AwsRegion, Client: ecrClient}})
+}
+
+// passState holds what a clean-up pass shares across regions.
+type passState struct {
+	keepTags    []string
+	policies    []*CleanupPolicy
+	recentPulls map[string]map[string]bool
+
+	// Number of images the namespaces using each repository demand to keep,
+	// by region and repository name
+	keepCounts map[string]map[string]int
+
+	// Number of repositories found so far
+	reposDiscovered int
+
+	// Set once deleted images cannot be recorded, if that must stop any
+	// further deletions
+	auditBlocked bool
+
+	// Context of the pass, which is stopped before the next repository once
+	// the context is done
+	ctx context.Context
+}
+
+// canceled tells whether the context of the pass is done, in which case the
+// error is recorded in the given result for the given region.
+func (s *passState) canceled(region string, result *ReconcileResult) bool {
+	err := s.ctx.Err()
+	if err == nil {
+		return false
+	}
+
+	result.Errors = append(result.Errors, &RepositoryError{
+		Region:  region,
+		Message: "Pass canceled",
+		Err:     err,
+	})
+	return true
+}
+
+// ReconcileRegions is like Reconcile, but cleans up the repositories of each
+// of the given regions, one after the other, using the ECR client of each
+// region. Images in use are found out once for all regions, and the limits
+// on the number of images deleted in a pass apply across all regions.
+func (t *CleanupTask) ReconcileRegions(kubeClient KubernetesClient, ecrClients []RegionalECRClient) *ReconcileResult {
+	return t.ReconcileRegionsContext(context.Background(), kubeClient, ecrClients)
+}
+
+// ReconcileRegionsContext is like ReconcileRegions, but stops the pass before
+// the next repository, or the next batch of images to delete, once the given
+// context is done, in which case the pass fails. The requests sent to ECR
+// with the clients returned by NewECRClients are aborted along with it, even
+// while waiting for the rate limiter or before a retry, except for the
+// deletions already sent, which are finished.
+func (t *CleanupTask) ReconcileRegionsContext(ctx context.Context, kubeClient KubernetesClient, ecrClients []RegionalECRClient) *ReconcileResult {
+	result := &ReconcileResult{
+		ReconcileID:    NewReconcileID(),
+		ImagesRetained: map[string]int{},
+		Plan:           NewPlan(),
+		Errors:         []error{},
+	}
+
+	regions := make([]string, len(ecrClients))
+	for i := range ecrClients {
+		regions[i] = ecrClients[i].Region
+	}
+
+	result.Plan.ReconcileID = result.ReconcileID
+	defer result.summarizeRegions(regions)
+
+	if !atomic.CompareAndSwapInt32(&t.reconciling, 0, 1) {
+		t.baseLog().Warningf("Previous cleanup loop is still running, skipping.")
+		skippedReconcilesTotal.Inc()
+
+		result.Skipped = true
+		return result
+	}
+	defer atomic.StoreInt32(&t.reconciling, 0)
+
+	startedAt := time.Now()
+	defer func() {
+		reconcileDurationSeconds.Observe(time.Since(startedAt).Seconds())
+		lastReconcileTimestampSeconds.Set(float64(time.Now().Unix()))
+	}()
+
+	t.passLogger.Store(loggerHolder{WithField(t.baseLog(), ReconcileIDField, result.ReconcileID)})
+	defer t.passLogger.Store(loggerHolder{})
+
+	t.log().Infof("Cleanup loop started.")
+
+	ctx, span := startSpan(ctx, "CleanupPass", attribute.String("reconcile.id", result.ReconcileID))
+	defer func() {
+		span.SetAttributes(
+			attribute.Int("ecr.repositories_processed", result.RepositoriesProcessed),
+			attribute.Int("ecr.images_deleted", result.ImagesDeleted),
+		)
+		endSpan(span, (&MultiError{Errors: result.Errors}).ErrorOrNil())
+	}()
+
+	t.passTraceContext.Store(contextHolder{ctx})
+	defer t.passTraceContext.Store(contextHolder{})
+
+	state := &passState{
+		keepTags:    []string{},
+		policies:    []*CleanupPolicy{},
+		recentPulls: map[string]map[string]bool{},
+		keepCounts:  map[string]map[string]int{},
+		ctx:         ctx,
+	}
+
+	if t.UseCleanupPolicies {
+		_, listSpan := startSpan(ctx, "List cleanup policies")
+		policies, err := kubeClient.ListCleanupPolicies()
+		endSpan(listSpan, err)
+		if err != nil {
+			if !t.IgnoreKubernetesErrors {
+				result.Errors = append(result.Errors, fmt.Errorf("Cannot list cleanup policies: %v", err))
+				return result
+			}
+			t.log().Warningf("Cannot list cleanup policies, proceeding as if there were none: %v", err)
+		}
 
-	glog.Info("Cleanup loop started.")
+		for _, policy := range policies {
+			if policy.Err != nil {
+				t.log().Warningf("Cleanup policy '%s' is invalid, the repos it matches will be skipped: %v", policy, policy.Err)
+			}
+		}
+
+		state.policies = append(state.policies, policies...)
+		t.log().Infof("There are currently %d cleanup policies.", len(state.policies))
+	}
 
-	pods, err := kubeClient.ListAllPods(t.KubeNamespaces)
+	// Failing to find out which images are in use must never be mistaken for
+	// no images being in use, unless explicitly allowed
+	_, listSpan := startSpan(ctx, "List namespaces")
+	namespaces, err := t.scannedNamespaces(kubeClient, state.policies)
+	endSpan(listSpan, err)
 	if err != nil {
-		errors = append(errors, fmt.Errorf("Cannot list pods: %v", err))
-		return errors
+		if !t.IgnoreKubernetesErrors {
+			result.Errors = append(result.Errors, fmt.Errorf("Cannot list namespaces: %v", err))
+			return result
+		}
+		t.log().Warningf("Cannot list namespaces, proceeding as if no images were in use: %v", err)
 	}
-	glog.Infof("There are currently %d running pods.", len(pods))
+	t.log().Infof("Looking for images in use in %d namespaces.", len(namespaces))
 
-	repos, err := ecrClient.ListRepositories(t.EcrRepositories)
+	_, listSpan = startSpan(ctx, "List pods")
+	pods, err := kubeClient.ListAllPods(namespaces)
+	endSpan(listSpan, err)
 	if err != nil {
-		errors = append(errors, fmt.Errorf("Cannot list ECR repositories: %v", err))
-		return errors
+		if !t.IgnoreKubernetesErrors {
+			result.Errors = append(result.Errors, fmt.Errorf("Cannot list pods: %v", err))
+			return result
+		}
+		t.log().Warningf("Cannot list pods, proceeding as if no images were in use: %v", err)
 	}
+	t.log().Infof("There are currently %d running pods.", len(pods))
 
-	usedImages := ECRImagesFromPods(pods)
-	glog.Infof("There are currently %d ECR images in use.", len(usedImages))
+	imageRefs := ImageReferencesFromPods(pods)
 
-	for _, repo := range repos {
-		repoName := *repo.RepositoryName
-		glog.Infof("Processing '%s' ECR repo.", repoName)
+	// Ephemeral containers, such as debug containers attached with `kubectl
+	// debug`, can run images that no other container uses
+	_, listSpan = startSpan(ctx, "List ephemeral containers")
+	ephemeralImageRefs, err := kubeClient.ListEphemeralContainerImages(namespaces)
+	endSpan(listSpan, err)
+	if err != nil {
+		if !t.IgnoreKubernetesErrors {
+			result.Errors = append(result.Errors, fmt.Errorf("Cannot list ephemeral containers: %v", err))
+			return result
+		}
+		t.log().Warningf("Cannot list ephemeral containers, proceeding as if there were none: %v", err)
+	}
+	imageRefs = append(imageRefs, ephemeralImageRefs...)
 
-		images, err := ecrClient.ListImages(&repoName)
+	if t.UseJobImages {
+		_, listSpan := startSpan(ctx, "List jobs and cron jobs")
+		jobImageRefs, err := t.jobImageReferences(kubeClient, namespaces)
+		endSpan(listSpan, err)
 		if err != nil {
-			errors = append(errors, fmt.Errorf("Cannot list images from repo '%s': %v", repoName, err))
-			continue
+			if !t.IgnoreKubernetesErrors {
+				result.Errors = append(result.Errors, err)
+				return result
+			}
+			t.log().Warningf("%v, proceeding as if no images were used by jobs", err)
 		}
-		glog.Infof("Number of images in ECR repo: %d", len(images))
+		t.log().Infof("There are currently %d images used by jobs and cron jobs.", len(jobImageRefs))
 
-		unusedOldImages := FilterOldUnusedImages(t.MaxImages, images, usedImages[repoName])
+		imageRefs = append(imageRefs, jobImageRefs...)
+	}
 
-		if len(unusedOldImages) == 0 {
-			glog.Info("There's no old unused images to remove. Continuing.")
-			continue
+	if t.UseRevisionHistoryImages {
+		_, listSpan := startSpan(ctx, "List replica sets and controller revisions")
+		revisionImageRefs, err := t.revisionImageReferences(kubeClient, namespaces)
+		endSpan(listSpan, err)
+		if err != nil {
+			if !t.IgnoreKubernetesErrors {
+				result.Errors = append(result.Errors, err)
+				return result
+			}
+			t.log().Warningf("%v, proceeding as if no images were needed for rollbacks", err)
 		}
+		t.log().Infof("There are currently %d images needed for rollbacks.", len(revisionImageRefs))
 
-		glog.Infof("Removing %d old unused images.", len(unusedOldImages))
-		if err = ecrClient.BatchRemoveImages(unusedOldImages); err != nil {
-			errors = append(errors, fmt.Errorf("Could not batch remove images from repo '%s': %v", repoName, err))
-			continue
+		imageRefs = append(imageRefs, revisionImageRefs...)
+	}
+
+	for _, scanner := range t.workloadScanners() {
+		_, listSpan := startSpan(ctx, "List "+scanner.Name())
+		workloadImageRefs, err := scanner.ScanImages(kubeClient, namespaces)
+		endSpan(listSpan, err)
+		if err != nil {
+			if !t.IgnoreKubernetesErrors {
+				result.Errors = append(result.Errors, fmt.Errorf("Cannot list %s: %v", scanner.Name(), err))
+				return result
+			}
+			t.log().Warningf("Cannot list %s, proceeding as if no images were used by them: %v", scanner.Name(), err)
+		}
+		t.log().Infof("There are currently %d images used by %s.", len(workloadImageRefs), scanner.Name())
+
+		imageRefs = append(imageRefs, workloadImageRefs...)
+	}
+
+	if t.UseNodePinnedImages {
+		_, listSpan := startSpan(ctx, "List nodes")
+		nodes, err := kubeClient.ListNodes()
+		endSpan(listSpan, err)
+		if err != nil {
+			if !t.IgnoreKubernetesErrors {
+				result.Errors = append(result.Errors, fmt.Errorf("Cannot list nodes: %v", err))
+				return result
+			}
+			t.log().Warningf("Cannot list nodes, proceeding as if no images were pinned: %v", err)
+		}
+
+		pinnedImageRefs := PinnedImageReferencesFromNodes(nodes)
+		t.log().Infof("There are currently %d images pinned via node annotations.", len(pinnedImageRefs))
+
+		imageRefs = append(imageRefs, pinnedImageRefs...)
+	}
+
+	if t.KeepTagsConfigMap != "" {
+		namespace, name, err := ParseNamespacedName(t.KeepTagsConfigMap)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Errorf("Invalid keep tags ConfigMap: %v", err))
+			return result
+		}
+
+		_, getSpan := startSpan(ctx, "Get keep tags ConfigMap")
+		configMap, err := kubeClient.GetConfigMap(namespace, name)
+		endSpan(getSpan, err)
+		if err != nil && !t.IgnoreKubernetesErrors {
+			result.Errors = append(result.Errors, fmt.Errorf("Cannot get keep tags ConfigMap: %v", err))
+			return result
+		}
+
+		switch {
+		case err != nil:
+			t.log().Warningf("Cannot get keep tags ConfigMap, proceeding as if no tags were listed: %v", err)
+		case configMap == nil:
+			t.log().Warningf("Keep tags ConfigMap '%s' does not exist, proceeding as if no tags were listed.", t.KeepTagsConfigMap)
+		}
+
+		state.keepTags = TagsFromConfigMap(configMap)
+		t.log().Infof("There are currently %d tags listed in the keep tags ConfigMap.", len(state.keepTags))
+	}
+
+	var namespaceKeepCounts map[string]int
+	if t.UseNamespaceKeepCounts {
+		_, listSpan := startSpan(ctx, "List namespace keep counts")
+		namespaceKeepCounts, err = t.namespaceKeepCounts(kubeClient)
+		endSpan(listSpan, err)
+		if err != nil {
+			if !t.IgnoreKubernetesErrors {
+				result.Errors = append(result.Errors, fmt.Errorf("Cannot list namespace keep counts: %v", err))
+				return result
+			}
+			t.log().Warningf("Cannot list namespace keep counts, proceeding as if there were none: %v", err)
+		}
+		t.log().Infof("There are currently %d namespaces demanding a keep count.", len(namespaceKeepCounts))
+	}
+
+	// Images hosted in different registries are different images, so they
+	// are only counted once for each registry
+	usedImagesByRegion := map[string]map[string][]string{}
+	countedHosts := map[string]bool{}
+	for _, region := range regions {
+		host := t.registryHost(region)
+		usedImagesByRegion[region] = ECRImagesFromReferences(imageRefs, host, t.RegistryAliases)
+		state.keepCounts[region] = RepositoryKeepCounts(pods, namespaceKeepCounts, host, t.RegistryAliases)
+
+		if !countedHosts[host] {
+			countedHosts[host] = true
+			for _, tags := range usedImagesByRegion[region] {
+				result.ImagesInUse += len(tags)
+			}
 		}
 	}
+	t.log().Infof("There are currently %d ECR images in use.", result.ImagesInUse)
+	imagesInUse.Set(float64(result.ImagesInUse))
+
+	if t.RecentPullWindow > 0 {
+		_, listSpan := startSpan(ctx, "List recent pulls")
+		state.recentPulls, err = t.PullEventsClient.ListRecentPulls(time.Now().Add(-t.RecentPullWindow))
+		endSpan(listSpan, err)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Errorf("Cannot list recent image pulls: %v", err))
+			return result
+		}
+		t.log().Infof("Images from %d ECR repos were pulled in the last %v.", len(state.recentPulls), t.RecentPullWindow)
+	}
+
+	for _, regional := range ecrClients {
+		before := *result
+
+		regionCtx, regionSpan := startSpan(ctx, "CleanupRegion", regionAttribute.String(regional.Region))
+		t.passTraceContext.Store(contextHolder{regionCtx})
+		t.reconcileRegion(regional.Region, regional.Client, usedImagesByRegion[regional.Region], state, result)
+		t.passTraceContext.Store(contextHolder{ctx})
+		endSpan(regionSpan, (&MultiError{Errors: result.Errors[len(before.Errors):]}).ErrorOrNil())
+
+		result.Regions = append(result.Regions, RegionResult{
+			Region:                regional.Region,
+			RepositoriesProcessed: result.RepositoriesProcessed - before.RepositoriesProcessed,
+			ImagesSelected:        result.ImagesSelected - before.ImagesSelected,
+			ImagesDeleted:         result.ImagesDeleted - before.ImagesDeleted,
+			Errors:                append([]error{}, result.Errors[len(before.Errors):]...),
+		})
+	}
+
+	if t.ReclaimBytes > 0 {
+		t.log().Infof("Reclaimed %d bytes in this pass, with %d bytes selected for the %d bytes target.", result.BytesDeleted, result.BytesSelected, t.ReclaimBytes)
+	}
+
+	repositoriesDiscovered.Set(float64(state.reposDiscovered))
+	repositoriesOrphaned.Set(float64(result.RepositoriesOrphaned))
+	repositoriesSuspended.Set(float64(result.RepositoriesSuspended))
+
+	if err = t.reportPlan(result.Plan); err != nil {
+		result.Errors = append(result.Errors, err)
+	}
+
+	t.log().Infof("Cleanup loop finished.")
+
+	return result
+}
 
-	glog.Info("Cleanup loop finished.")
+// jobImageReferences returns the image references used by the jobs and cron
+// jobs of the given namespaces, leaving out the jobs that finished before
+// `JobHistoryWindow`.
+func (t *CleanupTask) jobImageReferences(kubeClient KubernetesClient, namespaces []*string) ([]string, error) {
+	jobs, err := kubeClient.ListJobs(namespaces)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list jobs: %v", err)
+	}
+
+	cronJobs, err := kubeClient.ListCronJobs(namespaces)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list cron jobs: %v", err)
+	}
+
+	var since time.Time
+	if t.JobHistoryWindow > 0 {
+		since = time.Now().Add(-t.JobHistoryWindow)
+	}
+
+	return append(ImageReferencesFromJobs(jobs, since), ImageReferencesFromCronJobs(cronJobs)...), nil
+}
+
+// revisionImageReferences returns the image references used by the replica
+// sets and controller revisions of the given namespaces, which deployments
+// and stateful sets roll back to.
+func (t *CleanupTask) revisionImageReferences(kubeClient KubernetesClient, namespaces []*string) ([]string, error) {
+	replicaSets, err := kubeClient.ListReplicaSets(namespaces)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list replica sets: %v", err)
+	}
+
+	revisionImageRefs, err := kubeClient.ListControllerRevisionImages(namespaces)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list controller revisions: %v", err)
+	}
+
+	return append(ImageReferencesFromReplicaSets(replicaSets), revisionImageRefs...), nil
+}
+
+// reconcileRegion cleans up the repositories of the given region, in which
+// the given images are in use, and records the outcome in the given result.
+func (t *CleanupTask) reconcileRegion(region string, ecrClient ECRClient, usedImages map[string][]string, state *passState, result *ReconcileResult) {
+	if state.canceled(region, result) {
+		return
+	}
+
+	var repos []*ecr.Repository
+	var err error
+	if t.DiscoverRepositories {
+		repos, err = ecrClient.ListAllRepositories()
+	} else {
+		repos, err = ecrClient.ListRepositories(t.EcrRepositories)
+	}
+	if err != nil {
+		result.Errors = append(result.Errors, &RepositoryError{
+			Region:  region,
+			Message: "Cannot list ECR repositories",
+			Err:     err,
+		})
+		return
+	}
+
+	state.reposDiscovered += len(repos)
+	if len(repos) < t.MinRepositories {
+		err = fmt.Errorf("Found %d ECR repositories, but expected at least %d; make sure the AWS credentials and region are correct", len(repos), t.MinRepositories)
+
+		if t.MinRepositoriesAction == MinRepositoriesActionError {
+			result.Errors = append(result.Errors, &RepositoryError{
+				Region: region,
+				Err:    err,
+			})
+			return
+		}
+		t.log().Warningf("%v", &RepositoryError{Region: region, Err: err})
+	}
+
+	if t.DiscoverRepositories && (len(t.RepositoryIncludePatterns) > 0 || len(t.RepositoryExcludePatterns) > 0) {
+		matchingRepos := FilterRepositoriesByName(repos, t.RepositoryIncludePatterns, t.RepositoryExcludePatterns)
+		t.log().Infof("Only %d out of %d ECR repos discovered in '%s' region match the repo patterns, skipping the others.", len(matchingRepos), len(repos), region)
+		repos = matchingRepos
+	}
+
+	if t.OnlyRepositoriesInUse {
+		inUseRepos := FilterRepositoriesInUse(repos, usedImages)
+		t.log().Infof("Only %d out of %d ECR repos in '%s' region have images in use, skipping the others.", len(inUseRepos), len(repos), region)
+		repos = inUseRepos
+	}
+
+	var replicatedErrs []error
+	repos, replicatedErrs = t.filterReplicatedRepositories(region, ecrClient, repos)
+	result.Errors = append(result.Errors, replicatedErrs...)
+
+	plan := result.Plan
+
+	// Repositories processed in this pass, and the ones that failed as a
+	// whole, as per `RepositoryFailureThreshold`
+	processedRepos := []string{}
+	failedRepos := map[string]bool{}
+	defer func() {
+		t.recordRepositoryFailures(region, processedRepos, failedRepos)
+	}()
+
+	// Images to delete from each repository, in the order the repositories
+	// were processed
+	repoNames := []string{}
+	repoImages := map[string][]*ecr.ImageDetail{}
+	repoTagsInUse := map[string][]string{}
+	repoProtectedTags := map[string][]string{}
+	repoRules := map[string]repositoryRules{}
+	repoAudits := map[string]repositoryAudit{}
+	imagesToDelete := map[string][]*ecr.ImageDetail{}
+	orphaned := []*repositorySelection{}
+
+	for _, selection := range t.selectImagesInRepositories(region, ecrClient, repos, usedImages, state) {
+		if selection != nil && selection.suspended {
+			result.RepositoriesSuspended++
+		}
+		if selection == nil || !selection.processed {
+			continue
+		}
+
+		repoName := *selection.repo.RepositoryName
+
+		plan.AddRepository(region, selection.repo)
+		result.RepositoriesProcessed++
+		processedRepos = append(processedRepos, repoName)
+
+		if selection.err != nil {
+			result.Errors = append(result.Errors, selection.err)
+			failedRepos[repoName] = true
+			continue
+		}
+
+		if selection.orphaned != "" {
+			orphaned = append(orphaned, selection)
+		}
+
+		plan.AddRepositoryImages(region, repoName, selection.images)
+		plan.AddRetainedImages(region, repoName, selection.retained)
+		for _, image := range selection.retained {
+			result.ImagesRetained[image.Reason]++
+		}
+
+		if len(selection.imagesToDelete) == 0 {
+			continue
+		}
+
+		repoNames = append(repoNames, repoName)
+		repoImages[repoName] = selection.images
+		repoTagsInUse[repoName] = selection.tagsInUse
+		repoProtectedTags[repoName] = selection.protectedTags
+		repoRules[repoName] = selection.rules
+		repoAudits[repoName] = repositoryAudit{policy: selection.policy, reasons: selection.deleteReasons}
+		imagesToDelete[repoName] = selection.imagesToDelete
+	}
+
+	if state.canceled(region, result) {
+		return
+	}
+
+	t.handleOrphanedRepositories(region, ecrClient, orphaned, result)
+
+	if t.MaxDeletesPerRepository > 0 {
+		var deferred map[string][]*ecr.ImageDetail
+		imagesToDelete, deferred = LimitDeletionsPerRepository(imagesToDelete, t.MaxDeletesPerRepository)
+
+		for _, repoName := range repoNames {
+			if images := deferred[repoName]; len(images) > 0 {
+				result.ImagesDeferred += len(images)
+				t.log().Infof("Deleting only the %d oldest images from '%s' ECR repo in this pass, %d images will be deleted in the next passes: [%s].", t.MaxDeletesPerRepository, repoName, len(images), strings.Join(imageDigests(images), ", "))
+				t.emitImageEvents(repoName, images, v1.EventTypeNormal, EventReasonImageDeletionSkipped, "Not removing image '%s' from '%s' ECR repo, tagged with [%s], in this pass due to -max-deletes-per-repo.")
+			}
+		}
+	}
+
+	// Whatever was selected in the previous regions counts towards the limits
+	if t.MaxDeletesPerReconcile > 0 {
+		maxDeletes := t.MaxDeletesPerReconcile - (result.ImagesSelected - result.OrphanedManifestListsSelected)
+		if maxDeletes < 0 {
+			maxDeletes = 0
+		}
+
+		var deferred int
+		imagesToDelete, deferred = LimitDeletions(imagesToDelete, maxDeletes)
+		result.ImagesDeferred += deferred
+
+		if deferred > 0 {
+			t.log().Infof("Deleting only the %d oldest images in this pass, %d images will be deleted in the next passes.", t.MaxDeletesPerReconcile, result.ImagesDeferred)
+		}
+	}
+
+	// The budget only applies to the images left by the other limits, and
+	// the ones selected in the previous regions which went ahead count
+	// towards it
+	if t.ReclaimBytes > 0 {
+		imagesToDelete = t.limitDeletionsByReclaimBytes(imagesToDelete, repoImages, result)
+	}
+
+	if t.VerifyPlan {
+		violations := []error{}
+		for _, repoName := range repoNames {
+			for _, err := range VerifyImagesToDelete(repoImages[repoName], imagesToDelete[repoName], usedImages[repoName], repoProtectedTags[repoName], t.minImagesToKeep(repoRules[repoName])) {
+				violations = append(violations, &RepositoryError{
+					Region:     region,
+					Repository: repoName,
+					Message:    "Plan verification failed",
+					Err:        err,
+				})
+			}
+		}
+
+		if len(violations) > 0 {
+			t.log().Errorf("Plan verification found %d violations, no images will be removed from '%s' region in this pass.", len(violations), region)
+			result.Errors = append(result.Errors, violations...)
+
+			for _, repoName := range repoNames {
+				t.emitImageEvents(repoName, imagesToDelete[repoName], v1.EventTypeWarning, EventReasonImageDeletionSkipped, "Not removing image '%s' from '%s' ECR repo, tagged with [%s], since plan verification failed.")
+			}
+			return
+		}
+		t.log().Infof("Verified the images selected for deletion from %d ECR repos.", len(repoNames))
+	}
+
+	for _, repoName := range repoNames {
+		unusedOldImages := imagesToDelete[repoName]
+		if len(unusedOldImages) == 0 {
+			continue
+		}
+
+		if state.canceled(region, result) {
+			return
+		}
+
+		if state.auditBlocked {
+			t.log().Warningf("Not removing %d old unused images from '%s' ECR repo, since deleted images cannot be recorded for audit.", len(unusedOldImages), repoName)
+			t.emitImageEvents(repoName, unusedOldImages, v1.EventTypeWarning, EventReasonImageDeletionSkipped, "Not removing image '%s' from '%s' ECR repo, tagged with [%s], since deleted images cannot be recorded for audit.")
+			continue
+		}
+
+		if t.wouldEmptyRepository(len(unusedOldImages), len(repoImages[repoName])) {
+			t.log().Warningf("Removing %d old unused images would leave '%s' ECR repo empty, skipping.", len(unusedOldImages), repoName)
+			t.emitImageEvents(repoName, unusedOldImages, v1.EventTypeWarning, EventReasonImageDeletionSkipped, "Not removing image '%s' from '%s' ECR repo, tagged with [%s], since it would leave the repo empty.")
+			continue
+		}
+
+		result.ImagesSelected += len(unusedOldImages)
+		if t.ReclaimBytes > 0 {
+			result.BytesSelected += imagesSize(unusedOldImages)
+		}
+
+		if t.DryRun {
+			t.log().Infof("Would remove %d old unused images from '%s' ECR repo.", len(unusedOldImages), repoName)
+			t.logImagesToDelete(repoName, unusedOldImages)
+			t.emitImageEvents(repoName, unusedOldImages, v1.EventTypeNormal, EventReasonImageDeletionSkipped, "Would remove image '%s' from '%s' ECR repo, tagged with [%s], if not for a dry run.")
+			plan.AddImages(region, repoName, unusedOldImages, PlanActionWouldDelete)
+
+			if t.DeleteOrphanedManifestLists {
+				t.removeOrphanedManifestLists(region, ecrClient, repoName, ExcludeImages(repoImages[repoName], unusedOldImages), repoTagsInUse[repoName], repoAudits[repoName].policy, result)
+			}
+			continue
+		}
+
+		imagesToRemove := unusedOldImages
+		if t.QuarantineRetention > 0 {
+			var quarantined int
+			imagesToRemove, quarantined, err = t.quarantineImages(ecrClient, repoName, unusedOldImages)
+			result.ImagesQuarantined += quarantined
+			if err != nil {
+				failedRepos[repoName] = failedRepos[repoName] || repositoryAccessDenied(err)
+				result.Errors = append(result.Errors, &RepositoryError{
+					Region:     region,
+					Repository: repoName,
+					Message:    "Could not quarantine images",
+					Err:        err,
+				})
+			}
+		}
+
+		attemptedImages, removedImages := []*ecr.ImageDetail{}, []*ecr.ImageDetail{}
+		if len(imagesToRemove) > 0 {
+			t.log().Infof("Removing %d old unused images from '%s' ECR repo.", len(imagesToRemove), repoName)
+			attemptedImages, removedImages, err = t.deleteImages(ecrClient, repoName, imagesToRemove, state)
+			result.ImagesDeleted += len(removedImages)
+			result.BytesDeleted += imagesSize(removedImages)
+			if t.ReclaimBytes > 0 {
+				result.BytesSelected -= imagesSize(ExcludeImages(imagesToRemove, removedImages))
+			}
+			t.logDeletedImages(repoName, removedImages)
+			if err != nil {
+				failedRepos[repoName] = failedRepos[repoName] || repositoryAccessDenied(err)
+				result.Errors = append(result.Errors, &RepositoryError{
+					Region:     region,
+					Repository: repoName,
+					Message:    "Could not remove images",
+					Err:        err,
+				})
+				t.emitImageEvents(repoName, ExcludeImages(attemptedImages, removedImages), v1.EventTypeWarning, EventReasonImageDeletionFailed, "Could not remove image '%s' from '%s' ECR repo, tagged with [%s].")
+			}
+
+			state.auditBlocked = !t.recordDeletions(region, repoName, removedImages, repoAudits[repoName], result)
+		}
+
+		plan.AddImages(region, repoName, removedImages, PlanActionDeleted)
+		plan.AddImages(region, repoName, ExcludeImages(unusedOldImages, removedImages), PlanActionRetained)
+
+		// Images left out because the pass was canceled are removed in the
+		// next passes
+		if len(attemptedImages) < len(imagesToRemove) && state.canceled(region, result) {
+			return
+		}
+
+		if t.DeleteOrphanedManifestLists && len(removedImages) > 0 && !state.auditBlocked {
+			state.auditBlocked = !t.removeOrphanedManifestLists(region, ecrClient, repoName, ExcludeImages(repoImages[repoName], removedImages), repoTagsInUse[repoName], repoAudits[repoName].policy, result)
+		}
+	}
+}
+
+// wouldEmptyRepository tells whether deleting the given number of images from
+// a repository, out of the given number of images listed from it, leaves it
+// empty, unless `AllowEmptyRepositories` is set. With `ImageTagStatus`, the
+// images with the other tag status are not listed, so the repository is never
+// considered emptied.
+func (t *CleanupTask) wouldEmptyRepository(deleted, listed int) bool {
+	if t.AllowEmptyRepositories || t.ImageTagStatus != "" {
+		return false
+	}
+	return deleted >= listed
+}
+
+// limitDeletionsByReclaimBytes returns the oldest of the given images to
+// delete from each repository, as per `LimitDeletionsBySize`, which are
+// needed to reach what is left of `ReclaimBytes` after the images selected in
+// the previous regions. Unless `AllowEmptyRepositories` is set, the most
+// recent image of each repository is left out, so that reaching the target
+// never empties a repository.
+func (t *CleanupTask) limitDeletionsByReclaimBytes(imagesToDelete, repoImages map[string][]*ecr.ImageDetail, result *ReconcileResult) map[string][]*ecr.ImageDetail {
+	candidates := map[string][]*ecr.ImageDetail{}
+	for repoName, images := range imagesToDelete {
+		if len(images) > 0 && t.wouldEmptyRepository(len(images), len(repoImages[repoName])) {
+			images = append([]*ecr.ImageDetail{}, images...)
+			SortImagesByPushDate(images)
+			images = images[:len(images)-1]
+		}
+		candidates[repoName] = images
+	}
+
+	targetBytes := t.ReclaimBytes - result.BytesSelected
+	if targetBytes < 0 {
+		targetBytes = 0
+	}
+
+	limited, selectedBytes := LimitDeletionsBySize(candidates, targetBytes)
+	if selectedBytes < targetBytes {
+		t.log().Warningf("Only %d more bytes can be reclaimed in this pass, %d bytes short of the %d bytes target.", selectedBytes, targetBytes-selectedBytes, t.ReclaimBytes)
+	} else {
+		t.log().Infof("Selected images taking up %d bytes to reclaim at least %d more bytes.", selectedBytes, targetBytes)
+	}
+
+	return limited
+}
+
+// deleteImages deletes the given images from the given repository in batches,
+// stopping before the next batch once the context of the pass is done, so
+// that the deletions already sent to ECR are finished. It returns the images
+// whose deletion was attempted, along with the ones actually deleted.
+func (t *CleanupTask) deleteImages(ecrClient ECRClient, repoName string, images []*ecr.ImageDetail, state *passState) ([]*ecr.ImageDetail, []*ecr.ImageDetail, error) {
+	attempted, removed := []*ecr.ImageDetail{}, []*ecr.ImageDetail{}
+	errs := &MultiError{}
+
+	_, span := startSpan(t.traceContext(), "DeleteRepositoryImages", repositoryAttribute.String(repoName), attribute.Int("ecr.images_selected", len(images)))
+	defer func() {
+		span.SetAttributes(attribute.Int("ecr.images_deleted", len(removed)))
+		endSpan(span, errs.ErrorOrNil())
+	}()
+
+	for start := 0; start < len(images); start += batchRemoveMaxImages {
+		if state.ctx.Err() != nil {
+			t.log().Warningf("Pass canceled, not removing the remaining %d old unused images from '%s' ECR repo.", len(images)-start, repoName)
+			break
+		}
+
+		end := start + batchRemoveMaxImages
+		if end > len(images) {
+			end = len(images)
+		}
+
+		batch := images[start:end]
+		err := ecrClient.DeleteImages(batch)
+		attempted = append(attempted, batch...)
+		removed = append(removed, succeededImages(batch, err)...)
+		errs.Append(err)
+	}
+
+	return attempted, removed, errs.ErrorOrNil()
+}
+
+// repositorySelection is what a clean-up pass found out about a repository
+// before deleting any images from it.
+type repositorySelection struct {
+	repo *ecr.Repository
+
+	// Whether the repository was processed, rather than skipped
+	processed bool
+
+	// Whether the repository was skipped because it kept failing
+	suspended bool
+
+	// Error that stopped the repository from being processed any further
+	err error
+
+	images        []*ecr.ImageDetail
+	tagsInUse     []string
+	protectedTags []string
+	rules         repositoryRules
+
+	// Cleanup policy applied to the repository, if any
+	policy string
+
+	// Why the repository is orphaned, if it is
+	orphaned string
+
+	imagesToDelete []*ecr.ImageDetail
+	deleteReasons  map[string]string
+	retained       []RetainedImage
+}
+
+// selectImagesInRepositories selects the images to delete from each of the
+// given repositories of the given region, in which the given images are in
+// use, processing up to `Concurrency` repositories at once. The selections
+// are returned in the order of the repositories, and are nil for the ones
+// left out because the context of the pass is done.
+func (t *CleanupTask) selectImagesInRepositories(region string, ecrClient ECRClient, repos []*ecr.Repository, usedImages map[string][]string, state *passState) []*repositorySelection {
+	selections := make([]*repositorySelection, len(repos))
+
+	workers := t.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(repos) {
+		workers = len(repos)
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Each worker only writes the selections of its own repositories
+			for index := range indexes {
+				selections[index] = t.selectRepositoryImages(region, ecrClient, repos[index], usedImages, state)
+			}
+		}()
+	}
+
+	for index := range repos {
+		if state.ctx.Err() != nil {
+			break
+		}
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+
+	return selections
+}
+
+// selectRepositoryImages selects the images to delete from the given
+// repository of the given region, in which the given images are in use. It
+// only reads the given pass state, so it's safe to call for several
+// repositories at once.
+func (t *CleanupTask) selectRepositoryImages(region string, ecrClient ECRClient, repo *ecr.Repository, usedImages map[string][]string, state *passState) *repositorySelection {
+	repoName := *repo.RepositoryName
+	selection := &repositorySelection{repo: repo}
+
+	_, span := startSpan(t.traceContext(), "SelectRepositoryImages", regionAttribute.String(region), repositoryAttribute.String(repoName))
+	defer func() {
+		span.SetAttributes(
+			attribute.Bool("ecr.processed", selection.processed),
+			attribute.Int("ecr.images", len(selection.images)),
+			attribute.Int("ecr.images_selected", len(selection.imagesToDelete)),
+		)
+		endSpan(span, selection.err)
+	}()
+
+	// Images might still be being pushed to brand-new repositories
+	if t.RepositoryGracePeriod > 0 && repo.CreatedAt != nil && time.Since(*repo.CreatedAt) < t.RepositoryGracePeriod {
+		t.log().Infof("Skipping '%s' ECR repo, which was created less than %v ago.", repoName, t.RepositoryGracePeriod)
+		return selection
+	}
+
+	if until, ok := t.repositoryFailures.suspended(repositoryBreakerKey(region, repoName), time.Now()); ok {
+		t.log().Warningf("Skipping '%s' ECR repo, which is suspended until %v since it kept failing.", repoName, until.Format(time.RFC3339))
+		selection.suspended = true
+		return selection
+	}
+
+	// Repositories can opt out of the clean-up by their tags, while failing
+	// to list them fails the repository below
+	var repoTags map[string]string
+	var repoTagsErr error
+	if t.UseRepositoryTags {
+		repoTags, repoTagsErr = listRepositoryTags(ecrClient, repo)
+		if repoTagsErr == nil && disabledByRepositoryTags(repoTags) {
+			t.log().Infof("Skipping '%s' ECR repo, which opted out by its '%s' tag.", repoName, RepositoryTagEnabled)
+			return selection
+		}
+	}
+
+	t.log().Infof("Processing '%s' ECR repo in '%s' region.", repoName, region)
+
+	selection.processed = true
+	repositoriesProcessedTotal.Inc()
+
+	policy, err := t.policyFor(state.policies, repoName)
+	if err != nil {
+		selection.err = &RepositoryError{
+			Region:     region,
+			Repository: repoName,
+			Err:        err,
+		}
+		return selection
+	}
+	selection.rules = t.rulesFor(policy)
+	if policy != nil {
+		selection.policy = policy.String()
+	}
+
+	// Tags set by the owners of the repository win over cleanup policies
+	if t.UseRepositoryTags {
+		rules := selection.rules
+		if repoTagsErr == nil {
+			rules, repoTagsErr = rulesFromRepositoryTags(repoTags, selection.rules)
+		}
+		if repoTagsErr != nil {
+			selection.err = &RepositoryError{
+				Region:     region,
+				Repository: repoName,
+				Err:        repoTagsErr,
+			}
+			return selection
+		}
+
+		if rules != selection.rules {
+			t.log().Infof("Applying the retention rules given by the tags of '%s' ECR repo.", repoName)
+			selection.rules = rules
+		}
+	}
+
+	// Namespaces can only demand more images to be kept than the other rules
+	if keepCount := state.keepCounts[region][repoName]; keepCount > selection.rules.maxImages {
+		t.log().Infof("Keeping %d images in '%s' ECR repo, as demanded by the '%s' annotation of the namespaces using it.", keepCount, repoName, NamespaceKeepCountAnnotation)
+		selection.rules.maxImages = keepCount
+	}
+
+	images, err := ecrClient.ListImages(&repoName)
+	if err != nil {
+		selection.err = &RepositoryError{
+			Region:     region,
+			Repository: repoName,
+			Message:    "Cannot list images",
+			Err:        err,
+		}
+		return selection
+	}
+	t.log().Infof("Number of images in '%s' ECR repo: %d", repoName, len(images))
+	imagesScannedTotal.WithLabelValues(repoName).Add(float64(len(images)))
+
+	protectedTags := append(append([]string{}, state.keepTags...), TagsMatchingPatterns(images, t.KeepTagPatterns)...)
+	if policy != nil {
+		protectedTags = append(protectedTags, policy.Spec.ProtectedTags...)
+	}
+	tagsInUse := append(append([]string{}, usedImages[repoName]...), protectedTags...)
+
+	if t.OrphanedRepositoryDays > 0 {
+		selection.orphaned = orphanedReason(repo, images, tagsInUse, state.recentPulls[repoName], t.OrphanedRepositoryDays, time.Now())
+	}
+
+	// Manifests are cached per repository, so that workers don't share it
+	deleteReasons := map[string]string{}
+	unusedOldImages, retained, err := t.selectImagesToDelete(ecrClient, repoName, images, tagsInUse, state.recentPulls[repoName], map[string]string{}, deleteReasons, selection.rules)
+	if err != nil {
+		selection.err = &RepositoryError{
+			Region:     region,
+			Repository: repoName,
+			Err:        err,
+		}
+		return selection
+	}
+
+	if len(unusedOldImages) == 0 {
+		t.log().Infof("There's no old unused images to remove from '%s' ECR repo. Continuing.", repoName)
+	}
+
+	selection.images = images
+	selection.tagsInUse = tagsInUse
+	selection.protectedTags = protectedTags
+	selection.imagesToDelete = unusedOldImages
+	selection.deleteReasons = deleteReasons
+	selection.retained = retained
+
+	return selection
+}
+
+// minImagesToKeep returns the number of images that must be left in a
+// repository with the given rules according to `MaxImages`, which only holds
+// as long as no other rule deletes images regardless of it.
+func (t *CleanupTask) minImagesToKeep(rules repositoryRules) int {
+	if t.CountSince > 0 || t.ReclaimBytes > 0 || t.DeleteUntaggedImages || t.MaxTagsPerImage > 0 || t.MinImageSizeBytes > 0 || rules.maxImageAge > 0 || t.hasUntaggedPolicy() || t.DeleteManifestListChildren || t.DeleteCriticalFindings || t.MaxRepositorySizeBytes > 0 {
+		return 0
+	}
+	return rules.maxImages
+}
+
+// keepMaxGroup returns the function giving the group of images each image
+// belongs to, to which `MaxImages` applies, as per `SemverRetention` or
+// `TagGroupPattern`, or nil if it applies to the whole repository.
+func (t *CleanupTask) keepMaxGroup() func(*ecr.ImageDetail) string {
+	switch {
+	case t.SemverRetention != "":
+		return func(image *ecr.ImageDetail) string {
+			return SemverLine(image, t.SemverRetention)
+		}
+	case t.TagGroupPattern != nil:
+		return func(image *ecr.ImageDetail) string {
+			return TagGroup(image, t.TagGroupPattern)
+		}
+	}
+	return nil
+}
+
+// hasUntaggedPolicy tells whether untagged images are subject to their own
+// policy, given by `UntaggedKeepCount` and `UntaggedMaxAge`.
+func (t *CleanupTask) hasUntaggedPolicy() bool {
+	return t.UntaggedKeepCount > 0 || t.UntaggedMaxAge > 0
+}
+
+// getImageManifests returns the manifests of the given images from the given
+// repository, only fetching the ones missing from the given cache, which is
+// then updated.
+func getImageManifests(ecrClient ECRClient, repoName string, images []*ecr.ImageDetail, cache map[string]string) (map[string]string, error) {
+	missing := []*ecr.ImageDetail{}
+	for _, image := range images {
+		if _, ok := cache[aws.StringValue(image.ImageDigest)]; !ok {
+			missing = append(missing, image)
+		}
+	}
+
+	if len(missing) > 0 {
+		manifests, err := ecrClient.GetImageManifests(&repoName, missing)
+		if err != nil {
+			return nil, err
+		}
+
+		for digest, manifest := range manifests {
+			cache[digest] = manifest
+		}
+	}
+
+	return cache, nil
+}
+
+// removeOrphanedManifestLists deletes the manifest lists among the images
+// left in the given repository of the given region whose children are all
+// gone, or only reports them in a dry run, and records the outcome in the
+// given result. The deleted manifest lists are recorded for audit along with
+// the given policy. It returns false if further deletions must be stopped, as
+// per `recordDeletions`.
+func (t *CleanupTask) removeOrphanedManifestLists(region string, ecrClient ECRClient, repoName string, images []*ecr.ImageDetail, tagsInUse []string, policy string, result *ReconcileResult) bool {
+	children, err := ecrClient.ListManifestListChildren(&repoName, images)
+	if err != nil {
+		result.Errors = append(result.Errors, &RepositoryError{
+			Region:     region,
+			Repository: repoName,
+			Message:    "Cannot list manifest list children",
+			Err:        err,
+		})
+		return true
+	}
+
+	orphaned := FilterOrphanedManifestLists(images, children, tagsInUse)
+	if len(orphaned) == 0 {
+		return true
+	}
+
+	result.ImagesSelected += len(orphaned)
+	result.OrphanedManifestListsSelected += len(orphaned)
+
+	if t.DryRun {
+		t.log().Infof("Would remove %d orphaned manifest lists from '%s' ECR repo.", len(orphaned), repoName)
+		t.logImagesToDelete(repoName, orphaned)
+		t.emitImageEvents(repoName, orphaned, v1.EventTypeNormal, EventReasonImageDeletionSkipped, "Would remove orphaned manifest list '%s' from '%s' ECR repo, tagged with [%s], if not for a dry run.")
+		result.Plan.AddImages(region, repoName, orphaned, PlanActionWouldDelete)
+		return true
+	}
+
+	t.log().Infof("Removing %d orphaned manifest lists from '%s' ECR repo.", len(orphaned), repoName)
+	err = ecrClient.DeleteImages(orphaned)
+	removed := succeededImages(orphaned, err)
+	result.ImagesDeleted += len(removed)
+	result.BytesDeleted += imagesSize(removed)
+	t.logDeletedImages(repoName, removed)
+	if err != nil {
+		result.Errors = append(result.Errors, &RepositoryError{
+			Region:     region,
+			Repository: repoName,
+			Message:    "Could not remove orphaned manifest lists",
+			Err:        err,
+		})
+		t.emitImageEvents(repoName, ExcludeImages(orphaned, removed), v1.EventTypeWarning, EventReasonImageDeletionFailed, "Could not remove orphaned manifest list '%s' from '%s' ECR repo, tagged with [%s].")
+	}
+
+	result.Plan.AddImages(region, repoName, removed, PlanActionDeleted)
+	result.Plan.AddImages(region, repoName, ExcludeImages(orphaned, removed), PlanActionRetained)
+
+	reasons := map[string]string{}
+	addDeleteReasons(reasons, removed, DeleteReasonOrphanedManifestList)
+
+	return t.recordDeletions(region, repoName, removed, repositoryAudit{policy: policy, reasons: reasons}, result)
+}
+
+// logImagesToDelete logs each of the given images, which would be deleted from
+// the given repository if not for a dry run.
+func (t *CleanupTask) logImagesToDelete(repoName string, images []*ecr.ImageDetail) {
+	for _, image := range images {
+		digest, tags, pushedAt := imageLogDetails(image)
+		t.imageLog(repoName, image, PlanActionWouldDelete).Infof("Would remove image '%s' from '%s' ECR repo, pushed at %s, tagged with [%s].", digest, repoName, pushedAt, tags)
+	}
+}
+
+// logDeletedImages logs each of the given images, just deleted from the given
+// repository, and emits an event for each of them.
+func (t *CleanupTask) logDeletedImages(repoName string, images []*ecr.ImageDetail) {
+	for _, image := range images {
+		digest, tags, pushedAt := imageLogDetails(image)
+		t.imageLog(repoName, image, PlanActionDeleted).Infof("Removed image '%s' from '%s' ECR repo, pushed at %s, tagged with [%s].", digest, repoName, pushedAt, tags)
+	}
+
+	t.emitImageEvents(repoName, images, v1.EventTypeNormal, EventReasonImageDeleted, "Removed image '%s' from '%s' ECR repo, tagged with [%s].")
+}
+
+// imageLog returns the logger of this task, along with fields describing the
+// given image from the given repository and what was done with it, for the
+// loggers that support them.
+func (t *CleanupTask) imageLog(repoName string, image *ecr.ImageDetail, action string) Logger {
+	digest, tags, pushedAt := imageLogDetails(image)
+	return withDetails(t.log(), "repo", repoName, "image_digest", digest, "tags", tags, "pushed_at", pushedAt, "action", action)
+}
+
+// imageLogDetails returns the digest, the comma-separated tags and the push
+// date of the given image, as logged.
+func imageLogDetails(image *ecr.ImageDetail) (string, string, string) {
+	pushedAt := "unknown"
+	if image.ImagePushedAt != nil {
+		pushedAt = image.ImagePushedAt.UTC().Format(time.RFC3339)
+	}
+
+	return aws.StringValue(image.ImageDigest), strings.Join(aws.StringValueSlice(image.ImageTags), ", "), pushedAt
+}
+
+// recordDeletions records the given images, just deleted from the given
+// repository of the given region, in the audit sink, along with the given
+// policy and reasons why they were deleted. Failures are logged, or reported
+// as errors of the given result if `AuditFailuresBlockDeletion` is set, in
+// which case false is returned so that no further images are deleted.
+func (t *CleanupTask) recordDeletions(region, repoName string, images []*ecr.ImageDetail, audit repositoryAudit, result *ReconcileResult) bool {
+	if len(images) == 0 {
+		return true
+	}
+
+	err := t.auditSink().RecordDeletions(NewAuditRecords(region, repoName, images, audit.policy, audit.reasons, time.Now(), result.ReconcileID))
+	if err == nil {
+		return true
+	}
+
+	if !t.AuditFailuresBlockDeletion {
+		t.log().Errorf("Could not record %d images removed from '%s' ECR repo for audit: %v", len(images), repoName, err)
+		return true
+	}
+
+	result.Errors = append(result.Errors, &RepositoryError{
+		Region:     region,
+		Repository: repoName,
+		Message:    "Could not record removed images for audit, no further images will be removed",
+		Err:        err,
+	})
+	return false
+}
+
+// selectImagesToDelete returns the images from the given repository that
+// should be deleted, according to the image filters of this task, as
+// overridden by the given rules of the repository, along with the images
+// retained and why. Image manifests are fetched through the given cache, and
+// the reason why each image is deleted is recorded in the given map, by
+// digest.
+func (t *CleanupTask) selectImagesToDelete(ecrClient ECRClient, repoName string, images []*ecr.ImageDetail, tagsInUse []string, recentlyPulled map[string]bool, manifestCache map[string]string, reasons map[string]string, rules repositoryRules) ([]*ecr.ImageDetail, []RetainedImage, error) {
+	selection := &ImageSelection{
+		Client:         ecrClient,
+		Repository:     repoName,
+		Images:         images,
+		TagsInUse:      tagsInUse,
+		MaxImages:      rules.maxImages,
+		MaxImageAge:    rules.maxImageAge,
+		RecentlyPulled: recentlyPulled,
+		Now:            time.Now(),
+		Selected:       []*ecr.ImageDetail{},
+		Reasons:        reasons,
+		Retained:       []RetainedImage{},
+		manifestCache:  manifestCache,
+	}
+
+	return runImageFilters(t.imageFilters(), selection)
+}
+
+// addDeleteReasons records the given reason for each of the given images in
+// the given map, by digest, unless a reason was recorded for it already.
+func addDeleteReasons(reasons map[string]string, images []*ecr.ImageDetail, reason string) {
+	for _, image := range images {
+		digest := aws.StringValue(image.ImageDigest)
+		if _, ok := reasons[digest]; !ok {
+			reasons[digest] = reason
+		}
+	}
+}
+
+// quarantineImages tags the given images from the given repository as pending
+// deletion, unless they already are, and returns the images that have been
+// pending deletion for longer than the quarantine retention, which can be
+// deleted for good, along with the number of images newly tagged.
+func (t *CleanupTask) quarantineImages(ecrClient ECRClient, repoName string, images []*ecr.ImageDetail) ([]*ecr.ImageDetail, int, error) {
+	now := time.Now()
+	toQuarantine, toDelete := SplitQuarantinedImages(images, t.QuarantineRetention, now)
+
+	if len(toQuarantine) > 0 {
+		t.log().Infof("Marking %d old unused images from '%s' ECR repo as pending deletion.", len(toQuarantine), repoName)
+
+		tags := map[string]string{}
+		for _, image := range toQuarantine {
+			tags[*image.ImageDigest] = QuarantineTag(image, now)
+		}
+
+		if err := ecrClient.TagImages(&repoName, tags); err != nil {
+			return toDelete, countSucceeded(len(toQuarantine), err), err
+		}
+	}
+
+	return toDelete, len(toQuarantine), nil
+}
+
+// reportPlan logs how the given plan differs from the previous plan, if one
+// was specified, and then writes the given plan to the plan output path and
+// to the CSV report path, if those were specified. The previous plan is
+// loaded before the new one is written, so both paths may point to the same
+// file.
+func (t *CleanupTask) reportPlan(plan *Plan) error {
+	if t.PreviousPlanPath != "" {
+		previous, err := LoadPlan(t.PreviousPlanPath)
+		if os.IsNotExist(err) {
+			t.log().Warningf("Previous plan '%s' does not exist yet, comparing against an empty plan.", t.PreviousPlanPath)
+			previous, err = NewPlan(), nil
+		}
+		if err != nil {
+			return fmt.Errorf("Cannot load previous plan: %v", err)
+		}
+
+		diff := DiffPlans(previous, plan)
+		t.log().Infof("Compared to the previous plan, %d images are newly eligible for deletion, %d are no longer eligible, and %d are unchanged.", len(diff.Added), len(diff.Removed), len(diff.Unchanged))
+
+		for _, image := range diff.Added {
+			t.log().Infof("Newly eligible: %s@%s %v", image.Repository, image.Digest, image.Tags)
+		}
+		for _, image := range diff.Removed {
+			t.log().Infof("No longer eligible: %s@%s %v", image.Repository, image.Digest, image.Tags)
+		}
+	}
+
+	if t.PlanOutputPath != "" {
+		if err := WritePlan(t.PlanOutputPath, plan); err != nil {
+			return fmt.Errorf("Cannot write plan: %v", err)
+		}
+	}
+
+	if t.ReportCSVPath != "" {
+		if err := WriteCSVReport(t.ReportCSVPath, plan); err != nil {
+			return fmt.Errorf("Cannot write CSV report: %v", err)
+		}
+	}
 
-	return errors
+	return nil
 }
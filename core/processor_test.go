@@ -1,12 +1,25 @@
 package core
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/ecr"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 
 	"k8s.io/client-go/pkg/api/v1"
+	batchv1 "k8s.io/client-go/pkg/apis/batch/v1"
+	batchv2alpha1 "k8s.io/client-go/pkg/apis/batch/v2alpha1"
+	extensionsv1beta1 "k8s.io/client-go/pkg/apis/extensions/v1beta1"
 )
 
 // mockKubeClient is used to verify that the Kubernetes client is being called
@@ -19,6 +32,42 @@ type mockKubeClient struct {
 
 	listAllPodsResult []*v1.Pod
 	listAllPodsError  error
+
+	listEphemeralContainerImagesResult []string
+	listEphemeralContainerImagesError  error
+
+	listJobsResult []*batchv1.Job
+	listJobsError  error
+
+	listCronJobsResult []*batchv2alpha1.CronJob
+	listCronJobsError  error
+
+	listReplicaSetsResult []*extensionsv1beta1.ReplicaSet
+	listReplicaSetsError  error
+
+	listControllerRevisionImagesResult []string
+	listControllerRevisionImagesError  error
+
+	listCustomWorkloadImagesResult map[string][]string
+	listCustomWorkloadImagesError  error
+
+	listHelmReleaseSecretsResult []*v1.Secret
+	listHelmReleaseSecretsError  error
+
+	listNodesResult []*v1.Node
+	listNodesError  error
+
+	getConfigMapResult *v1.ConfigMap
+	getConfigMapError  error
+
+	namespaceExistsResult bool
+	namespaceExistsError  error
+
+	listNamespacesResult []string
+	listNamespacesError  error
+
+	listCleanupPoliciesResult []*CleanupPolicy
+	listCleanupPoliciesError  error
 }
 
 // mockECRClient is used to verify that the Kubernetes client is being called
@@ -32,12 +81,83 @@ type mockECRClient struct {
 	listRepositoriesResult []*ecr.Repository
 	listRepositoriesError  error
 
+	listAllRepositoriesResult []*ecr.Repository
+	listAllRepositoriesError  error
+
 	expectedImagesRepositoryName string
 	listImagesResult             []*ecr.ImageDetail
 	listImagesError              error
 
 	expectedImagesToRemove []*ecr.ImageDetail
-	batchRemoveImagesError error
+	deleteImagesError      error
+
+	listManifestListChildrenResult map[string][]string
+	listManifestListChildrenError  error
+
+	expectedImagesToTag map[string]string
+	tagImagesError      error
+
+	// If set, the tagged images are recorded in taggedImages instead of
+	// being checked against expectedImagesToTag, such as when the tags
+	// depend on the current time
+	recordImagesToTag bool
+	taggedImages      map[string]string
+
+	getImageManifestsResult map[string]string
+	getImageManifestsError  error
+	getImageManifestsCalls  int
+
+	listRepositoryTagsResult map[string]map[string]string
+	listRepositoryTagsError  error
+
+	pingError error
+}
+
+// mockIdentityClient is used to verify that the account ID returned by the
+// identity client is being handled correctly by its consumers.
+type mockIdentityClient struct {
+	getAccountIDResult string
+	getAccountIDError  error
+}
+
+func (m *mockIdentityClient) GetAccountID() (string, error) {
+	return m.getAccountIDResult, m.getAccountIDError
+}
+
+// mockLogger records the messages logged by its consumers, which might log
+// from several goroutines.
+type mockLogger struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (m *mockLogger) record(format string, args ...interface{}) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.messages = append(m.messages, fmt.Sprintf(format, args...))
+}
+
+func (m *mockLogger) Infof(format string, args ...interface{}) {
+	m.record(format, args...)
+}
+
+func (m *mockLogger) Warningf(format string, args ...interface{}) {
+	m.record(format, args...)
+}
+
+func (m *mockLogger) Errorf(format string, args ...interface{}) {
+	m.record(format, args...)
+}
+
+// mockPullEventsClient is used to verify that the recent pulls returned by the
+// pull events client are being handled correctly by its consumers.
+type mockPullEventsClient struct {
+	listRecentPullsResult map[string]map[string]bool
+	listRecentPullsError  error
+}
+
+func (m *mockPullEventsClient) ListRecentPulls(since time.Time) (map[string]map[string]bool, error) {
+	return m.listRecentPullsResult, m.listRecentPullsError
 }
 
 func (m *mockKubeClient) ListAllPods(namespace []*string) ([]*v1.Pod, error) {
@@ -54,6 +174,54 @@ func (m *mockKubeClient) ListAllPods(namespace []*string) ([]*v1.Pod, error) {
 	return m.listAllPodsResult, m.listAllPodsError
 }
 
+func (m *mockKubeClient) ListEphemeralContainerImages(namespace []*string) ([]string, error) {
+	return m.listEphemeralContainerImagesResult, m.listEphemeralContainerImagesError
+}
+
+func (m *mockKubeClient) ListJobs(namespace []*string) ([]*batchv1.Job, error) {
+	return m.listJobsResult, m.listJobsError
+}
+
+func (m *mockKubeClient) ListCronJobs(namespace []*string) ([]*batchv2alpha1.CronJob, error) {
+	return m.listCronJobsResult, m.listCronJobsError
+}
+
+func (m *mockKubeClient) ListReplicaSets(namespace []*string) ([]*extensionsv1beta1.ReplicaSet, error) {
+	return m.listReplicaSetsResult, m.listReplicaSetsError
+}
+
+func (m *mockKubeClient) ListControllerRevisionImages(namespace []*string) ([]string, error) {
+	return m.listControllerRevisionImagesResult, m.listControllerRevisionImagesError
+}
+
+func (m *mockKubeClient) ListCustomWorkloadImages(workload CustomWorkload, namespace []*string) ([]string, error) {
+	return m.listCustomWorkloadImagesResult[workload.String()], m.listCustomWorkloadImagesError
+}
+
+func (m *mockKubeClient) ListHelmReleaseSecrets(namespace []*string) ([]*v1.Secret, error) {
+	return m.listHelmReleaseSecretsResult, m.listHelmReleaseSecretsError
+}
+
+func (m *mockKubeClient) ListNodes() ([]*v1.Node, error) {
+	return m.listNodesResult, m.listNodesError
+}
+
+func (m *mockKubeClient) GetConfigMap(namespace, name string) (*v1.ConfigMap, error) {
+	return m.getConfigMapResult, m.getConfigMapError
+}
+
+func (m *mockKubeClient) NamespaceExists(name string) (bool, error) {
+	return m.namespaceExistsResult, m.namespaceExistsError
+}
+
+func (m *mockKubeClient) ListNamespaces() ([]string, error) {
+	return m.listNamespacesResult, m.listNamespacesError
+}
+
+func (m *mockKubeClient) ListCleanupPolicies() ([]*CleanupPolicy, error) {
+	return m.listCleanupPoliciesResult, m.listCleanupPoliciesError
+}
+
 func (m *mockECRClient) ListRepositories(repositoryNames []*string) ([]*ecr.Repository, error) {
 	if len(repositoryNames) != len(m.expectedRepositoryNames) {
 		m.t.Errorf("Expected repository names to contain %d elements, but it contains %d", len(m.expectedRepositoryNames), len(repositoryNames))
@@ -68,6 +236,10 @@ func (m *mockECRClient) ListRepositories(repositoryNames []*string) ([]*ecr.Repo
 	return m.listRepositoriesResult, m.listRepositoriesError
 }
 
+func (m *mockECRClient) ListAllRepositories() ([]*ecr.Repository, error) {
+	return m.listAllRepositoriesResult, m.listAllRepositoriesError
+}
+
 func (m *mockECRClient) ListImages(repositoryName *string) ([]*ecr.ImageDetail, error) {
 	if m.expectedImagesRepositoryName != *repositoryName {
 		m.t.Errorf("Expected repository name to be %v, but was %v", m.expectedImagesRepositoryName, *repositoryName)
@@ -76,7 +248,7 @@ func (m *mockECRClient) ListImages(repositoryName *string) ([]*ecr.ImageDetail,
 	return m.listImagesResult, m.listImagesError
 }
 
-func (m *mockECRClient) BatchRemoveImages(images []*ecr.ImageDetail) error {
+func (m *mockECRClient) DeleteImages(images []*ecr.ImageDetail) error {
 	if len(images) != len(m.expectedImagesToRemove) {
 		m.t.Errorf("Expected images to contain %d elements, but it contains %d", len(m.expectedImagesToRemove), len(images))
 	}
@@ -87,33 +259,2758 @@ func (m *mockECRClient) BatchRemoveImages(images []*ecr.ImageDetail) error {
 		}
 	}
 
-	return m.batchRemoveImagesError
-}
+	return m.deleteImagesError
+}
+
+func (m *mockECRClient) ListManifestListChildren(repositoryName *string, images []*ecr.ImageDetail) (map[string][]string, error) {
+	if m.expectedImagesRepositoryName != *repositoryName {
+		m.t.Errorf("Expected repository name to be %v, but was %v", m.expectedImagesRepositoryName, *repositoryName)
+	}
+
+	return m.listManifestListChildrenResult, m.listManifestListChildrenError
+}
+
+func (m *mockECRClient) TagImages(repositoryName *string, tags map[string]string) error {
+	if m.expectedImagesRepositoryName != *repositoryName {
+		m.t.Errorf("Expected repository name to be %v, but was %v", m.expectedImagesRepositoryName, *repositoryName)
+	}
+
+	if m.recordImagesToTag {
+		m.taggedImages = tags
+		return m.tagImagesError
+	}
+
+	if !reflect.DeepEqual(tags, m.expectedImagesToTag) {
+		m.t.Errorf("Expected image tags to be %v, but was %v", m.expectedImagesToTag, tags)
+	}
+
+	return m.tagImagesError
+}
+
+func (m *mockECRClient) GetImageManifests(repositoryName *string, images []*ecr.ImageDetail) (map[string]string, error) {
+	if m.expectedImagesRepositoryName != *repositoryName {
+		m.t.Errorf("Expected repository name to be %v, but was %v", m.expectedImagesRepositoryName, *repositoryName)
+	}
+
+	m.getImageManifestsCalls++
+	return m.getImageManifestsResult, m.getImageManifestsError
+}
+
+func (m *mockECRClient) ListRepositoryTags(repo *ecr.Repository) (map[string]string, error) {
+	return m.listRepositoryTagsResult[*repo.RepositoryName], m.listRepositoryTagsError
+}
+
+func (m *mockECRClient) Ping() error {
+	return m.pingError
+}
+
+func TestVerifyAccount(t *testing.T) {
+	testCases := []struct {
+		expectedAccountID string
+		identityClient    *mockIdentityClient
+		expectError       bool
+	}{
+		// No expected account, so the identity client is never called
+		{
+			expectedAccountID: "",
+			identityClient:    nil,
+			expectError:       false,
+		},
+
+		// Account matches
+		{
+			expectedAccountID: "123456789012",
+			identityClient:    &mockIdentityClient{getAccountIDResult: "123456789012"},
+			expectError:       false,
+		},
+
+		// Account does not match
+		{
+			expectedAccountID: "123456789012",
+			identityClient:    &mockIdentityClient{getAccountIDResult: "210987654321"},
+			expectError:       true,
+		},
+
+		// Cannot get caller identity
+		{
+			expectedAccountID: "123456789012",
+			identityClient:    &mockIdentityClient{getAccountIDError: fmt.Errorf("")},
+			expectError:       true,
+		},
+	}
+
+	for i, testCase := range testCases {
+		task := &CleanupTask{
+			ExpectedAccountID: testCase.expectedAccountID,
+		}
+
+		var identityClient IdentityClient
+		if testCase.identityClient != nil {
+			identityClient = testCase.identityClient
+		}
+
+		err := task.VerifyAccount(identityClient)
+
+		if testCase.expectError && err == nil {
+			t.Errorf("Expected error in test case %d not to be nil, but it was", i)
+		}
+		if !testCase.expectError && err != nil {
+			t.Errorf("Expected error in test case %d to be nil, but was %v", i, err)
+		}
+	}
+}
+
+func TestResolveControllerNamespace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "namespace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	namespacePath := filepath.Join(dir, "namespace")
+	if err = ioutil.WriteFile(namespacePath, []byte("pod-namespace\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		controllerNamespace string
+		namespacePath       string
+		kubeClient          *mockKubeClient
+		expectedNamespace   string
+		expectError         bool
+	}{
+		// Explicit namespace
+		{
+			controllerNamespace: "controller",
+			namespacePath:       namespacePath,
+			kubeClient:          &mockKubeClient{namespaceExistsResult: true},
+			expectedNamespace:   "controller",
+		},
+
+		// Namespace of the controller pod
+		{
+			namespacePath:     namespacePath,
+			kubeClient:        &mockKubeClient{namespaceExistsResult: true},
+			expectedNamespace: "pod-namespace",
+		},
+
+		// Running outside a cluster
+		{
+			namespacePath:     filepath.Join(dir, "missing"),
+			kubeClient:        &mockKubeClient{namespaceExistsResult: true},
+			expectedNamespace: DefaultControllerNamespace,
+		},
+
+		// Namespace does not exist
+		{
+			controllerNamespace: "controller",
+			kubeClient:          &mockKubeClient{namespaceExistsResult: false},
+			expectedNamespace:   "controller",
+			expectError:         true,
+		},
+
+		// Cannot get namespace
+		{
+			controllerNamespace: "controller",
+			kubeClient:          &mockKubeClient{namespaceExistsError: fmt.Errorf("")},
+			expectedNamespace:   "controller",
+			expectError:         true,
+		},
+	}
+
+	for i, testCase := range testCases {
+		task := &CleanupTask{
+			ControllerNamespace: testCase.controllerNamespace,
+			Logger:              &mockLogger{},
+		}
+
+		err := task.ResolveControllerNamespace(testCase.kubeClient, testCase.namespacePath)
+
+		if testCase.expectError && err == nil {
+			t.Errorf("Expected error in test case %d not to be nil, but it was", i)
+		}
+		if !testCase.expectError && err != nil {
+			t.Errorf("Expected error in test case %d to be nil, but was %v", i, err)
+		}
+		if task.ControllerNamespace != testCase.expectedNamespace {
+			t.Errorf("Expected namespace in test case %d to be '%s', but was '%s'", i, testCase.expectedNamespace, task.ControllerNamespace)
+		}
+	}
+}
+
+func TestResolveRegistryHost(t *testing.T) {
+	testCases := []struct {
+		expectedAccountID string
+		identityClient    *mockIdentityClient
+		expectedHost      string
+		expectError       bool
+	}{
+		// Uses the expected account, so the identity client is never called
+		{
+			expectedAccountID: "123456789012",
+			identityClient:    &mockIdentityClient{getAccountIDError: fmt.Errorf("")},
+			expectedHost:      "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+		},
+
+		// Uses the account from the caller identity
+		{
+			identityClient: &mockIdentityClient{getAccountIDResult: "210987654321"},
+			expectedHost:   "210987654321.dkr.ecr.us-east-1.amazonaws.com",
+		},
+
+		// Cannot get caller identity
+		{
+			identityClient: &mockIdentityClient{getAccountIDError: fmt.Errorf("")},
+			expectError:    true,
+		},
+	}
+
+	for i, testCase := range testCases {
+		task := &CleanupTask{
+			AwsRegion:         "us-east-1",
+			ExpectedAccountID: testCase.expectedAccountID,
+		}
+
+		err := task.ResolveRegistryHost(testCase.identityClient)
+
+		if testCase.expectError && err == nil {
+			t.Errorf("Expected error in test case %d not to be nil, but it was", i)
+		}
+		if !testCase.expectError && err != nil {
+			t.Errorf("Expected error in test case %d to be nil, but was %v", i, err)
+		}
+
+		if task.RegistryHost != testCase.expectedHost {
+			t.Errorf("Expected registry host in test case %d to be '%s', but was '%s'", i, testCase.expectedHost, task.RegistryHost)
+		}
+	}
+}
+
+func TestRegistryHostInOtherRegions(t *testing.T) {
+	task := &CleanupTask{
+		AwsRegion:  "us-east-1",
+		AwsRegions: []string{"us-east-1", "eu-west-1"},
+	}
+
+	// Images hosted anywhere are considered in use until resolved
+	if host := task.registryHost("eu-west-1"); host != "" {
+		t.Errorf("Expected registry host to be empty, but was '%s'", host)
+	}
+
+	if err := task.ResolveRegistryHost(&mockIdentityClient{getAccountIDResult: "123456789012"}); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	expectedHosts := map[string]string{
+		"us-east-1": "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+		"eu-west-1": "123456789012.dkr.ecr.eu-west-1.amazonaws.com",
+	}
+
+	for region, expected := range expectedHosts {
+		if host := task.registryHost(region); host != expected {
+			t.Errorf("Expected registry host in '%s' region to be '%s', but was '%s'", region, expected, host)
+		}
+	}
+}
+
+func TestRemoveOldImagesWithKubeListPodsError(t *testing.T) {
+	namespace := "namespace"
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+
+		listAllPodsResult: nil,
+		listAllPodsError:  fmt.Errorf(""),
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces: []*string{&namespace},
+	}
+
+	errs := task.RemoveOldImages(kubeClient, nil)
+
+	if len(errs) != 1 {
+		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
+	}
+}
+
+func TestReconcileLogsReconcileID(t *testing.T) {
+	namespace := "namespace"
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsError:  fmt.Errorf(""),
+	}
+
+	logger := &mockLogger{}
+	task := &CleanupTask{
+		KubeNamespaces: []*string{&namespace},
+		Logger:         logger,
+	}
+
+	result := task.Reconcile(kubeClient, nil)
+
+	if result.Plan.ReconcileID != result.ReconcileID {
+		t.Errorf("Expected plan reconcile ID to be '%s', but was '%s'", result.ReconcileID, result.Plan.ReconcileID)
+	}
+
+	if len(logger.messages) == 0 {
+		t.Fatalf("Expected messages to be logged, but none were")
+	}
+
+	prefix := "[reconcile_id=" + result.ReconcileID + "] "
+	for _, message := range logger.messages {
+		if !strings.HasPrefix(message, prefix) {
+			t.Errorf("Expected message to start with '%s', but was '%s'", prefix, message)
+		}
+	}
+
+	// Messages logged after the pass no longer carry its ID
+	task.log().Infof("done")
+	if last := logger.messages[len(logger.messages)-1]; last != "done" {
+		t.Errorf("Expected last message to be 'done', but was '%s'", last)
+	}
+}
+
+func TestReconcileSummarizesRegions(t *testing.T) {
+	namespace, region := "namespace", "us-east-1"
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsError:  fmt.Errorf(""),
+	}
+
+	task := &CleanupTask{
+		AwsRegion:      region,
+		KubeNamespaces: []*string{&namespace},
+	}
+
+	result := task.Reconcile(kubeClient, nil)
+
+	if len(result.Regions) != 1 {
+		t.Fatalf("Expected 1 region, but got %d", len(result.Regions))
+	}
+
+	if result.Regions[0].Region != region || !result.Regions[0].Failed() {
+		t.Errorf("Expected region '%s' to have failed, but got %+v", region, result.Regions[0])
+	}
+
+	if !result.Failed() {
+		t.Errorf("Expected pass to have failed, but it did not")
+	}
+}
+
+func TestReconcileTracesRepositories(t *testing.T) {
+	recorder, restore := recordSpans()
+	defer restore()
+
+	namespace, repoName := "namespace", "repo"
+	digests := []string{"old-digest", "new-digest"}
+	orderedTime := []time.Time{time.Unix(0, 0), time.Unix(1, 0)}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult:  []*ecr.Repository{{RepositoryName: &repoName}},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{ImageDigest: &digests[0], ImagePushedAt: &orderedTime[0]},
+			{ImageDigest: &digests[1], ImagePushedAt: &orderedTime[1]},
+		},
+		expectedImagesToRemove: []*ecr.ImageDetail{{ImageDigest: &digests[0]}},
+	}
+
+	task := &CleanupTask{
+		AwsRegion:       "us-east-1",
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		Logger:          &mockLogger{},
+
+		MaxImages: 1,
+	}
+
+	if result := task.Reconcile(kubeClient, ecrClient); len(result.Errors) != 0 {
+		t.Fatalf("Expected errors to be empty, but is %q", result.Errors)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+
+	for _, name := range []string{"CleanupPass", "List pods", "CleanupRegion", "SelectRepositoryImages", "DeleteRepositoryImages"} {
+		if _, ok := spans[name]; !ok {
+			t.Fatalf("Expected a %s span, but got none", name)
+		}
+	}
+
+	// Repositories are traced under the span of their region
+	region := spans["CleanupRegion"].SpanContext().SpanID()
+	for _, name := range []string{"SelectRepositoryImages", "DeleteRepositoryImages"} {
+		span := spans[name]
+		if span.Parent().SpanID() != region {
+			t.Errorf("Expected the %s span to be a child of the region span, but it was not", name)
+		}
+		if value, _ := spanAttribute(span, repositoryAttribute); value.AsString() != repoName {
+			t.Errorf("Expected the %s span to be for repo '%s', but was for '%s'", name, repoName, value.AsString())
+		}
+	}
+
+	if spans["CleanupRegion"].Parent().SpanID() != spans["CleanupPass"].SpanContext().SpanID() {
+		t.Errorf("Expected the region span to be a child of the pass span, but it was not")
+	}
+
+	// Requests sent after the pass are no longer traced under it
+	if ctx := task.traceContext(); ctx != context.Background() {
+		t.Errorf("Expected no trace context after the pass, but got %v", ctx)
+	}
+}
+
+func TestReconcileRegions(t *testing.T) {
+	namespace, repoName, tag := "namespace", "repo", "tag-1"
+	usedDigest, oldDigests := "used-digest", []string{"old-digest-1", "old-digest-2"}
+
+	orderedTime := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+	}
+
+	// The image in use is hosted in one region, but identically named images
+	// are kept in both
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{
+							Image: "id.dkr.ecr.us-east-1.amazonaws.com/repo:tag-1",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	ecrClients := []RegionalECRClient{}
+	for i, region := range []string{"us-east-1", "eu-west-1"} {
+		ecrClient := &mockECRClient{
+			t: t,
+
+			expectedRepositoryNames: []string{repoName},
+			listRepositoriesResult: []*ecr.Repository{
+				{
+					RepositoryName: &repoName,
+				},
+			},
+
+			expectedImagesRepositoryName: repoName,
+			listImagesResult: []*ecr.ImageDetail{
+				{
+					ImageDigest:   &usedDigest,
+					ImageTags:     []*string{&tag},
+					ImagePushedAt: &orderedTime[1],
+				},
+				{
+					ImageDigest:   &oldDigests[i],
+					ImagePushedAt: &orderedTime[0],
+				},
+			},
+		}
+
+		// Only one image can be deleted in the pass, which is used up by the
+		// first region
+		if i == 0 {
+			ecrClient.expectedImagesToRemove = []*ecr.ImageDetail{
+				{
+					ImageDigest: &oldDigests[i],
+				},
+			}
+		}
+
+		ecrClients = append(ecrClients, RegionalECRClient{Region: region, Client: ecrClient})
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		Logger:          &mockLogger{},
+
+		MaxImages:              0,
+		MaxDeletesPerReconcile: 1,
+	}
+
+	result := task.ReconcileRegions(kubeClient, ecrClients)
+
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
+	}
+
+	if result.ImagesDeleted != 1 || result.ImagesDeferred != 1 {
+		t.Errorf("Expected 1 image to be deleted and 1 deferred, but %d were deleted and %d deferred", result.ImagesDeleted, result.ImagesDeferred)
+	}
+
+	expectedRegions := []RegionResult{
+		{Region: "us-east-1", RepositoriesProcessed: 1, ImagesSelected: 1, ImagesDeleted: 1, Errors: []error{}},
+		{Region: "eu-west-1", RepositoriesProcessed: 1, Errors: []error{}},
+	}
+
+	if !reflect.DeepEqual(result.Regions, expectedRegions) {
+		t.Errorf("Expected regions to be %+v, but were %+v", expectedRegions, result.Regions)
+	}
+
+	if len(result.Plan.Repositories) != 2 || result.Plan.Repositories[1].Region != "eu-west-1" {
+		t.Errorf("Expected plan to have a repository in each region, but had %+v", result.Plan.Repositories)
+	}
+
+	if len(result.Plan.Images) != 1 || result.Plan.Images[0].Region != "us-east-1" {
+		t.Errorf("Expected plan to have an image deleted from 'us-east-1' region, but had %+v", result.Plan.Images)
+	}
+}
+
+func TestRemoveOldImagesIgnoringKubeListPodsError(t *testing.T) {
+	namespace, repoName, imageDigest := "namespace", "repo", "image-digest"
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+
+		listAllPodsResult: nil,
+		listAllPodsError:  fmt.Errorf(""),
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest: &imageDigest,
+			},
+		},
+
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &imageDigest,
+			},
+		},
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+
+		IgnoreKubernetesErrors: true,
+		AllowEmptyRepositories: true,
+	}
+
+	errs := task.RemoveOldImages(kubeClient, ecrClient)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+}
+
+func TestRemoveOldImagesWithKubeListNodesError(t *testing.T) {
+	namespace := "namespace"
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{},
+		},
+		listNodesError: fmt.Errorf(""),
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:      []*string{&namespace},
+		UseNodePinnedImages: true,
+	}
+
+	errs := task.RemoveOldImages(kubeClient, nil)
+
+	if len(errs) != 1 {
+		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
+	}
+}
+
+func TestRemoveOldImagesWithKubeListEphemeralContainerImagesError(t *testing.T) {
+	namespace := "namespace"
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{},
+		},
+		listEphemeralContainerImagesError: fmt.Errorf(""),
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces: []*string{&namespace},
+	}
+
+	errs := task.RemoveOldImages(kubeClient, nil)
+
+	if len(errs) != 1 {
+		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
+	}
+}
+
+func TestRemoveOldImagesWithKubeListReplicaSetsError(t *testing.T) {
+	namespace := "namespace"
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{},
+		},
+		listReplicaSetsError: fmt.Errorf(""),
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:           []*string{&namespace},
+		UseRevisionHistoryImages: true,
+	}
+
+	errs := task.RemoveOldImages(kubeClient, nil)
+
+	if len(errs) != 1 {
+		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
+	}
+}
+
+func TestRemoveOldImagesWithKubeListJobsError(t *testing.T) {
+	namespace := "namespace"
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{},
+		},
+		listJobsError: fmt.Errorf(""),
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces: []*string{&namespace},
+		UseJobImages:   true,
+	}
+
+	errs := task.RemoveOldImages(kubeClient, nil)
+
+	if len(errs) != 1 {
+		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
+	}
+}
+
+func TestReconcileKeepsImagesUsedByCronJobs(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	tags := []string{"tag-1", "tag-2"}
+	digests := []string{"digest-1", "digest-2"}
+	pushedAt := []time.Time{time.Unix(1, 0), time.Unix(2, 0)}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{},
+		listCronJobsResult: []*batchv2alpha1.CronJob{
+			{
+				Spec: batchv2alpha1.CronJobSpec{
+					JobTemplate: batchv2alpha1.JobTemplateSpec{
+						Spec: batchv2alpha1.JobSpec{
+							Template: v1.PodTemplateSpec{
+								Spec: v1.PodSpec{
+									Containers: []v1.Container{
+										{Image: "id.dkr.ecr.us-east-1.amazonaws.com/repo:tag-1"},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest:   &digests[0],
+				ImagePushedAt: &pushedAt[0],
+				ImageTags:     []*string{&tags[0]},
+			},
+			{
+				ImageDigest:   &digests[1],
+				ImagePushedAt: &pushedAt[1],
+				ImageTags:     []*string{&tags[1]},
+			},
+		},
+
+		// Only the image not used by the cron job is deleted
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &digests[1],
+			},
+		},
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		Logger:          &mockLogger{},
+
+		MaxImages:    0,
+		UseJobImages: true,
+	}
+
+	result := task.Reconcile(kubeClient, ecrClient)
+
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
+	}
+
+	if result.ImagesInUse != 1 {
+		t.Errorf("Expected 1 image to be in use, but got %d", result.ImagesInUse)
+	}
+}
+
+func TestRemoveOldImagesWithECRListRepositoriesError(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{},
+		},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult:  nil,
+		listRepositoriesError:   fmt.Errorf(""),
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+	}
+
+	errs := task.RemoveOldImages(kubeClient, ecrClient)
+
+	if len(errs) != 1 {
+		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
+	}
+}
+
+func TestRemoveOldImagesWithTooFewRepositories(t *testing.T) {
+	testCases := []struct {
+		action         string
+		expectedErrors int
+	}{
+		{
+			action:         MinRepositoriesActionWarn,
+			expectedErrors: 0,
+		},
+		{
+			action:         MinRepositoriesActionError,
+			expectedErrors: 1,
+		},
+	}
+
+	for _, testCase := range testCases {
+		namespace, repoName := "namespace", "repo"
+		kubeClient := &mockKubeClient{
+			t: t,
+
+			expectedNamespace: []string{namespace},
+			listAllPodsResult: []*v1.Pod{
+				{},
+			},
+		}
+
+		ecrClient := &mockECRClient{
+			t: t,
+
+			expectedRepositoryNames: []string{repoName},
+			listRepositoriesResult:  []*ecr.Repository{},
+		}
+
+		task := &CleanupTask{
+			KubeNamespaces:  []*string{&namespace},
+			EcrRepositories: []*string{&repoName},
+
+			MinRepositories:       1,
+			MinRepositoriesAction: testCase.action,
+		}
+
+		errs := task.RemoveOldImages(kubeClient, ecrClient)
+
+		if len(errs) != testCase.expectedErrors {
+			t.Errorf("Expected errors to contain %d elements with action '%s', but it contains %d", testCase.expectedErrors, testCase.action, len(errs))
+		}
+	}
+}
+
+func TestRemoveOldImagesWithECRListImagesError(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{
+							Image: "id.dkr.ecr.region.amazonaws.com/repo:tag-1",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult:             nil,
+		listImagesError:              fmt.Errorf(""),
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		MaxImages:       1,
+	}
+
+	errs := task.RemoveOldImages(kubeClient, ecrClient)
+
+	if len(errs) != 1 {
+		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
+	}
+}
+
+func TestRemoveOldImagesWithoutOldImagesToRemove(t *testing.T) {
+	namespace, repoName, imageDigest := "namespace", "repo", "image-digest"
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{
+							Image: "id.dkr.ecr.region.amazonaws.com/repo:tag-1",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest: &imageDigest,
+			},
+		},
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+
+		// No need to clean up any images
+		MaxImages: 1000,
+	}
+
+	errs := task.RemoveOldImages(kubeClient, ecrClient)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+}
+
+func TestRemoveOldImagesWithECRDeleteImagesError(t *testing.T) {
+	namespace, repoName, imageDigest := "namespace", "repo", "image-digest"
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{
+							Image: "id.dkr.ecr.region.amazonaws.com/repo:tag-1",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest: &imageDigest,
+			},
+		},
+
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &imageDigest,
+			},
+		},
+		deleteImagesError: fmt.Errorf(""),
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+
+		// Will cause the image to be deleted
+		MaxImages:              0,
+		AllowEmptyRepositories: true,
+	}
+
+	errs := task.RemoveOldImages(kubeClient, ecrClient)
+
+	if len(errs) == 0 {
+		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
+	}
+}
+
+func TestReconcileRecordsDeletionsForAudit(t *testing.T) {
+	testCases := []struct {
+		recordDeletionsError error
+		blockDeletion        bool
+		expectError          bool
+	}{
+		// Images are recorded
+		{},
+
+		// Failures are only logged
+		{
+			recordDeletionsError: fmt.Errorf(""),
+		},
+
+		// Failures are reported, since they stop further deletions
+		{
+			recordDeletionsError: fmt.Errorf(""),
+			blockDeletion:        true,
+			expectError:          true,
+		},
+	}
+
+	for i, testCase := range testCases {
+		namespace, repoName, imageDigest := "namespace", "repo", "image-digest"
+		kubeClient := &mockKubeClient{
+			t: t,
+
+			expectedNamespace: []string{namespace},
+			listAllPodsResult: []*v1.Pod{},
+		}
+
+		ecrClient := &mockECRClient{
+			t: t,
+
+			expectedRepositoryNames: []string{repoName},
+			listRepositoriesResult: []*ecr.Repository{
+				{
+					RepositoryName: &repoName,
+				},
+			},
+
+			expectedImagesRepositoryName: repoName,
+			listImagesResult: []*ecr.ImageDetail{
+				{
+					ImageDigest: &imageDigest,
+				},
+			},
+
+			expectedImagesToRemove: []*ecr.ImageDetail{
+				{
+					ImageDigest: &imageDigest,
+				},
+			},
+		}
+
+		auditSink := &mockAuditSink{
+			recordDeletionsError: testCase.recordDeletionsError,
+		}
+
+		task := &CleanupTask{
+			KubeNamespaces:  []*string{&namespace},
+			EcrRepositories: []*string{&repoName},
+			Logger:          &mockLogger{},
+
+			MaxImages:              0,
+			AllowEmptyRepositories: true,
+
+			AuditSink:                  auditSink,
+			AuditFailuresBlockDeletion: testCase.blockDeletion,
+		}
+
+		result := task.Reconcile(kubeClient, ecrClient)
+
+		if testCase.expectError && len(result.Errors) == 0 {
+			t.Errorf("Expected errors in test case %d not to be empty, but it was", i)
+		}
+		if !testCase.expectError && len(result.Errors) != 0 {
+			t.Errorf("Expected errors in test case %d to be empty, but is %q", i, result.Errors)
+		}
+
+		if len(auditSink.records) != 1 || auditSink.records[0].Digest != imageDigest || auditSink.records[0].ReconcileID != result.ReconcileID || auditSink.records[0].Reason != DeleteReasonKeepMax {
+			t.Errorf("Expected the removed image to be recorded in test case %d, but got %+v", i, auditSink.records)
+		}
+	}
+}
+
+func TestReconcileOnlyRepositoriesInUse(t *testing.T) {
+	namespace, repoName, otherRepoName, imageDigest := "namespace", "repo", "other-repo", "image-digest"
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{
+							Image: "id.dkr.ecr.region.amazonaws.com/repo:tag-1",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName, otherRepoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+			{
+				RepositoryName: &otherRepoName,
+			},
+		},
+
+		// Images are only listed from the repo in use
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest: &imageDigest,
+			},
+		},
+
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &imageDigest,
+			},
+		},
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName, &otherRepoName},
+
+		MaxImages:              0,
+		AllowEmptyRepositories: true,
+		OnlyRepositoriesInUse:  true,
+	}
+
+	result := task.Reconcile(kubeClient, ecrClient)
+
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
+	}
+
+	if result.RepositoriesProcessed != 1 {
+		t.Errorf("Expected 1 repo to be processed, but got %d", result.RepositoriesProcessed)
+	}
+}
+
+func TestReconcileProtectsAnnotatedImages(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	annotatedDigest, otherDigest := "annotated-digest", "other-digest"
+
+	orderedTime := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+	}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest:   &annotatedDigest,
+				ImagePushedAt: &orderedTime[0],
+			},
+			{
+				ImageDigest:   &otherDigest,
+				ImagePushedAt: &orderedTime[1],
+			},
+		},
+
+		getImageManifestsResult: map[string]string{
+			annotatedDigest: `{"schemaVersion":2,"annotations":{"com.example.keep":"forever"}}`,
+			otherDigest:     `{"schemaVersion":2,"annotations":{"com.example.keep":"never"}}`,
+		},
+
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &otherDigest,
+			},
+		},
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+
+		MaxImages: 0,
+
+		ProtectAnnotationKey:   "com.example.keep",
+		ProtectAnnotationValue: "forever",
+	}
+
+	result := task.Reconcile(kubeClient, ecrClient)
+
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
+	}
+
+	if result.ImagesRetained[RetainReasonAnnotation] != 1 {
+		t.Errorf("Expected 1 image to be retained due to its annotation, but got %d", result.ImagesRetained[RetainReasonAnnotation])
+	}
+
+	if ecrClient.getImageManifestsCalls != 1 {
+		t.Errorf("Expected image manifests to be fetched once, but were fetched %d times", ecrClient.getImageManifestsCalls)
+	}
+}
+
+func TestReconcileAbortsOnPlanVerificationFailure(t *testing.T) {
+	namespace, repoName, imageDigest := "namespace", "repo", "image-digest"
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		// The same image listed twice ends up selected for deletion twice
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest: &imageDigest,
+			},
+			{
+				ImageDigest: &imageDigest,
+			},
+		},
+
+		// No images must be deleted
+		expectedImagesToRemove: []*ecr.ImageDetail{},
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		Logger:          &mockLogger{},
+
+		MaxImages:              0,
+		AllowEmptyRepositories: true,
+		VerifyPlan:             true,
+	}
+
+	result := task.Reconcile(kubeClient, ecrClient)
+
+	if len(result.Errors) != 1 {
+		t.Errorf("Expected errors to contain 1 element, but it contains %q", result.Errors)
+	}
+
+	if result.ImagesSelected != 0 || result.ImagesDeleted != 0 {
+		t.Errorf("Expected no images to be selected or deleted, but %d were selected and %d deleted", result.ImagesSelected, result.ImagesDeleted)
+	}
+}
+
+func TestRemoveOldImages(t *testing.T) {
+	namespace, repoName, imageDigest := "namespace", "repo", "image-digest"
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{
+							Image: "id.dkr.ecr.region.amazonaws.com/repo:tag-1",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest: &imageDigest,
+			},
+		},
+
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &imageDigest,
+			},
+		},
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+
+		// Will cause the image to be deleted
+		MaxImages:              0,
+		AllowEmptyRepositories: true,
+	}
+
+	errs := task.RemoveOldImages(kubeClient, ecrClient)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+}
+
+func TestRemoveOldImagesProtectsManifestListChildren(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	listDigest, childDigest, otherDigest := "list-digest", "child-digest", "other-digest"
+	listMediaType, tag := "application/vnd.oci.image.index.v1+json", "tag-1"
+
+	orderedTime := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+		time.Unix(2, 0),
+	}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{
+							Image: "id.dkr.ecr.region.amazonaws.com/repo:tag-1",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest:            &listDigest,
+				ImageTags:              []*string{&tag},
+				ImageManifestMediaType: &listMediaType,
+				ImagePushedAt:          &orderedTime[2],
+			},
+			{
+				ImageDigest:   &childDigest,
+				ImagePushedAt: &orderedTime[1],
+			},
+			{
+				ImageDigest:   &otherDigest,
+				ImagePushedAt: &orderedTime[0],
+			},
+		},
+
+		listManifestListChildrenResult: map[string][]string{
+			listDigest: []string{childDigest},
+		},
+
+		// The child image is referenced by the manifest list in use
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &otherDigest,
+			},
+		},
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+
+		ProtectManifestListChildren: true,
+	}
+
+	errs := task.RemoveOldImages(kubeClient, ecrClient)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+}
+
+func TestReconcileDeletesOrphanedManifestLists(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	listDigest, childDigest := "list-digest", "child-digest"
+	listMediaType := "application/vnd.oci.image.index.v1+json"
+
+	orderedTime := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+	}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest:            &listDigest,
+				ImageManifestMediaType: &listMediaType,
+				ImagePushedAt:          &orderedTime[1],
+			},
+			{
+				ImageDigest:   &childDigest,
+				ImagePushedAt: &orderedTime[0],
+			},
+		},
+
+		// The only child of the retained manifest list is deleted
+		listManifestListChildrenResult: map[string][]string{
+			listDigest: []string{childDigest},
+		},
+	}
+
+	task := &CleanupTask{
+		MaxImages:       1,
+		DryRun:          true,
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+
+		DeleteOrphanedManifestLists: true,
+	}
+
+	result := task.Reconcile(kubeClient, ecrClient)
+
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
+	}
+
+	if result.OrphanedManifestListsSelected != 1 {
+		t.Errorf("Expected 1 orphaned manifest list to be selected, but got %d", result.OrphanedManifestListsSelected)
+	}
+
+	if result.ImagesSelected != 2 {
+		t.Errorf("Expected 2 images to be selected, but got %d", result.ImagesSelected)
+	}
+
+	if len(result.Plan.Images) != 2 || result.Plan.Images[1].Digest != listDigest {
+		t.Errorf("Expected the manifest list to be in the plan, but it was: %v", result.Plan.Images)
+	}
+}
+
+func TestReconcileDeletesManifestListChildren(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	listDigest, childDigest, otherDigest := "list-digest", "child-digest", "other-digest"
+	listMediaType := "application/vnd.oci.image.index.v1+json"
+	oldTag, newTag := "old", "new"
+
+	orderedTime := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+		time.Unix(2, 0),
+	}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest:            &listDigest,
+				ImageManifestMediaType: &listMediaType,
+				ImagePushedAt:          &orderedTime[0],
+				ImageTags:              []*string{&oldTag},
+			},
+			{
+				ImageDigest:   &childDigest,
+				ImagePushedAt: &orderedTime[1],
+			},
+			{
+				ImageDigest:   &otherDigest,
+				ImagePushedAt: &orderedTime[2],
+				ImageTags:     []*string{&newTag},
+			},
+		},
+
+		// The child is retained by -max-images, but it's only referenced by
+		// the manifest list being deleted
+		listManifestListChildrenResult: map[string][]string{
+			listDigest: []string{childDigest},
+		},
+	}
+
+	task := &CleanupTask{
+		MaxImages:       2,
+		DryRun:          true,
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+
+		ProtectManifestListChildren: true,
+		DeleteManifestListChildren:  true,
+	}
+
+	result := task.Reconcile(kubeClient, ecrClient)
+
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
+	}
+
+	if len(result.Plan.Images) != 2 || result.Plan.Images[0].Digest != listDigest || result.Plan.Images[1].Digest != childDigest {
+		t.Errorf("Expected the manifest list and its child to be in the plan, but it was: %v", result.Plan.Images)
+	}
+}
+
+func TestReconcileDiscoversRepositories(t *testing.T) {
+	namespace := "namespace"
+	repoNames := []string{"team-a/app", "team-a/base", "team-b/app"}
+	imageDigest := "digest"
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{},
+	}
+
+	repos := []*ecr.Repository{}
+	for i := range repoNames {
+		repos = append(repos, &ecr.Repository{RepositoryName: &repoNames[i]})
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		listAllRepositoriesResult: repos,
+
+		// Only the repository matching the patterns is cleaned up
+		expectedImagesRepositoryName: "team-a/app",
+		listImagesResult: []*ecr.ImageDetail{
+			{ImageDigest: &imageDigest},
+		},
+	}
+
+	task := &CleanupTask{
+		DryRun:         true,
+		KubeNamespaces: []*string{&namespace},
+
+		DiscoverRepositories:      true,
+		RepositoryIncludePatterns: []*regexp.Regexp{regexp.MustCompile("^team-a/")},
+		RepositoryExcludePatterns: []*regexp.Regexp{regexp.MustCompile("-base$")},
+	}
+
+	result := task.Reconcile(kubeClient, ecrClient)
+
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
+	}
+
+	if result.RepositoriesProcessed != 1 {
+		t.Errorf("Expected 1 repository to be processed, but got %d", result.RepositoriesProcessed)
+	}
+}
+
+func TestRemoveOldImagesWithDryRun(t *testing.T) {
+	namespace, repoName, imageDigest := "namespace", "repo", "image-digest"
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{},
+		},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest: &imageDigest,
+			},
+		},
+
+		// Must not be called, so any call would fail
+		deleteImagesError: fmt.Errorf(""),
+	}
+
+	logger := &mockLogger{}
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		DryRun:          true,
+		Logger:          logger,
+
+		// Would cause the image to be deleted
+		MaxImages:              0,
+		AllowEmptyRepositories: true,
+	}
+
+	errs := task.RemoveOldImages(kubeClient, ecrClient)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+
+	// Each image that would be removed is logged
+	logged := false
+	for _, message := range logger.messages {
+		if strings.Contains(message, "Would remove image '"+imageDigest+"'") {
+			logged = true
+		}
+	}
+
+	if !logged {
+		t.Errorf("Expected the image that would be removed to be logged, but it was not: %q", logger.messages)
+	}
+}
+
+func TestReconcileKeepsImagesWithinMinAge(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	oldDigest, newDigest := "old-digest", "new-digest"
+
+	pushedAt := []time.Time{
+		time.Now().Add(-48 * time.Hour),
+		time.Now().Add(-time.Hour),
+	}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest:   &oldDigest,
+				ImagePushedAt: &pushedAt[0],
+			},
+			{
+				ImageDigest:   &newDigest,
+				ImagePushedAt: &pushedAt[1],
+			},
+		},
+
+		// Only the image pushed before the window is deleted
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &oldDigest,
+			},
+		},
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		Logger:          &mockLogger{},
+
+		MaxImages:   0,
+		MinImageAge: 24 * time.Hour,
+	}
+
+	result := task.Reconcile(kubeClient, ecrClient)
+
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
+	}
+
+	if result.ImagesRetained[RetainReasonMinAge] != 1 {
+		t.Errorf("Expected 1 image to be retained due to its age, but got %d", result.ImagesRetained[RetainReasonMinAge])
+	}
+}
+
+func TestReconcileKeepsRecentlyPulledImages(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	digests := []string{"digest-0", "digest-1", "digest-2"}
+
+	pushedAt := time.Now().Add(-90 * 24 * time.Hour)
+	pulledAt := []time.Time{
+		time.Now().Add(-30 * 24 * time.Hour),
+		time.Now().Add(-24 * time.Hour),
+	}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest:          &digests[0],
+				ImagePushedAt:        &pushedAt,
+				LastRecordedPullTime: &pulledAt[0],
+			},
+			{
+				ImageDigest:          &digests[1],
+				ImagePushedAt:        &pushedAt,
+				LastRecordedPullTime: &pulledAt[1],
+			},
+			{
+				ImageDigest:   &digests[2],
+				ImagePushedAt: &pushedAt,
+			},
+		},
+
+		// Images pulled long ago, or never pulled, are deleted
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &digests[0],
+			},
+			{
+				ImageDigest: &digests[2],
+			},
+		},
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		Logger:          &mockLogger{},
+
+		MaxImages:            0,
+		MinDaysSinceLastPull: 7,
+	}
+
+	result := task.Reconcile(kubeClient, ecrClient)
+
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
+	}
+
+	if result.ImagesRetained[RetainReasonRecentlyPulled] != 1 {
+		t.Errorf("Expected 1 image to be retained due to a recent pull, but got %d", result.ImagesRetained[RetainReasonRecentlyPulled])
+	}
+}
+
+func TestReconcileWithUntaggedPolicy(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	tags := []string{"tag-1", "tag-2"}
+	digests := []string{"digest-0", "digest-1", "digest-2", "digest-3"}
+
+	pushedAt := []time.Time{
+		time.Now().Add(-4 * time.Hour),
+		time.Now().Add(-3 * time.Hour),
+		time.Now().Add(-2 * time.Hour),
+		time.Now().Add(-time.Hour),
+	}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest:   &digests[0],
+				ImagePushedAt: &pushedAt[0],
+				ImageTags:     []*string{&tags[0]},
+			},
+			{
+				ImageDigest:   &digests[1],
+				ImagePushedAt: &pushedAt[1],
+				ImageTags:     []*string{&tags[1]},
+			},
+			{
+				ImageDigest:   &digests[2],
+				ImagePushedAt: &pushedAt[2],
+			},
+			{
+				ImageDigest:   &digests[3],
+				ImagePushedAt: &pushedAt[3],
+			},
+		},
+
+		// The untagged images don't count against `MaxImages`, so only the
+		// older untagged image is deleted
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &digests[2],
+			},
+		},
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		Logger:          &mockLogger{},
+
+		MaxImages:         2,
+		UntaggedKeepCount: 1,
+	}
+
+	result := task.Reconcile(kubeClient, ecrClient)
+
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
+	}
+
+	if result.ImagesRetained[RetainReasonUntaggedKeep] != 1 {
+		t.Errorf("Expected 1 untagged image to be retained, but got %d", result.ImagesRetained[RetainReasonUntaggedKeep])
+	}
+}
+
+func TestReconcileWithCleanupPolicy(t *testing.T) {
+	namespace, policyNamespace, repoName := "namespace", "team-a", "team-a/app"
+	tags := []string{"tag-0", "stable", "tag-2", "tag-3"}
+	digests := []string{"digest-0", "digest-1", "digest-2", "digest-3"}
+	keepMax := 2
+
+	pushedAt := []time.Time{
+		time.Now().Add(-4 * time.Hour),
+		time.Now().Add(-3 * time.Hour),
+		time.Now().Add(-2 * time.Hour),
+		time.Now().Add(-time.Hour),
+	}
+
+	images := []*ecr.ImageDetail{}
+	for i := range digests {
+		images = append(images, &ecr.ImageDetail{
+			ImageDigest:   &digests[i],
+			ImagePushedAt: &pushedAt[i],
+			ImageTags:     []*string{&tags[i]},
+		})
+	}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		// Pods of the namespaces listed by policies are also looked at
+		expectedNamespace: []string{namespace, policyNamespace},
+		listAllPodsResult: []*v1.Pod{},
+
+		listCleanupPoliciesResult: []*CleanupPolicy{
+			{
+				Namespace: policyNamespace,
+				Name:      "default",
+				Spec: CleanupPolicySpec{
+					Repositories:  []string{"team-a/*"},
+					Namespaces:    []string{policyNamespace},
+					KeepMax:       &keepMax,
+					ProtectedTags: []string{"stable"},
+				},
+			},
+		},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult:             images,
+
+		// The policy only keeps two images, the one with a protected tag
+		// and the most recent one
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &digests[0],
+			},
+			{
+				ImageDigest: &digests[2],
+			},
+		},
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		Logger:          &mockLogger{},
+
+		MaxImages:          100,
+		UseCleanupPolicies: true,
+	}
+
+	result := task.Reconcile(kubeClient, ecrClient)
+
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
+	}
+}
+
+func TestReconcileWithInvalidCleanupPolicy(t *testing.T) {
+	namespace, repoName := "namespace", "team-a/app"
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{},
+
+		listCleanupPoliciesResult: []*CleanupPolicy{
+			{
+				Namespace: "team-a",
+				Name:      "default",
+				Spec: CleanupPolicySpec{
+					Repositories: []string{"team-a/*"},
+					Namespaces:   []string{"team-a"},
+				},
+				Err: fmt.Errorf("Invalid maxAge"),
+			},
+		},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		Logger:          &mockLogger{},
+
+		MaxImages:          0,
+		UseCleanupPolicies: true,
+	}
+
+	result := task.Reconcile(kubeClient, ecrClient)
+
+	if len(result.Errors) != 1 {
+		t.Fatalf("Expected 1 error, but got %q", result.Errors)
+	}
+
+	if !strings.Contains(result.Errors[0].Error(), "Invalid cleanup policy 'team-a/default'") {
+		t.Errorf("Expected the invalid policy to be reported, but got %q", result.Errors[0])
+	}
+}
+
+func TestReconcileWithImageFilters(t *testing.T) {
+	namespace, repoName := "namespace", "app"
+	digests := []string{"digest-0", "digest-1", "digest-2"}
+	tags := []string{"v1", "v2", "v3"}
+
+	pushedAt := []time.Time{
+		time.Now().Add(-3 * time.Hour),
+		time.Now().Add(-2 * time.Hour),
+		time.Now().Add(-time.Hour),
+	}
+
+	images := []*ecr.ImageDetail{}
+	for i := range digests {
+		images = append(images, &ecr.ImageDetail{
+			ImageDigest:   &digests[i],
+			ImageTags:     []*string{&tags[i]},
+			ImagePushedAt: &pushedAt[i],
+		})
+	}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult:             images,
+
+		// The release database keeps the oldest image, which would be
+		// deleted otherwise
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &digests[1],
+			},
+		},
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		Logger:          &mockLogger{},
+
+		MaxImages: 1,
+	}
+
+	released := ImageFilterFunc(func(selection *ImageSelection) error {
+		selection.Retain([]*ecr.ImageDetail{images[0]}, "released")
+		return nil
+	})
+
+	// Inserted before the final `InUseFilter`
+	filters := task.DefaultImageFilters()
+	inUse := filters[len(filters)-1]
+	task.ImageFilters = append(filters[:len(filters)-1], released, inUse)
+
+	result := task.Reconcile(kubeClient, ecrClient)
+
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
+	}
+
+	if result.ImagesRetained["released"] != 1 {
+		t.Errorf("Expected 1 image to be retained as released, but got %d", result.ImagesRetained["released"])
+	}
+
+	// Failing filters fail the repository
+	task.ImageFilters = []ImageFilter{ImageFilterFunc(func(selection *ImageSelection) error {
+		return fmt.Errorf("Release database unavailable")
+	})}
+	ecrClient.expectedImagesToRemove = nil
+
+	result = task.Reconcile(kubeClient, ecrClient)
+
+	if len(result.Errors) != 1 {
+		t.Errorf("Expected an error, but got %q", result.Errors)
+	}
+}
+
+func TestReconcileWithRepositoryTags(t *testing.T) {
+	namespace, repoName := "namespace", "team-a/app"
+	digests := []string{"digest-0", "digest-1", "digest-2"}
+
+	pushedAt := []time.Time{
+		time.Now().Add(-3 * time.Hour),
+		time.Now().Add(-2 * time.Hour),
+		time.Now().Add(-time.Hour),
+	}
+
+	images := []*ecr.ImageDetail{}
+	for i := range digests {
+		images = append(images, &ecr.ImageDetail{
+			ImageDigest:   &digests[i],
+			ImagePushedAt: &pushedAt[i],
+		})
+	}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult:             images,
+
+		listRepositoryTagsResult: map[string]map[string]string{
+			repoName: {RepositoryTagKeep: "1"},
+		},
+
+		// The tag only keeps the most recent image
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &digests[0],
+			},
+			{
+				ImageDigest: &digests[1],
+			},
+		},
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		Logger:          &mockLogger{},
+
+		MaxImages:         100,
+		UseRepositoryTags: true,
+	}
+
+	result := task.Reconcile(kubeClient, ecrClient)
+
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
+	}
+
+	// Repositories opting out are left untouched, without listing their
+	// images
+	ecrClient.expectedImagesRepositoryName = ""
+	ecrClient.expectedImagesToRemove = nil
+	ecrClient.listRepositoryTagsResult[repoName] = map[string]string{RepositoryTagEnabled: "false"}
+
+	result = task.Reconcile(kubeClient, ecrClient)
+
+	if len(result.Errors) != 0 || result.RepositoriesProcessed != 0 {
+		t.Errorf("Expected the repo to be skipped, but %d repos were processed with errors %q", result.RepositoriesProcessed, result.Errors)
+	}
+
+	// Invalid tags fail the repository
+	ecrClient.listRepositoryTagsResult[repoName] = map[string]string{RepositoryTagKeep: "many"}
+
+	result = task.Reconcile(kubeClient, ecrClient)
+
+	if len(result.Errors) != 1 || !strings.Contains(result.Errors[0].Error(), "Invalid 'cleanup.keep' tag") {
+		t.Errorf("Expected the invalid tag to be reported, but got %q", result.Errors)
+	}
+}
+
+func TestReconcileWithListCleanupPoliciesError(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		listCleanupPoliciesError: fmt.Errorf("the server could not find the requested resource"),
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		Logger:          &mockLogger{},
+
+		UseCleanupPolicies: true,
+	}
+
+	result := task.Reconcile(kubeClient, &mockECRClient{t: t})
+
+	if len(result.Errors) != 1 || !strings.Contains(result.Errors[0].Error(), "Cannot list cleanup policies") {
+		t.Errorf("Expected listing the cleanup policies to fail the pass, but got %q", result.Errors)
+	}
+}
+
+func TestRemoveOldImagesWithListRecentPullsError(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{},
+		},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+
+		RecentPullWindow: time.Hour,
+		PullEventsClient: &mockPullEventsClient{
+			listRecentPullsError: fmt.Errorf(""),
+		},
+	}
+
+	errs := task.RemoveOldImages(kubeClient, ecrClient)
+
+	if len(errs) != 1 {
+		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
+	}
+}
+
+func TestRemoveOldImagesKeepsRecentlyPulledImages(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	pulledDigest, otherDigest := "pulled-digest", "other-digest"
+
+	orderedTime := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+	}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{},
+		},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest:   &pulledDigest,
+				ImagePushedAt: &orderedTime[0],
+			},
+			{
+				ImageDigest:   &otherDigest,
+				ImagePushedAt: &orderedTime[1],
+			},
+		},
+
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &otherDigest,
+			},
+		},
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+
+		RecentPullWindow: time.Hour,
+		PullEventsClient: &mockPullEventsClient{
+			listRecentPullsResult: map[string]map[string]bool{
+				repoName: {pulledDigest: true},
+			},
+		},
+	}
+
+	errs := task.RemoveOldImages(kubeClient, ecrClient)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+}
+
+func TestRemoveOldImagesWithQuarantine(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	newDigest, pendingDigest, expiredDigest := "sha256:new", "sha256:pending", "sha256:expired"
+
+	now := time.Now()
+	pendingTag := QuarantineTag(&ecr.ImageDetail{ImageDigest: &pendingDigest}, now)
+	expiredTag := QuarantineTag(&ecr.ImageDetail{ImageDigest: &expiredDigest}, now.Add(-48*time.Hour))
+
+	orderedTime := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+		time.Unix(2, 0),
+	}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{},
+		},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest:   &newDigest,
+				ImagePushedAt: &orderedTime[0],
+			},
+			{
+				ImageDigest:   &pendingDigest,
+				ImageTags:     []*string{&pendingTag},
+				ImagePushedAt: &orderedTime[1],
+			},
+			{
+				ImageDigest:   &expiredDigest,
+				ImageTags:     []*string{&expiredTag},
+				ImagePushedAt: &orderedTime[2],
+			},
+		},
+
+		recordImagesToTag: true,
+
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &expiredDigest,
+			},
+		},
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+
+		QuarantineRetention:    24 * time.Hour,
+		AllowEmptyRepositories: true,
+	}
+
+	errs := task.RemoveOldImages(kubeClient, ecrClient)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+
+	// Only the new image is tagged, as pending deletion since the pass
+	if len(ecrClient.taggedImages) != 1 {
+		t.Fatalf("Expected only '%s' to be tagged, but got %v", newDigest, ecrClient.taggedImages)
+	}
+
+	tag := ecrClient.taggedImages[newDigest]
+	since, found := QuarantinedSince(&ecr.ImageDetail{ImageTags: []*string{&tag}})
+	if !found || since.Before(now.Truncate(time.Second)) || since.After(time.Now()) {
+		t.Errorf("Expected '%s' to be tagged as pending deletion since %v, but got tag '%s'", newDigest, now, tag)
+	}
+}
+
+func TestRemoveOldImagesWouldEmptyRepository(t *testing.T) {
+	namespace, repoName, imageDigest := "namespace", "repo", "image-digest"
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{},
+		},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest: &imageDigest,
+			},
+		},
+
+		// Must not be called, so any call would fail
+		deleteImagesError: fmt.Errorf(""),
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+
+		// Would cause the only image to be deleted
+		MaxImages: 0,
+	}
+
+	errs := task.RemoveOldImages(kubeClient, ecrClient)
+
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	usedDigest, unusedDigest, usedTag := "used-digest", "unused-digest", "tag-1"
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{
+							Image: "id.dkr.ecr.region.amazonaws.com/repo:tag-1",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest: &usedDigest,
+				ImageTags:   []*string{&usedTag},
+			},
+			{
+				ImageDigest: &unusedDigest,
+			},
+		},
+
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &unusedDigest,
+			},
+		},
+	}
+
+	logger := &mockLogger{}
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
+		Logger:          logger,
+	}
+
+	result := task.Reconcile(kubeClient, ecrClient)
+
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
+	}
+
+	if result.RepositoriesProcessed != 1 || result.ImagesInUse != 1 || result.ImagesSelected != 1 || result.ImagesDeleted != 1 {
+		t.Errorf("Expected 1 repo processed, and 1 image in use, selected and deleted, but got %+v", result)
+	}
+
+	if result.ImagesRetained[RetainReasonInUse] != 1 {
+		t.Errorf("Expected 1 image to be retained for being in use, but got %v", result.ImagesRetained)
+	}
+
+	if len(result.Plan.Images) != 1 || result.Plan.Images[0].Digest != unusedDigest {
+		t.Errorf("Expected plan to contain the unused image, but was %+v", result.Plan.Images)
+	}
+
+	if len(logger.messages) == 0 {
+		t.Errorf("Expected messages to be logged via the given logger, but none were")
+	}
+}
+
+func TestRemoveOldImagesKeepsTagsFromConfigMap(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	frozenDigest, otherDigest, newestDigest, frozenTag := "frozen-digest", "other-digest", "newest-digest", "frozen"
+
+	orderedTime := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+		time.Unix(2, 0),
+	}
+
+	testCases := []struct {
+		configMap *v1.ConfigMap
+		expected  []*ecr.ImageDetail
+	}{
+		// Missing ConfigMap
+		{
+			configMap: nil,
+			expected: []*ecr.ImageDetail{
+				{ImageDigest: &frozenDigest},
+				{ImageDigest: &otherDigest},
+			},
+		},
+
+		// Frozen tag
+		{
+			configMap: &v1.ConfigMap{
+				Data: map[string]string{"team-a": frozenTag},
+			},
+			expected: []*ecr.ImageDetail{
+				{ImageDigest: &otherDigest},
+				{ImageDigest: &newestDigest},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		kubeClient := &mockKubeClient{
+			t: t,
+
+			expectedNamespace: []string{namespace},
+			listAllPodsResult: []*v1.Pod{
+				{},
+			},
+			getConfigMapResult: testCase.configMap,
+		}
+
+		ecrClient := &mockECRClient{
+			t: t,
+
+			expectedRepositoryNames: []string{repoName},
+			listRepositoriesResult: []*ecr.Repository{
+				{
+					RepositoryName: &repoName,
+				},
+			},
+
+			expectedImagesRepositoryName: repoName,
+			listImagesResult: []*ecr.ImageDetail{
+				{
+					ImageDigest:   &frozenDigest,
+					ImageTags:     []*string{&frozenTag},
+					ImagePushedAt: &orderedTime[0],
+				},
+				{
+					ImageDigest:   &otherDigest,
+					ImagePushedAt: &orderedTime[1],
+				},
+				{
+					ImageDigest:   &newestDigest,
+					ImagePushedAt: &orderedTime[2],
+				},
+			},
+
+			expectedImagesToRemove: testCase.expected,
+		}
+
+		task := &CleanupTask{
+			KubeNamespaces:  []*string{&namespace},
+			EcrRepositories: []*string{&repoName},
+
+			MaxImages:         1,
+			KeepTagsConfigMap: "namespace/keep-tags",
+		}
+
+		errs := task.RemoveOldImages(kubeClient, ecrClient)
+
+		if len(errs) != 0 {
+			t.Errorf("Expected errors to be empty, but is %q", errs)
+		}
+	}
+}
+
+func TestRemoveOldImagesWithCountSince(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	baseDigest, oldBuildDigest, newBuildDigest := "base-digest", "old-build-digest", "new-build-digest"
+
+	now := time.Now()
+	orderedTime := []time.Time{
+		now.Add(-365 * 24 * time.Hour),
+		now.Add(-2 * time.Hour),
+		now.Add(-1 * time.Hour),
+	}
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{},
+		},
+	}
+
+	ecrClient := &mockECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult: []*ecr.ImageDetail{
+			{
+				ImageDigest:   &baseDigest,
+				ImagePushedAt: &orderedTime[0],
+			},
+			{
+				ImageDigest:   &oldBuildDigest,
+				ImagePushedAt: &orderedTime[1],
+			},
+			{
+				ImageDigest:   &newBuildDigest,
+				ImagePushedAt: &orderedTime[2],
+			},
+		},
+
+		// The base image is neither counted nor deleted
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &oldBuildDigest,
+			},
+		},
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:  []*string{&namespace},
+		EcrRepositories: []*string{&repoName},
 
-func TestRemoveOldImagesWithKubeListPodsError(t *testing.T) {
-	namespace := "namespace"
-	kubeClient := &mockKubeClient{
-		t: t,
+		MaxImages:  1,
+		CountSince: 24 * time.Hour,
+	}
 
-		expectedNamespace: []string{namespace},
+	errs := task.RemoveOldImages(kubeClient, ecrClient)
 
-		listAllPodsResult: nil,
-		listAllPodsError:  fmt.Errorf(""),
+	if len(errs) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", errs)
 	}
+}
 
+func TestReconcileWhileAnotherIsRunning(t *testing.T) {
 	task := &CleanupTask{
-		KubeNamespaces: []*string{&namespace},
+		reconciling: 1,
 	}
 
-	errs := task.RemoveOldImages(kubeClient, nil)
+	// The clients must not be used at all
+	result := task.Reconcile(nil, nil)
 
-	if len(errs) != 1 {
-		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
+	if !result.Skipped {
+		t.Errorf("Expected pass to be skipped, but it wasn't")
+	}
+
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
 	}
 }
 
-func TestRemoveOldImagesWithECRListRepositoriesError(t *testing.T) {
+func TestReconcileWithReclaimBytes(t *testing.T) {
 	namespace, repoName := "namespace", "repo"
+	digests := []string{"digest-0", "digest-1", "digest-2"}
+	sizes := []int64{10, 20, 30}
+
+	orderedTime := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+		time.Unix(2, 0),
+	}
+
+	images := []*ecr.ImageDetail{}
+	for i := range digests {
+		images = append(images, &ecr.ImageDetail{
+			ImageDigest:      &digests[i],
+			ImageSizeInBytes: &sizes[i],
+			ImagePushedAt:    &orderedTime[i],
+		})
+	}
+
 	kubeClient := &mockKubeClient{
 		t: t,
 
@@ -127,41 +3024,147 @@ func TestRemoveOldImagesWithECRListRepositoriesError(t *testing.T) {
 		t: t,
 
 		expectedRepositoryNames: []string{repoName},
-		listRepositoriesResult:  nil,
-		listRepositoriesError:   fmt.Errorf(""),
+		listRepositoriesResult: []*ecr.Repository{
+			{
+				RepositoryName: &repoName,
+			},
+		},
+
+		expectedImagesRepositoryName: repoName,
+		listImagesResult:             images,
+
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{ImageDigest: &digests[0]},
+			{ImageDigest: &digests[1]},
+		},
 	}
 
 	task := &CleanupTask{
 		KubeNamespaces:  []*string{&namespace},
 		EcrRepositories: []*string{&repoName},
+
+		// Ignored when reclaiming space
+		MaxImages:    900,
+		ReclaimBytes: 25,
 	}
 
-	errs := task.RemoveOldImages(kubeClient, ecrClient)
+	result := task.Reconcile(kubeClient, ecrClient)
 
-	if len(errs) != 1 {
-		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
+	}
+
+	if result.BytesSelected != 30 {
+		t.Errorf("Expected 30 bytes to be selected, but got %d", result.BytesSelected)
 	}
 }
 
-func TestRemoveOldImagesWithECRListImagesError(t *testing.T) {
+func TestReconcileWithReclaimBytesAfterLimits(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	digests := []string{"digest-0", "digest-1", "digest-2"}
+	sizes := []int64{10, 20, 30}
+
+	orderedTime := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+		time.Unix(2, 0),
+	}
+
+	images := []*ecr.ImageDetail{}
+	for i := range digests {
+		images = append(images, &ecr.ImageDetail{
+			ImageDigest:      &digests[i],
+			ImageSizeInBytes: &sizes[i],
+			ImagePushedAt:    &orderedTime[i],
+		})
+	}
+
+	testCases := []struct {
+		maxDeletes        int
+		deleteImagesError error
+		expectedToRemove  []*ecr.ImageDetail
+		expectedSelected  int64
+		expectedDeleted   int64
+	}{
+		// The newest image is never selected, so as not to empty the repo
+		{
+			expectedToRemove: []*ecr.ImageDetail{{ImageDigest: &digests[0]}, {ImageDigest: &digests[1]}},
+			expectedSelected: 30,
+			expectedDeleted:  30,
+		},
+
+		// Images dropped by the other limits don't count towards the target
+		{
+			maxDeletes:       1,
+			expectedToRemove: []*ecr.ImageDetail{{ImageDigest: &digests[0]}},
+			expectedSelected: 10,
+			expectedDeleted:  10,
+		},
+
+		// Neither do the images that could not be deleted
+		{
+			deleteImagesError: fmt.Errorf("AccessDeniedException"),
+			expectedToRemove:  []*ecr.ImageDetail{{ImageDigest: &digests[0]}, {ImageDigest: &digests[1]}},
+		},
+	}
+
+	for i, testCase := range testCases {
+		kubeClient := &mockKubeClient{
+			t: t,
+
+			expectedNamespace: []string{namespace},
+			listAllPodsResult: []*v1.Pod{
+				{},
+			},
+		}
+
+		ecrClient := &mockECRClient{
+			t: t,
+
+			expectedRepositoryNames: []string{repoName},
+			listRepositoriesResult: []*ecr.Repository{
+				{
+					RepositoryName: &repoName,
+				},
+			},
+
+			expectedImagesRepositoryName: repoName,
+			listImagesResult:             images,
+
+			expectedImagesToRemove: testCase.expectedToRemove,
+			deleteImagesError:      testCase.deleteImagesError,
+		}
+
+		task := &CleanupTask{
+			KubeNamespaces:  []*string{&namespace},
+			EcrRepositories: []*string{&repoName},
+
+			ReclaimBytes:           100,
+			MaxDeletesPerReconcile: testCase.maxDeletes,
+		}
+
+		result := task.Reconcile(kubeClient, ecrClient)
+
+		if result.BytesSelected != testCase.expectedSelected || result.BytesDeleted != testCase.expectedDeleted {
+			t.Errorf("Test case %d: expected %d bytes to be selected and %d deleted, but got %d and %d", i, testCase.expectedSelected, testCase.expectedDeleted, result.BytesSelected, result.BytesDeleted)
+		}
+	}
+}
+
+func TestRemoveOldImagesSkipsNewRepositories(t *testing.T) {
 	namespace, repoName := "namespace", "repo"
+	createdAt := time.Now().Add(-time.Hour)
+
 	kubeClient := &mockKubeClient{
 		t: t,
 
 		expectedNamespace: []string{namespace},
 		listAllPodsResult: []*v1.Pod{
-			{
-				Spec: v1.PodSpec{
-					Containers: []v1.Container{
-						{
-							Image: "id.dkr.ecr.region.amazonaws.com/repo:tag-1",
-						},
-					},
-				},
-			},
+			{},
 		},
 	}
 
+	// Listing images would fail, so the repository must be skipped
 	ecrClient := &mockECRClient{
 		t: t,
 
@@ -169,44 +3172,48 @@ func TestRemoveOldImagesWithECRListImagesError(t *testing.T) {
 		listRepositoriesResult: []*ecr.Repository{
 			{
 				RepositoryName: &repoName,
+				CreatedAt:      &createdAt,
 			},
 		},
 
-		expectedImagesRepositoryName: repoName,
-		listImagesResult:             nil,
-		listImagesError:              fmt.Errorf(""),
+		listImagesError: fmt.Errorf(""),
 	}
 
 	task := &CleanupTask{
 		KubeNamespaces:  []*string{&namespace},
 		EcrRepositories: []*string{&repoName},
-		MaxImages:       1,
+
+		RepositoryGracePeriod: 24 * time.Hour,
 	}
 
-	errs := task.RemoveOldImages(kubeClient, ecrClient)
+	result := task.Reconcile(kubeClient, ecrClient)
 
-	if len(errs) != 1 {
-		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
+	}
+
+	if result.RepositoriesProcessed != 0 {
+		t.Errorf("Expected no repos to be processed, but %d were", result.RepositoriesProcessed)
 	}
 }
 
-func TestRemoveOldImagesWithoutOldImagesToRemove(t *testing.T) {
-	namespace, repoName, imageDigest := "namespace", "repo", "image-digest"
+func TestReconcileWithScanFindings(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	digests := []string{"digest-0", "digest-1", "digest-2"}
+	inProgress := ecr.ScanStatusInProgress
+	critical := int64(2)
+
+	pushedAt := []time.Time{
+		time.Now().Add(-3 * time.Hour),
+		time.Now().Add(-2 * time.Hour),
+		time.Now().Add(-time.Hour),
+	}
+
 	kubeClient := &mockKubeClient{
 		t: t,
 
 		expectedNamespace: []string{namespace},
-		listAllPodsResult: []*v1.Pod{
-			{
-				Spec: v1.PodSpec{
-					Containers: []v1.Container{
-						{
-							Image: "id.dkr.ecr.region.amazonaws.com/repo:tag-1",
-						},
-					},
-				},
-			},
-		},
+		listAllPodsResult: []*v1.Pod{},
 	}
 
 	ecrClient := &mockECRClient{
@@ -222,7 +3229,28 @@ func TestRemoveOldImagesWithoutOldImagesToRemove(t *testing.T) {
 		expectedImagesRepositoryName: repoName,
 		listImagesResult: []*ecr.ImageDetail{
 			{
-				ImageDigest: &imageDigest,
+				ImageDigest:     &digests[0],
+				ImagePushedAt:   &pushedAt[0],
+				ImageScanStatus: &ecr.ImageScanStatus{Status: &inProgress},
+			},
+			{
+				ImageDigest:   &digests[1],
+				ImagePushedAt: &pushedAt[1],
+			},
+			{
+				ImageDigest:   &digests[2],
+				ImagePushedAt: &pushedAt[2],
+				ImageScanFindingsSummary: &ecr.ImageScanFindingsSummary{
+					FindingSeverityCounts: map[string]*int64{ecr.FindingSeverityCritical: &critical},
+				},
+			},
+		},
+
+		// The oldest image is kept while its scan is in progress, and the
+		// newest one is deleted despite -max-images due to its findings
+		expectedImagesToRemove: []*ecr.ImageDetail{
+			{
+				ImageDigest: &digests[2],
 			},
 		},
 	}
@@ -230,35 +3258,155 @@ func TestRemoveOldImagesWithoutOldImagesToRemove(t *testing.T) {
 	task := &CleanupTask{
 		KubeNamespaces:  []*string{&namespace},
 		EcrRepositories: []*string{&repoName},
+		Logger:          &mockLogger{},
 
-		// No need to clean up any images
-		MaxImages: 1000,
+		MaxImages:              2,
+		SkipScanPending:        true,
+		DeleteCriticalFindings: true,
+
+		// Images with critical findings are deleted regardless of -max-images
+		VerifyPlan: true,
 	}
 
-	errs := task.RemoveOldImages(kubeClient, ecrClient)
+	result := task.Reconcile(kubeClient, ecrClient)
 
-	if len(errs) != 0 {
-		t.Errorf("Expected errors to be empty, but is %q", errs)
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
+	}
+
+	if result.ImagesRetained[RetainReasonScanPending] != 1 {
+		t.Errorf("Expected 1 image to be retained due to its pending scan, but got %d", result.ImagesRetained[RetainReasonScanPending])
 	}
 }
 
-func TestRemoveOldImagesWithECRBatchRemoveImagesError(t *testing.T) {
-	namespace, repoName, imageDigest := "namespace", "repo", "image-digest"
+// mockRepositoriesECRClient holds several repositories whose images may be
+// listed from several goroutines.
+type mockRepositoriesECRClient struct {
+	*mockECRClient
+
+	lock          sync.Mutex
+	repoImages    map[string][]*ecr.ImageDetail
+	listedRepos   []string
+	deletedImages map[string][]*ecr.ImageDetail
+}
+
+func (m *mockRepositoriesECRClient) ListImages(repositoryName *string) ([]*ecr.ImageDetail, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.listedRepos = append(m.listedRepos, *repositoryName)
+	if images, ok := m.repoImages[*repositoryName]; ok {
+		return images, nil
+	}
+	return nil, fmt.Errorf("Repository '%s' not found", *repositoryName)
+}
+
+func (m *mockRepositoriesECRClient) DeleteImages(images []*ecr.ImageDetail) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	repoName := *images[0].RepositoryName
+	m.deletedImages[repoName] = append(m.deletedImages[repoName], images...)
+	return nil
+}
+
+func TestReconcileWithConcurrency(t *testing.T) {
+	namespace := "namespace"
+	repoNames := []string{"repo-0", "repo-1", "repo-2", "missing", "repo-4"}
+
+	repos := []*ecr.Repository{}
+	repoImages := map[string][]*ecr.ImageDetail{}
+	for i := range repoNames {
+		repos = append(repos, &ecr.Repository{RepositoryName: &repoNames[i]})
+		if repoNames[i] == "missing" {
+			continue
+		}
+
+		for j := 0; j < 3; j++ {
+			digest, pushedAt := fmt.Sprintf("%s-digest-%d", repoNames[i], j), time.Unix(int64(j), 0)
+			repoImages[repoNames[i]] = append(repoImages[repoNames[i]], &ecr.ImageDetail{
+				RepositoryName: &repoNames[i],
+				ImageDigest:    &digest,
+				ImagePushedAt:  &pushedAt,
+			})
+		}
+	}
+
+	for _, concurrency := range []int{1, 3, 10} {
+		ecrClient := &mockRepositoriesECRClient{
+			mockECRClient: &mockECRClient{
+				t: t,
+
+				listAllRepositoriesResult: repos,
+			},
+			repoImages:    repoImages,
+			deletedImages: map[string][]*ecr.ImageDetail{},
+		}
+
+		task := &CleanupTask{
+			KubeNamespaces:       []*string{&namespace},
+			DiscoverRepositories: true,
+			Concurrency:          concurrency,
+			Logger:               &mockLogger{},
+
+			MaxImages: 1,
+		}
+
+		kubeClient := &mockKubeClient{
+			t: t,
+
+			expectedNamespace: []string{namespace},
+			listAllPodsResult: []*v1.Pod{},
+		}
+
+		result := task.Reconcile(kubeClient, ecrClient)
+
+		if len(ecrClient.listedRepos) != len(repoNames) {
+			t.Errorf("Expected the images of %d repos to be listed with concurrency %d, but got %v", len(repoNames), concurrency, ecrClient.listedRepos)
+		}
+
+		if len(result.Errors) != 1 || !strings.Contains(result.Errors[0].Error(), "missing") {
+			t.Errorf("Expected an error about the missing repo with concurrency %d, but got %q", concurrency, result.Errors)
+		}
+
+		if result.RepositoriesProcessed != len(repoNames) || result.ImagesDeleted != 8 {
+			t.Errorf("Expected %d repos to be processed and 8 images to be deleted with concurrency %d, but got %d and %d", len(repoNames), concurrency, result.RepositoriesProcessed, result.ImagesDeleted)
+		}
+
+		// The plan lists the repositories in the order they were found
+		for i, repo := range result.Plan.Repositories {
+			if repo.Name != repoNames[i] {
+				t.Errorf("Expected repo %d of the plan to be '%s' with concurrency %d, but was '%s'", i, repoNames[i], concurrency, repo.Name)
+			}
+		}
+
+		for _, repoName := range repoNames {
+			if repoName != "missing" && len(ecrClient.deletedImages[repoName]) != 2 {
+				t.Errorf("Expected 2 images to be deleted from '%s' with concurrency %d, but got %d", repoName, concurrency, len(ecrClient.deletedImages[repoName]))
+			}
+		}
+	}
+}
+
+func TestReconcileWithTagGroups(t *testing.T) {
+	namespace, repoName := "namespace", "repo"
+	tags := []string{"main-aaa", "main-bbb", "main-ccc", "develop-ddd", "feature-xyz-eee", "feature-xyz-fff"}
+
+	images := []*ecr.ImageDetail{}
+	for i := range tags {
+		pushedAt := time.Unix(int64(i), 0)
+		images = append(images, &ecr.ImageDetail{
+			ImageDigest:   &tags[i],
+			ImagePushedAt: &pushedAt,
+			ImageTags:     []*string{&tags[i]},
+		})
+	}
+
 	kubeClient := &mockKubeClient{
 		t: t,
 
 		expectedNamespace: []string{namespace},
-		listAllPodsResult: []*v1.Pod{
-			{
-				Spec: v1.PodSpec{
-					Containers: []v1.Container{
-						{
-							Image: "id.dkr.ecr.region.amazonaws.com/repo:tag-1",
-						},
-					},
-				},
-			},
-		},
+		listAllPodsResult: []*v1.Pod{},
 	}
 
 	ecrClient := &mockECRClient{
@@ -272,54 +3420,128 @@ func TestRemoveOldImagesWithECRBatchRemoveImagesError(t *testing.T) {
 		},
 
 		expectedImagesRepositoryName: repoName,
-		listImagesResult: []*ecr.ImageDetail{
-			{
-				ImageDigest: &imageDigest,
-			},
-		},
+		listImagesResult:             images,
 
+		// Each branch keeps its most recent build
 		expectedImagesToRemove: []*ecr.ImageDetail{
-			{
-				ImageDigest: &imageDigest,
-			},
+			{ImageDigest: &tags[0]},
+			{ImageDigest: &tags[1]},
+			{ImageDigest: &tags[4]},
 		},
-		batchRemoveImagesError: fmt.Errorf(""),
 	}
 
 	task := &CleanupTask{
 		KubeNamespaces:  []*string{&namespace},
 		EcrRepositories: []*string{&repoName},
+		Logger:          &mockLogger{},
 
-		// Will cause the image to be deleted
-		MaxImages: 0,
+		MaxImages:       1,
+		TagGroupPattern: regexp.MustCompile(`^(.+)-[a-f]+$`),
+		VerifyPlan:      true,
 	}
 
-	errs := task.RemoveOldImages(kubeClient, ecrClient)
+	result := task.Reconcile(kubeClient, ecrClient)
 
-	if len(errs) == 0 {
-		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
+	}
+
+	if result.ImagesDeleted != 3 || result.ImagesRetained[RetainReasonKeepMax] != 3 {
+		t.Errorf("Expected 3 images to be deleted and 3 to be retained by -max-images, but got %d and %d", result.ImagesDeleted, result.ImagesRetained[RetainReasonKeepMax])
 	}
 }
 
-func TestRemoveOldImages(t *testing.T) {
-	namespace, repoName, imageDigest := "namespace", "repo", "image-digest"
+// cancelingECRClient cancels the pass once the first batch of images is
+// deleted, as a shutdown signal would.
+type cancelingECRClient struct {
+	*mockECRClient
+
+	cancel  context.CancelFunc
+	batches [][]*ecr.ImageDetail
+}
+
+func (m *cancelingECRClient) DeleteImages(images []*ecr.ImageDetail) error {
+	m.batches = append(m.batches, images)
+	m.cancel()
+	return nil
+}
+
+func TestDeleteImagesCanceled(t *testing.T) {
+	repoName := "repo"
+	images := []*ecr.ImageDetail{}
+	for i := 0; i < 250; i++ {
+		digest := fmt.Sprintf("digest-%d", i)
+		images = append(images, &ecr.ImageDetail{RepositoryName: &repoName, ImageDigest: &digest})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ecrClient := &cancelingECRClient{mockECRClient: &mockECRClient{t: t}, cancel: cancel}
+	task := &CleanupTask{Logger: &mockLogger{}}
+
+	attempted, removed, err := task.deleteImages(ecrClient, repoName, images, &passState{ctx: ctx})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	// The batch being deleted when the pass is canceled is completed, but no
+	// further batches are started
+	if len(ecrClient.batches) != 1 || len(attempted) != batchRemoveMaxImages || len(removed) != batchRemoveMaxImages {
+		t.Errorf("Expected only the first batch of %d images to be deleted, but got %d batches, %d attempted and %d removed images", batchRemoveMaxImages, len(ecrClient.batches), len(attempted), len(removed))
+	}
+}
+
+func TestDeleteImagesCanceledDuringBatch(t *testing.T) {
+	repoName := "repo"
+	images := []*ecr.ImageDetail{}
+	digests := []string{}
+	for i := 0; i < 3; i++ {
+		digest := fmt.Sprintf("digest-%d", i)
+		images = append(images, &ecr.ImageDetail{RepositoryName: &repoName, ImageDigest: &digest})
+		digests = append(digests, digest)
+	}
+
+	// The pass is canceled while the batch is being deleted by ECR
+	ctx, cancel := context.WithCancel(context.Background())
+	mock := &mockAWSECRClient{
+		t: t,
+
+		expectedRepositoryNames: []string{repoName},
+		expectedImageDigests:    digests,
+		onBatchDeleteImage:      cancel,
+	}
+	ecrClient := &ECRClientImpl{
+		ECRClient: mock,
+		Logger:    &mockLogger{},
+		Context:   func() context.Context { return ctx },
+	}
+	task := &CleanupTask{Logger: &mockLogger{}}
+
+	attempted, removed, err := task.deleteImages(ecrClient, repoName, images, &passState{ctx: ctx})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	// The deletion is finished, so the images are all recorded as removed
+	if mock.batchDeleteImageCalls != 1 || len(attempted) != len(images) || len(removed) != len(images) {
+		t.Errorf("Expected the batch of %d images to be removed, but got %d calls, %d attempted and %d removed images", len(images), mock.batchDeleteImageCalls, len(attempted), len(removed))
+	}
+}
+
+func TestReconcileWithImageTagStatusRemovesAllListedImages(t *testing.T) {
+	namespace, repoName, imageDigest := "namespace", "repo", "untagged-digest"
+	pushedAt, size := time.Now().Add(-time.Hour), int64(10)
+
 	kubeClient := &mockKubeClient{
 		t: t,
 
 		expectedNamespace: []string{namespace},
 		listAllPodsResult: []*v1.Pod{
-			{
-				Spec: v1.PodSpec{
-					Containers: []v1.Container{
-						{
-							Image: "id.dkr.ecr.region.amazonaws.com/repo:tag-1",
-						},
-					},
-				},
-			},
+			{},
 		},
 	}
 
+	// Only the untagged image is listed, whereas the repo holds tagged
+	// images as well
 	ecrClient := &mockECRClient{
 		t: t,
 
@@ -333,7 +3555,9 @@ func TestRemoveOldImages(t *testing.T) {
 		expectedImagesRepositoryName: repoName,
 		listImagesResult: []*ecr.ImageDetail{
 			{
-				ImageDigest: &imageDigest,
+				ImageDigest:      &imageDigest,
+				ImagePushedAt:    &pushedAt,
+				ImageSizeInBytes: &size,
 			},
 		},
 
@@ -348,13 +3572,17 @@ func TestRemoveOldImages(t *testing.T) {
 		KubeNamespaces:  []*string{&namespace},
 		EcrRepositories: []*string{&repoName},
 
-		// Will cause the image to be deleted
-		MaxImages: 0,
+		MaxImages:      0,
+		ImageTagStatus: ImageTagStatusUntagged,
+		ReclaimBytes:   10,
 	}
 
-	errs := task.RemoveOldImages(kubeClient, ecrClient)
+	result := task.Reconcile(kubeClient, ecrClient)
 
-	if len(errs) != 0 {
-		t.Errorf("Expected errors to be empty, but is %q", errs)
+	if len(result.Errors) != 0 {
+		t.Errorf("Expected errors to be empty, but is %q", result.Errors)
+	}
+	if result.ImagesDeleted != 1 {
+		t.Errorf("Expected the untagged image to be removed, but got %d removed images", result.ImagesDeleted)
 	}
 }
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+const (
+	// Prefix of the tags that mark images as pending deletion
+	QuarantineTagPrefix = "pending-deletion-"
+
+	// Layout of the time since when images are pending deletion, down to the
+	// second, so that retentions shorter than a day are honored
+	quarantineTagTimeLayout = "20060102T150405Z"
+
+	// Layout of the date of the quarantine tags of earlier versions, which
+	// are still understood
+	quarantineTagDateLayout = "20060102"
+
+	// Number of digest characters included in quarantine tags
+	quarantineTagDigestLength = 12
+)
+
+// IsQuarantineTag tells whether the given tag marks an image as pending
+// deletion.
+func IsQuarantineTag(tag string) bool {
+	return strings.HasPrefix(tag, QuarantineTagPrefix)
+}
+
+// QuarantineTag returns the tag that marks the given image as pending deletion
+// since the given time, e.g. `pending-deletion-20170102T150405Z-0123456789ab`.
+// Since a tag can only point to one image in a repo, the tag includes the
+// first characters of the image digest.
+func QuarantineTag(image *ecr.ImageDetail, now time.Time) string {
+	digest := aws.StringValue(image.ImageDigest)
+
+	if i := strings.Index(digest, ":"); i >= 0 {
+		digest = digest[i+1:]
+	}
+	if len(digest) > quarantineTagDigestLength {
+		digest = digest[:quarantineTagDigestLength]
+	}
+
+	return QuarantineTagPrefix + now.UTC().Format(quarantineTagTimeLayout) + "-" + digest
+}
+
+// QuarantinedSince returns the time since when the given image has been
+// pending deletion, according to the earliest of its quarantine tags, and
+// whether the image has any quarantine tags at all. Tags that only carry a
+// date count from the start of that day.
+func QuarantinedSince(image *ecr.ImageDetail) (time.Time, bool) {
+	since, found := time.Time{}, false
+
+	for _, tag := range image.ImageTags {
+		if !IsQuarantineTag(*tag) {
+			continue
+		}
+
+		t, ok := parseQuarantineTime(strings.TrimPrefix(*tag, QuarantineTagPrefix))
+		if !ok {
+			continue
+		}
+
+		if !found || t.Before(since) {
+			since, found = t, true
+		}
+	}
+
+	return since, found
+}
+
+// parseQuarantineTime returns the time at the start of the given quarantine
+// tag, stripped of its prefix, and whether there's any.
+func parseQuarantineTime(value string) (time.Time, bool) {
+	for _, layout := range []string{quarantineTagTimeLayout, quarantineTagDateLayout} {
+		if len(value) < len(layout) {
+			continue
+		}
+
+		if t, err := time.Parse(layout, value[:len(layout)]); err == nil {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// SplitQuarantinedImages goes through the given list of ECR images selected for
+// deletion and returns the images that must be quarantined, i.e. the ones not
+// pending deletion yet, and the images that have been pending deletion for
+// longer than the given retention, which can be deleted for good. Images still
+// within the retention are not returned at all.
+func SplitQuarantinedImages(images []*ecr.ImageDetail, retention time.Duration, now time.Time) ([]*ecr.ImageDetail, []*ecr.ImageDetail) {
+	toQuarantine, toDelete := []*ecr.ImageDetail{}, []*ecr.ImageDetail{}
+
+	for _, image := range images {
+		since, quarantined := QuarantinedSince(image)
+
+		if !quarantined {
+			toQuarantine = append(toQuarantine, image)
+			continue
+		}
+
+		if now.Sub(since) >= retention {
+			toDelete = append(toDelete, image)
+		}
+	}
+
+	return toQuarantine, toDelete
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+func TestQuarantineTag(t *testing.T) {
+	digest := "sha256:0123456789abcdef"
+	image := &ecr.ImageDetail{ImageDigest: &digest}
+
+	now := time.Date(2017, 1, 2, 23, 0, 0, 0, time.FixedZone("", -3*60*60))
+	expected := "pending-deletion-20170103T020000Z-0123456789ab"
+
+	if actual := QuarantineTag(image, now); actual != expected {
+		t.Errorf("Expected quarantine tag to be %s, but was %s", expected, actual)
+	}
+}
+
+func TestQuarantinedSince(t *testing.T) {
+	tags := []string{"v1", "pending-deletion-20170105-abc", "pending-deletion-20170102-def", "pending-deletion-invalid", "pending-deletion-20170102T150405Z-abc"}
+
+	testCases := []struct {
+		tags          []*string
+		expectedSince time.Time
+		expectedFound bool
+	}{
+		// Not quarantined
+		{
+			tags:          []*string{&tags[0]},
+			expectedFound: false,
+		},
+
+		// Malformed quarantine tags are ignored
+		{
+			tags:          []*string{&tags[3]},
+			expectedFound: false,
+		},
+
+		// The earliest quarantine tag wins
+		{
+			tags:          []*string{&tags[0], &tags[1], &tags[2], &tags[3]},
+			expectedSince: time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC),
+			expectedFound: true,
+		},
+
+		// Quarantine tags carry the time down to the second
+		{
+			tags:          []*string{&tags[1], &tags[4]},
+			expectedSince: time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC),
+			expectedFound: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		since, found := QuarantinedSince(&ecr.ImageDetail{ImageTags: testCase.tags})
+
+		if found != testCase.expectedFound {
+			t.Errorf("Expected found to be %v, but was %v", testCase.expectedFound, found)
+		}
+
+		if !since.Equal(testCase.expectedSince) {
+			t.Errorf("Expected since to be %v, but was %v", testCase.expectedSince, since)
+		}
+	}
+}
+
+func TestSplitQuarantinedImages(t *testing.T) {
+	digests := []string{"digest-1", "digest-2", "digest-3"}
+	tags := []string{"pending-deletion-20170101-2", "pending-deletion-20170110-3"}
+
+	images := []*ecr.ImageDetail{
+		{
+			ImageDigest: &digests[0],
+		},
+		{
+			ImageDigest: &digests[1],
+			ImageTags:   []*string{&tags[0]},
+		},
+		{
+			ImageDigest: &digests[2],
+			ImageTags:   []*string{&tags[1]},
+		},
+	}
+
+	now := time.Date(2017, 1, 11, 0, 0, 0, 0, time.UTC)
+	toQuarantine, toDelete := SplitQuarantinedImages(images, 7*24*time.Hour, now)
+
+	actualToQuarantine := []string{}
+	for _, image := range toQuarantine {
+		actualToQuarantine = append(actualToQuarantine, *image.ImageDigest)
+	}
+
+	actualToDelete := []string{}
+	for _, image := range toDelete {
+		actualToDelete = append(actualToDelete, *image.ImageDigest)
+	}
+
+	if expected := []string{"digest-1"}; !reflect.DeepEqual(actualToQuarantine, expected) {
+		t.Errorf("Expected images to quarantine to be %v, but was %v", expected, actualToQuarantine)
+	}
+
+	if expected := []string{"digest-2"}; !reflect.DeepEqual(actualToDelete, expected) {
+		t.Errorf("Expected images to delete to be %v, but was %v", expected, actualToDelete)
+	}
+}
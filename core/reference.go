@@ -0,0 +1,149 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Registry host implied by image references without one
+const DefaultRegistryHost = "docker.io"
+
+// Hosts that also stand for `DefaultRegistryHost`
+var defaultRegistryHosts = map[string]bool{
+	DefaultRegistryHost:    true,
+	"index.docker.io":      true,
+	"registry-1.docker.io": true,
+}
+
+// Only matches images hosted on ECR, whether tagged, pinned to a digest, or
+// both
+var ecrImageReferenceRegexp = regexp.MustCompile(`^([^/]+\.dkr\.ecr\.[^\./]+\.amazonaws\.com(?:\.cn)?)/([^:@]+)(?::([^@]+))?(?:@(.+))?$`)
+
+// Other hosts of ECR registries, such as FIPS and dual-stack endpoints, which
+// capture the AWS account ID and region of the registry
+var ecrRegistryHostRegexps = []*regexp.Regexp{
+	regexp.MustCompile(`^([^\./]+)\.dkr\.ecr-fips\.([^\./]+)\.amazonaws\.com(?:\.cn)?$`),
+	regexp.MustCompile(`^([^\./]+)\.dkr-ecr(?:-fips)?\.([^\./]+)\.on\.aws$`),
+}
+
+// ImageReference holds the parts of a container image reference that are
+// relevant to find out which ECR images are in use.
+type ImageReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ECRRegistryHost returns the host of the ECR registry belonging to the given
+// AWS account in the given region.
+func ECRRegistryHost(accountID, region string) string {
+	domain := "amazonaws.com"
+
+	// China regions live in a separate partition
+	if strings.HasPrefix(region, "cn-") {
+		domain = "amazonaws.com.cn"
+	}
+
+	return fmt.Sprintf("%s.dkr.ecr.%s.%s", accountID, region, domain)
+}
+
+// ParseImageReference parses the given ECR image reference, such as
+// `id.dkr.ecr.region.amazonaws.com/repo:tag`. References starting with one of
+// the keys in registryAliases, such as a registry mirror or pull-through cache
+// host, are first normalized to the ECR registry host they map to. Otherwise,
+// the reference is brought into its canonical form with
+// `NormalizeImageReference` before looking up the aliases again, so that
+// aliases such as `docker.io` also apply to references without a registry
+// host. The second return value is false if the reference does not point to an
+// ECR image that is either tagged or pinned to a digest.
+func ParseImageReference(image string, registryAliases map[string]string) (ImageReference, bool) {
+	if aliased, ok := normalizeRegistryAlias(image, registryAliases); ok {
+		image = aliased
+	} else {
+		image, _ = normalizeRegistryAlias(NormalizeImageReference(image), registryAliases)
+	}
+
+	imageData := ecrImageReferenceRegexp.FindStringSubmatch(image)
+	if imageData == nil || (imageData[3] == "" && imageData[4] == "") {
+		return ImageReference{}, false
+	}
+
+	return ImageReference{
+		Registry:   imageData[1],
+		Repository: imageData[2],
+		Tag:        imageData[3],
+		Digest:     imageData[4],
+	}, true
+}
+
+// NormalizeImageReference brings the given image reference into its
+// canonical form, the way container runtimes resolve it: references without a
+// registry host, such as `team/app:tag`, get `DefaultRegistryHost` injected,
+// official images in that registry, such as `nginx:tag`, get the `library/`
+// namespace, registry hosts are lowercased and stripped of any `https://` or
+// `http://` scheme, and the FIPS and dual-stack hosts of ECR registries are
+// replaced with their `ECRRegistryHost`. The first path segment is taken as a
+// registry host only if it contains a dot or a port, or if it's `localhost`.
+func NormalizeImageReference(image string) string {
+	image = strings.TrimSpace(image)
+	for _, scheme := range []string{"https://", "http://"} {
+		if len(image) >= len(scheme) && strings.EqualFold(image[:len(scheme)], scheme) {
+			image = image[len(scheme):]
+			break
+		}
+	}
+
+	registry, path := "", image
+
+	if i := strings.Index(image, "/"); i >= 0 {
+		host := image[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			registry, path = normalizeECRRegistryHost(strings.ToLower(host)), image[i+1:]
+		}
+	}
+
+	if registry == "" || defaultRegistryHosts[registry] {
+		registry = DefaultRegistryHost
+
+		if !strings.Contains(path, "/") {
+			path = "library/" + path
+		}
+	}
+
+	return registry + "/" + path
+}
+
+// normalizeECRRegistryHost returns the `ECRRegistryHost` of the given host if
+// it's another host of an ECR registry, or the host itself otherwise.
+func normalizeECRRegistryHost(host string) string {
+	for _, hostRegexp := range ecrRegistryHostRegexps {
+		if hostData := hostRegexp.FindStringSubmatch(host); hostData != nil {
+			return ECRRegistryHost(hostData[1], hostData[2])
+		}
+	}
+	return host
+}
+
+// normalizeRegistryAlias replaces the registry alias the given image reference
+// starts with, if any, with the ECR registry host it maps to. Aliases may
+// contain a path prefix, e.g. `mirror.internal/ecr`, in which case the longest
+// matching alias wins. The second return value is false if no alias matched.
+func normalizeRegistryAlias(image string, registryAliases map[string]string) (string, bool) {
+	longestPrefix, target := "", ""
+
+	for alias, registry := range registryAliases {
+		prefix := strings.TrimSuffix(alias, "/") + "/"
+
+		if strings.HasPrefix(image, prefix) && len(prefix) > len(longestPrefix) {
+			longestPrefix, target = prefix, registry
+		}
+	}
+
+	if longestPrefix == "" {
+		return image, false
+	}
+
+	return strings.TrimSuffix(target, "/") + "/" + strings.TrimPrefix(image, longestPrefix), true
+}
@@ -0,0 +1,296 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestParseImageReference(t *testing.T) {
+	registry := "id.dkr.ecr.region.amazonaws.com"
+	registryAliases := map[string]string{
+		"mirror.internal":     "other-id.dkr.ecr.region.amazonaws.com",
+		"mirror.internal/ecr": registry,
+		"ecr-cache.corp.com/": registry + "/",
+		"docker.io":           registry + "/docker-hub",
+	}
+
+	testCases := []struct {
+		image    string
+		expected ImageReference
+		ok       bool
+	}{
+		// ECR image
+		{
+			image:    "id.dkr.ecr.region.amazonaws.com/repo:tag",
+			expected: ImageReference{Registry: registry, Repository: "repo", Tag: "tag"},
+			ok:       true,
+		},
+
+		// ECR image within a namespace
+		{
+			image:    "id.dkr.ecr.region.amazonaws.com/team/repo:tag",
+			expected: ImageReference{Registry: registry, Repository: "team/repo", Tag: "tag"},
+			ok:       true,
+		},
+
+		// ECR image pinned to a digest as well
+		{
+			image:    "id.dkr.ecr.region.amazonaws.com/repo:tag@sha256:abc",
+			expected: ImageReference{Registry: registry, Repository: "repo", Tag: "tag", Digest: "sha256:abc"},
+			ok:       true,
+		},
+
+		// ECR image only pinned to a digest
+		{
+			image:    "id.dkr.ecr.region.amazonaws.com/repo@sha256:abc",
+			expected: ImageReference{Registry: registry, Repository: "repo", Digest: "sha256:abc"},
+			ok:       true,
+		},
+
+		// ECR image in a China region
+		{
+			image:    "id.dkr.ecr.cn-north-1.amazonaws.com.cn/repo:tag",
+			expected: ImageReference{Registry: "id.dkr.ecr.cn-north-1.amazonaws.com.cn", Repository: "repo", Tag: "tag"},
+			ok:       true,
+		},
+
+		// Untagged ECR image
+		{
+			image: "id.dkr.ecr.region.amazonaws.com/repo",
+			ok:    false,
+		},
+
+		// Non-ECR image
+		{
+			image: "other-registry.com/repo:tag",
+			ok:    false,
+		},
+
+		// Mirrored image, the longest alias wins
+		{
+			image:    "mirror.internal/ecr/team/repo:tag",
+			expected: ImageReference{Registry: registry, Repository: "team/repo", Tag: "tag"},
+			ok:       true,
+		},
+
+		// Mirrored image, the shortest alias applies
+		{
+			image:    "mirror.internal/repo:tag",
+			expected: ImageReference{Registry: "other-id.dkr.ecr.region.amazonaws.com", Repository: "repo", Tag: "tag"},
+			ok:       true,
+		},
+
+		// Alias with trailing slashes
+		{
+			image:    "ecr-cache.corp.com/repo:tag",
+			expected: ImageReference{Registry: registry, Repository: "repo", Tag: "tag"},
+			ok:       true,
+		},
+
+		// Alias must match whole path segments
+		{
+			image: "mirror.internal.evil.com/repo:tag",
+			ok:    false,
+		},
+
+		// Uppercase registry host
+		{
+			image:    "ID.DKR.ECR.REGION.AMAZONAWS.COM/repo:tag",
+			expected: ImageReference{Registry: registry, Repository: "repo", Tag: "tag"},
+			ok:       true,
+		},
+
+		// Official image resolved by the default registry
+		{
+			image:    "nginx:1.19",
+			expected: ImageReference{Registry: registry, Repository: "docker-hub/library/nginx", Tag: "1.19"},
+			ok:       true,
+		},
+
+		// Image resolved by the default registry
+		{
+			image:    "team/app:tag",
+			expected: ImageReference{Registry: registry, Repository: "docker-hub/team/app", Tag: "tag"},
+			ok:       true,
+		},
+
+		// Image in the default registry under another host
+		{
+			image:    "index.docker.io/team/app:tag",
+			expected: ImageReference{Registry: registry, Repository: "docker-hub/team/app", Tag: "tag"},
+			ok:       true,
+		},
+
+		// Image in a local registry
+		{
+			image: "localhost:5000/repo:tag",
+			ok:    false,
+		},
+
+		// Alias given with a scheme
+		{
+			image:    "https://ecr-cache.corp.com/repo:tag",
+			expected: ImageReference{Registry: registry, Repository: "repo", Tag: "tag"},
+			ok:       true,
+		},
+
+		// ECR image through a dual-stack endpoint
+		{
+			image:    "id.dkr-ecr.region.on.aws/repo:tag",
+			expected: ImageReference{Registry: registry, Repository: "repo", Tag: "tag"},
+			ok:       true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		actual, ok := ParseImageReference(testCase.image, registryAliases)
+
+		if ok != testCase.ok {
+			t.Errorf("Expected '%s' to be parsed: %t, but was %t", testCase.image, testCase.ok, ok)
+		}
+
+		if actual != testCase.expected {
+			t.Errorf("Expected '%s' to be parsed as %+v, but was %+v", testCase.image, testCase.expected, actual)
+		}
+	}
+}
+
+func TestParseImageReferenceWithoutDefaultRegistryAlias(t *testing.T) {
+	testCases := []string{
+		"nginx:1.19",
+		"library/nginx:1.19",
+		"team/app:tag",
+		"docker.io/team/app:tag",
+		"registry-1.docker.io/library/nginx:1.19",
+
+		// Looks like a repository in the default registry, not an ECR host
+		"id/repo:tag",
+	}
+
+	for _, image := range testCases {
+		if actual, ok := ParseImageReference(image, nil); ok {
+			t.Errorf("Expected '%s' not to be parsed, but was parsed as %+v", image, actual)
+		}
+	}
+}
+
+func TestNormalizeImageReference(t *testing.T) {
+	testCases := []struct {
+		image    string
+		expected string
+	}{
+		// Official image
+		{
+			image:    "nginx",
+			expected: "docker.io/library/nginx",
+		},
+		{
+			image:    "nginx:1.19",
+			expected: "docker.io/library/nginx:1.19",
+		},
+		{
+			image:    "nginx@sha256:abc",
+			expected: "docker.io/library/nginx@sha256:abc",
+		},
+
+		// Image within a namespace
+		{
+			image:    "team/app:tag",
+			expected: "docker.io/team/app:tag",
+		},
+		{
+			image:    "team/sub/app:tag",
+			expected: "docker.io/team/sub/app:tag",
+		},
+
+		// Default registry under any of its hosts
+		{
+			image:    "docker.io/nginx:1.19",
+			expected: "docker.io/library/nginx:1.19",
+		},
+		{
+			image:    "index.docker.io/team/app:tag",
+			expected: "docker.io/team/app:tag",
+		},
+		{
+			image:    "registry-1.docker.io/library/nginx:1.19",
+			expected: "docker.io/library/nginx:1.19",
+		},
+
+		// Other registries are left alone, except for the host case
+		{
+			image:    "id.dkr.ecr.region.amazonaws.com/repo:tag",
+			expected: "id.dkr.ecr.region.amazonaws.com/repo:tag",
+		},
+		{
+			image:    "ID.DKR.ECR.REGION.AMAZONAWS.COM/Repo:Tag",
+			expected: "id.dkr.ecr.region.amazonaws.com/Repo:Tag",
+		},
+		{
+			image:    "localhost/repo:tag",
+			expected: "localhost/repo:tag",
+		},
+
+		// Schemes are stripped
+		{
+			image:    "https://id.dkr.ecr.region.amazonaws.com/repo:tag",
+			expected: "id.dkr.ecr.region.amazonaws.com/repo:tag",
+		},
+		{
+			image:    " HTTP://mirror.internal/repo:tag",
+			expected: "mirror.internal/repo:tag",
+		},
+
+		// FIPS and dual-stack ECR hosts stand for the regular one
+		{
+			image:    "id.dkr.ecr-fips.us-east-1.amazonaws.com/repo:tag",
+			expected: "id.dkr.ecr.us-east-1.amazonaws.com/repo:tag",
+		},
+		{
+			image:    "id.dkr-ecr.us-east-1.on.aws/repo:tag",
+			expected: "id.dkr.ecr.us-east-1.amazonaws.com/repo:tag",
+		},
+		{
+			image:    "id.dkr-ecr-fips.cn-north-1.on.aws/repo:tag",
+			expected: "id.dkr.ecr.cn-north-1.amazonaws.com.cn/repo:tag",
+		},
+		{
+			image:    "registry:5000/repo:tag",
+			expected: "registry:5000/repo:tag",
+		},
+	}
+
+	for _, testCase := range testCases {
+		actual := NormalizeImageReference(testCase.image)
+
+		if actual != testCase.expected {
+			t.Errorf("Expected '%s' to be normalized to '%s', but was '%s'", testCase.image, testCase.expected, actual)
+		}
+	}
+}
+
+func TestECRRegistryHost(t *testing.T) {
+	testCases := []struct {
+		accountID string
+		region    string
+		expected  string
+	}{
+		{
+			accountID: "123456789012",
+			region:    "us-east-1",
+			expected:  "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+		},
+		{
+			accountID: "123456789012",
+			region:    "cn-north-1",
+			expected:  "123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn",
+		},
+	}
+
+	for _, testCase := range testCases {
+		actual := ECRRegistryHost(testCase.accountID, testCase.region)
+
+		if actual != testCase.expected {
+			t.Errorf("Expected registry host to be '%s', but was '%s'", testCase.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// RegistryReplication tells which repositories of an ECR registry are
+// managed by ECR itself, so that deleting their images causes churn
+// elsewhere.
+type RegistryReplication struct {
+	// Prefixes of the names of the repositories replicated to other regions
+	// or registries, as per the replication rules of the registry. An empty
+	// prefix matches all repositories.
+	ReplicatedPrefixes []string
+
+	// ECR repository prefixes of the pull-through cache rules of the
+	// registry, under which the cached repositories are created.
+	PullThroughCachePrefixes []string
+}
+
+// Reason returns why the repository with the given name is managed by ECR,
+// or an empty string if it is not.
+func (r *RegistryReplication) Reason(repositoryName string) string {
+	for _, prefix := range r.ReplicatedPrefixes {
+		if strings.HasPrefix(repositoryName, prefix) {
+			return "replicated to other regions or accounts"
+		}
+	}
+
+	for _, prefix := range r.PullThroughCachePrefixes {
+		if strings.HasPrefix(repositoryName, prefix+"/") {
+			return "a pull-through cache"
+		}
+	}
+
+	return ""
+}
+
+// RegistryReplicationClient defines the expected interface of any object
+// capable of describing the replication settings of ECR registries.
+type RegistryReplicationClient interface {
+	DescribeRegistryReplication(repositoryName *string) (*RegistryReplication, error)
+}
+
+// DescribeRegistryReplication returns the replication rules and pull-through
+// cache rules of the registry the repository with the given name lives in.
+func (c *ECRClientImpl) DescribeRegistryReplication(repositoryName *string) (*RegistryReplication, error) {
+	api := c.api(repositoryName)
+	replication := &RegistryReplication{
+		ReplicatedPrefixes:       []string{},
+		PullThroughCachePrefixes: []string{},
+	}
+
+	registry, err := api.DescribeRegistryWithContext(c.requestContext(), &ecr.DescribeRegistryInput{})
+	if err != nil {
+		return nil, err
+	}
+
+	if registry.ReplicationConfiguration != nil {
+		for _, rule := range registry.ReplicationConfiguration.Rules {
+			if len(rule.Destinations) == 0 {
+				continue
+			}
+
+			// Rules without filters replicate all the repositories
+			if len(rule.RepositoryFilters) == 0 {
+				replication.ReplicatedPrefixes = append(replication.ReplicatedPrefixes, "")
+			}
+			for _, filter := range rule.RepositoryFilters {
+				if aws.StringValue(filter.FilterType) == ecr.RepositoryFilterTypePrefixMatch {
+					replication.ReplicatedPrefixes = append(replication.ReplicatedPrefixes, aws.StringValue(filter.Filter))
+				}
+			}
+		}
+	}
+
+	err = api.DescribePullThroughCacheRulesPagesWithContext(c.requestContext(), &ecr.DescribePullThroughCacheRulesInput{}, func(page *ecr.DescribePullThroughCacheRulesOutput, lastPage bool) bool {
+		for _, rule := range page.PullThroughCacheRules {
+			replication.PullThroughCachePrefixes = append(replication.PullThroughCachePrefixes, aws.StringValue(rule.EcrRepositoryPrefix))
+		}
+		return !lastPage
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return replication, nil
+}
+
+// filterReplicatedRepositories leaves out the given repositories of the given
+// region that are replicated to other regions or accounts, or that are
+// pull-through caches, unless `AllowReplicatedRepositories` is set. Such
+// repositories are skipped with `SkipReplicatedRepositories`, and fail the
+// pass otherwise, along with the repositories whose registry settings cannot
+// be described when skipping them. The replication settings are described
+// once per registry.
+func (t *CleanupTask) filterReplicatedRepositories(region string, ecrClient ECRClient, repos []*ecr.Repository) ([]*ecr.Repository, []error) {
+	if t.AllowReplicatedRepositories {
+		return repos, nil
+	}
+
+	replicationClient, ok := ecrClient.(RegistryReplicationClient)
+	if !ok {
+		if t.SkipReplicatedRepositories {
+			return nil, []error{&RepositoryError{Region: region, Err: fmt.Errorf("ECR client cannot describe registry replication")}}
+		}
+		return repos, nil
+	}
+
+	registries := map[string]*RegistryReplication{}
+	registryErrors := map[string]error{}
+
+	filtered := []*ecr.Repository{}
+	errs := []error{}
+	for _, repo := range repos {
+		repoName := aws.StringValue(repo.RepositoryName)
+		registryID := aws.StringValue(repo.RegistryId)
+
+		replication, described := registries[registryID]
+		err, failed := registryErrors[registryID]
+		if !described && !failed {
+			replication, err = replicationClient.DescribeRegistryReplication(repo.RepositoryName)
+			if err != nil {
+				registryErrors[registryID] = err
+				failed = true
+
+				// Registries are only checked on a best-effort basis unless
+				// replicated repositories are skipped
+				if !t.SkipReplicatedRepositories {
+					t.log().Warningf("Cannot describe the replication of the registry of '%s' ECR repo in '%s' region, assuming it's not replicated: %v", repoName, region, err)
+				}
+			} else {
+				registries[registryID] = replication
+			}
+		}
+
+		if failed {
+			if t.SkipReplicatedRepositories {
+				errs = append(errs, &RepositoryError{
+					Region:     region,
+					Repository: repoName,
+					Message:    "Cannot describe registry replication",
+					Err:        err,
+				})
+			} else {
+				filtered = append(filtered, repo)
+			}
+			continue
+		}
+
+		reason := replication.Reason(repoName)
+		switch {
+		case reason == "":
+			filtered = append(filtered, repo)
+		case t.SkipReplicatedRepositories:
+			t.log().Infof("Skipping '%s' ECR repo, which is %s.", repoName, reason)
+		default:
+			errs = append(errs, &RepositoryError{
+				Region:     region,
+				Repository: repoName,
+				Err:        fmt.Errorf("Not cleaning up ECR repo, which is %s, unless replicated repos are allowed", reason),
+			})
+		}
+	}
+
+	return filtered, errs
+}
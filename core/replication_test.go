@@ -0,0 +1,175 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// mockReplicationECRClient describes the replication of the registries
+// named after the first letter of the repositories, and counts how many
+// times it is asked to.
+type mockReplicationECRClient struct {
+	ECRClient
+
+	registries    map[string]*RegistryReplication
+	outputError   error
+	describeCalls int
+}
+
+func (m *mockReplicationECRClient) DescribeRegistryReplication(repositoryName *string) (*RegistryReplication, error) {
+	m.describeCalls++
+
+	if m.outputError != nil {
+		return nil, m.outputError
+	}
+
+	return m.registries[aws.StringValue(repositoryName)[:1]], nil
+}
+
+func TestRegistryReplicationReason(t *testing.T) {
+	replication := &RegistryReplication{
+		ReplicatedPrefixes:       []string{"prod-"},
+		PullThroughCachePrefixes: []string{"docker-hub"},
+	}
+
+	testCases := []struct {
+		repositoryName string
+		expected       string
+	}{
+		{"prod-api", "replicated to other regions or accounts"},
+		{"docker-hub/library/nginx", "a pull-through cache"},
+		{"docker-hub-mirror", ""},
+		{"staging-api", ""},
+	}
+
+	for i, testCase := range testCases {
+		if reason := replication.Reason(testCase.repositoryName); reason != testCase.expected {
+			t.Errorf("Test case %d: expected reason %q, but got %q", i, testCase.expected, reason)
+		}
+	}
+
+	// Rules without filters replicate all the repositories
+	all := &RegistryReplication{ReplicatedPrefixes: []string{""}}
+	if reason := all.Reason("staging-api"); reason == "" {
+		t.Errorf("Expected all repos to be replicated")
+	}
+}
+
+func TestDescribeRegistryReplication(t *testing.T) {
+	mock := &mockAWSECRClient{
+		t: t,
+		describeRegistryOutput: &ecr.DescribeRegistryOutput{
+			RegistryId: aws.String("123456789012"),
+			ReplicationConfiguration: &ecr.ReplicationConfiguration{
+				Rules: []*ecr.ReplicationRule{
+					{
+						Destinations: []*ecr.ReplicationDestination{{Region: aws.String("eu-west-1")}},
+						RepositoryFilters: []*ecr.RepositoryFilter{
+							{Filter: aws.String("prod-"), FilterType: aws.String(ecr.RepositoryFilterTypePrefixMatch)},
+						},
+					},
+					// Rules without destinations replicate nothing
+					{},
+				},
+			},
+		},
+		pullThroughCacheRules: []*ecr.PullThroughCacheRule{
+			{EcrRepositoryPrefix: aws.String("docker-hub")},
+			{EcrRepositoryPrefix: aws.String("quay")},
+		},
+	}
+
+	client := &ECRClientImpl{ECRClient: mock}
+	replication, err := client.DescribeRegistryReplication(aws.String("prod-api"))
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	expected := &RegistryReplication{
+		ReplicatedPrefixes:       []string{"prod-"},
+		PullThroughCachePrefixes: []string{"docker-hub", "quay"},
+	}
+	if !reflect.DeepEqual(replication, expected) {
+		t.Errorf("Expected replication %+v, but got %+v", expected, replication)
+	}
+
+	mock.outputError = fmt.Errorf("AccessDeniedException")
+	if _, err := client.DescribeRegistryReplication(aws.String("prod-api")); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+}
+
+func TestFilterReplicatedRepositories(t *testing.T) {
+	repos := []*ecr.Repository{
+		{RepositoryName: aws.String("a-replicated"), RegistryId: aws.String("a")},
+		{RepositoryName: aws.String("a-local"), RegistryId: aws.String("a")},
+		{RepositoryName: aws.String("b-cache/nginx"), RegistryId: aws.String("b")},
+	}
+	registries := map[string]*RegistryReplication{
+		"a": {ReplicatedPrefixes: []string{"a-replicated"}},
+		"b": {PullThroughCachePrefixes: []string{"b-cache"}},
+	}
+
+	testCases := []struct {
+		task           *CleanupTask
+		outputError    error
+		expectedRepos  []string
+		expectedErrors int
+	}{
+		{
+			task:           &CleanupTask{},
+			expectedRepos:  []string{"a-local"},
+			expectedErrors: 2,
+		},
+		{
+			task:          &CleanupTask{SkipReplicatedRepositories: true},
+			expectedRepos: []string{"a-local"},
+		},
+		{
+			task:          &CleanupTask{AllowReplicatedRepositories: true},
+			expectedRepos: []string{"a-replicated", "a-local", "b-cache/nginx"},
+		},
+		{
+			task:          &CleanupTask{},
+			outputError:   fmt.Errorf("AccessDeniedException"),
+			expectedRepos: []string{"a-replicated", "a-local", "b-cache/nginx"},
+		},
+		{
+			task:           &CleanupTask{SkipReplicatedRepositories: true},
+			outputError:    fmt.Errorf("AccessDeniedException"),
+			expectedRepos:  []string{},
+			expectedErrors: 3,
+		},
+	}
+
+	for i, testCase := range testCases {
+		client := &mockReplicationECRClient{registries: registries, outputError: testCase.outputError}
+
+		filtered, errs := testCase.task.filterReplicatedRepositories("us-east-1", client, repos)
+
+		names := []string{}
+		for _, repo := range filtered {
+			names = append(names, aws.StringValue(repo.RepositoryName))
+		}
+		if !reflect.DeepEqual(names, testCase.expectedRepos) {
+			t.Errorf("Test case %d: expected repos %v, but got %v", i, testCase.expectedRepos, names)
+		}
+
+		if len(errs) != testCase.expectedErrors {
+			t.Errorf("Test case %d: expected %d errors, but got %v", i, testCase.expectedErrors, errs)
+		}
+
+		// Registries are described once per pass, if at all
+		expectedCalls := 2
+		if testCase.task.AllowReplicatedRepositories {
+			expectedCalls = 0
+		}
+		if client.describeCalls != expectedCalls {
+			t.Errorf("Test case %d: expected %d calls, but got %d", i, expectedCalls, client.describeCalls)
+		}
+	}
+}
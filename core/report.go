@@ -0,0 +1,174 @@
+package core
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Columns of the CSV report
+var csvReportHeader = []string{"repo", "digest", "tags", "pushed_at", "size_bytes", "action", "reconcile_id", "region"}
+
+// WriteCSVReport writes the images in the given plan to the given path as CSV,
+// one row per image. Tags are joined by commas within their column, and
+// missing push dates and sizes are left empty.
+func WriteCSVReport(path string, plan *Plan) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+
+	if err = writer.Write(csvReportHeader); err != nil {
+		return err
+	}
+
+	for _, image := range plan.Images {
+		pushedAt := ""
+		if image.PushedAt != nil {
+			pushedAt = image.PushedAt.UTC().Format(time.RFC3339)
+		}
+
+		sizeInBytes := ""
+		if image.SizeInBytes != nil {
+			sizeInBytes = strconv.FormatInt(*image.SizeInBytes, 10)
+		}
+
+		row := []string{image.Repository, image.Digest, strings.Join(image.Tags, ","), pushedAt, sizeInBytes, image.Action, plan.ReconcileID, image.Region}
+		if err = writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	if err = writer.Error(); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// Default price of the storage of ECR images, in USD per GB and month
+const DefaultStoragePricePerGBMonth = 0.10
+
+// Bytes per GB, as billed by AWS
+const bytesPerGB = 1 << 30
+
+// UsageReport summarizes how much storage the repositories processed in a
+// pass take up, and how much of it deleting the images selected for deletion
+// would reclaim, so that retention rules can be sized before being enforced.
+type UsageReport struct {
+	ReconcileID            string  `json:"reconcileId,omitempty"`
+	StoragePricePerGBMonth float64 `json:"storagePricePerGBMonth"`
+
+	// Repositories, the largest ones first, and their sum.
+	Repositories []RepositoryUsage `json:"repositories"`
+	Total        RepositoryUsage   `json:"total"`
+}
+
+// RepositoryUsage tells how much storage a repository takes up, and how much
+// of it would be reclaimed.
+type RepositoryUsage struct {
+	Region      string `json:"region,omitempty"`
+	Name        string `json:"name,omitempty"`
+	ImageCount  int    `json:"imageCount"`
+	SizeInBytes int64  `json:"sizeInBytes"`
+
+	// Images selected for deletion by the retention rules, and their size.
+	ImagesSelected int   `json:"imagesSelected"`
+	BytesSelected  int64 `json:"bytesSelected"`
+
+	// Estimated monthly cost of the storage of the selected images.
+	ReclaimablePerMonth float64 `json:"reclaimablePerMonth"`
+}
+
+// repositoryUsagesBySize sorts repository usages by decreasing size.
+type repositoryUsagesBySize []RepositoryUsage
+
+func (s repositoryUsagesBySize) Len() int           { return len(s) }
+func (s repositoryUsagesBySize) Less(i, j int) bool { return s[i].SizeInBytes > s[j].SizeInBytes }
+func (s repositoryUsagesBySize) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// NewUsageReport returns the usage report of the given plan, whose images
+// selected for deletion are priced at the given price per GB and month. ECR
+// only stores the layers shared by several images once, so the sizes are
+// upper bounds of what is billed.
+func NewUsageReport(plan *Plan, pricePerGBMonth float64) *UsageReport {
+	report := &UsageReport{
+		ReconcileID:            plan.ReconcileID,
+		StoragePricePerGBMonth: pricePerGBMonth,
+		Repositories:           []RepositoryUsage{},
+	}
+
+	indexes := map[string]int{}
+	for _, repo := range plan.Repositories {
+		indexes[repo.Region+"/"+repo.Name] = len(report.Repositories)
+		report.Repositories = append(report.Repositories, RepositoryUsage{
+			Region:      repo.Region,
+			Name:        repo.Name,
+			ImageCount:  repo.ImageCount,
+			SizeInBytes: repo.SizeInBytes,
+		})
+	}
+
+	for _, image := range plan.Images {
+		index, ok := indexes[image.Region+"/"+image.Repository]
+		if !ok {
+			continue
+		}
+
+		usage := &report.Repositories[index]
+		usage.ImagesSelected++
+		if image.SizeInBytes != nil {
+			usage.BytesSelected += *image.SizeInBytes
+		}
+	}
+
+	for i := range report.Repositories {
+		usage := &report.Repositories[i]
+		usage.ReclaimablePerMonth = float64(usage.BytesSelected) / bytesPerGB * pricePerGBMonth
+
+		report.Total.ImageCount += usage.ImageCount
+		report.Total.SizeInBytes += usage.SizeInBytes
+		report.Total.ImagesSelected += usage.ImagesSelected
+		report.Total.BytesSelected += usage.BytesSelected
+		report.Total.ReclaimablePerMonth += usage.ReclaimablePerMonth
+	}
+	sort.Stable(repositoryUsagesBySize(report.Repositories))
+
+	return report
+}
+
+// WriteTable writes the report to the given writer as a table, with a row per
+// repository followed by the total.
+func (r *UsageReport) WriteTable(w io.Writer) error {
+	writer := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	row := func(columns ...string) {
+		fmt.Fprintf(writer, "%s\n", strings.Join(columns, "\t"))
+	}
+	usageRow := func(repo string, usage RepositoryUsage) {
+		row(usage.Region, repo, strconv.Itoa(usage.ImageCount), formatGB(usage.SizeInBytes), strconv.Itoa(usage.ImagesSelected), formatGB(usage.BytesSelected), fmt.Sprintf("$%.2f", usage.ReclaimablePerMonth))
+	}
+
+	row("REGION", "REPO", "IMAGES", "SIZE", "SELECTED", "RECLAIMABLE", "PER MONTH")
+	for _, usage := range r.Repositories {
+		usageRow(usage.Name, usage)
+	}
+	usageRow("TOTAL", r.Total)
+
+	return writer.Flush()
+}
+
+// formatGB formats the given size in GB, as billed by AWS.
+func formatGB(bytes int64) string {
+	return fmt.Sprintf("%.2f GB", float64(bytes)/bytesPerGB)
+}
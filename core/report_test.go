@@ -0,0 +1,117 @@
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWriteCSVReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pushedAt, size := time.Unix(0, 0), int64(10)
+
+	path := filepath.Join(dir, "report.csv")
+	plan := &Plan{
+		ReconcileID: "reconcile-1",
+		Images: []PlanImage{
+			{Region: "us-east-1", Repository: "repo-1", Digest: "digest-1", Tags: []string{"tag-1", "tag-2"}, PushedAt: &pushedAt, SizeInBytes: &size, Action: PlanActionDeleted},
+			{Repository: "repo-1", Digest: "digest-2", Action: PlanActionWouldDelete},
+		},
+	}
+
+	if err = WriteCSVReport(path, plan); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "repo,digest,tags,pushed_at,size_bytes,action,reconcile_id,region\n" +
+		"repo-1,digest-1,\"tag-1,tag-2\",1970-01-01T00:00:00Z,10,deleted,reconcile-1,us-east-1\n" +
+		"repo-1,digest-2,,,,would-delete,reconcile-1,\n"
+
+	if string(data) != expected {
+		t.Errorf("Expected report to be %q, but was %q", expected, string(data))
+	}
+}
+
+func TestWriteCSVReportError(t *testing.T) {
+	if err := WriteCSVReport("/does/not/exist.csv", NewPlan()); err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+}
+
+func TestNewUsageReport(t *testing.T) {
+	gb := int64(bytesPerGB)
+	small, large := 2*gb, 10*gb
+
+	plan := &Plan{
+		ReconcileID: "reconcile-1",
+		Repositories: []PlanRepository{
+			{Region: "us-east-1", Name: "repo-1", ImageCount: 3, SizeInBytes: 4 * gb},
+			{Region: "us-east-1", Name: "repo-2", ImageCount: 5, SizeInBytes: 30 * gb},
+			{Region: "eu-west-1", Name: "repo-1", ImageCount: 1, SizeInBytes: gb},
+		},
+		Images: []PlanImage{
+			{Region: "us-east-1", Repository: "repo-1", Digest: "digest-1", SizeInBytes: &small, Action: PlanActionWouldDelete},
+			{Region: "us-east-1", Repository: "repo-2", Digest: "digest-2", SizeInBytes: &large, Action: PlanActionWouldDelete},
+			{Region: "us-east-1", Repository: "repo-2", Digest: "digest-3", Action: PlanActionWouldDelete},
+		},
+	}
+
+	report := NewUsageReport(plan, 0.5)
+
+	if report.ReconcileID != "reconcile-1" || report.StoragePricePerGBMonth != 0.5 {
+		t.Errorf("Expected reconcile ID and price to be copied, but got %q and %v", report.ReconcileID, report.StoragePricePerGBMonth)
+	}
+
+	// Largest repositories first
+	expected := []RepositoryUsage{
+		{Region: "us-east-1", Name: "repo-2", ImageCount: 5, SizeInBytes: 30 * gb, ImagesSelected: 2, BytesSelected: 10 * gb, ReclaimablePerMonth: 5},
+		{Region: "us-east-1", Name: "repo-1", ImageCount: 3, SizeInBytes: 4 * gb, ImagesSelected: 1, BytesSelected: 2 * gb, ReclaimablePerMonth: 1},
+		{Region: "eu-west-1", Name: "repo-1", ImageCount: 1, SizeInBytes: gb},
+	}
+	if !reflect.DeepEqual(report.Repositories, expected) {
+		t.Errorf("Expected repositories to be %+v, but were %+v", expected, report.Repositories)
+	}
+
+	expectedTotal := RepositoryUsage{ImageCount: 9, SizeInBytes: 35 * gb, ImagesSelected: 3, BytesSelected: 12 * gb, ReclaimablePerMonth: 6}
+	if report.Total != expectedTotal {
+		t.Errorf("Expected total to be %+v, but was %+v", expectedTotal, report.Total)
+	}
+}
+
+func TestUsageReportWriteTable(t *testing.T) {
+	gb := int64(bytesPerGB)
+
+	report := &UsageReport{
+		Repositories: []RepositoryUsage{
+			{Region: "us-east-1", Name: "repo-1", ImageCount: 12, SizeInBytes: 3 * gb, ImagesSelected: 2, BytesSelected: gb / 2, ReclaimablePerMonth: 0.05},
+		},
+		Total: RepositoryUsage{ImageCount: 12, SizeInBytes: 3 * gb, ImagesSelected: 2, BytesSelected: gb / 2, ReclaimablePerMonth: 0.05},
+	}
+
+	var buffer bytes.Buffer
+	if err := report.WriteTable(&buffer); err != nil {
+		t.Fatalf("Expected error to be nil, but was %v", err)
+	}
+
+	expected := "REGION     REPO    IMAGES  SIZE     SELECTED  RECLAIMABLE  PER MONTH\n" +
+		"us-east-1  repo-1  12      3.00 GB  2         0.50 GB      $0.05\n" +
+		"           TOTAL   12      3.00 GB  2         0.50 GB      $0.05\n"
+
+	if buffer.String() != expected {
+		t.Errorf("Expected table to be %q, but was %q", expected, buffer.String())
+	}
+}
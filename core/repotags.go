@@ -0,0 +1,103 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// AWS resource tags of ECR repositories that override the retention rules of
+// the repositories they are set on, with `UseRepositoryTags`.
+const (
+	// Number of images to keep, overriding `MaxImages`.
+	RepositoryTagKeep = "cleanup.keep"
+
+	// Maximum age of the images, e.g. "14d", overriding `MaxImageAge`.
+	RepositoryTagMaxAge = "cleanup.max-age"
+
+	// Whether the repository is cleaned up at all; "false" skips it.
+	RepositoryTagEnabled = "cleanup.enabled"
+)
+
+// RepositoryTagsClient defines the expected interface of any object capable
+// of listing the AWS resource tags of ECR repositories.
+type RepositoryTagsClient interface {
+	ListRepositoryTags(repo *ecr.Repository) (map[string]string, error)
+}
+
+// ListRepositoryTags returns the AWS resource tags of the given repository,
+// by key.
+func (c *ECRClientImpl) ListRepositoryTags(repo *ecr.Repository) (map[string]string, error) {
+	if repo.RepositoryArn == nil {
+		return nil, fmt.Errorf("Unknown ARN of '%s' ECR repo", aws.StringValue(repo.RepositoryName))
+	}
+
+	output, err := c.api(repo.RepositoryName).ListTagsForResourceWithContext(c.requestContext(), &ecr.ListTagsForResourceInput{
+		ResourceArn: repo.RepositoryArn,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tags := map[string]string{}
+	for _, tag := range output.Tags {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+
+	return tags, nil
+}
+
+// listRepositoryTags returns the AWS resource tags of the given repository
+// through the given client, which must be a RepositoryTagsClient.
+func listRepositoryTags(ecrClient ECRClient, repo *ecr.Repository) (map[string]string, error) {
+	tagsClient, ok := ecrClient.(RepositoryTagsClient)
+	if !ok {
+		return nil, fmt.Errorf("ECR client cannot list repository tags")
+	}
+
+	tags, err := tagsClient.ListRepositoryTags(repo)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list repository tags: %v", err)
+	}
+
+	return tags, nil
+}
+
+// disabledByRepositoryTags tells whether the given repository tags opt the
+// repository out of the clean-up. Invalid values are reported by
+// `rulesFromRepositoryTags`.
+func disabledByRepositoryTags(tags map[string]string) bool {
+	enabled, err := strconv.ParseBool(tags[RepositoryTagEnabled])
+	return err == nil && !enabled
+}
+
+// rulesFromRepositoryTags applies the overrides given by the given
+// repository tags to the given rules. An error is returned if any of the tags
+// is invalid.
+func rulesFromRepositoryTags(tags map[string]string, rules repositoryRules) (repositoryRules, error) {
+	if value, ok := tags[RepositoryTagEnabled]; ok {
+		if _, err := strconv.ParseBool(value); err != nil {
+			return rules, fmt.Errorf("Invalid '%s' tag '%s', must be either 'true' or 'false'", RepositoryTagEnabled, value)
+		}
+	}
+
+	if value, ok := tags[RepositoryTagKeep]; ok {
+		keep, err := strconv.Atoi(value)
+		if err != nil || keep < 0 {
+			return rules, fmt.Errorf("Invalid '%s' tag '%s', must be a non-negative number", RepositoryTagKeep, value)
+		}
+		rules.maxImages = keep
+	}
+
+	if value, ok := tags[RepositoryTagMaxAge]; ok {
+		maxAge, err := ParseDuration(value)
+		if err != nil || maxAge < 0 {
+			return rules, fmt.Errorf("Invalid '%s' tag '%s', must be a duration such as 14d or 336h", RepositoryTagMaxAge, value)
+		}
+		rules.maxImageAge = maxAge
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,134 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+func TestRulesFromRepositoryTags(t *testing.T) {
+	defaults := repositoryRules{maxImages: 10, maxImageAge: 720 * time.Hour}
+
+	testCases := []struct {
+		tags     map[string]string
+		expected repositoryRules
+		err      bool
+	}{
+		{
+			tags:     map[string]string{},
+			expected: defaults,
+		},
+		{
+			tags:     map[string]string{"team": "a", RepositoryTagEnabled: "true"},
+			expected: defaults,
+		},
+		{
+			tags:     map[string]string{RepositoryTagKeep: "20"},
+			expected: repositoryRules{maxImages: 20, maxImageAge: 720 * time.Hour},
+		},
+		{
+			tags:     map[string]string{RepositoryTagKeep: "0", RepositoryTagMaxAge: "14d"},
+			expected: repositoryRules{maxImages: 0, maxImageAge: 336 * time.Hour},
+		},
+		{
+			tags:     map[string]string{RepositoryTagMaxAge: "36h"},
+			expected: repositoryRules{maxImages: 10, maxImageAge: 36 * time.Hour},
+		},
+		{
+			tags: map[string]string{RepositoryTagKeep: "-1"},
+			err:  true,
+		},
+		{
+			tags: map[string]string{RepositoryTagKeep: "many"},
+			err:  true,
+		},
+		{
+			tags: map[string]string{RepositoryTagMaxAge: "two weeks"},
+			err:  true,
+		},
+		{
+			tags: map[string]string{RepositoryTagEnabled: "no"},
+			err:  true,
+		},
+	}
+
+	for i, testCase := range testCases {
+		rules, err := rulesFromRepositoryTags(testCase.tags, defaults)
+
+		if testCase.err {
+			if err == nil {
+				t.Errorf("Test case %d: expected an error, but got rules %+v", i, rules)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Test case %d: expected no error, but got %v", i, err)
+		} else if rules != testCase.expected {
+			t.Errorf("Test case %d: expected rules %+v, but got %+v", i, testCase.expected, rules)
+		}
+	}
+}
+
+func TestDisabledByRepositoryTags(t *testing.T) {
+	testCases := []struct {
+		tags     map[string]string
+		expected bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{RepositoryTagEnabled: "true"}, false},
+		{map[string]string{RepositoryTagEnabled: "false"}, true},
+		{map[string]string{RepositoryTagEnabled: "FALSE"}, true},
+
+		// Invalid values are reported as errors rather than skipping the repo
+		{map[string]string{RepositoryTagEnabled: "off"}, false},
+	}
+
+	for i, testCase := range testCases {
+		if disabled := disabledByRepositoryTags(testCase.tags); disabled != testCase.expected {
+			t.Errorf("Test case %d: expected %v for tags %v, but got %v", i, testCase.expected, testCase.tags, disabled)
+		}
+	}
+}
+
+func TestListRepositoryTags(t *testing.T) {
+	awsClient := &mockAWSECRClient{
+		t: t,
+		listTagsForResourceOutput: &ecr.ListTagsForResourceOutput{
+			Tags: []*ecr.Tag{
+				{Key: aws.String(RepositoryTagKeep), Value: aws.String("20")},
+				{Key: aws.String("team"), Value: aws.String("a")},
+			},
+		},
+	}
+	client := &ECRClientImpl{ECRClient: awsClient}
+
+	repo := &ecr.Repository{
+		RepositoryName: aws.String("repo"),
+		RepositoryArn:  aws.String("arn:aws:ecr:us-east-1:123456789012:repository/repo"),
+	}
+
+	tags, err := client.ListRepositoryTags(repo)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	expected := map[string]string{RepositoryTagKeep: "20", "team": "a"}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Errorf("Expected tags %v, but got %v", expected, tags)
+	}
+
+	// Repositories without ARNs cannot be looked up
+	if _, err := client.ListRepositoryTags(&ecr.Repository{RepositoryName: aws.String("repo")}); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+
+	awsClient.outputError = fmt.Errorf("AccessDeniedException")
+	if _, err := listRepositoryTags(client, repo); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+}
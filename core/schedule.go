@@ -0,0 +1,207 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Upper bound of the search for the next time matching a cron schedule, so
+// that schedules never matching, such as `0 0 30 2 *`, are told apart
+const cronMaxSearch = 5 * 366 * 24 * time.Hour
+
+// Shorthands accepted in place of cron expressions
+var cronDescriptors = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// cronField describes one of the fields of a cron expression.
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// CronSchedule gives the times clean-up passes run at, as per a standard
+// 5-field cron expression: minute, hour, day of month, month and day of week,
+// in the local time of the controller.
+type CronSchedule struct {
+	spec string
+
+	minutes, hours, daysOfMonth, months, daysOfWeek map[int]bool
+
+	// Whether the day of month and day of week fields are restricted, since
+	// days matching either of them match when both are, as in cron
+	daysOfMonthSet, daysOfWeekSet bool
+}
+
+// ParseCronSchedule parses the given cron expression, such as `30 2 * * 1-5`
+// to run at 02:30 on weekdays. Fields are made of comma-separated values,
+// ranges (`1-5`), wildcards (`*`) and steps (`*/15` or `0-30/10`). Sunday is
+// either 0 or 7 in the day of week field. Shorthands such as `@daily` are
+// accepted as well.
+func ParseCronSchedule(spec string) (*CronSchedule, error) {
+	expression := strings.TrimSpace(spec)
+	if descriptor, ok := cronDescriptors[expression]; ok {
+		expression = descriptor
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("Expected %d fields, but got %d", len(cronFields), len(fields))
+	}
+
+	values := make([]map[int]bool, len(fields))
+	for i, field := range fields {
+		parsed, err := parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, err
+		}
+		values[i] = parsed
+	}
+
+	// Sunday is both 0 and 7
+	if values[4][7] {
+		values[4][0] = true
+	}
+
+	schedule := &CronSchedule{
+		spec:           spec,
+		minutes:        values[0],
+		hours:          values[1],
+		daysOfMonth:    values[2],
+		months:         values[3],
+		daysOfWeek:     values[4],
+		daysOfMonthSet: !strings.HasPrefix(fields[2], "*"),
+		daysOfWeekSet:  !strings.HasPrefix(fields[4], "*"),
+	}
+
+	if schedule.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("Schedule never matches any time")
+	}
+
+	return schedule, nil
+}
+
+// parseCronField returns the values matched by the given field of a cron
+// expression.
+func parseCronField(field string, spec cronField) (map[int]bool, error) {
+	values := map[int]bool{}
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if index := strings.Index(part, "/"); index >= 0 {
+			var err error
+			rangePart = part[:index]
+			if step, err = strconv.Atoi(part[index+1:]); err != nil || step < 1 {
+				return nil, fmt.Errorf("Invalid step in %s field '%s'", spec.name, field)
+			}
+		}
+
+		start, end := spec.min, spec.max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+
+			var err error
+			if start, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("Invalid %s field '%s'", spec.name, field)
+			}
+			end = start
+
+			if len(bounds) == 2 {
+				if end, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("Invalid %s field '%s'", spec.name, field)
+				}
+			} else if step > 1 {
+				// As in cron, `5/15` stands for `5-<max>/15`
+				end = spec.max
+			}
+		}
+
+		if start < spec.min || end > spec.max || start > end {
+			return nil, fmt.Errorf("Invalid %s field '%s', values must be between %d and %d", spec.name, field, spec.min, spec.max)
+		}
+
+		for value := start; value <= end; value += step {
+			values[value] = true
+		}
+	}
+
+	return values, nil
+}
+
+// String returns the cron expression of the schedule.
+func (s *CronSchedule) String() string {
+	return s.spec
+}
+
+// Next returns the first time matching the schedule strictly after the given
+// time, truncated to the minute, or the zero time if none matches within
+// `cronMaxSearch`.
+func (s *CronSchedule) Next(after time.Time) time.Time {
+	next := after.Truncate(time.Minute).Add(time.Minute)
+	limit := after.Add(cronMaxSearch)
+
+	for next.Before(limit) {
+		if !s.months[int(next.Month())] {
+			next = time.Date(next.Year(), next.Month()+1, 1, 0, 0, 0, 0, next.Location())
+			continue
+		}
+
+		if !s.matchesDay(next) {
+			next = time.Date(next.Year(), next.Month(), next.Day()+1, 0, 0, 0, 0, next.Location())
+			continue
+		}
+
+		if !s.hours[next.Hour()] {
+			next = time.Date(next.Year(), next.Month(), next.Day(), next.Hour()+1, 0, 0, 0, next.Location())
+			continue
+		}
+
+		if !s.minutes[next.Minute()] {
+			next = next.Add(time.Minute)
+			continue
+		}
+
+		return next
+	}
+
+	return time.Time{}
+}
+
+// nextPassTime returns the time of the next clean-up pass after the given
+// time, as given by `Schedule`, or `Interval` minutes later otherwise, delayed
+// by up to `ScheduleJitter`.
+func (t *CleanupTask) nextPassTime(now time.Time) time.Time {
+	next := now.Add(time.Duration(t.Interval) * time.Minute)
+	if t.Schedule != nil {
+		next = t.Schedule.Next(now)
+	}
+
+	return next.Add(RandomDuration(t.ScheduleJitter))
+}
+
+// matchesDay tells whether the day of the given time matches the schedule.
+func (s *CronSchedule) matchesDay(t time.Time) bool {
+	dayOfMonth := s.daysOfMonth[t.Day()]
+	dayOfWeek := s.daysOfWeek[int(t.Weekday())]
+
+	if s.daysOfMonthSet && s.daysOfWeekSet {
+		return dayOfMonth || dayOfWeek
+	}
+	return dayOfMonth && dayOfWeek
+}
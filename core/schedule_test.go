@@ -0,0 +1,92 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronSchedule(t *testing.T) {
+	testCases := []struct {
+		spec string
+		ok   bool
+	}{
+		{spec: "*/15 * * * *", ok: true},
+		{spec: "30 2 * * 1-5", ok: true},
+		{spec: "0 0,12 1 */2 7", ok: true},
+		{spec: "@daily", ok: true},
+		{spec: "* * * *"},
+		{spec: "60 * * * *"},
+		{spec: "0 5-2 * * *"},
+		{spec: "*/0 * * * *"},
+		{spec: "a * * * *"},
+		{spec: "@fortnightly"},
+
+		// Valid fields, but no such day
+		{spec: "0 0 30 2 *"},
+	}
+
+	for i, testCase := range testCases {
+		if _, err := ParseCronSchedule(testCase.spec); (err == nil) != testCase.ok {
+			t.Errorf("Test case %d: expected parsing '%s' to succeed to be %t, but got error %v", i, testCase.spec, testCase.ok, err)
+		}
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	// A Wednesday
+	after := time.Date(2017, time.March, 15, 10, 7, 30, 0, time.UTC)
+
+	testCases := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{spec: "*/15 * * * *", expected: time.Date(2017, time.March, 15, 10, 15, 0, 0, time.UTC)},
+		{spec: "30 2 * * 1-5", expected: time.Date(2017, time.March, 16, 2, 30, 0, 0, time.UTC)},
+		{spec: "0 0 * * 0", expected: time.Date(2017, time.March, 19, 0, 0, 0, 0, time.UTC)},
+		{spec: "0 0 * * 7", expected: time.Date(2017, time.March, 19, 0, 0, 0, 0, time.UTC)},
+		{spec: "@monthly", expected: time.Date(2017, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{spec: "5/20 10 * * *", expected: time.Date(2017, time.March, 15, 10, 25, 0, 0, time.UTC)},
+
+		// Days matching either the day of month or the day of week match
+		// when both are restricted
+		{spec: "0 0 1 * 5", expected: time.Date(2017, time.March, 17, 0, 0, 0, 0, time.UTC)},
+		{spec: "0 0 1 * *", expected: time.Date(2017, time.April, 1, 0, 0, 0, 0, time.UTC)},
+
+		// Times are strictly after the given one
+		{spec: "7 10 15 3 *", expected: time.Date(2018, time.March, 15, 10, 7, 0, 0, time.UTC)},
+	}
+
+	for i, testCase := range testCases {
+		schedule, err := ParseCronSchedule(testCase.spec)
+		if err != nil {
+			t.Fatalf("Test case %d: expected no error, but got %v", i, err)
+		}
+
+		if actual := schedule.Next(after); !actual.Equal(testCase.expected) {
+			t.Errorf("Test case %d: expected next time of '%s' to be %v, but was %v", i, testCase.spec, testCase.expected, actual)
+		}
+	}
+}
+
+func TestNextPassTime(t *testing.T) {
+	now := time.Date(2017, time.March, 15, 10, 7, 30, 0, time.UTC)
+	schedule, _ := ParseCronSchedule("0 3 * * *")
+
+	testCases := []struct {
+		task     *CleanupTask
+		min, max time.Time
+	}{
+		{task: &CleanupTask{Interval: 30}, min: now.Add(30 * time.Minute), max: now.Add(30 * time.Minute)},
+		{task: &CleanupTask{Interval: 30, ScheduleJitter: time.Minute}, min: now.Add(30 * time.Minute), max: now.Add(31 * time.Minute)},
+		{task: &CleanupTask{Interval: 30, Schedule: schedule, ScheduleJitter: time.Hour}, min: time.Date(2017, time.March, 16, 3, 0, 0, 0, time.UTC), max: time.Date(2017, time.March, 16, 4, 0, 0, 0, time.UTC)},
+	}
+
+	for i, testCase := range testCases {
+		for j := 0; j < 10; j++ {
+			actual := testCase.task.nextPassTime(now)
+			if actual.Before(testCase.min) || actual.After(testCase.max) {
+				t.Errorf("Test case %d: expected next pass between %v and %v, but was %v", i, testCase.min, testCase.max, actual)
+			}
+		}
+	}
+}
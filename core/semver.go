@@ -0,0 +1,93 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// Version lines that `MaxImages` can be applied to with `SemverRetention`.
+const (
+	SemverRetentionMajor = "major"
+	SemverRetentionMinor = "minor"
+)
+
+// semverTagRegex matches the tags that are semantic versions, optionally
+// prefixed with `v`, such as `v1.2.3` or `1.2.3-rc.1+build.5`.
+var semverTagRegex = regexp.MustCompile(`^v?(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+// SemverTag is a tag that is a semantic version.
+type SemverTag struct {
+	Major, Minor, Patch int
+	PreRelease          string
+}
+
+// ParseSemverTag parses the given tag as a semantic version. The second
+// return value is false if the tag is not one.
+func ParseSemverTag(tag string) (SemverTag, bool) {
+	matches := semverTagRegex.FindStringSubmatch(tag)
+	if matches == nil {
+		return SemverTag{}, false
+	}
+
+	version := SemverTag{PreRelease: matches[4]}
+	for i, part := range []*int{&version.Major, &version.Minor, &version.Patch} {
+		number, err := strconv.Atoi(matches[i+1])
+		if err != nil {
+			return SemverTag{}, false
+		}
+		*part = number
+	}
+
+	return version, true
+}
+
+// Less tells whether this version comes before the given one, pre-releases
+// coming before the release of the same version. Pre-releases of the same
+// version are compared as strings.
+func (v SemverTag) Less(other SemverTag) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	}
+	if v.Minor != other.Minor {
+		return v.Minor < other.Minor
+	}
+	if v.Patch != other.Patch {
+		return v.Patch < other.Patch
+	}
+
+	if v.PreRelease == "" || other.PreRelease == "" {
+		return v.PreRelease != "" && other.PreRelease == ""
+	}
+	return v.PreRelease < other.PreRelease
+}
+
+// Line returns the version line this version belongs to for the given
+// retention, such as `v1` for `SemverRetentionMajor` or `v1.2` for
+// `SemverRetentionMinor`.
+func (v SemverTag) Line(retention string) string {
+	if retention == SemverRetentionMinor {
+		return fmt.Sprintf("v%d.%d", v.Major, v.Minor)
+	}
+	return fmt.Sprintf("v%d", v.Major)
+}
+
+// SemverLine returns the version line the given image belongs to for the
+// given retention, according to the highest of its tags that are semantic
+// versions, or an empty string if none of them are.
+func SemverLine(image *ecr.ImageDetail, retention string) string {
+	var highest *SemverTag
+	for _, tag := range image.ImageTags {
+		version, ok := ParseSemverTag(*tag)
+		if ok && (highest == nil || highest.Less(version)) {
+			highest = &version
+		}
+	}
+
+	if highest == nil {
+		return ""
+	}
+	return highest.Line(retention)
+}
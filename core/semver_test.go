@@ -0,0 +1,71 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+func TestParseSemverTag(t *testing.T) {
+	testCases := []struct {
+		tag      string
+		expected SemverTag
+		ok       bool
+	}{
+		{tag: "1.2.3", expected: SemverTag{Major: 1, Minor: 2, Patch: 3}, ok: true},
+		{tag: "v10.0.1", expected: SemverTag{Major: 10, Minor: 0, Patch: 1}, ok: true},
+		{tag: "v1.2.3-rc.1+build.5", expected: SemverTag{Major: 1, Minor: 2, Patch: 3, PreRelease: "rc.1"}, ok: true},
+		{tag: "1.2", ok: false},
+		{tag: "01.2.3", ok: false},
+		{tag: "latest", ok: false},
+		{tag: "main-1.2.3", ok: false},
+	}
+
+	for _, testCase := range testCases {
+		version, ok := ParseSemverTag(testCase.tag)
+
+		if ok != testCase.ok || version != testCase.expected {
+			t.Errorf("Expected '%s' to be parsed as %+v (%t), but got %+v (%t)", testCase.tag, testCase.expected, testCase.ok, version, ok)
+		}
+	}
+}
+
+func TestSemverTagLess(t *testing.T) {
+	ordered := []string{"v1.0.0-alpha", "v1.0.0-beta", "v1.0.0", "v1.0.1", "v1.2.0", "v2.0.0"}
+
+	for i := 0; i < len(ordered)-1; i++ {
+		lower, _ := ParseSemverTag(ordered[i])
+		higher, _ := ParseSemverTag(ordered[i+1])
+
+		if !lower.Less(higher) || higher.Less(lower) {
+			t.Errorf("Expected '%s' to come before '%s'", ordered[i], ordered[i+1])
+		}
+	}
+}
+
+func TestSemverLine(t *testing.T) {
+	tags := []string{"1.2.3", "v2.0.0-rc.1", "latest"}
+
+	testCases := []struct {
+		tags      []*string
+		retention string
+		expected  string
+	}{
+		{tags: []*string{&tags[0]}, retention: SemverRetentionMajor, expected: "v1"},
+		{tags: []*string{&tags[0]}, retention: SemverRetentionMinor, expected: "v1.2"},
+
+		// The highest version wins
+		{tags: []*string{&tags[0], &tags[1], &tags[2]}, retention: SemverRetentionMinor, expected: "v2.0"},
+
+		{tags: []*string{&tags[2]}, retention: SemverRetentionMajor, expected: ""},
+		{tags: []*string{}, retention: SemverRetentionMajor, expected: ""},
+	}
+
+	for i, testCase := range testCases {
+		line := SemverLine(&ecr.ImageDetail{ImageTags: testCase.tags}, testCase.retention)
+
+		if line != testCase.expected {
+			t.Errorf("Test case %d: expected version line to be '%s', but was '%s'", i, testCase.expected, line)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// StatusConfigMapKey is the data key of the status ConfigMap holding the
+// `Status` of the last pass as JSON.
+const StatusConfigMapKey = "status.json"
+
+// Maximum number of errors recorded in the status, so that passes failing
+// in every repository don't outgrow the size limit of ConfigMaps
+const statusMaxErrors = 100
+
+// StatusClient defines the expected interface of any object capable of
+// reading and writing the ConfigMap the status of the passes is recorded in.
+type StatusClient interface {
+	GetConfigMap(namespace, name string) (*v1.ConfigMap, error)
+	CreateConfigMap(configMap *v1.ConfigMap) (*v1.ConfigMap, error)
+	UpdateConfigMap(configMap *v1.ConfigMap) (*v1.ConfigMap, error)
+}
+
+// Status summarizes the last clean-up pass, for other tools and dashboards
+// to consume.
+type Status struct {
+	ReconcileID string    `json:"reconcileId"`
+	LastRunTime time.Time `json:"lastRunTime"`
+
+	// Last time a pass succeeded, which is kept from the previous status
+	// when the pass failed.
+	LastSuccessTime *time.Time `json:"lastSuccessTime,omitempty"`
+
+	Succeeded             bool  `json:"succeeded"`
+	DryRun                bool  `json:"dryRun"`
+	RepositoriesProcessed int   `json:"repositoriesProcessed"`
+	ImagesSelected        int   `json:"imagesSelected"`
+	ImagesDeleted         int   `json:"imagesDeleted"`
+	BytesDeleted          int64 `json:"bytesDeleted"`
+
+	// Repositories images were selected for deletion from, in the order they
+	// were processed.
+	Repositories []RepositoryStatus `json:"repositories"`
+
+	// Number of errors found in the pass, of which up to `statusMaxErrors`
+	// are listed in `Errors`.
+	ErrorCount int      `json:"errorCount"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// RepositoryStatus tells how many images were selected for deletion from a
+// repository in the last pass, and how many of them were actually deleted.
+type RepositoryStatus struct {
+	Region         string `json:"region,omitempty"`
+	Name           string `json:"name"`
+	ImagesSelected int    `json:"imagesSelected"`
+	ImagesDeleted  int    `json:"imagesDeleted"`
+}
+
+// NewStatus returns the status of the given pass, run at the given time, as
+// per the plan of the pass. The time of the last successful pass is taken
+// from the given previous status, if any, when the pass failed.
+func NewStatus(result *ReconcileResult, now time.Time, dryRun bool, previous *Status) *Status {
+	status := &Status{
+		ReconcileID:           result.ReconcileID,
+		LastRunTime:           now,
+		Succeeded:             !result.Failed(),
+		DryRun:                dryRun,
+		RepositoriesProcessed: result.RepositoriesProcessed,
+		ImagesSelected:        result.ImagesSelected,
+		ImagesDeleted:         result.ImagesDeleted,
+		BytesDeleted:          result.BytesDeleted,
+		Repositories:          []RepositoryStatus{},
+		ErrorCount:            len(result.Errors),
+	}
+
+	if status.Succeeded {
+		status.LastSuccessTime = &now
+	} else if previous != nil {
+		status.LastSuccessTime = previous.LastSuccessTime
+	}
+
+	if result.Plan != nil {
+		indexes := map[string]int{}
+		for _, image := range result.Plan.Images {
+			key := image.Region + "/" + image.Repository
+			index, ok := indexes[key]
+			if !ok {
+				index = len(status.Repositories)
+				indexes[key] = index
+				status.Repositories = append(status.Repositories, RepositoryStatus{Region: image.Region, Name: image.Repository})
+			}
+
+			status.Repositories[index].ImagesSelected++
+			if image.Action == PlanActionDeleted {
+				status.Repositories[index].ImagesDeleted++
+			}
+		}
+	}
+
+	for i, err := range result.Errors {
+		if i == statusMaxErrors {
+			break
+		}
+		status.Errors = append(status.Errors, err.Error())
+	}
+
+	return status
+}
+
+// statusFromConfigMap returns the status recorded in the given ConfigMap, or
+// nil if there's none.
+func statusFromConfigMap(configMap *v1.ConfigMap) (*Status, error) {
+	if configMap == nil || configMap.Data[StatusConfigMapKey] == "" {
+		return nil, nil
+	}
+
+	status := &Status{}
+	if err := json.Unmarshal([]byte(configMap.Data[StatusConfigMapKey]), status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// WriteStatus records the status of the given pass, run at the given time,
+// in the `StatusConfigMap` ConfigMap of `ControllerNamespace`, creating it if
+// needed.
+func (t *CleanupTask) WriteStatus(result *ReconcileResult, now time.Time) error {
+	configMap, err := t.StatusClient.GetConfigMap(t.ControllerNamespace, t.StatusConfigMap)
+	if err != nil {
+		return fmt.Errorf("Cannot get status ConfigMap '%s/%s': %v", t.ControllerNamespace, t.StatusConfigMap, err)
+	}
+
+	// A status that cannot be parsed is only missing its last success time
+	previous, err := statusFromConfigMap(configMap)
+	if err != nil {
+		t.log().Warningf("Cannot parse status of ConfigMap '%s/%s', replacing it: %v", t.ControllerNamespace, t.StatusConfigMap, err)
+	}
+
+	data, err := json.Marshal(NewStatus(result, now, t.DryRun, previous))
+	if err != nil {
+		return fmt.Errorf("Cannot encode status: %v", err)
+	}
+
+	if configMap == nil {
+		configMap = &v1.ConfigMap{
+			ObjectMeta: v1.ObjectMeta{
+				Namespace: t.ControllerNamespace,
+				Name:      t.StatusConfigMap,
+			},
+			Data: map[string]string{StatusConfigMapKey: string(data)},
+		}
+
+		if _, err := t.StatusClient.CreateConfigMap(configMap); err != nil {
+			return fmt.Errorf("Cannot create status ConfigMap '%s/%s': %v", t.ControllerNamespace, t.StatusConfigMap, err)
+		}
+		return nil
+	}
+
+	if configMap.Data == nil {
+		configMap.Data = map[string]string{}
+	}
+	configMap.Data[StatusConfigMapKey] = string(data)
+
+	if _, err := t.StatusClient.UpdateConfigMap(configMap); err != nil {
+		return fmt.Errorf("Cannot update status ConfigMap '%s/%s': %v", t.ControllerNamespace, t.StatusConfigMap, err)
+	}
+	return nil
+}
+
+// reportStatus records the status of the given pass, if `StatusConfigMap` is
+// set. Passes that were skipped are left out, and failing to record the
+// status is only logged.
+func (t *CleanupTask) reportStatus(result *ReconcileResult) {
+	if t.StatusConfigMap == "" || t.StatusClient == nil || result.Skipped {
+		return
+	}
+
+	if err := t.WriteStatus(result, time.Now()); err != nil {
+		WithField(t.baseLog(), ReconcileIDField, result.ReconcileID).Errorf("Cannot record status: %v", err)
+	}
+}
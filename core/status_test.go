@@ -0,0 +1,98 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewStatus(t *testing.T) {
+	plan := NewPlan()
+	plan.Images = []PlanImage{
+		{Region: "us-east-1", Repository: "repo-1", Digest: "digest-1", Action: PlanActionDeleted},
+		{Region: "us-east-1", Repository: "repo-1", Digest: "digest-2", Action: PlanActionRetained},
+		{Region: "us-east-1", Repository: "repo-2", Digest: "digest-3", Action: PlanActionDeleted},
+		{Region: "us-west-2", Repository: "repo-1", Digest: "digest-4", Action: PlanActionDeleted},
+	}
+
+	result := &ReconcileResult{
+		ReconcileID:           "reconcile-id",
+		RepositoriesProcessed: 3,
+		ImagesSelected:        4,
+		ImagesDeleted:         3,
+		Plan:                  plan,
+	}
+
+	now := time.Unix(100, 0)
+	status := NewStatus(result, now, false, nil)
+
+	expected := []RepositoryStatus{
+		{Region: "us-east-1", Name: "repo-1", ImagesSelected: 2, ImagesDeleted: 1},
+		{Region: "us-east-1", Name: "repo-2", ImagesSelected: 1, ImagesDeleted: 1},
+		{Region: "us-west-2", Name: "repo-1", ImagesSelected: 1, ImagesDeleted: 1},
+	}
+	if !reflect.DeepEqual(status.Repositories, expected) {
+		t.Errorf("Expected repositories to be %+v, but were %+v", expected, status.Repositories)
+	}
+
+	if !status.Succeeded || status.LastSuccessTime == nil || !status.LastSuccessTime.Equal(now) {
+		t.Errorf("Expected the pass to have succeeded at %v, but got %+v", now, status)
+	}
+
+	// Failed passes keep the last success time, and list only some errors
+	for i := 0; i < statusMaxErrors+1; i++ {
+		result.Errors = append(result.Errors, fmt.Errorf("error %d", i))
+	}
+
+	failed := NewStatus(result, time.Unix(200, 0), false, status)
+
+	if failed.Succeeded || failed.LastSuccessTime == nil || !failed.LastSuccessTime.Equal(now) {
+		t.Errorf("Expected the pass to have failed, with the last success at %v, but got %+v", now, failed)
+	}
+
+	if failed.ErrorCount != statusMaxErrors+1 || len(failed.Errors) != statusMaxErrors {
+		t.Errorf("Expected %d errors with %d listed, but got %d with %d listed", statusMaxErrors+1, statusMaxErrors, failed.ErrorCount, len(failed.Errors))
+	}
+}
+
+func TestWriteStatus(t *testing.T) {
+	client := &mockLeaderLockClient{}
+	task := &CleanupTask{
+		ControllerNamespace: "namespace",
+		StatusConfigMap:     "ecr-cleanup-status",
+		StatusClient:        client,
+		Logger:              &mockLogger{},
+	}
+
+	first := time.Unix(100, 0)
+	if err := task.WriteStatus(&ReconcileResult{ReconcileID: "first", Plan: NewPlan()}, first); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	if client.configMap.Namespace != "namespace" || client.configMap.Name != "ecr-cleanup-status" {
+		t.Errorf("Expected the status to be created in 'namespace/ecr-cleanup-status', but was in '%s/%s'", client.configMap.Namespace, client.configMap.Name)
+	}
+
+	// The ConfigMap is updated by the next passes, keeping its other keys
+	client.configMap.Data["other"] = "value"
+
+	failed := &ReconcileResult{ReconcileID: "second", Plan: NewPlan(), Errors: []error{fmt.Errorf("error")}}
+	if err := task.WriteStatus(failed, time.Unix(200, 0)); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	status := &Status{}
+	if err := json.Unmarshal([]byte(client.configMap.Data[StatusConfigMapKey]), status); err != nil {
+		t.Fatalf("Expected the status to be valid JSON, but got %v", err)
+	}
+
+	if status.ReconcileID != "second" || status.LastSuccessTime == nil || !status.LastSuccessTime.Equal(first) {
+		t.Errorf("Expected the status of the second pass, with the last success at %v, but got %+v", first, status)
+	}
+
+	if client.configMap.Data["other"] != "value" {
+		t.Errorf("Expected the other keys of the ConfigMap to be kept, but got %+v", client.configMap.Data)
+	}
+}
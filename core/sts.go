@@ -0,0 +1,37 @@
+package core
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+)
+
+type STSClientImpl struct {
+	STSClient stsiface.STSAPI
+}
+
+// IdentityClient defines the expected interface of any object capable of
+// telling which AWS account the credentials in use belong to.
+type IdentityClient interface {
+	GetAccountID() (string, error)
+}
+
+// NewSTSClient returns a new client for interacting with the STS API, using
+// the same credentials as the ECR client. If roleARN is not empty, that IAM
+// role is assumed.
+func NewSTSClient(auth AWSAuth, region, roleARN string) *STSClientImpl {
+	return &STSClientImpl{
+		STSClient: sts.New(newAssumeRoleSession(auth, region, roleARN)),
+	}
+}
+
+// GetAccountID returns the ID of the AWS account the credentials in use
+// belong to.
+func (c *STSClientImpl) GetAccountID() (string, error) {
+	output, err := c.STSClient.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(output.Account), nil
+}
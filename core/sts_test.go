@@ -0,0 +1,64 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+)
+
+// mockAWSSTSClient is used to verify that the return values of the STS client
+// are being handled correctly by its consumers.
+type mockAWSSTSClient struct {
+	stsiface.STSAPI
+
+	outputAccount string
+	outputError   error
+}
+
+func (m *mockAWSSTSClient) GetCallerIdentity(input *sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	if m.outputError != nil {
+		return nil, m.outputError
+	}
+
+	return &sts.GetCallerIdentityOutput{
+		Account: &m.outputAccount,
+	}, nil
+}
+
+func TestGetAccountIDError(t *testing.T) {
+	client := STSClientImpl{
+		STSClient: &mockAWSSTSClient{
+			outputError: fmt.Errorf(""),
+		},
+	}
+
+	accountID, err := client.GetAccountID()
+
+	if accountID != "" {
+		t.Errorf("Expected account ID to be empty, but was %s", accountID)
+	}
+
+	if err == nil {
+		t.Errorf("Expected error not to be nil, but it was")
+	}
+}
+
+func TestGetAccountID(t *testing.T) {
+	client := STSClientImpl{
+		STSClient: &mockAWSSTSClient{
+			outputAccount: "123456789012",
+		},
+	}
+
+	accountID, err := client.GetAccountID()
+
+	if accountID != "123456789012" {
+		t.Errorf("Expected account ID to be 123456789012, but was %s", accountID)
+	}
+
+	if err != nil {
+		t.Errorf("Expected error to be nil, but was %v", err)
+	}
+}
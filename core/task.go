@@ -1,27 +1,578 @@
 package core
 
+import (
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// Actions taken when fewer repositories than expected are found
+	MinRepositoriesActionWarn  = "warn"
+	MinRepositoriesActionError = "error"
+
+	// Namespace used for the resources owned by the controller when running
+	// outside a cluster, unless specified otherwise
+	DefaultControllerNamespace = "default"
+
+	// Versions of the AWS SDK that can back the ECR client
+	AwsSdkVersionV1 = "v1"
+	AwsSdkVersionV2 = "v2"
+
+	// Passes whose summaries are sent through the notifier
+	NotifyOnAlways = "always"
+	NotifyOnErrors = "errors"
+
+	// Tag statuses of the only images listed from the repositories
+	ImageTagStatusTagged   = "tagged"
+	ImageTagStatusUntagged = "untagged"
+)
+
 // CleanupTask encapsulates the input parameters for the clean-up code.
 type CleanupTask struct {
 
 	// Interval in which the clean-up process will happen, in minutes.
 	Interval int
 
+	// If set, clean-up passes run at the times given by this schedule,
+	// instead of every `Interval` minutes.
+	Schedule *CronSchedule
+
+	// Each pass is delayed by a random duration of up to this long, so that
+	// the controllers of several clusters don't all hit ECR at once.
+	ScheduleJitter time.Duration
+
 	// Number of images to keep in each ECR repository.
 	MaxImages int
 
-	// AWS region in which the repositories live.
+	// If greater than zero, `MaxImages` is ignored, and instead the oldest
+	// unused images across all repositories are deleted until their sizes add
+	// up to at least this many bytes.
+	ReclaimBytes int64
+
+	// If greater than zero, only images pushed within this window count
+	// against `MaxImages`, and older images are never deleted because of it;
+	// they can still be deleted by the other rules, such as
+	// `DeleteUntaggedImages`.
+	CountSince time.Duration
+
+	// If set to `SemverRetentionMajor` or `SemverRetentionMinor`, `MaxImages`
+	// applies to each major or minor version line, as given by the tags of
+	// the images that are semantic versions, instead of to the whole
+	// repository. Images without such tags make up a line of their own.
+	SemverRetention string
+
+	// If not nil, `MaxImages` applies to each group of images sharing the
+	// same text captured by this pattern from their tags, such as the branch
+	// a build comes from, instead of to the whole repository. Images without
+	// matching tags make up a group of their own. Cannot be used along with
+	// `SemverRetention`.
+	TagGroupPattern *regexp.Regexp
+
+	// Images pushed more than this long ago are deleted regardless of
+	// `MaxImages`. Zero disables this rule.
+	MaxImageAge time.Duration
+
+	// Images pushed within this window are never deleted, regardless of
+	// `MaxImages` and the other rules. Zero disables this rule.
+	MinImageAge time.Duration
+
+	// Whether images whose ECR scans are yet to complete should be kept until
+	// the next pass, regardless of the other rules.
+	SkipScanPending bool
+
+	// Whether unused images whose latest ECR scans found vulnerabilities of
+	// `CRITICAL` severity should be deleted regardless of `MaxImages` and the
+	// other retention rules. The protections, such as `MinImageAge` and
+	// `RecentPullWindow`, still apply.
+	DeleteCriticalFindings bool
+
+	// Whether the images selected for deletion should be checked against
+	// invariants that must hold regardless of the retention rules, such as no
+	// images in use being selected, before deleting any of them. The pass is
+	// aborted if any invariant is violated.
+	VerifyPlan bool
+
+	// Whether images should only be reported instead of actually deleted.
+	DryRun bool
+
+	// Whether images without any tags should be deleted regardless of
+	// `MaxImages`.
+	DeleteUntaggedImages bool
+
+	// If greater than zero, untagged images have their own policy, such that
+	// only this many of the most recent ones are kept, and they take no part
+	// in the `MaxImages` accounting.
+	UntaggedKeepCount int
+
+	// If greater than zero, untagged images have their own policy, such that
+	// the ones pushed more than this long ago are deleted, and they take no
+	// part in the `MaxImages` accounting.
+	UntaggedMaxAge time.Duration
+
+	// Images with more tags than this are deleted regardless of `MaxImages`.
+	// Zero disables this rule.
+	MaxTagsPerImage int
+
+	// Images smaller than this many bytes, which are most likely left behind
+	// by failed pushes, are deleted regardless of `MaxImages`. Images of
+	// unknown size are never deleted because of it. Zero disables this rule.
+	MinImageSizeBytes int64
+
+	// The oldest unused images of each repository are deleted, regardless of
+	// `MaxImages`, until the sizes of the images left add up to at most this
+	// many bytes. Images of unknown size are never deleted because of it.
+	// Zero disables this rule.
+	MaxRepositorySizeBytes int64
+
+	// Whether images referenced by manifest lists (or OCI image indexes) that
+	// are not being deleted should be kept, so that pulls of multi-arch images
+	// don't break. This requires additional API calls for repositories with
+	// manifest lists.
+	ProtectManifestListChildren bool
+
+	// Whether manifest lists (or OCI image indexes) whose children were all
+	// deleted in a pass should be deleted as well, since they can no longer
+	// be pulled. This requires additional API calls for repositories with
+	// manifest lists.
+	DeleteOrphanedManifestLists bool
+
+	// Whether the images referenced by the manifest lists (or OCI image
+	// indexes) being deleted, and by no other manifest list, should be deleted
+	// along with them, rather than being left behind as untagged images. This
+	// requires additional API calls for repositories with manifest lists.
+	DeleteManifestListChildren bool
+
+	// Maximum number of images deleted in each pass across all repositories,
+	// starting with the oldest ones. The remaining images are deleted in the
+	// next passes. Zero means no limit.
+	MaxDeletesPerReconcile int
+
+	// Maximum number of images deleted from each repository in each pass,
+	// starting with the oldest ones. The remaining images are deleted in the
+	// next passes. Zero means no limit.
+	MaxDeletesPerRepository int
+
+	// AWS region in which the repositories live. This is also the region of
+	// the other AWS services the controller talks to, such as STS.
 	AwsRegion string
 
+	// If not empty, the repositories are searched for in each of these AWS
+	// regions, in this order, instead of only in `AwsRegion`, which should be
+	// one of them.
+	AwsRegions []string
+
+	// Custom ECR endpoint URL. If empty, the default endpoint for the AWS
+	// region is used.
+	EcrEndpoint string
+
+	// Version of the AWS SDK backing the ECR client, either `AwsSdkVersionV1`
+	// or the experimental `AwsSdkVersionV2`, which requires the `awssdkv2`
+	// build tag.
+	AwsSdkVersion string
+
+	// Maximum number of requests per second sent to the ECR API, and the
+	// maximum burst size. Requests exceeding this budget wait for their turn.
+	// Zero disables the rate limiting.
+	ApiQPS   float64
+	ApiBurst int
+
+	// Maximum number of times failed ECR API requests are retried, with
+	// exponential backoff, such as when they are throttled.
+	ApiMaxRetries int
+
+	// If greater than zero, the images listed from each repository are cached
+	// for this long across passes, and all of them are listed again every
+	// `FullResyncInterval`, if greater than zero, as per `ECRClientImpl`.
+	ImageCacheTTL      time.Duration
+	FullResyncInterval time.Duration
+
+	// If set, either to `ImageTagStatusTagged` or `ImageTagStatusUntagged`,
+	// only the images with this tag status are listed from the repositories,
+	// as per `ECRClientImpl`, and the others are left untouched.
+	ImageTagStatus string
+
+	// Number of repositories of a region whose images are listed and selected
+	// for deletion at once, sharing the `ApiQPS` budget. Deletions still
+	// happen one repository after the other. Defaults to 1.
+	Concurrency int
+
+	// Where the AWS credentials come from, before assuming `AssumeRoleARN`,
+	// if any.
+	AwsAuth AWSAuth
+
+	// If not empty, this IAM role is assumed to access the repositories, so
+	// that repositories living in another AWS account than the cluster can be
+	// cleaned up. The credentials are refreshed automatically.
+	AssumeRoleARN string
+
+	// Maps the names of the repositories that require a different IAM role
+	// than `AssumeRoleARN` to the role to assume for each one.
+	RepositoryRoles map[string]string
+
+	// If not empty, the controller refuses to run unless the AWS credentials
+	// in use, after assuming `AssumeRoleARN`, belong to this account.
+	ExpectedAccountID string
+
+	// Whether to verify at startup that the AWS credentials in use are
+	// allowed the IAM actions, and the Kubernetes client the RBAC
+	// permissions, that the settings require, refusing to run otherwise.
+	Preflight bool
+
 	// ECR repositories to clean up.
 	EcrRepositories []*string
 
+	// Whether all the repositories in the registry should be cleaned up,
+	// instead of `EcrRepositories`, as long as their names match any of
+	// `RepositoryIncludePatterns`, if any, and none of
+	// `RepositoryExcludePatterns`.
+	DiscoverRepositories      bool
+	RepositoryIncludePatterns []*regexp.Regexp
+	RepositoryExcludePatterns []*regexp.Regexp
+
+	// Whether only the repositories with images in use by the cluster should
+	// be cleaned up, leaving the others untouched.
+	OnlyRepositoriesInUse bool
+
+	// Repositories created less than this long ago are not cleaned up, so as
+	// not to race with their initial pushes. Zero disables this rule.
+	RepositoryGracePeriod time.Duration
+
+	// Repositories failing in this many consecutive passes, such as because
+	// access to them is denied, are skipped by the next passes for
+	// `RepositoryCooldown`, which doubles each time they fail again, up to
+	// `RepositoryMaxCooldown`. Zero disables this rule.
+	RepositoryFailureThreshold int
+	RepositoryCooldown         time.Duration
+	RepositoryMaxCooldown      time.Duration
+
+	// Minimum number of repositories expected to be found. Finding fewer
+	// repositories usually means the credentials or the region are wrong.
+	MinRepositories int
+
+	// What to do when fewer than `MinRepositories` repositories are found,
+	// either `MinRepositoriesActionWarn` or `MinRepositoriesActionError`.
+	MinRepositoriesAction string
+
 	// Path to the kubeconfig file used to access the Kubernetes cluster.
 	// This is used to find out which images are in use, so they don't get
 	// deleted by accident.
 	KubeConfig string
 
+	// Namespace holding the Kubernetes resources owned by the controller
+	// itself. If empty, the namespace of the pod the controller runs in is
+	// used, falling back to `DefaultControllerNamespace` when running outside
+	// a cluster.
+	ControllerNamespace string
+
 	// Images used by pods running in these namespaces will not get deleted.
+	// Namespaces may contain wildcards, such as `*` or `team-*`, in which case
+	// the namespaces of the cluster are listed in each pass.
 	KubeNamespaces []*string
+
+	// Namespaces whose workloads are left out when finding out which images
+	// are in use, such as ephemeral preview environments, which may contain
+	// wildcards. These take precedence over `KubeNamespaces` and the
+	// namespaces of cleanup policies.
+	ExcludeNamespaces []*string
+
+	// Whether images listed in the `PinnedImagesAnnotation` annotation of the
+	// cluster nodes should be considered in use.
+	UseNodePinnedImages bool
+
+	// Whether images used by the jobs and cron jobs of `KubeNamespaces` should
+	// be considered in use, even if no pods are running them right now.
+	UseJobImages bool
+
+	// Whether images used by the replica sets and controller revisions of
+	// `KubeNamespaces`, which deployments and stateful sets roll back to,
+	// should be considered in use, even if scaled down to zero.
+	UseRevisionHistoryImages bool
+
+	// Whether images used by the Argo Rollouts of `KubeNamespaces`, and by the
+	// replica sets they keep around for aborts and rollbacks, should be
+	// considered in use.
+	UseRolloutImages bool
+
+	// Whether images used by the rendered manifests of the Helm releases of
+	// `KubeNamespaces` should be considered in use, even if the workloads are
+	// scaled down to zero.
+	UseHelmReleaseImages bool
+
+	// Custom resources whose objects run pods, and whose images in
+	// `KubeNamespaces` should be considered in use.
+	CustomWorkloads []CustomWorkload
+
+	// GitOps repositories whose manifests, kustomizations and Helm values
+	// reference images that should be considered in use, even if they are
+	// not deployed yet.
+	GitOpsRepositories []GitRepository
+
+	// If not empty, the path of the file holding the token sent to the HTTPS
+	// remotes of `GitOpsRepositories`.
+	GitTokenPath string
+
+	// The client checking out `GitOpsRepositories`, which is created by
+	// `NewClients` if not set.
+	GitClient GitClient
+
+	// Scanners of further workloads whose images should be considered in use,
+	// for programs embedding the controller.
+	WorkloadScanners []WorkloadScanner
+
+	// Jobs that finished longer ago than this are left out when finding out
+	// which images are in use, if `UseJobImages` is set. Zero means that all
+	// jobs are taken into account.
+	JobHistoryWindow time.Duration
+
+	// Maps registry hosts (optionally followed by a path prefix), such as
+	// registry mirrors, to the ECR registry host they stand for, so that
+	// images pulled through them are still recognized as in use.
+	RegistryAliases map[string]string
+
+	// Whether only images hosted in the ECR registry being cleaned up should
+	// be considered in use, ignoring identically named images hosted in other
+	// registries.
+	MatchRegistryOnly bool
+
+	// Host of the ECR registry being cleaned up in `AwsRegion`. If empty,
+	// images hosted in any ECR registry are considered in use.
+	RegistryHost string
+
+	// AWS account the ECR registries being cleaned up belong to, as resolved
+	// by `ResolveRegistryHost`, from which the registry hosts of the regions
+	// other than `AwsRegion` are derived.
+	registryAccountID string
+
+	// Image tags matching any of these patterns are protected in all
+	// repositories, as if they were in use.
+	KeepTagPatterns []*regexp.Regexp
+
+	// Whether the retention rules of the repositories matched by
+	// `ECRCleanupPolicy` resources should be overridden by them. The policies
+	// are read again in each pass.
+	UseCleanupPolicies bool
+
+	// Whether the `RepositoryTagKeep`, `RepositoryTagMaxAge` and
+	// `RepositoryTagEnabled` AWS resource tags of the repositories override
+	// their retention rules, including the ones of cleanup policies. The tags
+	// are read again in each pass.
+	UseRepositoryTags bool
+
+	// Whether the `NamespaceKeepCountAnnotation` annotation of the namespaces
+	// raises the number of images kept in the repositories their pods use,
+	// to the highest of the keep counts of these namespaces. The annotations
+	// are read again in each pass.
+	UseNamespaceKeepCounts bool
+
+	// Whether the repositories replicated to other regions or accounts by
+	// ECR, or created by pull-through cache rules, should be skipped. Unless
+	// `AllowReplicatedRepositories` is set, such repositories otherwise fail
+	// the pass, since deleting their images causes churn elsewhere.
+	SkipReplicatedRepositories  bool
+	AllowReplicatedRepositories bool
+
+	// If positive, repositories none of whose images were in use, pushed or
+	// pulled in this many days, or that are empty and were created longer ago
+	// than that, are reported as orphaned. Empty orphaned repositories are
+	// deleted if `DeleteEmptyRepositories` is set.
+	OrphanedRepositoryDays  int
+	DeleteEmptyRepositories bool
+
+	// If not empty, the image tags listed in this ConfigMap, given as
+	// `namespace/name`, are protected in all repositories. The ConfigMap is
+	// read again in each pass.
+	KeepTagsConfigMap string
+
+	// Filters selecting the images to delete from each repository, in order,
+	// for programs embedding the controller. If nil, the filters returned by
+	// `DefaultImageFilters` for the current settings are used.
+	ImageFilters []ImageFilter
+
+	// Whether to proceed with the cleanup when the Kubernetes API cannot tell
+	// which images are in use, treating them as not in use. This is unsafe,
+	// since images used by running pods might be deleted.
+	IgnoreKubernetesErrors bool
+
+	// Whether to keep images pushed after the newest image in use in each
+	// repository, since they might be pending rollouts.
+	ProtectImagesNewerThanInUse bool
+
+	// Whether the most recent image carrying any tag is always kept in each
+	// repository, along with the most recent tagged image of each version
+	// line or tag group, if any, regardless of the other rules.
+	AlwaysKeepLatestTagged bool
+
+	// If not empty, images whose manifests carry this annotation, along with
+	// `ProtectAnnotationValue`, unless it's empty, are never deleted. This
+	// requires additional API calls for the images selected for deletion.
+	ProtectAnnotationKey   string
+	ProtectAnnotationValue string
+
+	// Whether to delete images even if that would leave a repository without
+	// any images, which might break deployments that still refer to them.
+	AllowEmptyRepositories bool
+
+	// If greater than zero, images are not deleted right away, but tagged as
+	// pending deletion instead, and only deleted once they have been pending
+	// deletion for this long.
+	QuarantineRetention time.Duration
+
+	// Images pulled within this window, according to CloudTrail, are not
+	// deleted even if they are not in use by the cluster. Zero disables this
+	// rule, which requires the `cloudtrail:LookupEvents` permission.
+	RecentPullWindow time.Duration
+
+	// Images last pulled within this many days, according to the pull times
+	// recorded by ECR, are never deleted, even if not in use by the cluster.
+	// Zero disables this rule.
+	MinDaysSinceLastPull int
+
+	// Client used to find out which images were pulled recently.
+	PullEventsClient PullEventsClient
+
+	// Sink in which the deleted images are recorded for long-term audit.
+	// Defaults to one that records nothing.
+	AuditSink AuditSink
+
+	// If not empty, and `AuditSink` is not set, the deleted images are
+	// recorded as JSON lines in this S3 bucket, under `AuditS3Prefix`.
+	AuditS3Bucket string
+	AuditS3Prefix string
+
+	// If not empty, and `AuditSink` is not set, the deleted images are
+	// also appended as JSON lines to the file at this path.
+	AuditPath string
+
+	// Whether failing to record deleted images in `AuditSink` stops any
+	// further deletions in the pass, instead of only being logged.
+	AuditFailuresBlockDeletion bool
+
+	// Notifier through which the summary of each pass is sent. Defaults to
+	// none.
+	Notifier Notifier
+
+	// If not empty, and `Notifier` is not set, the summary of each pass is
+	// posted to this webhook URL as a Slack-compatible payload.
+	NotifyWebhookURL string
+
+	// Which passes are notified, either `NotifyOnAlways` or `NotifyOnErrors`.
+	NotifyOn string
+
+	// If not empty, the `Status` of each pass is recorded in the ConfigMap
+	// with this name in `ControllerNamespace`, for other tools to consume.
+	StatusConfigMap string
+
+	// Client used to read and write the status ConfigMap. Defaults to the
+	// Kubernetes client if `StatusConfigMap` is set.
+	StatusClient StatusClient
+
+	// If not empty, the images selected for deletion in each pass are written
+	// to this path as JSON.
+	PlanOutputPath string
+
+	// If not empty, the images selected for deletion in each pass are compared
+	// against the plan stored in this path, and the differences are logged.
+	PreviousPlanPath string
+
+	// If not empty, the images selected for deletion in each pass, and what
+	// happened to them, are written to this path as CSV.
+	ReportCSVPath string
+
+	// Whether only the replica of the controller holding the lead, recorded
+	// in the `LeaderElectionConfigMapName` ConfigMap of `ControllerNamespace`,
+	// should run clean-up passes, so that several replicas can be deployed
+	// for availability.
+	LeaderElection bool
+
+	// How long the lead is held without being renewed before another replica
+	// can take it over. The lead is renewed every third of it.
+	LeaderElectionLeaseDuration time.Duration
+
+	// Identity of this replica for leader election. Defaults to the hostname,
+	// which is the pod name when running inside a Kubernetes cluster.
+	LeaderElectionIdentity string
+
+	// Client used to read and write the leader election ConfigMap.
+	LeaderLockClient LeaderLockClient
+
+	// Clusters, other than the one the controller runs in, whose workloads
+	// are also looked at, in the same `KubeNamespaces`, to find out which
+	// images are in use.
+	RemoteClusters []RemoteCluster
+
+	// Whether a Kubernetes event should be emitted on `EventsTarget` for each
+	// image deleted, skipped or that failed to be deleted.
+	EmitEvents bool
+
+	// Object the events are emitted on, given as `Kind/name` in
+	// `ControllerNamespace`. Defaults to the controller pod.
+	EventsTarget string
+
+	// Client used to emit the events. Defaults to the Kubernetes client if
+	// `EmitEvents` is set.
+	EventsClient EventsClient
+
+	// Number of intervals, or of passes due as per `Schedule`, without the
+	// clean-up loop completing a pass after which `CheckLiveness` fails (0
+	// disables).
+	LivenessIntervals int
+
+	// Logger used to report the progress of the clean-up. Defaults to glog.
+	Logger Logger
+
+	// Set to 1 while a clean-up pass is running, so that passes never overlap.
+	reconciling int32
+
+	// Set to 1 while this replica holds the lead, if `LeaderElection` is set.
+	leading int32
+
+	// Logger of the running pass, if any, held in a `loggerHolder`.
+	passLogger atomic.Value
+
+	// Context of the spans of the running pass, if any, held in a
+	// `contextHolder`.
+	passTraceContext atomic.Value
+
+	// Object the events are emitted on, once looked up.
+	eventsObjectRef *v1.ObjectReference
+
+	// Time the clean-up loop last made progress, in nanoseconds since the
+	// epoch, or 0 if it is yet to start.
+	loopActivity int64
+
+	// Clients of the clean-up loop, held in a `healthClients`.
+	clients atomic.Value
+
+	// Consecutive failures of each repository across passes, as per
+	// `RepositoryFailureThreshold`.
+	repositoryFailures repositoryBreaker
+
+	// Guards the settings changed by `tryReload` that are read outside of
+	// passes, such as by `CheckLiveness` and `notify`.
+	settingsMutex sync.RWMutex
+
+	// Channels of the clean-up loop that `Reload` hands settings over
+	// through, held in a `reloadChannels` once the loop starts.
+	reloads atomic.Value
+}
+
+// reloadChannels holds the channel the clean-up loop receives reloaded
+// settings from, and the channel closed once it stops.
+type reloadChannels struct {
+	settings chan *CleanupTask
+	done     chan struct{}
+}
+
+// regions returns the AWS regions in which the repositories are searched for.
+func (t *CleanupTask) regions() []string {
+	if len(t.AwsRegions) == 0 {
+		return []string{t.AwsRegion}
+	}
+	return t.AwsRegions
 }
 
 func NewCleanupTask() *CleanupTask {
@@ -29,5 +580,29 @@ func NewCleanupTask() *CleanupTask {
 		Interval:  30,
 		MaxImages: 900,
 		AwsRegion: "us-east-1",
+		ApiQPS:    50,
+		ApiBurst:  100,
+
+		ApiMaxRetries: 8,
+		Concurrency:   1,
+
+		AwsSdkVersion: AwsSdkVersionV1,
+		AwsAuth:       AWSAuth{Mode: AwsAuthModeAuto},
+
+		MinRepositories:       1,
+		MinRepositoriesAction: MinRepositoriesActionWarn,
+
+		NotifyOn: NotifyOnAlways,
+
+		ProtectManifestListChildren: true,
+
+		JobHistoryWindow: 7 * 24 * time.Hour,
+
+		RepositoryCooldown:    30 * time.Minute,
+		RepositoryMaxCooldown: 24 * time.Hour,
+
+		LeaderElectionLeaseDuration: 60 * time.Second,
+
+		LivenessIntervals: 3,
 	}
 }
@@ -16,4 +16,22 @@ func TestNewCleanupTask(t *testing.T) {
 	if task.AwsRegion != "us-east-1" {
 		t.Errorf("Expected aws region to be 'us-east-1', but was %s", task.AwsRegion)
 	}
+	if task.ApiQPS != 50 {
+		t.Errorf("Expected API QPS to be 50, but was %f", task.ApiQPS)
+	}
+	if task.ApiBurst != 100 {
+		t.Errorf("Expected API burst to be 100, but was %d", task.ApiBurst)
+	}
+	if task.MinRepositories != 1 {
+		t.Errorf("Expected min repositories to be 1, but was %d", task.MinRepositories)
+	}
+	if task.MinRepositoriesAction != MinRepositoriesActionWarn {
+		t.Errorf("Expected min repositories action to be '%s', but was '%s'", MinRepositoriesActionWarn, task.MinRepositoriesAction)
+	}
+	if task.AwsAuth.Mode != AwsAuthModeAuto {
+		t.Errorf("Expected AWS auth mode to be '%s', but was '%s'", AwsAuthModeAuto, task.AwsAuth.Mode)
+	}
+	if !task.ProtectManifestListChildren {
+		t.Errorf("Expected manifest list children to be protected, but they were not")
+	}
 }
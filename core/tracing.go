@@ -0,0 +1,171 @@
+package core
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// Name of the tracer the spans of the clean-up passes are started with.
+	tracerName = "github.com/danielfm/kube-ecr-cleanup-controller/core"
+
+	// Name of the service the spans are exported for.
+	tracingServiceName = "kube-ecr-cleanup-controller"
+)
+
+// Attributes set on the spans of the clean-up passes.
+const (
+	regionAttribute     = attribute.Key("aws.region")
+	repositoryAttribute = attribute.Key("ecr.repository")
+)
+
+// NewTracerProvider returns a tracer provider exporting spans in batches via
+// OTLP over HTTP to the given endpoint, given as host:port, over plain HTTP
+// if insecure is set. The exporter is configured by the standard
+// `OTEL_EXPORTER_OTLP_*` environment variables otherwise. The spans of the
+// clean-up passes are only exported once the provider is set as the global
+// one, which it must be shut down to flush.
+func NewTracerProvider(endpoint string, insecure bool) (*sdktrace.TracerProvider, error) {
+	options := []otlptracehttp.Option{}
+	if endpoint != "" {
+		options = append(options, otlptracehttp.WithEndpoint(endpoint))
+	}
+	if insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", tracingServiceName)))
+	if err != nil {
+		return nil, err
+	}
+
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res)), nil
+}
+
+// startSpan starts a span with the given name and attributes, as a child of
+// the span in the given context, if any, using the global tracer provider.
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// endSpan ends the given span, which failed with the given error, if any.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// contextHolder holds the context of the spans of the running pass, since
+// atomic.Value cannot hold nil.
+type contextHolder struct {
+	context.Context
+}
+
+// traceContext returns the context holding the span of the region being
+// cleaned up, or of the pass while no region is, which the spans of the
+// requests sent along the way are children of. It is canceled along with the
+// pass.
+func (t *CleanupTask) traceContext() context.Context {
+	if holder, ok := t.passTraceContext.Load().(contextHolder); ok && holder.Context != nil {
+		return holder.Context
+	}
+	return context.Background()
+}
+
+// traceAWSRequests adds handlers to the given request handlers of an AWS
+// service client that trace each request, including its retries, as a child
+// of the span in the context returned by parent. Each failed attempt is
+// recorded as an event of the span, telling whether it was throttled.
+func traceAWSRequests(handlers *request.Handlers, parent func() context.Context) {
+	// Requests are validated once before being sent, whereas they are signed
+	// again for each retry
+	handlers.Validate.PushFrontNamed(request.NamedHandler{
+		Name: "tracing.StartSpan",
+		Fn: func(r *request.Request) {
+			_, span := otel.Tracer(tracerName).Start(parent(), r.ClientInfo.ServiceID+"."+r.Operation.Name,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(
+					attribute.String("rpc.system", "aws-api"),
+					attribute.String("rpc.service", r.ClientInfo.ServiceID),
+					attribute.String("rpc.method", r.Operation.Name),
+					regionAttribute.String(aws.StringValue(r.Config.Region)),
+				),
+			)
+			if repositoryName := requestRepositoryName(r.Params); repositoryName != "" {
+				span.SetAttributes(repositoryAttribute.String(repositoryName))
+			}
+
+			// The request keeps its own context, which is canceled along
+			// with the pass
+			r.SetContext(trace.ContextWithSpan(r.Context(), span))
+		},
+	})
+
+	handlers.Retry.PushFrontNamed(request.NamedHandler{
+		Name: "tracing.RecordAttempt",
+		Fn: func(r *request.Request) {
+			if r.Error == nil {
+				return
+			}
+
+			code := ""
+			if awsErr, ok := r.Error.(awserr.Error); ok {
+				code = awsErr.Code()
+			}
+
+			trace.SpanFromContext(r.Context()).AddEvent("Attempt failed", trace.WithAttributes(
+				attribute.Int("aws.attempt", r.RetryCount+1),
+				attribute.String("aws.error_code", code),
+				attribute.Bool("aws.throttled", request.IsErrorThrottle(r.Error)),
+			))
+		},
+	})
+
+	handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "tracing.EndSpan",
+		Fn: func(r *request.Request) {
+			span := trace.SpanFromContext(r.Context())
+			span.SetAttributes(
+				attribute.Int("aws.retries", r.RetryCount),
+				attribute.String("aws.request_id", r.RequestID),
+			)
+			endSpan(span, r.Error)
+		},
+	})
+}
+
+// requestRepositoryName returns the name of the ECR repository the given
+// parameters of an AWS request refer to, if any.
+func requestRepositoryName(params interface{}) string {
+	value := reflect.ValueOf(params)
+	if value.Kind() != reflect.Ptr || value.IsNil() || value.Elem().Kind() != reflect.Struct {
+		return ""
+	}
+
+	field := value.Elem().FieldByName("RepositoryName")
+	if !field.IsValid() {
+		return ""
+	}
+
+	name, _ := field.Interface().(*string)
+	return aws.StringValue(name)
+}
@@ -0,0 +1,127 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/corehandlers"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// recordSpans sets the global tracer provider to one recording the spans
+// that end, and returns the recorder along with a function that disables
+// tracing again.
+func recordSpans() (*tracetest.SpanRecorder, func()) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	return recorder, func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	}
+}
+
+// spanAttribute returns the value of the attribute with the given key of the
+// given span, if any.
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, attr := range span.Attributes() {
+		if attr.Key == key {
+			return attr.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestRequestRepositoryName(t *testing.T) {
+	testCases := []struct {
+		params   interface{}
+		expected string
+	}{
+		{&ecr.DescribeImagesInput{RepositoryName: aws.String("repo")}, "repo"},
+		{&ecr.DescribeImagesInput{}, ""},
+		{&ecr.DescribeRegistryInput{}, ""},
+		{(*ecr.DescribeImagesInput)(nil), ""},
+		{nil, ""},
+	}
+
+	for i, testCase := range testCases {
+		if name := requestRepositoryName(testCase.params); name != testCase.expected {
+			t.Errorf("Test case %d: expected repository name '%s', but got '%s'", i, testCase.expected, name)
+		}
+	}
+}
+
+func TestTraceAWSRequests(t *testing.T) {
+	recorder, restore := recordSpans()
+	defer restore()
+
+	parentCtx, parent := startSpan(context.Background(), "CleanupRegion")
+	defer parent.End()
+
+	// The first attempt is throttled, and the retry succeeds
+	attempts := 0
+	handlers := request.Handlers{}
+	traceAWSRequests(&handlers, func() context.Context { return parentCtx })
+	handlers.Send.PushBack(func(r *request.Request) {
+		attempts++
+		r.HTTPResponse = &http.Response{StatusCode: 200, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(""))}
+		if attempts == 1 {
+			r.HTTPResponse.StatusCode = 400
+			r.Error = awserr.New("ThrottlingException", "Rate exceeded", nil)
+		}
+	})
+	handlers.AfterRetry.PushBackNamed(corehandlers.AfterRetryHandler)
+
+	retryer := client.DefaultRetryer{NumMaxRetries: 1, MinThrottleDelay: time.Millisecond, MaxThrottleDelay: time.Millisecond}
+	r := request.New(aws.Config{Region: aws.String("us-east-1")}, metadata.ClientInfo{ServiceID: "ECR"}, handlers, retryer,
+		&request.Operation{Name: "DescribeImages"}, &ecr.DescribeImagesInput{RepositoryName: aws.String("repo")}, &ecr.DescribeImagesOutput{})
+
+	if err := r.Send(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, but got %d", len(spans))
+	}
+
+	span := spans[0]
+	if span.Name() != "ECR.DescribeImages" || span.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("Expected an ECR.DescribeImages span under the region span, but got %s", span.Name())
+	}
+
+	if value, _ := spanAttribute(span, repositoryAttribute); value.AsString() != "repo" {
+		t.Errorf("Expected repository 'repo', but got '%s'", value.AsString())
+	}
+	if value, _ := spanAttribute(span, "aws.retries"); value.AsInt64() != 1 {
+		t.Errorf("Expected 1 retry, but got %d", value.AsInt64())
+	}
+
+	if events := span.Events(); len(events) != 1 {
+		t.Errorf("Expected the failed attempt to be recorded, but got %d events", len(events))
+	} else {
+		throttled := false
+		for _, attr := range events[0].Attributes {
+			if attr.Key == "aws.throttled" {
+				throttled = attr.Value.AsBool()
+			}
+		}
+		if !throttled {
+			t.Errorf("Expected the failed attempt to be throttled, but it was not")
+		}
+	}
+}
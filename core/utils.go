@@ -1,7 +1,12 @@
 package core
 
 import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // ParseCommaSeparatedList takes a comma-separated string, such as "str1, str2",
@@ -19,3 +24,84 @@ func ParseCommaSeparatedList(commaSeparatedList string) []*string {
 
 	return items
 }
+
+// ParseKeyValueList takes a comma-separated list of key-value pairs, such as
+// "key1=value1, key2=value2", and returns a map with those pairs.
+func ParseKeyValueList(keyValueList string) (map[string]string, error) {
+	pairs := map[string]string{}
+
+	for _, item := range ParseCommaSeparatedList(keyValueList) {
+		pair := strings.SplitN(*item, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("Expected key=value pair, but got '%s'", *item)
+		}
+
+		key, value := strings.TrimSpace(pair[0]), strings.TrimSpace(pair[1])
+		if len(key) == 0 || len(value) == 0 {
+			return nil, fmt.Errorf("Expected key=value pair, but got '%s'", *item)
+		}
+
+		pairs[key] = value
+	}
+
+	return pairs, nil
+}
+
+// ParseDuration is like time.ParseDuration, but also accepts a whole number
+// of days followed by "d", such as "30d".
+func ParseDuration(duration string) (time.Duration, error) {
+	if !strings.HasSuffix(duration, "d") {
+		return time.ParseDuration(duration)
+	}
+
+	days, err := strconv.Atoi(strings.TrimSuffix(duration, "d"))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid duration '%s'", duration)
+	}
+
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// ParseNamespacedName takes a string such as "namespace/name" and returns the
+// namespace and name it refers to.
+func ParseNamespacedName(namespacedName string) (string, string, error) {
+	parts := strings.Split(namespacedName, "/")
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", "", fmt.Errorf("Expected namespace/name, but got '%s'", namespacedName)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// RandomDuration returns a random duration between zero and the given one,
+// excluded, or zero if the given duration is not positive.
+func RandomDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+
+	value := make([]byte, 8)
+	if _, err := rand.Read(value); err != nil {
+		return time.Duration(time.Now().UnixNano() % int64(max))
+	}
+
+	return time.Duration(binary.BigEndian.Uint64(value) % uint64(max))
+}
+
+// NewReconcileID returns a random (version 4) UUID identifying a clean-up
+// pass, so that everything a pass logs and reports can be told apart from
+// the output of the other passes.
+func NewReconcileID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		binaryTime := time.Now().UnixNano()
+		for i := range id {
+			id[i] = byte(binaryTime >> uint(8*(i%8)))
+		}
+	}
+
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
@@ -1,7 +1,10 @@
 package core
 
 import (
+	"reflect"
+	"regexp"
 	"testing"
+	"time"
 )
 
 func TestParseCommaSeparatedList(t *testing.T) {
@@ -60,3 +63,175 @@ func TestParseCommaSeparatedList(t *testing.T) {
 		}
 	}
 }
+
+func TestParseKeyValueList(t *testing.T) {
+	testCases := []struct {
+		input       string
+		expected    map[string]string
+		expectError bool
+	}{
+		{
+			// No items
+			input:    "",
+			expected: map[string]string{},
+		},
+		{
+			// One item
+			input:    " key-1 = value-1 , ",
+			expected: map[string]string{"key-1": "value-1"},
+		},
+		{
+			// Two items, the value may contain '='
+			input:    "key-1=value-1, key-2=value=2",
+			expected: map[string]string{"key-1": "value-1", "key-2": "value=2"},
+		},
+		{
+			// Missing value
+			input:       "key-1",
+			expectError: true,
+		},
+		{
+			// Empty key
+			input:       "=value-1",
+			expectError: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		output, err := ParseKeyValueList(testCase.input)
+
+		if testCase.expectError {
+			if err == nil {
+				t.Errorf("Expected error for input '%s' not to be nil, but it was", testCase.input)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Expected error for input '%s' to be nil, but was %v", testCase.input, err)
+		}
+
+		if !reflect.DeepEqual(output, testCase.expected) {
+			t.Errorf("Expected output to be %+v, but was %+v", testCase.expected, output)
+		}
+	}
+}
+
+func TestParseNamespacedName(t *testing.T) {
+	testCases := []struct {
+		input             string
+		expectedNamespace string
+		expectedName      string
+		expectError       bool
+	}{
+		{
+			input:             "namespace-1/name-1",
+			expectedNamespace: "namespace-1",
+			expectedName:      "name-1",
+		},
+		{
+			// Missing namespace
+			input:       "name-1",
+			expectError: true,
+		},
+		{
+			// Empty name
+			input:       "namespace-1/",
+			expectError: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		namespace, name, err := ParseNamespacedName(testCase.input)
+
+		if testCase.expectError {
+			if err == nil {
+				t.Errorf("Expected error for input '%s' not to be nil, but it was", testCase.input)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Expected error for input '%s' to be nil, but was %v", testCase.input, err)
+		}
+
+		if namespace != testCase.expectedNamespace || name != testCase.expectedName {
+			t.Errorf("Expected output to be %s/%s, but was %s/%s", testCase.expectedNamespace, testCase.expectedName, namespace, name)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	testCases := []struct {
+		input       string
+		expected    time.Duration
+		expectError bool
+	}{
+		{
+			input:    "30d",
+			expected: 30 * 24 * time.Hour,
+		},
+		{
+			input:    "36h",
+			expected: 36 * time.Hour,
+		},
+		{
+			// Fractional days
+			input:       "1.5d",
+			expectError: true,
+		},
+		{
+			input:       "forever",
+			expectError: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		output, err := ParseDuration(testCase.input)
+
+		if testCase.expectError {
+			if err == nil {
+				t.Errorf("Expected error for input '%s' not to be nil, but it was", testCase.input)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Expected error for input '%s' to be nil, but was %v", testCase.input, err)
+		}
+
+		if output != testCase.expected {
+			t.Errorf("Expected output for input '%s' to be %v, but was %v", testCase.input, testCase.expected, output)
+		}
+	}
+}
+
+func TestNewReconcileID(t *testing.T) {
+	uuidRegexp := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	first, second := NewReconcileID(), NewReconcileID()
+
+	for _, id := range []string{first, second} {
+		if !uuidRegexp.MatchString(id) {
+			t.Errorf("Expected '%s' to be a version 4 UUID, but it was not", id)
+		}
+	}
+
+	if first == second {
+		t.Errorf("Expected reconcile IDs to be unique, but got '%s' twice", first)
+	}
+}
+
+func TestRandomDuration(t *testing.T) {
+	for _, max := range []time.Duration{-time.Second, 0} {
+		if actual := RandomDuration(max); actual != 0 {
+			t.Errorf("Expected random duration up to %v to be 0, but was %v", max, actual)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if actual := RandomDuration(time.Second); actual < 0 || actual >= time.Second {
+			t.Errorf("Expected random duration to be within [0, 1s), but was %v", actual)
+		}
+	}
+}
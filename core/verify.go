@@ -0,0 +1,78 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// VerifyImagesToDelete checks the images selected for deletion from a
+// repository against invariants that must hold regardless of the retention
+// rules in use, as a safety net against bugs in those rules. That is, no image
+// tagged with one of tagsInUse, one of protectedTags or 'latest', or whose
+// digest is one of tagsInUse, is deleted, only images listed in the repository
+// are deleted, each one once, so that the deleted and retained images add up
+// to the listed ones, and at least minKeep images (or all of them, if there
+// are fewer) survive. It returns an error describing each violated invariant.
+func VerifyImagesToDelete(repoImages, imagesToDelete []*ecr.ImageDetail, tagsInUse, protectedTags []string, minKeep int) []error {
+	errs := []error{}
+
+	listed := map[string]bool{}
+	for _, image := range repoImages {
+		listed[aws.StringValue(image.ImageDigest)] = true
+	}
+
+	inUse := map[string]bool{}
+	for _, tag := range tagsInUse {
+		inUse[tag] = true
+	}
+
+	protected := map[string]bool{"latest": true}
+	for _, tag := range protectedTags {
+		protected[tag] = true
+	}
+
+	deleted := map[string]bool{}
+	for _, image := range imagesToDelete {
+		digest := aws.StringValue(image.ImageDigest)
+
+		if inUse[digest] {
+			errs = append(errs, fmt.Errorf("Image '%s' is in use by digest", digest))
+		}
+
+		for _, tag := range aws.StringValueSlice(image.ImageTags) {
+			if inUse[tag] {
+				errs = append(errs, fmt.Errorf("Image '%s' is in use with tag '%s'", digest, tag))
+			}
+			if protected[tag] {
+				errs = append(errs, fmt.Errorf("Image '%s' has protected tag '%s'", digest, tag))
+			}
+		}
+
+		if !listed[digest] {
+			errs = append(errs, fmt.Errorf("Image '%s' is not listed in the repository", digest))
+		}
+		if deleted[digest] {
+			errs = append(errs, fmt.Errorf("Image '%s' is selected for deletion more than once", digest))
+		}
+		deleted[digest] = true
+	}
+
+	if minKeep > len(listed) {
+		minKeep = len(listed)
+	}
+
+	surviving := 0
+	for digest := range listed {
+		if !deleted[digest] {
+			surviving++
+		}
+	}
+
+	if surviving < minKeep {
+		errs = append(errs, fmt.Errorf("Only %d images would be left, but at least %d must be kept", surviving, minKeep))
+	}
+
+	return errs
+}
@@ -0,0 +1,75 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+func TestVerifyImagesToDelete(t *testing.T) {
+	digests := []string{"digest-1", "digest-2", "digest-3", "other"}
+	tags := []string{"in-use", "keep", "latest", "tag-1"}
+
+	images := []*ecr.ImageDetail{
+		{ImageDigest: &digests[0], ImageTags: []*string{&tags[3]}},
+		{ImageDigest: &digests[1]},
+		{ImageDigest: &digests[2]},
+	}
+
+	testCases := []struct {
+		imagesToDelete     []*ecr.ImageDetail
+		minKeep            int
+		expectedViolations int
+	}{
+		// All invariants hold
+		{
+			imagesToDelete:     []*ecr.ImageDetail{images[0], images[1]},
+			minKeep:            1,
+			expectedViolations: 0,
+		},
+
+		// Images in use or with protected tags
+		{
+			imagesToDelete: []*ecr.ImageDetail{
+				{ImageDigest: &digests[0], ImageTags: []*string{&tags[0]}},
+				{ImageDigest: &digests[1], ImageTags: []*string{&tags[1], &tags[2]}},
+			},
+			minKeep:            0,
+			expectedViolations: 3,
+		},
+
+		// Image not listed in the repository, and image selected twice
+		{
+			imagesToDelete:     []*ecr.ImageDetail{{ImageDigest: &digests[3]}, images[0], images[0]},
+			minKeep:            0,
+			expectedViolations: 2,
+		},
+
+		// Too few images left
+		{
+			imagesToDelete:     []*ecr.ImageDetail{images[0], images[1]},
+			minKeep:            2,
+			expectedViolations: 1,
+		},
+
+		// Repositories with fewer images than minKeep are left untouched
+		{
+			imagesToDelete:     []*ecr.ImageDetail{},
+			minKeep:            10,
+			expectedViolations: 0,
+		},
+		{
+			imagesToDelete:     []*ecr.ImageDetail{images[0]},
+			minKeep:            10,
+			expectedViolations: 1,
+		},
+	}
+
+	for i, testCase := range testCases {
+		errs := VerifyImagesToDelete(images, testCase.imagesToDelete, []string{tags[0]}, []string{tags[1]}, testCase.minKeep)
+
+		if len(errs) != testCase.expectedViolations {
+			t.Errorf("Expected %d violations in test case %d, but got %q", testCase.expectedViolations, i, errs)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	extensionsv1beta1 "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+// WorkloadScanner finds out the images used by a kind of workload that the
+// controller does not know about on its own, such as the objects of a custom
+// resource, so that they are also considered in use.
+type WorkloadScanner interface {
+	// Name of the workloads, such as `rollouts`, used in logs and errors.
+	Name() string
+
+	// ScanImages returns the image references used by the workloads from the
+	// given namespaces.
+	ScanImages(kubeClient KubernetesClient, namespace []*string) ([]string, error)
+}
+
+// CustomWorkload is a custom resource whose objects run pods.
+type CustomWorkload struct {
+	Group   string
+	Version string
+	Plural  string
+}
+
+// RolloutWorkload is the `Rollout` resource of Argo Rollouts.
+var RolloutWorkload = CustomWorkload{Group: "argoproj.io", Version: "v1alpha1", Plural: "rollouts"}
+
+// ParseCustomWorkload parses the given custom resource, given as
+// `<plural>.<version>.<group>`, such as `rollouts.v1alpha1.argoproj.io`.
+func ParseCustomWorkload(value string) (CustomWorkload, error) {
+	parts := strings.SplitN(strings.TrimSpace(value), ".", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return CustomWorkload{}, fmt.Errorf("Invalid custom workload '%s', must be given as <plural>.<version>.<group>", value)
+	}
+
+	return CustomWorkload{Group: parts[2], Version: parts[1], Plural: parts[0]}, nil
+}
+
+// ParseCustomWorkloads parses the given comma-separated list of custom
+// resources, as per `ParseCustomWorkload`.
+func ParseCustomWorkloads(value string) ([]CustomWorkload, error) {
+	workloads := []CustomWorkload{}
+
+	for _, entry := range ParseCommaSeparatedList(value) {
+		workload, err := ParseCustomWorkload(*entry)
+		if err != nil {
+			return nil, err
+		}
+		workloads = append(workloads, workload)
+	}
+
+	return workloads, nil
+}
+
+// String returns the workload as `<plural>.<version>.<group>`.
+func (w CustomWorkload) String() string {
+	return w.Plural + "." + w.Version + "." + w.Group
+}
+
+// Path returns the API server path under which the objects of the workload
+// are listed in the given namespace.
+func (w CustomWorkload) Path(namespace string) string {
+	return "/apis/" + w.Group + "/" + w.Version + "/namespaces/" + namespace + "/" + w.Plural
+}
+
+// ImagesFromUnstructuredList returns the image references found in the given
+// JSON list of objects of any kind, as returned by the API server. These are
+// the images of every container list found anywhere in the objects, such as
+// the ones of the pod template of a `Rollout`, so that custom resources can
+// be scanned without knowing their schema.
+func ImagesFromUnstructuredList(data []byte) ([]string, error) {
+	list := struct {
+		Items []interface{} `json:"items"`
+	}{}
+
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("Cannot parse object list: %v", err)
+	}
+
+	images := []string{}
+	for _, item := range list.Items {
+		images = appendUnstructuredImages(images, item)
+	}
+
+	return images, nil
+}
+
+// appendUnstructuredImages appends the images of the container lists found
+// in the given unstructured value to the given images.
+func appendUnstructuredImages(images []string, value interface{}) []string {
+	switch value := value.(type) {
+	case []interface{}:
+		for _, item := range value {
+			images = appendUnstructuredImages(images, item)
+		}
+
+	case map[string]interface{}:
+		// Sorted, so that images are listed in the same order every time
+		keys := []string{}
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if key == "initContainers" || key == "containers" || key == "ephemeralContainers" {
+				images = append(images, unstructuredContainerImages(value[key])...)
+				continue
+			}
+			images = appendUnstructuredImages(images, value[key])
+		}
+	}
+
+	return images
+}
+
+// unstructuredContainerImages returns the images of the given unstructured
+// container list.
+func unstructuredContainerImages(value interface{}) []string {
+	images := []string{}
+
+	containers, _ := value.([]interface{})
+	for _, container := range containers {
+		fields, _ := container.(map[string]interface{})
+		if image, ok := fields["image"].(string); ok && image != "" {
+			images = append(images, image)
+		}
+	}
+
+	return images
+}
+
+// CustomWorkloadScanner finds out the images used by the objects of a custom
+// resource, as per `ImagesFromUnstructuredList`.
+type CustomWorkloadScanner struct {
+	Workload CustomWorkload
+}
+
+// Name returns the custom resource being scanned.
+func (s *CustomWorkloadScanner) Name() string {
+	return s.Workload.String()
+}
+
+// ScanImages returns the image references used by the objects of the custom
+// resource from the given namespaces.
+func (s *CustomWorkloadScanner) ScanImages(kubeClient KubernetesClient, namespace []*string) ([]string, error) {
+	return kubeClient.ListCustomWorkloadImages(s.Workload, namespace)
+}
+
+// RolloutScanner finds out the images used by Argo Rollouts, which are the
+// ones of the pod template of each `Rollout`, as well as the ones of the
+// replica sets owned by them, which hold the previous steps and revisions
+// that aborts and rollbacks go back to.
+type RolloutScanner struct{}
+
+// Name returns the plural name of the `Rollout` resource.
+func (s *RolloutScanner) Name() string {
+	return RolloutWorkload.Plural
+}
+
+// ScanImages returns the image references used by the rollouts from the given
+// namespaces, and by the replica sets they own.
+func (s *RolloutScanner) ScanImages(kubeClient KubernetesClient, namespace []*string) ([]string, error) {
+	images, err := kubeClient.ListCustomWorkloadImages(RolloutWorkload, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	replicaSets, err := kubeClient.ListReplicaSets(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list replica sets: %v", err)
+	}
+
+	return append(images, ImageReferencesFromReplicaSets(RolloutReplicaSets(replicaSets))...), nil
+}
+
+// RolloutReplicaSets returns the given replica sets that are owned by a
+// `Rollout`.
+func RolloutReplicaSets(replicaSets []*extensionsv1beta1.ReplicaSet) []*extensionsv1beta1.ReplicaSet {
+	owned := []*extensionsv1beta1.ReplicaSet{}
+
+	for _, replicaSet := range replicaSets {
+		for _, owner := range replicaSet.OwnerReferences {
+			if owner.Kind == "Rollout" && strings.HasPrefix(owner.APIVersion, RolloutWorkload.Group+"/") {
+				owned = append(owned, replicaSet)
+				break
+			}
+		}
+	}
+
+	return owned
+}
+
+// workloadScanners returns the scanners of the workloads whose images are
+// considered in use, besides the ones the controller knows about on its own.
+func (t *CleanupTask) workloadScanners() []WorkloadScanner {
+	scanners := []WorkloadScanner{}
+
+	if t.UseRolloutImages {
+		scanners = append(scanners, &RolloutScanner{})
+	}
+
+	if t.UseHelmReleaseImages {
+		scanners = append(scanners, &HelmReleaseScanner{})
+	}
+
+	for _, workload := range t.CustomWorkloads {
+		scanners = append(scanners, &CustomWorkloadScanner{Workload: workload})
+	}
+
+	if len(t.GitOpsRepositories) > 0 {
+		scanners = append(scanners, &GitOpsScanner{Repositories: t.GitOpsRepositories, Client: t.GitClient})
+	}
+
+	return append(scanners, t.WorkloadScanners...)
+}
@@ -0,0 +1,172 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/pkg/api/v1"
+	extensionsv1beta1 "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+func TestParseCustomWorkloads(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected []CustomWorkload
+		err      bool
+	}{
+		{value: "", expected: []CustomWorkload{}},
+		{value: "rollouts.v1alpha1.argoproj.io", expected: []CustomWorkload{RolloutWorkload}},
+		{
+			value: "workflows.v1alpha1.argoproj.io, services.v1.serving.knative.dev",
+			expected: []CustomWorkload{
+				{Group: "argoproj.io", Version: "v1alpha1", Plural: "workflows"},
+				{Group: "serving.knative.dev", Version: "v1", Plural: "services"},
+			},
+		},
+		{value: "rollouts", err: true},
+		{value: "rollouts.v1alpha1", err: true},
+		{value: "rollouts..argoproj.io", err: true},
+	}
+
+	for i, testCase := range testCases {
+		actual, err := ParseCustomWorkloads(testCase.value)
+		if (err != nil) != testCase.err {
+			t.Errorf("Test case %d: expected error to be %t, but got %v", i, testCase.err, err)
+			continue
+		}
+
+		if !testCase.err && !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("Test case %d: expected result to be %+v, but was %+v", i, testCase.expected, actual)
+		}
+	}
+
+	if path := RolloutWorkload.Path("namespace"); path != "/apis/argoproj.io/v1alpha1/namespaces/namespace/rollouts" {
+		t.Errorf("Expected path of rollouts to be the one they are listed under, but was %s", path)
+	}
+}
+
+func TestImagesFromUnstructuredList(t *testing.T) {
+	data := []byte(`{
+		"items": [
+			{"kind": "Rollout", "spec": {"template": {"spec": {"initContainers": [{"image": "repo-1:init"}], "containers": [{"name": "app", "image": "repo-1:tag-1"}, {"name": "no-image"}]}}}},
+			{"kind": "Workflow", "spec": {"templates": [{"container": {"image": "ignored"}}, {"podSpecPatch": "", "steps": [{"spec": {"containers": [{"image": "repo-2:tag-1"}]}}]}]}},
+			{"kind": "Empty"}
+		]
+	}`)
+
+	expected := []string{"repo-1:tag-1", "repo-1:init", "repo-2:tag-1"}
+	actual, err := ImagesFromUnstructuredList(data)
+
+	if err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected result to be %+v, but was %+v", expected, actual)
+	}
+
+	if _, err := ImagesFromUnstructuredList([]byte("not json")); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+}
+
+func TestRolloutScannerScanImages(t *testing.T) {
+	namespace := "namespace"
+
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		listCustomWorkloadImagesResult: map[string][]string{
+			RolloutWorkload.String(): {"repo-1:tag-3"},
+		},
+		listReplicaSetsResult: []*extensionsv1beta1.ReplicaSet{
+			// Previous step of a rollout, kept for aborts
+			{
+				ObjectMeta: v1.ObjectMeta{OwnerReferences: []v1.OwnerReference{{APIVersion: "argoproj.io/v1alpha1", Kind: "Rollout"}}},
+				Spec:       extensionsv1beta1.ReplicaSetSpec{Template: newTestPodTemplate("", "repo-1:tag-2")},
+			},
+
+			// Owned by a deployment
+			{
+				ObjectMeta: v1.ObjectMeta{OwnerReferences: []v1.OwnerReference{{APIVersion: "extensions/v1beta1", Kind: "Deployment"}}},
+				Spec:       extensionsv1beta1.ReplicaSetSpec{Template: newTestPodTemplate("", "repo-1:tag-1")},
+			},
+		},
+	}
+
+	expected := []string{"repo-1:tag-3", "repo-1:tag-2"}
+	actual, err := (&RolloutScanner{}).ScanImages(kubeClient, []*string{&namespace})
+
+	if err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected result to be %+v, but was %+v", expected, actual)
+	}
+
+	kubeClient.listCustomWorkloadImagesError = fmt.Errorf("the server could not find the requested resource")
+	if _, err := (&RolloutScanner{}).ScanImages(kubeClient, []*string{&namespace}); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+}
+
+// mockWorkloadScanner is a workload scanner returning the given images, or
+// the given error.
+type mockWorkloadScanner struct {
+	scanImagesResult []string
+	scanImagesError  error
+}
+
+func (m *mockWorkloadScanner) Name() string {
+	return "mock workloads"
+}
+
+func (m *mockWorkloadScanner) ScanImages(kubeClient KubernetesClient, namespace []*string) ([]string, error) {
+	return m.scanImagesResult, m.scanImagesError
+}
+
+func TestRemoveOldImagesWithWorkloadScannerError(t *testing.T) {
+	namespace := "namespace"
+	kubeClient := &mockKubeClient{
+		t: t,
+
+		expectedNamespace: []string{namespace},
+		listAllPodsResult: []*v1.Pod{
+			{},
+		},
+	}
+
+	task := &CleanupTask{
+		KubeNamespaces:   []*string{&namespace},
+		WorkloadScanners: []WorkloadScanner{&mockWorkloadScanner{scanImagesError: fmt.Errorf("")}},
+	}
+
+	errs := task.RemoveOldImages(kubeClient, nil)
+
+	if len(errs) != 1 {
+		t.Errorf("Expected errors to contain 1 element, but it contains %d", len(errs))
+	}
+}
+
+func TestWorkloadScanners(t *testing.T) {
+	embedded := &mockWorkloadScanner{}
+
+	task := &CleanupTask{
+		UseRolloutImages:   true,
+		CustomWorkloads:    []CustomWorkload{{Group: "argoproj.io", Version: "v1alpha1", Plural: "workflows"}},
+		GitOpsRepositories: []GitRepository{{URL: "https://github.com/org/deploy.git"}},
+		WorkloadScanners:   []WorkloadScanner{embedded},
+	}
+
+	names := []string{}
+	for _, scanner := range task.workloadScanners() {
+		names = append(names, scanner.Name())
+	}
+
+	expected := []string{"rollouts", "workflows.v1alpha1.argoproj.io", "GitOps repos", "mock workloads"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected scanners to be %+v, but were %+v", expected, names)
+	}
+}